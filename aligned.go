@@ -0,0 +1,224 @@
+package qcow2
+
+import (
+	"io"
+	"math"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// alignedFile lets an image run on a host file that only accepts I/O whose
+// offset, length and buffer address are multiples of a block size, such as
+// a file opened with O_DIRECT. Requests that are already aligned pass
+// straight through; the rest go through an aligned bounce buffer, with
+// partial blocks read, modified and written back.
+//
+// Writes that end in a partial block past the end of the file leave the
+// file padded to the block size, so alignedFile keeps the logical size the
+// image expects, reports it from Stat, and trims the padding on Close.
+type alignedFile struct {
+	File
+	block int64
+
+	mu     sync.Mutex // Serializes read-modify-write of partial blocks
+	size   int64      // Logical file size, -1 until first needed
+	padded bool       // Data may extend past size
+}
+
+// alignedFdFile is an alignedFile over a file with a descriptor, which hole
+// punching and mmap need.
+type alignedFdFile struct {
+	*alignedFile
+	fd fdFile
+}
+
+func (f *alignedFdFile) Fd() uintptr {
+	return f.fd.Fd()
+}
+
+// newAlignedFile wraps f so it accepts unaligned I/O. block must be a power
+// of two.
+func newAlignedFile(f File, block int) File {
+	af := &alignedFile{File: f, block: int64(block), size: -1}
+	if fd, ok := f.(fdFile); ok {
+		return &alignedFdFile{alignedFile: af, fd: fd}
+	}
+	return af
+}
+
+// isAligned reports whether p can be passed to the host file as is for I/O
+// at off.
+func (f *alignedFile) isAligned(p []byte, off int64) bool {
+	mask := f.block - 1
+	if off&mask != 0 || int64(len(p))&mask != 0 {
+		return false
+	}
+	return len(p) == 0 || int64(uintptr(unsafe.Pointer(&p[0])))&mask == 0
+}
+
+// bounceBuffer returns n bytes of zeroed memory aligned to the block size.
+func (f *alignedFile) bounceBuffer(n int64) []byte {
+	buf := make([]byte, n+f.block)
+	skip := (f.block - int64(uintptr(unsafe.Pointer(&buf[0])))&(f.block-1)) & (f.block - 1)
+	return buf[skip : skip+n : skip+n]
+}
+
+// sizeLocked returns the logical file size, loading it on first use.
+func (f *alignedFile) sizeLocked() (int64, error) {
+	if f.size < 0 {
+		info, err := f.File.Stat()
+		if err != nil {
+			return 0, err
+		}
+		f.size = info.Size()
+		if info.Mode()&os.ModeDevice != 0 {
+			// A device has no logical end to keep; reads stop at its end
+			f.size = math.MaxInt64
+		}
+	}
+	return f.size, nil
+}
+
+// readBlocks reads the aligned range [start, start+len(buf)) into buf.
+// Blocks past the end of the host file are left zero.
+func (f *alignedFile) readBlocks(buf []byte, start int64) error {
+	_, err := f.File.ReadAt(buf, start)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (f *alignedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	size, err := f.sizeLocked()
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// Stop at the logical end rather than reading the padding
+	want := p
+	if off >= size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-off {
+		want = p[:size-off]
+	}
+
+	var n int
+	if f.isAligned(want, off) {
+		n, err = f.File.ReadAt(want, off)
+	} else {
+		start := off &^ (f.block - 1)
+		end := (off + int64(len(want)) + f.block - 1) &^ (f.block - 1)
+		buf := f.bounceBuffer(end - start)
+		if err = f.readBlocks(buf, start); err == nil {
+			n = copy(want, buf[off-start:])
+		}
+	}
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *alignedFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.isAligned(p, off) {
+		n, err := f.File.WriteAt(p, off)
+		f.mu.Lock()
+		if size, serr := f.sizeLocked(); serr == nil && off+int64(n) > size {
+			f.size = off + int64(n)
+		}
+		f.mu.Unlock()
+		return n, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size, err := f.sizeLocked()
+	if err != nil {
+		return 0, err
+	}
+
+	start := off &^ (f.block - 1)
+	end := (off + int64(len(p)) + f.block - 1) &^ (f.block - 1)
+	buf := f.bounceBuffer(end - start)
+
+	// Only the partial blocks at either edge need their old contents
+	if off != start {
+		if err := f.readBlocks(buf[:f.block], start); err != nil {
+			return 0, err
+		}
+	}
+	if tail := end - f.block; off+int64(len(p)) != end && (tail != start || off == start) {
+		if err := f.readBlocks(buf[tail-start:], tail); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+
+	written, err := f.File.WriteAt(buf, start)
+	n := int(min(max(int64(written)-(off-start), 0), int64(len(p))))
+	if off+int64(n) > size {
+		f.size = off + int64(n)
+	}
+	if start+int64(written) > f.size {
+		f.padded = true
+	}
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (f *alignedFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.size = size
+	f.padded = false
+	return nil
+}
+
+func (f *alignedFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size, err := f.sizeLocked()
+	if err != nil {
+		return nil, err
+	}
+	return sizedFileInfo{FileInfo: info, size: size}, nil
+}
+
+// Close trims any block padding past the logical end before closing.
+func (f *alignedFile) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.padded {
+		err = f.File.Truncate(f.size)
+		f.padded = false
+	}
+	f.mu.Unlock()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sizedFileInfo is an os.FileInfo reporting a different size.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedFileInfo) Size() int64 {
+	return fi.size
+}
@@ -0,0 +1,185 @@
+// aligned_test.go - Aligned I/O layer tests
+
+package qcow2
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// strictFile rejects I/O that is not aligned to block, like a file opened
+// with O_DIRECT.
+type strictFile struct {
+	File
+	block int64
+}
+
+func (f *strictFile) check(p []byte, off int64) error {
+	mask := f.block - 1
+	if off&mask != 0 || int64(len(p))&mask != 0 ||
+		(len(p) > 0 && int64(uintptr(unsafe.Pointer(&p[0])))&mask != 0) {
+		return fmt.Errorf("unaligned I/O at %d+%d: %w", off, len(p), syscall.EINVAL)
+	}
+	return nil
+}
+
+func (f *strictFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(p, off); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *strictFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check(p, off); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// TestAlignedFile checks random unaligned I/O against an in-memory model.
+func TestAlignedFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "aligned.bin")
+	osf, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newAlignedFile(&strictFile{File: osf, block: 512}, 512)
+
+	rng := rand.New(rand.NewSource(1))
+	var model []byte
+	for i := 0; i < 500; i++ {
+		off := rng.Int63n(16 * 1024)
+		n := rng.Intn(3000)
+		switch rng.Intn(3) {
+		case 0:
+			data := testutil.RandomBytes(int64(i), n)
+			if _, err := f.WriteAt(data, off); err != nil {
+				t.Fatalf("WriteAt(%d, %d): %v", off, n, err)
+			}
+			if end := off + int64(n); end > int64(len(model)) && n > 0 {
+				model = append(model, make([]byte, end-int64(len(model)))...)
+			}
+			copy(model[off:], data)
+		case 1:
+			got := make([]byte, n)
+			m, err := f.ReadAt(got, off)
+			want := []byte{}
+			if off < int64(len(model)) {
+				want = model[off:min(off+int64(n), int64(len(model)))]
+			}
+			if m != len(want) || !bytes.Equal(got[:m], want) {
+				t.Fatalf("ReadAt(%d, %d) = %d, %v; data mismatch", off, n, m, err)
+			}
+			if m < n && err == nil {
+				t.Fatalf("short ReadAt(%d, %d) returned no error", off, n)
+			}
+		case 2:
+			if rng.Intn(10) == 0 {
+				size := rng.Int63n(20 * 1024)
+				if err := f.Truncate(size); err != nil {
+					t.Fatalf("Truncate(%d): %v", size, err)
+				}
+				if size < int64(len(model)) {
+					model = model[:size]
+				} else {
+					model = append(model, make([]byte, size-int64(len(model)))...)
+				}
+			}
+		}
+
+		info, err := f.Stat()
+		if err != nil || info.Size() != int64(len(model)) {
+			t.Fatalf("Stat size = %d, %v; want %d", info.Size(), err, len(model))
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	onDisk, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onDisk, model) {
+		t.Errorf("file on disk (%d bytes) does not match model (%d bytes)", len(onDisk), len(model))
+	}
+}
+
+// TestWithAlignedIO runs an image over a file that rejects unaligned I/O.
+func TestWithAlignedIO(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "direct.qcow2")
+	img, err := Create(path, CreateOptions{Size: 4 * 1024 * 1024, ClusterBits: 12})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithAlignedIO(4096), WithFileWrapper(func(f File) File {
+		return &strictFile{File: f, block: 4096}
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	want := make([]byte, 64*1024)
+	writes := []struct{ off, n int }{
+		{100, 7000},
+		{4096, 4096},
+		{20000, 1},
+		{30000, 25000},
+	}
+	for i, w := range writes {
+		data := testutil.RandomBytes(int64(i), w.n)
+		if _, err := img.WriteAt(data, int64(w.off)); err != nil {
+			t.Fatalf("WriteAt(%d, %d) failed: %v", w.off, w.n, err)
+		}
+		copy(want[w.off:], data)
+	}
+	img.SetCompressionLevel(CompressionDefault)
+	comp := bytes.Repeat([]byte("compress me "), 4096/12+1)[:4096]
+	if _, err := img.WriteAtCompressed(comp, 56*1024); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	copy(want[56*1024:], comp)
+
+	got := make([]byte, len(want))
+	if _, err := img.ReadAt(got[3:], 3); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got[3:], want[3:]) {
+		t.Error("data mismatch through aligned layer")
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt after reopen failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch after reopen")
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean: %+v", result)
+	}
+}
@@ -0,0 +1,65 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// growSectorSize is the unit auto-grown virtual sizes are rounded up to,
+// since qemu only handles disks of whole 512-byte sectors.
+const growSectorSize = 512
+
+// autoGrowFor grows the virtual size so a write of length bytes at off
+// fits, as far as the WithAutoGrow limit allows. Writes still beyond the
+// new end are clamped as usual.
+func (img *Image) autoGrowFor(off int64, length int) error {
+	if img.autoGrow == 0 || off < 0 || length == 0 {
+		return nil
+	}
+	end := uint64(off) + uint64(length)
+	if end <= uint64(img.Size()) {
+		return nil
+	}
+	end = (end + growSectorSize - 1) &^ (growSectorSize - 1)
+	end = min(end, img.autoGrow)
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	return img.growVirtualSizeLocked(end)
+}
+
+// growVirtualSizeLocked raises the virtual size to size. The L1 table is
+// grown to cover it first, so a crash in between leaves the old size with
+// a larger table, which is valid. The caller holds writeMu.
+func (img *Image) growVirtualSizeLocked(size uint64) error {
+	if size <= img.header.Size {
+		return nil
+	}
+	// Persistent bitmaps are sized for the old disk
+	if img.hasBitmaps() {
+		return fmt.Errorf("qcow2: cannot grow an image with persistent bitmaps")
+	}
+
+	l2Coverage := img.clusterSize * img.l2Entries
+	if err := img.growL1TableLocked((size + l2Coverage - 1) / l2Coverage); err != nil {
+		return err
+	}
+	if img.header.HasRawExternalData() {
+		if err := img.ensureDataFileSize(size); err != nil {
+			return fmt.Errorf("qcow2: failed to grow external data file: %w", err)
+		}
+	}
+
+	var field [8]byte
+	binary.BigEndian.PutUint64(field[:], size)
+	if _, err := img.file.WriteAt(field[:], 24); err != nil {
+		return fmt.Errorf("qcow2: failed to update virtual size: %w", err)
+	}
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: virtual size barrier failed: %w", err)
+	}
+	atomic.StoreUint64(&img.header.Size, size)
+	img.dirty.Store(true)
+	return nil
+}
@@ -0,0 +1,95 @@
+// autogrow_test.go - Auto-grow on write tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestAutoGrowAppend builds an image by appending to a tiny one and checks
+// the result survives a reopen.
+func TestAutoGrowAppend(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "grow.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 512, AutoGrow: 64 * 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	data := testutil.RandomBytes(7, 600*1000+123)
+	const chunk = 100 * 1000
+	for off := 0; off < len(data); off += chunk {
+		end := min(off+chunk, len(data))
+		if n, err := img.WriteAt(data[off:end], int64(off)); err != nil || n != end-off {
+			t.Fatalf("WriteAt(%d) = %d, %v", off, n, err)
+		}
+	}
+	want := int64(len(data)+511) &^ 511
+	if img.Size() != want {
+		t.Errorf("Size() = %d, want %d", img.Size(), want)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if img.Size() != want {
+		t.Errorf("Size() after reopen = %d, want %d", img.Size(), want)
+	}
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("appended data mismatch after reopen")
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("grown image not clean: %+v", result)
+	}
+}
+
+// TestAutoGrowLimit checks growth stops at the limit and that images
+// without the option still reject writes past the end.
+func TestAutoGrowLimit(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "grow.qcow2")
+
+	img, err := CreateSimple(path, 64*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte{1}, 64*1024); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("write past the end without auto-grow = %v, want ErrOffsetOutOfRange", err)
+	}
+	img.Close()
+
+	const limit = 1024 * 1024
+	img, err = Open(path, WithAutoGrow(limit))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	n, err := img.WriteAt(make([]byte, 200), limit-100)
+	if !errors.Is(err, ErrShortWrite) || n != 100 {
+		t.Errorf("write across the limit = %d, %v; want 100, ErrShortWrite", n, err)
+	}
+	if img.Size() != limit {
+		t.Errorf("Size() = %d, want %d", img.Size(), limit)
+	}
+	if _, err := img.WriteAt([]byte{1}, limit); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("write past the limit = %v, want ErrOffsetOutOfRange", err)
+	}
+}
@@ -59,40 +59,72 @@ func (img *Image) openBackingFile() error {
 		backingFormat = img.extensions.BackingFormat
 	}
 
-	// Open backing file based on format
-	switch backingFormat {
+	opts := []Option{WithMaxVirtualSize(img.maxVirtualSize)}
+	if img.keyProvider != nil {
+		opts = append(opts, WithKeyProvider(img.keyProvider))
+	}
+	if img.forensic != nil {
+		opts = append(opts, withForensic(img.forensic))
+	}
+	open := func() (BackingStore, error) {
+		return openBackingStore(backingPath, backingFormat, img.chainDepth+1, opts...)
+	}
+	store, err := open()
+	if err != nil {
+		return err
+	}
+	if backing, ok := store.(*Image); ok {
+		stats := backing.OpenStats()
+		img.openStats.BackingStats = &stats
+	}
+	if img.backingRetry != nil {
+		img.backing = newRetryingBacking(store, open, *img.backingRetry)
+	} else {
+		img.backing = store
+	}
+
+	return nil
+}
+
+// openBackingStore opens the backing file at path in the given format.
+// depth is the chain depth of the backing file itself; opts apply to qcow2
+// backing files.
+func openBackingStore(path, format string, depth int, opts ...Option) (BackingStore, error) {
+	switch format {
 	case "raw":
 		// Open as raw image
-		f, err := os.OpenFile(backingPath, os.O_RDONLY, 0)
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
 		if err != nil {
-			return fmt.Errorf("qcow2: failed to open raw backing file %q: %w", backingPath, err)
+			return nil, fmt.Errorf("qcow2: failed to open raw backing file %q: %w", path, err)
 		}
-		img.backing = &RawImage{file: f}
+		return &RawImage{file: f}, nil
 
 	case "qcow2", "":
 		// Open as qcow2 (default if format not specified)
-		// Pass depth+1 to track backing chain depth
-		backing, err := openFileWithDepth(backingPath, os.O_RDONLY, 0, img.chainDepth+1)
+		backing, err := openFileWithDepth(path, os.O_RDONLY, 0, depth, opts...)
 		if err != nil {
-			return fmt.Errorf("qcow2: failed to open backing file %q: %w", backingPath, err)
+			return nil, fmt.Errorf("qcow2: failed to open backing file %q: %w", path, err)
 		}
-		img.backing = backing
+		return backing, nil
 
 	default:
-		return fmt.Errorf("qcow2: unsupported backing file format %q", backingFormat)
+		return nil, fmt.Errorf("qcow2: unsupported backing file format %q", format)
 	}
-
-	return nil
 }
 
 // BackingFile returns the path to the backing file, or empty string if none.
 func (img *Image) BackingFile() string {
-	if img.header.BackingFileOffset == 0 || img.header.BackingFileSize == 0 {
+	return img.backingFileName(img.header)
+}
+
+// backingFileName reads the backing file name header points at.
+func (img *Image) backingFileName(header *Header) string {
+	if header.BackingFileOffset == 0 || header.BackingFileSize == 0 {
 		return ""
 	}
 
-	pathBuf := make([]byte, img.header.BackingFileSize)
-	_, err := img.file.ReadAt(pathBuf, int64(img.header.BackingFileOffset))
+	pathBuf := make([]byte, header.BackingFileSize)
+	_, err := img.file.ReadAt(pathBuf, int64(header.BackingFileOffset))
 	if err != nil {
 		return ""
 	}
@@ -111,6 +143,10 @@ func (img *Image) BackingChainDepth() int {
 	depth := 0
 	current := img.backing
 	for current != nil {
+		if r, ok := current.(*retryingBacking); ok {
+			current = r.current()
+			continue
+		}
 		depth++
 		// Only qcow2 images can have further backing files
 		if qcow2Img, ok := current.(*Image); ok {
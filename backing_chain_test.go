@@ -612,3 +612,121 @@ func TestBackingChainAbsolutePath(t *testing.T) {
 		t.Error("Data mismatch from backing file")
 	}
 }
+
+// countingBacking is a BackingStore of a fixed byte pattern that counts reads.
+type countingBacking struct {
+	reads int
+}
+
+func (c *countingBacking) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	for i := range p {
+		p[i] = 0xbb
+	}
+	return len(p), nil
+}
+
+func (c *countingBacking) Close() error { return nil }
+
+// TestBackingChainFullClusterWriteSkipsCopy verifies a write covering a whole
+// cluster allocates it without reading the backing data it replaces, while a
+// partial write still merges with the backing cluster.
+func TestBackingChainFullClusterWriteSkipsCopy(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "overlay.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	backing := &countingBacking{}
+	img, err = Open(path, WithBackingStore(backing))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	cs := img.ClusterSize()
+
+	full := testutil.RandomBytes(1, cs)
+	if _, err := img.WriteAt(full, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if backing.reads != 0 {
+		t.Errorf("full cluster write read the backing file %d times", backing.reads)
+	}
+
+	partial := testutil.RandomBytes(2, 100)
+	if _, err := img.WriteAt(partial, int64(cs)+10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if backing.reads != 1 {
+		t.Errorf("partial write read the backing file %d times, want 1", backing.reads)
+	}
+
+	want := append([]byte(nil), full...)
+	want = append(want, bytes.Repeat([]byte{0xbb}, cs)...)
+	copy(want[cs+10:], partial)
+	got := make([]byte, 2*cs)
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch")
+	}
+}
+
+// TestBackingChainRunWriteBatchesBackingReads verifies an unaligned write
+// across several unallocated clusters reads the backing data of its partial
+// edge clusters in one go and allocates the run contiguously.
+func TestBackingChainRunWriteBatchesBackingReads(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "overlay.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	backing := &countingBacking{}
+	img, err = Open(path, WithBackingStore(backing))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	cs := img.ClusterSize()
+
+	// Covers half of cluster 1, all of clusters 2-3 and half of cluster 4
+	data := testutil.RandomBytes(3, 3*cs)
+	off := int64(cs + cs/2)
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if backing.reads > 2 {
+		t.Errorf("run write read the backing file %d times, want at most 2", backing.reads)
+	}
+
+	first, err := img.translate(uint64(cs))
+	if err != nil {
+		t.Fatalf("translate failed: %v", err)
+	}
+	for i := 2; i <= 4; i++ {
+		info, err := img.translate(uint64(i * cs))
+		if err != nil {
+			t.Fatalf("translate failed: %v", err)
+		}
+		if info.physOff != first.physOff+uint64((i-1)*cs) {
+			t.Errorf("cluster %d at %#x, want contiguous run from %#x", i, info.physOff, first.physOff)
+		}
+	}
+
+	want := bytes.Repeat([]byte{0xbb}, 6*cs)
+	copy(want[off:], data)
+	got := make([]byte, 6*cs)
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch")
+	}
+}
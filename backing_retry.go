@@ -0,0 +1,119 @@
+package qcow2
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Defaults for BackingRetryPolicy backoff.
+const (
+	defaultBackingRetryBackoff    = 10 * time.Millisecond
+	defaultBackingRetryMaxBackoff = time.Second
+)
+
+// BackingRetryPolicy controls how an image recovers from failed reads of its
+// backing file, such as a backing file on network storage that disappears
+// for a moment. After a failed read the backing file is closed and reopened
+// by path, and the read is retried, with exponential backoff in between.
+type BackingRetryPolicy struct {
+	// MaxRetries is the number of times a failed read is retried.
+	// 0 disables retrying.
+	MaxRetries int
+
+	// InitialBackoff is the wait before the first retry (default 10ms). It
+	// doubles after every retry, up to MaxBackoff (default 1s).
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// OnRetry, if set, is called before each retry with the attempt number
+	// (starting at 1) and the error that caused it. Returning false gives
+	// up and fails the read with that error.
+	OnRetry func(attempt int, err error) bool
+}
+
+// retryingBacking is a BackingStore that retries failed reads according to a
+// BackingRetryPolicy, reopening the underlying store between attempts.
+type retryingBacking struct {
+	policy BackingRetryPolicy
+	open   func() (BackingStore, error)
+
+	mu      sync.RWMutex
+	store   BackingStore // nil while the backing file cannot be reopened
+	openErr error        // why store is nil
+	closed  bool
+}
+
+func newRetryingBacking(store BackingStore, open func() (BackingStore, error), policy BackingRetryPolicy) *retryingBacking {
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaultBackingRetryBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultBackingRetryMaxBackoff
+	}
+	return &retryingBacking{policy: policy, open: open, store: store}
+}
+
+// current returns the store reads go to, or nil if reopening it failed.
+func (r *retryingBacking) current() BackingStore {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.store
+}
+
+// ReadAt implements io.ReaderAt. io.EOF is passed through without retrying,
+// since it marks the end of a backing file shorter than the image.
+func (r *retryingBacking) ReadAt(p []byte, off int64) (int, error) {
+	backoff := r.policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		r.mu.RLock()
+		store, openErr, closed := r.store, r.openErr, r.closed
+		r.mu.RUnlock()
+		if closed {
+			return 0, os.ErrClosed
+		}
+
+		n, err := 0, openErr
+		if store != nil {
+			n, err = store.ReadAt(p, off)
+		}
+		if err == nil || err == io.EOF || attempt > r.policy.MaxRetries {
+			return n, err
+		}
+		if r.policy.OnRetry != nil && !r.policy.OnRetry(attempt, err) {
+			return n, err
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, r.policy.MaxBackoff)
+		r.reopen(store)
+	}
+}
+
+// reopen replaces failed with a freshly opened store, unless another reader
+// already did.
+func (r *retryingBacking) reopen(failed BackingStore) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.store != failed {
+		return
+	}
+	if r.store != nil {
+		// The store is being replaced because it failed; its close error
+		// says nothing new
+		_ = r.store.Close()
+	}
+	r.store, r.openErr = r.open()
+}
+
+// Close implements io.Closer.
+func (r *retryingBacking) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.store == nil {
+		return nil
+	}
+	return r.store.Close()
+}
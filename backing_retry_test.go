@@ -0,0 +1,121 @@
+// backing_retry_test.go - Backing file retry/reopen tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// createRetryChain creates base.qcow2 holding data at offset 0 and an empty
+// overlay on top of it, and returns the overlay and base paths.
+func createRetryChain(t *testing.T, data []byte) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+
+	base, err := CreateSimple(basePath, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := base.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	base.Close()
+
+	overlay, err := Create(overlayPath, CreateOptions{Size: 4 * 1024 * 1024, BackingFile: "base.qcow2"})
+	if err != nil {
+		t.Fatalf("Create overlay failed: %v", err)
+	}
+	overlay.Close()
+	return overlayPath, basePath
+}
+
+// TestBackingRetryReopens verifies a read survives the backing file going
+// away and coming back between retries.
+func TestBackingRetryReopens(t *testing.T) {
+	t.Parallel()
+	data := testutil.RandomBytes(1, 4096)
+	overlayPath, basePath := createRetryChain(t, data)
+	movedPath := basePath + ".moved"
+
+	var attempts []int
+	img, err := Open(overlayPath, WithBackingRetry(BackingRetryPolicy{
+		MaxRetries:     5,
+		InitialBackoff: time.Millisecond,
+		OnRetry: func(attempt int, err error) bool {
+			attempts = append(attempts, attempt)
+			if attempt == 2 {
+				// The file is back for the second reopen
+				if err := os.Rename(movedPath, basePath); err != nil {
+					t.Errorf("Rename failed: %v", err)
+				}
+			}
+			return true
+		},
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if depth := img.BackingChainDepth(); depth != 1 {
+		t.Errorf("BackingChainDepth = %d, want 1", depth)
+	}
+
+	// Lose the backing file: the open handle fails and a reopen cannot find it
+	if err := os.Rename(basePath, movedPath); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	img.backing.(*retryingBacking).current().Close()
+
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data mismatch after reopen")
+	}
+	if len(attempts) != 2 {
+		t.Errorf("OnRetry called for attempts %v, want [1 2]", attempts)
+	}
+}
+
+// TestBackingRetryGivesUp verifies reads fail with the last error once the
+// retries run out.
+func TestBackingRetryGivesUp(t *testing.T) {
+	t.Parallel()
+	overlayPath, basePath := createRetryChain(t, testutil.RandomBytes(2, 4096))
+
+	calls := 0
+	img, err := Open(overlayPath, WithBackingRetry(BackingRetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+		OnRetry: func(attempt int, err error) bool {
+			calls++
+			return true
+		},
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	if err := os.Remove(basePath); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	img.backing.(*retryingBacking).current().Close()
+
+	if _, err := img.ReadAt(make([]byte, 512), 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadAt error = %v, want ErrNotExist", err)
+	}
+	if calls != 2 {
+		t.Errorf("OnRetry called %d times, want 2", calls)
+	}
+}
@@ -1,7 +1,9 @@
 package qcow2
 
 import (
+	"fmt"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -301,3 +303,411 @@ func BenchmarkCOWRead(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkReadAt1MUnallocated benchmarks large reads of never-written space
+func BenchmarkReadAt1MUnallocated(b *testing.B) {
+	const imageSize = 1024 * 1024 * 1024 // 1GB sparse
+	const readSize = 1024 * 1024
+
+	img := setupBenchImage(b, imageSize, false)
+	defer img.Close()
+
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64((i * readSize) % (imageSize - readSize))
+		if _, err := img.ReadAt(buf, off); err != nil {
+			b.Fatalf("ReadAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkReadAt1MZero benchmarks large reads of zero clusters
+func BenchmarkReadAt1MZero(b *testing.B) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+	const readSize = 1024 * 1024
+
+	img := setupBenchImage(b, imageSize, false)
+	defer img.Close()
+	if err := img.WriteZeroAt(0, imageSize); err != nil {
+		b.Fatalf("WriteZeroAt failed: %v", err)
+	}
+
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64((i * readSize) % (imageSize - readSize))
+		if _, err := img.ReadAt(buf, off); err != nil {
+			b.Fatalf("ReadAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkReadCompressed benchmarks 64KB reads of compressed clusters
+// cycling through more clusters than the decompressed cache holds
+func BenchmarkReadCompressed(b *testing.B) {
+	benchmarkReadCompressed(b, 4*1024*1024)
+}
+
+// BenchmarkReadCompressedCached benchmarks 64KB reads of compressed clusters
+// that stay in the decompressed cache
+func BenchmarkReadCompressedCached(b *testing.B) {
+	benchmarkReadCompressed(b, 64*1024)
+}
+
+func benchmarkReadCompressed(b *testing.B, imageSize int64) {
+	const readSize = 64 * 1024
+
+	img := setupBenchImage(b, uint64(imageSize), false)
+	defer img.Close()
+	img.SetWriteBarrierMode(BarrierNone)
+	data := make([]byte, readSize)
+	for i := range data {
+		data[i] = byte(i / 64)
+	}
+	for off := int64(0); off < imageSize; off += readSize {
+		if _, err := img.WriteAtCompressed(data, off); err != nil {
+			b.Fatalf("WriteAtCompressed failed: %v", err)
+		}
+	}
+
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := (int64(i) * readSize) % imageSize
+		if _, err := img.ReadAt(buf, off); err != nil {
+			b.Fatalf("ReadAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkAllocate64K benchmarks cluster-sized writes that always allocate
+// a new cluster (and periodically a new L2 table)
+func BenchmarkAllocate64K(b *testing.B) {
+	const imageSize = 1024 * 1024 * 1024 // 1GB
+	const writeSize = 64 * 1024
+
+	img := setupBenchImage(b, imageSize, false)
+	img.SetWriteBarrierMode(BarrierNone)
+	defer func() { img.Close() }()
+
+	buf := make([]byte, writeSize)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	b.SetBytes(writeSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	off := int64(0)
+	for i := 0; i < b.N; i++ {
+		if off+writeSize > imageSize {
+			// Start over on a fresh image so every write keeps allocating
+			b.StopTimer()
+			img.Close()
+			img = setupBenchImage(b, imageSize, false)
+			img.SetWriteBarrierMode(BarrierNone)
+			off = 0
+			b.StartTimer()
+		}
+		if _, err := img.WriteAt(buf, off); err != nil {
+			b.Fatalf("WriteAt failed: %v", err)
+		}
+		off += writeSize
+	}
+}
+
+// BenchmarkWriteCompressed benchmarks compressed cluster writes
+func BenchmarkWriteCompressed(b *testing.B) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+	const writeSize = 64 * 1024
+
+	img := setupBenchImage(b, imageSize, false)
+	img.SetWriteBarrierMode(BarrierNone)
+	defer img.Close()
+
+	buf := make([]byte, writeSize)
+	for i := range buf {
+		buf[i] = byte(i / 64)
+	}
+	b.SetBytes(writeSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64((i * writeSize) % imageSize)
+		if _, err := img.WriteAtCompressed(buf, off); err != nil {
+			b.Fatalf("WriteAtCompressed failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkWriteCompressedIncompressible benchmarks compressed writes of
+// random data, which end up stored uncompressed
+func BenchmarkWriteCompressedIncompressible(b *testing.B) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+	const writeSize = 64 * 1024
+
+	img := setupBenchImage(b, imageSize, false)
+	img.SetWriteBarrierMode(BarrierNone)
+	img.SetCompressionLevel(CompressionDefault)
+	defer img.Close()
+
+	buf := make([]byte, writeSize)
+	rand.New(rand.NewSource(1)).Read(buf)
+	b.SetBytes(writeSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64((i * writeSize) % imageSize)
+		if _, err := img.WriteAt(buf, off); err != nil {
+			b.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkBackingChainRead benchmarks 64KB reads that fall through four
+// overlays to the base image
+func BenchmarkBackingChainRead(b *testing.B) {
+	const imageSize = 16 * 1024 * 1024 // 16MB
+	const readSize = 64 * 1024
+	const depth = 4
+
+	dir := b.TempDir()
+	path := filepath.Join(dir, "base.qcow2")
+	base, err := CreateSimple(path, imageSize)
+	if err != nil {
+		b.Fatalf("Create base failed: %v", err)
+	}
+	data := make([]byte, imageSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := base.WriteAt(data, 0); err != nil {
+		b.Fatalf("Write base failed: %v", err)
+	}
+	base.Close()
+
+	for i := 0; i < depth; i++ {
+		overlayPath := filepath.Join(dir, fmt.Sprintf("overlay%d.qcow2", i))
+		overlay, err := CreateOverlay(overlayPath, path)
+		if err != nil {
+			b.Fatalf("Create overlay failed: %v", err)
+		}
+		overlay.Close()
+		path = overlayPath
+	}
+
+	img, err := Open(path)
+	if err != nil {
+		b.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64((i * readSize) % imageSize)
+		if _, err := img.ReadAt(buf, off); err != nil {
+			b.Fatalf("ReadAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkReadRandom4KReadOnly and BenchmarkReadRandom4KMmap compare random
+// 4KB reads of a read-only image with and without WithMmap
+func BenchmarkReadRandom4KReadOnly(b *testing.B) {
+	benchmarkReadRandom4KReadOnly(b)
+}
+
+func BenchmarkReadRandom4KMmap(b *testing.B) {
+	benchmarkReadRandom4KReadOnly(b, WithMmap())
+}
+
+func benchmarkReadRandom4KReadOnly(b *testing.B, opts ...Option) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+	const readSize = 4096
+
+	img := setupBenchImage(b, imageSize, true)
+	path := img.file.Name()
+	img.Close()
+
+	img, err := OpenFile(path, os.O_RDONLY, 0, opts...)
+	if err != nil {
+		b.Fatalf("OpenFile failed: %v", err)
+	}
+	defer img.Close()
+
+	rng := rand.New(rand.NewSource(42))
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64(rng.Intn(imageSize - readSize))
+		if _, err := img.ReadAt(buf, off); err != nil {
+			b.Fatalf("ReadAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkReadAtSnapshot4K measures random 4KB reads through a snapshot,
+// as a backup tool reading a point-in-time view would issue
+func BenchmarkReadAtSnapshot4K(b *testing.B) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+	const readSize = 4096
+
+	img := setupBenchImage(b, imageSize, true)
+	defer img.Close()
+	snap, err := img.CreateSnapshot("bench")
+	if err != nil {
+		b.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	buf := make([]byte, readSize)
+	b.SetBytes(readSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64(rng.Intn(imageSize - readSize))
+		if _, err := img.ReadAtSnapshot(buf, off, snap); err != nil {
+			b.Fatalf("ReadAtSnapshot failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkWriteOverlay1M measures large sequential writes onto a fresh
+// overlay, where every cluster written is first allocated in the overlay.
+// Barriers are off to measure the copy-on-write work rather than fsync
+// latency.
+func BenchmarkWriteOverlay1M(b *testing.B) {
+	benchmarkWriteOverlay1M(b, 0, BarrierNone)
+}
+
+// BenchmarkWriteOverlay1MUnaligned writes off cluster boundaries with the
+// default barriers, so both edge clusters of each write need the backing
+// data and every allocation pays for its barriers
+func BenchmarkWriteOverlay1MUnaligned(b *testing.B) {
+	benchmarkWriteOverlay1M(b, 4096, BarrierMetadata)
+}
+
+func benchmarkWriteOverlay1M(b *testing.B, shift int64, mode WriteBarrierMode) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+	const writeSize = 1024 * 1024
+
+	dir := b.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	base, err := CreateSimple(basePath, imageSize)
+	if err != nil {
+		b.Fatalf("Create base failed: %v", err)
+	}
+	data := make([]byte, imageSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := base.WriteAt(data, 0); err != nil {
+		b.Fatalf("Write base failed: %v", err)
+	}
+	base.Close()
+
+	var overlay *Image
+	newOverlay := func(n int) {
+		if overlay != nil {
+			overlay.Close()
+		}
+		overlay, err = CreateOverlay(filepath.Join(dir, fmt.Sprintf("overlay%d.qcow2", n)), basePath)
+		if err != nil {
+			b.Fatalf("Create overlay failed: %v", err)
+		}
+		overlay.SetWriteBarrierMode(mode)
+	}
+	newOverlay(0)
+	defer func() { overlay.Close() }()
+
+	buf := data[:writeSize]
+	b.SetBytes(writeSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		off := int64(i*writeSize) % (imageSize - writeSize)
+		if off == 0 && i > 0 {
+			b.StopTimer()
+			newOverlay(i)
+			b.StartTimer()
+		}
+		if _, err := overlay.WriteAt(buf, off+shift); err != nil {
+			b.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkIsZeroBuffer benchmarks zero detection of a 1MB all-zero buffer
+// against a byte loop, for several zero buffer sizes
+func BenchmarkIsZeroBuffer(b *testing.B) {
+	data := make([]byte, 1024*1024)
+	b.Run("ByteLoop", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			for _, c := range data {
+				if c != 0 {
+					b.Fatal("not zero")
+				}
+			}
+		}
+	})
+	defer SetZeroBufferSize(0)
+	for _, size := range []int{4096, DefaultZeroBufferSize, 1024 * 1024} {
+		b.Run(fmt.Sprintf("Buffer%dK", size/1024), func(b *testing.B) {
+			SetZeroBufferSize(size)
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if !isZeroBuffer(data) {
+					b.Fatal("not zero")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSparseWriterZeros benchmarks streaming an all-zero disk through
+// a SparseWriter, which checks every cluster for zeros
+func BenchmarkSparseWriterZeros(b *testing.B) {
+	const imageSize = 64 * 1024 * 1024 // 64MB
+
+	img := setupBenchImage(b, imageSize, false)
+	defer img.Close()
+
+	buf := make([]byte, 1024*1024)
+	b.SetBytes(imageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		w := NewSparseWriter(img, 0)
+		for off := 0; off < imageSize; off += len(buf) {
+			if _, err := w.Write(buf); err != nil {
+				b.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			b.Fatalf("Close failed: %v", err)
+		}
+	}
+}
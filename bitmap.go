@@ -45,6 +45,11 @@ func (b *freeClusterBitmap) setFree(clusterIdx uint64) {
 	wordIdx := clusterIdx / 64
 	bitIdx := clusterIdx % 64
 	b.words[wordIdx] |= 1 << bitIdx
+
+	// Keep findFree returning the lowest free cluster
+	if wordIdx < b.hintWord {
+		b.hintWord = wordIdx
+	}
 }
 
 // setUsed marks a cluster as used (not available for allocation).
@@ -139,6 +144,50 @@ func (b *freeClusterBitmap) findFree() (uint64, bool) {
 	return 0, false
 }
 
+// findBestFit finds the first cluster of the shortest run of free clusters
+// and marks it used. A run reaching the end of the bitmap counts as longer
+// than any other, and ties go to the lowest run.
+func (b *freeClusterBitmap) findBestFit() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var bestStart, bestLen, runStart, runLen uint64
+	endRun := func(length uint64) {
+		if runLen > 0 && (bestLen == 0 || length < bestLen) {
+			bestStart, bestLen = runStart, length
+		}
+		runLen = 0
+	}
+	for idx := b.minCluster; idx < b.numClusters && bestLen != 1; {
+		w := b.words[idx/64] >> (idx % 64)
+		if w == 0 {
+			endRun(runLen)
+			idx = (idx/64 + 1) * 64
+			continue
+		}
+		if zeros := uint64(bits.TrailingZeros64(w)); zeros > 0 {
+			endRun(runLen)
+			idx += zeros
+			continue
+		}
+		n := min(uint64(bits.TrailingZeros64(^w)), 64-idx%64, b.numClusters-idx)
+		if runLen == 0 {
+			runStart = idx
+		}
+		runLen += n
+		idx += n
+	}
+	if bestLen != 1 {
+		endRun(^uint64(0))
+	}
+	if bestLen == 0 {
+		return 0, false
+	}
+
+	b.words[bestStart/64] &^= 1 << (bestStart % 64)
+	return bestStart, true
+}
+
 // isFree checks if a cluster is marked as free.
 func (b *freeClusterBitmap) isFree(clusterIdx uint64) bool {
 	b.mu.RLock()
@@ -250,3 +250,49 @@ func TestFreeClusterBitmapEdgeCases(t *testing.T) {
 		t.Error("Should not find more free clusters")
 	}
 }
+
+func TestFreeClusterBitmapBestFit(t *testing.T) {
+	t.Parallel()
+
+	b := newFreeClusterBitmap(293, 4)
+
+	// Runs of 3 at 10, 1 at 70, 2 at 130 and 290 to the end, which counts as longest
+	for _, idx := range []uint64{10, 11, 12, 70, 130, 131, 290, 291, 292} {
+		b.setFree(idx)
+	}
+	for i, want := range []uint64{70, 130, 131, 10, 11, 12, 290} {
+		got, found := b.findBestFit()
+		if !found || got != want {
+			t.Errorf("findBestFit %d: got %d (found=%v), want %d", i, got, found, want)
+		}
+	}
+
+	// A run spanning words is measured as one
+	b.setFree(60)
+	for idx := uint64(62); idx < 68; idx++ {
+		b.setFree(idx)
+	}
+	if got, _ := b.findBestFit(); got != 60 {
+		t.Errorf("findBestFit: got %d, want 60", got)
+	}
+	if got, _ := b.findBestFit(); got != 62 {
+		t.Errorf("findBestFit: got %d, want 62", got)
+	}
+}
+
+func TestFreeClusterBitmapFirstFitAfterFree(t *testing.T) {
+	t.Parallel()
+
+	b := newFreeClusterBitmap(1000, 4)
+	b.setFree(900)
+	if got, _ := b.findFree(); got != 900 {
+		t.Fatalf("findFree: got %d, want 900", got)
+	}
+
+	// A cluster freed below the last one found is reused first
+	b.setFree(950)
+	b.setFree(20)
+	if got, _ := b.findFree(); got != 20 {
+		t.Errorf("findFree: got %d, want 20", got)
+	}
+}
@@ -0,0 +1,248 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// blockDeviceFile lets an image live on a host block device, such as an LVM
+// logical volume. A device has a fixed size and cannot be truncated, so the
+// image's notion of file size is kept here as an end-of-allocated-space
+// marker: Stat reports it and Truncate moves it. Growing past the end of
+// the device fails with ErrDeviceFull.
+//
+// Space exposed by growing is zeroed, as it would read on a regular file;
+// the device may hold stale data there.
+type blockDeviceFile struct {
+	File
+	capacity int64 // Size of the device
+
+	mu  sync.Mutex
+	end int64 // End of allocated space
+}
+
+// blockDeviceFdFile is a blockDeviceFile over a file with a descriptor,
+// which hole punching and mmap need.
+type blockDeviceFdFile struct {
+	*blockDeviceFile
+	fd fdFile
+}
+
+func (f *blockDeviceFdFile) Fd() uintptr {
+	return f.fd.Fd()
+}
+
+// newBlockDeviceFile wraps f, a block device of the given capacity. The
+// whole device counts as allocated until setEnd is called.
+func newBlockDeviceFile(f File, capacity int64) (File, *blockDeviceFile) {
+	bf := &blockDeviceFile{File: f, capacity: capacity, end: capacity}
+	if fd, ok := f.(fdFile); ok {
+		return &blockDeviceFdFile{blockDeviceFile: bf, fd: fd}, bf
+	}
+	return bf, bf
+}
+
+// blockDeviceSize returns the size of f if it is a block device.
+func blockDeviceSize(f *os.File) (int64, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	if !isBlockDevice(info) {
+		return 0, false, nil
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false, fmt.Errorf("qcow2: failed to get size of block device %q: %w", f.Name(), err)
+	}
+	if size <= 0 {
+		return 0, false, fmt.Errorf("qcow2: cannot determine size of block device %q", f.Name())
+	}
+	return size, true, nil
+}
+
+// createHostFile creates the file at path for a new image. An existing
+// block device at path is opened for writing instead, and device is true.
+func createHostFile(path string) (f *os.File, device bool, err error) {
+	if info, err := os.Stat(path); err == nil && isBlockDevice(info) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		return f, true, err
+	}
+	f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	return f, false, err
+}
+
+// isBlockDevice reports whether info describes a block device.
+func isBlockDevice(info os.FileInfo) bool {
+	return info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+// zeroDeviceStart zeroes the first size bytes of the block device f, where
+// a new image's header and tables go.
+func zeroDeviceStart(f *os.File, size int64) error {
+	capacity, _, err := blockDeviceSize(f)
+	if err != nil {
+		return err
+	}
+	if size > capacity {
+		return fmt.Errorf("%w: image needs %d bytes, device has %d", ErrDeviceFull, size, capacity)
+	}
+	bf := &blockDeviceFile{File: f, capacity: capacity}
+	return bf.zeroLocked(0, size)
+}
+
+// openHostFile prepares an opened image or data file for use: it applies
+// the file wrapper and, for block devices, the end-of-allocation tracking.
+// The returned *blockDeviceFile is nil for regular files.
+func openHostFile(f *os.File, wrap func(File) File) (File, *blockDeviceFile, error) {
+	var file File = f
+	if wrap != nil {
+		file = wrap(f)
+	}
+	capacity, ok, err := blockDeviceSize(f)
+	if err != nil || !ok {
+		return file, nil, err
+	}
+	file, bf := newBlockDeviceFile(file, capacity)
+	return file, bf, nil
+}
+
+// setEnd sets the end-of-allocated-space marker.
+func (f *blockDeviceFile) setEnd(end int64) {
+	f.mu.Lock()
+	f.end = min(end, f.capacity)
+	f.mu.Unlock()
+}
+
+func (f *blockDeviceFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return sizedFileInfo{FileInfo: info, size: f.end}, nil
+}
+
+func (f *blockDeviceFile) Truncate(size int64) error {
+	if size > f.capacity {
+		return fmt.Errorf("%w: cannot grow to %d bytes on a %d byte device",
+			ErrDeviceFull, size, f.capacity)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size > f.end {
+		if err := f.zeroLocked(f.end, size); err != nil {
+			return err
+		}
+	}
+	f.end = size
+	return nil
+}
+
+// zeroLocked zeroes [start, end) on the device.
+func (f *blockDeviceFile) zeroLocked(start, end int64) error {
+	zeros := make([]byte, min(end-start, 1<<20))
+	for off := start; off < end; {
+		n := min(end-off, int64(len(zeros)))
+		if _, err := f.File.WriteAt(zeros[:n], off); err != nil {
+			return fmt.Errorf("qcow2: failed to zero block device at 0x%x: %w", off, err)
+		}
+		off += n
+	}
+	return nil
+}
+
+// allocatedEnd returns the end of the host space in use by the image: the
+// highest cluster with a nonzero refcount, or anything referenced from the
+// header, L1 or L2 tables (of the image or any snapshot) beyond it. The
+// tables are scanned as well because compressed data and, with lazy
+// refcounts, recent allocations are not covered by the refcounts.
+func (img *Image) allocatedEnd() (uint64, error) {
+	end := img.clusterSize // Header
+	extend := func(off, size uint64) {
+		end = max(end, off+size)
+	}
+
+	if err := img.loadRefcountTable(); err != nil {
+		return 0, err
+	}
+	if err := img.faultAllL1(); err != nil {
+		return 0, err
+	}
+	extend(img.header.RefcountTableOffset, uint64(img.header.RefcountTableClusters)*img.clusterSize)
+	refcountBits := img.header.RefcountBits()
+	entriesPerBlock := img.clusterSize * 8 / uint64(refcountBits)
+	block := make([]byte, img.clusterSize)
+	for i := 0; i+8 <= len(img.refcountTable); i += 8 {
+		blockOff := binary.BigEndian.Uint64(img.refcountTable[i:]) &^ img.offsetMask
+		if blockOff == 0 {
+			continue
+		}
+		extend(blockOff, img.clusterSize)
+		if _, err := img.file.ReadAt(block, int64(blockOff)); err != nil {
+			return 0, fmt.Errorf("qcow2: failed to read refcount block: %w", err)
+		}
+		for j := entriesPerBlock; j > 0; j-- {
+			if readRefcountEntry(block, j-1, refcountBits) != 0 {
+				cluster := uint64(i/8)*entriesPerBlock + j - 1
+				extend(cluster<<img.clusterBits, img.clusterSize)
+				break
+			}
+		}
+	}
+
+	// Data clusters in an external data file take no space here
+	external := img.header.HasExternalDataFile()
+	l2Table := make([]byte, img.clusterSize)
+	scanL1 := func(l1Table []byte) error {
+		for i := 0; i+8 <= len(l1Table); i += 8 {
+			l2Off := binary.BigEndian.Uint64(l1Table[i:]) & L1EntryOffsetMask
+			if l2Off == 0 {
+				continue
+			}
+			extend(l2Off, img.clusterSize)
+			if _, err := img.file.ReadAt(l2Table, int64(l2Off)); err != nil {
+				return fmt.Errorf("qcow2: failed to read L2 table: %w", err)
+			}
+			for j := 0; j+int(img.l2EntrySize) <= len(l2Table); j += int(img.l2EntrySize) {
+				entry := binary.BigEndian.Uint64(l2Table[j:])
+				if entry&L2EntryCompressed != 0 {
+					off, size := img.parseCompressedL2Entry(entry)
+					extend(off, size)
+				} else if off := entry & L2EntryOffsetMask; off != 0 && !external {
+					extend(off, img.clusterSize)
+				}
+			}
+		}
+		return nil
+	}
+
+	extend(img.header.L1TableOffset, uint64(img.header.L1Size)*8)
+	img.l1Mu.RLock()
+	err := scanL1(img.l1Table)
+	img.l1Mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := img.loadSnapshots(); err != nil {
+		return 0, err
+	}
+	for _, snap := range img.snapshots {
+		extend(snap.L1TableOffset, uint64(snap.L1Size)*8)
+		l1Table, err := img.snapshotL1Table(snap)
+		if err != nil {
+			return 0, err
+		}
+		if err := scanL1(l1Table); err != nil {
+			return 0, err
+		}
+	}
+
+	// Whole clusters, so the next allocation starts on a fresh one
+	return (end + img.offsetMask) &^ img.offsetMask, nil
+}
@@ -0,0 +1,104 @@
+// blockdev_test.go - Block device host file tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestBlockDeviceFile verifies the end-of-allocation marker over a file
+// standing in for a 1 MiB device full of stale data.
+func TestBlockDeviceFile(t *testing.T) {
+	t.Parallel()
+	const capacity = 1 << 20
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{0xaa}, capacity), 0644); err != nil {
+		t.Fatal(err)
+	}
+	osf, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, bf := newBlockDeviceFile(osf, capacity)
+	defer f.Close()
+
+	if _, ok := f.(fdFile); !ok {
+		t.Error("descriptor not passed through")
+	}
+	bf.setEnd(4096)
+	if info, err := f.Stat(); err != nil || info.Size() != 4096 {
+		t.Fatalf("Stat size = %v, %v; want 4096", info.Size(), err)
+	}
+
+	if err := f.Truncate(3*4096 + 100); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	got := make([]byte, 4096+4096)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got[4095] != 0xaa {
+		t.Error("data below the old end was zeroed")
+	}
+	if !bytes.Equal(got[4096:], make([]byte, 4096)) {
+		t.Error("space exposed by growing was not zeroed")
+	}
+
+	if err := f.Truncate(capacity + 1); !errors.Is(err, ErrDeviceFull) {
+		t.Errorf("growing past the device: got %v, want ErrDeviceFull", err)
+	}
+	if info, _ := f.Stat(); info.Size() != 3*4096+100 {
+		t.Errorf("failed growth moved the end to %d", info.Size())
+	}
+}
+
+// TestAllocatedEnd verifies the end found from metadata matches the file
+// size, including compressed data, which has no refcounts.
+func TestAllocatedEnd(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "end.qcow2")
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	cs := int64(img.ClusterSize())
+
+	check := func(what string) {
+		t.Helper()
+		info, err := img.file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := (uint64(info.Size()) + img.offsetMask) &^ img.offsetMask
+		got, err := img.allocatedEnd()
+		if err != nil {
+			t.Fatalf("allocatedEnd failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("%s: allocatedEnd = 0x%x, want 0x%x", what, got, want)
+		}
+	}
+
+	check("new image")
+	if _, err := img.WriteAt(testutil.RandomBytes(1, int(3*cs)), 5*cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	check("after writes")
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	check("after snapshot")
+
+	img.SetCompressionLevel(CompressionDefault)
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte("z"), int(cs)), 9*cs); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	check("after compressed write")
+}
@@ -5,8 +5,11 @@ package qcow2
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -687,3 +690,101 @@ func TestAlignedVsUnalignedWrites(t *testing.T) {
 		t.Error("Unaligned data mismatch")
 	}
 }
+
+// TestCreateAllClusterSizes tests every cluster size the spec allows, from
+// 512 bytes to 2MB. Small clusters in particular need more than one refcount
+// block for the initial metadata and more than one refcount table cluster.
+func TestCreateAllClusterSizes(t *testing.T) {
+	t.Parallel()
+
+	for bits := uint32(MinClusterBits); bits <= MaxClusterBits; bits++ {
+		bits := bits
+		t.Run(fmt.Sprintf("bits=%d", bits), func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "image.qcow2")
+
+			img, err := Create(path, CreateOptions{Size: 64 * 1024 * 1024, ClusterBits: bits})
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			cs := int(img.ClusterSize())
+			if cs != 1<<bits {
+				t.Fatalf("ClusterSize = %d, want %d", cs, 1<<bits)
+			}
+
+			// 8MB covers thousands of refcount blocks with 512-byte clusters
+			data := bytes.Repeat([]byte{byte(bits), 0x5a}, 4*1024*1024)
+			if _, err := img.WriteAt(data, 0); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+			compressible := bytes.Repeat([]byte("qcow"), cs/4)
+			compOff := int64(32 * 1024 * 1024)
+			if _, err := img.WriteAtCompressed(compressible, compOff); err != nil {
+				t.Fatalf("WriteAtCompressed failed: %v", err)
+			}
+
+			result, err := img.Check()
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if result.Corruptions > 0 || result.Leaks > 0 {
+				t.Errorf("Check found %d corruptions, %d leaks: %v", result.Corruptions, result.Leaks, result.Errors)
+			}
+			if err := img.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			img, err = Open(path)
+			if err != nil {
+				t.Fatalf("Reopen failed: %v", err)
+			}
+			defer img.Close()
+
+			buf := make([]byte, len(data))
+			if _, err := img.ReadAt(buf, 0); err != nil {
+				t.Fatalf("ReadAt failed: %v", err)
+			}
+			if !bytes.Equal(buf, data) {
+				t.Error("Data mismatch after reopen")
+			}
+			if _, err := img.ReadAt(buf[:cs], compOff); err != nil {
+				t.Fatalf("ReadAt compressed failed: %v", err)
+			}
+			if !bytes.Equal(buf[:cs], compressible) {
+				t.Error("Compressed data mismatch after reopen")
+			}
+		})
+	}
+}
+
+// TestCreateRejectsInvalidClusterCombinations tests cluster sizes that are
+// valid on their own but cannot describe the requested image.
+func TestCreateRejectsInvalidClusterCombinations(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		opts CreateOptions
+	}{
+		{"bits_too_small", CreateOptions{Size: 1024 * 1024, ClusterBits: MinClusterBits - 1}},
+		{"bits_too_large", CreateOptions{Size: 1024 * 1024, ClusterBits: MaxClusterBits + 1}},
+		// 512-byte clusters map 32KB per L1 entry: 2TB needs a 512MB L1 table
+		{"l1_too_large", CreateOptions{Size: 2 << 40, ClusterBits: 9}},
+		// Header plus backing file name must fit in cluster 0
+		{"header_overflow", CreateOptions{Size: 1024 * 1024, ClusterBits: 9, BackingFile: strings.Repeat("b", 512)}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image.qcow2")
+			img, err := Create(path, tc.opts)
+			if err == nil {
+				img.Close()
+				t.Fatal("Create should fail")
+			}
+			if !errors.Is(err, ErrInvalidClusterBits) {
+				t.Errorf("error = %v, want ErrInvalidClusterBits", err)
+			}
+		})
+	}
+}
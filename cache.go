@@ -12,15 +12,14 @@ const defaultL2CacheShards = 8
 // l2Cache is a sharded LRU cache for L2 tables.
 // Uses multiple independent shards to reduce lock contention under concurrent access.
 // Each shard maintains its own LRU list and lock.
+//
+// Lookups only take a shard's read lock, so concurrent reads of cached
+// tables do not serialize. Instead of moving a hit to the front of the list
+// they set its referenced bit, and eviction gives referenced entries a
+// second chance (CLOCK), which approximates LRU.
 type l2Cache struct {
 	shards    []*l2CacheShard
 	shardMask uint64 // shardCount - 1 for fast modulo
-
-	// Statistics (atomic for lock-free access)
-	hits       atomic.Uint64
-	misses     atomic.Uint64
-	evictions  atomic.Uint64
-	insertions atomic.Uint64
 }
 
 // l2CacheShard is a single shard of the L2 cache.
@@ -31,6 +30,13 @@ type l2CacheShard struct {
 	head    *cacheEntry // Most recently used
 	tail    *cacheEntry // Least recently used
 	maxSize int
+
+	// Statistics, kept per shard so readers on different shards do not
+	// contend on shared counters
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	evictions  atomic.Uint64
+	insertions atomic.Uint64
 }
 
 type cacheEntry struct {
@@ -38,6 +44,9 @@ type cacheEntry struct {
 	data   []byte
 	prev   *cacheEntry
 	next   *cacheEntry
+
+	// Set by lookups under the read lock, cleared by eviction
+	referenced atomic.Bool
 }
 
 // newL2Cache creates a new L2 table cache with sharding.
@@ -66,9 +75,10 @@ func newL2CacheWithShards(maxSize, shardCount int) *l2Cache {
 		shardCount = v + 1
 	}
 
-	// Distribute maxSize across shards (minimum 1 per shard)
-	perShard := maxSize / shardCount
-	if perShard < 1 {
+	// Distribute maxSize across shards (minimum 1 per shard); a maxSize of
+	// 0 disables the cache
+	perShard := max(maxSize, 0) / shardCount
+	if perShard < 1 && maxSize > 0 {
 		perShard = 1
 	}
 
@@ -98,23 +108,43 @@ func (c *l2Cache) getShard(offset uint64) *l2CacheShard {
 // Returns nil if not found.
 // Returns a copy of the cached data for thread-safety.
 func (c *l2Cache) get(offset uint64) []byte {
-	data := c.getShard(offset).get(offset)
+	shard := c.getShard(offset)
+	data := shard.get(offset)
 	if data != nil {
-		c.hits.Add(1)
+		shard.hits.Add(1)
 	} else {
-		c.misses.Add(1)
+		shard.misses.Add(1)
 	}
 	return data
 }
 
+// readAt copies len(dst) bytes starting at pos of a cached table into dst,
+// without copying the whole table. Returns false (and records nothing) on a
+// miss, so the caller can fall back to get and load the table.
+func (c *l2Cache) readAt(offset uint64, dst []byte, pos uint64) bool {
+	shard := c.getShard(offset)
+	if !shard.readAt(offset, dst, pos) {
+		return false
+	}
+	shard.hits.Add(1)
+	return true
+}
+
+// miss records a miss for a lookup done with readAt that is not followed
+// by get.
+func (c *l2Cache) miss(offset uint64) {
+	c.getShard(offset).misses.Add(1)
+}
+
 // put adds or updates an L2 table in the cache.
 func (c *l2Cache) put(offset uint64, data []byte) {
-	inserted, evicted := c.getShard(offset).put(offset, data)
+	shard := c.getShard(offset)
+	inserted, evicted := shard.put(offset, data)
 	if inserted {
-		c.insertions.Add(1)
+		shard.insertions.Add(1)
 	}
 	if evicted > 0 {
-		c.evictions.Add(uint64(evicted))
+		shard.evictions.Add(uint64(evicted))
 	}
 }
 
@@ -134,16 +164,14 @@ func (c *l2Cache) clear() {
 // Returns a copy of the cached data to avoid races when multiple goroutines
 // access the same L2 table concurrently.
 func (s *l2CacheShard) get(offset uint64) []byte {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	entry, ok := s.entries[offset]
 	if !ok {
 		return nil
 	}
-
-	// Move to front (most recently used)
-	s.moveToFront(entry)
+	entry.touch()
 
 	// Return a copy to avoid concurrent modification races.
 	// Multiple goroutines may get the same L2 table and modify different entries.
@@ -152,9 +180,26 @@ func (s *l2CacheShard) get(offset uint64) []byte {
 	return result
 }
 
+// readAt copies part of a cached table into dst under the shard read lock.
+func (s *l2CacheShard) readAt(offset uint64, dst []byte, pos uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.entries[offset]
+	if !ok {
+		return false
+	}
+	entry.touch()
+	copy(dst, entry.data[pos:])
+	return true
+}
+
 // put adds or updates an L2 table in the shard.
 // Returns (inserted, evictionCount) where inserted is true if a new entry was added.
 func (s *l2CacheShard) put(offset uint64, data []byte) (bool, int) {
+	if s.maxSize == 0 {
+		return false, 0
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -166,24 +211,26 @@ func (s *l2CacheShard) put(offset uint64, data []byte) (bool, int) {
 		return false, 0
 	}
 
-	// Create new entry
-	entry := &cacheEntry{
-		offset: offset,
-		data:   make([]byte, len(data)),
+	// Evict down to make room, recycling the last victim's buffer so a full
+	// cache inserts without allocating
+	evicted := 0
+	var entry *cacheEntry
+	for len(s.entries) >= s.maxSize && s.tail != nil {
+		entry = s.evictLRU()
+		evicted++
 	}
+
+	if entry == nil || len(entry.data) != len(data) {
+		entry = &cacheEntry{data: make([]byte, len(data))}
+	}
+	entry.offset = offset
+	entry.referenced.Store(false)
 	copy(entry.data, data)
 
 	// Add to front
 	s.addToFront(entry)
 	s.entries[offset] = entry
 
-	// Evict if necessary
-	evicted := 0
-	for len(s.entries) > s.maxSize {
-		s.evictLRU()
-		evicted++
-	}
-
 	return true, evicted
 }
 
@@ -211,6 +258,19 @@ func (s *l2CacheShard) clear() {
 	s.tail = nil
 }
 
+// bytes returns the memory held by cached entries.
+func (c *l2Cache) bytes() uint64 {
+	var total uint64
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		for _, entry := range shard.entries {
+			total += uint64(len(entry.data))
+		}
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
 // size returns the total number of entries across all shards.
 func (c *l2Cache) size() int {
 	total := 0
@@ -238,38 +298,43 @@ type CacheStats struct {
 	MaxSize int
 }
 
-// stats returns cache statistics.
+// stats returns cache statistics, summed over the shards.
 func (c *l2Cache) stats() CacheStats {
-	hits := c.hits.Load()
-	misses := c.misses.Load()
-	total := hits + misses
-	var hitRate float64
-	if total > 0 {
-		hitRate = float64(hits) / float64(total)
-	}
+	return c.takeStats(false)
+}
 
-	maxSize := 0
+// takeStats returns cache statistics like stats, resetting each counter
+// as it is read if reset is set, so no lookup goes uncounted.
+func (c *l2Cache) takeStats(reset bool) CacheStats {
+	take := func(v *atomic.Uint64) uint64 {
+		if reset {
+			return v.Swap(0)
+		}
+		return v.Load()
+	}
+	var stats CacheStats
 	for _, shard := range c.shards {
-		maxSize += shard.maxSize
+		stats.Hits += take(&shard.hits)
+		stats.Misses += take(&shard.misses)
+		stats.Insertions += take(&shard.insertions)
+		stats.Evictions += take(&shard.evictions)
+		stats.MaxSize += shard.maxSize
 	}
-
-	return CacheStats{
-		Hits:       hits,
-		Misses:     misses,
-		HitRate:    hitRate,
-		Insertions: c.insertions.Load(),
-		Evictions:  c.evictions.Load(),
-		Size:       c.size(),
-		MaxSize:    maxSize,
+	stats.Size = c.size()
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
 	}
+	return stats
 }
 
 // resetStats resets all statistics counters to zero.
 func (c *l2Cache) resetStats() {
-	c.hits.Store(0)
-	c.misses.Store(0)
-	c.insertions.Store(0)
-	c.evictions.Store(0)
+	for _, shard := range c.shards {
+		shard.hits.Store(0)
+		shard.misses.Store(0)
+		shard.insertions.Store(0)
+		shard.evictions.Store(0)
+	}
 }
 
 // size returns the number of entries in the shard.
@@ -279,6 +344,14 @@ func (s *l2CacheShard) size() int {
 	return len(s.entries)
 }
 
+// touch marks an entry as recently used. It skips the store when the bit is
+// already set so hot entries are not written on every lookup.
+func (e *cacheEntry) touch() {
+	if !e.referenced.Load() {
+		e.referenced.Store(true)
+	}
+}
+
 // moveToFront moves an entry to the front of the LRU list.
 func (s *l2CacheShard) moveToFront(entry *cacheEntry) {
 	if entry == s.head {
@@ -319,13 +392,83 @@ func (s *l2CacheShard) removeEntry(entry *cacheEntry) {
 	}
 }
 
-// evictLRU removes the least recently used entry.
-func (s *l2CacheShard) evictLRU() {
+// evictLRU removes and returns the least recently used entry. Entries
+// looked up since they last reached the tail move back to the front
+// instead, once.
+func (s *l2CacheShard) evictLRU() *cacheEntry {
 	if s.tail == nil {
-		return
+		return nil
 	}
 
 	entry := s.tail
+	for entry.referenced.Swap(false) {
+		s.moveToFront(entry)
+		entry = s.tail
+	}
 	s.removeEntry(entry)
 	delete(s.entries, entry.offset)
+	return entry
+}
+
+// dataClusterCache caches uncompressed data clusters by host offset.
+//
+// A read that misses loads the cluster from disk and then inserts it, so a
+// write landing in between could leave the old contents cached. Every
+// invalidation bumps gen, and put drops clusters loaded under an older
+// generation.
+type dataClusterCache struct {
+	mu    sync.Mutex
+	gen   uint64
+	cache *l2Cache
+}
+
+func newDataClusterCache(maxSize int, clusterSize int) *dataClusterCache {
+	return &dataClusterCache{cache: newL2Cache(maxSize, clusterSize)}
+}
+
+// generation returns the generation to pass to put for a cluster about to
+// be loaded from disk.
+func (c *dataClusterCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// readAt copies part of a cached cluster into dst, recording a miss if it
+// is not cached.
+func (c *dataClusterCache) readAt(offset uint64, dst []byte, pos uint64) bool {
+	if c.cache.readAt(offset, dst, pos) {
+		return true
+	}
+	c.cache.miss(offset)
+	return false
+}
+
+// put caches a cluster loaded from disk at generation gen, unless it has
+// been invalidated since.
+func (c *dataClusterCache) put(offset uint64, data []byte, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen == c.gen {
+		c.cache.put(offset, data)
+	}
+}
+
+// invalidate drops the clusters overlapping [offset, offset+length).
+func (c *dataClusterCache) invalidate(offset, length, clusterSize uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	start := offset &^ (clusterSize - 1)
+	for off := start; off < offset+length; off += clusterSize {
+		c.cache.invalidate(off)
+	}
+}
+
+// clear drops every cached cluster.
+func (c *dataClusterCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.cache.clear()
 }
@@ -43,6 +43,9 @@ func (img *Image) Check() (*CheckResult, error) {
 	if err := img.loadRefcountTable(); err != nil {
 		return nil, fmt.Errorf("qcow2: failed to load refcount table: %w", err)
 	}
+	if err := img.faultAllL1(); err != nil {
+		return nil, err
+	}
 
 	// Build a map of expected refcounts by scanning L1/L2 tables
 	expectedRefcounts := make(map[uint64]uint64) // cluster index -> expected refcount
@@ -75,6 +78,16 @@ func (img *Image) Check() (*CheckResult, error) {
 		expectedRefcounts[blockOffset>>img.clusterBits] = 1
 	}
 
+	// LUKS header clusters
+	if img.extensions != nil && img.extensions.EncryptionHeader != nil {
+		ext := img.extensions.EncryptionHeader
+		start := ext.Offset >> img.clusterBits
+		end := (ext.Offset + ext.Length + img.clusterSize - 1) >> img.clusterBits
+		for i := start; i < end; i++ {
+			expectedRefcounts[i] = 1
+		}
+	}
+
 	// Scan L1 table for L2 tables and data clusters
 	img.l1Mu.RLock()
 	l1Entries := uint64(img.header.L1Size)
@@ -234,7 +247,10 @@ func (img *Image) CheckWithOptions(opts CheckOptions) (*CheckResult, error) {
 		return nil, err
 	}
 
-	if opts.Repair && !result.IsClean() && !img.readOnly {
+	if opts.Repair && !result.IsClean() {
+		if img.readOnly {
+			return result, ErrReadOnly
+		}
 		return img.Repair()
 	}
 
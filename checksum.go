@@ -0,0 +1,221 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Checksum sidecar layout:
+//
+//	Offset  Size  Description
+//	0       8     Magic "QCOWCSUM"
+//	8       4     Version (1)
+//	12      4     Cluster bits of the image the sidecar belongs to
+//	16      48    Reserved
+//	64      ...   Entries, one per host cluster of the data file
+//
+// Each entry is 8 bytes: CRC-32C (Castagnoli) of the host cluster followed by
+// a flags word. An entry with the valid flag clear has no recorded checksum,
+// which is the case for clusters written before the sidecar was attached.
+const (
+	checksumMagic      = "QCOWCSUM"
+	checksumVersion    = 1
+	checksumHeaderSize = 64
+	checksumEntrySize  = 8
+	checksumFlagValid  = uint32(1) << 0
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch is matched by errors.Is for any *ChecksumError.
+var ErrChecksumMismatch = errors.New("qcow2: checksum mismatch")
+
+// ChecksumError reports a cluster whose contents no longer match the
+// checksum recorded when it was written: a data cluster checked against the
+// WithChecksumFile sidecar, or a metadata cluster checked against the
+// WithMetadataChecksumFile sidecar.
+type ChecksumError struct {
+	HostOffset uint64 // Offset of the cluster in its host file
+	Expected   uint32 // CRC-32C recorded at write time
+	Actual     uint32 // CRC-32C of the current contents
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("qcow2: checksum mismatch for cluster at 0x%x (expected %08x, got %08x)",
+		e.HostOffset, e.Expected, e.Actual)
+}
+
+// Is reports whether target is ErrChecksumMismatch.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// checksumStripes is the number of cluster lock stripes.
+const checksumStripes = 64
+
+// checksumStore is a per-cluster checksum sidecar file.
+type checksumStore struct {
+	f           *os.File
+	clusterBits uint32
+	mu          sync.Mutex
+
+	// Striped cluster locks keep a data write and its checksum update atomic
+	// with respect to other writers and verifiers of the same cluster
+	stripes [checksumStripes]sync.Mutex
+}
+
+// openChecksumStore opens (or, for writable images, creates) a sidecar.
+func openChecksumStore(path string, clusterBits uint32, readOnly bool) (*checksumStore, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to open checksum file: %w", err)
+	}
+
+	hdr := make([]byte, checksumHeaderSize)
+	n, err := f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, fmt.Errorf("qcow2: failed to read checksum header: %w", err)
+	}
+
+	if n == 0 && !readOnly {
+		// New sidecar
+		copy(hdr[0:8], checksumMagic)
+		binary.BigEndian.PutUint32(hdr[8:12], checksumVersion)
+		binary.BigEndian.PutUint32(hdr[12:16], clusterBits)
+		if _, err := f.WriteAt(hdr, 0); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("qcow2: failed to write checksum header: %w", err)
+		}
+	} else {
+		if n < checksumHeaderSize || string(hdr[0:8]) != checksumMagic {
+			f.Close()
+			return nil, fmt.Errorf("qcow2: %s is not a checksum file", path)
+		}
+		if v := binary.BigEndian.Uint32(hdr[8:12]); v != checksumVersion {
+			f.Close()
+			return nil, fmt.Errorf("qcow2: unsupported checksum file version %d", v)
+		}
+		if bits := binary.BigEndian.Uint32(hdr[12:16]); bits != clusterBits {
+			f.Close()
+			return nil, fmt.Errorf("qcow2: checksum file cluster bits %d do not match image (%d)", bits, clusterBits)
+		}
+	}
+
+	return &checksumStore{f: f, clusterBits: clusterBits}, nil
+}
+
+// clusterLock returns the lock stripe guarding the host cluster.
+func (s *checksumStore) clusterLock(hostOff uint64) *sync.Mutex {
+	return &s.stripes[(hostOff>>s.clusterBits)%checksumStripes]
+}
+
+func (s *checksumStore) entryOffset(hostOff uint64) int64 {
+	return checksumHeaderSize + int64(hostOff>>s.clusterBits)*checksumEntrySize
+}
+
+// get returns the recorded checksum for the host cluster, if any.
+func (s *checksumStore) get(hostOff uint64) (uint32, bool, error) {
+	var entry [checksumEntrySize]byte
+	s.mu.Lock()
+	_, err := s.f.ReadAt(entry[:], s.entryOffset(hostOff))
+	s.mu.Unlock()
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("qcow2: failed to read checksum: %w", err)
+	}
+	if binary.BigEndian.Uint32(entry[4:8])&checksumFlagValid == 0 {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint32(entry[0:4]), true, nil
+}
+
+// set records the checksum for the host cluster.
+func (s *checksumStore) set(hostOff uint64, sum uint32) error {
+	var entry [checksumEntrySize]byte
+	binary.BigEndian.PutUint32(entry[0:4], sum)
+	binary.BigEndian.PutUint32(entry[4:8], checksumFlagValid)
+	s.mu.Lock()
+	_, err := s.f.WriteAt(entry[:], s.entryOffset(hostOff))
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to write checksum: %w", err)
+	}
+	return nil
+}
+
+func (s *checksumStore) sync() error {
+	return s.f.Sync()
+}
+
+func (s *checksumStore) close() error {
+	return s.f.Close()
+}
+
+// updateChecksum records the checksum of the host cluster at hostOff after a
+// write. When the write covered the whole cluster, data is the full contents
+// and no read-back is needed. The caller holds the cluster lock.
+func (img *Image) updateChecksum(hostOff uint64, data []byte) error {
+	if uint64(len(data)) != img.clusterSize {
+		buf := img.getClusterBuffer()
+		defer img.putClusterBuffer(buf)
+		n, err := img.dataFile().ReadAt(buf, int64(hostOff))
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("qcow2: failed to read cluster for checksum: %w", err)
+		}
+		clear(buf[n:]) // Short read at end of file reads as zeros
+		data = buf
+	}
+	return img.checksums.set(hostOff, crc32.Checksum(data, crc32cTable))
+}
+
+// writeChecksummed writes data at physOff and records the new checksum of the
+// containing host cluster under its cluster lock.
+func (img *Image) writeChecksummed(data []byte, physOff uint64) (int, error) {
+	lock := img.checksums.clusterLock(physOff)
+	lock.Lock()
+	defer lock.Unlock()
+
+	written, err := img.dataFile().WriteAt(data, int64(physOff))
+	if err != nil {
+		return written, err
+	}
+	return written, img.updateChecksum(physOff&^img.offsetMask, data)
+}
+
+// verifyChecksum checks the host cluster at hostOff against its recorded
+// checksum. Clusters without a recorded checksum pass.
+func (img *Image) verifyChecksum(hostOff uint64) error {
+	lock := img.checksums.clusterLock(hostOff)
+	lock.Lock()
+	defer lock.Unlock()
+
+	expected, ok, err := img.checksums.get(hostOff)
+	if err != nil || !ok {
+		return err
+	}
+
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	n, err := img.dataFile().ReadAt(buf, int64(hostOff))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	clear(buf[n:])
+
+	if actual := crc32.Checksum(buf, crc32cTable); actual != expected {
+		return &ChecksumError{HostOffset: hostOff, Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// checksum_test.go - Checksum sidecar and scrub tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestChecksumRoundTrip verifies clean data passes verification across reopen.
+func TestChecksumRoundTrip(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "csum.qcow2")
+	sidecar := filepath.Join(dir, "csum.qcow2.crc")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data := testutil.RandomBytes(1, 200*1024)
+	if _, err := img.WriteAt(data, 1000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	// Partial overwrite forces a read-back checksum
+	if _, err := img.WriteAt([]byte("patch"), 70000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[70000-1000:], "patch")
+	img.Close()
+
+	img, err = OpenFile(path, os.O_RDONLY, 0, WithChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer img.Close()
+
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 1000); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data mismatch")
+	}
+
+	report, err := img.Scrub(context.Background())
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if report.ClustersChecked != 4 || len(report.Mismatches) != 0 {
+		t.Errorf("unexpected scrub report: %+v", report)
+	}
+}
+
+// TestChecksumDetectsBitRot flips a byte behind the library's back and
+// verifies both ReadAt and Scrub report it.
+func TestChecksumDetectsBitRot(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rot.qcow2")
+	sidecar := filepath.Join(dir, "rot.qcow2.crc")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0xAB}, 4096), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	info, err := img.translate(0)
+	if err != nil {
+		t.Fatalf("translate failed: %v", err)
+	}
+	img.Close()
+
+	// Corrupt one byte of the data cluster
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0x00}, int64(info.physOff)+100); err != nil {
+		t.Fatalf("corrupt write failed: %v", err)
+	}
+	f.Close()
+
+	img, err = Open(path, WithChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	buf := make([]byte, 512)
+	_, err = img.ReadAt(buf, 0)
+	var csErr *ChecksumError
+	if !errors.As(err, &csErr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ChecksumError, got %v", err)
+	}
+	if csErr.HostOffset != info.physOff {
+		t.Errorf("HostOffset = 0x%x, want 0x%x", csErr.HostOffset, info.physOff)
+	}
+
+	report, err := img.Scrub(context.Background())
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if len(report.Mismatches) != 1 {
+		t.Errorf("Scrub found %d mismatches, want 1", len(report.Mismatches))
+	}
+}
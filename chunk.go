@@ -0,0 +1,268 @@
+package qcow2
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+)
+
+// Default content-defined chunking parameters.
+const (
+	DefaultChunkMinSize = 16 * 1024
+	DefaultChunkAvgSize = 64 * 1024
+	DefaultChunkMaxSize = 256 * 1024
+)
+
+// ChunkOptions configures content-defined chunking for ExportChunks.
+// Zero values select the defaults.
+type ChunkOptions struct {
+	// MinSize is the smallest chunk emitted (except at the end of a data run).
+	MinSize int
+
+	// AvgSize is the target average chunk size.
+	AvgSize int
+
+	// MaxSize is the largest chunk emitted.
+	MaxSize int
+}
+
+// Chunk describes one content-defined chunk of the virtual disk.
+type Chunk struct {
+	Offset uint64   `json:"offset"` // Virtual offset of the chunk
+	Length uint64   `json:"length"` // Chunk length in bytes
+	Hash   [32]byte `json:"hash"`   // SHA-256 of the chunk contents
+}
+
+// ChunkIndex is the manifest produced by ExportChunks.
+// Virtual ranges not covered by any chunk read as zeros.
+type ChunkIndex struct {
+	VirtualSize uint64  `json:"virtual_size"`
+	ClusterSize uint64  `json:"cluster_size"`
+	MinSize     int     `json:"min_size"`
+	AvgSize     int     `json:"avg_size"`
+	MaxSize     int     `json:"max_size"`
+	Chunks      []Chunk `json:"chunks"`
+}
+
+// gearTable holds the 256 random values used by the FastCDC rolling hash.
+// It is generated from a fixed seed so chunk boundaries are stable across
+// runs and library versions, which is what makes the output dedup-friendly.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x2d358dccaa6c78a5)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// fastCDC implements normalized FastCDC chunk boundary detection.
+type fastCDC struct {
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64 // Stricter mask used before the average size
+	maskL   uint64 // Looser mask used after the average size
+}
+
+// newFastCDC validates the options and builds the chunker.
+func newFastCDC(opts ChunkOptions) (*fastCDC, error) {
+	if opts.MinSize == 0 {
+		opts.MinSize = DefaultChunkMinSize
+	}
+	if opts.AvgSize == 0 {
+		opts.AvgSize = DefaultChunkAvgSize
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultChunkMaxSize
+	}
+	if opts.MinSize < 64 || opts.MinSize > opts.AvgSize || opts.AvgSize > opts.MaxSize {
+		return nil, fmt.Errorf("qcow2: invalid chunk sizes (min=%d avg=%d max=%d)",
+			opts.MinSize, opts.AvgSize, opts.MaxSize)
+	}
+
+	avgBits := bits.Len(uint(opts.AvgSize)) - 1
+	return &fastCDC{
+		minSize: opts.MinSize,
+		avgSize: opts.AvgSize,
+		maxSize: opts.MaxSize,
+		maskS:   topBitsMask(avgBits + 1),
+		maskL:   topBitsMask(avgBits - 1),
+	}, nil
+}
+
+// topBitsMask returns a mask selecting the n most significant bits.
+// The high bits of the gear hash depend on the most recent input bytes.
+func topBitsMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// cut returns the length of the next chunk at the start of data.
+func (c *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// ExportChunks splits the virtual disk into content-defined chunks (FastCDC)
+// for dedup-friendly backup stores. Unallocated and zero regions are skipped
+// using the allocation map; data that falls through to a backing file is
+// included, skipping the holes of qcow2 backing images by their own maps.
+// Chunking restarts at every hole, so identical data runs produce
+// identical chunks regardless of where they sit on the disk.
+//
+// emit is called once per chunk in ascending offset order. The data slice is
+// only valid for the duration of the call. The returned index lists every
+// emitted chunk and is suitable for JSON serialization.
+func (img *Image) ExportChunks(opts ChunkOptions, emit func(c Chunk, data []byte) error) (*ChunkIndex, error) {
+	cdc, err := newFastCDC(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &ChunkIndex{
+		VirtualSize: uint64(img.Size()),
+		ClusterSize: img.clusterSize,
+		MinSize:     cdc.minSize,
+		AvgSize:     cdc.avgSize,
+		MaxSize:     cdc.maxSize,
+	}
+
+	// Collect data runs, merging data held here with data in the backing chain
+	var runs []Extent
+	err = img.walkDataExtents(0, img.Size(), func(e Extent) error {
+		if n := len(runs); n > 0 && runs[n-1].End() == e.Start {
+			runs[n-1].Length += e.Length
+		} else {
+			runs = append(runs, Extent{Start: e.Start, Length: e.Length, Type: ExtentData})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bufSize := 4 * cdc.maxSize
+	if bufSize < 1024*1024 {
+		bufSize = 1024 * 1024
+	}
+	buf := make([]byte, bufSize)
+
+	for _, run := range runs {
+		if err := img.chunkRun(cdc, run, buf, index, emit); err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// walkDataExtents calls fn for each extent of [off, off+length) that holds
+// data somewhere in the backing chain, in ascending order. Ranges that fall
+// through to a qcow2 backing image are looked up in its own map; those of
+// other backing stores, such as raw files, are reported whole.
+func (img *Image) walkDataExtents(off, length int64, fn func(Extent) error) error {
+	return img.walkExtents(off, length, func(e Extent) error {
+		switch e.Type {
+		case ExtentData:
+			return fn(e)
+		case ExtentBacking:
+			layer := img.backing
+			if r, ok := layer.(*retryingBacking); ok {
+				layer = r.current()
+			}
+			if backing, ok := layer.(*Image); ok {
+				return backing.walkDataExtents(int64(e.Start), int64(e.Length), fn)
+			}
+			return fn(Extent{Start: e.Start, Length: e.Length, Type: ExtentData})
+		}
+		return nil
+	})
+}
+
+// chunkRun chunks a single contiguous data run, refilling buf as needed.
+func (img *Image) chunkRun(cdc *fastCDC, run Extent, buf []byte, index *ChunkIndex, emit func(Chunk, []byte) error) error {
+	pos := run.Start
+	end := run.End()
+	bufStart, bufLen := 0, 0
+
+	for pos < end {
+		need := uint64(cdc.maxSize)
+		if remaining := end - pos; remaining < need {
+			need = remaining
+		}
+
+		// Make sure the window holds a full max-size chunk (or the rest of the run)
+		if uint64(bufLen) < need {
+			copy(buf, buf[bufStart:bufStart+bufLen])
+			bufStart = 0
+			fillFrom := pos + uint64(bufLen)
+			toRead := uint64(len(buf) - bufLen)
+			if remaining := end - fillFrom; remaining < toRead {
+				toRead = remaining
+			}
+			n, err := img.ReadAt(buf[bufLen:bufLen+int(toRead)], int64(fillFrom))
+			if err != nil && n < int(toRead) {
+				return fmt.Errorf("qcow2: chunk read at 0x%x failed: %w", fillFrom, err)
+			}
+			bufLen += n
+		}
+
+		window := buf[bufStart : bufStart+bufLen]
+		if len(window) > cdc.maxSize {
+			window = window[:cdc.maxSize]
+		}
+		size := cdc.cut(window)
+		data := window[:size]
+
+		c := Chunk{
+			Offset: pos,
+			Length: uint64(size),
+			Hash:   sha256.Sum256(data),
+		}
+		if emit != nil {
+			if err := emit(c, data); err != nil {
+				return err
+			}
+		}
+		index.Chunks = append(index.Chunks, c)
+
+		bufStart += size
+		bufLen -= size
+		pos += uint64(size)
+	}
+
+	return nil
+}
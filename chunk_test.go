@@ -0,0 +1,169 @@
+// chunk_test.go - Content-defined chunk export tests
+
+package qcow2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestExportChunksRoundTrip verifies chunks cover exactly the allocated data.
+func TestExportChunksRoundTrip(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "chunks.qcow2")
+
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	data := testutil.RandomBytes(1, 3*1024*1024)
+	if _, err := img.WriteAt(data, 1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(8*1024*1024, 1024*1024); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+
+	rebuilt := make([]byte, img.Size())
+	index, err := img.ExportChunks(ChunkOptions{}, func(c Chunk, chunk []byte) error {
+		if sha256.Sum256(chunk) != c.Hash {
+			t.Errorf("chunk at %d: hash mismatch", c.Offset)
+		}
+		if c.Length > DefaultChunkMaxSize {
+			t.Errorf("chunk at %d: length %d exceeds max", c.Offset, c.Length)
+		}
+		copy(rebuilt[c.Offset:], chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ExportChunks failed: %v", err)
+	}
+
+	var total uint64
+	for _, c := range index.Chunks {
+		total += c.Length
+	}
+	if total != uint64(len(data)) {
+		t.Errorf("chunks cover %d bytes, want %d", total, len(data))
+	}
+
+	expected := make([]byte, img.Size())
+	copy(expected[1024*1024:], data)
+	if !bytes.Equal(rebuilt, expected) {
+		t.Error("reassembled chunks do not match image contents")
+	}
+}
+
+// TestExportChunksShiftResistant verifies that chunk boundaries follow content,
+// so inserting bytes near the start only disturbs the first few chunks.
+func TestExportChunksShiftResistant(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	data := testutil.RandomBytes(2, 2*1024*1024)
+	hashes := func(name string, payload []byte) map[[32]byte]bool {
+		img, err := CreateSimple(filepath.Join(dir, name), 4*1024*1024)
+		if err != nil {
+			t.Fatalf("CreateSimple failed: %v", err)
+		}
+		defer img.Close()
+		if _, err := img.WriteAt(payload, 0); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		index, err := img.ExportChunks(ChunkOptions{}, nil)
+		if err != nil {
+			t.Fatalf("ExportChunks failed: %v", err)
+		}
+		set := make(map[[32]byte]bool)
+		for _, c := range index.Chunks {
+			set[c.Hash] = true
+		}
+		return set
+	}
+
+	a := hashes("a.qcow2", data)
+	b := hashes("b.qcow2", append([]byte("inserted prefix"), data...))
+
+	shared := 0
+	for h := range a {
+		if b[h] {
+			shared++
+		}
+	}
+	if shared < len(a)/2 {
+		t.Errorf("only %d of %d chunks shared after small insertion", shared, len(a))
+	}
+}
+
+// TestExportChunksInvalidOptions verifies inconsistent sizes are rejected.
+func TestExportChunksInvalidOptions(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	img, err := CreateSimple(filepath.Join(dir, "bad.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	if _, err := img.ExportChunks(ChunkOptions{MinSize: 8192, AvgSize: 4096, MaxSize: 16384}, nil); err == nil {
+		t.Error("expected error for min > avg")
+	}
+}
+
+// TestExportChunksBackingHoles verifies ranges that fall through to a qcow2
+// backing image are chunked by its map, skipping its holes.
+func TestExportChunksBackingHoles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	base, err := CreateSimple(basePath, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	baseData := testutil.RandomBytes(1, 512*1024)
+	if _, err := base.WriteAt(baseData, 2*1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	base.Close()
+
+	img, err := Create(filepath.Join(dir, "overlay.qcow2"), CreateOptions{Size: 16 * 1024 * 1024, BackingFile: "base.qcow2"})
+	if err != nil {
+		t.Fatalf("Create overlay failed: %v", err)
+	}
+	defer img.Close()
+	data := testutil.RandomBytes(2, 256*1024)
+	if _, err := img.WriteAt(data, 8*1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	rebuilt := make([]byte, img.Size())
+	index, err := img.ExportChunks(ChunkOptions{}, func(c Chunk, chunk []byte) error {
+		copy(rebuilt[c.Offset:], chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ExportChunks failed: %v", err)
+	}
+
+	var total uint64
+	for _, c := range index.Chunks {
+		total += c.Length
+	}
+	if want := uint64(len(baseData) + len(data)); total != want {
+		t.Errorf("chunks cover %d bytes, want %d", total, want)
+	}
+	expected := make([]byte, img.Size())
+	copy(expected[2*1024*1024:], baseData)
+	copy(expected[8*1024*1024:], data)
+	if !bytes.Equal(rebuilt, expected) {
+		t.Error("reassembled chunks do not match image contents")
+	}
+}
@@ -0,0 +1,217 @@
+// Command qcow2img is a qemu-img style tool for QCOW2 images:
+//
+//	qcow2img info [--output=human|json] image
+//	qcow2img check [--output=human|json] image
+//	qcow2img map [--output=human|json] image
+//	qcow2img snapshot list [--output=human|json] image
+//	qcow2img create [--profile=name] [--backing=file] image size
+//	qcow2img profiles
+//	qcow2img completion bash
+//
+// JSON output uses qemu-img's field names; see package qcow2img for the
+// schemas. As with qemu-img, check exits with status 2 if the image is
+// corrupt and 3 if it only leaks clusters.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ehrlich-b/go-qcow2"
+	"github.com/ehrlich-b/go-qcow2/qcow2img"
+)
+
+// errUsage makes main print the usage and exit with status 2.
+var errUsage = errors.New("usage")
+
+const usage = `usage: qcow2img <command> [--output=human|json] image
+
+commands:
+  info           show image information
+  check          check the image for consistency
+  map            show the allocation map
+  snapshot list  list internal snapshots
+  create         create an image: create [--profile=name] [--backing=file] image size
+  profiles       list creation profiles
+  completion bash
+                 print a bash completion script
+`
+
+func main() {
+	status, err := run(os.Args[1:], os.Stdout)
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "qcow2img: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(status)
+}
+
+// run executes one command line and returns the exit status.
+func run(args []string, out io.Writer) (int, error) {
+	if len(args) == 0 {
+		return 0, errUsage
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "completion":
+		if len(args) != 1 || args[0] != "bash" {
+			return 0, errUsage
+		}
+		_, err := io.WriteString(out, bashCompletion)
+		return 0, err
+	case "snapshot":
+		if len(args) == 0 || args[0] != "list" {
+			return 0, errUsage
+		}
+		cmd, args = "snapshot list", args[1:]
+	case "create":
+		return 0, create(args)
+	case "profiles":
+		if len(args) != 0 {
+			return 0, errUsage
+		}
+		for _, p := range qcow2.CreateProfiles() {
+			if _, err := fmt.Fprintf(out, "%-20s %s\n", p.Name, p.Description); err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	case "info", "check", "map":
+	default:
+		return 0, errUsage
+	}
+
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	output := fs.String("output", "human", "output format: human or json")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return 0, errUsage
+	}
+	if *output != "human" && *output != "json" {
+		return 0, fmt.Errorf("unknown output format %q", *output)
+	}
+	filename := fs.Arg(0)
+
+	img, err := qcow2.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+
+	var report any
+	var text func(io.Writer) error
+	status := 0
+	switch cmd {
+	case "info":
+		r, err := qcow2img.Info(img, filename)
+		if err != nil {
+			return 0, err
+		}
+		report, text = r, r.WriteText
+	case "check":
+		r, err := qcow2img.Check(img, filename)
+		if err != nil {
+			return 0, err
+		}
+		report, text = r, r.WriteText
+		switch {
+		case r.Corruptions > 0 || r.CheckErrors > 0:
+			status = 2
+		case r.Leaks > 0:
+			status = 3
+		}
+	case "map":
+		entries, err := qcow2img.Map(img)
+		if err != nil {
+			return 0, err
+		}
+		report = entries
+		text = func(w io.Writer) error { return qcow2img.WriteMap(w, entries, filename) }
+	case "snapshot list":
+		snapshots := qcow2img.Snapshots(img)
+		if snapshots == nil {
+			snapshots = []qcow2img.SnapshotInfo{}
+		}
+		report = snapshots
+		text = func(w io.Writer) error { return qcow2img.WriteSnapshotList(w, snapshots) }
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return status, enc.Encode(report)
+	}
+	return status, text(out)
+}
+
+// create runs the create command.
+func create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	profile := fs.String("profile", "", "creation profile")
+	backing := fs.String("backing", "", "backing file")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 2 {
+		return errUsage
+	}
+	size, err := parseSize(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	img, err := qcow2.Create(fs.Arg(0), qcow2.CreateOptions{
+		Size:        size,
+		BackingFile: *backing,
+		Profile:     *profile,
+	})
+	if err != nil {
+		return err
+	}
+	return img.Close()
+}
+
+// parseSize parses a size with an optional qemu-img suffix (k, M, G, T).
+func parseSize(s string) (uint64, error) {
+	shift := 0
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("bkmgt", s[n-1]|0x20); i >= 0 {
+			shift = 10 * i
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v > (1<<64-1)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v << shift, nil
+}
+
+const bashCompletion = `_qcow2img() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    case $COMP_CWORD in
+    1)
+        COMPREPLY=($(compgen -W "info check map snapshot create profiles completion" -- "$cur"))
+        return ;;
+    2)
+        case ${COMP_WORDS[1]} in
+        snapshot) COMPREPLY=($(compgen -W "list" -- "$cur")); return ;;
+        completion) COMPREPLY=($(compgen -W "bash" -- "$cur")); return ;;
+        esac ;;
+    esac
+    case $cur in
+    --output=*) COMPREPLY=($(compgen -W "human json" -- "${cur#--output=}")) ;;
+    --profile=*) COMPREPLY=($(compgen -W "$(qcow2img profiles | cut -d' ' -f1)" -- "${cur#--profile=}")) ;;
+    -*) COMPREPLY=($(compgen -W "--output= --profile= --backing=" -- "$cur")); compopt -o nospace ;;
+    *) COMPREPLY=($(compgen -f -- "$cur")) ;;
+    esac
+}
+complete -F _qcow2img qcow2img
+`
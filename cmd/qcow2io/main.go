@@ -0,0 +1,72 @@
+// Command qcow2io runs qemu-io style commands against a QCOW2 image:
+//
+//	qcow2io [-r] [-f qcow2] -c 'write -P 0xab 0 64k' -c 'read -P 0xab 0 64k' disk.qcow2
+//
+// Commands run in order; the first failure stops the run and the exit
+// status is 1. See package qcow2io for the supported commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ehrlich-b/go-qcow2"
+	"github.com/ehrlich-b/go-qcow2/qcow2io"
+)
+
+// commandList collects repeated -c flags.
+type commandList []string
+
+func (c *commandList) String() string { return strings.Join(*c, "; ") }
+
+func (c *commandList) Set(s string) error {
+	*c = append(*c, s)
+	return nil
+}
+
+func main() {
+	var cmds commandList
+	flag.Var(&cmds, "c", "command to run (may be repeated)")
+	readOnly := flag.Bool("r", false, "open the image read-only")
+	format := flag.String("f", "qcow2", "image format (only qcow2 is supported)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: qcow2io [-r] [-f qcow2] -c command... image\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format != "qcow2" {
+		fmt.Fprintf(os.Stderr, "qcow2io: unsupported format %q\n", *format)
+		os.Exit(2)
+	}
+
+	flags := os.O_RDWR
+	if *readOnly {
+		flags = os.O_RDONLY
+	}
+	img, err := qcow2.OpenFile(flag.Arg(0), flags, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "qcow2io: %v\n", err)
+		os.Exit(1)
+	}
+
+	status := 0
+	s := qcow2io.New(img, os.Stdout)
+	for _, cmd := range cmds {
+		if err := s.Exec(cmd); err != nil {
+			fmt.Fprintf(os.Stderr, "qcow2io: %v\n", err)
+			status = 1
+			break
+		}
+	}
+	if err := img.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "qcow2io: %v\n", err)
+		status = 1
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,103 @@
+package qcow2
+
+import (
+	"fmt"
+)
+
+// CompatLevel is the oldest QEMU an image must stay usable with, named after
+// qemu-img's compat option. Features the level predates are refused rather
+// than enabled, so an image never picks up something an old hypervisor
+// cannot open.
+type CompatLevel int
+
+const (
+	// CompatAny places no restriction on features.
+	CompatAny CompatLevel = iota
+
+	// Compat010 is compat=0.10: a version 2 image, readable by QEMU 0.10
+	// and later. Version 2 has no feature bits, so lazy refcounts, external
+	// data files, zstd compression, extended L2 entries and LUKS encryption
+	// are all unavailable.
+	Compat010
+
+	// Compat11 is compat=1.1 as QEMU 1.1 understood it: a version 3 image
+	// with lazy refcounts allowed, but without the incompatible features
+	// added later (external data files, zstd compression, extended L2
+	// entries) or LUKS encryption.
+	Compat11
+)
+
+// String returns the level as qemu-img spells it, or "any".
+func (c CompatLevel) String() string {
+	switch c {
+	case CompatAny:
+		return "any"
+	case Compat010:
+		return "0.10"
+	case Compat11:
+		return "1.1"
+	}
+	return fmt.Sprintf("CompatLevel(%d)", int(c))
+}
+
+// version returns the header version the level requires.
+func (c CompatLevel) version() uint32 {
+	if c == Compat010 {
+		return Version2
+	}
+	return Version3
+}
+
+// allowsNewFeatures reports whether the level allows features added after
+// QEMU 1.1.
+func (c CompatLevel) allowsNewFeatures() bool {
+	return c == CompatAny
+}
+
+// CompatLevel returns the compat level the image is held to: the level set
+// at Create or with WithCompatLevel, and at least Compat010 for a version 2
+// image, which cannot take on newer features. The level of a version 3
+// image is not stored in the file and must be given again when reopening.
+func (img *Image) CompatLevel() CompatLevel {
+	if img.header.Version < Version3 {
+		return Compat010
+	}
+	return img.compat
+}
+
+// requireNewFeatures fails with ErrCompatLevel if the image's compat level
+// predates feature, which was added after QEMU 1.1.
+func (img *Image) requireNewFeatures(feature string) error {
+	if level := img.CompatLevel(); !level.allowsNewFeatures() {
+		return fmt.Errorf("%w: %s not allowed at compat=%s", ErrCompatLevel, feature, level)
+	}
+	return nil
+}
+
+// checkCompatLevel fails with ErrCompatLevel if the image already uses a
+// feature beyond its compat level.
+func (img *Image) checkCompatLevel() error {
+	level := img.CompatLevel()
+	if level == CompatAny {
+		return nil
+	}
+	h := img.header
+	if h.Version != level.version() {
+		return fmt.Errorf("%w: version %d image at compat=%s", ErrCompatLevel, h.Version, level)
+	}
+
+	var feature string
+	switch {
+	case h.IncompatibleFeatures&IncompatExternalData != 0:
+		feature = "external data file"
+	case h.IncompatibleFeatures&IncompatCompression != 0 && h.CompressionType != CompressionZlib:
+		feature = "zstd compression"
+	case h.IncompatibleFeatures&IncompatExtendedL2 != 0:
+		feature = "extended L2 entries"
+	case h.EncryptMethod == EncryptionLUKS:
+		feature = "LUKS encryption"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: image uses %s, beyond compat=%s", ErrCompatLevel, feature, level)
+}
@@ -0,0 +1,120 @@
+// compat_test.go - Compat level enforcement tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestCompatLevelCreate checks the version and feature restrictions of each
+// level on new images.
+func TestCompatLevelCreate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	cluster := bytes.Repeat([]byte("compressible "), 65536/13+1)[:65536]
+
+	tests := []struct {
+		compat  CompatLevel
+		version uint32
+		zstd    bool
+	}{
+		{CompatAny, Version3, true},
+		{Compat010, Version2, false},
+		{Compat11, Version3, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.compat.String()+".qcow2")
+		img, err := Create(path, CreateOptions{Size: 1 << 20, Compat: tt.compat})
+		if err != nil {
+			t.Fatalf("compat=%s: Create failed: %v", tt.compat, err)
+		}
+		if img.header.Version != tt.version {
+			t.Errorf("compat=%s: version %d, want %d", tt.compat, img.header.Version, tt.version)
+		}
+		if img.CompatLevel() != tt.compat {
+			t.Errorf("compat=%s: CompatLevel() = %s", tt.compat, img.CompatLevel())
+		}
+
+		// zlib is always allowed
+		img.SetCompressionLevel(CompressionDefault)
+		if _, err := img.WriteAtCompressed(cluster, 0); err != nil {
+			t.Errorf("compat=%s: zlib write failed: %v", tt.compat, err)
+		}
+		img.SetCompressionType(CompressionZstd)
+		_, err = img.WriteAtCompressed(cluster, 65536)
+		if tt.zstd && err != nil {
+			t.Errorf("compat=%s: zstd write failed: %v", tt.compat, err)
+		}
+		if !tt.zstd && !errors.Is(err, ErrCompatLevel) {
+			t.Errorf("compat=%s: zstd write: got %v, want ErrCompatLevel", tt.compat, err)
+		}
+		if !tt.zstd && img.header.CompressionType != CompressionZlib {
+			t.Errorf("compat=%s: refused zstd still changed the header", tt.compat)
+		}
+
+		err = img.AttachExternalDataFile(tt.compat.String() + ".data")
+		if tt.compat != CompatAny && !errors.Is(err, ErrCompatLevel) {
+			t.Errorf("compat=%s: AttachExternalDataFile: got %v, want ErrCompatLevel", tt.compat, err)
+		}
+		img.Close()
+	}
+
+	bad := []CreateOptions{
+		{Size: 1 << 20, Compat: Compat010, Version: Version3},
+		{Size: 1 << 20, Compat: Compat11, Version: Version2},
+		{Size: 1 << 20, Compat: Compat010, LazyRefcounts: true},
+	}
+	for i, opts := range bad {
+		path := filepath.Join(dir, "bad.qcow2")
+		if img, err := Create(path, opts); !errors.Is(err, ErrCompatLevel) {
+			t.Errorf("case %d: got %v, want ErrCompatLevel", i, err)
+			if img != nil {
+				img.Close()
+			}
+		}
+	}
+}
+
+// TestWithCompatLevel checks existing images against a level on open.
+func TestWithCompatLevel(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "zstd.qcow2")
+	img, err := CreateSimple(path, 1<<20)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	// A plain version 3 image meets 1.1 but not 0.10
+	img, err = Open(path, WithCompatLevel(Compat11))
+	if err != nil {
+		t.Fatalf("Open at compat=1.1 failed: %v", err)
+	}
+	img.SetCompressionLevel(CompressionDefault)
+	img.SetCompressionType(CompressionZstd)
+	if _, err := img.WriteAtCompressed(make([]byte, 65536), 0); !errors.Is(err, ErrCompatLevel) {
+		t.Errorf("zstd at compat=1.1: got %v, want ErrCompatLevel", err)
+	}
+	img.Close()
+	if _, err := Open(path, WithCompatLevel(Compat010)); !errors.Is(err, ErrCompatLevel) {
+		t.Errorf("Open v3 at compat=0.10: got %v, want ErrCompatLevel", err)
+	}
+
+	// Once it uses zstd it no longer meets 1.1
+	img, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.SetCompressionLevel(CompressionDefault)
+	img.SetCompressionType(CompressionZstd)
+	if _, err := img.WriteAtCompressed(make([]byte, 65536), 0); err != nil {
+		t.Fatalf("zstd write failed: %v", err)
+	}
+	img.Close()
+	if _, err := Open(path, WithCompatLevel(Compat11)); !errors.Is(err, ErrCompatLevel) {
+		t.Errorf("Open zstd image at compat=1.1: got %v, want ErrCompatLevel", err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -51,83 +53,98 @@ func (img *Image) parseCompressedL2Entry(l2Entry uint64) (offset uint64, compres
 	return offset, compressedSize
 }
 
-// decompressCluster reads and decompresses a compressed cluster.
-func (img *Image) decompressCluster(l2Entry uint64) ([]byte, error) {
+// decompressCluster reads and decompresses a compressed cluster into dst,
+// which must be cluster-sized (typically a pooled cluster buffer).
+func (img *Image) decompressCluster(l2Entry uint64, dst []byte) error {
 	offset, compressedSize := img.parseCompressedL2Entry(l2Entry)
 
-	// Read compressed data (use dataFile for external data file support)
-	compressed := make([]byte, compressedSize)
+	// Read compressed data (use dataFile for external data file support).
+	// The size field can describe up to two clusters, but anything written
+	// by a sane encoder fits in one, so use the pool when possible.
+	var compressed []byte
+	if compressedSize <= img.clusterSize {
+		buf := img.getClusterBuffer()
+		defer img.putClusterBuffer(buf)
+		compressed = buf[:compressedSize]
+	} else {
+		compressed = make([]byte, compressedSize)
+	}
 	n, err := img.dataFile().ReadAt(compressed, int64(offset))
 	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("qcow2: failed to read compressed cluster at 0x%x: %w", offset, err)
+		return fmt.Errorf("qcow2: failed to read compressed cluster at 0x%x: %w", offset, err)
 	}
 	compressed = compressed[:n]
 
 	// Decompress based on compression type
 	switch img.header.CompressionType {
 	case CompressionZstd:
-		return img.decompressZstd(compressed)
+		return img.decompressZstd(compressed, dst)
 	default:
 		// Default is deflate (zlib without header)
-		return img.decompressDeflate(compressed)
+		return img.decompressDeflate(compressed, dst)
 	}
 }
 
+// flateReaderPool holds deflate readers for reuse via flate.Resetter.
+var flateReaderPool sync.Pool
+
+// zstdDecoderPool holds single-threaded zstd stream decoders for reuse.
+var zstdDecoderPool sync.Pool
+
 // decompressDeflate decompresses data using deflate (the default QCOW2 compression).
-func (img *Image) decompressDeflate(compressed []byte) ([]byte, error) {
-	reader := flate.NewReader(bytes.NewReader(compressed))
-	defer reader.Close()
-
-	decompressed := make([]byte, img.clusterSize)
-	totalRead := 0
-	for totalRead < int(img.clusterSize) {
-		n, err := reader.Read(decompressed[totalRead:])
-		totalRead += n
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("qcow2: failed to decompress deflate cluster: %w", err)
+func (img *Image) decompressDeflate(compressed []byte, dst []byte) error {
+	src := bytes.NewReader(compressed)
+	reader, ok := flateReaderPool.Get().(io.ReadCloser)
+	if ok {
+		if err := reader.(flate.Resetter).Reset(src, nil); err != nil {
+			return fmt.Errorf("qcow2: failed to reset deflate reader: %w", err)
 		}
+	} else {
+		reader = flate.NewReader(src)
 	}
+	defer flateReaderPool.Put(reader)
 
-	// Pad with zeros if decompressed data is smaller than cluster
-	for i := totalRead; i < int(img.clusterSize); i++ {
-		decompressed[i] = 0
+	if err := readFull(reader, dst); err != nil {
+		return fmt.Errorf("qcow2: failed to decompress deflate cluster: %w", err)
 	}
-
-	return decompressed, nil
+	return nil
 }
 
 // decompressZstd decompresses data using zstd compression.
 // Uses a streaming decoder to handle padded data correctly - the decoder
-// will stop at the zstd frame boundary and ignore trailing padding bytes.
-func (img *Image) decompressZstd(compressed []byte) ([]byte, error) {
-	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
-	if err != nil {
-		return nil, fmt.Errorf("qcow2: failed to create zstd decoder: %w", err)
-	}
-	defer decoder.Close()
-
-	decompressed := make([]byte, img.clusterSize)
-	totalRead := 0
-	for totalRead < int(img.clusterSize) {
-		n, err := decoder.Read(decompressed[totalRead:])
-		totalRead += n
-		if err == io.EOF {
-			break
+// reads frame after frame, skipping skippable frames, until the cluster is
+// full, and never looks at the trailing padding bytes.
+func (img *Image) decompressZstd(compressed []byte, dst []byte) error {
+	src := bytes.NewReader(compressed)
+	decoder, ok := zstdDecoderPool.Get().(*zstd.Decoder)
+	if ok {
+		if err := decoder.Reset(src); err != nil {
+			return fmt.Errorf("qcow2: failed to reset zstd decoder: %w", err)
 		}
+	} else {
+		var err error
+		decoder, err = zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
 		if err != nil {
-			return nil, fmt.Errorf("qcow2: failed to decompress zstd cluster: %w", err)
+			return fmt.Errorf("qcow2: failed to create zstd decoder: %w", err)
 		}
 	}
+	defer zstdDecoderPool.Put(decoder)
 
-	// Zero-pad if decompressed data is smaller than cluster
-	for i := totalRead; i < int(img.clusterSize); i++ {
-		decompressed[i] = 0
+	if err := readFull(decoder, dst); err != nil {
+		return fmt.Errorf("qcow2: failed to decompress zstd cluster: %w", err)
 	}
+	return nil
+}
 
-	return decompressed, nil
+// readFull reads from r until dst is full or r reaches EOF, and zero-pads
+// whatever r did not fill.
+func readFull(r io.Reader, dst []byte) error {
+	n, err := io.ReadFull(r, dst)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	clear(dst[n:])
+	return err
 }
 
 // compressedClusterCache caches decompressed clusters to avoid repeated decompression.
@@ -146,6 +163,12 @@ func (c *compressedClusterCache) get(offset uint64) []byte {
 	return c.cache.get(offset)
 }
 
+// readAt copies part of a cached decompressed cluster into dst. Returns
+// false on a miss.
+func (c *compressedClusterCache) readAt(offset uint64, dst []byte, pos uint64) bool {
+	return c.cache.readAt(offset, dst, pos)
+}
+
 func (c *compressedClusterCache) put(offset uint64, data []byte) {
 	c.cache.put(offset, data)
 }
@@ -178,23 +201,29 @@ func (c CompressionLevel) toFlateLevel() int {
 	}
 }
 
-// compressCluster compresses cluster data using deflate.
+// compressCluster compresses cluster data using deflate, appending the
+// output to dst[:0] so callers can compress into a pooled cluster buffer.
 // Returns the compressed data or an error. If the compressed data is
 // larger than the original, returns ErrCompressionNotBeneficial.
-func (img *Image) compressCluster(data []byte) ([]byte, error) {
+func (img *Image) compressCluster(data []byte, dst []byte) ([]byte, error) {
 	if len(data) != int(img.clusterSize) {
 		return nil, fmt.Errorf("qcow2: compress requires full cluster (%d bytes), got %d",
 			img.clusterSize, len(data))
 	}
 
+	// Skip clusters that would only be compressed to be thrown away
+	if likelyIncompressible(data) {
+		return nil, ErrCompressionNotBeneficial
+	}
+
 	var compressed []byte
 	var err error
 
 	// Use zstd if explicitly set, otherwise default to deflate
 	if img.compressionType == CompressionZstd {
-		compressed, err = img.compressZstd(data)
+		compressed, err = img.compressZstd(data, dst[:0])
 	} else {
-		compressed, err = img.compressDeflate(data)
+		compressed, err = img.compressDeflate(data, dst[:0])
 	}
 	if err != nil {
 		return nil, err
@@ -211,13 +240,77 @@ func (img *Image) compressCluster(data []byte) ([]byte, error) {
 	return compressed, nil
 }
 
-// compressDeflate compresses data using deflate.
-func (img *Image) compressDeflate(data []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	w, err := flate.NewWriter(&buf, img.compressionLevel.toFlateLevel())
-	if err != nil {
-		return nil, fmt.Errorf("qcow2: failed to create deflate compressor: %w", err)
+// Sampling parameters for likelyIncompressible
+const (
+	probeSamples    = 16
+	probeSampleSize = 256
+	probeMaxEntropy = 7.9 // Bits per byte; random data samples at about 7.95
+)
+
+// likelyIncompressible reports whether data looks too random to be worth
+// compressing, judged from samples spread evenly over it: their bytes are
+// close to 8 bits of entropy, and no sample repeats the first, which would
+// hint at long-range repeats that order-0 entropy misses. Checking costs a
+// small fraction of compressing the cluster, and a wrong guess only means
+// the cluster is stored uncompressed.
+func likelyIncompressible(data []byte) bool {
+	if len(data) < 2*probeSamples*probeSampleSize {
+		return false // Small enough to just try
+	}
+	stride := len(data) / probeSamples
+	first := data[:probeSampleSize]
+	var counts [256]int
+	for i := 0; i < probeSamples; i++ {
+		sample := data[i*stride : i*stride+probeSampleSize]
+		if i > 0 && bytes.Equal(sample, first) {
+			return false
+		}
+		for _, b := range sample {
+			counts[b]++
+		}
+	}
+
+	const total = probeSamples * probeSampleSize
+	entropy := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > probeMaxEntropy
+}
+
+// Compressors are pooled per CompressionLevel since neither flate nor zstd
+// can change level on reset.
+var (
+	flateWriterPools [CompressionBest + 1]sync.Pool
+	zstdEncoderPools [CompressionBest + 1]sync.Pool
+)
+
+// poolIndex maps a compression level to its compressor pool.
+func (c CompressionLevel) poolIndex() int {
+	if c < CompressionDisabled || c > CompressionBest {
+		return int(CompressionDefault)
 	}
+	return int(c)
+}
+
+// compressDeflate compresses data using deflate, appending to dst.
+func (img *Image) compressDeflate(data []byte, dst []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	pool := &flateWriterPools[img.compressionLevel.poolIndex()]
+	w, ok := pool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		var err error
+		w, err = flate.NewWriter(buf, img.compressionLevel.toFlateLevel())
+		if err != nil {
+			return nil, fmt.Errorf("qcow2: failed to create deflate compressor: %w", err)
+		}
+	}
+	defer pool.Put(w)
 
 	if _, err := w.Write(data); err != nil {
 		return nil, fmt.Errorf("qcow2: failed to compress data with deflate: %w", err)
@@ -229,28 +322,49 @@ func (img *Image) compressDeflate(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// compressZstd compresses data using zstd.
-func (img *Image) compressZstd(data []byte) ([]byte, error) {
-	level := zstd.SpeedDefault
-	switch img.compressionLevel {
-	case CompressionFast:
-		level = zstd.SpeedFastest
-	case CompressionBest:
-		level = zstd.SpeedBestCompression
-	}
+// compressZstd compresses data using zstd, appending to dst.
+func (img *Image) compressZstd(data []byte, dst []byte) ([]byte, error) {
+	pool := &zstdEncoderPools[img.compressionLevel.poolIndex()]
+	encoder, ok := pool.Get().(*zstd.Encoder)
+	if !ok {
+		level := zstd.SpeedDefault
+		switch img.compressionLevel {
+		case CompressionFast:
+			level = zstd.SpeedFastest
+		case CompressionBest:
+			level = zstd.SpeedBestCompression
+		}
 
-	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
-	if err != nil {
-		return nil, fmt.Errorf("qcow2: failed to create zstd encoder: %w", err)
+		var err error
+		encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("qcow2: failed to create zstd encoder: %w", err)
+		}
 	}
-	defer encoder.Close()
+	defer pool.Put(encoder)
 
-	return encoder.EncodeAll(data, nil), nil
+	// Each frame is complete on its own; decoders read them in sequence
+	frame := img.zstdFrameSize
+	if frame <= 0 {
+		frame = len(data)
+	}
+	for len(data) > 0 {
+		n := min(frame, len(data))
+		dst = encoder.EncodeAll(data[:n], dst)
+		data = data[n:]
+	}
+	return dst, nil
 }
 
 // updateHeaderCompressionType updates the compression type in the header and persists it.
 // This is needed when writing compressed clusters with a non-default compression type.
 func (img *Image) updateHeaderCompressionType(ctype uint8) error {
+	if ctype != CompressionZlib {
+		if err := img.requireNewFeatures("zstd compression"); err != nil {
+			return err
+		}
+	}
+
 	// Update in-memory header
 	img.header.CompressionType = ctype
 
@@ -306,10 +420,14 @@ func (img *Image) allocateCompressedSpace(size int) (uint64, error) {
 	offset := uint64(info.Size())
 
 	// Extend file
-	if err := dataFile.Truncate(info.Size() + int64(size)); err != nil {
+	if err := img.checkQuota(dataFile, offset+uint64(size)); err != nil {
+		return 0, err
+	}
+	if err := img.growFile(dataFile, info.Size(), offset+uint64(size)); err != nil {
 		return 0, fmt.Errorf("qcow2: failed to extend file for compressed data: %w", err)
 	}
 
+	img.allocated(offset, uint64(size), AllocCompressed, false)
 	return offset, nil
 }
 
@@ -325,9 +443,12 @@ func (img *Image) writeCompressedCluster(virtOff uint64, data []byte) (uint64, e
 	if len(data) != int(img.clusterSize) {
 		return 0, fmt.Errorf("qcow2: compressed write requires full cluster")
 	}
+	img.dropDelayedCluster(virtOff)
 
-	// Try to compress
-	compressed, err := img.compressCluster(data)
+	// Try to compress into a pooled buffer; a beneficial result always fits
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	compressed, err := img.compressCluster(data, buf)
 	if err == ErrCompressionNotBeneficial {
 		// Fall back to normal allocation
 		return 0, ErrCompressionNotBeneficial
@@ -352,9 +473,11 @@ func (img *Image) writeCompressedCluster(virtOff uint64, data []byte) (uint64, e
 		return 0, err
 	}
 
-	// Write compressed data (padded) - use dataFile for external data file support
-	padded := make([]byte, paddedSize)
+	// Write compressed data (padded) - use dataFile for external data file support.
+	// The copy is a no-op unless the encoder outgrew buf.
+	padded := buf[:paddedSize]
 	copy(padded, compressed)
+	clear(padded[len(compressed):])
 	if _, err := img.dataFile().WriteAt(padded, int64(offset)); err != nil {
 		return 0, fmt.Errorf("qcow2: failed to write compressed cluster: %w", err)
 	}
@@ -380,6 +503,7 @@ func (img *Image) writeCompressedCluster(virtOff uint64, data []byte) (uint64, e
 // If compression is not beneficial, falls back to normal uncompressed write.
 // Returns the number of bytes written (always clusterSize on success) and any error.
 func (img *Image) WriteAtCompressed(data []byte, off int64) (int, error) {
+	defer img.lockRange(off, int64(len(data)))()
 	if img.readOnly {
 		return 0, ErrReadOnly
 	}
@@ -414,6 +538,7 @@ func (img *Image) WriteAtCompressed(data []byte, off int64) (int, error) {
 	if off >= img.Size() {
 		return 0, ErrOffsetOutOfRange
 	}
+	defer img.unsynced.addWrite(off, int64(len(data)))
 
 	// Invalidate any persistent bitmaps on first write
 	if !img.bitmapsInvalidated && img.hasBitmaps() {
@@ -426,8 +551,14 @@ func (img *Image) WriteAtCompressed(data []byte, off int64) (int, error) {
 	// Try compressed write
 	_, err := img.writeCompressedCluster(uint64(off), data)
 	if err == ErrCompressionNotBeneficial {
-		// Fall back to normal write
-		return img.WriteAt(data, off)
+		// Fall back to normal write. The last cluster may extend past the
+		// end of the image, which a compressed write tolerates, so report
+		// the whole cluster as written
+		end := min(int64(len(data)), img.Size()-off)
+		if n, err := img.writeAt(data[:end], off); err != nil {
+			return n, err
+		}
+		return len(data), nil
 	}
 	if err != nil {
 		return 0, err
@@ -449,8 +580,9 @@ func (img *Image) updateL2EntryForCompressed(virtOff uint64, l2Entry uint64) err
 	}
 
 	// Get L2 table
-	l2Table, err := img.getL2Table(l2TableOff)
-	if err != nil {
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	if err := img.readL2Table(l2TableOff, l2Table); err != nil {
 		return err
 	}
 
@@ -0,0 +1,150 @@
+package qcow2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// contentBitmapMagic starts a content bitmap file.
+var contentBitmapMagic = [8]byte{'Q', 'C', 'O', 'W', 'C', 'B', 'M', 0}
+
+// contentBitmapHeaderSize is the size of the magic, cluster size and virtual
+// size that precede the bits in a content bitmap file.
+const contentBitmapHeaderSize = 24
+
+// contentBitmapChunk is how many bytes of bits ReadContentBitmap allocates
+// at a time, so a header claiming a huge image costs no more memory than
+// the bits that actually follow it.
+const contentBitmapChunk = 1 << 20
+
+// ErrInvalidContentBitmap is returned by ReadContentBitmap for data that is
+// not a content bitmap.
+var ErrInvalidContentBitmap = errors.New("qcow2: invalid content bitmap")
+
+// ContentBitmap records which guest clusters of an image hold non-zero
+// data, as read through the backing chain. Tools comparing or
+// deduplicating images can use it to skip clusters that read as zeros in
+// both images without reading either.
+type ContentBitmap struct {
+	ClusterSize uint64 // Bytes covered by each bit
+	Size        uint64 // Virtual size of the image
+
+	bits []byte // Bit n is bit n%8 of bits[n/8]
+}
+
+// Clusters returns the number of clusters the bitmap covers.
+func (b *ContentBitmap) Clusters() uint64 {
+	return (b.Size + b.ClusterSize - 1) / b.ClusterSize
+}
+
+// NonZero reports whether the given cluster holds non-zero data.
+func (b *ContentBitmap) NonZero(cluster uint64) bool {
+	return cluster < b.Clusters() && b.bits[cluster/8]&(1<<(cluster%8)) != 0
+}
+
+// Count returns the number of non-zero clusters.
+func (b *ContentBitmap) Count() uint64 {
+	var n uint64
+	for _, v := range b.bits {
+		for ; v != 0; v &= v - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *ContentBitmap) set(cluster uint64) {
+	b.bits[cluster/8] |= 1 << (cluster % 8)
+}
+
+// WriteTo writes the bitmap in its file format: the magic "QCOWCBM\0", the
+// cluster size and virtual size as big-endian 64-bit values, then one bit
+// per cluster, least significant bit first.
+func (b *ContentBitmap) WriteTo(w io.Writer) (int64, error) {
+	var hdr [contentBitmapHeaderSize]byte
+	copy(hdr[:8], contentBitmapMagic[:])
+	binary.BigEndian.PutUint64(hdr[8:16], b.ClusterSize)
+	binary.BigEndian.PutUint64(hdr[16:24], b.Size)
+	n, err := w.Write(hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(b.bits)
+	return int64(n + m), err
+}
+
+// ReadContentBitmap reads a bitmap written by ContentBitmap.WriteTo.
+func ReadContentBitmap(r io.Reader) (*ContentBitmap, error) {
+	var hdr [contentBitmapHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidContentBitmap, err)
+	}
+	if [8]byte(hdr[:8]) != contentBitmapMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidContentBitmap)
+	}
+	b := &ContentBitmap{
+		ClusterSize: binary.BigEndian.Uint64(hdr[8:16]),
+		Size:        binary.BigEndian.Uint64(hdr[16:24]),
+	}
+	if b.ClusterSize < 1<<MinClusterBits || b.ClusterSize > 1<<MaxClusterBits || b.ClusterSize&(b.ClusterSize-1) != 0 {
+		return nil, fmt.Errorf("%w: cluster size %d", ErrInvalidContentBitmap, b.ClusterSize)
+	}
+	// Virtual sizes are int64s; this also keeps Clusters from overflowing
+	if b.Size > math.MaxInt64 {
+		return nil, fmt.Errorf("%w: virtual size %d", ErrInvalidContentBitmap, b.Size)
+	}
+	n := (b.Clusters() + 7) / 8
+	if n > math.MaxInt {
+		return nil, fmt.Errorf("%w: %d bytes of bits", ErrInvalidContentBitmap, n)
+	}
+	b.bits = make([]byte, 0, min(n, contentBitmapChunk))
+	for uint64(len(b.bits)) < n {
+		start := len(b.bits)
+		chunk := int(min(n-uint64(start), contentBitmapChunk))
+		b.bits = append(b.bits, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r, b.bits[start:]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidContentBitmap, err)
+		}
+	}
+	return b, nil
+}
+
+// ContentBitmap scans the image for clusters holding non-zero data. Zero
+// and unallocated clusters without a backing file are known to be zero from
+// the metadata; every other cluster is read, through the backing chain, and
+// checked for zeros. It returns early with ctx.Err() if the context is
+// cancelled, and runs at the priority ctx carries (WithPriority).
+func (img *Image) ContentBitmap(ctx context.Context) (*ContentBitmap, error) {
+	b := &ContentBitmap{ClusterSize: img.clusterSize, Size: uint64(img.Size())}
+	b.bits = make([]byte, (b.Clusters()+7)/8)
+
+	extents, err := img.Map(0, img.Size())
+	if err != nil {
+		return nil, err
+	}
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	for _, e := range extents {
+		if e.Type != ExtentData && e.Type != ExtentBacking {
+			continue
+		}
+		for off := e.Start; off < e.End(); {
+			if _, err := img.waitTurn(ctx); err != nil {
+				return nil, err
+			}
+			n := min(img.clusterSize-off&img.offsetMask, e.End()-off)
+			if _, err := img.readUntracked(buf[:n], int64(off)); err != nil {
+				return nil, fmt.Errorf("qcow2: content scan at 0x%x failed: %w", off, err)
+			}
+			if !isZeroBuffer(buf[:n]) {
+				b.set(off >> img.clusterBits)
+			}
+			off += n
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,91 @@
+// content_test.go - Content bitmap tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// TestContentBitmap checks data, zero-filled, zero-flag and backing
+// clusters are classified by content, and that the bitmap round-trips
+// through its file format.
+func TestContentBitmap(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := base.ClusterSize()
+	for _, w := range []struct {
+		cluster int
+		fill    byte
+	}{{0, 1}, {1, 0}, {3, 2}} {
+		if _, err := base.WriteAt(bytes.Repeat([]byte{w.fill}, cs), int64(w.cluster*cs)); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	base.Close()
+
+	img, err := CreateOverlay(overlayPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte{3}, cs), int64(5*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	if err := img.WriteZeroAt(int64(3*cs), int64(cs)); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte{4}, int64(7*cs)+100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	b, err := img.ContentBitmap(context.Background())
+	if err != nil {
+		t.Fatalf("ContentBitmap failed: %v", err)
+	}
+	want := map[uint64]bool{0: true, 5: true, 7: true}
+	for c := uint64(0); c < b.Clusters(); c++ {
+		if b.NonZero(c) != want[c] {
+			t.Errorf("cluster %d: NonZero = %v, want %v", c, b.NonZero(c), want[c])
+		}
+	}
+	if b.Count() != 3 {
+		t.Errorf("Count = %d, want 3", b.Count())
+	}
+
+	var file bytes.Buffer
+	if _, err := b.WriteTo(&file); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	got, err := ReadContentBitmap(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadContentBitmap failed: %v", err)
+	}
+	if got.ClusterSize != b.ClusterSize || got.Size != b.Size || !bytes.Equal(got.bits, b.bits) {
+		t.Errorf("round trip = %+v, want %+v", got, b)
+	}
+	if _, err := ReadContentBitmap(bytes.NewReader(file.Bytes()[:file.Len()-1])); !errors.Is(err, ErrInvalidContentBitmap) {
+		t.Errorf("truncated bitmap: got %v, want ErrInvalidContentBitmap", err)
+	}
+
+	// Headers claiming huge images fail without allocating for them
+	for _, size := range []uint64{1 << 62, math.MaxUint64} {
+		hdr := append([]byte(nil), file.Bytes()[:contentBitmapHeaderSize]...)
+		binary.BigEndian.PutUint64(hdr[16:24], size)
+		if _, err := ReadContentBitmap(bytes.NewReader(hdr)); !errors.Is(err, ErrInvalidContentBitmap) {
+			t.Errorf("size %d with no bits: got %v, want ErrInvalidContentBitmap", size, err)
+		}
+	}
+}
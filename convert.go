@@ -0,0 +1,628 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Default convert tuning parameters.
+const (
+	// DefaultConvertSegmentSize is the unit of progress tracked in a checkpoint.
+	DefaultConvertSegmentSize = 4 * 1024 * 1024
+
+	// DefaultCheckpointInterval is how much virtual disk is processed between
+	// checkpoint writes.
+	DefaultCheckpointInterval = 256 * 1024 * 1024
+)
+
+// checkpointVersion is bumped whenever the checkpoint format changes.
+const checkpointVersion = 1
+
+// ConvertOptions configures Convert.
+type ConvertOptions struct {
+	// ClusterBits is log2 of the destination cluster size.
+	// Default is the source cluster size.
+	ClusterBits uint32
+
+	// Compress writes full data clusters compressed.
+	Compress bool
+
+	// CheckpointPath enables resumable conversion. Progress is persisted to
+	// this file periodically; if the file exists when Convert starts and
+	// matches the source and destination, completed segments are skipped.
+	// The file is removed once the conversion finishes.
+	CheckpointPath string
+
+	// CheckpointInterval is the number of virtual bytes processed between
+	// checkpoint writes. Default is DefaultCheckpointInterval.
+	CheckpointInterval int64
+
+	// Workers is the number of segments copied concurrently. Each worker
+	// buffers a single destination cluster. Default is 1.
+	Workers int
+
+	// SourceAdvice is passed to the host for the source files while they
+	// are read, for instance AdviceSequential for more readahead; see
+	// Image.Advise.
+	SourceAdvice FileAdvice
+
+	// DropCache drops the source and destination files from the host page
+	// cache every CheckpointInterval bytes and at the end, so a large
+	// conversion does not evict the pages the rest of the host is using.
+	DropCache bool
+}
+
+// convertCheckpoint is the on-disk progress record for a resumable convert.
+type convertCheckpoint struct {
+	Version     int    `json:"version"`
+	Source      string `json:"source"`
+	Dest        string `json:"dest"`
+	VirtualSize uint64 `json:"virtual_size"`
+	ClusterBits uint32 `json:"cluster_bits"`
+	SegmentSize uint64 `json:"segment_size"`
+	Compress    bool   `json:"compress"`
+	Done        []byte `json:"done"` // Bitmap of completed segments
+}
+
+func (cp *convertCheckpoint) isDone(seg uint64) bool {
+	return cp.Done[seg/8]&(1<<(seg%8)) != 0
+}
+
+func (cp *convertCheckpoint) markDone(seg uint64) {
+	cp.Done[seg/8] |= 1 << (seg % 8)
+}
+
+// matches reports whether a loaded checkpoint belongs to the same job.
+func (cp *convertCheckpoint) matches(other *convertCheckpoint) bool {
+	return cp.Version == other.Version &&
+		cp.Source == other.Source &&
+		cp.Dest == other.Dest &&
+		cp.VirtualSize == other.VirtualSize &&
+		cp.ClusterBits == other.ClusterBits &&
+		cp.SegmentSize == other.SegmentSize &&
+		cp.Compress == other.Compress &&
+		len(cp.Done) == len(other.Done)
+}
+
+// loadCheckpoint reads a checkpoint file. A missing file returns nil, nil.
+func loadCheckpoint(path string) (*convertCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to read checkpoint: %w", err)
+	}
+	var cp convertCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to parse checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint atomically replaces the checkpoint file.
+func saveCheckpoint(path string, cp *convertCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to encode checkpoint: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to create checkpoint: %w", err)
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("qcow2: failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("qcow2: failed to sync checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("qcow2: failed to close checkpoint: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("qcow2: failed to install checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Convert copies the virtual disk of the QCOW2 image at srcPath into a new,
+// standalone QCOW2 image at dstPath. The backing chain is flattened, and
+// unallocated, zero, and all-zero clusters are left sparse.
+//
+// With CheckpointPath set, an interrupted conversion can be restarted with
+// the same arguments and picks up from the last checkpoint instead of
+// starting over. Segments that were in flight at the time of the failure
+// are simply copied again; this is safe because every write is a full
+// overwrite of the same source data.
+func Convert(srcPath, dstPath string, opts ConvertOptions) error {
+	src, err := OpenFile(srcPath, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to open source: %w", err)
+	}
+	defer src.Close()
+	if opts.SourceAdvice != AdviceNormal {
+		if err := src.Advise(opts.SourceAdvice); err != nil {
+			return err
+		}
+	}
+
+	clusterBits := opts.ClusterBits
+	if clusterBits == 0 {
+		clusterBits = src.header.ClusterBits
+	}
+	if err := invalidClusterBits(clusterBits); err != nil {
+		return err
+	}
+
+	interval := opts.CheckpointInterval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+
+	// Segments must hold whole destination clusters
+	segSize := uint64(DefaultConvertSegmentSize)
+	if cs := uint64(1) << clusterBits; segSize < cs {
+		segSize = cs
+	}
+	virtSize := uint64(src.Size())
+	numSegs := (virtSize + segSize - 1) / segSize
+
+	job := &convertCheckpoint{
+		Version:     checkpointVersion,
+		Source:      srcPath,
+		Dest:        dstPath,
+		VirtualSize: virtSize,
+		ClusterBits: clusterBits,
+		SegmentSize: segSize,
+		Compress:    opts.Compress,
+		Done:        make([]byte, (numSegs+7)/8),
+	}
+
+	dst, err := openConvertTarget(dstPath, opts.CheckpointPath, job)
+	if err != nil {
+		return err
+	}
+	// Refcount blocks are written once per write rather than per cluster;
+	// checkpoints flush them
+	dst.enableRefcountWriteback()
+
+	if err := convertSegments(src, dst, job, opts, uint64(interval)); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("qcow2: failed to close destination: %w", err)
+	}
+
+	if opts.CheckpointPath != "" {
+		if err := os.Remove(opts.CheckpointPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("qcow2: failed to remove checkpoint: %w", err)
+		}
+	}
+	return nil
+}
+
+// openConvertTarget creates the destination image, or reopens it when a
+// matching checkpoint exists. On resume, job.Done is filled from the checkpoint.
+func openConvertTarget(dstPath, checkpointPath string, job *convertCheckpoint) (*Image, error) {
+	if checkpointPath != "" {
+		cp, err := loadCheckpoint(checkpointPath)
+		if err != nil {
+			return nil, err
+		}
+		if cp != nil {
+			if !cp.matches(job) {
+				return nil, fmt.Errorf("qcow2: checkpoint %s belongs to a different conversion", checkpointPath)
+			}
+			if _, err := os.Stat(dstPath); err == nil {
+				dst, err := OpenFile(dstPath, os.O_RDWR, 0)
+				if err != nil {
+					return nil, fmt.Errorf("qcow2: failed to reopen destination: %w", err)
+				}
+				// Refcount updates made after the last checkpoint may not
+				// have reached the file
+				if err := dst.rebuildRefcounts(); err != nil {
+					dst.Close()
+					return nil, fmt.Errorf("qcow2: failed to rebuild destination refcounts: %w", err)
+				}
+				copy(job.Done, cp.Done)
+				return dst, nil
+			}
+			// Destination vanished; start over
+		}
+	}
+
+	dst, err := Create(dstPath, CreateOptions{
+		Size:        job.VirtualSize,
+		ClusterBits: job.ClusterBits,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the job before copying anything so a crash right after
+	// creation resumes into this image instead of failing on O_EXCL
+	if checkpointPath != "" {
+		if err := saveCheckpoint(checkpointPath, job); err != nil {
+			dst.Close()
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// convertSegments copies every segment not yet marked done, persisting the
+// checkpoint every interval bytes. Segments are handed out to opts.Workers
+// goroutines; each worker holds a single cluster buffer, so memory use is
+// bounded regardless of image size.
+func convertSegments(src, dst *Image, job *convertCheckpoint, opts ConvertOptions, interval uint64) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	numSegs := (job.VirtualSize + job.SegmentSize - 1) / job.SegmentSize
+
+	type segResult struct {
+		seg uint64
+		err error
+	}
+
+	segs := make(chan uint64)
+	results := make(chan segResult)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, dst.clusterSize)
+			for seg := range segs {
+				start := seg * job.SegmentSize
+				end := start + job.SegmentSize
+				if end > job.VirtualSize {
+					end = job.VirtualSize
+				}
+				err := convertRange(src, dst, start, end, buf, opts.Compress)
+				select {
+				case results <- segResult{seg: seg, err: err}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	// Snapshot the pending list up front; the collector below updates Done
+	var pending []uint64
+	for seg := uint64(0); seg < numSegs; seg++ {
+		if !job.isDone(seg) {
+			pending = append(pending, seg)
+		}
+	}
+
+	// Feed pending segments until done or told to stop
+	go func() {
+		defer close(segs)
+		for _, seg := range pending {
+			select {
+			case segs <- seg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	var sinceCheckpoint uint64
+	for r := range results {
+		if firstErr != nil {
+			continue
+		}
+		if r.err != nil {
+			firstErr = r.err
+			close(stop)
+			continue
+		}
+
+		job.markDone(r.seg)
+		sinceCheckpoint += job.SegmentSize
+
+		if (opts.CheckpointPath != "" || opts.DropCache) && sinceCheckpoint >= interval {
+			// Data must be durable before the checkpoint claims it is done,
+			// and written back before its pages can be dropped
+			if err := dst.Flush(); err != nil {
+				firstErr = fmt.Errorf("qcow2: failed to flush destination: %w", err)
+				close(stop)
+				continue
+			}
+			if opts.CheckpointPath != "" {
+				if err := saveCheckpoint(opts.CheckpointPath, job); err != nil {
+					firstErr = err
+					close(stop)
+					continue
+				}
+			}
+			if opts.DropCache {
+				if err := dropConvertCache(src, dst); err != nil {
+					firstErr = err
+					close(stop)
+					continue
+				}
+			}
+			sinceCheckpoint = 0
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := dst.Flush(); err != nil {
+		return err
+	}
+	if opts.DropCache {
+		return dropConvertCache(src, dst)
+	}
+	return nil
+}
+
+// dropConvertCache drops the pages a conversion has read and written so far
+// from the host page cache.
+func dropConvertCache(src, dst *Image) error {
+	if err := src.Advise(AdviceDontNeed); err != nil {
+		return err
+	}
+	return dst.Advise(AdviceDontNeed)
+}
+
+// convertRange copies the data clusters of [start, end) from src to dst.
+func convertRange(src, dst *Image, start, end uint64, buf []byte, compress bool) error {
+	clusterSize := uint64(len(buf))
+
+	for off := start; off < end; off += clusterSize {
+		n := clusterSize
+		if off+n > end {
+			n = end - off
+		}
+
+		// Skip clusters with nothing stored anywhere in the chain
+		hasData := false
+		err := src.walkExtents(int64(off), int64(n), func(e Extent) error {
+			if e.Type == ExtentData || e.Type == ExtentBacking {
+				hasData = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !hasData {
+			continue
+		}
+
+		chunk := buf[:n]
+		if _, err := src.ReadAt(chunk, int64(off)); err != nil {
+			return fmt.Errorf("qcow2: convert read at 0x%x failed: %w", off, err)
+		}
+		if isZeroBuffer(chunk) {
+			continue
+		}
+
+		if compress && n == clusterSize {
+			_, err = dst.WriteAtCompressed(chunk, int64(off))
+		} else {
+			_, err = dst.WriteAt(chunk, int64(off))
+		}
+		if err != nil {
+			return fmt.Errorf("qcow2: convert write at 0x%x failed: %w", off, err)
+		}
+	}
+
+	return nil
+}
+
+// ConvertClusterSize rewrites the QCOW2 image at srcPath into a new image at
+// dstPath with a cluster size of 1<<newBits (for example 64KB to 2MB for
+// hugepage-friendly hosting). The backing file reference, if any, is kept.
+//
+// Internal snapshots are preserved: each snapshot is replayed into the new
+// image in order and only the clusters that changed between snapshots are
+// written, so clusters remain shared as in the source. Snapshot names, IDs,
+// dates, VM clocks, and lineage are kept. Snapshots that carry saved VM
+// state, and snapshots of images with a backing file, cannot be migrated and
+// make the conversion fail before anything is written.
+func ConvertClusterSize(srcPath, dstPath string, newBits uint32) error {
+	if err := invalidClusterBits(newBits); err != nil {
+		return err
+	}
+
+	src, err := OpenFile(srcPath, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	snapshots := src.Snapshots()
+	if err := checkSnapshotsMigratable(src, snapshots); err != nil {
+		return err
+	}
+
+	createOpts := CreateOptions{
+		Size:          uint64(src.Size()),
+		ClusterBits:   newBits,
+		Version:       src.header.Version,
+		LazyRefcounts: src.header.HasLazyRefcounts(),
+	}
+	if src.HasBackingFile() {
+		createOpts.BackingFile = rebaseBackingPath(src.BackingFile(), srcPath, dstPath)
+		createOpts.BackingFormat = src.BackingFormat()
+	}
+
+	dst, err := Create(dstPath, createOpts)
+	if err != nil {
+		return err
+	}
+
+	if err := migrateClusterSize(src, dst, snapshots); err != nil {
+		dst.Close()
+		os.Remove(dstPath)
+		return err
+	}
+
+	return dst.Close()
+}
+
+// checkSnapshotsMigratable rejects snapshots that migrateClusterSize cannot
+// replay into a new image.
+func checkSnapshotsMigratable(src *Image, snapshots []*Snapshot) error {
+	for _, snap := range snapshots {
+		if snap.VMStateLength() != 0 {
+			return fmt.Errorf("qcow2: snapshot %q has saved VM state, which cannot be migrated to a new image", snap.Name)
+		}
+	}
+	if len(snapshots) > 0 && src.HasBackingFile() {
+		return fmt.Errorf("qcow2: cannot migrate snapshots of an image with a backing file")
+	}
+	return nil
+}
+
+// migrateClusterSize replays every snapshot and then the active state of src
+// into dst.
+func migrateClusterSize(src, dst *Image, snapshots []*Snapshot) error {
+	srcBuf := make([]byte, dst.clusterSize)
+	dstBuf := make([]byte, dst.clusterSize)
+
+	for _, snap := range snapshots {
+		snap := snap
+		read := func(p []byte, off int64) (int, error) {
+			return src.ReadAtSnapshot(p, off, snap)
+		}
+		if err := replayState(src, dst, read, srcBuf, dstBuf); err != nil {
+			return fmt.Errorf("qcow2: failed to migrate snapshot %q: %w", snap.Name, err)
+		}
+		if _, err := dst.CreateSnapshot(snap.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := replayState(src, dst, src.ReadAt, srcBuf, dstBuf); err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		return dst.Flush()
+	}
+
+	// Carry over snapshot identity, timestamps, and lineage
+	dst.writeMu.Lock()
+	defer dst.writeMu.Unlock()
+	for i, snap := range snapshots {
+		dst.snapshots[i].ID = snap.ID
+		dst.snapshots[i].Date = snap.Date
+		dst.snapshots[i].VMClock = snap.VMClock
+		if snap.ExtraData != nil {
+			dst.snapshots[i].ExtraData = append([]byte(nil), snap.ExtraData...)
+		}
+	}
+	return dst.rewriteSnapshotTable()
+}
+
+// replayState makes the active state of dst match the content produced by
+// read, writing only clusters that differ. On an image without a backing
+// file every cluster is compared; with a backing file only clusters
+// allocated in src are copied so unallocated ranges keep falling through.
+func replayState(src, dst *Image, read func([]byte, int64) (int, error), srcBuf, dstBuf []byte) error {
+	size := uint64(dst.Size())
+	clusterSize := dst.clusterSize
+
+	for off := uint64(0); off < size; off += clusterSize {
+		n := clusterSize
+		if off+n > size {
+			n = size - off
+		}
+
+		if src.backing != nil {
+			var allocated, zero bool
+			err := src.walkExtents(int64(off), int64(n), func(e Extent) error {
+				switch e.Type {
+				case ExtentData:
+					allocated = true
+				case ExtentZero:
+					zero = true
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !allocated && !zero {
+				continue
+			}
+			if !allocated && n == clusterSize {
+				if err := dst.WriteZeroAt(int64(off), int64(n)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if _, err := read(srcBuf[:n], int64(off)); err != nil && err != io.EOF {
+			return fmt.Errorf("read at 0x%x failed: %w", off, err)
+		}
+		if _, err := dst.ReadAt(dstBuf[:n], int64(off)); err != nil && err != io.EOF {
+			return fmt.Errorf("read back at 0x%x failed: %w", off, err)
+		}
+		if bytes.Equal(srcBuf[:n], dstBuf[:n]) {
+			continue
+		}
+
+		if isZeroBuffer(srcBuf[:n]) && n == clusterSize {
+			if err := dst.WriteZeroAt(int64(off), int64(n)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := dst.WriteAt(srcBuf[:n], int64(off)); err != nil {
+			return fmt.Errorf("write at 0x%x failed: %w", off, err)
+		}
+	}
+
+	return nil
+}
+
+// rebaseBackingPath rewrites a relative backing path so it still resolves
+// when the image moves from srcPath to dstPath.
+func rebaseBackingPath(backing, srcPath, dstPath string) string {
+	if backing == "" || filepath.IsAbs(backing) {
+		return backing
+	}
+	abs := filepath.Join(filepath.Dir(srcPath), backing)
+	rel, err := filepath.Rel(filepath.Dir(dstPath), abs)
+	if err != nil {
+		if a, err := filepath.Abs(abs); err == nil {
+			return a
+		}
+		return abs
+	}
+	return rel
+}
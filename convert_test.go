@@ -0,0 +1,357 @@
+// convert_test.go - Convert and checkpoint/resume tests
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// readAll reads the full virtual disk of the image at path.
+func readAll(t *testing.T, path string) []byte {
+	t.Helper()
+	img, err := OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open %s failed: %v", path, err)
+	}
+	defer img.Close()
+	buf := make([]byte, img.Size())
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt %s failed: %v", path, err)
+	}
+	return buf
+}
+
+// TestConvertFlattensChain verifies Convert copies overlay and backing data.
+func TestConvertFlattensChain(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+
+	base, err := CreateSimple(basePath, 8*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := base.WriteAt(testutil.RandomBytes(1, 256*1024), 0); err != nil {
+		t.Fatalf("WriteAt base failed: %v", err)
+	}
+	base.Close()
+
+	overlay, err := CreateOverlay(overlayPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	if _, err := overlay.WriteAt(testutil.RandomBytes(2, 100*1024), 5*1024*1024); err != nil {
+		t.Fatalf("WriteAt overlay failed: %v", err)
+	}
+	overlay.Close()
+
+	if err := Convert(overlayPath, dstPath, ConvertOptions{ClusterBits: 12}); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	if !bytes.Equal(readAll(t, overlayPath), readAll(t, dstPath)) {
+		t.Error("converted image content differs from source")
+	}
+
+	dst, err := Open(dstPath)
+	if err != nil {
+		t.Fatalf("Open dst failed: %v", err)
+	}
+	defer dst.Close()
+	if dst.backing != nil {
+		t.Error("converted image should not have a backing file")
+	}
+	if dst.ClusterSize() != 4096 {
+		t.Errorf("cluster size = %d, want 4096", dst.ClusterSize())
+	}
+}
+
+// TestConvertResumeFromCheckpoint simulates a conversion that died after
+// writing a checkpoint and verifies the rerun skips completed segments.
+func TestConvertResumeFromCheckpoint(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+	cpPath := filepath.Join(dir, "convert.checkpoint")
+
+	size := uint64(4 * DefaultConvertSegmentSize)
+	src, err := CreateSimple(srcPath, size)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	data := testutil.RandomBytes(3, int(size))
+	if _, err := src.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	// Copy the first two segments, checkpoint, then "crash"
+	job := &convertCheckpoint{
+		Version:     checkpointVersion,
+		Source:      srcPath,
+		Dest:        dstPath,
+		VirtualSize: size,
+		ClusterBits: DefaultClusterBits,
+		SegmentSize: DefaultConvertSegmentSize,
+		Done:        make([]byte, 1),
+	}
+	dst, err := openConvertTarget(dstPath, cpPath, job)
+	if err != nil {
+		t.Fatalf("openConvertTarget failed: %v", err)
+	}
+	buf := make([]byte, dst.clusterSize)
+	for seg := uint64(0); seg < 2; seg++ {
+		start := seg * DefaultConvertSegmentSize
+		if err := convertRange(src, dst, start, start+DefaultConvertSegmentSize, buf, false); err != nil {
+			t.Fatalf("convertRange failed: %v", err)
+		}
+		job.markDone(seg)
+	}
+	if err := dst.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := saveCheckpoint(cpPath, job); err != nil {
+		t.Fatalf("saveCheckpoint failed: %v", err)
+	}
+	dst.Close()
+
+	// Change the source inside a completed segment; a resumed convert must not
+	// copy it again, which proves the segment was skipped
+	if _, err := src.WriteAt(bytes.Repeat([]byte{0xEE}, 4096), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	src.Close()
+
+	if err := Convert(srcPath, dstPath, ConvertOptions{CheckpointPath: cpPath}); err != nil {
+		t.Fatalf("resumed Convert failed: %v", err)
+	}
+
+	if !bytes.Equal(readAll(t, dstPath), data) {
+		t.Error("resumed conversion content mismatch")
+	}
+	if testutil.FileExists(cpPath) {
+		t.Error("checkpoint should be removed after a successful convert")
+	}
+}
+
+// TestConvertCheckpointMismatch verifies a stale checkpoint is not reused.
+func TestConvertCheckpointMismatch(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.qcow2")
+	cpPath := filepath.Join(dir, "convert.checkpoint")
+
+	src, err := CreateSimple(srcPath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	src.Close()
+
+	stale := &convertCheckpoint{Version: checkpointVersion, Source: "other.qcow2", Done: []byte{0}}
+	if err := saveCheckpoint(cpPath, stale); err != nil {
+		t.Fatalf("saveCheckpoint failed: %v", err)
+	}
+
+	err = Convert(srcPath, filepath.Join(dir, "dst.qcow2"), ConvertOptions{CheckpointPath: cpPath})
+	if err == nil {
+		t.Fatal("expected error for mismatched checkpoint")
+	}
+}
+
+// TestConvertWorkers verifies concurrent segment copies produce the same image.
+func TestConvertWorkers(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+	cpPath := filepath.Join(dir, "convert.checkpoint")
+
+	size := uint64(8 * DefaultConvertSegmentSize)
+	src, err := CreateSimple(srcPath, size)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	// Scatter data across every segment, leaving holes in between
+	for seg := uint64(0); seg < 8; seg++ {
+		data := testutil.RandomBytes(int64(seg), 300*1024)
+		if _, err := src.WriteAt(data, int64(seg*DefaultConvertSegmentSize+seg*4096)); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	src.Close()
+
+	opts := ConvertOptions{
+		Workers:            4,
+		CheckpointPath:     cpPath,
+		CheckpointInterval: DefaultConvertSegmentSize,
+	}
+	if err := Convert(srcPath, dstPath, opts); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	if !bytes.Equal(readAll(t, srcPath), readAll(t, dstPath)) {
+		t.Error("converted image content differs from source")
+	}
+}
+
+// TestConvertClusterSizePreservesSnapshots verifies every snapshot and the
+// active state survive a cluster size change.
+func TestConvertClusterSizePreservesSnapshots(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+
+	img, err := CreateSimple(srcPath, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(1, 200*1024), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("first"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(2, 10*1024), 70*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(128*1024, 64*1024); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("second"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(3, 64*1024), 3*1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	if err := ConvertClusterSize(srcPath, dstPath, 12); err != nil {
+		t.Fatalf("ConvertClusterSize failed: %v", err)
+	}
+
+	src, err := OpenFile(srcPath, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open src failed: %v", err)
+	}
+	defer src.Close()
+	dst, err := OpenFile(dstPath, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open dst failed: %v", err)
+	}
+	defer dst.Close()
+
+	if dst.ClusterSize() != 4096 {
+		t.Errorf("ClusterSize = %d, want 4096", dst.ClusterSize())
+	}
+
+	srcSnaps, dstSnaps := src.Snapshots(), dst.Snapshots()
+	if len(dstSnaps) != len(srcSnaps) {
+		t.Fatalf("got %d snapshots, want %d", len(dstSnaps), len(srcSnaps))
+	}
+
+	want := make([]byte, src.Size())
+	got := make([]byte, dst.Size())
+	for i, s := range srcSnaps {
+		d := dstSnaps[i]
+		if d.Name != s.Name || d.ID != s.ID || !d.Date.Equal(s.Date) {
+			t.Errorf("snapshot %d = %q/%q, want %q/%q", i, d.ID, d.Name, s.ID, s.Name)
+		}
+		if _, err := src.ReadAtSnapshot(want, 0, s); err != nil {
+			t.Fatalf("ReadAtSnapshot src failed: %v", err)
+		}
+		if _, err := dst.ReadAtSnapshot(got, 0, d); err != nil {
+			t.Fatalf("ReadAtSnapshot dst failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("snapshot %q content differs", s.Name)
+		}
+	}
+
+	if !bytes.Equal(readAll(t, srcPath), readAll(t, dstPath)) {
+		t.Error("active content differs from source")
+	}
+}
+
+// TestConvertClusterSizeRejectsBackedSnapshots verifies images that combine
+// a backing file with snapshots fail cleanly.
+func TestConvertClusterSizeRejectsBackedSnapshots(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	base.Close()
+
+	overlay, err := CreateOverlay(overlayPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	if _, err := overlay.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	overlay.Close()
+
+	if err := ConvertClusterSize(overlayPath, dstPath, 21); err == nil {
+		t.Fatal("expected error for backed image with snapshots")
+	}
+	if testutil.FileExists(dstPath) {
+		t.Error("destination should not be created")
+	}
+}
+
+// TestConvertClusterSizeKeepsBacking verifies an overlay stays an overlay.
+func TestConvertClusterSizeKeepsBacking(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+
+	base, err := CreateSimple(basePath, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := base.WriteAt(testutil.RandomBytes(1, 1024*1024), 0); err != nil {
+		t.Fatalf("WriteAt base failed: %v", err)
+	}
+	base.Close()
+
+	overlay, err := CreateOverlay(overlayPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	if _, err := overlay.WriteAt(testutil.RandomBytes(2, 4096), 300*1024); err != nil {
+		t.Fatalf("WriteAt overlay failed: %v", err)
+	}
+	overlay.Close()
+
+	if err := ConvertClusterSize(overlayPath, dstPath, 21); err != nil {
+		t.Fatalf("ConvertClusterSize failed: %v", err)
+	}
+
+	dst, err := OpenFile(dstPath, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open dst failed: %v", err)
+	}
+	hasBacking := dst.HasBackingFile()
+	dst.Close()
+	if !hasBacking {
+		t.Error("converted overlay lost its backing file")
+	}
+	if !bytes.Equal(readAll(t, overlayPath), readAll(t, dstPath)) {
+		t.Error("converted overlay content differs from source")
+	}
+}
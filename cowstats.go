@@ -0,0 +1,118 @@
+package qcow2
+
+import "math/bits"
+
+// LayerCOWStats describes how far an image has diverged from one layer of
+// its backing chain, counted in clusters of the image.
+type LayerCOWStats struct {
+	Depth    int    // 1 for the backing file, 2 for its backing file, and so on
+	Filename string // Path the layer was opened from
+
+	// Clusters is the number of clusters the layer supplies to the chain:
+	// those allocated in it and in no layer above it, not counting the
+	// image itself.
+	Clusters uint64
+
+	// Copied is the number of those clusters the image has since written,
+	// by copy-on-write or by overwriting or zeroing them outright, and so
+	// no longer reads from the layer.
+	Copied uint64
+}
+
+// CopiedRatio returns the fraction of the layer's clusters the image no
+// longer reads from it, or 0 if it supplies none. An overlay whose ratio
+// nears 1 gains little from its backing file and is a candidate for
+// flattening.
+func (s LayerCOWStats) CopiedRatio() float64 {
+	if s.Clusters == 0 {
+		return 0
+	}
+	return float64(s.Copied) / float64(s.Clusters)
+}
+
+// COWStats returns copy-on-write statistics for each layer of the backing
+// chain, nearest first. The counts are derived from the allocation maps,
+// so they cover every write since the overlay was created, not just those
+// of this session. It returns nil for an image without a backing file.
+//
+// A raw backing file supplies every cluster within its size.
+func (img *Image) COWStats() ([]LayerCOWStats, error) {
+	if img.backing == nil {
+		return nil, nil
+	}
+	clusters := (uint64(img.Size()) + img.clusterSize - 1) >> img.clusterBits
+	top, err := img.allocatedClusters(img, clusters)
+	if err != nil {
+		return nil, err
+	}
+	remaining := make([]uint64, len(top))
+	for i := range remaining {
+		remaining[i] = ^uint64(0)
+	}
+
+	var stats []LayerCOWStats
+	for layer, depth := img.backing, 1; layer != nil; depth++ {
+		if r, ok := layer.(*retryingBacking); ok {
+			layer = r.current()
+		}
+		var alloc []uint64
+		var next BackingStore
+		s := LayerCOWStats{Depth: depth}
+		switch l := layer.(type) {
+		case *Image:
+			s.Filename = l.file.Name()
+			if alloc, err = img.allocatedClusters(l, clusters); err != nil {
+				return nil, err
+			}
+			next = l.backing
+		case *RawImage:
+			s.Filename = l.file.Name()
+			fi, err := l.file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			alloc = make([]uint64, len(top))
+			img.markClusters(alloc, clusters, 0, uint64(fi.Size()))
+		default:
+			alloc = make([]uint64, len(top))
+		}
+
+		for i := range alloc {
+			supplied := alloc[i] & remaining[i]
+			s.Clusters += uint64(bits.OnesCount64(supplied))
+			s.Copied += uint64(bits.OnesCount64(supplied & top[i]))
+			remaining[i] &^= supplied
+		}
+		stats = append(stats, s)
+		layer = next
+	}
+	return stats, nil
+}
+
+// allocatedClusters returns a bitmap, in clusters of img, of the ranges
+// layer stores itself as data or zero clusters.
+func (img *Image) allocatedClusters(layer *Image, clusters uint64) ([]uint64, error) {
+	bitmap := make([]uint64, (clusters+63)/64)
+	extents, err := layer.Map(0, layer.Size())
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range extents {
+		if e.Type == ExtentData || e.Type == ExtentZero {
+			img.markClusters(bitmap, clusters, e.Start, e.End())
+		}
+	}
+	return bitmap, nil
+}
+
+// markClusters sets the bits of the clusters of img overlapping
+// [start, end) in bitmap.
+func (img *Image) markClusters(bitmap []uint64, clusters, start, end uint64) {
+	if start >= end || clusters == 0 {
+		return
+	}
+	last := min((end-1)>>img.clusterBits, clusters-1)
+	for c := start >> img.clusterBits; c <= last; c++ {
+		bitmap[c/64] |= 1 << (c % 64)
+	}
+}
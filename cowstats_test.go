@@ -0,0 +1,90 @@
+// cowstats_test.go - Copy-on-write statistics tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestCOWStats checks clusters are credited to the nearest layer that
+// supplies them, and counted as copied once the overlay writes them.
+func TestCOWStats(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	midPath := filepath.Join(dir, "mid.qcow2")
+	topPath := filepath.Join(dir, "top.qcow2")
+
+	write := func(img *Image, clusters ...int) {
+		t.Helper()
+		cs := img.ClusterSize()
+		for _, c := range clusters {
+			if _, err := img.WriteAt(bytes.Repeat([]byte{0xaa}, cs), int64(c*cs)); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+		}
+	}
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	write(base, 0, 1, 2)
+	base.Close()
+
+	mid, err := CreateOverlay(midPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	write(mid, 2, 3)
+	mid.Close()
+
+	img, err := CreateOverlay(topPath, midPath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	defer img.Close()
+
+	stats, err := img.COWStats()
+	if err != nil {
+		t.Fatalf("COWStats failed: %v", err)
+	}
+	if len(stats) != 2 || stats[0].Copied != 0 || stats[1].Copied != 0 {
+		t.Fatalf("fresh overlay stats = %+v, want two layers with nothing copied", stats)
+	}
+
+	write(img, 0, 3, 5)
+	if err := img.WriteZeroAt(int64(img.ClusterSize()), int64(img.ClusterSize())); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	stats, err = img.COWStats()
+	if err != nil {
+		t.Fatalf("COWStats failed: %v", err)
+	}
+	want := []LayerCOWStats{
+		{Depth: 1, Filename: midPath, Clusters: 2, Copied: 1},
+		{Depth: 2, Filename: basePath, Clusters: 2, Copied: 2},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d layers, want %d", len(stats), len(want))
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("layer %d = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+	if r := stats[1].CopiedRatio(); r != 1 {
+		t.Errorf("base CopiedRatio = %v, want 1", r)
+	}
+
+	plain, err := CreateSimple(filepath.Join(dir, "plain.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer plain.Close()
+	if stats, err := plain.COWStats(); err != nil || stats != nil {
+		t.Errorf("COWStats without backing = %+v, %v; want nil, nil", stats, err)
+	}
+}
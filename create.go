@@ -3,6 +3,7 @@ package qcow2
 import (
 	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"os"
 )
 
@@ -12,7 +13,10 @@ type CreateOptions struct {
 	Size uint64
 
 	// ClusterBits is log2 of cluster size. Default is 16 (64KB clusters).
-	// Valid range: 9-21.
+	// Valid range: 9-21 (512 bytes to 2MB). Small clusters limit the
+	// virtual size, since the L1 table may not exceed 32MB (about 2TB with
+	// 512-byte clusters), and the header and backing file name must fit in
+	// the first cluster.
 	ClusterBits uint32
 
 	// Version is the QCOW2 version. Default is 3.
@@ -28,29 +32,84 @@ type CreateOptions struct {
 	// BackingFormat specifies the format of the backing file (e.g., "qcow2", "raw").
 	// If empty and BackingFile is set, defaults to "qcow2".
 	BackingFormat string
+
+	// Compat is the oldest QEMU the image must stay usable with. It sets
+	// the version when Version is 0, and the returned Image refuses
+	// features beyond it; see CompatLevel. Default is CompatAny.
+	Compat CompatLevel
+
+	// RefcountBits is the width of a refcount entry, a power of two from 1
+	// to 64. Default is 16, the only width version 2 images allow.
+	RefcountBits uint32
+
+	// CompressionLevel and CompressionType set the write compression of
+	// the returned Image, as SetCompressionLevel and SetCompressionType
+	// do. They are not stored in the file.
+	CompressionLevel CompressionLevel
+	CompressionType  uint8
+
+	// PreallocateMetadata allocates the L2 tables and refcount blocks for
+	// the whole disk up front; see Image.PreallocateMetadata.
+	PreallocateMetadata bool
+
+	// AutoGrow lets writes past the end of the returned Image grow it up
+	// to this many bytes, as WithAutoGrow does. It is not stored in the
+	// file.
+	AutoGrow uint64
+
+	// Profile names a creation profile (see CreateProfiles) whose settings
+	// fill in the fields above that are left at their zero value.
+	Profile string
 }
 
-// Create creates a new QCOW2 image file.
+// Create creates a new QCOW2 image file. If path is an existing block
+// device, such as an LVM logical volume, the image is written to the start
+// of the device instead; Open works on such devices too. The image can then
+// grow up to the size of the device, beyond which allocating writes fail
+// with ErrDeviceFull.
 func Create(path string, opts CreateOptions) (*Image, error) {
 	if opts.Size == 0 {
 		return nil, fmt.Errorf("qcow2: size is required")
 	}
+	if opts.Profile != "" {
+		p, ok := LookupCreateProfile(opts.Profile)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownProfile, opts.Profile)
+		}
+		p.apply(&opts)
+	}
 
 	// Apply defaults
+	if opts.RefcountBits == 0 {
+		opts.RefcountBits = 16
+	}
 	if opts.ClusterBits == 0 {
 		opts.ClusterBits = DefaultClusterBits
 	}
 	if opts.Version == 0 {
-		opts.Version = Version3
+		opts.Version = opts.Compat.version()
 	}
 
 	// Validate
-	if opts.ClusterBits < MinClusterBits || opts.ClusterBits > MaxClusterBits {
-		return nil, fmt.Errorf("%w: %d", ErrInvalidClusterBits, opts.ClusterBits)
+	if err := invalidClusterBits(opts.ClusterBits); err != nil {
+		return nil, err
 	}
 	if opts.Version != Version2 && opts.Version != Version3 {
 		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, opts.Version)
 	}
+	if opts.Compat != CompatAny && opts.Version != opts.Compat.version() {
+		return nil, fmt.Errorf("%w: version %d image at compat=%s", ErrCompatLevel, opts.Version, opts.Compat)
+	}
+	if opts.LazyRefcounts && opts.Version < Version3 {
+		return nil, fmt.Errorf("%w: lazy refcounts need a version 3 image", ErrCompatLevel)
+	}
+	refcountOrder := uint32(bits.TrailingZeros32(opts.RefcountBits))
+	if opts.RefcountBits > 64 || opts.RefcountBits&(opts.RefcountBits-1) != 0 {
+		return nil, fmt.Errorf("qcow2: refcount width of %d bits is not a power of two from 1 to 64", opts.RefcountBits)
+	}
+	if opts.RefcountBits != 16 && opts.Version < Version3 {
+		return nil, fmt.Errorf("%w: %d-bit refcounts need a version 3 image", ErrCompatLevel, opts.RefcountBits)
+	}
 
 	clusterSize := uint64(1) << opts.ClusterBits
 	l2Entries := clusterSize / 8
@@ -73,8 +132,8 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 	// Layout the image:
 	// Cluster 0: Header
 	// Cluster 1+: L1 table (may span multiple clusters)
-	// Next cluster: Refcount table
-	// Next cluster: First refcount block
+	// Next clusters: Refcount table
+	// Next clusters: Refcount blocks for the clusters above
 	// Remaining: Data clusters
 
 	headerLength := uint32(HeaderSizeV3)
@@ -88,15 +147,33 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		l1Clusters = 1
 	}
 
-	l1TableOffset := clusterSize                                  // Starts at cluster 1
-	refcountTableOffset := clusterSize + l1Clusters*clusterSize   // After L1 table
-	firstRefcountBlockOffset := refcountTableOffset + clusterSize // After refcount table
+	if l1TableBytes > maxL1TableBytes {
+		return nil, fmt.Errorf("%w: %d-byte clusters need a %d-byte L1 table for a %d-byte disk (limit %d)",
+			ErrInvalidClusterBits, clusterSize, l1TableBytes, opts.Size, maxL1TableBytes)
+	}
 
-	// Calculate refcount table size
-	// With 16-bit refcounts and 64KB clusters, one refcount block covers:
-	// 65536 / 2 = 32768 clusters = 2GB
-	// For simplicity, start with 1 cluster for refcount table
-	refcountTableClusters := uint32(1)
+	// Size the refcount structures. The refcount table cannot grow yet, so
+	// make it cover twice a fully allocated image (data, L2 tables and
+	// metadata), leaving headroom for snapshots and COW. With 64KB clusters
+	// one table cluster covers 16TB of file, so only small clusters need more.
+	// The refcount blocks for the initial clusters are written up front.
+	refcountsPerBlock := clusterSize * 8 / uint64(opts.RefcountBits)
+	fullClusters := 1 + l1Clusters + (opts.Size+clusterSize-1)/clusterSize + l1Size
+	fullBlocks := (2*fullClusters + refcountsPerBlock - 1) / refcountsPerBlock
+	refcountTableClusters := (fullBlocks*8 + clusterSize - 1) / clusterSize
+	refcountBlocks := uint64(1)
+	for {
+		initial := 1 + l1Clusters + refcountTableClusters + refcountBlocks
+		needed := (initial + refcountsPerBlock - 1) / refcountsPerBlock
+		if needed <= refcountBlocks {
+			break
+		}
+		refcountBlocks = needed
+	}
+
+	l1TableOffset := clusterSize                                                        // Starts at cluster 1
+	refcountTableOffset := clusterSize + l1Clusters*clusterSize                         // After L1 table
+	firstRefcountBlockOffset := refcountTableOffset + refcountTableClusters*clusterSize // After refcount table
 
 	// Calculate extension area size
 	extensionAreaOffset := uint64(headerLength)
@@ -124,6 +201,12 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		backingFileSize = uint32(len(opts.BackingFile))
 	}
 
+	// Header, extensions and backing file name must fit in cluster 0
+	if end := extensionAreaOffset + extensionAreaSize + uint64(backingFileSize); end > clusterSize {
+		return nil, fmt.Errorf("%w: %d-byte header area does not fit in a %d-byte cluster",
+			ErrInvalidClusterBits, end, clusterSize)
+	}
+
 	// Build header
 	header := &Header{
 		Magic:                 Magic,
@@ -135,8 +218,8 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		L1Size:                uint32(l1Size),
 		L1TableOffset:         l1TableOffset,
 		RefcountTableOffset:   refcountTableOffset,
-		RefcountTableClusters: refcountTableClusters,
-		RefcountOrder:         4, // 16-bit refcounts
+		RefcountTableClusters: uint32(refcountTableClusters),
+		RefcountOrder:         refcountOrder,
 		HeaderLength:          headerLength,
 	}
 
@@ -144,17 +227,33 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		header.CompatibleFeatures |= CompatLazyRefcounts
 	}
 
-	// Create file
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	// Create file, or take over a block device
+	f, device, err := createHostFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("qcow2: failed to create file: %w", err)
 	}
+	removeFile := func() {
+		if !device {
+			os.Remove(path)
+		}
+	}
+
+	initialClusters := 1 + l1Clusters + refcountTableClusters + refcountBlocks
+	initialSize := initialClusters * clusterSize
+
+	// A device may hold stale data where the header and tables go
+	if device {
+		if err := zeroDeviceStart(f, int64(initialSize)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 
 	// Write header
 	headerBytes := header.Encode()
 	if _, err := f.WriteAt(headerBytes, 0); err != nil {
 		f.Close()
-		os.Remove(path)
+		removeFile()
 		return nil, fmt.Errorf("qcow2: failed to write header: %w", err)
 	}
 
@@ -168,7 +267,7 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		binary.BigEndian.PutUint32(extHeader[4:8], uint32(len(opts.BackingFormat)))
 		if _, err := f.WriteAt(extHeader, extOffset); err != nil {
 			f.Close()
-			os.Remove(path)
+			removeFile()
 			return nil, fmt.Errorf("qcow2: failed to write backing format extension header: %w", err)
 		}
 		extOffset += 8
@@ -179,7 +278,7 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		copy(extData, opts.BackingFormat)
 		if _, err := f.WriteAt(extData, extOffset); err != nil {
 			f.Close()
-			os.Remove(path)
+			removeFile()
 			return nil, fmt.Errorf("qcow2: failed to write backing format extension data: %w", err)
 		}
 		extOffset += int64(extPaddedLen)
@@ -188,7 +287,7 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 		endMarker := make([]byte, 8) // All zeros = end marker
 		if _, err := f.WriteAt(endMarker, extOffset); err != nil {
 			f.Close()
-			os.Remove(path)
+			removeFile()
 			return nil, fmt.Errorf("qcow2: failed to write end-of-header marker: %w", err)
 		}
 	}
@@ -197,7 +296,7 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 	if opts.BackingFile != "" {
 		if _, err := f.WriteAt([]byte(opts.BackingFile), int64(backingFileOffset)); err != nil {
 			f.Close()
-			os.Remove(path)
+			removeFile()
 			return nil, fmt.Errorf("qcow2: failed to write backing file path: %w", err)
 		}
 	}
@@ -206,65 +305,77 @@ func Create(path string, opts CreateOptions) (*Image, error) {
 	l1Table := make([]byte, l1TableBytes)
 	if _, err := f.WriteAt(l1Table, int64(l1TableOffset)); err != nil {
 		f.Close()
-		os.Remove(path)
+		removeFile()
 		return nil, fmt.Errorf("qcow2: failed to write L1 table: %w", err)
 	}
 
 	// Write refcount table
-	// First entry points to the first refcount block
-	refcountTable := make([]byte, clusterSize)
-	binary.BigEndian.PutUint64(refcountTable[0:8], firstRefcountBlockOffset)
+	// Leading entries point to the initial refcount blocks
+	refcountTable := make([]byte, refcountTableClusters*clusterSize)
+	for i := uint64(0); i < refcountBlocks; i++ {
+		binary.BigEndian.PutUint64(refcountTable[i*8:], firstRefcountBlockOffset+i*clusterSize)
+	}
 	if _, err := f.WriteAt(refcountTable, int64(refcountTableOffset)); err != nil {
 		f.Close()
-		os.Remove(path)
+		removeFile()
 		return nil, fmt.Errorf("qcow2: failed to write refcount table: %w", err)
 	}
 
-	// Write first refcount block
+	// Write initial refcount blocks
 	// Mark all initial clusters as used (refcount = 1)
 	// Cluster 0: header
 	// Clusters 1 to l1Clusters: L1 table
-	// Next cluster: refcount table
-	// Next cluster: refcount block
-	refcountBlock := make([]byte, clusterSize)
-
-	// Calculate total initial clusters
-	// 1 (header) + l1Clusters (L1 table) + 1 (refcount table) + 1 (refcount block)
-	initialClusters := 1 + l1Clusters + 2
+	// Next clusters: refcount table
+	// Next clusters: refcount blocks
+	refcountBlock := make([]byte, refcountBlocks*clusterSize)
 
 	// Mark each initial cluster with refcount = 1
 	for i := uint64(0); i < initialClusters; i++ {
-		binary.BigEndian.PutUint16(refcountBlock[i*2:(i+1)*2], 1)
+		writeRefcountEntry(refcountBlock, i, opts.RefcountBits, 1)
 	}
 
 	if _, err := f.WriteAt(refcountBlock, int64(firstRefcountBlockOffset)); err != nil {
 		f.Close()
-		os.Remove(path)
+		removeFile()
 		return nil, fmt.Errorf("qcow2: failed to write refcount block: %w", err)
 	}
 
-	// Extend file to include all initial clusters
-	initialSize := initialClusters * clusterSize
-	if err := f.Truncate(int64(initialSize)); err != nil {
-		f.Close()
-		os.Remove(path)
-		return nil, fmt.Errorf("qcow2: failed to set file size: %w", err)
+	// Extend file to include all initial clusters; on a device the end of
+	// the image is found from its metadata when it is opened
+	if !device {
+		if err := f.Truncate(int64(initialSize)); err != nil {
+			f.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("qcow2: failed to set file size: %w", err)
+		}
 	}
 
 	// Sync to disk
 	if err := f.Sync(); err != nil {
 		f.Close()
-		os.Remove(path)
+		removeFile()
 		return nil, fmt.Errorf("qcow2: failed to sync: %w", err)
 	}
 
 	// Now open as normal image (depth=0 for newly created image)
-	img, err := newImage(f, false, 0)
+	img, err := newImage(f, false, 0, WithMaxVirtualSize(0))
 	if err != nil {
 		f.Close()
-		os.Remove(path)
+		removeFile()
 		return nil, err
 	}
+	img.compat = opts.Compat
+	img.compressionLevel = opts.CompressionLevel
+	img.compressionType = opts.CompressionType
+	img.autoGrow = opts.AutoGrow
+
+	if opts.PreallocateMetadata {
+		if err := img.PreallocateMetadata(0, img.Size()); err != nil {
+			img.Close()
+			removeFile()
+			return nil, err
+		}
+	}
 
 	return img, nil
 }
@@ -284,7 +395,7 @@ func CreateSimple(path string, size uint64) (*Image, error) {
 //	overlay, err := qcow2.CreateOverlay("snapshot.qcow2", "base.qcow2")
 func CreateOverlay(path, backingFile string) (*Image, error) {
 	// Open backing file to get its size
-	backing, err := OpenFile(backingFile, os.O_RDONLY, 0)
+	backing, err := OpenFile(backingFile, os.O_RDONLY, 0, WithMaxVirtualSize(0))
 	if err != nil {
 		return nil, fmt.Errorf("qcow2: failed to open backing file: %w", err)
 	}
@@ -6,6 +6,7 @@ package qcow2
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -1342,22 +1343,61 @@ func TestHugeVirtualSize(t *testing.T) {
 	}
 	f.Close()
 
-	// Open might succeed (virtual size is just a number)
-	img2, err := Open(path)
+	// The default limit rejects the header
+	if _, err := Open(path); !errors.Is(err, ErrVirtualSizeLimit) {
+		t.Fatalf("Open huge image: got %v, want ErrVirtualSizeLimit", err)
+	}
+
+	// Lifting the limit still refuses a size no L1 table could cover
+	if _, err := Open(path, WithMaxVirtualSize(1<<61)); !errors.Is(err, ErrL1TableSize) {
+		t.Fatalf("Open with raised limit: got %v, want ErrL1TableSize", err)
+	}
+
+	// Removing the checks opens it; reads of the real data still work
+	img2, err := Open(path, WithMaxVirtualSize(0))
 	if err != nil {
-		t.Logf("Open huge image: %v", err)
-		return
+		t.Fatalf("Open without limit failed: %v", err)
 	}
 	defer img2.Close()
+	if img2.Size() != 1<<60 {
+		t.Errorf("Size = %d, want %d", img2.Size(), int64(1)<<60)
+	}
+	buf := make([]byte, 4096)
+	if _, err := img2.ReadAt(buf, 0); err != nil {
+		t.Errorf("ReadAt on huge image: %v", err)
+	}
+}
+
+// TestMaxVirtualSizeBackingChain tests that the virtual size limit applies
+// to backing files too.
+func TestMaxVirtualSizeBackingChain(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
 
-	t.Logf("Image reports size: %d bytes", img2.Size())
+	base, err := CreateSimple(basePath, 2*1024*1024*1024)
+	if err != nil {
+		t.Fatalf("Create base failed: %v", err)
+	}
+	base.Close()
 
-	// Read at offset 0 should work (if there's data)
-	buf := make([]byte, 4096)
-	_, err = img2.ReadAt(buf, 0)
+	// A small overlay over a larger base
+	overlay, err := Create(overlayPath, CreateOptions{Size: 1024 * 1024, BackingFile: basePath})
 	if err != nil {
-		t.Logf("ReadAt on huge image: %v", err)
+		t.Fatalf("Create overlay failed: %v", err)
 	}
+	overlay.Close()
+
+	if _, err := Open(overlayPath, WithMaxVirtualSize(1024*1024*1024)); !errors.Is(err, ErrVirtualSizeLimit) {
+		t.Fatalf("Open with limit below base size: got %v, want ErrVirtualSizeLimit", err)
+	}
+
+	img, err := Open(overlayPath, WithMaxVirtualSize(0))
+	if err != nil {
+		t.Fatalf("Open without limit failed: %v", err)
+	}
+	img.Close()
 }
 
 // TestInvalidCompressedDescriptor tests handling of bad compressed cluster descriptor.
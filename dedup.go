@@ -0,0 +1,131 @@
+package qcow2
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+)
+
+// DuplicationStats counts the allocated clusters of one image, or of a set
+// of images, by whether their contents occur more than once.
+type DuplicationStats struct {
+	Clusters       uint64 // Allocated clusters hashed
+	ZeroClusters   uint64 // Allocated clusters holding only zeros
+	UniqueClusters uint64 // Distinct non-zero contents
+	SharedClusters uint64 // Clusters mapping a host cluster already counted
+
+	// DuplicateClusters are non-zero clusters whose contents were seen
+	// before in another host cluster: what a dedup copy would merge.
+	DuplicateClusters uint64
+}
+
+// Savings returns the bytes a dedup copy could save: duplicate clusters
+// stored once and zero clusters replaced by the zero flag. Compressed
+// clusters are counted at full cluster size, so this is an upper bound.
+func (s DuplicationStats) Savings(clusterSize uint64) uint64 {
+	return (s.DuplicateClusters + s.ZeroClusters) * clusterSize
+}
+
+// DuplicationReport is the result of AnalyzeDuplication.
+type DuplicationReport struct {
+	ClusterSize uint64
+	Images      []DuplicationStats // Each image on its own, in argument order
+	Total       DuplicationStats   // All images together
+}
+
+// Savings returns the bytes a dedup copy of all the images into one store
+// could save.
+func (r *DuplicationReport) Savings() uint64 {
+	return r.Total.Savings(r.ClusterSize)
+}
+
+// AnalyzeDuplication hashes the clusters allocated in each image and
+// counts how many hold contents that occur elsewhere, within the image and
+// across the set, to judge whether deduplicating them would pay off. It
+// only reads. Clusters an image leaves to its backing file are not
+// counted; pass the backing image too to include them. All images must
+// have the same cluster size.
+//
+// It returns early with ctx.Err() if the context is cancelled, and runs at
+// the priority ctx carries (WithPriority). Memory grows with the number of
+// clusters: a hash per distinct content and a host offset per allocated
+// cluster, plus map overhead.
+func AnalyzeDuplication(ctx context.Context, imgs ...*Image) (*DuplicationReport, error) {
+	if len(imgs) == 0 {
+		return nil, fmt.Errorf("qcow2: no images to analyze")
+	}
+	report := &DuplicationReport{
+		ClusterSize: imgs[0].clusterSize,
+		Images:      make([]DuplicationStats, len(imgs)),
+	}
+	seen := make(map[[sha256.Size]byte]struct{})
+	for i, img := range imgs {
+		if img.clusterSize != report.ClusterSize {
+			return nil, fmt.Errorf("qcow2: cluster size %d of image %d differs from %d",
+				img.clusterSize, i, report.ClusterSize)
+		}
+		if err := img.analyzeDuplication(ctx, seen, &report.Images[i], &report.Total); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// analyzeDuplication adds the image's clusters to its own stats and to
+// total, whose contents so far are in seen.
+func (img *Image) analyzeDuplication(ctx context.Context, seen map[[sha256.Size]byte]struct{},
+	stats, total *DuplicationStats) error {
+	own := make(map[[sha256.Size]byte]struct{})
+	hosts := make(map[uint64]struct{})
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+
+	size := uint64(img.Size())
+	for off := uint64(0); off < size; off += img.clusterSize {
+		desc, err := img.DescribeCluster(off)
+		if err != nil {
+			return err
+		}
+		if desc.Type != ClusterNormal && desc.Type != ClusterCompressed {
+			continue
+		}
+		if _, err := img.waitTurn(ctx); err != nil {
+			return err
+		}
+		stats.Clusters++
+		total.Clusters++
+
+		// Clusters already sharing storage cost nothing extra
+		if _, ok := hosts[desc.HostOffset]; ok {
+			stats.SharedClusters++
+			total.SharedClusters++
+			continue
+		}
+		hosts[desc.HostOffset] = struct{}{}
+
+		n := min(img.clusterSize, size-off)
+		if _, err := img.readUntracked(buf[:n], int64(off)); err != nil {
+			return fmt.Errorf("qcow2: duplication scan at 0x%x failed: %w", off, err)
+		}
+		if isZeroBuffer(buf[:n]) {
+			stats.ZeroClusters++
+			total.ZeroClusters++
+			continue
+		}
+
+		sum := sha256.Sum256(buf[:n])
+		if _, ok := own[sum]; ok {
+			stats.DuplicateClusters++
+		} else {
+			own[sum] = struct{}{}
+			stats.UniqueClusters++
+		}
+		if _, ok := seen[sum]; ok {
+			total.DuplicateClusters++
+		} else {
+			seen[sum] = struct{}{}
+			total.UniqueClusters++
+		}
+	}
+	return nil
+}
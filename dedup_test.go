@@ -0,0 +1,72 @@
+// dedup_test.go - Duplication analysis tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// TestAnalyzeDuplication checks duplicates are counted within each image
+// and across the set.
+func TestAnalyzeDuplication(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	create := func(name string, clusters ...[]byte) *Image {
+		t.Helper()
+		img, err := CreateSimple(filepath.Join(dir, name), 16*1024*1024)
+		if err != nil {
+			t.Fatalf("CreateSimple failed: %v", err)
+		}
+		t.Cleanup(func() { img.Close() })
+		for i, data := range clusters {
+			if _, err := img.WriteAt(data, int64(i)*int64(img.ClusterSize())); err != nil {
+				t.Fatalf("WriteAt failed: %v", err)
+			}
+		}
+		return img
+	}
+	cs := 64 * 1024
+	x := bytes.Repeat([]byte{'x'}, cs)
+	y := bytes.Repeat([]byte{'y'}, cs)
+	z := bytes.Repeat([]byte{'z'}, cs)
+
+	// Clusters: x, x, y, a written cluster of zeros
+	a := create("a.qcow2", x, x, y, make([]byte, cs))
+	b := create("b.qcow2", x, z)
+	if desc, err := a.DescribeCluster(3 * uint64(cs)); err != nil || desc.Type != ClusterNormal {
+		t.Fatalf("zero data cluster: %+v, %v", desc, err)
+	}
+
+	report, err := AnalyzeDuplication(context.Background(), a, b)
+	if err != nil {
+		t.Fatalf("AnalyzeDuplication failed: %v", err)
+	}
+	wantA := DuplicationStats{Clusters: 4, ZeroClusters: 1, UniqueClusters: 2, DuplicateClusters: 1}
+	wantB := DuplicationStats{Clusters: 2, UniqueClusters: 2}
+	wantTotal := DuplicationStats{Clusters: 6, ZeroClusters: 1, UniqueClusters: 3, DuplicateClusters: 2}
+	if report.Images[0] != wantA {
+		t.Errorf("image a: %+v, want %+v", report.Images[0], wantA)
+	}
+	if report.Images[1] != wantB {
+		t.Errorf("image b: %+v, want %+v", report.Images[1], wantB)
+	}
+	if report.Total != wantTotal {
+		t.Errorf("total: %+v, want %+v", report.Total, wantTotal)
+	}
+	if got := report.Savings(); got != 3*uint64(cs) {
+		t.Errorf("Savings = %d, want %d", got, 3*cs)
+	}
+
+	small, err := Create(filepath.Join(dir, "small.qcow2"), CreateOptions{Size: 1024 * 1024, ClusterBits: 12})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer small.Close()
+	if _, err := AnalyzeDuplication(context.Background(), a, small); err == nil {
+		t.Error("AnalyzeDuplication accepted images of different cluster sizes")
+	}
+}
@@ -0,0 +1,243 @@
+package qcow2
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// delayedAllocator buffers writes to unallocated clusters in memory until
+// they are flushed (see WithDelayedAllocation).
+type delayedAllocator struct {
+	mu       sync.Mutex
+	limit    uint64
+	size     uint64
+	clusters map[uint64][]byte // guest cluster offset -> cluster data
+}
+
+func newDelayedAllocator(limit uint64) *delayedAllocator {
+	return &delayedAllocator{
+		limit:    limit,
+		clusters: make(map[uint64][]byte),
+	}
+}
+
+// delayedActive reports whether writes to unallocated clusters are
+// buffered. Images whose data needs per-cluster handling write through.
+func (img *Image) delayedActive() bool {
+	return img.delayed != nil && img.externalDataFile == nil && img.checksums == nil
+}
+
+// writeDelayed buffers p, which must lie within the cluster containing off,
+// if that cluster is unallocated or already buffered. It returns false when
+// the cluster is allocated and the caller should write it normally.
+//
+// A partially written cluster is first filled from the backing file, as a
+// copy-on-write would. The buffer is flushed once it reaches its limit.
+func (img *Image) writeDelayed(p []byte, off int64) (bool, error) {
+	d := img.delayed
+	clusterStart := uint64(off) &^ img.offsetMask
+	clusterOff := uint64(off) & img.offsetMask
+
+	d.mu.Lock()
+	buf, ok := d.clusters[clusterStart]
+	if !ok {
+		info, err := img.translate(clusterStart)
+		if err != nil || info.ctype != clusterUnallocated {
+			d.mu.Unlock()
+			return false, err
+		}
+
+		buf = img.getClusterBuffer()
+		if uint64(len(p)) < img.clusterSize {
+			if err := img.readBackingCluster(buf, clusterStart); err != nil {
+				d.mu.Unlock()
+				img.putClusterBuffer(buf)
+				return false, err
+			}
+		}
+		d.clusters[clusterStart] = buf
+		d.size += img.clusterSize
+	}
+	copy(buf[clusterOff:], p)
+	full := d.size >= d.limit
+	d.mu.Unlock()
+
+	if full {
+		return true, img.flushDelayed()
+	}
+	return true, nil
+}
+
+// readBackingCluster fills buf with the backing data of the cluster at
+// clusterStart, or zeros when there is no backing file.
+func (img *Image) readBackingCluster(buf []byte, clusterStart uint64) error {
+	if img.backing == nil {
+		clear(buf)
+		return nil
+	}
+	n, err := img.backing.ReadAt(buf, int64(clusterStart))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("qcow2: COW read from backing failed: %w", err)
+	}
+	clear(buf[n:])
+	img.copiedOnWrite(clusterStart, true)
+	return nil
+}
+
+// readDelayed copies buffered data for off into p, which must lie within
+// one cluster. It returns false if the cluster is not buffered.
+func (img *Image) readDelayed(p []byte, off uint64) bool {
+	d := img.delayed
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	buf, ok := d.clusters[off&^img.offsetMask]
+	if !ok {
+		return false
+	}
+	copy(p, buf[off&img.offsetMask:])
+	return true
+}
+
+// dropDelayedCluster forgets any buffered data for the cluster at virtOff,
+// for operations that replace the whole cluster.
+func (img *Image) dropDelayedCluster(virtOff uint64) {
+	d := img.delayed
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if buf, ok := d.clusters[virtOff]; ok {
+		delete(d.clusters, virtOff)
+		d.size -= img.clusterSize
+		img.putClusterBuffer(buf)
+	}
+}
+
+// discardDelayed forgets all buffered data.
+func (img *Image) discardDelayed() {
+	d := img.delayed
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for off, buf := range d.clusters {
+		delete(d.clusters, off)
+		img.putClusterBuffer(buf)
+	}
+	d.size = 0
+}
+
+// flushDelayed allocates and writes out all buffered clusters.
+func (img *Image) flushDelayed() error {
+	if img.delayed == nil {
+		return nil
+	}
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	return img.flushDelayedLocked()
+}
+
+// flushDelayedLocked is flushDelayed for callers holding writeMu.
+//
+// Missing L2 tables are allocated first, then all buffered clusters get one
+// contiguous host run in guest order, so a bulk import lays out like a
+// converted image. The buffer is kept if anything fails so a later flush
+// can retry.
+func (img *Image) flushDelayedLocked() error {
+	d := img.delayed
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.clusters) == 0 {
+		return nil
+	}
+
+	offs := make([]uint64, 0, len(d.clusters))
+	for off := range d.clusters {
+		offs = append(offs, off)
+	}
+	slices.Sort(offs)
+
+	l1Shift := img.clusterBits + img.l2Bits
+	for i, off := range offs {
+		if i > 0 && off>>l1Shift == offs[i-1]>>l1Shift {
+			continue
+		}
+		if _, err := img.getOrAllocateL2Table(off >> l1Shift); err != nil {
+			return err
+		}
+	}
+
+	physStart, err := img.allocateClusterRun(uint64(len(offs)), AllocData)
+	if err != nil {
+		return err
+	}
+	for i, off := range offs {
+		if _, err := img.file.WriteAt(d.clusters[off], int64(physStart+uint64(i)*img.clusterSize)); err != nil {
+			img.releaseClusters(physStart, uint64(len(offs)))
+			return fmt.Errorf("qcow2: failed to write delayed cluster: %w", err)
+		}
+	}
+
+	// Barrier: ensure data is on disk before L2 points to it
+	if err := img.dataBarrier(); err != nil {
+		img.releaseClusters(physStart, uint64(len(offs)))
+		return fmt.Errorf("qcow2: data barrier failed: %w", err)
+	}
+
+	// One L2 write per run of consecutive entries
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	for i := 0; i < len(offs); {
+		j := i + 1
+		for j < len(offs) && offs[j] == offs[j-1]+img.clusterSize && offs[j]>>l1Shift == offs[i]>>l1Shift {
+			j++
+		}
+
+		if err := img.mapDelayedRun(offs[i:j], physStart+uint64(i)*img.clusterSize, l2Table); err != nil {
+			// Clusters already mapped are stored; the rest stay buffered
+			// for the next flush and give back their host clusters
+			for _, off := range offs[:i] {
+				img.putClusterBuffer(d.clusters[off])
+				d.size -= img.clusterSize
+				delete(d.clusters, off)
+			}
+			img.releaseClusters(physStart+uint64(i)*img.clusterSize, uint64(len(offs)-i))
+			return err
+		}
+		i = j
+	}
+
+	// Every cluster is mapped now, so none may be flushed again
+	for off, buf := range d.clusters {
+		delete(d.clusters, off)
+		img.putClusterBuffer(buf)
+	}
+	d.size = 0
+
+	// Barrier: ensure L2 updates are on disk
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: L2 update barrier failed: %w", err)
+	}
+	return nil
+}
+
+// mapDelayedRun points the L2 entries of offs, consecutive clusters within
+// one L2 table, at the host clusters from physStart on.
+func (img *Image) mapDelayedRun(offs []uint64, physStart uint64, l2Table []byte) error {
+	l2TableOff, err := img.getOrAllocateL2Table(offs[0] >> (img.clusterBits + img.l2Bits))
+	if err != nil {
+		return err
+	}
+	if err := img.readL2Table(l2TableOff, l2Table); err != nil {
+		return err
+	}
+	l2Index := (offs[0] >> img.clusterBits) & (img.l2Entries - 1)
+	return img.setL2Run(l2TableOff, l2Table, l2Index, uint64(len(offs)), physStart)
+}
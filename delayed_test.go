@@ -0,0 +1,169 @@
+// delayed_test.go - Delayed allocation tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestDelayedAllocationLayout verifies clusters written out of order are
+// readable before the flush and land contiguously in guest order after it.
+func TestDelayedAllocationLayout(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "delayed.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithDelayedAllocation(1024*1024))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	cs := img.ClusterSize()
+
+	// Write clusters 7..0 backwards, the last one only partially
+	want := make([]byte, 8*cs)
+	for i := 7; i >= 0; i-- {
+		data := testutil.RandomBytes(int64(i), cs)
+		off := i * cs
+		if i == 0 {
+			data = data[:100]
+			off = 50
+		}
+		if _, err := img.WriteAt(data, int64(off)); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		copy(want[off:], data)
+	}
+
+	if info, err := img.translate(0); err != nil || info.ctype != clusterUnallocated {
+		t.Fatalf("cluster allocated before flush: %v, %v", info.ctype, err)
+	}
+	got := make([]byte, len(want))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("buffered data mismatch")
+	}
+
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	first, err := img.translate(0)
+	if err != nil {
+		t.Fatalf("translate failed: %v", err)
+	}
+	for i := 1; i < 8; i++ {
+		info, err := img.translate(uint64(i * cs))
+		if err != nil {
+			t.Fatalf("translate failed: %v", err)
+		}
+		if info.physOff != first.physOff+uint64(i*cs) {
+			t.Errorf("cluster %d at %#x, want %#x", i, info.physOff, first.physOff+uint64(i*cs))
+		}
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch after reopen")
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean: %+v", result)
+	}
+}
+
+// TestDelayedAllocationLimit verifies a full buffer is flushed by WriteAt.
+func TestDelayedAllocationLimit(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "delayed.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithDelayedAllocation(2*64*1024))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	cs := img.ClusterSize()
+
+	if _, err := img.WriteAt(testutil.RandomBytes(1, cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if img.isClusterAllocated(0) {
+		t.Fatal("first cluster allocated before the buffer filled")
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(2, cs), int64(cs)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if !img.isClusterAllocated(0) || !img.isClusterAllocated(uint64(cs)) {
+		t.Error("full buffer was not flushed")
+	}
+}
+
+// TestDelayedAllocationOverlay verifies partial writes to a buffered cluster
+// keep the backing data, and zeroing drops a buffered cluster.
+func TestDelayedAllocationOverlay(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "overlay.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithBackingStore(&countingBacking{}), WithDelayedAllocation(1024*1024))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	cs := img.ClusterSize()
+
+	partial := testutil.RandomBytes(1, 100)
+	if _, err := img.WriteAt(partial, 10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(2, cs), int64(cs)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(int64(cs), int64(cs)); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	want := bytes.Repeat([]byte{0xbb}, 2*cs)
+	copy(want[10:], partial)
+	clear(want[cs:])
+	got := make([]byte, 2*cs)
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch")
+	}
+}
@@ -0,0 +1,133 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ClusterType is how a cluster is stored, as recorded in its L2 entry.
+type ClusterType int
+
+const (
+	// ClusterUnallocated has no data in this image; reads go to the backing
+	// file, or return zeros without one.
+	ClusterUnallocated ClusterType = iota
+
+	// ClusterZero reads as zeros because of the zero flag. A host offset may
+	// still be attached (preallocated zero cluster).
+	ClusterZero
+
+	// ClusterNormal is stored uncompressed at its host offset.
+	ClusterNormal
+
+	// ClusterCompressed is stored compressed at its host offset.
+	ClusterCompressed
+)
+
+// String returns a short lowercase name for the cluster type.
+func (t ClusterType) String() string {
+	switch t {
+	case ClusterUnallocated:
+		return "unallocated"
+	case ClusterZero:
+		return "zero"
+	case ClusterNormal:
+		return "normal"
+	case ClusterCompressed:
+		return "compressed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// ClusterDescription is a decoded view of the L2 entry for one guest
+// cluster, for debugging and tooling.
+type ClusterDescription struct {
+	VirtualOffset  uint64      // Virtual offset of the start of the cluster
+	L2TableOffset  uint64      // Host offset of the L2 table (0 if none)
+	L2Entry        uint64      // Raw L2 entry (first word on extended L2 images)
+	Type           ClusterType // Storage type of the cluster as a whole
+	HostOffset     uint64      // Host offset of the data (0 if none)
+	CompressedSize uint64      // Upper bound of the compressed data size (compressed only)
+	Copied         bool        // COPIED flag: refcount known to be exactly 1
+
+	// SubclusterBitmap is the second word of an extended L2 entry: bits
+	// 0-31 mark allocated subclusters and bits 32-63 zero subclusters. It is
+	// 0 on standard images.
+	SubclusterBitmap uint64
+
+	// Refcount is the refcount of the host cluster at HostOffset (the first
+	// one, for compressed data that spans two), or 0 without a host offset.
+	Refcount uint64
+}
+
+// DescribeCluster decodes the L2 entry of the cluster containing virtOff.
+// It reads metadata only and never allocates.
+//
+// On extended L2 images Type describes the whole cluster; use
+// SubclusterBitmap for the state of individual subclusters. Clusters
+// buffered by WithDelayedAllocation are described as unallocated until they
+// are flushed.
+func (img *Image) DescribeCluster(virtOff uint64) (ClusterDescription, error) {
+	if virtOff >= uint64(img.Size()) {
+		return ClusterDescription{}, ErrOffsetOutOfRange
+	}
+
+	desc := ClusterDescription{VirtualOffset: virtOff &^ img.offsetMask}
+	l2Index := (virtOff >> img.clusterBits) & (img.l2Entries - 1)
+	l1Index := virtOff >> (img.clusterBits + img.l2Bits)
+	if err := img.faultL1(l1Index); err != nil {
+		return desc, err
+	}
+
+	img.l1Mu.RLock()
+	var l1Entry uint64
+	if l1Index < uint64(len(img.l1Table))/8 {
+		l1Entry = binary.BigEndian.Uint64(img.l1Table[l1Index*8:])
+	}
+	img.l1Mu.RUnlock()
+
+	desc.L2TableOffset = l1Entry & L1EntryOffsetMask
+	if desc.L2TableOffset == 0 {
+		return desc, nil
+	}
+
+	var raw [16]byte
+	entry := raw[:img.l2EntrySize]
+	entryOffset := l2Index * uint64(img.l2EntrySize)
+	if !img.l2Cache.readAt(desc.L2TableOffset, entry, entryOffset) {
+		l2Table, err := img.getL2Table(desc.L2TableOffset)
+		if err != nil {
+			return desc, err
+		}
+		copy(entry, l2Table[entryOffset:])
+	}
+	desc.L2Entry = binary.BigEndian.Uint64(raw[0:8])
+	if img.extendedL2 {
+		desc.SubclusterBitmap = binary.BigEndian.Uint64(raw[8:16])
+	}
+	desc.Copied = desc.L2Entry&L2EntryCopied != 0
+
+	switch {
+	case desc.L2Entry&L2EntryCompressed != 0:
+		desc.Type = ClusterCompressed
+		desc.HostOffset, desc.CompressedSize = img.parseCompressedL2Entry(desc.L2Entry)
+	case !img.extendedL2 && desc.L2Entry&L2EntryZeroFlag != 0:
+		desc.Type = ClusterZero
+		desc.HostOffset = desc.L2Entry & L2EntryOffsetMask
+	case desc.L2Entry&L2EntryOffsetMask != 0:
+		desc.Type = ClusterNormal
+		desc.HostOffset = desc.L2Entry & L2EntryOffsetMask
+	default:
+		desc.Type = ClusterUnallocated
+	}
+
+	if desc.HostOffset != 0 {
+		refcount, err := img.getRefcount(desc.HostOffset &^ img.offsetMask)
+		if err != nil {
+			return desc, err
+		}
+		desc.Refcount = refcount
+	}
+	return desc, nil
+}
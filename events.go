@@ -0,0 +1,83 @@
+package qcow2
+
+// AllocationKind says what a newly allocated host range holds.
+type AllocationKind int
+
+const (
+	// AllocData is a guest data cluster, or a run of them.
+	AllocData AllocationKind = iota
+
+	// AllocCompressed is the byte range of one compressed cluster.
+	AllocCompressed
+
+	// AllocMetadata is an L1 or L2 table, refcount block, snapshot table
+	// or other metadata.
+	AllocMetadata
+)
+
+// String returns a short lowercase name for the allocation kind.
+func (k AllocationKind) String() string {
+	switch k {
+	case AllocData:
+		return "data"
+	case AllocCompressed:
+		return "compressed"
+	case AllocMetadata:
+		return "metadata"
+	default:
+		return "unknown"
+	}
+}
+
+// AllocateEvent reports host space allocated in the image file or its
+// external data file.
+type AllocateEvent struct {
+	Offset uint64         // Host offset of the range
+	Length uint64         // Length in bytes
+	Kind   AllocationKind // What the range holds
+	Reused bool           // A free cluster was reused rather than appended
+}
+
+// FileGrowEvent reports a host file extended by an allocation.
+type FileGrowEvent struct {
+	DataFile bool   // The external data file rather than the image file
+	OldSize  uint64 // Size before the allocation
+	NewSize  uint64 // Size after it
+}
+
+// COWEvent reports a guest cluster whose old contents were copied so a
+// partial write could land in a cluster of its own.
+type COWEvent struct {
+	Offset      uint64 // Virtual offset of the cluster
+	FromBacking bool   // Copied from the backing file, not a cluster shared with a snapshot
+}
+
+// Events holds callbacks for allocation events, so an embedder can do
+// accounting, enforce quotas or log growth without polling file sizes.
+// Nil callbacks are skipped.
+//
+// Callbacks run synchronously on the goroutine doing the allocation, with
+// the image's locks held: they must return quickly and must not call
+// methods of the image. Allocations made by a write that then fails and
+// gives its clusters back are still reported.
+type Events struct {
+	OnAllocate func(AllocateEvent)
+	OnFileGrow func(FileGrowEvent)
+	OnCOW      func(COWEvent)
+}
+
+// allocated reports an allocation to the OnAllocate callback.
+func (img *Image) allocated(offset, length uint64, kind AllocationKind, reused bool) {
+	img.stats.count(&img.stats.allocatedBytes, length)
+	if fn := img.events.OnAllocate; fn != nil {
+		fn(AllocateEvent{Offset: offset, Length: length, Kind: kind, Reused: reused})
+	}
+}
+
+// copiedOnWrite reports a copy-on-write to the OnCOW callback.
+func (img *Image) copiedOnWrite(virtOff uint64, fromBacking bool) {
+	img.stats.count(&img.stats.cows, 1)
+	if fn := img.events.OnCOW; fn != nil {
+		fn(COWEvent{Offset: virtOff &^ img.offsetMask, FromBacking: fromBacking})
+	}
+}
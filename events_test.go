@@ -0,0 +1,102 @@
+// events_test.go - Allocation event tests
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEvents checks allocations, file growth and copy-on-write from the
+// backing file and from snapshot-shared clusters are reported.
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := base.ClusterSize()
+	if _, err := base.WriteAt(bytes.Repeat([]byte{1}, 2*cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	base.Close()
+	overlay, err := CreateOverlay(overlayPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	overlay.Close()
+
+	var allocs []AllocateEvent
+	var grows []FileGrowEvent
+	var cows []COWEvent
+	img, err := OpenFile(overlayPath, os.O_RDWR, 0, WithEvents(Events{
+		OnAllocate: func(e AllocateEvent) { allocs = append(allocs, e) },
+		OnFileGrow: func(e FileGrowEvent) { grows = append(grows, e) },
+		OnCOW:      func(e COWEvent) { cows = append(cows, e) },
+	}))
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer img.Close()
+
+	// A partial write over backing data allocates an L2 table and a data
+	// cluster, and copies the rest of the cluster from the backing file
+	if _, err := img.WriteAt([]byte{2}, int64(cs)+10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	var data, meta int
+	for _, e := range allocs {
+		switch e.Kind {
+		case AllocData:
+			data++
+		case AllocMetadata:
+			meta++
+		}
+		if e.Length == 0 || e.Offset == 0 {
+			t.Errorf("bad allocation event %+v", e)
+		}
+	}
+	if data != 1 || meta == 0 {
+		t.Errorf("allocations = %+v, want one data cluster and an L2 table", allocs)
+	}
+	if len(grows) == 0 {
+		t.Fatal("no file growth reported")
+	}
+	last := grows[len(grows)-1]
+	if info, _ := os.Stat(overlayPath); last.DataFile || last.NewSize != uint64(info.Size()) || last.OldSize >= last.NewSize {
+		t.Errorf("last growth = %+v, file size %d", last, info.Size())
+	}
+	if len(cows) != 1 || cows[0] != (COWEvent{Offset: uint64(cs), FromBacking: true}) {
+		t.Errorf("COW events = %+v, want cluster 1 from backing", cows)
+	}
+
+	// After a snapshot the cluster is shared, so writing it copies it
+	if _, err := img.CreateSnapshot("s1"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	cows = nil
+	if _, err := img.WriteAt([]byte{3}, int64(cs)+20); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if len(cows) != 1 || cows[0] != (COWEvent{Offset: uint64(cs)}) {
+		t.Errorf("COW events = %+v, want cluster 1 from a shared cluster", cows)
+	}
+
+	allocs = nil
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte{4}, cs), int64(4*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	var compressed bool
+	for _, e := range allocs {
+		compressed = compressed || e.Kind == AllocCompressed
+	}
+	if !compressed {
+		t.Errorf("allocations = %+v, want a compressed range", allocs)
+	}
+}
@@ -34,6 +34,7 @@ type HeaderExtensions struct {
 	FeatureNames     map[string]string        // Feature name table
 	ExternalDataFile string                   // External data file name
 	EncryptionHeader *EncryptionHeaderPointer // LUKS encryption header location (if present)
+	Metadata         map[string]string        // User metadata (see SetMetadata)
 	Unknown          []HeaderExtension        // Unknown but compatible extensions
 }
 
@@ -113,6 +114,13 @@ func (img *Image) parseHeaderExtensions() (*HeaderExtensions, error) {
 				}
 			}
 
+		case ExtensionUserMetadata:
+			metadata, err := parseMetadata(data)
+			if err != nil {
+				return nil, err
+			}
+			extensions.Metadata = metadata
+
 		case ExtensionBitmaps:
 			// Parse bitmap extension and store directly on Image
 			bitmapExt, err := parseBitmapExtension(data)
@@ -196,3 +204,81 @@ func (img *Image) BackingFormat() string {
 	}
 	return ""
 }
+
+// setHeaderExtension replaces the header extension of type extType with
+// data, or removes it if data is nil. The other extensions are kept byte for
+// byte. The backing file name, which follows the extensions in cluster 0, is
+// moved along with them and the header updated if its offset changed.
+func (img *Image) setHeaderExtension(extType uint32, data []byte) error {
+	if img.header.Version < Version3 {
+		return fmt.Errorf("qcow2: header extensions require a version 3 image")
+	}
+	start := uint64(img.header.HeaderLength)
+
+	cluster0 := make([]byte, img.clusterSize)
+	if _, err := img.file.ReadAt(cluster0, 0); err != nil {
+		return fmt.Errorf("qcow2: failed to read header cluster: %w", err)
+	}
+
+	end := img.clusterSize
+	var backingName []byte
+	if img.header.BackingFileOffset > 0 {
+		nameEnd := img.header.BackingFileOffset + uint64(img.header.BackingFileSize)
+		if nameEnd > img.clusterSize {
+			return fmt.Errorf("qcow2: backing file name is outside the header cluster")
+		}
+		backingName = append([]byte(nil), cluster0[img.header.BackingFileOffset:nameEnd]...)
+		// A name right after the header leaves no room for extensions
+		if img.header.BackingFileOffset >= start {
+			end = img.header.BackingFileOffset
+		}
+	}
+
+	// Copy every other extension as is
+	var area []byte
+	for offset := start; offset+8 <= end; {
+		typ := binary.BigEndian.Uint32(cluster0[offset:])
+		if typ == ExtensionEndOfHeader {
+			break
+		}
+		next := offset + 8 + uint64((binary.BigEndian.Uint32(cluster0[offset+4:])+7)&^uint32(7))
+		if next > end {
+			return fmt.Errorf("qcow2: header extension exceeds bounds")
+		}
+		if typ != extType {
+			area = append(area, cluster0[offset:next]...)
+		}
+		offset = next
+	}
+
+	if data != nil {
+		var ext [8]byte
+		binary.BigEndian.PutUint32(ext[0:4], extType)
+		binary.BigEndian.PutUint32(ext[4:8], uint32(len(data)))
+		area = append(area, ext[:]...)
+		area = append(area, data...)
+		area = append(area, make([]byte, (8-len(data)%8)%8)...)
+	}
+	area = append(area, make([]byte, 8)...) // End-of-header marker
+
+	backingOffset := img.header.BackingFileOffset
+	if backingName != nil {
+		backingOffset = start + uint64(len(area))
+		area = append(area, backingName...)
+	}
+	if start+uint64(len(area)) > img.clusterSize {
+		return fmt.Errorf("qcow2: header extensions do not fit in a %d-byte cluster", img.clusterSize)
+	}
+
+	// Clear whatever followed the old layout
+	area = append(area, make([]byte, img.clusterSize-start-uint64(len(area)))...)
+	if _, err := img.file.WriteAt(area, int64(start)); err != nil {
+		return fmt.Errorf("qcow2: failed to write header extensions: %w", err)
+	}
+
+	if backingOffset != img.header.BackingFileOffset {
+		img.header.BackingFileOffset = backingOffset
+		return img.writeHeader()
+	}
+	return img.metadataBarrier()
+}
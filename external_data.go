@@ -0,0 +1,506 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// rawExternalData reports whether the image keeps its data in a raw
+// external data file (data_file_raw). Every guest cluster then lives at the
+// same offset in the data file, so the file can be mounted directly.
+func (img *Image) rawExternalData() bool {
+	return img.externalDataFile != nil && img.header.HasRawExternalData()
+}
+
+// allocateDataCluster allocates the host cluster backing the guest cluster
+// at virtOff. Raw external data files have no choice of location: the host
+// cluster is the guest cluster. Everything else goes through allocateCluster.
+func (img *Image) allocateDataCluster(virtOff uint64) (uint64, error) {
+	if !img.rawExternalData() {
+		return img.allocateCluster()
+	}
+
+	offset := virtOff &^ img.offsetMask
+	if err := img.ensureDataFileSize(offset + img.clusterSize); err != nil {
+		return 0, err
+	}
+
+	// Update refcount for the new cluster (refcounts always in main qcow2 file)
+	if err := img.incrementRefcount(offset); err != nil {
+		return 0, fmt.Errorf("qcow2: failed to update refcount for new cluster: %w", err)
+	}
+	img.dataWritten(offset, img.clusterSize)
+	img.allocated(offset, img.clusterSize, AllocData, false)
+	return offset, nil
+}
+
+// ensureDataFileSize grows the external data file to at least size bytes.
+// The new space is a hole, so it reads as zeros.
+func (img *Image) ensureDataFileSize(size uint64) error {
+	info, err := img.externalDataFile.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) >= size {
+		return nil
+	}
+
+	if err := img.checkQuota(img.externalDataFile, size); err != nil {
+		return err
+	}
+	if err := img.growFile(img.externalDataFile, info.Size(), size); err != nil {
+		return fmt.Errorf("qcow2: failed to extend raw data file: %w", err)
+	}
+	return nil
+}
+
+// checkRawMapping fails with ErrRawDataFile if the cluster at virtOff is
+// mapped anywhere but its own offset in a raw external data file.
+func (img *Image) checkRawMapping(virtOff, physOff uint64) error {
+	if !img.rawExternalData() || physOff == 0 {
+		return nil
+	}
+	if want := virtOff &^ img.offsetMask; physOff != want {
+		return fmt.Errorf("%w: guest cluster 0x%x is mapped to 0x%x", ErrRawDataFile, want, physOff)
+	}
+	return nil
+}
+
+// zeroRawRange writes zeros over [off, off+length) of a raw external data
+// file. Zero clusters only exist in the qcow2 metadata, so without this a
+// direct reader of the data file would still see the old contents.
+func (img *Image) zeroRawRange(off, length int64) error {
+	if err := img.ensureDataFileSize(uint64(off + length)); err != nil {
+		return err
+	}
+
+	zeros := img.getZeroedClusterBuffer()
+	defer img.putClusterBuffer(zeros)
+	for length > 0 {
+		n := int64(len(zeros)) - off&int64(img.offsetMask)
+		if n > length {
+			n = length
+		}
+		var err error
+		if img.checksums != nil {
+			_, err = img.writeChecksummed(zeros[:n], uint64(off))
+		} else {
+			_, err = img.externalDataFile.WriteAt(zeros[:n], off)
+		}
+		if err != nil {
+			return fmt.Errorf("qcow2: failed to zero raw data file: %w", err)
+		}
+		img.dataWritten(uint64(off), uint64(n))
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// AttachExternalDataFile moves the guest data of an image into a new
+// external data file at path, which must not exist yet. A relative path is
+// stored as given and resolved against the image's directory, as on open.
+//
+// Data clusters keep their host offsets, so the L2 tables and refcounts are
+// left alone and the data file ends up sparse wherever the qcow2 file holds
+// metadata, which is the layout QEMU uses. The image only switches to the
+// data file once it is complete and synced; afterwards the copies left in the
+// qcow2 file are punched out where the platform supports it.
+//
+// Images with snapshots, compressed clusters, or a checksum sidecar are
+// rejected.
+func (img *Image) AttachExternalDataFile(path string) error {
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if img.externalDataFile != nil {
+		return fmt.Errorf("qcow2: image already has an external data file")
+	}
+	if err := img.requireNewFeatures("external data file"); err != nil {
+		return err
+	}
+	if err := img.checkDataFileMove(); err != nil {
+		return err
+	}
+	if err := img.Flush(); err != nil {
+		return err
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	clusters, err := img.activeDataClusters()
+	if err != nil {
+		return err
+	}
+
+	fullPath, err := resolveExternalDataPath(img.file.Name(), path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to create external data file: %w", err)
+	}
+	_ = markSparse(f)
+	var dataFile File = f
+	if img.fileWrapper != nil {
+		dataFile = img.fileWrapper(f)
+	}
+
+	if err := img.copyDataClusters(dataFile, clusters); err != nil {
+		dataFile.Close()
+		os.Remove(fullPath)
+		return err
+	}
+
+	// The extension is ignored until the feature bit is set, so the header
+	// write below is what switches the image over
+	if err := img.setHeaderExtension(ExtensionExternalDataFile, []byte(path)); err != nil {
+		dataFile.Close()
+		os.Remove(fullPath)
+		return err
+	}
+	img.header.IncompatibleFeatures |= IncompatExternalData
+	if err := img.writeHeader(); err != nil {
+		img.header.IncompatibleFeatures &^= IncompatExternalData
+		dataFile.Close()
+		return fmt.Errorf("qcow2: failed to update header: %w", err)
+	}
+	img.externalDataFile = dataFile
+	img.extensions.ExternalDataFile = path
+	if img.dataCache != nil {
+		img.dataCache.clear()
+	}
+
+	for _, off := range clusters {
+		if err := punchHole(img.file, int64(off), int64(img.clusterSize)); err != nil {
+			if errors.Is(err, ErrHolePunchUnsupported) {
+				break
+			}
+			return fmt.Errorf("qcow2: failed to punch hole at 0x%x: %w", off, err)
+		}
+	}
+
+	img.dirty.Store(true)
+	return nil
+}
+
+// DetachExternalDataFile moves the guest data of an image back from its
+// external data file into the qcow2 file and drops the data file from the
+// header. The data file itself is closed but not deleted.
+//
+// External data offsets can collide with qcow2 metadata, so the clusters are
+// copied to newly allocated clusters and the L1 and L2 tables are rewritten
+// into new clusters as well. A single header write then switches to the new
+// L1 table and clears the external data feature, so a crash leaves the image
+// using either the data file or the copies. An error before that write
+// frees the new clusters and leaves the image using the data file.
+//
+// Images with snapshots, a raw data file, or a checksum sidecar are rejected.
+func (img *Image) DetachExternalDataFile() error {
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if img.externalDataFile == nil {
+		return fmt.Errorf("qcow2: image has no external data file")
+	}
+	if err := img.checkDataFileMove(); err != nil {
+		return err
+	}
+	if err := img.Flush(); err != nil {
+		return err
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	if err := img.faultAllL1(); err != nil {
+		return err
+	}
+	img.l1Mu.RLock()
+	newL1 := append([]byte(nil), img.l1Table...)
+	img.l1Mu.RUnlock()
+
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	data := img.getClusterBuffer()
+	defer img.putClusterBuffer(data)
+
+	// Clusters allocated for the copy are given back if it fails before the
+	// header points at them
+	var newClusters []uint64
+	committed := false
+	defer func() {
+		if !committed {
+			for _, off := range newClusters {
+				img.releaseClusters(off, 1)
+			}
+		}
+	}()
+
+	var oldL2s, oldData []uint64
+	for i := 0; i+8 <= len(newL1); i += 8 {
+		l1Entry := binary.BigEndian.Uint64(newL1[i:])
+		l2Offset := l1Entry & L1EntryOffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		if err := img.readL2Table(l2Offset, l2Table); err != nil {
+			return err
+		}
+
+		for j := uint64(0); j < img.l2Entries; j++ {
+			pos := j * uint64(img.l2EntrySize)
+			l2Entry := binary.BigEndian.Uint64(l2Table[pos:])
+			hostOff := l2Entry & L2EntryOffsetMask
+			if hostOff == 0 {
+				continue
+			}
+			if l2Entry&L2EntryCompressed != 0 {
+				return fmt.Errorf("qcow2: compressed cluster in L2 table at 0x%x", l2Offset)
+			}
+
+			newOff, err := img.allocateClusterRun(1, AllocData)
+			if err != nil {
+				return err
+			}
+			newClusters = append(newClusters, newOff)
+			if _, err := img.externalDataFile.ReadAt(data, int64(hostOff)); err != nil && err != io.EOF {
+				return fmt.Errorf("qcow2: failed to read data cluster at 0x%x: %w", hostOff, err)
+			}
+			if _, err := img.file.WriteAt(data, int64(newOff)); err != nil {
+				return fmt.Errorf("qcow2: failed to copy data cluster: %w", err)
+			}
+			binary.BigEndian.PutUint64(l2Table[pos:], l2Entry&^L2EntryOffsetMask|newOff)
+			oldData = append(oldData, hostOff)
+		}
+
+		newL2, err := img.allocateMetadataCluster()
+		if err != nil {
+			return err
+		}
+		newClusters = append(newClusters, newL2)
+		if _, err := img.file.WriteAt(l2Table, int64(newL2)); err != nil {
+			return fmt.Errorf("qcow2: failed to write L2 table: %w", err)
+		}
+		binary.BigEndian.PutUint64(newL1[i:], l1Entry&^L1EntryOffsetMask|newL2)
+		oldL2s = append(oldL2s, l2Offset)
+	}
+
+	l1Clusters := (uint64(len(newL1)) + img.offsetMask) >> img.clusterBits
+	newL1Offset, err := img.allocateClusterRun(l1Clusters, AllocMetadata)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to allocate L1 table: %w", err)
+	}
+	for i := uint64(0); i < l1Clusters; i++ {
+		newClusters = append(newClusters, newL1Offset+i*img.clusterSize)
+	}
+	if _, err := img.file.WriteAt(newL1, int64(newL1Offset)); err != nil {
+		return fmt.Errorf("qcow2: failed to write L1 table: %w", err)
+	}
+
+	// Everything the new L1 table reaches must be on disk before the switch
+	if err := img.file.Sync(); err != nil {
+		return fmt.Errorf("qcow2: failed to sync copied clusters: %w", err)
+	}
+
+	oldL1Offset := img.header.L1TableOffset
+	oldIncompat := img.header.IncompatibleFeatures
+	img.header.L1TableOffset = newL1Offset
+	img.header.IncompatibleFeatures &^= IncompatExternalData
+	if err := img.writeHeader(); err != nil {
+		img.header.L1TableOffset = oldL1Offset
+		img.header.IncompatibleFeatures = oldIncompat
+		return fmt.Errorf("qcow2: failed to update header: %w", err)
+	}
+	committed = true
+	img.l1Mu.Lock()
+	img.l1Table = newL1
+	img.l1Mu.Unlock()
+	img.l2Cache.clear()
+	if img.dataCache != nil {
+		img.dataCache.clear()
+	}
+
+	dataFile := img.externalDataFile
+	img.externalDataFile = nil
+	img.extensions.ExternalDataFile = ""
+	if err := dataFile.Close(); err != nil {
+		return fmt.Errorf("qcow2: failed to close external data file: %w", err)
+	}
+	if err := img.setHeaderExtension(ExtensionExternalDataFile, nil); err != nil {
+		return err
+	}
+
+	// Release the old tables and the refcounts of the external clusters
+	for i := uint64(0); i < l1Clusters; i++ {
+		oldL2s = append(oldL2s, oldL1Offset+i*img.clusterSize)
+	}
+	for _, off := range append(oldL2s, oldData...) {
+		if err := img.decrementRefcount(off); err != nil {
+			return fmt.Errorf("qcow2: failed to release cluster at 0x%x: %w", off, err)
+		}
+	}
+
+	img.dirty.Store(true)
+	return nil
+}
+
+// SetExternalDataFilePath points the image at an external data file that
+// was moved or renamed, rewriting the data file name in the header. As on
+// open, a relative path is resolved against the image's directory. The new
+// file must exist and be at least as large as the current one; its contents
+// are not compared.
+func (img *Image) SetExternalDataFilePath(newPath string) error {
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if img.externalDataFile == nil {
+		return fmt.Errorf("qcow2: image has no external data file")
+	}
+
+	fullPath, err := resolveExternalDataPath(img.file.Name(), newPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fullPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to open external data file %q: %w", fullPath, err)
+	}
+	newInfo, err := f.Stat()
+	if err == nil && !newInfo.Mode().IsRegular() {
+		err = fmt.Errorf("qcow2: external data file %q is not a regular file", fullPath)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := img.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	oldInfo, err := img.externalDataFile.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if newInfo.Size() < oldInfo.Size() {
+		f.Close()
+		return fmt.Errorf("qcow2: external data file %q is %d bytes, the current one is %d",
+			fullPath, newInfo.Size(), oldInfo.Size())
+	}
+
+	if err := img.setHeaderExtension(ExtensionExternalDataFile, []byte(newPath)); err != nil {
+		f.Close()
+		return err
+	}
+
+	old := img.externalDataFile
+	img.externalDataFile = f
+	if img.fileWrapper != nil {
+		img.externalDataFile = img.fileWrapper(f)
+	}
+	img.extensions.ExternalDataFile = newPath
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("qcow2: failed to close old external data file: %w", err)
+	}
+	return nil
+}
+
+// checkDataFileMove rejects images whose data clusters cannot simply be
+// moved between the qcow2 file and an external data file.
+func (img *Image) checkDataFileMove() error {
+	switch {
+	case img.header.Version < Version3:
+		return fmt.Errorf("qcow2: external data files require a version 3 image")
+	case len(img.snapshots) > 0:
+		return fmt.Errorf("qcow2: cannot move the data of an image with snapshots")
+	case img.checksums != nil:
+		return fmt.Errorf("qcow2: cannot move the data of an image with a checksum sidecar")
+	case img.rawExternalData():
+		return fmt.Errorf("%w: the data file is the guest disk", ErrRawDataFile)
+	}
+	return nil
+}
+
+// activeDataClusters returns the host offsets of all data clusters the
+// active L2 tables point to. Compressed clusters are an error, since they
+// cannot live in an external data file.
+func (img *Image) activeDataClusters() ([]uint64, error) {
+	if err := img.faultAllL1(); err != nil {
+		return nil, err
+	}
+	img.l1Mu.RLock()
+	l1 := append([]byte(nil), img.l1Table...)
+	img.l1Mu.RUnlock()
+
+	clusters, compressed, err := img.l1DataClusters(l1)
+	if err == nil && compressed {
+		err = fmt.Errorf("qcow2: compressed clusters cannot move to an external data file")
+	}
+	return clusters, err
+}
+
+// l1DataClusters returns the host offsets of the data clusters the L2
+// tables under l1 point to, and whether any clusters are compressed, which
+// are not included.
+func (img *Image) l1DataClusters(l1 []byte) (clusters []uint64, compressed bool, err error) {
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+
+	for i := 0; i+8 <= len(l1); i += 8 {
+		l2Offset := binary.BigEndian.Uint64(l1[i:]) & L1EntryOffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		if err := img.readL2Table(l2Offset, l2Table); err != nil {
+			return nil, false, err
+		}
+		for j := uint64(0); j < img.l2Entries; j++ {
+			l2Entry := binary.BigEndian.Uint64(l2Table[j*uint64(img.l2EntrySize):])
+			if l2Entry&L2EntryCompressed != 0 {
+				compressed = true
+			} else if off := l2Entry & L2EntryOffsetMask; off != 0 {
+				clusters = append(clusters, off)
+			}
+		}
+	}
+	return clusters, compressed, nil
+}
+
+// copyDataClusters copies the given clusters of the qcow2 file to the same
+// offsets in dst and syncs it.
+func (img *Image) copyDataClusters(dst File, clusters []uint64) error {
+	info, err := img.file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := dst.Truncate(info.Size()); err != nil {
+		return fmt.Errorf("qcow2: failed to size external data file: %w", err)
+	}
+
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	for _, off := range clusters {
+		if _, err := img.file.ReadAt(buf, int64(off)); err != nil && err != io.EOF {
+			return fmt.Errorf("qcow2: failed to read data cluster at 0x%x: %w", off, err)
+		}
+		if _, err := dst.WriteAt(buf, int64(off)); err != nil {
+			return fmt.Errorf("qcow2: failed to write external data file: %w", err)
+		}
+	}
+
+	if err := dst.Sync(); err != nil {
+		return fmt.Errorf("qcow2: failed to sync external data file: %w", err)
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ package qcow2
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -466,3 +468,364 @@ func TestExternalDataFileWithCompression(t *testing.T) {
 		t.Errorf("qemu-img check failed: %s", checkResult.Stderr)
 	}
 }
+
+// createRawExternalDataImage builds an image with a raw external data file
+// without qemu-img: a fresh image gets the external data and data_file_raw
+// feature bits and a data file name extension pointing at an empty file.
+func createRawExternalDataImage(t *testing.T, size uint64) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "raw_external.qcow2")
+	dataPath := filepath.Join(dir, "raw_external.raw")
+
+	img, err := Create(path, CreateOptions{Size: size})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	header := img.Header()
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := os.WriteFile(dataPath, nil, 0644); err != nil {
+		t.Fatalf("creating data file failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], header.IncompatibleFeatures|IncompatExternalData)
+	if _, err := f.WriteAt(buf[:], 72); err != nil {
+		t.Fatalf("patching incompatible features failed: %v", err)
+	}
+	binary.BigEndian.PutUint64(buf[:], header.AutoclearFeatures|AutoclearRawExternal)
+	if _, err := f.WriteAt(buf[:], 88); err != nil {
+		t.Fatalf("patching autoclear features failed: %v", err)
+	}
+
+	name := filepath.Base(dataPath)
+	ext := make([]byte, 8+(len(name)+7)&^7+8)
+	binary.BigEndian.PutUint32(ext[0:4], ExtensionExternalDataFile)
+	binary.BigEndian.PutUint32(ext[4:8], uint32(len(name)))
+	copy(ext[8:], name)
+	if _, err := f.WriteAt(ext, int64(header.HeaderLength)); err != nil {
+		t.Fatalf("writing data file extension failed: %v", err)
+	}
+
+	return path, dataPath
+}
+
+func TestRawExternalDataMapping(t *testing.T) {
+	t.Parallel()
+	const size = 4 * 1024 * 1024
+	path, dataPath := createRawExternalDataImage(t, size)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	if !img.header.HasRawExternalData() {
+		t.Fatal("Expected raw external data file")
+	}
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("data file size = %d, want %d", info.Size(), size)
+	}
+
+	// Writes out of order must still land at their guest offsets
+	cs := int64(img.ClusterSize())
+	a := testutil.RandomBytes(1, 4096)
+	b := testutil.RandomBytes(2, 4096)
+	if _, err := img.WriteAt(a, 5*cs+100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAt(b, 2*cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	raw, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(raw[5*cs+100:5*cs+100+4096], a) || !bytes.Equal(raw[2*cs:2*cs+4096], b) {
+		t.Fatal("data file does not hold the data at the guest offsets")
+	}
+
+	// Zeroing has to reach the data file as well
+	if err := img.WriteZeroAt(2*cs, cs); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(5*cs+200, 1000); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	raw, err = os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	got := make([]byte, size)
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(raw, got) {
+		t.Error("data file and guest view differ after zeroing")
+	}
+	if !bytes.Equal(got[2*cs:3*cs], make([]byte, cs)) {
+		t.Error("zeroed cluster does not read as zeros")
+	}
+}
+
+func TestRawExternalDataRejectsSnapshots(t *testing.T) {
+	t.Parallel()
+	path, _ := createRawExternalDataImage(t, 1024*1024)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	if _, err := img.CreateSnapshot("snap"); !errors.Is(err, ErrRawDataFile) {
+		t.Errorf("CreateSnapshot error = %v, want ErrRawDataFile", err)
+	}
+}
+
+func TestAttachDetachExternalDataFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "attach.qcow2")
+	const size = 8 * 1024 * 1024
+
+	base, err := Create(filepath.Join(dir, "base.qcow2"), CreateOptions{Size: size})
+	if err != nil {
+		t.Fatalf("Create base failed: %v", err)
+	}
+	base.Close()
+	img, err := Create(path, CreateOptions{Size: size, BackingFile: "base.qcow2", BackingFormat: "qcow2"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	want := make([]byte, size)
+	cs := int64(img.ClusterSize())
+	for i, off := range []int64{0, 3*cs + 100, 40 * cs} {
+		data := testutil.RandomBytes(int64(i), 8192)
+		if _, err := img.WriteAt(data, off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		copy(want[off:], data)
+	}
+
+	if err := img.AttachExternalDataFile("attach.data"); err != nil {
+		t.Fatalf("AttachExternalDataFile failed: %v", err)
+	}
+	if err := img.AttachExternalDataFile("other.data"); err == nil {
+		t.Error("second AttachExternalDataFile should fail")
+	}
+
+	// New writes go to the data file too
+	data := testutil.RandomBytes(10, 4096)
+	if _, err := img.WriteAt(data, 20*cs); err != nil {
+		t.Fatalf("WriteAt after attach failed: %v", err)
+	}
+	copy(want[20*cs:], data)
+	img.Close()
+
+	readAll := func(img *Image) {
+		t.Helper()
+		got := make([]byte, size)
+		if _, err := img.ReadAt(got, 0); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("data mismatch")
+		}
+	}
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if img.Extensions().ExternalDataFile != "attach.data" || !img.header.HasExternalDataFile() {
+		t.Fatalf("external data file not recorded in header")
+	}
+	if img.BackingFile() != "base.qcow2" {
+		t.Errorf("backing file = %q after moving extensions", img.BackingFile())
+	}
+	readAll(img)
+
+	if err := img.DetachExternalDataFile(); err != nil {
+		t.Fatalf("DetachExternalDataFile failed: %v", err)
+	}
+	readAll(img)
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen after detach failed: %v", err)
+	}
+	defer img.Close()
+	if img.header.HasExternalDataFile() || img.Extensions().ExternalDataFile != "" {
+		t.Error("external data file still in header after detach")
+	}
+	if img.BackingFile() != "base.qcow2" || img.BackingFormat() != "qcow2" {
+		t.Errorf("backing file = %q (%q) after detach", img.BackingFile(), img.BackingFormat())
+	}
+	readAll(img)
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Corruptions != 0 || result.Leaks != 0 {
+		t.Errorf("Check found %d corruptions and %d leaks: %v", result.Corruptions, result.Leaks, result.Errors)
+	}
+}
+
+// TestDetachExternalDataFileFailure steps a write failure through
+// DetachExternalDataFile and verifies each failure before the header switch
+// leaves the image on its data file with nothing leaked. The loop ends at
+// the first failure after the switch, which may leak the old clusters.
+func TestDetachExternalDataFileFailure(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "detach.qcow2")
+	const size = 4 * 1024 * 1024
+
+	img, err := Create(path, CreateOptions{Size: size})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	want := make([]byte, size)
+	cs := int64(img.ClusterSize())
+	for i, off := range []int64{0, 5 * cs, 30 * cs} {
+		data := testutil.RandomBytes(int64(i), int(cs))
+		if _, err := img.WriteAt(data, off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		copy(want[off:], data)
+	}
+	if err := img.AttachExternalDataFile("detach.data"); err != nil {
+		t.Fatalf("AttachExternalDataFile failed: %v", err)
+	}
+	img.Close()
+
+	// Faults go to the qcow2 file, the first one wrapped
+	var ff *testutil.FaultFile
+	img, err = Open(path, WithFileWrapper(func(f File) File {
+		if ff != nil {
+			return f
+		}
+		ff = testutil.NewFaultFile(f, testutil.FaultConfig{})
+		return ff
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	got := make([]byte, size)
+	for failAt := uint64(1); ; failAt++ {
+		ff.SetConfig(testutil.FaultConfig{Write: testutil.FaultProfile{FailAt: failAt}})
+		err := img.DetachExternalDataFile()
+		ff.SetConfig(testutil.FaultConfig{})
+		if err == nil || !img.header.HasExternalDataFile() {
+			// Done, or failed after the header switch
+			break
+		}
+
+		if _, err := img.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("write %d: data mismatch after failed detach (err %v)", failAt, err)
+		}
+		result, err := img.Check()
+		if err != nil {
+			t.Fatalf("write %d: Check failed: %v", failAt, err)
+		}
+		if result.Corruptions != 0 || result.Leaks != 0 {
+			t.Fatalf("write %d: Check found %d corruptions and %d leaks: %v",
+				failAt, result.Corruptions, result.Leaks, result.Errors)
+		}
+	}
+
+	if _, err := img.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("data mismatch after detach (err %v)", err)
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Corruptions != 0 {
+		t.Errorf("Check found %d corruptions after detach: %v", result.Corruptions, result.Errors)
+	}
+}
+
+func TestSetExternalDataFilePath(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "moved.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 4 * 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	data := testutil.RandomBytes(1, 100000)
+	if _, err := img.WriteAt(data, 12345); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.AttachExternalDataFile("old.data"); err != nil {
+		t.Fatalf("AttachExternalDataFile failed: %v", err)
+	}
+
+	if err := img.SetExternalDataFilePath("missing.data"); err == nil {
+		t.Error("SetExternalDataFilePath should fail for a missing file")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "small.data"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := img.SetExternalDataFilePath("small.data"); err == nil {
+		t.Error("SetExternalDataFilePath should fail for a truncated file")
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	newPath := filepath.Join("sub", "new.data")
+	if err := os.Rename(filepath.Join(dir, "old.data"), filepath.Join(dir, newPath)); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := img.SetExternalDataFilePath(newPath); err != nil {
+		t.Fatalf("SetExternalDataFilePath failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer img.Close()
+	if got := img.Extensions().ExternalDataFile; got != newPath {
+		t.Errorf("ExternalDataFile = %q, want %q", got, newPath)
+	}
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 12345); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data mismatch after relocating the data file")
+	}
+}
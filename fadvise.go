@@ -0,0 +1,83 @@
+package qcow2
+
+import (
+	"fmt"
+)
+
+// FileAdvice is a hint about how image files are about to be accessed,
+// passed to the host with posix_fadvise. Hints are ignored on platforms
+// without it and for files not backed by a file descriptor.
+type FileAdvice int
+
+const (
+	// AdviceNormal restores the default readahead.
+	AdviceNormal FileAdvice = iota
+
+	// AdviceSequential suits a front to back copy: more readahead.
+	AdviceSequential
+
+	// AdviceRandom turns readahead off.
+	AdviceRandom
+
+	// AdviceDontNeed drops the files' clean pages from the page cache,
+	// for instance after a large copy, so they do not push out pages the
+	// guest is using. Dirty pages are only dropped once written back, so
+	// flush first.
+	AdviceDontNeed
+)
+
+// String returns the posix_fadvise name of the advice.
+func (a FileAdvice) String() string {
+	switch a {
+	case AdviceNormal:
+		return "normal"
+	case AdviceSequential:
+		return "sequential"
+	case AdviceRandom:
+		return "random"
+	case AdviceDontNeed:
+		return "dontneed"
+	default:
+		return fmt.Sprintf("FileAdvice(%d)", int(a))
+	}
+}
+
+// Advise passes advice for the whole of the image file, its external data
+// file and every file of its backing chain to the host.
+func (img *Image) Advise(advice FileAdvice) error {
+	if img.closed.Load() {
+		return ErrClosed
+	}
+	if advice < AdviceNormal || advice > AdviceDontNeed {
+		return fmt.Errorf("qcow2: unknown file advice %d", int(advice))
+	}
+	files := []File{img.file}
+	if img.externalDataFile != nil {
+		files = append(files, img.externalDataFile)
+	}
+	for layer := img.backing; layer != nil; {
+		if r, ok := layer.(*retryingBacking); ok {
+			layer = r.current()
+		}
+		switch l := layer.(type) {
+		case *Image:
+			files = append(files, l.file)
+			if l.externalDataFile != nil {
+				files = append(files, l.externalDataFile)
+			}
+			layer = l.backing
+		case *RawImage:
+			files = append(files, l.file)
+			layer = nil
+		default:
+			layer = nil
+		}
+	}
+
+	for _, f := range files {
+		if err := fadvise(f, advice); err != nil {
+			return fmt.Errorf("qcow2: fadvise %s on %s failed: %w", advice, f.Name(), err)
+		}
+	}
+	return nil
+}
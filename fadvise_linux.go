@@ -0,0 +1,23 @@
+//go:build linux
+
+package qcow2
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+var fadviseFlags = [...]int{
+	AdviceNormal:     unix.FADV_NORMAL,
+	AdviceSequential: unix.FADV_SEQUENTIAL,
+	AdviceRandom:     unix.FADV_RANDOM,
+	AdviceDontNeed:   unix.FADV_DONTNEED,
+}
+
+// fadvise applies advice to the whole of f.
+func fadvise(f File, advice FileAdvice) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return nil
+	}
+	return unix.Fadvise(int(fd.Fd()), 0, 0, fadviseFlags[advice])
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package qcow2
+
+// fadvise is not supported on this platform; advice is ignored.
+func fadvise(f File, advice FileAdvice) error {
+	return nil
+}
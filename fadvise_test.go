@@ -0,0 +1,79 @@
+// fadvise_test.go - Page cache advice tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestAdvise checks every advice is accepted for an image and its backing
+// chain, and unknown advice is rejected.
+func TestAdvise(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+
+	img, err := CreateSimple(base, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+	overlay := filepath.Join(dir, "overlay.qcow2")
+	img, err = CreateOverlay(overlay, base)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(overlay, WithFileAdvice(AdviceRandom))
+	if err != nil {
+		t.Fatalf("Open with advice failed: %v", err)
+	}
+	for _, advice := range []FileAdvice{AdviceNormal, AdviceSequential, AdviceRandom, AdviceDontNeed} {
+		if err := img.Advise(advice); err != nil {
+			t.Errorf("Advise(%s) failed: %v", advice, err)
+		}
+	}
+	if err := img.Advise(FileAdvice(42)); err == nil {
+		t.Error("Advise accepted unknown advice")
+	}
+	img.Close()
+	if err := img.Advise(AdviceNormal); !errors.Is(err, ErrClosed) {
+		t.Errorf("Advise after Close = %v, want ErrClosed", err)
+	}
+}
+
+// TestConvertDropCache checks a conversion that advises the host and drops
+// its pages along the way still copies everything.
+func TestConvertDropCache(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.qcow2")
+	dstPath := filepath.Join(dir, "dst.qcow2")
+
+	src, err := CreateSimple(srcPath, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := src.WriteAt(testutil.RandomBytes(3, 6*1024*1024), 1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	src.Close()
+
+	err = Convert(srcPath, dstPath, ConvertOptions{
+		SourceAdvice:       AdviceSequential,
+		DropCache:          true,
+		CheckpointInterval: DefaultConvertSegmentSize,
+	})
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if !bytes.Equal(readAll(t, srcPath), readAll(t, dstPath)) {
+		t.Error("converted image content differs from source")
+	}
+}
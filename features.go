@@ -0,0 +1,161 @@
+package qcow2
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// FeatureType is the header bitmap a feature bit lives in, numbered as in
+// the feature name table extension.
+type FeatureType uint8
+
+const (
+	FeatureIncompatible FeatureType = 0 // Must be understood to open the image
+	FeatureCompatible   FeatureType = 1 // Can be ignored if unknown
+	FeatureAutoclear    FeatureType = 2 // Cleared by writers that do not know it
+)
+
+// String returns "incompatible", "compatible" or "autoclear".
+func (t FeatureType) String() string {
+	switch t {
+	case FeatureIncompatible:
+		return "incompatible"
+	case FeatureCompatible:
+		return "compatible"
+	case FeatureAutoclear:
+		return "autoclear"
+	default:
+		return fmt.Sprintf("type%d", uint8(t))
+	}
+}
+
+// Feature is a single header feature bit.
+type Feature struct {
+	Type FeatureType
+	Bit  uint8
+}
+
+// The feature bits defined by the qcow2 specification.
+var (
+	FeatureDirty           = Feature{FeatureIncompatible, 0}
+	FeatureCorrupt         = Feature{FeatureIncompatible, 1}
+	FeatureExternalData    = Feature{FeatureIncompatible, 2}
+	FeatureCompressionType = Feature{FeatureIncompatible, 3}
+	FeatureExtendedL2      = Feature{FeatureIncompatible, 4}
+	FeatureLazyRefcounts   = Feature{FeatureCompatible, 0}
+	FeatureBitmaps         = Feature{FeatureAutoclear, 0}
+	FeatureRawExternalData = Feature{FeatureAutoclear, 1}
+)
+
+// featureNames are the names qemu writes to the feature name table.
+var featureNames = map[Feature]string{
+	FeatureDirty:           "dirty bit",
+	FeatureCorrupt:         "corrupt bit",
+	FeatureExternalData:    "external data file",
+	FeatureCompressionType: "compression type",
+	FeatureExtendedL2:      "extended L2 entries",
+	FeatureLazyRefcounts:   "lazy refcounts",
+	FeatureBitmaps:         "bitmaps",
+	FeatureRawExternalData: "raw external data",
+}
+
+// KnownFeatures returns the feature bits defined by the specification, in
+// the order of the feature name table qemu writes.
+func KnownFeatures() []Feature {
+	return []Feature{
+		FeatureDirty, FeatureCorrupt, FeatureExternalData, FeatureCompressionType,
+		FeatureExtendedL2, FeatureLazyRefcounts, FeatureBitmaps, FeatureRawExternalData,
+	}
+}
+
+// String returns the feature's name from the specification's feature name
+// table, such as "extended L2 entries", or "incompatible bit 7" for a bit
+// the package does not know.
+func (f Feature) String() string {
+	if name, ok := featureNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("%s bit %d", f.Type, f.Bit)
+}
+
+// Features holds the three feature bitmaps of a version 3 header.
+type Features struct {
+	Incompatible uint64
+	Compatible   uint64
+	Autoclear    uint64
+}
+
+// Features returns the header's feature bits. Version 2 headers have none.
+func (h *Header) Features() Features {
+	return Features{
+		Incompatible: h.IncompatibleFeatures,
+		Compatible:   h.CompatibleFeatures,
+		Autoclear:    h.AutoclearFeatures,
+	}
+}
+
+// Features returns the image's feature bits.
+func (img *Image) Features() Features {
+	return img.header.Features()
+}
+
+// bitmap returns the bitmap holding features of type t.
+func (f Features) bitmap(t FeatureType) uint64 {
+	switch t {
+	case FeatureIncompatible:
+		return f.Incompatible
+	case FeatureCompatible:
+		return f.Compatible
+	case FeatureAutoclear:
+		return f.Autoclear
+	default:
+		return 0
+	}
+}
+
+// Has reports whether feature is set.
+func (f Features) Has(feature Feature) bool {
+	return feature.Bit < 64 && f.bitmap(feature.Type)&(1<<feature.Bit) != 0
+}
+
+// List returns the features set, incompatible ones first and by bit
+// within each type.
+func (f Features) List() []Feature {
+	var list []Feature
+	for _, t := range []FeatureType{FeatureIncompatible, FeatureCompatible, FeatureAutoclear} {
+		for b := f.bitmap(t); b != 0; b &= b - 1 {
+			list = append(list, Feature{Type: t, Bit: uint8(bits.TrailingZeros64(b))})
+		}
+	}
+	return list
+}
+
+// String lists the names of the features set, separated by commas, or
+// returns "none".
+func (f Features) String() string {
+	list := f.List()
+	if len(list) == 0 {
+		return "none"
+	}
+	names := make([]string, len(list))
+	for i, feature := range list {
+		names[i] = feature.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// FeatureName returns the name of feature, preferring the image's own
+// feature name table extension, which can name bits newer than this
+// package.
+func (img *Image) FeatureName(feature Feature) string {
+	if img.extensions != nil {
+		prefix := [...]string{"incompat", "compat", "autoclear"}
+		if int(feature.Type) < len(prefix) {
+			if name := img.extensions.FeatureNames[fmt.Sprintf("%s_%d", prefix[feature.Type], feature.Bit)]; name != "" {
+				return name
+			}
+		}
+	}
+	return feature.String()
+}
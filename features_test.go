@@ -0,0 +1,66 @@
+// features_test.go - Feature bit helper tests
+
+package qcow2
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestFeatures checks Has, List and String on known and unknown bits.
+func TestFeatures(t *testing.T) {
+	t.Parallel()
+	f := Features{
+		Incompatible: IncompatCompression | IncompatExtendedL2 | 1<<7,
+		Autoclear:    AutoclearBitmaps,
+	}
+	for _, feature := range []Feature{FeatureCompressionType, FeatureExtendedL2, FeatureBitmaps} {
+		if !f.Has(feature) {
+			t.Errorf("Has(%s) = false, want true", feature)
+		}
+	}
+	for _, feature := range []Feature{FeatureDirty, FeatureLazyRefcounts, {Type: FeatureType(9)}, {Bit: 64}} {
+		if f.Has(feature) {
+			t.Errorf("Has(%s) = true, want false", feature)
+		}
+	}
+
+	want := "compression type, extended L2 entries, incompatible bit 7, bitmaps"
+	if got := f.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := (Features{}).String(); got != "none" {
+		t.Errorf("empty String() = %q, want none", got)
+	}
+	if got := len(f.List()); got != 4 {
+		t.Errorf("List() has %d features, want 4", got)
+	}
+	for _, feature := range KnownFeatures() {
+		if _, ok := featureNames[feature]; !ok {
+			t.Errorf("known feature %+v has no name", feature)
+		}
+	}
+}
+
+// TestImageFeatures checks the features of a created image.
+func TestImageFeatures(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "features.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 1024 * 1024, LazyRefcounts: true})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer img.Close()
+
+	f := img.Features()
+	if !f.Has(FeatureLazyRefcounts) || f.Has(FeatureExtendedL2) {
+		t.Errorf("Features() = %s, want lazy refcounts only", f)
+	}
+	if got := img.FeatureName(FeatureLazyRefcounts); got != "lazy refcounts" {
+		t.Errorf("FeatureName = %q, want lazy refcounts", got)
+	}
+	if got := img.FeatureName(Feature{Type: FeatureCompatible, Bit: 5}); got != "compatible bit 5" {
+		t.Errorf("FeatureName of unknown bit = %q", got)
+	}
+}
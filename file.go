@@ -0,0 +1,24 @@
+package qcow2
+
+import (
+	"io"
+	"os"
+)
+
+// File is the host file interface an Image performs its I/O through.
+// *os.File implements it; WithFileWrapper can interpose on it, for example
+// to inject latency or errors in tests.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Name() string
+}
+
+// fdFile is implemented by files backed by an OS file descriptor.
+type fdFile interface {
+	Fd() uintptr
+}
@@ -0,0 +1,86 @@
+// file_test.go - File wrapper and fault injection tests
+
+package qcow2
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// openFaulty opens the image at path through a FaultFile with no faults.
+func openFaulty(t *testing.T, path string) (*Image, *testutil.FaultFile) {
+	t.Helper()
+	var ff *testutil.FaultFile
+	img, err := Open(path, WithFileWrapper(func(f File) File {
+		ff = testutil.NewFaultFile(f, testutil.FaultConfig{})
+		return ff
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return img, ff
+}
+
+// TestFileWrapperInjectedErrors verifies injected errors surface from
+// image operations and the image works again once faults stop.
+func TestFileWrapperInjectedErrors(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "faulty.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, ff := openFaulty(t, path)
+	defer img.Close()
+	if ff.Calls(testutil.OpRead) == 0 {
+		t.Error("expected header reads to go through the wrapper")
+	}
+
+	ff.SetConfig(testutil.FaultConfig{Write: testutil.FaultProfile{ErrorRate: 1}})
+	if _, err := img.WriteAt([]byte("data"), 0); !errors.Is(err, testutil.ErrInjected) {
+		t.Fatalf("WriteAt: got %v, want ErrInjected", err)
+	}
+	if ff.Faults(testutil.OpWrite) == 0 {
+		t.Error("expected injected write faults to be counted")
+	}
+
+	ff.SetConfig(testutil.FaultConfig{})
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt after faults cleared failed: %v", err)
+	}
+}
+
+// TestFileWrapperLatency verifies injected latency delays reads.
+func TestFileWrapperLatency(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "slow.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	img, ff := openFaulty(t, path)
+	defer img.Close()
+
+	const latency = 20 * time.Millisecond
+	ff.SetConfig(testutil.FaultConfig{Read: testutil.FaultProfile{Latency: latency}})
+
+	start := time.Now()
+	buf := make([]byte, 4)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("ReadAt took %v, want at least %v", elapsed, latency)
+	}
+}
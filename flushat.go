@@ -0,0 +1,208 @@
+package qcow2
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// byteRange is the half-open guest range [start, end).
+type byteRange struct {
+	start, end uint64
+}
+
+// maxUnsyncedRanges caps the unsynced range set. Past it the whole image
+// counts as unsynced until the next sync, so heavy random writes cost a
+// bounded amount of memory and insertion time.
+const maxUnsyncedRanges = 1024
+
+// unsyncedRanges is the set of guest ranges written since the last Flush,
+// kept sorted with overlapping and adjacent ranges merged. Nothing is
+// tracked until the first FlushAt, so images that never use it pay only an
+// atomic load per write.
+type unsyncedRanges struct {
+	// Set by the first FlushAt
+	tracking atomic.Bool
+
+	mu     sync.Mutex
+	ranges []byteRange
+
+	// Everything counts as unsynced: writes landed before tracking began,
+	// or the set outgrew maxUnsyncedRanges
+	all bool
+
+	// Recorded writes are widened to multiples of this (the cluster size)
+	grain uint64
+
+	// Held from beginSync to endSync, so a range taken by a sync in
+	// progress is not reported clean before that sync completes
+	syncMu sync.Mutex
+}
+
+// unsyncedSet is the content of an unsyncedRanges taken for a sync.
+type unsyncedSet struct {
+	ranges []byteRange
+	all    bool
+}
+
+// track starts recording writes at the given granularity. Writes that
+// completed before it are unknown, so the whole image counts as unsynced
+// until the next sync.
+func (u *unsyncedRanges) track(grain uint64) {
+	if u.tracking.Load() {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.tracking.Load() {
+		u.grain = grain
+		u.all = true
+		u.ranges = nil
+		u.tracking.Store(true)
+	}
+}
+
+// add records a write to [start, end).
+func (u *unsyncedRanges) add(start, end uint64) {
+	if start >= end {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addLocked(start, end)
+}
+
+// addWrite records a write of n bytes at guest offset off, widened to
+// whole grains. Writes are recorded after they complete, so a sync that
+// starts earlier cannot consume them.
+func (u *unsyncedRanges) addWrite(off, n int64) {
+	if !u.tracking.Load() || off < 0 || n <= 0 {
+		return
+	}
+	start, end := uint64(off), uint64(off)+uint64(n)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if g := u.grain; g > 0 {
+		start -= start % g
+		end += (g - end%g) % g
+	}
+	u.addLocked(start, end)
+}
+
+func (u *unsyncedRanges) addLocked(start, end uint64) {
+	if u.all {
+		return
+	}
+	// First range that touches or follows the new one
+	i := sort.Search(len(u.ranges), func(i int) bool { return u.ranges[i].end >= start })
+	j := i
+	for j < len(u.ranges) && u.ranges[j].start <= end {
+		start = min(start, u.ranges[j].start)
+		end = max(end, u.ranges[j].end)
+		j++
+	}
+	if i == j {
+		if len(u.ranges) >= maxUnsyncedRanges {
+			u.ranges = nil
+			u.all = true
+			return
+		}
+		u.ranges = append(u.ranges, byteRange{})
+		copy(u.ranges[i+1:], u.ranges[i:])
+	} else {
+		u.ranges = append(u.ranges[:i+1], u.ranges[j:]...)
+	}
+	u.ranges[i] = byteRange{start, end}
+}
+
+// overlaps reports whether any unsynced write intersects [start, end).
+func (u *unsyncedRanges) overlaps(start, end uint64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.all {
+		return true
+	}
+	i := sort.Search(len(u.ranges), func(i int) bool { return u.ranges[i].end > start })
+	return i < len(u.ranges) && u.ranges[i].start < end
+}
+
+// beginSync takes the ranges a sync is about to make durable. It must be
+// paired with endSync.
+func (u *unsyncedRanges) beginSync() unsyncedSet {
+	u.syncMu.Lock()
+	return u.take()
+}
+
+// endSync finishes a sync started by beginSync, putting its ranges back if
+// the sync failed.
+func (u *unsyncedRanges) endSync(set unsyncedSet, err error) {
+	if err != nil {
+		u.restore(set)
+	}
+	u.syncMu.Unlock()
+}
+
+// dirty reports whether [start, end) has writes that are not yet durable,
+// waiting for any sync in progress to finish first.
+func (u *unsyncedRanges) dirty(start, end uint64) bool {
+	u.syncMu.Lock()
+	defer u.syncMu.Unlock()
+	return u.overlaps(start, end)
+}
+
+// take empties the set and returns what it held, before a sync.
+func (u *unsyncedRanges) take() unsyncedSet {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	set := unsyncedSet{ranges: u.ranges, all: u.all}
+	u.ranges = nil
+	u.all = false
+	return set
+}
+
+// restore puts back ranges taken for a sync that failed.
+func (u *unsyncedRanges) restore(set unsyncedSet) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if set.all {
+		u.ranges = nil
+		u.all = true
+		return
+	}
+	for _, r := range set.ranges {
+		u.addLocked(r.start, r.end)
+	}
+}
+
+// FlushAt makes the writes to the guest range [off, off+length) durable,
+// like a guest flush limited to that range. The image remembers which guest
+// ranges were written since the last flush; when none of them intersect the
+// range there is nothing to do and no sync is issued, which keeps repeated
+// flushes of clean ranges cheap. Otherwise FlushAt performs a full Flush,
+// since the host offers no durable sync of part of a file.
+//
+// Ranges are only remembered from the first FlushAt on, so that call always
+// flushes, and are tracked at cluster granularity. Past a fixed number of
+// separate ranges the whole image counts as unsynced until the next flush.
+func (img *Image) FlushAt(off, length int64) error {
+	if off < 0 || length < 0 {
+		return ErrOffsetOutOfRange
+	}
+	img.unsynced.track(img.clusterSize)
+	if !img.unsynced.dirty(uint64(off), uint64(off)+uint64(length)) {
+		return nil
+	}
+	return img.Flush()
+}
+
+// WriteAtFUA is WriteAt with force unit access semantics: when it returns
+// without error the data, and the metadata needed to find it, are durable,
+// whatever the WriteBarrierMode. Use it to emulate SCSI and NVMe FUA writes;
+// other unsynced writes may be made durable along with it.
+func (img *Image) WriteAtFUA(p []byte, off int64) (int, error) {
+	n, err := img.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, img.FlushAt(off, int64(n))
+}
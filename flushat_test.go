@@ -0,0 +1,290 @@
+// flushat_test.go - Range flush tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestFlushAt verifies FlushAt only syncs when the range has unsynced writes.
+func TestFlushAt(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "flushat.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, ff := openFaulty(t, path)
+	defer img.Close()
+	cs := int64(img.ClusterSize())
+
+	// The first FlushAt starts tracking ranges
+	if err := img.FlushAt(0, 0); err != nil {
+		t.Fatalf("FlushAt failed: %v", err)
+	}
+
+	if _, err := img.WriteAt(testutil.RandomBytes(1, int(cs)), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(2, 100), 4*cs+10); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	syncs := ff.Calls(testutil.OpSync)
+	if err := img.FlushAt(2*cs, cs); err != nil {
+		t.Fatalf("FlushAt failed: %v", err)
+	}
+	if got := ff.Calls(testutil.OpSync) - syncs; got != 0 {
+		t.Errorf("flush of clean range issued %d syncs, want 0", got)
+	}
+
+	if err := img.FlushAt(4*cs, 11); err != nil {
+		t.Fatalf("FlushAt failed: %v", err)
+	}
+	if got := ff.Calls(testutil.OpSync) - syncs; got == 0 {
+		t.Error("flush of written range issued no sync")
+	}
+
+	// The flush above synced everything, including cluster 0
+	syncs = ff.Calls(testutil.OpSync)
+	if err := img.FlushAt(0, 4*cs+110); err != nil {
+		t.Fatalf("FlushAt failed: %v", err)
+	}
+	if got := ff.Calls(testutil.OpSync) - syncs; got != 0 {
+		t.Errorf("flush after full sync issued %d syncs, want 0", got)
+	}
+
+	if err := img.FlushAt(-1, 1); err != ErrOffsetOutOfRange {
+		t.Errorf("negative offset: got %v, want ErrOffsetOutOfRange", err)
+	}
+}
+
+// TestWriteAtFUA verifies a FUA write syncs even in batched barrier mode,
+// and leaves its range clean for FlushAt.
+func TestWriteAtFUA(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "fua.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, ff := openFaulty(t, path)
+	defer img.Close()
+	img.SetWriteBarrierMode(BarrierBatched)
+	cs := int64(img.ClusterSize())
+
+	syncs := ff.Calls(testutil.OpSync)
+	if _, err := img.WriteAt(testutil.RandomBytes(1, int(cs)), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if got := ff.Calls(testutil.OpSync) - syncs; got != 0 {
+		t.Fatalf("batched write issued %d syncs, want 0", got)
+	}
+
+	data := testutil.RandomBytes(2, 512)
+	n, err := img.WriteAtFUA(data, 3*cs+100)
+	if err != nil || n != len(data) {
+		t.Fatalf("WriteAtFUA = %d, %v", n, err)
+	}
+	if ff.Calls(testutil.OpSync) == syncs {
+		t.Error("FUA write issued no sync")
+	}
+
+	syncs = ff.Calls(testutil.OpSync)
+	if err := img.FlushAt(0, 4*cs); err != nil {
+		t.Fatalf("FlushAt failed: %v", err)
+	}
+	if got := ff.Calls(testutil.OpSync) - syncs; got != 0 {
+		t.Errorf("FlushAt after FUA write issued %d syncs, want 0", got)
+	}
+
+	if _, err := img.WriteAtFUA(data, img.Size()); err != ErrOffsetOutOfRange {
+		t.Errorf("write past end: got %v, want ErrOffsetOutOfRange", err)
+	}
+}
+
+// syncOrderFile records when the write of a watched payload landed and
+// when the latest sync started, on one sequence.
+type syncOrderFile struct {
+	File
+	seq, landed, syncStart *atomic.Int64
+	payload                *atomic.Pointer[[]byte]
+}
+
+func (f syncOrderFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if want := f.payload.Load(); want != nil && bytes.Equal(p, *want) {
+		f.landed.Store(f.seq.Add(1))
+	}
+	return n, err
+}
+
+func (f syncOrderFile) Sync() error {
+	f.syncStart.Store(f.seq.Add(1))
+	// A slow sync lets writes land while it runs
+	time.Sleep(100 * time.Microsecond)
+	return f.File.Sync()
+}
+
+// TestWriteAtFUAConcurrentFlush verifies a FUA write is synced after its
+// data landed even while other goroutines keep flushing, which can clear
+// the dirty flag between the write and its flush.
+func TestWriteAtFUAConcurrentFlush(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "fua.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	var seq, landed, syncStart atomic.Int64
+	var payload atomic.Pointer[[]byte]
+	img, err = Open(path, WithFileWrapper(func(f File) File {
+		return syncOrderFile{f, &seq, &landed, &syncStart, &payload}
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	img.SetWriteBarrierMode(BarrierBatched)
+	cs := img.ClusterSize()
+
+	// Other writes keep the image dirty, so the flushes keep syncing
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(writer bool) {
+			defer wg.Done()
+			other := testutil.RandomBytes(-1, 512)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var err error
+				if writer {
+					_, err = img.WriteAt(other, img.Size()-int64(cs))
+				} else {
+					err = img.Flush()
+				}
+				if err != nil {
+					t.Errorf("concurrent I/O failed: %v", err)
+					return
+				}
+			}
+		}(i == 0)
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := 0; i < 20; i++ {
+		data := testutil.RandomBytes(int64(i), cs)
+		payload.Store(&data)
+		if _, err := img.WriteAtFUA(data, int64(i%32*cs)); err != nil {
+			t.Fatalf("WriteAtFUA failed: %v", err)
+		}
+		if syncStart.Load() < landed.Load() {
+			t.Fatalf("write %d: WriteAtFUA returned with no sync after its data landed", i)
+		}
+	}
+}
+
+// TestUnsyncedRanges exercises merging in the unsynced range set.
+func TestUnsyncedRanges(t *testing.T) {
+	t.Parallel()
+	var u unsyncedRanges
+	u.add(10, 20)
+	u.add(40, 50)
+	u.add(30, 35)
+	u.add(20, 30) // Joins the first two
+	u.add(5, 5)   // Empty
+
+	want := []byteRange{{10, 35}, {40, 50}}
+	if len(u.ranges) != len(want) {
+		t.Fatalf("ranges = %v, want %v", u.ranges, want)
+	}
+	for i := range want {
+		if u.ranges[i] != want[i] {
+			t.Fatalf("ranges = %v, want %v", u.ranges, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		start, end uint64
+		want       bool
+	}{
+		{0, 10, false},
+		{0, 11, true},
+		{35, 40, false},
+		{34, 41, true},
+		{50, 60, false},
+	} {
+		if got := u.overlaps(tc.start, tc.end); got != tc.want {
+			t.Errorf("overlaps(%d, %d) = %v, want %v", tc.start, tc.end, got, tc.want)
+		}
+	}
+
+	taken := u.take()
+	if u.overlaps(0, 100) {
+		t.Error("set not empty after take")
+	}
+	u.add(0, 12)
+	u.restore(taken)
+	if len(u.ranges) != 2 || u.ranges[0] != (byteRange{0, 35}) {
+		t.Errorf("after restore ranges = %v", u.ranges)
+	}
+}
+
+// TestUnsyncedRangesTracking verifies writes are ignored until tracking
+// starts, widened to whole grains after, and collapse to the whole image
+// past maxUnsyncedRanges.
+func TestUnsyncedRangesTracking(t *testing.T) {
+	t.Parallel()
+	var u unsyncedRanges
+	u.addWrite(100, 10)
+	if len(u.ranges) != 0 || u.all {
+		t.Fatalf("write recorded before tracking: %v", u.ranges)
+	}
+
+	u.track(64)
+	if !u.overlaps(1<<40, 1<<40+1) {
+		t.Error("writes before tracking not treated as unsynced")
+	}
+	u.take()
+
+	u.addWrite(100, 10)
+	if len(u.ranges) != 1 || u.ranges[0] != (byteRange{64, 128}) {
+		t.Errorf("ranges = %v, want [{64 128}]", u.ranges)
+	}
+
+	for i := range maxUnsyncedRanges {
+		u.addWrite(int64(i+2)*128, 1)
+	}
+	if !u.all || u.ranges != nil {
+		t.Fatalf("set of %d ranges not collapsed", maxUnsyncedRanges+1)
+	}
+	taken := u.take()
+	if u.overlaps(0, 1) {
+		t.Error("set not empty after take")
+	}
+	u.restore(taken)
+	if !u.overlaps(0, 1) {
+		t.Error("restore lost the whole-image state")
+	}
+}
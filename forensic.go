@@ -0,0 +1,132 @@
+package qcow2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ForensicWarning describes damage that an image opened with OpenForensic
+// worked around.
+type ForensicWarning struct {
+	// Off and Length give the guest range a read returned as zeros, or
+	// are -1 and 0 for problems found while opening the image.
+	Off    int64
+	Length int64
+
+	// Err is the error that would otherwise have been returned.
+	Err error
+}
+
+func (w ForensicWarning) Error() string {
+	if w.Off < 0 {
+		return fmt.Sprintf("qcow2: forensic open: %v", w.Err)
+	}
+	return fmt.Sprintf("qcow2: forensic read at %d+%d: %v", w.Off, w.Length, w.Err)
+}
+
+func (w ForensicWarning) Unwrap() error {
+	return w.Err
+}
+
+// OpenForensic opens a damaged image read-only for data recovery, calling
+// warn (if not nil) instead of failing for anything it can work around:
+//
+//   - a corrupt bit or unknown incompatible features in the header
+//   - an L1 table running past the end of the file, which is cut short
+//   - a virtual size beyond what the L1 table covers, which is reduced
+//   - unreadable header extensions, which are ignored
+//   - a broken snapshot table, of which the snapshots parsed before the
+//     damage are kept
+//   - a missing or unreadable backing file, which then reads as zeros
+//
+// Refcounts are not consulted for reads, so they may be arbitrarily wrong.
+// ReadAt returns zeros for clusters it cannot read, such as ones behind an
+// unreadable L2 table or with a corrupt compressed payload, and reports
+// each through warn. Backing files are opened the same way.
+func OpenForensic(path string, warn func(ForensicWarning), opts ...Option) (*Image, error) {
+	if warn == nil {
+		warn = func(ForensicWarning) {}
+	}
+	opts = append(opts, withForensic(warn))
+	return OpenFile(path, os.O_RDONLY, 0, opts...)
+}
+
+// withForensic makes the image tolerate damage as OpenForensic describes.
+func withForensic(warn func(ForensicWarning)) Option {
+	return func(o *imageOptions) {
+		o.forensic = warn
+		o.readOnly = true
+	}
+}
+
+// tolerate reports err to the forensic callback and returns true, or
+// returns false if the image is not being opened forensically.
+func (o *imageOptions) tolerate(err error) bool {
+	if o.forensic == nil {
+		return false
+	}
+	o.forensic(ForensicWarning{Off: -1, Err: err})
+	return true
+}
+
+// trimForensicLayout cuts the L1 table to what the file holds and the
+// virtual size to what the L1 table covers.
+func (img *Image) trimForensicLayout(o *imageOptions) error {
+	info, err := img.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := uint64(info.Size())
+
+	l1Off := img.header.L1TableOffset
+	l1Size := uint64(img.header.L1Size)
+	var avail uint64
+	if l1Off < fileSize {
+		avail = (fileSize - l1Off) / 8
+	}
+	if l1Size > avail {
+		o.tolerate(fmt.Errorf("L1 table at 0x%x with %d entries runs past the end of the file; using %d entries",
+			l1Off, l1Size, avail))
+		img.header.L1Size = uint32(avail)
+		l1Size = avail
+	}
+
+	coverage := l1Size * img.l2Entries * img.clusterSize
+	if img.header.Size > coverage || img.header.Size > 1<<63-1 {
+		o.tolerate(fmt.Errorf("virtual size %d is beyond the %d bytes the L1 table covers", img.header.Size, coverage))
+		img.header.Size = min(coverage, 1<<63-1)
+	}
+	return nil
+}
+
+// readAtForensic is ReadAt for forensically opened images: each cluster
+// that fails to read is zeroed and reported, and the read goes on after it.
+func (img *Image) readAtForensic(p []byte, off int64) (n int, err error) {
+	// Clamp like ReadAt, so skipping a cluster cannot run past the end
+	if size := img.Size(); off >= 0 && off < size && off+int64(len(p)) > size {
+		p = p[:size-off]
+	}
+	for {
+		read, err := img.readAt(p[n:], off+int64(n))
+		n += read
+		if err == nil || errors.Is(err, ErrClosed) || errors.Is(err, ErrOffsetOutOfRange) {
+			return n, err
+		}
+		// io.EOF means the end of the image, or a cluster past the end of
+		// the file
+		pos := off + int64(n)
+		if err == io.EOF && pos >= img.Size() {
+			return n, err
+		}
+
+		skip := min(int64(img.clusterSize)-pos&int64(img.offsetMask), int64(len(p)-n))
+		clear(p[n : n+int(skip)])
+		img.forensic(ForensicWarning{Off: pos, Length: skip, Err: err})
+		n += int(skip)
+		if n == len(p) {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// forensic_test.go - Forensic open tests
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenForensic verifies a damaged image that Open refuses can still be
+// read, with the damage reported and unreadable clusters read as zeros.
+func TestOpenForensic(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "damaged.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := int64(img.ClusterSize())
+	for i := int64(0); i < 3; i++ {
+		if _, err := img.WriteAt(bytes.Repeat([]byte{byte(i + 1)}, int(cs)), i*cs); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	l2Off := binary.BigEndian.Uint64(img.l1Table) & L1EntryOffsetMask
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Point cluster 1 past the end of the file, set the corrupt bit and
+	// claim a virtual size the L1 table cannot cover
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], L2EntryCopied|1<<40)
+	if _, err := f.WriteAt(buf[:], int64(l2Off)+8); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(buf[:], IncompatCorruptBit)
+	if _, err := f.WriteAt(buf[:], 72); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(buf[:], 1<<62)
+	if _, err := f.WriteAt(buf[:], 24); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := Open(path); !errors.Is(err, ErrIncompatFeatures) {
+		t.Fatalf("Open: got %v, want ErrIncompatFeatures", err)
+	}
+
+	var warnings []ForensicWarning
+	img, err = OpenForensic(path, func(w ForensicWarning) { warnings = append(warnings, w) })
+	if err != nil {
+		t.Fatalf("OpenForensic failed: %v", err)
+	}
+	defer img.Close()
+	if len(warnings) != 2 || !errors.Is(warnings[0], ErrIncompatFeatures) || warnings[0].Off != -1 {
+		t.Errorf("open warnings = %v, want corrupt bit and virtual size", warnings)
+	}
+	if img.Size() >= 1<<62 {
+		t.Errorf("Size = %d, want it cut to the L1 table", img.Size())
+	}
+	if _, err := img.WriteAt([]byte{1}, 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("WriteAt: got %v, want ErrReadOnly", err)
+	}
+
+	warnings = nil
+	got := make([]byte, 3*cs)
+	n, err := img.ReadAt(got, 0)
+	if err != nil || n != len(got) {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	for i, want := range []byte{1, 0, 3} {
+		if !bytes.Equal(got[int64(i)*cs:int64(i+1)*cs], bytes.Repeat([]byte{want}, int(cs))) {
+			t.Errorf("cluster %d does not read as %d", i, want)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Off != cs || warnings[0].Length != cs {
+		t.Errorf("read warnings = %v, want one for cluster 1", warnings)
+	}
+}
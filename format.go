@@ -30,6 +30,9 @@ const (
 	MaxClusterBits     = 21 // 2MB
 )
 
+// MaxRefcountOrder is the largest refcount order: 64-bit refcounts.
+const MaxRefcountOrder = 6
+
 // Encryption methods
 const (
 	EncryptionNone = 0
@@ -66,6 +69,10 @@ const (
 // WriteBarrierMode controls how write ordering barriers are applied.
 // Barriers ensure crash consistency by syncing data to disk before
 // updating metadata that references it.
+//
+// Barriers sync through File.Sync. On macOS, *os.File implements that with
+// fcntl(F_FULLFSYNC), which also flushes the drive's write cache; a plain
+// fsync there does not, so barriers would not survive power loss.
 type WriteBarrierMode int
 
 const (
@@ -104,6 +111,27 @@ const (
 	ZeroAlloc
 )
 
+// ClusterReusePolicy controls which free cluster (refcount 0) a new
+// cluster is placed in before the file is grown.
+type ClusterReusePolicy int
+
+const (
+	// ReuseFirstFit reuses the lowest free cluster. This keeps the file
+	// small, but new data ends up interleaved with old.
+	ReuseFirstFit ClusterReusePolicy = iota
+
+	// ReuseAppendOnly never reuses clusters and always grows the file, so
+	// data written together stays together. Freed clusters stay holes
+	// until the image is compacted.
+	ReuseAppendOnly
+
+	// ReuseBestFit reuses the first cluster of the shortest run of free
+	// clusters, filling small holes first and leaving long runs free for
+	// later writes. The free space at the end of the file counts as the
+	// longest run.
+	ReuseBestFit
+)
+
 // L2 entry flags (in the high bits of the 64-bit entry)
 const (
 	L2EntryCompressed = uint64(1) << 62
@@ -176,6 +204,8 @@ var (
 	ErrInvalidMagic             = errors.New("qcow2: invalid magic number")
 	ErrUnsupportedVersion       = errors.New("qcow2: unsupported version")
 	ErrInvalidClusterBits       = errors.New("qcow2: invalid cluster bits")
+	ErrInvalidRefcountOrder     = errors.New("qcow2: invalid refcount order")
+	ErrInvalidHeaderLength      = errors.New("qcow2: invalid header length")
 	ErrIncompatFeatures         = errors.New("qcow2: unsupported incompatible features")
 	ErrCorruptImage             = errors.New("qcow2: image is marked corrupt")
 	ErrImageDirty               = errors.New("qcow2: image is marked dirty, needs repair")
@@ -186,8 +216,56 @@ var (
 	ErrCompressionNotBeneficial = errors.New("qcow2: compression not beneficial for this data")
 	ErrEncryptedImage           = errors.New("qcow2: encrypted images are not supported")
 	ErrExternalDataFileMissing  = errors.New("qcow2: external data file name not specified in header extension")
+	ErrQuotaExceeded            = errors.New("qcow2: allocation quota exceeded")
+	ErrRawDataFile              = errors.New("qcow2: operation would break the raw external data file mapping")
+	ErrDeviceFull               = errors.New("qcow2: no space left on host block device")
+	ErrCompatLevel              = errors.New("qcow2: feature beyond the image's compat level")
+	ErrShortWrite               = errors.New("qcow2: write extends past end of image")
+	ErrNoSpace                  = errors.New("qcow2: no space left on host file system")
+	ErrClosed                   = errors.New("qcow2: image is closed")
+	ErrNoVMState                = errors.New("qcow2: snapshot has no saved VM state")
+	ErrVirtualSizeLimit         = errors.New("qcow2: virtual size exceeds the limit")
+	ErrL1TableSize              = errors.New("qcow2: L1 table size is inconsistent with the image")
+	ErrUnknownProfile           = errors.New("qcow2: unknown creation profile")
+	ErrInvalidMetadata          = errors.New("qcow2: invalid user metadata")
+	ErrMetadataTooLarge         = errors.New("qcow2: user metadata too large")
+	ErrTranslationMismatch      = errors.New("qcow2: cached translation differs from the image file")
 )
 
+// HeaderFieldError reports a header field, or a value requested for one,
+// outside the range the package supports. errors.Is matches it against the
+// error for the field: ErrInvalidClusterBits, ErrInvalidRefcountOrder or
+// ErrInvalidHeaderLength.
+type HeaderFieldError struct {
+	Field    string // Field name as in the qcow2 specification
+	Value    uint64 // Offending value
+	Min, Max uint64 // Valid range, inclusive
+	Align    uint64 // Value must be a multiple of Align, if nonzero
+
+	err error
+}
+
+// invalidClusterBits returns the error for cluster bits outside
+// [MinClusterBits, MaxClusterBits], or nil.
+func invalidClusterBits(bits uint32) error {
+	if bits >= MinClusterBits && bits <= MaxClusterBits {
+		return nil
+	}
+	return &HeaderFieldError{Field: "cluster_bits", Value: uint64(bits), Min: MinClusterBits, Max: MaxClusterBits, err: ErrInvalidClusterBits}
+}
+
+func (e *HeaderFieldError) Error() string {
+	msg := fmt.Sprintf("%v: %d (valid range %d-%d", e.err, e.Value, e.Min, e.Max)
+	if e.Align != 0 {
+		msg += fmt.Sprintf(", multiple of %d", e.Align)
+	}
+	return msg + ")"
+}
+
+func (e *HeaderFieldError) Unwrap() error {
+	return e.err
+}
+
 // ParseHeader reads and validates a QCOW2 header from raw bytes.
 // The input must be at least HeaderSizeV2 bytes.
 func ParseHeader(data []byte) (*Header, error) {
@@ -219,8 +297,8 @@ func ParseHeader(data []byte) (*Header, error) {
 		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
 	}
 
-	if h.ClusterBits < MinClusterBits || h.ClusterBits > MaxClusterBits {
-		return nil, fmt.Errorf("%w: %d", ErrInvalidClusterBits, h.ClusterBits)
+	if err := invalidClusterBits(h.ClusterBits); err != nil {
+		return nil, err
 	}
 
 	// Parse version 3 fields
@@ -233,6 +311,13 @@ func ParseHeader(data []byte) (*Header, error) {
 		h.AutoclearFeatures = binary.BigEndian.Uint64(data[88:96])
 		h.RefcountOrder = binary.BigEndian.Uint32(data[96:100])
 		h.HeaderLength = binary.BigEndian.Uint32(data[100:104])
+		if h.RefcountOrder > MaxRefcountOrder {
+			return nil, &HeaderFieldError{Field: "refcount_order", Value: uint64(h.RefcountOrder), Max: MaxRefcountOrder, err: ErrInvalidRefcountOrder}
+		}
+		// The header must fit in the first cluster
+		if h.HeaderLength < HeaderSizeV3 || uint64(h.HeaderLength) > h.ClusterSize() || h.HeaderLength%8 != 0 {
+			return nil, &HeaderFieldError{Field: "header_length", Value: uint64(h.HeaderLength), Min: HeaderSizeV3, Max: h.ClusterSize(), Align: 8, err: ErrInvalidHeaderLength}
+		}
 
 		// Parse compression type if the feature bit is set
 		if h.IncompatibleFeatures&IncompatCompression != 0 && len(data) > 104 {
@@ -257,7 +342,7 @@ func (h *Header) Validate() error {
 		// Legacy AES encryption supported (read-only, requires SetPassword)
 		// Note: This is insecure and deprecated, only for data recovery
 	case EncryptionLUKS:
-		// LUKS encryption supported (read-only, requires SetPasswordLUKS)
+		// LUKS encryption supported (read-only, requires UnlockLUKS)
 	default:
 		return fmt.Errorf("%w: unknown method=%d", ErrEncryptedImage, h.EncryptMethod)
 	}
@@ -318,6 +403,13 @@ func (h *Header) HasExternalDataFile() bool {
 	return h.IncompatibleFeatures&IncompatExternalData != 0
 }
 
+// HasRawExternalData returns true if the external data file is a raw image:
+// guest offsets map 1:1 to data file offsets, so the file is usable on its
+// own without the qcow2 metadata.
+func (h *Header) HasRawExternalData() bool {
+	return h.HasExternalDataFile() && h.AutoclearFeatures&AutoclearRawExternal != 0
+}
+
 // HasExtendedL2 returns true if the image uses extended L2 entries (128-bit).
 // Extended L2 entries support 32 subclusters per cluster for finer-grained
 // allocation and zero tracking.
@@ -0,0 +1,166 @@
+package qcow2
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// InvalidateCaches drops everything the image holds in memory about its
+// file and reloads it from disk: the header and its extensions, the L1 and
+// refcount tables, the snapshot table, and the L2, refcount block,
+// compressed and data cluster caches. It is the counterpart of QEMU's
+// bdrv_invalidate_cache, for taking an image back after another process
+// has written to it, as at the end of a migration handoff.
+//
+// The other writer must be finished with the image. Writes buffered by
+// WithDelayedAllocation and refcount updates held by WithRefcountWriteback
+// are not flushed into a file that changed under them; InvalidateCaches
+// fails if any are pending. It also fails if the image changed in ways an
+// open image cannot follow: a different cluster size, subcluster layout,
+// encryption method, external data file or backing file. A metadata
+// checksum sidecar cannot be kept in step with another writer, so images
+// opened with one are refused as well.
+//
+// A writable image is marked dirty again if the other writer closed it
+// cleanly, and lazy refcounts are rebuilt if it did not.
+//
+// InvalidateCaches must not run concurrently with any other method of the
+// image, reads included: it replaces the header, tables, caches and file
+// mapping they use without locking them against readers.
+func (img *Image) InvalidateCaches() error {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	if img.metaChecksums != nil {
+		return fmt.Errorf("qcow2: cannot invalidate caches with a metadata checksum sidecar attached")
+	}
+	if d := img.delayed; d != nil {
+		d.mu.Lock()
+		pending := len(d.clusters)
+		d.mu.Unlock()
+		if pending > 0 {
+			return fmt.Errorf("qcow2: cannot invalidate caches with %d delayed clusters unwritten", pending)
+		}
+	}
+	if pin := img.refcountPin; pin != nil {
+		pin.mu.Lock()
+		dirty := pin.dirty
+		pin.mu.Unlock()
+		if dirty {
+			return fmt.Errorf("qcow2: cannot invalidate caches with refcount updates unwritten")
+		}
+	}
+
+	headerBuf := make([]byte, HeaderSizeV3+1)
+	n, err := img.file.ReadAt(headerBuf, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("qcow2: failed to read header: %w", err)
+	}
+	if n < HeaderSizeV2 {
+		return fmt.Errorf("qcow2: file too small for header: %d bytes", n)
+	}
+	header, err := ParseHeader(headerBuf[:n])
+	if err != nil {
+		return err
+	}
+	if err := header.Validate(); err != nil {
+		return err
+	}
+
+	old := img.header
+	switch {
+	case header.ClusterBits != old.ClusterBits:
+		return fmt.Errorf("qcow2: cluster size changed from %d to %d", old.ClusterSize(), header.ClusterSize())
+	case header.HasExtendedL2() != old.HasExtendedL2():
+		return fmt.Errorf("qcow2: extended L2 entries were enabled or disabled")
+	case header.EncryptMethod != old.EncryptMethod:
+		return fmt.Errorf("qcow2: encryption method changed from %d to %d", old.EncryptMethod, header.EncryptMethod)
+	case header.HasExternalDataFile() != old.HasExternalDataFile():
+		return fmt.Errorf("qcow2: external data file was attached or detached")
+	}
+
+	if oldBacking, backing := img.BackingFile(), img.backingFileName(header); backing != oldBacking {
+		return fmt.Errorf("qcow2: backing file changed from %q to %q", oldBacking, backing)
+	}
+
+	// Reload the tables and drop everything derived from the old ones. The
+	// old header and L1 table stay if the new L1 table cannot be read
+	oldL1 := img.l1Table
+	img.header = header
+	if err := img.loadL1Table(); err != nil {
+		img.header = old
+		img.l1Table = oldL1
+		return fmt.Errorf("qcow2: failed to load L1 table: %w", err)
+	}
+	img.lazyRefcounts = header.HasLazyRefcounts()
+	img.refcountTableLock.Lock()
+	img.refcountTable = nil
+	err = img.loadRefcountTable()
+	img.refcountTableLock.Unlock()
+	if err != nil {
+		return err
+	}
+	img.freeBitmap = nil
+	img.freeBitmapOnce = sync.Once{}
+
+	img.l2Cache.clear()
+	img.refcountBlockCache.clear()
+	if err := img.unpinRefcountBlock(true); err != nil {
+		return err
+	}
+	img.compressedCache.cache.clear()
+	if img.dataCache != nil {
+		img.dataCache.clear()
+	}
+	img.snapshotL1Mu.Lock()
+	img.snapshotL1 = nil
+	img.snapshotL1Mu.Unlock()
+
+	img.bitmapExt = nil
+	img.bitmapsInvalidated = false
+	extensions, err := img.parseHeaderExtensions()
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to parse header extensions: %w", err)
+	}
+	img.extensions = extensions
+	if err := img.loadSnapshots(); err != nil {
+		return fmt.Errorf("qcow2: failed to load snapshots: %w", err)
+	}
+
+	if img.device != nil {
+		end, err := img.allocatedEnd()
+		if err != nil {
+			return fmt.Errorf("qcow2: failed to find end of image on block device: %w", err)
+		}
+		img.device.setEnd(int64(end))
+	}
+
+	// The file may have grown past the old mapping
+	if img.mmapData != nil {
+		if err := munmapFile(img.mmapData); err != nil {
+			return fmt.Errorf("qcow2: failed to unmap image: %w", err)
+		}
+		img.mmapData = nil
+		data, err := mmapFile(img.dataFile())
+		if err != nil {
+			return fmt.Errorf("qcow2: failed to mmap image: %w", err)
+		}
+		img.mmapData = data
+	}
+
+	if img.readOnly {
+		return nil
+	}
+	if header.HasLazyRefcounts() && header.IsDirty() {
+		if err := img.rebuildRefcounts(); err != nil {
+			return fmt.Errorf("qcow2: failed to rebuild refcounts: %w", err)
+		}
+	}
+	if header.Version >= Version3 {
+		if err := img.markDirty(); err != nil {
+			return fmt.Errorf("qcow2: failed to mark image dirty: %w", err)
+		}
+	}
+	return nil
+}
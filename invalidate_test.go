@@ -0,0 +1,213 @@
+// invalidate_test.go - Tests for reloading an image changed by another writer
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+func TestInvalidateCaches(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	first := bytes.Repeat([]byte("first"), 1000)
+	if _, err := img.WriteAt(first, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	reader, err := OpenFile(path, os.O_RDONLY, 0, WithDataCacheSize(4))
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer reader.Close()
+	got := make([]byte, len(first))
+	if _, err := reader.ReadAt(got, 0); err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("initial read mismatch (err %v)", err)
+	}
+
+	// Hand the image over to a second writer, which snapshots and rewrites
+	// it
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	other, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := other.CreateSnapshot("handoff"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	second := bytes.Repeat([]byte("second"), 1000)
+	if _, err := other.WriteAt(second, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := other.WriteAt([]byte("later"), 768*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if err := reader.InvalidateCaches(); err != nil {
+		t.Fatalf("InvalidateCaches failed: %v", err)
+	}
+	got = make([]byte, len(second))
+	if _, err := reader.ReadAt(got, 0); err != nil || !bytes.Equal(got, second) {
+		t.Errorf("read after reload mismatch (err %v)", err)
+	}
+	if _, err := reader.ReadAt(got[:5], 768*1024); err != nil || string(got[:5]) != "later" {
+		t.Errorf("read of new cluster = %q, %v", got[:5], err)
+	}
+	snap := reader.FindSnapshot("handoff")
+	if snap == nil {
+		t.Fatal("snapshot not visible after reload")
+	}
+	got = make([]byte, len(first))
+	if _, err := reader.ReadAtSnapshot(got, 0, snap); err != nil || !bytes.Equal(got, first) {
+		t.Errorf("snapshot read mismatch (err %v)", err)
+	}
+
+	// A writable image takes the image back and keeps writing
+	writer, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer writer.Close()
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	other, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := other.DeleteSnapshot("handoff"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	if _, err := other.WriteAt([]byte("third"), 128*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if err := writer.InvalidateCaches(); err != nil {
+		t.Fatalf("InvalidateCaches failed: %v", err)
+	}
+	if !writer.IsDirty() {
+		t.Error("writable image not marked dirty after reload")
+	}
+	if _, err := writer.WriteAt([]byte("fourth"), 256*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	for off, want := range map[int64]string{0: "second", 128 * 1024: "third", 256 * 1024: "fourth"} {
+		buf := make([]byte, len(want))
+		if _, err := writer.ReadAt(buf, off); err != nil || string(buf) != want {
+			t.Errorf("ReadAt(%d) = %q, %v; want %q", off, buf, err, want)
+		}
+	}
+	result, err := writer.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean after reload and write: %+v", result)
+	}
+}
+
+func TestInvalidateCachesRefused(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	// Buffered writes are never flushed into a changed file
+	img, err = Open(path, WithDelayedAllocation(1024*1024))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("pending"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.InvalidateCaches(); err == nil {
+		t.Error("expected pending delayed writes to be refused")
+	}
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := img.InvalidateCaches(); err != nil {
+		t.Errorf("InvalidateCaches after Flush failed: %v", err)
+	}
+
+	// The image cannot follow a change of cluster size
+	other := filepath.Join(dir, "other.qcow2")
+	otherImg, err := Create(other, CreateOptions{Size: 1024 * 1024, ClusterBits: 12})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	otherImg.Close()
+	data, err := os.ReadFile(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer reader.Close()
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.InvalidateCaches(); err == nil {
+		t.Error("expected changed cluster size to be refused")
+	}
+}
+
+// TestInvalidateCachesL1ReadFailure verifies a failed L1 table read leaves
+// the old header and L1 table in place.
+func TestInvalidateCachesL1ReadFailure(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	data := bytes.Repeat([]byte("kept"), 1000)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	img, ff := openFaulty(t, path)
+	defer img.Close()
+
+	// The header is read first, then the L1 table
+	ff.SetConfig(testutil.FaultConfig{Read: testutil.FaultProfile{FailAt: 2}})
+	if err := img.InvalidateCaches(); err == nil {
+		t.Fatal("expected InvalidateCaches to fail")
+	}
+	ff.SetConfig(testutil.FaultConfig{})
+
+	if img.Size() != 1024*1024 {
+		t.Errorf("Size = %d after failed reload, want %d", img.Size(), 1024*1024)
+	}
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read after failed reload mismatch (err %v)", err)
+	}
+}
@@ -0,0 +1,145 @@
+package qcow2
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults for IORetryPolicy backoff.
+const (
+	defaultIORetryBackoff    = time.Millisecond
+	defaultIORetryMaxBackoff = 100 * time.Millisecond
+)
+
+// IORetryPolicy controls how an image retries operations on its own files
+// (the image file and any external data file) that fail with a transient
+// error: EINTR or EAGAIN, and optionally ENOSPC. Reads and writes that
+// transferred part of their data before failing are resumed where they
+// stopped. These errors are only recognised on Unix systems; elsewhere
+// nothing is retried and ENOSPC is not turned into ErrNoSpace.
+type IORetryPolicy struct {
+	// MaxRetries is the number of times a failed operation is retried.
+	// 0 disables retrying.
+	MaxRetries int
+
+	// InitialBackoff is the wait before the first retry (default 1ms). It
+	// doubles after every retry, up to MaxBackoff (default 100ms).
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// RetryNoSpace retries writes that fail with ENOSPC too, for storage
+	// that can gain space while the image waits, such as a thin-provisioned
+	// volume being extended. Otherwise they fail at once with ErrNoSpace.
+	RetryNoSpace bool
+
+	// OnRetry, if set, is called before each retry with the attempt number
+	// (starting at 1) and the error that caused it. Returning false gives
+	// up and fails the operation with that error.
+	OnRetry func(attempt int, err error) bool
+}
+
+// retryable reports whether err is worth retrying under the policy.
+func (p *IORetryPolicy) retryable(err error) bool {
+	switch {
+	case transientErr(err):
+		return true
+	case noSpaceErr(err):
+		return p.RetryNoSpace
+	}
+	return false
+}
+
+// ioFile is the innermost layer an image does I/O through: it retries
+// transient errors according to an IORetryPolicy, if one is set, and turns
+// ENOSPC into ErrNoSpace.
+type ioFile struct {
+	File
+	policy *IORetryPolicy // nil disables retrying
+}
+
+// ioFdFile is an ioFile over a file with a descriptor, which hole punching
+// and mmap need.
+type ioFdFile struct {
+	*ioFile
+	fd fdFile
+}
+
+func (f *ioFdFile) Fd() uintptr {
+	return f.fd.Fd()
+}
+
+// newIOFile wraps f with ENOSPC mapping and, if policy is not nil, retries.
+func newIOFile(f File, policy *IORetryPolicy) File {
+	if policy != nil {
+		p := *policy
+		if p.InitialBackoff <= 0 {
+			p.InitialBackoff = defaultIORetryBackoff
+		}
+		if p.MaxBackoff <= 0 {
+			p.MaxBackoff = defaultIORetryMaxBackoff
+		}
+		policy = &p
+	}
+	iof := &ioFile{File: f, policy: policy}
+	if fd, ok := f.(fdFile); ok {
+		return &ioFdFile{ioFile: iof, fd: fd}
+	}
+	return iof
+}
+
+// retry runs op until it succeeds, fails with an error the policy does not
+// retry, or runs out of attempts.
+func (f *ioFile) retry(op func() error) error {
+	err := op()
+	if err == nil || f.policy == nil {
+		return err
+	}
+	backoff := f.policy.InitialBackoff
+	for attempt := 1; attempt <= f.policy.MaxRetries && f.policy.retryable(err); attempt++ {
+		if f.policy.OnRetry != nil && !f.policy.OnRetry(attempt, err) {
+			break
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, f.policy.MaxBackoff)
+		if err = op(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// noSpace wraps an ENOSPC error in ErrNoSpace.
+func noSpace(err error) error {
+	if err != nil && noSpaceErr(err) {
+		return fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+	return err
+}
+
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := f.retry(func() error {
+		m, err := f.File.ReadAt(p[n:], off+int64(n))
+		n += m
+		return err
+	})
+	return n, err
+}
+
+func (f *ioFile) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := f.retry(func() error {
+		m, err := f.File.WriteAt(p[n:], off+int64(n))
+		n += m
+		return err
+	})
+	return n, noSpace(err)
+}
+
+func (f *ioFile) Truncate(size int64) error {
+	return noSpace(f.retry(func() error { return f.File.Truncate(size) }))
+}
+
+func (f *ioFile) Sync() error {
+	return noSpace(f.retry(f.File.Sync))
+}
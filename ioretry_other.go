@@ -0,0 +1,14 @@
+//go:build !unix
+
+package qcow2
+
+// transientErr is not supported on this platform; no error is retried.
+func transientErr(err error) bool {
+	return false
+}
+
+// noSpaceErr is not supported on this platform; out-of-space errors are
+// passed on as they are.
+func noSpaceErr(err error) bool {
+	return false
+}
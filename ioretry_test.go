@@ -0,0 +1,148 @@
+// ioretry_test.go - Tests for retrying transient host I/O errors
+
+//go:build unix
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// openRetrying opens path with a fault-injecting wrapper under policy.
+func openRetrying(t *testing.T, path string, policy IORetryPolicy) (*Image, *testutil.FaultFile) {
+	t.Helper()
+	var ff *testutil.FaultFile
+	img, err := Open(path, WithIORetry(policy), WithFileWrapper(func(f File) File {
+		ff = testutil.NewFaultFile(f, testutil.FaultConfig{})
+		return ff
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return img, ff
+}
+
+func TestIORetryTransient(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	retries := 0
+	img, ff := openRetrying(t, path, IORetryPolicy{
+		MaxRetries:     50,
+		InitialBackoff: time.Microsecond,
+		MaxBackoff:     time.Microsecond,
+		OnRetry: func(attempt int, err error) bool {
+			retries++
+			return true
+		},
+	})
+	defer img.Close()
+	ff.SetConfig(testutil.FaultConfig{
+		Read:  testutil.FaultProfile{ErrorRate: 0.3, Err: syscall.EINTR},
+		Write: testutil.FaultProfile{ErrorRate: 0.3, Err: syscall.EAGAIN},
+		Seed:  1,
+	})
+
+	data := bytes.Repeat([]byte("transient"), 10000)
+	if _, err := img.WriteAt(data, 4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 4096); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back mismatch (err %v)", err)
+	}
+	if retries == 0 || ff.Faults(testutil.OpWrite) == 0 {
+		t.Error("no faults were retried")
+	}
+
+	// Errors that are not transient are not retried
+	ff.SetConfig(testutil.FaultConfig{Write: testutil.FaultProfile{ErrorRate: 1}})
+	retries = 0
+	if _, err := img.WriteAt(data[:512], 0); !errors.Is(err, testutil.ErrInjected) {
+		t.Errorf("WriteAt: got %v, want ErrInjected", err)
+	}
+	if retries != 0 {
+		t.Errorf("permanent error retried %d times", retries)
+	}
+}
+
+// fullDisk fails writes at or beyond limit with ENOSPC, like a file system
+// that ran out of space for new blocks.
+type fullDisk struct {
+	File
+	limit int64
+}
+
+func (f *fullDisk) WriteAt(p []byte, off int64) (int, error) {
+	if f.limit > 0 && off+int64(len(p)) > f.limit {
+		return 0, &os.PathError{Op: "write", Path: "full", Err: syscall.ENOSPC}
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestIORetryNoSpace(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	// Allocate the L2 table so only the data cluster is new
+	if _, err := img.WriteAt([]byte("first"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var disk *fullDisk
+	img, err = Open(path, WithFileWrapper(func(f File) File {
+		disk = &fullDisk{File: f}
+		return disk
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	disk.limit = info.Size()
+
+	// A whole cluster is written before the L2 table points at it, so the
+	// failed write must give the cluster back
+	cs := int64(img.ClusterSize())
+	full := bytes.Repeat([]byte("full"), int(cs)/4)
+	if _, err := img.WriteAt(full, cs); !errors.Is(err, ErrNoSpace) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("WriteAt on full disk: got %v, want ErrNoSpace", err)
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("cluster leaked after ENOSPC: %+v", result)
+	}
+
+	// Once space is back the write goes through
+	disk.limit = 0
+	if _, err := img.WriteAt(full, cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	got := make([]byte, cs)
+	if _, err := img.ReadAt(got, cs); err != nil || !bytes.Equal(got, full) {
+		t.Errorf("read back mismatch (err %v)", err)
+	}
+}
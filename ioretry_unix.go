@@ -0,0 +1,18 @@
+//go:build unix
+
+package qcow2
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transientErr reports whether err is EINTR or EAGAIN.
+func transientErr(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// noSpaceErr reports whether err is ENOSPC.
+func noSpaceErr(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
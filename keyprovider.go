@@ -0,0 +1,105 @@
+package qcow2
+
+import (
+	"fmt"
+)
+
+// AnyKeySlot in LUKSKey.Slot tries the passphrase against every active key
+// slot.
+const AnyKeySlot = -1
+
+// KeyRequest describes the key needed to unlock a LUKS-encrypted image.
+type KeyRequest struct {
+	Path  string // Absolute path of the image file
+	Slots []int  // Active key slots, in ascending order
+}
+
+// LUKSKey is a passphrase for one key slot of a LUKS-encrypted image, or
+// for any of them when Slot is AnyKeySlot. Note the zero value names slot 0.
+//
+// The image takes ownership of Passphrase and zeroes it once the master key
+// has been derived, so a provider should hand over a fresh buffer rather
+// than one it keeps.
+type LUKSKey struct {
+	Passphrase []byte
+	Slot       int
+}
+
+// KeyProvider supplies the keys of LUKS-encrypted images as they are opened,
+// so passphrases can come from a KMS, an agent or a prompt when needed
+// rather than being held in memory as strings for the life of the process.
+//
+// LUKSKey is called once for each encrypted image, including encrypted
+// layers of a backing chain. Returning a nil key and a nil error leaves the
+// image locked; an error fails the open.
+type KeyProvider interface {
+	LUKSKey(req KeyRequest) (*LUKSKey, error)
+}
+
+// KeyProviderFunc adapts a function to a KeyProvider.
+type KeyProviderFunc func(req KeyRequest) (*LUKSKey, error)
+
+// LUKSKey calls f(req).
+func (f KeyProviderFunc) LUKSKey(req KeyRequest) (*LUKSKey, error) {
+	return f(req)
+}
+
+// passwordProvider is a KeyProvider over passphrases by absolute path, as
+// set by WithLUKSPasswords.
+type passwordProvider map[string]string
+
+func (p passwordProvider) LUKSKey(req KeyRequest) (*LUKSKey, error) {
+	password, ok := p[req.Path]
+	if !ok {
+		return nil, nil
+	}
+	return &LUKSKey{Passphrase: []byte(password), Slot: AnyKeySlot}, nil
+}
+
+// UnlockLUKS unlocks a LUKS-encrypted image with a key from p. It fails if
+// the image is not LUKS-encrypted, p returns no key, or the key is wrong.
+func (img *Image) UnlockLUKS(p KeyProvider) error {
+	if img.header.EncryptMethod != EncryptionLUKS {
+		return fmt.Errorf("qcow2: UnlockLUKS called on non-LUKS encrypted image (method=%d)", img.header.EncryptMethod)
+	}
+	unlocked, err := img.unlockLUKS(p)
+	if err == nil && !unlocked {
+		err = fmt.Errorf("qcow2: no LUKS key provided for %s", layerPath(img.file.Name()))
+	}
+	return err
+}
+
+// unlockLUKS asks p for the key of a LUKS-encrypted image and unlocks it.
+// It reports false, without error, for other images and when p has no key.
+func (img *Image) unlockLUKS(p KeyProvider) (bool, error) {
+	if p == nil || img.header.EncryptMethod != EncryptionLUKS {
+		return false, nil
+	}
+	if img.extensions == nil || img.extensions.EncryptionHeader == nil {
+		return false, fmt.Errorf("qcow2: LUKS image missing encryption header extension")
+	}
+
+	// The LUKS header and key material are stored at the specified offset
+	ext := img.extensions.EncryptionHeader
+	r := newLUKSReaderWrapper(img.file, int64(ext.Offset), int64(ext.Length))
+	hdr, err := readLUKSHeader(r)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := p.LUKSKey(KeyRequest{Path: layerPath(img.file.Name()), Slots: hdr.activeSlots()})
+	if err != nil {
+		return false, fmt.Errorf("qcow2: key provider failed: %w", err)
+	}
+	if key == nil {
+		return false, nil
+	}
+	defer clear(key.Passphrase)
+
+	decryptor, err := hdr.unlock(r, key.Passphrase, key.Slot)
+	if err != nil {
+		return false, err
+	}
+	img.luksDecryptor = decryptor
+	return true, nil
+}
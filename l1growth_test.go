@@ -5,6 +5,7 @@ package qcow2
 
 import (
 	"bytes"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -385,3 +386,190 @@ func TestL1IndexCalculation(t *testing.T) {
 		}
 	}
 }
+
+// TestGrowL1Table tests enlarging the L1 table of an open image.
+func TestGrowL1Table(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "l1_online.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 1024 * 1024 * 1024, ClusterBits: 16})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	data := testutil.RandomBytes(1, 64*1024)
+	l2Coverage := int64(img.ClusterSize()/8) * int64(img.ClusterSize())
+	if _, err := img.WriteAt(data, l2Coverage+4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	oldOffset := img.header.L1TableOffset
+
+	// 10000 entries need 80000 bytes, rounded up to two 64KB clusters
+	if err := img.GrowL1Table(10000); err != nil {
+		t.Fatalf("GrowL1Table failed: %v", err)
+	}
+	if got := img.L1Size(); got != 16384 {
+		t.Errorf("L1Size = %d, want 16384", got)
+	}
+	if img.header.L1TableOffset == oldOffset {
+		t.Error("L1 table was not moved")
+	}
+
+	// Shrinking is a no-op
+	if err := img.GrowL1Table(1); err != nil {
+		t.Fatalf("GrowL1Table(1) failed: %v", err)
+	}
+	if got := img.L1Size(); got != 16384 {
+		t.Errorf("L1Size after no-op = %d, want 16384", got)
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, l2Coverage+4096); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Data mismatch after L1 growth")
+	}
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Corruptions > 0 || result.Leaks > 0 {
+		t.Errorf("Check found %d corruptions, %d leaks: %v", result.Corruptions, result.Leaks, result.Errors)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer img.Close()
+	if got := img.L1Size(); got != 16384 {
+		t.Errorf("L1Size after reopen = %d, want 16384", got)
+	}
+	if _, err := img.ReadAt(buf, l2Coverage+4096); err != nil {
+		t.Fatalf("ReadAt after reopen failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Data mismatch after reopen")
+	}
+}
+
+// TestGrowL1TableLimit tests that the L1 table never exceeds QEMU's limit.
+func TestGrowL1TableLimit(t *testing.T) {
+	t.Parallel()
+	img, err := CreateSimple(filepath.Join(t.TempDir(), "l1_limit.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer img.Close()
+
+	if err := img.GrowL1Table(maxL1TableBytes/8 + 1); err == nil {
+		t.Error("GrowL1Table past the limit should fail")
+	}
+}
+
+// TestWriteGrowsShortL1Table tests that writes past the end of an L1 table
+// smaller than the virtual size grow the table instead of failing.
+func TestWriteGrowsShortL1Table(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "l1_short.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 2 * 1024 * 1024 * 1024, ClusterBits: 16})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	// Truncate the table to a single entry, as a minimal writer might
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0, 0, 0, 1}, 36); err != nil {
+		t.Fatalf("patching l1_size failed: %v", err)
+	}
+	f.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data := testutil.RandomBytes(2, 4096)
+	off := int64(1536 * 1024 * 1024) // Covered by L1[3]
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatalf("WriteAt beyond L1 table failed: %v", err)
+	}
+	if got := img.L1Size(); got < 4 {
+		t.Errorf("L1Size = %d, want >= 4", got)
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Corruptions > 0 || result.Leaks > 0 {
+		t.Errorf("Check found %d corruptions, %d leaks: %v", result.Corruptions, result.Leaks, result.Errors)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer img.Close()
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, off); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Data mismatch after reopen")
+	}
+}
+
+// TestRevertAfterL1Growth tests reverting to a snapshot whose L1 table is
+// smaller than the active one.
+func TestRevertAfterL1Growth(t *testing.T) {
+	t.Parallel()
+	img, err := CreateSimple(filepath.Join(t.TempDir(), "l1_revert.qcow2"), 64*1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer img.Close()
+
+	before := testutil.RandomBytes(2, 4096)
+	if _, err := img.WriteAt(before, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("before"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	if err := img.GrowL1Table(20000); err != nil {
+		t.Fatalf("GrowL1Table failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(3, 4096), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	if err := img.RevertToSnapshot("before"); err != nil {
+		t.Fatalf("RevertToSnapshot failed: %v", err)
+	}
+	buf := make([]byte, len(before))
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, before) {
+		t.Error("Data mismatch after revert")
+	}
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	// Check does not walk snapshot tables, so shared clusters show up as
+	// refcount mismatches; only corruptions are meaningful here
+	if result.Corruptions > 0 {
+		t.Errorf("Check found %d corruptions: %v", result.Corruptions, result.Errors)
+	}
+}
@@ -0,0 +1,177 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// maxL1TableBytes matches QEMU's QCOW_MAX_L1_SIZE; larger tables are
+// rejected by qemu-img, so never grow past it.
+const maxL1TableBytes = 32 * 1024 * 1024
+
+// DefaultMaxVirtualSize is the largest virtual size Open accepts unless
+// WithMaxVirtualSize raises it: 64TB, well beyond real disks but far below
+// the exabyte sizes of corrupt or hostile headers.
+const DefaultMaxVirtualSize = 64 << 40
+
+// checkHeaderLimits rejects headers whose virtual size is over maxSize (0
+// for no limit) or whose L1 table, as recorded or as the virtual size
+// requires, is beyond what QEMU would ever create. L1 tables shorter than
+// the virtual size needs are allowed; writes grow them.
+func checkHeaderLimits(h *Header, maxSize uint64) error {
+	if maxSize > 0 && h.Size > maxSize {
+		return fmt.Errorf("%w: %d bytes is over the limit of %d", ErrVirtualSizeLimit, h.Size, maxSize)
+	}
+	if uint64(h.L1Size)*8 > maxL1TableBytes {
+		return fmt.Errorf("%w: %d entries is over the %d byte limit", ErrL1TableSize, h.L1Size, maxL1TableBytes)
+	}
+	if maxSize == 0 {
+		return nil
+	}
+	entrySize := uint64(8)
+	if h.HasExtendedL2() {
+		entrySize = 16
+	}
+	l2Coverage := h.ClusterSize() / entrySize * h.ClusterSize()
+	if needed := (h.Size + l2Coverage - 1) / l2Coverage; needed*8 > maxL1TableBytes {
+		return fmt.Errorf("%w: a virtual size of %d bytes needs %d entries, over the %d byte limit",
+			ErrL1TableSize, h.Size, needed, maxL1TableBytes)
+	}
+	return nil
+}
+
+// L1Size returns the number of entries in the active L1 table.
+func (img *Image) L1Size() uint64 {
+	img.l1Mu.RLock()
+	defer img.l1Mu.RUnlock()
+	return uint64(len(img.l1Table)) / 8
+}
+
+// GrowL1Table enlarges the active L1 table to hold at least minEntries
+// entries, without reopening the image. The table is rounded up to whole
+// clusters, so it may end up larger than requested. It is a no-op if the
+// table is already big enough.
+//
+// Preallocation tooling can use this to size the L1 table for a future
+// virtual size up front; writes grow the table on demand otherwise.
+func (img *Image) GrowL1Table(minEntries uint64) error {
+	if img.readOnly {
+		return ErrReadOnly
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	if err := img.growL1TableLocked(minEntries); err != nil {
+		return err
+	}
+	img.dirty.Store(true)
+	return nil
+}
+
+// growL1TableLocked moves the L1 table to a larger, freshly allocated run of
+// clusters. The new table is written and flushed before the header switches
+// to it with a single write of the adjacent l1_size and l1_table_offset
+// fields, so a crash leaves either the old or the new table in effect. The
+// caller holds writeMu.
+func (img *Image) growL1TableLocked(minEntries uint64) error {
+	oldEntries := uint64(img.header.L1Size)
+	if minEntries <= oldEntries {
+		return nil
+	}
+
+	newBytes := (minEntries*8 + img.clusterSize - 1) &^ img.offsetMask
+	if newBytes > maxL1TableBytes {
+		return fmt.Errorf("qcow2: L1 table of %d entries exceeds the %d byte limit", minEntries, maxL1TableBytes)
+	}
+	newEntries := newBytes / 8
+
+	// The old table is copied into the new one
+	if err := img.faultAllL1(); err != nil {
+		return err
+	}
+
+	newOffset, err := img.allocateClusterRun(newBytes>>img.clusterBits, AllocMetadata)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to allocate L1 table: %w", err)
+	}
+
+	img.l1Mu.RLock()
+	newTable := make([]byte, newBytes)
+	copy(newTable, img.l1Table)
+	img.l1Mu.RUnlock()
+
+	if _, err := img.file.WriteAt(newTable, int64(newOffset)); err != nil {
+		return fmt.Errorf("qcow2: failed to write L1 table: %w", err)
+	}
+
+	// Barrier: the new table must be on disk before the header points to it
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: L1 table barrier failed: %w", err)
+	}
+
+	var fields [12]byte
+	binary.BigEndian.PutUint32(fields[0:4], uint32(newEntries))
+	binary.BigEndian.PutUint64(fields[4:12], newOffset)
+	if _, err := img.file.WriteAt(fields[:], 36); err != nil {
+		return fmt.Errorf("qcow2: failed to update L1 table location: %w", err)
+	}
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: L1 header barrier failed: %w", err)
+	}
+
+	oldOffset := img.header.L1TableOffset
+	img.l1Mu.Lock()
+	img.l1Table = newTable
+	img.header.L1Size = uint32(newEntries)
+	img.header.L1TableOffset = newOffset
+	img.l1Mu.Unlock()
+
+	// Release the old table's clusters
+	oldClusters := (oldEntries*8 + img.clusterSize - 1) >> img.clusterBits
+	for i := uint64(0); i < oldClusters; i++ {
+		if err := img.decrementRefcount(oldOffset + i*img.clusterSize); err != nil {
+			return fmt.Errorf("qcow2: failed to free old L1 table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// allocateClusterRun allocates n contiguous clusters at the end of the main
+// qcow2 file and returns the offset of the first. The clusters can hold
+// metadata or data, as kind says. Unlike allocateMetadataCluster it never reuses free
+// clusters, which are unlikely to be contiguous, and it zeroes them by
+// growing the file rather than by writing.
+func (img *Image) allocateClusterRun(n uint64, kind AllocationKind) (uint64, error) {
+	info, err := img.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Align to cluster boundary
+	offset := (uint64(info.Size()) + img.offsetMask) &^ img.offsetMask
+	end := offset + n*img.clusterSize
+
+	if err := img.checkQuota(img.file, end); err != nil {
+		return 0, err
+	}
+	if err := img.growFile(img.file, info.Size(), end); err != nil {
+		return 0, err
+	}
+
+	if img.freeBitmap != nil {
+		img.freeBitmap.grow(end >> img.clusterBits)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if err := img.incrementRefcount(offset + i*img.clusterSize); err != nil {
+			img.releaseClusters(offset, i)
+			return 0, fmt.Errorf("qcow2: failed to update refcount for new cluster: %w", err)
+		}
+	}
+
+	img.dataWritten(offset, n*img.clusterSize)
+	img.allocated(offset, n*img.clusterSize, kind, false)
+	return offset, nil
+}
@@ -0,0 +1,115 @@
+package qcow2
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// l1SegmentBytes is how much of a lazily loaded L1 table is read at a
+// time: 8192 entries, mapping 4TB of virtual disk with 64KB clusters.
+const l1SegmentBytes = 64 * 1024
+
+// lazyL1 tracks which segments of img.l1Table have been read from the
+// file (WithLazyL1). The table is allocated at full size on open, but the
+// runtime takes large allocations from fresh zero pages, which the OS only
+// backs with memory once a segment is written into them.
+//
+// Code that looks up single entries faults in their segment with faultL1.
+// Code that walks, copies or rewrites the whole table calls faultAllL1
+// first. Updates to an entry happen after its segment is loaded and are
+// written through to the file, so a segment read later matches memory.
+type lazyL1 struct {
+	mu      sync.Mutex    // Serializes faults; taken before l1Mu
+	loaded  []atomic.Bool // Per segment
+	pending atomic.Int64  // Segments not read yet
+}
+
+// initLazyL1 allocates the L1 table without reading it.
+func (img *Image) initLazyL1() {
+	size := uint64(img.header.L1Size) * 8
+	img.l1Table = make([]byte, size)
+	segments := (size + l1SegmentBytes - 1) / l1SegmentBytes
+	img.lazyL1 = &lazyL1{loaded: make([]atomic.Bool, segments)}
+	img.lazyL1.pending.Store(int64(segments))
+}
+
+// l1Loaded reports whether the whole L1 table is in memory.
+func (img *Image) l1Loaded() bool {
+	return img.lazyL1 == nil || img.lazyL1.pending.Load() == 0
+}
+
+// faultL1 makes sure the L1 entry l1Index is in memory. Indices past the
+// end of the table are left to the caller's bounds check. The caller must
+// not hold l1Mu.
+func (img *Image) faultL1(l1Index uint64) error {
+	if img.l1Loaded() {
+		return nil
+	}
+	seg := l1Index * 8 / l1SegmentBytes
+	if seg >= uint64(len(img.lazyL1.loaded)) || img.lazyL1.loaded[seg].Load() {
+		return nil
+	}
+	return img.faultL1Segment(seg)
+}
+
+// faultAllL1 reads every L1 segment not in memory yet. The caller must not
+// hold l1Mu.
+func (img *Image) faultAllL1() error {
+	if img.l1Loaded() {
+		return nil
+	}
+	for seg := range img.lazyL1.loaded {
+		if img.lazyL1.loaded[seg].Load() {
+			continue
+		}
+		if err := img.faultL1Segment(uint64(seg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (img *Image) faultL1Segment(seg uint64) error {
+	lazy := img.lazyL1
+	lazy.mu.Lock()
+	defer lazy.mu.Unlock()
+	if lazy.loaded[seg].Load() {
+		return nil
+	}
+
+	// The table cannot move or shrink while segments are missing: growing
+	// it faults in the whole table first
+	img.l1Mu.RLock()
+	start := seg * l1SegmentBytes
+	end := min(start+l1SegmentBytes, uint64(len(img.l1Table)))
+	tableOff := img.header.L1TableOffset
+	img.l1Mu.RUnlock()
+
+	buf := make([]byte, end-start)
+	if _, err := img.file.ReadAt(buf, int64(tableOff+start)); err != nil {
+		return fmt.Errorf("qcow2: failed to load L1 table: %w", err)
+	}
+	img.l1Mu.Lock()
+	defer img.l1Mu.Unlock()
+	// Invalidate may have reloaded the whole table meanwhile
+	if !lazy.loaded[seg].Load() {
+		copy(img.l1Table[start:end], buf)
+		lazy.loaded[seg].Store(true)
+		lazy.pending.Add(-1)
+	}
+	return nil
+}
+
+// markL1Loaded records that the whole table was read by loadL1Table. The
+// caller holds l1Mu.
+func (img *Image) markL1Loaded() {
+	if img.lazyL1 == nil {
+		return
+	}
+	for seg := range img.lazyL1.loaded {
+		if !img.lazyL1.loaded[seg].Swap(true) {
+			img.lazyL1.pending.Add(-1)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// lazyl1_test.go - Lazy L1 table loading tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestLazyL1 checks an image opened with WithLazyL1 reads its L1 table a
+// segment at a time, and that whole-table operations read the rest first.
+func TestLazyL1(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lazy.qcow2")
+
+	// 512-byte clusters: each 64KB L1 segment maps 256MB
+	const segment = 256 * 1024 * 1024
+	img, err := Create(path, CreateOptions{Size: 4 * segment, ClusterBits: 9})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	first := testutil.RandomBytes(1, 4096)
+	last := testutil.RandomBytes(2, 4096)
+	if _, err := img.WriteAt(first, 1000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAt(last, 3*segment+5000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithLazyL1())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if got := img.lazyL1.pending.Load(); got != 4 {
+		t.Fatalf("%d segments pending after open, want 4", got)
+	}
+
+	buf := make([]byte, len(last))
+	if _, err := img.ReadAt(buf, 3*segment+5000); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, last) {
+		t.Error("read from the last segment returned wrong data")
+	}
+	if got := img.lazyL1.pending.Load(); got != 3 {
+		t.Errorf("%d segments pending after one read, want 3", got)
+	}
+
+	// A write allocating an L2 table in an unread segment
+	mid := testutil.RandomBytes(3, 4096)
+	if _, err := img.WriteAt(mid, 2*segment); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if got := img.lazyL1.pending.Load(); got != 2 {
+		t.Errorf("%d segments pending after a write, want 2", got)
+	}
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("Check found problems: %+v", result)
+	}
+	if !img.l1Loaded() {
+		t.Error("Check did not read the whole L1 table")
+	}
+	for _, c := range []struct {
+		off  int64
+		want []byte
+	}{{1000, first}, {2 * segment, mid}, {3*segment + 5000, last}} {
+		if _, err := img.ReadAt(buf, c.off); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(buf, c.want) {
+			t.Errorf("data at %d differs", c.off)
+		}
+	}
+}
+
+// TestLazyL1Snapshot checks a snapshot taken before the L1 table is read
+// records all of it.
+func TestLazyL1Snapshot(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lazy-snap.qcow2")
+
+	const off = 600 * 1024 * 1024
+	img, err := CreateSimple(path, 1024*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	data := testutil.RandomBytes(4, 1024)
+	if _, err := img.WriteAt(data, off); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithLazyL1())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	snap, err := img.CreateSnapshot("before")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(make([]byte, len(data)), off); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAtSnapshot(buf, off, img.FindSnapshot(snap.ID)); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("snapshot lost data from an unread L1 table")
+	}
+}
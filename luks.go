@@ -9,6 +9,9 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
 
 	"github.com/containers/luksy"
 	"golang.org/x/crypto/argon2"
@@ -35,23 +38,67 @@ type LUKSDecryptor struct {
 // - Implements PBKDF2 key derivation and AF merge ourselves
 // - Uses x/crypto/xts for random-access decryption
 func NewLUKSDecryptor(r luksy.ReaderAtSeekCloser, password string) (*LUKSDecryptor, error) {
-	// Read LUKS headers (supports both v1 and v2)
+	hdr, err := readLUKSHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := []byte(password)
+	defer clear(passphrase)
+	return hdr.unlock(r, passphrase, AnyKeySlot)
+}
+
+// luksHeader is a parsed LUKS1 or LUKS2 header.
+type luksHeader struct {
+	v1   *luksy.V1Header
+	v2   *luksy.V2Header
+	json *luksy.V2JSON
+}
+
+// readLUKSHeader reads the LUKS header (v1 or v2) from r.
+func readLUKSHeader(r luksy.ReaderAtSeekCloser) (*luksHeader, error) {
 	v1hdr, v2hdr, _, v2json, err := luksy.ReadHeaders(r, luksy.ReadHeaderOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("qcow2: failed to read LUKS headers: %w", err)
 	}
+	if v1hdr == nil && (v2hdr == nil || v2json == nil) {
+		return nil, fmt.Errorf("qcow2: no valid LUKS header found")
+	}
+	return &luksHeader{v1: v1hdr, v2: v2hdr, json: v2json}, nil
+}
 
-	if v1hdr != nil {
-		return newLUKS1Decryptor(v1hdr, r, password)
-	} else if v2hdr != nil && v2json != nil {
-		return newLUKS2Decryptor(v2hdr, v2json, r, password)
+// activeSlots returns the numbers of the key slots in use, in order.
+func (h *luksHeader) activeSlots() []int {
+	var slots []int
+	if h.v1 != nil {
+		for i := 0; i < 8; i++ {
+			if ks, err := h.v1.KeySlot(i); err == nil {
+				if active, err := ks.Active(); err == nil && active {
+					slots = append(slots, i)
+				}
+			}
+		}
+		return slots
 	}
+	for id, ks := range h.json.Keyslots {
+		if n, err := strconv.Atoi(id); err == nil && ks.Type == "luks2" {
+			slots = append(slots, n)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
 
-	return nil, fmt.Errorf("qcow2: no valid LUKS header found")
+// unlock derives the master key from passphrase, trying only the given key
+// slot unless it is AnyKeySlot.
+func (h *luksHeader) unlock(r io.ReaderAt, passphrase []byte, slot int) (*LUKSDecryptor, error) {
+	if h.v1 != nil {
+		return newLUKS1Decryptor(h.v1, r, passphrase, slot)
+	}
+	return newLUKS2Decryptor(h.v2, h.json, r, passphrase, slot)
 }
 
 // newLUKS1Decryptor creates a decryptor for LUKS1 volumes.
-func newLUKS1Decryptor(hdr *luksy.V1Header, r io.ReaderAt, password string) (*LUKSDecryptor, error) {
+func newLUKS1Decryptor(hdr *luksy.V1Header, r io.ReaderAt, passphrase []byte, only int) (*LUKSDecryptor, error) {
 	// Parse cipher configuration
 	cipherName := hdr.CipherName()
 	cipherMode := hdr.CipherMode()
@@ -75,6 +122,9 @@ func newLUKS1Decryptor(hdr *luksy.V1Header, r io.ReaderAt, password string) (*LU
 	// Try each active key slot
 	var masterKey []byte
 	for slot := 0; slot < 8; slot++ {
+		if only != AnyKeySlot && slot != only {
+			continue
+		}
 		ks, err := hdr.KeySlot(slot)
 		if err != nil {
 			continue
@@ -85,7 +135,7 @@ func newLUKS1Decryptor(hdr *luksy.V1Header, r io.ReaderAt, password string) (*LU
 		}
 
 		// Try to unlock this key slot
-		mk, err := tryUnlockKeySlot(hdr, &ks, r, password, keyBytes, hashFunc)
+		mk, err := tryUnlockKeySlot(hdr, &ks, r, passphrase, keyBytes, hashFunc)
 		if err == nil {
 			masterKey = mk
 			break
@@ -97,8 +147,9 @@ func newLUKS1Decryptor(hdr *luksy.V1Header, r io.ReaderAt, password string) (*LU
 		return nil, fmt.Errorf("qcow2: LUKS decryption failed (wrong password?)")
 	}
 
-	// Create XTS cipher with master key
+	// Create XTS cipher with master key; the cipher keeps its own schedule
 	cipher, err := xts.NewCipher(aes.NewCipher, masterKey)
+	clear(masterKey)
 	if err != nil {
 		return nil, fmt.Errorf("qcow2: failed to create XTS cipher: %w", err)
 	}
@@ -110,7 +161,7 @@ func newLUKS1Decryptor(hdr *luksy.V1Header, r io.ReaderAt, password string) (*LU
 }
 
 // tryUnlockKeySlot attempts to decrypt the master key from a key slot.
-func tryUnlockKeySlot(hdr *luksy.V1Header, ks *luksy.V1KeySlot, r io.ReaderAt, password string, keyBytes int, hashFunc func() hash.Hash) ([]byte, error) {
+func tryUnlockKeySlot(hdr *luksy.V1Header, ks *luksy.V1KeySlot, r io.ReaderAt, passphrase []byte, keyBytes int, hashFunc func() hash.Hash) ([]byte, error) {
 	salt := ks.KeySlotSalt()
 	iterations := ks.Iterations()
 	stripes := int(ks.Stripes())
@@ -119,7 +170,8 @@ func tryUnlockKeySlot(hdr *luksy.V1Header, ks *luksy.V1KeySlot, r io.ReaderAt, p
 	// Step 1: Derive the anti-forensic key using PBKDF2
 	// For XTS mode, we need double the key bytes (encryption key + tweak key)
 	afKeyLen := keyBytes
-	afKey := pbkdf2.Key([]byte(password), salt, int(iterations), afKeyLen, hashFunc)
+	afKey := pbkdf2.Key(passphrase, salt, int(iterations), afKeyLen, hashFunc)
+	defer clear(afKey)
 
 	// Step 2: Read encrypted key material from disk
 	// Key material size = keyBytes * stripes, rounded to sector size
@@ -142,6 +194,7 @@ func tryUnlockKeySlot(hdr *luksy.V1Header, ks *luksy.V1KeySlot, r io.ReaderAt, p
 
 	// Step 4: Apply anti-forensic merge to recover the master key
 	masterKey := afMerge(splitKey, keyBytes, stripes, hashFunc)
+	clear(splitKey)
 
 	// Step 5: Verify the master key against the digest
 	mkDigest := hdr.MKDigest()
@@ -154,6 +207,7 @@ func tryUnlockKeySlot(hdr *luksy.V1Header, ks *luksy.V1KeySlot, r io.ReaderAt, p
 	// Constant-time comparison would be better, but for read-only this is fine
 	for i := range mkDigest {
 		if mkDigest[i] != computedDigest[i] {
+			clear(masterKey)
 			return nil, fmt.Errorf("master key verification failed")
 		}
 	}
@@ -162,7 +216,7 @@ func tryUnlockKeySlot(hdr *luksy.V1Header, ks *luksy.V1KeySlot, r io.ReaderAt, p
 }
 
 // newLUKS2Decryptor creates a decryptor for LUKS2 volumes.
-func newLUKS2Decryptor(hdr *luksy.V2Header, json *luksy.V2JSON, r io.ReaderAt, password string) (*LUKSDecryptor, error) {
+func newLUKS2Decryptor(hdr *luksy.V2Header, json *luksy.V2JSON, r io.ReaderAt, passphrase []byte, only int) (*LUKSDecryptor, error) {
 	// Find a crypt segment to get cipher info
 	var segment *luksy.V2JSONSegment
 	for _, seg := range json.Segments {
@@ -193,8 +247,11 @@ func newLUKS2Decryptor(hdr *luksy.V2Header, json *luksy.V2JSON, r io.ReaderAt, p
 		if slot.Type != "luks2" || slot.V2JSONKeyslotLUKS2 == nil {
 			continue
 		}
+		if only != AnyKeySlot && slotID != strconv.Itoa(only) {
+			continue
+		}
 
-		mk, err := tryUnlockKeySlotV2(json, slotID, &slot, r, password)
+		mk, err := tryUnlockKeySlotV2(json, slotID, &slot, r, passphrase)
 		if err == nil {
 			masterKey = mk
 			break
@@ -206,8 +263,9 @@ func newLUKS2Decryptor(hdr *luksy.V2Header, json *luksy.V2JSON, r io.ReaderAt, p
 		return nil, fmt.Errorf("qcow2: LUKS2 decryption failed (wrong password?)")
 	}
 
-	// Create XTS cipher with master key
+	// Create XTS cipher with master key; the cipher keeps its own schedule
 	cipher, err := xts.NewCipher(aes.NewCipher, masterKey)
+	clear(masterKey)
 	if err != nil {
 		return nil, fmt.Errorf("qcow2: failed to create XTS cipher: %w", err)
 	}
@@ -219,7 +277,7 @@ func newLUKS2Decryptor(hdr *luksy.V2Header, json *luksy.V2JSON, r io.ReaderAt, p
 }
 
 // tryUnlockKeySlotV2 attempts to decrypt the master key from a LUKS2 key slot.
-func tryUnlockKeySlotV2(json *luksy.V2JSON, slotID string, slot *luksy.V2JSONKeyslot, r io.ReaderAt, password string) ([]byte, error) {
+func tryUnlockKeySlotV2(json *luksy.V2JSON, slotID string, slot *luksy.V2JSONKeyslot, r io.ReaderAt, passphrase []byte) ([]byte, error) {
 	luks2 := slot.V2JSONKeyslotLUKS2
 	kdf := luks2.Kdf
 	af := luks2.AF
@@ -252,25 +310,26 @@ func tryUnlockKeySlotV2(json *luksy.V2JSON, slotID string, slot *luksy.V2JSONKey
 		if kdfHashFunc == nil {
 			return nil, fmt.Errorf("unsupported PBKDF2 hash: %s", kdf.Hash)
 		}
-		afKey = pbkdf2.Key([]byte(password), kdf.Salt, kdf.Iterations, keySize, kdfHashFunc)
+		afKey = pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, keySize, kdfHashFunc)
 
 	case "argon2i":
 		if kdf.V2JSONKdfArgon2i == nil {
 			return nil, fmt.Errorf("argon2i KDF missing parameters")
 		}
-		afKey = argon2.Key([]byte(password), kdf.Salt,
+		afKey = argon2.Key(passphrase, kdf.Salt,
 			uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.CPUs), uint32(keySize))
 
 	case "argon2id":
 		if kdf.V2JSONKdfArgon2i == nil {
 			return nil, fmt.Errorf("argon2id KDF missing parameters")
 		}
-		afKey = argon2.IDKey([]byte(password), kdf.Salt,
+		afKey = argon2.IDKey(passphrase, kdf.Salt,
 			uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.CPUs), uint32(keySize))
 
 	default:
 		return nil, fmt.Errorf("unsupported KDF type: %s", kdf.Type)
 	}
+	defer clear(afKey)
 
 	// Step 2: Read encrypted key material from the area
 	area := slot.Area
@@ -293,6 +352,7 @@ func tryUnlockKeySlotV2(json *luksy.V2JSON, slotID string, slot *luksy.V2JSONKey
 
 	// Step 4: Apply anti-forensic merge to recover the master key
 	masterKey := afMerge(splitKey, keySize, stripes, hashFunc)
+	clear(splitKey)
 
 	// Step 5: Verify the master key against the digest
 	// Find a digest that references this keyslot
@@ -324,6 +384,7 @@ func tryUnlockKeySlotV2(json *luksy.V2JSON, slotID string, slot *luksy.V2JSONKey
 		}
 	}
 
+	clear(masterKey)
 	return nil, fmt.Errorf("master key verification failed")
 }
 
@@ -614,35 +675,29 @@ func (w *luksReaderWrapper) Close() error {
 // SetPasswordLUKS sets the password for a LUKS-encrypted image.
 // Must be called before reading from a LUKS-encrypted image.
 // Returns an error if the image is not LUKS-encrypted or if the password is wrong.
+//
+// Deprecated: Use UnlockLUKS or WithKeyProvider, which do not require the
+// passphrase to be held as a string.
 func (img *Image) SetPasswordLUKS(password string) error {
 	if img.header.EncryptMethod != EncryptionLUKS {
 		return fmt.Errorf("qcow2: SetPasswordLUKS called on non-LUKS encrypted image (method=%d)", img.header.EncryptMethod)
 	}
+	return img.UnlockLUKS(passwordProvider{layerPath(img.file.Name()): password})
+}
 
-	// Get LUKS header location from extension
-	if img.extensions == nil || img.extensions.EncryptionHeader == nil {
-		return fmt.Errorf("qcow2: LUKS image missing encryption header extension")
-	}
-
-	ext := img.extensions.EncryptionHeader
-
-	// Create a reader wrapper for the LUKS header region
-	// The LUKS header and key material are stored at the specified offset
-	wrapper := newLUKSReaderWrapper(img.file, int64(ext.Offset), int64(ext.Length))
-
-	decryptor, err := NewLUKSDecryptor(wrapper, password)
-	if err != nil {
-		return err
+// layerPath returns the form of an image path used to look up its LUKS
+// passphrase.
+func layerPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
 	}
-
-	img.luksDecryptor = decryptor
-	return nil
+	return filepath.Clean(path)
 }
 
 // readLUKSEncrypted reads and decrypts data from a LUKS-encrypted cluster.
 func (img *Image) readLUKSEncrypted(buf []byte, physOff, virtOff uint64) (int, error) {
 	if img.luksDecryptor == nil {
-		return 0, fmt.Errorf("qcow2: LUKS encrypted image requires password (call SetPasswordLUKS)")
+		return 0, fmt.Errorf("qcow2: LUKS encrypted image requires a key (call UnlockLUKS)")
 	}
 
 	// Read the encrypted cluster data
@@ -670,10 +725,12 @@ func (img *Image) readLUKSEncrypted(buf []byte, physOff, virtOff uint64) (int, e
 // writeLUKSEncrypted writes encrypted data to a LUKS-encrypted cluster.
 // physOff is the physical offset including cluster offset.
 // data is the plaintext data to write.
-// isNewCluster indicates whether this is a newly allocated cluster (no existing data).
-func (img *Image) writeLUKSEncrypted(data []byte, physOff uint64, isNewCluster bool) (int, error) {
+// virtOff is the virtual offset being written, for copying from the backing file.
+// base is the type the cluster had before the write, which decides what a
+// partial write is merged with.
+func (img *Image) writeLUKSEncrypted(data []byte, physOff, virtOff uint64, base clusterType) (int, error) {
 	if img.luksDecryptor == nil {
-		return 0, fmt.Errorf("qcow2: LUKS encrypted image requires password (call SetPasswordLUKS)")
+		return 0, fmt.Errorf("qcow2: LUKS encrypted image requires a key (call UnlockLUKS)")
 	}
 
 	clusterStart := physOff & ^img.offsetMask
@@ -683,10 +740,17 @@ func (img *Image) writeLUKSEncrypted(data []byte, physOff uint64, isNewCluster b
 
 	// For partial cluster writes, we need to read-modify-write
 	if clusterOff != 0 || uint64(len(data)) < img.clusterSize {
-		if isNewCluster {
-			// New cluster: start with zeros
+		switch base {
+		case clusterUnallocated:
+			// New cluster: start from the backing file, which decrypts
+			// with its own key if it is encrypted too (zeros without one)
+			plaintext = make([]byte, img.clusterSize)
+			if err := img.readBackingCluster(plaintext, virtOff&^img.offsetMask); err != nil {
+				return 0, err
+			}
+		case clusterZero:
 			plaintext = make([]byte, img.clusterSize)
-		} else {
+		default:
 			// Existing cluster: read and decrypt current content
 			encrypted := make([]byte, img.clusterSize)
 			_, err := img.dataFile().ReadAt(encrypted, int64(clusterStart))
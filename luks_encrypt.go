@@ -0,0 +1,405 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/containers/luksy"
+)
+
+// EncryptOptions configures EncryptCopy and EncryptInPlace.
+type EncryptOptions struct {
+	// Passphrase protects LUKS key slot 0 of the encrypted image
+	// (required). It is zeroed when the conversion returns.
+	Passphrase []byte
+}
+
+// luksHeaderBytes is an in-memory LUKS header, read back to unlock a header
+// just generated.
+type luksHeaderBytes struct {
+	*bytes.Reader
+}
+
+func (luksHeaderBytes) Close() error {
+	return nil
+}
+
+// newLUKSHeader generates a LUKS1 header for aes-xts-plain64, the cipher
+// QEMU uses by default, with a fresh master key protected by passphrase in
+// key slot 0. It returns the header with a decryptor for the master key.
+func newLUKSHeader(passphrase []byte) ([]byte, *LUKSDecryptor, error) {
+	if len(passphrase) == 0 {
+		return nil, nil, fmt.Errorf("qcow2: a passphrase is required to encrypt an image")
+	}
+	header, _, _, err := luksy.EncryptV1([]string{string(passphrase)}, "aes-xts-plain64")
+	if err != nil {
+		return nil, nil, fmt.Errorf("qcow2: failed to create LUKS header: %w", err)
+	}
+
+	// luksy does not hand out the master key, so derive it again
+	r := luksHeaderBytes{bytes.NewReader(header)}
+	hdr, err := readLUKSHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	decryptor, err := hdr.unlock(r, passphrase, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, decryptor, nil
+}
+
+// writeLUKSHeader stores a LUKS header in clusters allocated at the end of
+// the file, where it displaces nothing already in the image. The image does
+// not use it until enableLUKS.
+func (img *Image) writeLUKSHeader(header []byte) (*EncryptionHeaderPointer, error) {
+	clusters := (uint64(len(header)) + img.offsetMask) >> img.clusterBits
+	off, err := img.allocateClusterRun(clusters, AllocMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to allocate LUKS header: %w", err)
+	}
+	if _, err := img.file.WriteAt(header, int64(off)); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to write LUKS header: %w", err)
+	}
+	return &EncryptionHeaderPointer{Offset: off, Length: uint64(len(header))}, nil
+}
+
+// enableLUKS points the header at a LUKS header written by writeLUKSHeader
+// and marks the image LUKS-encrypted, unlocked with decryptor. From here on
+// data clusters are read and written encrypted.
+func (img *Image) enableLUKS(ptr *EncryptionHeaderPointer, decryptor *LUKSDecryptor) error {
+	if err := img.requireNewFeatures("LUKS encryption"); err != nil {
+		return err
+	}
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[0:8], ptr.Offset)
+	binary.BigEndian.PutUint64(data[8:16], ptr.Length)
+	if err := img.setHeaderExtension(ExtensionFullDiskEncrypt, data); err != nil {
+		return err
+	}
+	img.header.EncryptMethod = EncryptionLUKS
+	if err := img.writeHeader(); err != nil {
+		img.header.EncryptMethod = EncryptionNone
+		return fmt.Errorf("qcow2: failed to update header: %w", err)
+	}
+	img.extensions.EncryptionHeader = ptr
+	img.luksDecryptor = decryptor
+	return nil
+}
+
+// EncryptCopy copies the plaintext QCOW2 image at srcPath into a new
+// LUKS-encrypted image at dstPath, which QEMU opens with
+// encrypt.format=luks and the same passphrase. The cluster size and backing
+// file reference are kept, and internal snapshots are migrated as by
+// ConvertClusterSize, with the same restrictions. Compressed clusters are
+// written out uncompressed, since encrypted images cannot hold them. The
+// source is not modified.
+func EncryptCopy(srcPath, dstPath string, opts EncryptOptions) error {
+	defer clear(opts.Passphrase)
+
+	src, err := OpenFile(srcPath, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	if src.header.IsEncrypted() {
+		return fmt.Errorf("qcow2: source image is already encrypted")
+	}
+	snapshots := src.Snapshots()
+	if err := checkSnapshotsMigratable(src, snapshots); err != nil {
+		return err
+	}
+
+	header, decryptor, err := newLUKSHeader(opts.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	createOpts := CreateOptions{
+		Size:          uint64(src.Size()),
+		ClusterBits:   src.header.ClusterBits,
+		LazyRefcounts: src.header.HasLazyRefcounts(),
+	}
+	if src.HasBackingFile() {
+		createOpts.BackingFile = rebaseBackingPath(src.BackingFile(), srcPath, dstPath)
+		createOpts.BackingFormat = src.BackingFormat()
+	}
+	dst, err := Create(dstPath, createOpts)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		ptr, err := dst.writeLUKSHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := dst.enableLUKS(ptr, decryptor); err != nil {
+			return err
+		}
+		return migrateClusterSize(src, dst, snapshots)
+	}()
+	if err != nil {
+		dst.Close()
+		os.Remove(dstPath)
+		return err
+	}
+	return dst.Close()
+}
+
+// EncryptInPlace converts the plaintext QCOW2 image at path into a
+// LUKS-encrypted one without copying it, which QEMU opens with
+// encrypt.format=luks and the same passphrase. The LUKS header goes in
+// clusters appended to the file, and every data cluster, including those
+// only snapshots refer to, is encrypted where it lies, so the layout of the
+// image is otherwise unchanged.
+//
+// The image switches to encrypted only once all data is encrypted and
+// synced, but a conversion that is interrupted before then leaves data
+// clusters in both forms and the image unusable, so keep a copy or use
+// EncryptCopy when the source must survive a failure.
+//
+// Images with compressed clusters, an external data file or a checksum
+// sidecar are rejected before anything is written; EncryptCopy handles
+// compressed clusters.
+func EncryptInPlace(path string, opts EncryptOptions) (err error) {
+	defer clear(opts.Passphrase)
+
+	img, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := img.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	switch {
+	case img.header.IsEncrypted():
+		return fmt.Errorf("qcow2: image is already encrypted")
+	case img.header.Version < Version3:
+		return fmt.Errorf("qcow2: LUKS encryption requires a version 3 image")
+	case img.header.HasExternalDataFile():
+		return fmt.Errorf("qcow2: cannot encrypt an image with an external data file in place")
+	case img.checksums != nil:
+		return fmt.Errorf("qcow2: cannot encrypt an image with a checksum sidecar in place")
+	}
+	if err := img.Flush(); err != nil {
+		return err
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	clusters, err := img.allDataClusters()
+	if err != nil {
+		return err
+	}
+
+	header, decryptor, err := newLUKSHeader(opts.Passphrase)
+	if err != nil {
+		return err
+	}
+	ptr, err := img.writeLUKSHeader(header)
+	if err != nil {
+		return err
+	}
+	if err := img.flushLocked(); err != nil {
+		return err
+	}
+
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	for _, off := range clusters {
+		if _, err := img.file.ReadAt(buf, int64(off)); err != nil && err != io.EOF {
+			return fmt.Errorf("qcow2: failed to read data cluster at 0x%x: %w", off, err)
+		}
+		ciphertext, err := decryptor.EncryptCluster(buf, off)
+		if err != nil {
+			return fmt.Errorf("qcow2: LUKS encryption failed: %w", err)
+		}
+		if _, err := img.file.WriteAt(ciphertext, int64(off)); err != nil {
+			return fmt.Errorf("qcow2: failed to write encrypted cluster at 0x%x: %w", off, err)
+		}
+	}
+	if err := img.file.Sync(); err != nil {
+		return fmt.Errorf("qcow2: failed to sync encrypted data: %w", err)
+	}
+
+	return img.enableLUKS(ptr, decryptor)
+}
+
+// allDataClusters returns the host offsets of the data clusters of the
+// active state and all snapshots, each once and in order. Compressed
+// clusters are an error, since encrypted images cannot hold them.
+func (img *Image) allDataClusters() ([]uint64, error) {
+	if err := img.loadSnapshots(); err != nil {
+		return nil, err
+	}
+	if err := img.faultAllL1(); err != nil {
+		return nil, err
+	}
+	img.l1Mu.RLock()
+	l1Tables := [][]byte{append([]byte(nil), img.l1Table...)}
+	img.l1Mu.RUnlock()
+	for _, snap := range img.snapshots {
+		l1, err := img.snapshotL1Table(snap)
+		if err != nil {
+			return nil, err
+		}
+		l1Tables = append(l1Tables, l1)
+	}
+
+	seen := make(map[uint64]bool)
+	var clusters []uint64
+	for _, l1 := range l1Tables {
+		offsets, compressed, err := img.l1DataClusters(l1)
+		if err != nil {
+			return nil, err
+		}
+		if compressed {
+			return nil, fmt.Errorf("qcow2: compressed clusters cannot be encrypted in place (use EncryptCopy)")
+		}
+		for _, off := range offsets {
+			if !seen[off] {
+				seen[off] = true
+				clusters = append(clusters, off)
+			}
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+	return clusters, nil
+}
+
+// DecryptOptions configures DecryptCopy.
+type DecryptOptions struct {
+	// Passphrase unlocks the source image, LUKS or legacy AES. It is
+	// zeroed when DecryptCopy returns.
+	Passphrase []byte
+
+	// KeyProvider supplies the keys of encrypted backing layers, and of a
+	// LUKS source when Passphrase is empty.
+	KeyProvider KeyProvider
+
+	// Format is the format of the target: "qcow2" (the default) or "raw".
+	Format string
+}
+
+// DecryptCopy copies the encrypted QCOW2 image at srcPath into a new
+// plaintext image at dstPath, for forensic work or migration to storage
+// that encrypts on its own. The source is not modified.
+//
+// A qcow2 target keeps the cluster size and backing file reference, so
+// backing layers are left as they are, and internal snapshots are migrated
+// as by ConvertClusterSize, with the same restrictions. A raw target is the
+// whole virtual disk, backing chain included, with all-zero clusters left
+// sparse.
+func DecryptCopy(srcPath, dstPath string, opts DecryptOptions) error {
+	defer clear(opts.Passphrase)
+
+	format := opts.Format
+	if format == "" {
+		format = "qcow2"
+	}
+	if format != "qcow2" && format != "raw" {
+		return fmt.Errorf("qcow2: unsupported target format %q", format)
+	}
+
+	var options []Option
+	if opts.KeyProvider != nil {
+		options = append(options, WithKeyProvider(opts.KeyProvider))
+	}
+	src, err := OpenFile(srcPath, os.O_RDONLY, 0, options...)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	if len(opts.Passphrase) > 0 {
+		switch src.header.EncryptMethod {
+		case EncryptionAES:
+			err = src.SetPassword(string(opts.Passphrase))
+		case EncryptionLUKS:
+			err = src.UnlockLUKS(KeyProviderFunc(func(KeyRequest) (*LUKSKey, error) {
+				return &LUKSKey{Passphrase: append([]byte(nil), opts.Passphrase...), Slot: AnyKeySlot}, nil
+			}))
+		default:
+			err = fmt.Errorf("qcow2: source image is not encrypted")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if format == "raw" {
+		return decryptToRaw(src, dstPath)
+	}
+
+	snapshots := src.Snapshots()
+	if err := checkSnapshotsMigratable(src, snapshots); err != nil {
+		return err
+	}
+	createOpts := CreateOptions{
+		Size:          uint64(src.Size()),
+		ClusterBits:   src.header.ClusterBits,
+		Version:       src.header.Version,
+		LazyRefcounts: src.header.HasLazyRefcounts(),
+	}
+	if src.HasBackingFile() {
+		createOpts.BackingFile = rebaseBackingPath(src.BackingFile(), srcPath, dstPath)
+		createOpts.BackingFormat = src.BackingFormat()
+	}
+	dst, err := Create(dstPath, createOpts)
+	if err != nil {
+		return err
+	}
+	if err := migrateClusterSize(src, dst, snapshots); err != nil {
+		dst.Close()
+		os.Remove(dstPath)
+		return err
+	}
+	return dst.Close()
+}
+
+// decryptToRaw streams the virtual disk of src into a new raw file at
+// dstPath one cluster at a time.
+func decryptToRaw(src *Image, dstPath string) error {
+	f, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("qcow2: failed to create target: %w", err)
+	}
+	err = func() error {
+		size := src.Size()
+		if err := f.Truncate(size); err != nil {
+			return fmt.Errorf("qcow2: failed to size target: %w", err)
+		}
+		buf := src.getClusterBuffer()
+		defer src.putClusterBuffer(buf)
+		for off := int64(0); off < size; off += int64(len(buf)) {
+			n := min(int64(len(buf)), size-off)
+			if _, err := src.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+				return fmt.Errorf("qcow2: read at 0x%x failed: %w", off, err)
+			}
+			if isZeroBuffer(buf[:n]) {
+				continue
+			}
+			if _, err := f.WriteAt(buf[:n], off); err != nil {
+				return fmt.Errorf("qcow2: failed to write target: %w", err)
+			}
+		}
+		return f.Sync()
+	}()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dstPath)
+	}
+	return err
+}
@@ -0,0 +1,235 @@
+// luks_encrypt_test.go - Tests for encrypting existing images
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptTestImage creates a plaintext image with a snapshot, data only the
+// snapshot refers to, and optionally a compressed cluster. It returns the
+// active and snapshot contents of the first 256KB.
+func encryptTestImage(t *testing.T, path string, compressed bool) (active, snapshot []byte) {
+	t.Helper()
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	snapshot = bytes.Repeat([]byte("PLAINTEXT-SNAPSHOT-"), 256*1024/19+1)[:256*1024]
+	if _, err := img.WriteAt(snapshot, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("before"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	active = append([]byte(nil), snapshot...)
+	update := bytes.Repeat([]byte("PLAINTEXT-ACTIVE-"), 64*1024/17+1)[:64*1024]
+	if _, err := img.WriteAt(update, 64*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(active[64*1024:], update)
+
+	if compressed {
+		img.SetCompressionLevel(CompressionDefault)
+		comp := bytes.Repeat([]byte("PLAINTEXT-COMPRESSED-"), 64*1024/21+1)[:64*1024]
+		if _, err := img.WriteAtCompressed(comp, 192*1024); err != nil {
+			t.Fatalf("WriteAtCompressed failed: %v", err)
+		}
+		copy(active[192*1024:], comp)
+	}
+	return active, snapshot
+}
+
+// checkEncrypted opens an encrypted image and compares its contents.
+func checkEncrypted(t *testing.T, path, passphrase string, active, snapshot []byte) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("PLAINTEXT")) {
+		t.Error("plaintext left in the encrypted file")
+	}
+
+	locked, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open without key failed: %v", err)
+	}
+	if hdr := locked.Header(); hdr.EncryptionMethod() != EncryptionLUKS {
+		t.Errorf("encryption method = %d, want LUKS", hdr.EncryptionMethod())
+	}
+	if _, err := locked.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Error("read without key should fail")
+	}
+	locked.Close()
+
+	img, err := Open(path, WithLUKSPasswords(map[string]string{path: passphrase}))
+	if err != nil {
+		t.Fatalf("Open with key failed: %v", err)
+	}
+	defer img.Close()
+
+	got := make([]byte, len(active))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, active) {
+		t.Error("active data mismatch")
+	}
+	snap := img.FindSnapshot("before")
+	if snap == nil {
+		t.Fatal("snapshot not found")
+	}
+	if _, err := img.ReadAtSnapshot(got, 0, snap); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if !bytes.Equal(got, snapshot) {
+		t.Error("snapshot data mismatch")
+	}
+
+	// Check does not follow snapshots
+	if err := img.DeleteSnapshot("before"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+
+	// New writes are encrypted too
+	if _, err := img.WriteAt([]byte("after"), 300*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.ReadAt(got[:5], 300*1024); err != nil || string(got[:5]) != "after" {
+		t.Errorf("read back %q, %v", got[:5], err)
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean: %+v", result)
+	}
+}
+
+func TestEncryptCopy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping LUKS test in short mode (slow key derivation)")
+	}
+	t.Parallel()
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "plain.qcow2")
+	dstPath := filepath.Join(dir, "encrypted.qcow2")
+	active, snapshot := encryptTestImage(t, srcPath, true)
+
+	passphrase := []byte("copy-secret")
+	if err := EncryptCopy(srcPath, dstPath, EncryptOptions{Passphrase: passphrase}); err != nil {
+		t.Fatalf("EncryptCopy failed: %v", err)
+	}
+	if !bytes.Equal(passphrase, make([]byte, len(passphrase))) {
+		t.Error("passphrase not zeroed")
+	}
+	checkEncrypted(t, dstPath, "copy-secret", active, snapshot)
+
+	if err := EncryptCopy(dstPath, filepath.Join(dir, "again.qcow2"), EncryptOptions{Passphrase: []byte("x")}); err == nil {
+		t.Error("expected encrypting an encrypted image to fail")
+	}
+}
+
+func TestEncryptInPlace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping LUKS test in short mode (slow key derivation)")
+	}
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plain.qcow2")
+	active, snapshot := encryptTestImage(t, path, false)
+
+	if err := EncryptInPlace(path, EncryptOptions{Passphrase: []byte("inplace-secret")}); err != nil {
+		t.Fatalf("EncryptInPlace failed: %v", err)
+	}
+	checkEncrypted(t, path, "inplace-secret", active, snapshot)
+
+	// Compressed clusters are rejected before anything changes
+	compPath := filepath.Join(dir, "compressed.qcow2")
+	encryptTestImage(t, compPath, true)
+	before, err := os.ReadFile(compPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptInPlace(compPath, EncryptOptions{Passphrase: []byte("x")}); err == nil {
+		t.Error("expected compressed image to be rejected")
+	}
+	after, err := os.ReadFile(compPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("rejected image was modified")
+	}
+}
+
+func TestDecryptCopy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping LUKS test in short mode (slow key derivation)")
+	}
+	t.Parallel()
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.qcow2")
+	encPath := filepath.Join(dir, "encrypted.qcow2")
+	active, snapshot := encryptTestImage(t, plainPath, true)
+	if err := EncryptCopy(plainPath, encPath, EncryptOptions{Passphrase: []byte("secret")}); err != nil {
+		t.Fatalf("EncryptCopy failed: %v", err)
+	}
+
+	qcowPath := filepath.Join(dir, "decrypted.qcow2")
+	if err := DecryptCopy(encPath, qcowPath, DecryptOptions{Passphrase: []byte("secret")}); err != nil {
+		t.Fatalf("DecryptCopy to qcow2 failed: %v", err)
+	}
+	img, err := Open(qcowPath)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if hdr := img.Header(); hdr.IsEncrypted() {
+		t.Error("decrypted image is still marked encrypted")
+	}
+	got := make([]byte, len(active))
+	if _, err := img.ReadAt(got, 0); err != nil || !bytes.Equal(got, active) {
+		t.Errorf("qcow2 target data mismatch (err %v)", err)
+	}
+	snap := img.FindSnapshot("before")
+	if snap == nil {
+		t.Fatal("snapshot not migrated")
+	}
+	if _, err := img.ReadAtSnapshot(got, 0, snap); err != nil || !bytes.Equal(got, snapshot) {
+		t.Errorf("qcow2 target snapshot mismatch (err %v)", err)
+	}
+
+	rawPath := filepath.Join(dir, "decrypted.raw")
+	provider := passwordProvider{layerPath(encPath): "secret"}
+	if err := DecryptCopy(encPath, rawPath, DecryptOptions{KeyProvider: provider, Format: "raw"}); err != nil {
+		t.Fatalf("DecryptCopy to raw failed: %v", err)
+	}
+	raw, err := os.ReadFile(rawPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(raw)) != img.Size() || !bytes.Equal(raw[:len(active)], active) ||
+		!bytes.Equal(raw[len(active):], make([]byte, len(raw)-len(active))) {
+		t.Error("raw target mismatch")
+	}
+
+	badPath := filepath.Join(dir, "bad.qcow2")
+	if err := DecryptCopy(encPath, badPath, DecryptOptions{Passphrase: []byte("wrong")}); err == nil {
+		t.Error("expected wrong passphrase to fail")
+	}
+	if _, err := os.Stat(badPath); !os.IsNotExist(err) {
+		t.Error("failed DecryptCopy left a target behind")
+	}
+	if err := DecryptCopy(encPath, badPath, DecryptOptions{Format: "vmdk"}); err == nil {
+		t.Error("expected unsupported format to fail")
+	}
+}
@@ -2,6 +2,7 @@ package qcow2
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -442,3 +443,195 @@ func TestLUKSWriteWithoutPassword(t *testing.T) {
 		t.Error("WriteAt should fail without password set")
 	}
 }
+
+// TestLUKSEncryptedBackingChain opens an encrypted overlay over a backing
+// file encrypted with a different passphrase.
+func TestLUKSEncryptedBackingChain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping LUKS test in short mode (slow key derivation)")
+	}
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not available")
+	}
+
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2",
+		"-o", "encrypt.format=luks,encrypt.key-secret=sec0",
+		"--object", "secret,id=sec0,data=basepass",
+		basePath, "10M")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create base image: %v\n%s", err, out)
+	}
+	// -u: qemu-img cannot open the encrypted backing file without its secret
+	cmd = exec.Command("qemu-img", "create", "-f", "qcow2", "-u",
+		"-b", "base.qcow2", "-F", "qcow2",
+		"-o", "encrypt.format=luks,encrypt.key-secret=sec1",
+		"--object", "secret,id=sec1,data=overlaypass",
+		overlayPath, "10M")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create overlay: %v\n%s", err, out)
+	}
+
+	// Fill the first two clusters of the base
+	base, err := Open(basePath, WithLUKSPasswords(map[string]string{basePath: "basepass"}))
+	if err != nil {
+		t.Fatalf("Open base failed: %v", err)
+	}
+	baseData := bytes.Repeat([]byte("base"), 32*1024)
+	if _, err := base.WriteAt(baseData, 0); err != nil {
+		t.Fatalf("WriteAt base failed: %v", err)
+	}
+	base.Close()
+
+	passwords := map[string]string{
+		overlayPath: "overlaypass",
+		basePath:    "basepass",
+	}
+	img, err := Open(overlayPath, WithLUKSPasswords(passwords))
+	if err != nil {
+		t.Fatalf("Open overlay failed: %v", err)
+	}
+	got := make([]byte, len(baseData))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt through overlay failed: %v", err)
+	}
+	if !bytes.Equal(got, baseData) {
+		t.Fatal("backing data not decrypted with its own key")
+	}
+
+	// A partial write copies the rest of the cluster up from the base
+	if _, err := img.WriteAt([]byte("overlay"), 100); err != nil {
+		t.Fatalf("WriteAt overlay failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(overlayPath, WithLUKSPasswords(passwords))
+	if err != nil {
+		t.Fatalf("reopen overlay failed: %v", err)
+	}
+	defer img.Close()
+	want := append([]byte(nil), baseData...)
+	copy(want[100:], "overlay")
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt after reopen failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch after copy-up")
+	}
+
+	// Without the base's passphrase, backing reads fail
+	locked, err := Open(overlayPath, WithLUKSPasswords(map[string]string{overlayPath: "overlaypass"}))
+	if err != nil {
+		t.Fatalf("Open with partial passwords failed: %v", err)
+	}
+	defer locked.Close()
+	if _, err := locked.ReadAt(got[:10], 70*1024); err == nil {
+		t.Error("expected reads of the locked base to fail")
+	}
+}
+
+// TestKeyProvider unlocks a LUKS image with keys fetched from a provider.
+func TestKeyProvider(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping LUKS test in short mode (slow key derivation)")
+	}
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img not available")
+	}
+
+	imgPath := filepath.Join(t.TempDir(), "luks.qcow2")
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2",
+		"-o", "encrypt.format=luks,encrypt.key-secret=sec0",
+		"--object", "secret,id=sec0,data=secret",
+		imgPath, "10M")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create LUKS image: %v\n%s", err, out)
+	}
+
+	var handed [][]byte
+	provider := func(slot int) KeyProvider {
+		return KeyProviderFunc(func(req KeyRequest) (*LUKSKey, error) {
+			if len(req.Slots) != 1 || req.Slots[0] != 0 {
+				t.Errorf("active slots = %v, want [0]", req.Slots)
+			}
+			p := []byte("secret")
+			handed = append(handed, p)
+			return &LUKSKey{Passphrase: p, Slot: slot}, nil
+		})
+	}
+
+	img, err := Open(imgPath, WithKeyProvider(provider(0)))
+	if err != nil {
+		t.Fatalf("Open with key provider failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+	if !bytes.Equal(handed[0], make([]byte, len("secret"))) {
+		t.Error("passphrase not zeroed after use")
+	}
+
+	// A key for an inactive slot does not unlock the image
+	if _, err := Open(imgPath, WithKeyProvider(provider(3))); err == nil {
+		t.Error("expected open with a key for the wrong slot to fail")
+	}
+
+	// Without a key the image opens locked and can be unlocked later
+	img, err = Open(imgPath, WithKeyProvider(KeyProviderFunc(func(KeyRequest) (*LUKSKey, error) {
+		return nil, nil
+	})))
+	if err != nil {
+		t.Fatalf("Open without key failed: %v", err)
+	}
+	defer img.Close()
+	buf := make([]byte, 4)
+	if _, err := img.ReadAt(buf, 0); err == nil {
+		t.Error("read of locked image should fail")
+	}
+	if err := img.UnlockLUKS(provider(AnyKeySlot)); err != nil {
+		t.Fatalf("UnlockLUKS failed: %v", err)
+	}
+	if _, err := img.ReadAt(buf, 0); err != nil || string(buf) != "data" {
+		t.Errorf("ReadAt after UnlockLUKS = %q, %v", buf, err)
+	}
+
+	failing := KeyProviderFunc(func(KeyRequest) (*LUKSKey, error) {
+		return nil, errors.New("agent unavailable")
+	})
+	if _, err := Open(imgPath, WithKeyProvider(failing)); err == nil {
+		t.Error("expected provider error to fail the open")
+	}
+}
+
+// TestUnlockLUKSUnencrypted checks that providers are not consulted for
+// unencrypted images.
+func TestUnlockLUKSUnencrypted(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "plain.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	called := false
+	provider := KeyProviderFunc(func(KeyRequest) (*LUKSKey, error) {
+		called = true
+		return nil, nil
+	})
+	img, err = Open(path, WithKeyProvider(provider))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if called {
+		t.Error("key provider called for an unencrypted image")
+	}
+	if err := img.UnlockLUKS(provider); err == nil {
+		t.Error("UnlockLUKS should fail on an unencrypted image")
+	}
+}
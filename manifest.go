@@ -0,0 +1,237 @@
+package qcow2
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ManifestVersion is the version of the manifest format written by
+// Manifest.WriteTo.
+const ManifestVersion = 1
+
+// Manifest errors.
+var (
+	// ErrInvalidManifest is returned by ReadManifest and
+	// VerifyAgainstManifest for a manifest they cannot use.
+	ErrInvalidManifest = errors.New("qcow2: invalid manifest")
+
+	// ErrManifestMismatch marks a range whose contents differ from the
+	// manifest in a ScrubReport.
+	ErrManifestMismatch = errors.New("qcow2: contents differ from manifest")
+)
+
+// Manifest records the contents of an image or snapshot at backup time:
+// header details, the allocation map and a SHA-256 hash of every cluster
+// holding data. VerifyAgainstManifest checks a restored image against it.
+type Manifest struct {
+	Version      int              `json:"version"`                // ManifestVersion
+	ImageVersion uint32           `json:"image-version"`          // qcow2 version of the image
+	VirtualSize  uint64           `json:"virtual-size"`           // Virtual size in bytes
+	ClusterSize  uint64           `json:"cluster-size"`           // Bytes covered by each hash
+	BackingFile  string           `json:"backing-file,omitempty"` // Backing file named in the header
+	Snapshot     string           `json:"snapshot,omitempty"`     // ID of the snapshot described, if any
+	Extents      []ManifestExtent `json:"extents"`                // Allocation map
+	Clusters     []ClusterHash    `json:"clusters"`               // Hashes of data clusters, ascending
+}
+
+// ManifestExtent is an Extent with its type spelled out, as in Map.
+type ManifestExtent struct {
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+	Type   string `json:"type"` // ExtentType.String()
+}
+
+// ClusterHash is the hash of one guest cluster. The last cluster is hashed
+// only up to the virtual size.
+type ClusterHash struct {
+	Offset uint64 `json:"offset"` // Virtual offset of the cluster
+	SHA256 string `json:"sha256"` // Hex-encoded hash of its contents
+}
+
+// Manifest builds a manifest of the active image. Data and backing
+// extents are read, through the backing chain, and hashed per cluster;
+// zero and unallocated extents are known to read as zeros and are only
+// recorded in the allocation map. It returns early with ctx.Err() if the
+// context is cancelled, and runs at the priority ctx carries (WithPriority).
+func (img *Image) Manifest(ctx context.Context) (*Manifest, error) {
+	return img.buildManifest(ctx, img.translate, img.readUntracked, nil)
+}
+
+// SnapshotManifest builds a manifest of the image as it was when snap was
+// taken, like Manifest does for the active image.
+func (img *Image) SnapshotManifest(ctx context.Context, snap *Snapshot) (*Manifest, error) {
+	translate, err := img.snapshotTranslate(snap)
+	if err != nil {
+		return nil, err
+	}
+	read := func(p []byte, off int64) (int, error) {
+		return img.ReadAtSnapshot(p, off, snap)
+	}
+	return img.buildManifest(ctx, translate, read, snap)
+}
+
+func (img *Image) buildManifest(ctx context.Context, translate func(uint64) (clusterInfo, error),
+	read func([]byte, int64) (int, error), snap *Snapshot) (*Manifest, error) {
+	m := &Manifest{
+		Version:      ManifestVersion,
+		ImageVersion: img.header.Version,
+		VirtualSize:  uint64(img.Size()),
+		ClusterSize:  img.clusterSize,
+		BackingFile:  img.BackingFile(),
+		Extents:      []ManifestExtent{},
+		Clusters:     []ClusterHash{},
+	}
+	if snap != nil {
+		m.Snapshot = snap.ID
+	}
+
+	var extents []Extent
+	err := img.walkExtentsWith(0, img.Size(), translate, func(e Extent) error {
+		extents = append(extents, e)
+		m.Extents = append(m.Extents, ManifestExtent{Start: e.Start, Length: e.Length, Type: e.Type.String()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	for _, e := range extents {
+		if e.Type != ExtentData && e.Type != ExtentBacking {
+			continue
+		}
+		// Extents of extended L2 images can start mid-cluster; hash whole
+		// clusters, once each
+		start := e.Start &^ img.offsetMask
+		if n := len(m.Clusters); n > 0 && m.Clusters[n-1].Offset == start {
+			start += img.clusterSize
+		}
+		for off := start; off < e.End(); off += img.clusterSize {
+			if _, err := img.waitTurn(ctx); err != nil {
+				return nil, err
+			}
+			sum, err := hashCluster(buf, off, m.VirtualSize, read)
+			if err != nil {
+				return nil, err
+			}
+			m.Clusters = append(m.Clusters, ClusterHash{Offset: off, SHA256: sum})
+		}
+	}
+	return m, nil
+}
+
+// hashCluster hashes the guest cluster at off, read into buf, stopping at
+// the virtual size.
+func hashCluster(buf []byte, off, size uint64, read func([]byte, int64) (int, error)) (string, error) {
+	n := min(uint64(len(buf)), size-off)
+	if _, err := read(buf[:n], int64(off)); err != nil {
+		return "", fmt.Errorf("qcow2: manifest read at 0x%x failed: %w", off, err)
+	}
+	sum := sha256.Sum256(buf[:n])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// WriteTo writes the manifest as indented JSON.
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// ReadManifest reads a manifest written by Manifest.WriteTo.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidManifest, m.Version)
+	}
+	return &m, nil
+}
+
+// VerifyAgainstManifest checks a restored image against a manifest taken
+// of the original. Every cluster hashed in m is read back and re-hashed,
+// and every other cluster allocated in img must read as zeros, as the
+// manifest recorded it. The image only has to match bit for bit: its
+// allocation map, cluster size and backing chain may differ from the
+// original's.
+//
+// Results go into a ScrubReport: differing clusters in ManifestMismatches,
+// merged into ranges, and clusters that fail to read in Unreadable. The
+// virtual sizes must match, or it fails with ErrInvalidManifest. It
+// returns early with ctx.Err() if the context is cancelled, and runs at the
+// priority ctx carries (WithPriority).
+func VerifyAgainstManifest(ctx context.Context, img *Image, m *Manifest) (*ScrubReport, error) {
+	size := uint64(img.Size())
+	if m.VirtualSize != size {
+		return nil, fmt.Errorf("%w: virtual size %d, image is %d", ErrInvalidManifest, m.VirtualSize, size)
+	}
+	if m.ClusterSize == 0 || m.ClusterSize&(m.ClusterSize-1) != 0 || m.ClusterSize > 1<<MaxClusterBits {
+		return nil, fmt.Errorf("%w: cluster size %d", ErrInvalidManifest, m.ClusterSize)
+	}
+
+	// An empty hash stands for a cluster the manifest has as zeros
+	hashes := make(map[uint64]string, len(m.Clusters))
+	for _, c := range m.Clusters {
+		if c.Offset >= size || c.Offset&(m.ClusterSize-1) != 0 {
+			return nil, fmt.Errorf("%w: bad cluster offset 0x%x", ErrInvalidManifest, c.Offset)
+		}
+		hashes[c.Offset] = c.SHA256
+	}
+	extents, err := img.Map(0, img.Size())
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range extents {
+		if e.Type != ExtentData && e.Type != ExtentBacking {
+			continue
+		}
+		for off := e.Start &^ (m.ClusterSize - 1); off < e.End(); off += m.ClusterSize {
+			if _, ok := hashes[off]; !ok {
+				hashes[off] = ""
+			}
+		}
+	}
+	offsets := make([]uint64, 0, len(hashes))
+	for off := range hashes {
+		offsets = append(offsets, off)
+	}
+	slices.Sort(offsets)
+
+	report := &ScrubReport{}
+	buf := make([]byte, m.ClusterSize)
+	for _, off := range offsets {
+		if _, err := img.waitTurn(ctx); err != nil {
+			return report, err
+		}
+		n := min(m.ClusterSize, size-off)
+		sum, err := hashCluster(buf, off, size, img.readUntracked)
+		if err != nil {
+			report.addUnreadable(off, n, err)
+			continue
+		}
+		want := hashes[off]
+		if want == "" {
+			zero := sha256.Sum256(make([]byte, n))
+			want = hex.EncodeToString(zero[:])
+		}
+		report.ManifestChecked++
+		report.BytesRead += n
+		if sum != want {
+			report.ManifestMismatches = appendScrubRange(report.ManifestMismatches, off, n,
+				fmt.Errorf("%w at 0x%x", ErrManifestMismatch, off))
+		}
+	}
+	return report, nil
+}
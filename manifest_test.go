@@ -0,0 +1,155 @@
+// manifest_test.go - Backup manifest tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestManifest checks a manifest round-trips through its file format,
+// verifies a restored copy with a different layout, and catches a changed
+// cluster.
+func TestManifest(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "src.qcow2")
+	restorePath := filepath.Join(dir, "restore.qcow2")
+	ctx := context.Background()
+
+	img, err := CreateSimple(path, 1024*1024+4096)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, cs+100), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte{2}, cs), int64(4*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	if err := img.WriteZeroAtMode(int64(6*cs), int64(cs), ZeroAlloc); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte{3}, img.Size()-1); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	m, err := img.Manifest(ctx)
+	if err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	var offsets []uint64
+	for _, c := range m.Clusters {
+		offsets = append(offsets, c.Offset)
+	}
+	last := uint64(img.Size()-1) &^ uint64(cs-1)
+	if want := []uint64{0, uint64(cs), uint64(4 * cs), last}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("hashed clusters = %v, want %v", offsets, want)
+	}
+	if len(m.Extents) == 0 || m.Extents[0].Type != "data" {
+		t.Errorf("extents = %+v", m.Extents)
+	}
+
+	var file bytes.Buffer
+	if _, err := m.WriteTo(&file); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	got, err := ReadManifest(&file)
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("round trip = %+v, want %+v", got, m)
+	}
+	img.Close()
+
+	if err := ConvertClusterSize(path, restorePath, 12); err != nil {
+		t.Fatalf("ConvertClusterSize failed: %v", err)
+	}
+	restored, err := Open(restorePath)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer restored.Close()
+	report, err := VerifyAgainstManifest(ctx, restored, got)
+	if err != nil {
+		t.Fatalf("VerifyAgainstManifest failed: %v", err)
+	}
+	if !report.IsClean() || report.ManifestChecked != 4 {
+		t.Errorf("restored copy report = %+v, want 4 matching clusters", report)
+	}
+
+	// A changed cluster, and data where the manifest has zeros, adjacent
+	// to it so the two merge into one range
+	if _, err := restored.WriteAt([]byte{9}, int64(4*cs)+7); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := restored.WriteAt([]byte{9}, int64(5*cs)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	report, err = VerifyAgainstManifest(ctx, restored, got)
+	if err != nil {
+		t.Fatalf("VerifyAgainstManifest failed: %v", err)
+	}
+	if report.IsClean() || len(report.ManifestMismatches) != 1 {
+		t.Fatalf("mismatches = %+v, want one range", report.ManifestMismatches)
+	}
+	if r := report.ManifestMismatches[0]; r.Start != uint64(4*cs) || r.Length != uint64(2*cs) || !errors.Is(r.Err, ErrManifestMismatch) {
+		t.Errorf("mismatch = %+v, want clusters 4 and 5", r)
+	}
+
+	got.VirtualSize++
+	if _, err := VerifyAgainstManifest(ctx, restored, got); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("size mismatch: got %v, want ErrInvalidManifest", err)
+	}
+	if _, err := ReadManifest(bytes.NewReader([]byte(`{"version": 99}`))); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("unknown version: got %v, want ErrInvalidManifest", err)
+	}
+}
+
+// TestSnapshotManifest checks a snapshot's manifest describes the image as
+// it was when the snapshot was taken.
+func TestSnapshotManifest(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	img, err := CreateSimple(filepath.Join(t.TempDir(), "snap.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, 4096), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	before, err := img.Manifest(ctx)
+	if err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	snap, err := img.CreateSnapshot("s1")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{2}, 4096), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	m, err := img.SnapshotManifest(ctx, snap)
+	if err != nil {
+		t.Fatalf("SnapshotManifest failed: %v", err)
+	}
+	if m.Snapshot != snap.ID || !reflect.DeepEqual(m.Clusters, before.Clusters) {
+		t.Errorf("snapshot manifest = %+v, want clusters %+v", m, before.Clusters)
+	}
+	report, err := VerifyAgainstManifest(ctx, img, m)
+	if err != nil {
+		t.Fatalf("VerifyAgainstManifest failed: %v", err)
+	}
+	if report.IsClean() {
+		t.Error("active image matches the snapshot manifest after being overwritten")
+	}
+}
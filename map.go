@@ -0,0 +1,221 @@
+package qcow2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+)
+
+// ExtentType describes how a range of the virtual disk is stored.
+type ExtentType int
+
+const (
+	// ExtentData is allocated in this image (normal or compressed clusters).
+	ExtentData ExtentType = iota
+
+	// ExtentZero reads as zeros because of the zero flag; no data is stored.
+	ExtentZero
+
+	// ExtentBacking is unallocated in this image and reads from the backing file.
+	ExtentBacking
+
+	// ExtentUnallocated is unallocated with no backing file and reads as zeros.
+	ExtentUnallocated
+)
+
+// String returns a short lowercase name for the extent type.
+func (t ExtentType) String() string {
+	switch t {
+	case ExtentData:
+		return "data"
+	case ExtentZero:
+		return "zero"
+	case ExtentBacking:
+		return "backing"
+	case ExtentUnallocated:
+		return "unallocated"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// Extent is a contiguous range of the virtual disk with a single allocation state.
+type Extent struct {
+	Start  uint64     // Virtual offset of the first byte
+	Length uint64     // Length in bytes
+	Type   ExtentType // Allocation state of the whole range
+}
+
+// End returns the virtual offset just past the extent.
+func (e Extent) End() uint64 {
+	return e.Start + e.Length
+}
+
+// Map returns the allocation map for the virtual range [off, off+length).
+// Adjacent clusters with the same allocation state are merged into a single
+// extent. The range is clamped to the virtual size of the image.
+func (img *Image) Map(off, length int64) ([]Extent, error) {
+	var extents []Extent
+	err := img.walkExtents(off, length, func(e Extent) error {
+		extents = append(extents, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// errStopExtents ends a walk whose consumer has stopped iterating.
+var errStopExtents = errors.New("qcow2: extent iteration stopped")
+
+// Extents iterates over the allocation map of the whole virtual disk, as
+// Map would return it, but produces each extent as soon as it is found,
+// so a backup loop over a large disk needs no memory for the whole map:
+//
+//	for e, err := range img.Extents(ctx) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// An error ends the iteration: a failed lookup, or ctx.Err() once ctx is
+// done, which is checked before each cluster is looked up.
+func (img *Image) Extents(ctx context.Context) iter.Seq2[Extent, error] {
+	return func(yield func(Extent, error) bool) {
+		translate := func(off uint64) (clusterInfo, error) {
+			if err := ctx.Err(); err != nil {
+				return clusterInfo{}, err
+			}
+			return img.translate(off)
+		}
+		err := img.walkExtentsWith(0, img.Size(), translate, func(e Extent) error {
+			if !yield(e, nil) {
+				return errStopExtents
+			}
+			return nil
+		})
+		if err != nil && err != errStopExtents {
+			yield(Extent{}, err)
+		}
+	}
+}
+
+// SnapshotMap is Map for the image as it was when snap was taken, so that
+// a backup of the snapshot, rather than of the live state, skips the right
+// holes.
+func (img *Image) SnapshotMap(snap *Snapshot, off, length int64) ([]Extent, error) {
+	translate, err := img.snapshotTranslate(snap)
+	if err != nil {
+		return nil, err
+	}
+	var extents []Extent
+	err = img.walkExtentsWith(off, length, translate, func(e Extent) error {
+		extents = append(extents, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// snapshotTranslate returns the address translation of snap's L1 table.
+func (img *Image) snapshotTranslate(snap *Snapshot) (func(uint64) (clusterInfo, error), error) {
+	if snap == nil {
+		return nil, fmt.Errorf("qcow2: nil snapshot")
+	}
+	l1Table, err := img.snapshotL1Table(snap)
+	if err != nil {
+		return nil, err
+	}
+	return func(off uint64) (clusterInfo, error) {
+		return img.translateWithL1(off, l1Table)
+	}, nil
+}
+
+// walkExtents calls fn for each merged extent in [off, off+length).
+// Extents are reported in ascending order and never overlap.
+func (img *Image) walkExtents(off, length int64, fn func(Extent) error) error {
+	return img.walkExtentsWith(off, length, img.translate, fn)
+}
+
+// walkExtentsWith is walkExtents with the given address translation, such
+// as that of a snapshot's L1 table.
+func (img *Image) walkExtentsWith(off, length int64, translate func(uint64) (clusterInfo, error), fn func(Extent) error) error {
+	if off < 0 || length < 0 {
+		return ErrOffsetOutOfRange
+	}
+
+	size := uint64(img.Size())
+	start := uint64(off)
+	if start >= size {
+		return nil
+	}
+	end := start + uint64(length)
+	if end > size || end < start {
+		end = size
+	}
+
+	// Extended L2 images track allocation per subcluster
+	step := img.subclusterSize
+	if step == 0 {
+		step = img.clusterSize
+	}
+	// The virtual range one L2 table maps
+	l2Span := img.clusterSize << img.l2Bits
+
+	var cur Extent
+	haveCur := false
+	for pos := start; pos < end; {
+		info, err := translate(pos)
+		if err != nil {
+			return err
+		}
+		etype := img.extentTypeOf(info.ctype)
+
+		// Without an L2 table the rest of its span needs no lookups
+		next := (pos &^ (step - 1)) + step
+		if info.noL2 {
+			next = (pos &^ (l2Span - 1)) + l2Span
+		}
+		if next > end || next < pos {
+			next = end
+		}
+
+		if haveCur && cur.Type == etype {
+			cur.Length += next - pos
+		} else {
+			if haveCur {
+				if err := fn(cur); err != nil {
+					return err
+				}
+			}
+			cur = Extent{Start: pos, Length: next - pos, Type: etype}
+			haveCur = true
+		}
+		pos = next
+	}
+
+	if haveCur {
+		return fn(cur)
+	}
+	return nil
+}
+
+// extentTypeOf maps an internal cluster type to the public extent type.
+func (img *Image) extentTypeOf(ctype clusterType) ExtentType {
+	switch ctype {
+	case clusterNormal, clusterCompressed:
+		return ExtentData
+	case clusterZero:
+		return ExtentZero
+	default:
+		if img.backing != nil {
+			return ExtentBacking
+		}
+		return ExtentUnallocated
+	}
+}
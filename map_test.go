@@ -0,0 +1,350 @@
+// map_test.go - Allocation map tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestMapExtents verifies that Map merges clusters by allocation state.
+func TestMapExtents(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "map.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := int64(img.ClusterSize())
+	data := make([]byte, 2*cs)
+	for i := range data {
+		data[i] = 0x5A
+	}
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(4*cs, cs); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+
+	extents, err := img.Map(0, img.Size())
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+
+	want := []Extent{
+		{Start: 0, Length: uint64(2 * cs), Type: ExtentData},
+		{Start: uint64(2 * cs), Length: uint64(2 * cs), Type: ExtentUnallocated},
+		{Start: uint64(4 * cs), Length: uint64(cs), Type: ExtentZero},
+		{Start: uint64(5 * cs), Length: uint64(img.Size() - 5*cs), Type: ExtentUnallocated},
+	}
+	if len(extents) != len(want) {
+		t.Fatalf("Map returned %d extents, want %d: %+v", len(extents), len(want), extents)
+	}
+	for i := range want {
+		if extents[i] != want[i] {
+			t.Errorf("extent %d = %+v, want %+v", i, extents[i], want[i])
+		}
+	}
+
+	// Partial ranges are clamped to the request and the virtual size
+	extents, err = img.Map(cs/2, img.Size())
+	if err != nil {
+		t.Fatalf("Map partial failed: %v", err)
+	}
+	if extents[0].Start != uint64(cs/2) || extents[0].Length != uint64(cs+cs/2) {
+		t.Errorf("first partial extent = %+v", extents[0])
+	}
+	if last := extents[len(extents)-1]; last.End() != uint64(img.Size()) {
+		t.Errorf("last extent ends at %d, want %d", last.End(), img.Size())
+	}
+}
+
+// TestMapBacking verifies unallocated overlay ranges report the backing file.
+func TestMapBacking(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	base.Close()
+
+	overlay, err := CreateOverlay(overlayPath, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	defer overlay.Close()
+
+	if _, err := overlay.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	extents, err := overlay.Map(0, overlay.Size())
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	if len(extents) != 2 || extents[0].Type != ExtentData || extents[1].Type != ExtentBacking {
+		t.Fatalf("unexpected extents: %+v", extents)
+	}
+}
+
+// TestSnapshotMap verifies SnapshotMap reports the snapshot's allocation,
+// not that of the active image written after it.
+func TestSnapshotMap(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "map.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := int64(img.ClusterSize())
+	if _, err := img.WriteAt(make([]byte, cs), cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	snap, err := img.CreateSnapshot("before")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(make([]byte, cs), 3*cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAtMode(cs, cs, ZeroPlain); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+
+	extents, err := img.SnapshotMap(snap, 0, img.Size())
+	if err != nil {
+		t.Fatalf("SnapshotMap failed: %v", err)
+	}
+	want := []Extent{
+		{Start: 0, Length: uint64(cs), Type: ExtentUnallocated},
+		{Start: uint64(cs), Length: uint64(cs), Type: ExtentData},
+		{Start: uint64(2 * cs), Length: uint64(img.Size() - 2*cs), Type: ExtentUnallocated},
+	}
+	if len(extents) != len(want) {
+		t.Fatalf("SnapshotMap returned %+v, want %+v", extents, want)
+	}
+	for i := range want {
+		if extents[i] != want[i] {
+			t.Errorf("extent %d = %+v, want %+v", i, extents[i], want[i])
+		}
+	}
+
+	if _, err := img.SnapshotMap(nil, 0, img.Size()); err == nil {
+		t.Error("SnapshotMap accepted a nil snapshot")
+	}
+}
+
+// TestDescribeCluster verifies the decoded view of each kind of L2 entry.
+func TestDescribeCluster(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "describe.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	cs := int64(img.ClusterSize())
+
+	if _, err := img.WriteAt([]byte("data"), 100); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(cs, cs); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if err := img.WriteZeroAtMode(2*cs, cs, ZeroAlloc); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+	if _, err := img.WriteAtCompressed(make([]byte, cs), 3*cs); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+
+	desc, err := img.DescribeCluster(100)
+	if err != nil {
+		t.Fatalf("DescribeCluster failed: %v", err)
+	}
+	if desc.Type != ClusterNormal || desc.VirtualOffset != 0 || desc.HostOffset == 0 ||
+		!desc.Copied || desc.Refcount != 1 || desc.L2TableOffset == 0 {
+		t.Errorf("normal cluster: %+v", desc)
+	}
+
+	if desc, err = img.DescribeCluster(uint64(cs)); err != nil || desc.Type != ClusterZero || desc.HostOffset != 0 {
+		t.Errorf("zero cluster: %+v, %v", desc, err)
+	}
+	if desc, err = img.DescribeCluster(uint64(2 * cs)); err != nil || desc.Type != ClusterZero || desc.HostOffset == 0 || desc.Refcount != 1 {
+		t.Errorf("preallocated zero cluster: %+v, %v", desc, err)
+	}
+	if desc, err = img.DescribeCluster(uint64(3 * cs)); err != nil || desc.Type != ClusterCompressed || desc.HostOffset == 0 || desc.CompressedSize == 0 {
+		t.Errorf("compressed cluster: %+v, %v", desc, err)
+	}
+	if desc, err = img.DescribeCluster(uint64(4 * cs)); err != nil || desc.Type != ClusterUnallocated || desc.HostOffset != 0 {
+		t.Errorf("unallocated cluster: %+v, %v", desc, err)
+	}
+
+	// A snapshot shares the cluster and clears COPIED
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if desc, err = img.DescribeCluster(0); err != nil || desc.Copied || desc.Refcount != 2 {
+		t.Errorf("shared cluster: %+v, %v", desc, err)
+	}
+
+	if _, err := img.DescribeCluster(uint64(img.Size())); err != ErrOffsetOutOfRange {
+		t.Errorf("DescribeCluster past the end: got %v, want ErrOffsetOutOfRange", err)
+	}
+}
+
+// TestExtentsIterator checks Extents yields what Map returns, stops when
+// the loop breaks, and ends with the context's error once it is done.
+func TestExtentsIterator(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "extents.qcow2")
+
+	img, err := CreateSimple(path, 8*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := int64(img.ClusterSize())
+	if _, err := img.WriteAt(make([]byte, cs), 2*cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAtMode(5*cs, cs, ZeroPlain); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+
+	want, err := img.Map(0, img.Size())
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	var got []Extent
+	for e, err := range img.Extents(context.Background()) {
+		if err != nil {
+			t.Fatalf("Extents failed: %v", err)
+		}
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Extents = %v, want %v", got, want)
+	}
+
+	n := 0
+	for range img.Extents(context.Background()) {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("loop ran %d times after break", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var errs []error
+	for _, err := range img.Extents(ctx) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("cancelled iteration yielded %v, want one context.Canceled", errs)
+	}
+}
+
+// TestSnapshotMapExtendedL2 verifies snapshot maps and reads of an extended
+// L2 image agree with the live image they were taken from.
+func TestSnapshotMapExtendedL2(t *testing.T) {
+	t.Parallel()
+	path, data := createExtendedL2Image(t, true)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	snap, err := img.CreateSnapshot("ext")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	want, err := img.Map(0, img.Size())
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	got, err := img.SnapshotMap(snap, 0, img.Size())
+	if err != nil {
+		t.Fatalf("SnapshotMap failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("SnapshotMap returned %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("extent %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	buf := make([]byte, 2*len(data))
+	if _, err := img.ReadAtSnapshot(buf, 0, snap); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if !bytes.Equal(buf[:len(data)], data) || !bytes.Equal(buf[len(data):], make([]byte, len(data))) {
+		t.Error("ReadAtSnapshot returned wrong data")
+	}
+}
+
+// TestMapSkipsEmptyL1 verifies the walk looks up one offset per L2 span
+// that has no L2 table, rather than one per cluster.
+func TestMapSkipsEmptyL1(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "sparse.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("data"), 1024*1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	lookups := 0
+	translate := func(off uint64) (clusterInfo, error) {
+		lookups++
+		return img.translate(off)
+	}
+	var extents []Extent
+	err = img.walkExtentsWith(0, img.Size(), translate, func(e Extent) error {
+		extents = append(extents, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkExtentsWith failed: %v", err)
+	}
+
+	// One lookup for each empty span, and one per cluster of the mapped one
+	span := uint64(img.ClusterSize()) << img.l2Bits
+	spans := uint64(img.Size()) / span
+	if want := int(spans - 1 + span/uint64(img.ClusterSize())); lookups != want {
+		t.Errorf("walk made %d lookups, want %d", lookups, want)
+	}
+	want, err := img.Map(0, img.Size())
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	if !reflect.DeepEqual(extents, want) || len(extents) != 3 {
+		t.Errorf("extents = %+v", extents)
+	}
+}
@@ -0,0 +1,97 @@
+package qcow2
+
+// MemoryUsage is the memory an open image holds on to between calls, in
+// bytes, by what it is for. Buffers of calls in progress, pooled buffers
+// and Go runtime overhead are not counted.
+type MemoryUsage struct {
+	L1Table          uint64 // Active L1 table; with WithLazyL1 the part read so far
+	RefcountTable    uint64 // Refcount table
+	L2Cache          uint64 // Cached L2 tables (WithL2CacheSize)
+	RefcountCache    uint64 // Cached refcount blocks (WithRefcountCacheSize)
+	CompressedCache  uint64 // Decompressed clusters (WithCompressedCacheSize)
+	DataCache        uint64 // Cached data clusters (WithDataCacheSize)
+	SnapshotL1Tables uint64 // L1 tables of internal snapshots read so far
+	FreeBitmap       uint64 // Free cluster bitmap, built on first allocation
+	RefcountPin      uint64 // Pinned refcount block (WithRefcountWriteback)
+	DelayedWrites    uint64 // Buffered clusters (WithDelayedAllocation)
+
+	// MetadataChecksums estimates the sums kept for a metadata checksum
+	// sidecar (WithMetadataChecksumFile).
+	MetadataChecksums uint64
+
+	// Backing is the Total of a qcow2 backing file and its own chain.
+	Backing uint64
+
+	// Total is the sum of the fields above.
+	Total uint64
+}
+
+// metadataChecksumEntryBytes estimates a sidecar sum's share of its maps.
+const metadataChecksumEntryBytes = 32
+
+// MemoryUsage returns the memory the image holds, for sizing caches in
+// memory-constrained environments. Each cache can be disabled by setting
+// its size to 0.
+func (img *Image) MemoryUsage() MemoryUsage {
+	var m MemoryUsage
+
+	img.l1Mu.RLock()
+	m.L1Table = uint64(len(img.l1Table))
+	img.l1Mu.RUnlock()
+	if lazy := img.lazyL1; lazy != nil && lazy.pending.Load() > 0 {
+		loaded := uint64(len(lazy.loaded)) - uint64(lazy.pending.Load())
+		m.L1Table = min(m.L1Table, loaded*l1SegmentBytes)
+	}
+
+	img.refcountTableLock.RLock()
+	m.RefcountTable = uint64(len(img.refcountTable))
+	img.refcountTableLock.RUnlock()
+
+	m.L2Cache = img.l2Cache.bytes()
+	m.RefcountCache = img.refcountBlockCache.bytes()
+	m.CompressedCache = img.compressedCache.cache.bytes()
+	if img.dataCache != nil {
+		m.DataCache = img.dataCache.cache.bytes()
+	}
+
+	img.snapshotL1Mu.Lock()
+	for _, l1 := range img.snapshotL1 {
+		m.SnapshotL1Tables += uint64(len(l1))
+	}
+	img.snapshotL1Mu.Unlock()
+
+	// The bitmap is built and dropped under writeMu
+	img.writeMu.Lock()
+	if b := img.freeBitmap; b != nil {
+		b.mu.RLock()
+		m.FreeBitmap = uint64(len(b.words)) * 8
+		b.mu.RUnlock()
+	}
+	img.writeMu.Unlock()
+
+	if img.refcountPin != nil {
+		m.RefcountPin = uint64(len(img.refcountPin.block))
+	}
+	if d := img.delayed; d != nil {
+		d.mu.Lock()
+		m.DelayedWrites = d.size
+		d.mu.Unlock()
+	}
+	if s := img.metaChecksums; s != nil {
+		s.mu.Lock()
+		m.MetadataChecksums = uint64(len(s.sums)+len(s.written)) * metadataChecksumEntryBytes
+		s.mu.Unlock()
+	}
+	layer := img.backing
+	if r, ok := layer.(*retryingBacking); ok {
+		layer = r.current()
+	}
+	if backing, ok := layer.(*Image); ok {
+		m.Backing = backing.MemoryUsage().Total
+	}
+
+	m.Total = m.L1Table + m.RefcountTable + m.L2Cache + m.RefcountCache +
+		m.CompressedCache + m.DataCache + m.SnapshotL1Tables + m.FreeBitmap +
+		m.RefcountPin + m.DelayedWrites + m.MetadataChecksums + m.Backing
+	return m
+}
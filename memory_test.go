@@ -0,0 +1,83 @@
+// memory_test.go - Memory usage tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestMemoryUsage checks cached tables show up in MemoryUsage, and that
+// disabled caches hold nothing while reads still work.
+func TestMemoryUsage(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "memory.qcow2")
+
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	data := testutil.RandomBytes(1, 256*1024)
+	if _, err := img.WriteAt(data, 1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	usage := func(opts OpenOptionsV2) MemoryUsage {
+		t.Helper()
+		opts.ReadOnly = true
+		v2, err := OpenWithOptions(path, opts)
+		if err != nil {
+			t.Fatalf("OpenWithOptions failed: %v", err)
+		}
+		defer v2.Close()
+		buf := make([]byte, len(data))
+		if _, err := v2.ReadAt(buf, 1024*1024); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatal("ReadAt returned wrong data")
+		}
+		return v2.(*Image).MemoryUsage()
+	}
+
+	m := usage(OpenOptionsV2{})
+	if m.L2Cache != 65536 || m.L1Table == 0 {
+		t.Errorf("default caches: %+v", m)
+	}
+	sum := m.L1Table + m.RefcountTable + m.L2Cache + m.RefcountCache + m.CompressedCache +
+		m.DataCache + m.SnapshotL1Tables + m.FreeBitmap + m.RefcountPin + m.DelayedWrites +
+		m.MetadataChecksums + m.Backing
+	if m.Total != sum {
+		t.Errorf("Total = %d, fields add up to %d", m.Total, sum)
+	}
+
+	m = usage(OpenOptionsV2{NoL2Cache: true, NoCompressedCache: true, NoRefcountCache: true})
+	if m.L2Cache != 0 || m.CompressedCache != 0 || m.RefcountCache != 0 {
+		t.Errorf("disabled caches hold memory: %+v", m)
+	}
+
+	m = usage(OpenOptionsV2{DataCacheSize: 64})
+	if m.DataCache != uint64(len(data)) {
+		t.Errorf("DataCache = %d, want %d", m.DataCache, len(data))
+	}
+}
+
+// TestMemoryUsageBackingRetry checks a backing file opened with retries is
+// still counted.
+func TestMemoryUsageBackingRetry(t *testing.T) {
+	t.Parallel()
+	overlayPath, _ := createRetryChain(t, testutil.RandomBytes(1, 4096))
+
+	img, err := Open(overlayPath, WithReadOnly(), WithBackingRetry(BackingRetryPolicy{MaxRetries: 1}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if m := img.MemoryUsage(); m.Backing == 0 {
+		t.Errorf("backing file behind retries not counted: %+v", m)
+	}
+}
@@ -0,0 +1,141 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ExtensionUserMetadata is the header extension holding user metadata
+// ("META"). QEMU ignores it, and keeps it when it rewrites the header.
+const ExtensionUserMetadata = 0x4d455441
+
+// Limits on user metadata. The encoded extension must also fit in the
+// header cluster alongside the other extensions and the backing file name.
+const (
+	MaxMetadataKeyLen = 255  // Longest key in bytes
+	MaxMetadataSize   = 4096 // Largest encoded extension in bytes
+)
+
+// encodeMetadata encodes entries as the user metadata extension: for each
+// key, in sorted order, a big-endian 16-bit key length and value length
+// followed by the key and value bytes.
+func encodeMetadata(entries map[string]string) []byte {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var data []byte
+	for _, k := range keys {
+		v := entries[k]
+		data = binary.BigEndian.AppendUint16(data, uint16(len(k)))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(v)))
+		data = append(data, k...)
+		data = append(data, v...)
+	}
+	return data
+}
+
+// parseMetadata decodes the user metadata extension.
+func parseMetadata(data []byte) (map[string]string, error) {
+	entries := make(map[string]string)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("%w: truncated entry", ErrInvalidMetadata)
+		}
+		keyLen := int(binary.BigEndian.Uint16(data[0:2]))
+		valueLen := int(binary.BigEndian.Uint16(data[2:4]))
+		data = data[4:]
+		if keyLen == 0 || keyLen+valueLen > len(data) {
+			return nil, fmt.Errorf("%w: bad entry lengths", ErrInvalidMetadata)
+		}
+		entries[string(data[:keyLen])] = string(data[keyLen : keyLen+valueLen])
+		data = data[keyLen+valueLen:]
+	}
+	return entries, nil
+}
+
+// Metadata returns a copy of the user metadata stored in the image, or an
+// empty map if there is none.
+func (img *Image) Metadata() map[string]string {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	return img.copyMetadata()
+}
+
+// GetMetadata returns the user metadata value stored under key.
+func (img *Image) GetMetadata(key string) (string, bool) {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	if img.extensions == nil {
+		return "", false
+	}
+	v, ok := img.extensions.Metadata[key]
+	return v, ok
+}
+
+// SetMetadata stores a user metadata value under key, replacing any value
+// already there, so provisioning systems can stamp an image ID or version
+// into the file. Keys are 1 to MaxMetadataKeyLen bytes. It fails with
+// ErrMetadataTooLarge if the encoded metadata would exceed MaxMetadataSize,
+// and with an error if it does not fit in the header cluster. User metadata
+// needs a version 3 image.
+func (img *Image) SetMetadata(key, value string) error {
+	if key == "" || len(key) > MaxMetadataKeyLen {
+		return fmt.Errorf("%w: key must be 1 to %d bytes", ErrInvalidMetadata, MaxMetadataKeyLen)
+	}
+	return img.updateMetadata(func(entries map[string]string) {
+		entries[key] = value
+	})
+}
+
+// DeleteMetadata removes the user metadata value stored under key. The
+// extension is removed along with the last key.
+func (img *Image) DeleteMetadata(key string) error {
+	return img.updateMetadata(func(entries map[string]string) {
+		delete(entries, key)
+	})
+}
+
+// updateMetadata applies change to a copy of the metadata and writes the
+// result to the header.
+func (img *Image) updateMetadata(change func(map[string]string)) error {
+	if img.readOnly {
+		return ErrReadOnly
+	}
+	if img.closed.Load() {
+		return ErrClosed
+	}
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	entries := img.copyMetadata()
+	change(entries)
+
+	var data []byte
+	if len(entries) > 0 {
+		data = encodeMetadata(entries)
+		if len(data) > MaxMetadataSize {
+			return fmt.Errorf("%w: %d bytes, limit is %d", ErrMetadataTooLarge, len(data), MaxMetadataSize)
+		}
+	}
+	if err := img.setHeaderExtension(ExtensionUserMetadata, data); err != nil {
+		return err
+	}
+	img.extensions.Metadata = entries
+	return nil
+}
+
+// copyMetadata returns a copy of the user metadata. The caller holds
+// writeMu.
+func (img *Image) copyMetadata() map[string]string {
+	entries := make(map[string]string)
+	if img.extensions != nil {
+		for k, v := range img.extensions.Metadata {
+			entries[k] = v
+		}
+	}
+	return entries
+}
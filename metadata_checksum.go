@@ -0,0 +1,410 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Metadata checksum sidecar layout:
+//
+//	Offset  Size  Description
+//	0       8     Magic "QCOWMCRC"
+//	8       4     Version (1)
+//	12      4     Cluster bits of the image the sidecar belongs to
+//	16      4     Flags (bit 0: dirty)
+//	20      4     Reserved
+//	24      8     Number of entries
+//	32      32    Reserved
+//	64      ...   Entries, sorted by host offset
+//
+// Each entry is 16 bytes: the host offset of a metadata cluster, its CRC-32C
+// and 4 reserved bytes. The dirty flag is set before the first write to the
+// image after a commit and cleared once the entries are up to date again;
+// a sidecar found dirty on open is rebuilt from the image.
+const (
+	metaChecksumMagic      = "QCOWMCRC"
+	metaChecksumVersion    = 1
+	metaChecksumHeaderSize = 64
+	metaChecksumEntrySize  = 16
+	metaChecksumFlagDirty  = uint32(1) << 0
+)
+
+// metadataChecksums holds the CRCs of the image's L1 tables, L2 tables,
+// refcount table and refcount blocks in memory, backed by a sidecar file.
+type metadataChecksums struct {
+	f           *os.File
+	clusterBits uint32
+	readOnly    bool
+
+	mu          sync.Mutex
+	sums        map[uint64]uint32   // host cluster offset -> CRC-32C
+	written     map[uint64]struct{} // host clusters written since the last commit
+	dirtyOnDisk bool                // dirty flag as last written to the sidecar
+	trusted     bool                // sums came from a cleanly committed sidecar
+}
+
+// openMetadataChecksums opens (or, for writable images, creates) a metadata
+// checksum sidecar.
+func openMetadataChecksums(path string, clusterBits uint32, readOnly bool) (*metadataChecksums, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to open metadata checksum file: %w", err)
+	}
+
+	s := &metadataChecksums{
+		f:           f,
+		clusterBits: clusterBits,
+		readOnly:    readOnly,
+		sums:        make(map[uint64]uint32),
+		written:     make(map[uint64]struct{}),
+	}
+
+	hdr := make([]byte, metaChecksumHeaderSize)
+	n, err := f.ReadAt(hdr, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, fmt.Errorf("qcow2: failed to read metadata checksum header: %w", err)
+	}
+
+	if n == 0 && !readOnly {
+		// New sidecar: nothing recorded yet, so the image builds it
+		if err := s.writeHeader(0, true); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
+	if n < metaChecksumHeaderSize || string(hdr[0:8]) != metaChecksumMagic {
+		f.Close()
+		return nil, fmt.Errorf("qcow2: %s is not a metadata checksum file", path)
+	}
+	if v := binary.BigEndian.Uint32(hdr[8:12]); v != metaChecksumVersion {
+		f.Close()
+		return nil, fmt.Errorf("qcow2: unsupported metadata checksum file version %d", v)
+	}
+	if bits := binary.BigEndian.Uint32(hdr[12:16]); bits != clusterBits {
+		f.Close()
+		return nil, fmt.Errorf("qcow2: metadata checksum file cluster bits %d do not match image (%d)", bits, clusterBits)
+	}
+	if binary.BigEndian.Uint32(hdr[16:20])&metaChecksumFlagDirty != 0 {
+		// Not cleanly committed; the recorded sums cannot be trusted
+		s.dirtyOnDisk = true
+		return s, nil
+	}
+
+	count := binary.BigEndian.Uint64(hdr[24:32])
+	entries := make([]byte, count*metaChecksumEntrySize)
+	if _, err := f.ReadAt(entries, metaChecksumHeaderSize); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("qcow2: failed to read metadata checksums: %w", err)
+	}
+	for i := uint64(0); i < count; i++ {
+		e := entries[i*metaChecksumEntrySize:]
+		s.sums[binary.BigEndian.Uint64(e[0:8])] = binary.BigEndian.Uint32(e[8:12])
+	}
+	s.trusted = true
+	return s, nil
+}
+
+// writeHeader writes the sidecar header and syncs it.
+func (s *metadataChecksums) writeHeader(count uint64, dirty bool) error {
+	hdr := make([]byte, metaChecksumHeaderSize)
+	copy(hdr[0:8], metaChecksumMagic)
+	binary.BigEndian.PutUint32(hdr[8:12], metaChecksumVersion)
+	binary.BigEndian.PutUint32(hdr[12:16], s.clusterBits)
+	if dirty {
+		binary.BigEndian.PutUint32(hdr[16:20], metaChecksumFlagDirty)
+	}
+	binary.BigEndian.PutUint64(hdr[24:32], count)
+	if _, err := s.f.WriteAt(hdr, 0); err != nil {
+		return fmt.Errorf("qcow2: failed to write metadata checksum header: %w", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("qcow2: failed to sync metadata checksum file: %w", err)
+	}
+	s.dirtyOnDisk = dirty
+	return nil
+}
+
+// markWritten records that [off, off+n) of the image file is about to be
+// written, setting the dirty flag on disk first if it is clear. The header
+// cluster holds no covered metadata, so writes to it are not tracked.
+func (s *metadataChecksums) markWritten(off, n int64) error {
+	mask := uint64(1)<<s.clusterBits - 1
+	if n <= 0 || uint64(off+n) <= mask+1 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirtyOnDisk {
+		if err := s.writeHeader(uint64(len(s.sums)), true); err != nil {
+			return err
+		}
+	}
+	for c := uint64(off) &^ mask; c < uint64(off+n); c += mask + 1 {
+		s.written[c] = struct{}{}
+	}
+	return nil
+}
+
+// verify checks a cluster just read from disk against its recorded CRC.
+// Clusters without one, or written since the last commit, pass.
+func (s *metadataChecksums) verify(hostOff uint64, data []byte) error {
+	s.mu.Lock()
+	expected, ok := s.sums[hostOff]
+	if _, written := s.written[hostOff]; written {
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if actual := crc32.Checksum(data, crc32cTable); actual != expected {
+		return &ChecksumError{HostOffset: hostOff, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+func (s *metadataChecksums) close() error {
+	return s.f.Close()
+}
+
+// metadataTrackingFile reports every write to the image file to the
+// metadata checksums before passing it on.
+type metadataTrackingFile struct {
+	File
+	sums *metadataChecksums
+}
+
+func (f *metadataTrackingFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.sums.markWritten(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// metadataTrackingFdFile is a metadataTrackingFile over a file with a
+// descriptor, which hole punching and mmap need.
+type metadataTrackingFdFile struct {
+	*metadataTrackingFile
+	fd fdFile
+}
+
+func (f *metadataTrackingFdFile) Fd() uintptr {
+	return f.fd.Fd()
+}
+
+// trackMetadataWrites wraps f so writes through it are tracked by sums.
+func trackMetadataWrites(f File, sums *metadataChecksums) File {
+	tf := &metadataTrackingFile{File: f, sums: sums}
+	if fd, ok := f.(fdFile); ok {
+		return &metadataTrackingFdFile{metadataTrackingFile: tf, fd: fd}
+	}
+	return tf
+}
+
+// metadataClusterSet returns the host offsets of every L1 table, L2 table,
+// refcount table and refcount block cluster, including those of snapshots.
+func (img *Image) metadataClusterSet() (map[uint64]struct{}, error) {
+	set := make(map[uint64]struct{})
+	addRange := func(off, size uint64) {
+		for c := off &^ img.offsetMask; c < off+size; c += img.clusterSize {
+			set[c] = struct{}{}
+		}
+	}
+	addL2Tables := func(l1Table []byte) {
+		for i := 0; i+8 <= len(l1Table); i += 8 {
+			if off := binary.BigEndian.Uint64(l1Table[i:]) & L1EntryOffsetMask; off != 0 {
+				set[off] = struct{}{}
+			}
+		}
+	}
+
+	addRange(img.header.L1TableOffset, uint64(img.header.L1Size)*8)
+	if err := img.faultAllL1(); err != nil {
+		return nil, err
+	}
+	img.l1Mu.RLock()
+	addL2Tables(img.l1Table)
+	img.l1Mu.RUnlock()
+
+	if err := img.loadRefcountTable(); err != nil {
+		return nil, err
+	}
+	addRange(img.header.RefcountTableOffset, uint64(img.header.RefcountTableClusters)*img.clusterSize)
+	img.refcountTableLock.RLock()
+	for i := 0; i+8 <= len(img.refcountTable); i += 8 {
+		if off := binary.BigEndian.Uint64(img.refcountTable[i:]) &^ img.offsetMask; off != 0 {
+			set[off] = struct{}{}
+		}
+	}
+	img.refcountTableLock.RUnlock()
+
+	for _, snap := range img.snapshots {
+		addRange(snap.L1TableOffset, uint64(snap.L1Size)*8)
+		l1Table, err := img.snapshotL1Table(snap)
+		if err != nil {
+			return nil, err
+		}
+		addL2Tables(l1Table)
+	}
+	return set, nil
+}
+
+// readMetadataCRC returns the CRC-32C of the host cluster at off.
+func (img *Image) readMetadataCRC(off uint64, buf []byte) (uint32, error) {
+	n, err := img.file.ReadAt(buf, int64(off))
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("qcow2: failed to read metadata cluster at 0x%x: %w", off, err)
+	}
+	clear(buf[n:])
+	return crc32.Checksum(buf, crc32cTable), nil
+}
+
+// initMetadataChecksums runs at the end of open. A sidecar that was cleanly
+// committed has the L1 table and refcount table checked against it; L2
+// tables and refcount blocks are checked as they are loaded. Otherwise the
+// sums are rebuilt from the image as it is now.
+func (img *Image) initMetadataChecksums() error {
+	s := img.metaChecksums
+	if !s.trusted {
+		if s.readOnly {
+			return nil
+		}
+		// Mark every metadata cluster as written so the commit
+		// recomputes it
+		set, err := img.metadataClusterSet()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		clear(s.sums)
+		for off := range set {
+			s.written[off] = struct{}{}
+		}
+		s.mu.Unlock()
+		return img.commitMetadataChecksumsLocked()
+	}
+
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	check := func(off, size uint64) error {
+		for c := off &^ img.offsetMask; c < off+size; c += img.clusterSize {
+			if _, err := img.file.ReadAt(buf, int64(c)); err != nil && err != io.EOF {
+				return fmt.Errorf("qcow2: failed to read metadata cluster at 0x%x: %w", c, err)
+			}
+			if err := s.verify(c, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := check(img.header.L1TableOffset, uint64(img.header.L1Size)*8); err != nil {
+		return fmt.Errorf("qcow2: L1 table: %w", err)
+	}
+	if err := check(img.header.RefcountTableOffset, uint64(img.header.RefcountTableClusters)*img.clusterSize); err != nil {
+		return fmt.Errorf("qcow2: refcount table: %w", err)
+	}
+	return nil
+}
+
+// verifyMetadata checks an L2 table or refcount block read from disk at
+// hostOff against the metadata checksums, if they are enabled.
+func (img *Image) verifyMetadata(hostOff uint64, data []byte) error {
+	if img.metaChecksums == nil {
+		return nil
+	}
+	return img.metaChecksums.verify(hostOff, data)
+}
+
+// commitMetadataChecksums brings the sidecar up to date with the image
+// file.
+func (img *Image) commitMetadataChecksums() error {
+	if img.metaChecksums == nil || img.readOnly {
+		return nil
+	}
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	return img.commitMetadataChecksumsLocked()
+}
+
+// commitMetadataChecksumsLocked is commitMetadataChecksums for callers
+// holding writeMu. Clusters written since the last commit get a fresh CRC
+// if they are metadata and lose it otherwise; the dirty flag is cleared
+// unless more writes came in meanwhile.
+func (img *Image) commitMetadataChecksumsLocked() error {
+	s := img.metaChecksums
+	s.mu.Lock()
+	written := s.written
+	s.written = make(map[uint64]struct{})
+	dirty := s.dirtyOnDisk
+	s.mu.Unlock()
+	if len(written) == 0 && !dirty {
+		return nil
+	}
+
+	// The recorded sums must never be ahead of the image on disk
+	if err := img.file.Sync(); err != nil {
+		return err
+	}
+
+	set, err := img.metadataClusterSet()
+	if err != nil {
+		return err
+	}
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	fresh := make(map[uint64]uint32, len(written))
+	for off := range written {
+		if _, ok := set[off]; !ok {
+			continue
+		}
+		sum, err := img.readMetadataCRC(off, buf)
+		if err != nil {
+			return err
+		}
+		fresh[off] = sum
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for off := range written {
+		if sum, ok := fresh[off]; ok {
+			s.sums[off] = sum
+		} else {
+			delete(s.sums, off)
+		}
+	}
+
+	offs := make([]uint64, 0, len(s.sums))
+	for off := range s.sums {
+		offs = append(offs, off)
+	}
+	slices.Sort(offs)
+	entries := make([]byte, len(offs)*metaChecksumEntrySize)
+	for i, off := range offs {
+		e := entries[i*metaChecksumEntrySize:]
+		binary.BigEndian.PutUint64(e[0:8], off)
+		binary.BigEndian.PutUint32(e[8:12], s.sums[off])
+	}
+	if _, err := s.f.WriteAt(entries, metaChecksumHeaderSize); err != nil {
+		return fmt.Errorf("qcow2: failed to write metadata checksums: %w", err)
+	}
+	if err := s.f.Truncate(int64(metaChecksumHeaderSize + len(entries))); err != nil {
+		return fmt.Errorf("qcow2: failed to write metadata checksums: %w", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("qcow2: failed to sync metadata checksum file: %w", err)
+	}
+	return s.writeHeader(uint64(len(offs)), len(s.written) > 0)
+}
@@ -0,0 +1,190 @@
+// metadata_checksum_test.go - Metadata checksum sidecar tests
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// createMetaChecksumImage creates an image with 4KB clusters, so a few
+// megabytes of writes span several L2 tables, and returns its path and the
+// path of its metadata checksum sidecar.
+func createMetaChecksumImage(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "meta.qcow2")
+	img, err := Create(path, CreateOptions{Size: 64 * 1024 * 1024, ClusterBits: 12})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+	return path, filepath.Join(dir, "meta.qcow2.mcrc")
+}
+
+// corruptAt overwrites one byte of the file at path.
+func corruptAt(t *testing.T, path string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], off); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b[:], off); err != nil {
+		t.Fatalf("corrupt write failed: %v", err)
+	}
+}
+
+// TestMetadataChecksumsRoundTrip runs writes, a snapshot and copy-on-write
+// of shared tables through the sidecar and verifies nothing is reported.
+func TestMetadataChecksumsRoundTrip(t *testing.T) {
+	t.Parallel()
+	path, sidecar := createMetaChecksumImage(t)
+
+	img, err := Open(path, WithMetadataChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data := testutil.RandomBytes(1, 4*1024*1024)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0x5a}, 8192), 2*1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(data[2*1024*1024:], bytes.Repeat([]byte{0x5a}, 8192))
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	img, err = OpenFile(path, os.O_RDONLY, 0, WithMetadataChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer img.Close()
+	if !img.metaChecksums.trusted || len(img.metaChecksums.sums) == 0 {
+		t.Fatal("sidecar was not committed on close")
+	}
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data mismatch")
+	}
+	if _, err := img.ClusterRefcount(img.header.L1TableOffset); err != nil {
+		t.Errorf("ClusterRefcount failed: %v", err)
+	}
+}
+
+// TestMetadataChecksumsDetectCorruption flips bytes in an L2 table and in
+// the L1 table behind the library's back.
+func TestMetadataChecksumsDetectCorruption(t *testing.T) {
+	t.Parallel()
+	path, sidecar := createMetaChecksumImage(t)
+
+	img, err := Open(path, WithMetadataChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := img.WriteAt(testutil.RandomBytes(2, 8192), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	l1Off := img.header.L1TableOffset
+	l2Off := binary.BigEndian.Uint64(img.l1Table) & L1EntryOffsetMask
+	img.Close()
+
+	// An unused entry, so the image still reads fine without the sidecar
+	corruptAt(t, path, int64(l2Off)+int64(img.clusterSize)-1)
+
+	img, err = Open(path, WithMetadataChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	buf := make([]byte, 512)
+	_, err = img.ReadAt(buf, 0)
+	var csErr *ChecksumError
+	if !errors.As(err, &csErr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ChecksumError, got %v", err)
+	}
+	if csErr.HostOffset != l2Off {
+		t.Errorf("HostOffset = 0x%x, want 0x%x", csErr.HostOffset, l2Off)
+	}
+	img.Close()
+
+	plain, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open without sidecar failed: %v", err)
+	}
+	if _, err := plain.ReadAt(buf, 0); err != nil {
+		t.Errorf("ReadAt without sidecar failed: %v", err)
+	}
+	plain.Close()
+
+	corruptAt(t, path, int64(l1Off)+int64(img.clusterSize)-1)
+	if _, err := Open(path, WithMetadataChecksumFile(sidecar)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Open with corrupt L1 table: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+// TestMetadataChecksumsRebuildAfterUncleanClose verifies a sidecar left
+// dirty is rebuilt on the next writable open instead of reporting stale
+// sums.
+func TestMetadataChecksumsRebuildAfterUncleanClose(t *testing.T) {
+	t.Parallel()
+	path, sidecar := createMetaChecksumImage(t)
+
+	img, err := Open(path, WithMetadataChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	img.Close()
+
+	// Write through a second handle without the sidecar, then mark the
+	// sidecar dirty as a crash mid-write would leave it
+	plain, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := plain.WriteAt(testutil.RandomBytes(3, 8192), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	plain.Close()
+	f, err := os.OpenFile(sidecar, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	var flags [4]byte
+	binary.BigEndian.PutUint32(flags[:], metaChecksumFlagDirty)
+	if _, err := f.WriteAt(flags[:], 16); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	f.Close()
+
+	img, err = Open(path, WithMetadataChecksumFile(sidecar))
+	if err != nil {
+		t.Fatalf("Open after unclean close failed: %v", err)
+	}
+	defer img.Close()
+	if img.metaChecksums.dirtyOnDisk {
+		t.Error("sidecar still dirty after rebuild")
+	}
+	buf := make([]byte, 8192)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Errorf("ReadAt failed: %v", err)
+	}
+}
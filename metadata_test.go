@@ -0,0 +1,126 @@
+// metadata_test.go - User metadata extension tests
+
+package qcow2
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMetadata checks metadata round-trips through the header of an
+// overlay without disturbing its backing file name.
+func TestMetadata(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	path := filepath.Join(dir, "overlay.qcow2")
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	base.Close()
+	img, err := CreateOverlay(path, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	if len(img.Metadata()) != 0 {
+		t.Errorf("new image has metadata %v", img.Metadata())
+	}
+	for k, v := range map[string]string{"image-id": "4f1c2a", "version": "1", "empty": ""} {
+		if err := img.SetMetadata(k, v); err != nil {
+			t.Fatalf("SetMetadata(%q) failed: %v", k, err)
+		}
+	}
+	if err := img.SetMetadata("version", "2"); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+	if err := img.DeleteMetadata("empty"); err != nil {
+		t.Fatalf("DeleteMetadata failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if v, ok := img.GetMetadata("image-id"); !ok || v != "4f1c2a" {
+		t.Errorf("image-id = %q, %v", v, ok)
+	}
+	if v, _ := img.GetMetadata("version"); v != "2" {
+		t.Errorf("version = %q, want 2", v)
+	}
+	if _, ok := img.GetMetadata("empty"); ok {
+		t.Error("deleted key still present")
+	}
+	if len(img.Metadata()) != 2 {
+		t.Errorf("Metadata = %v, want two keys", img.Metadata())
+	}
+	if img.BackingFile() != basePath {
+		t.Errorf("backing file = %q, want %q", img.BackingFile(), basePath)
+	}
+
+	// Deleting every key removes the extension
+	img.DeleteMetadata("image-id")
+	img.DeleteMetadata("version")
+	for _, ext := range img.Extensions().Unknown {
+		if ext.Type == ExtensionUserMetadata {
+			t.Error("metadata extension parsed as unknown")
+		}
+	}
+	ext, err := img.parseHeaderExtensions()
+	if err != nil {
+		t.Fatalf("parseHeaderExtensions failed: %v", err)
+	}
+	if ext.Metadata != nil {
+		t.Errorf("metadata extension left behind: %v", ext.Metadata)
+	}
+}
+
+// TestMetadataLimits checks bad keys, oversized metadata, version 2 images
+// and read-only images are refused.
+func TestMetadataLimits(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	img, err := CreateSimple(filepath.Join(dir, "img.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	if err := img.SetMetadata("", "x"); !errors.Is(err, ErrInvalidMetadata) {
+		t.Errorf("empty key: got %v, want ErrInvalidMetadata", err)
+	}
+	if err := img.SetMetadata(strings.Repeat("k", MaxMetadataKeyLen+1), "x"); !errors.Is(err, ErrInvalidMetadata) {
+		t.Errorf("long key: got %v, want ErrInvalidMetadata", err)
+	}
+	if err := img.SetMetadata("big", strings.Repeat("v", MaxMetadataSize)); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Errorf("big value: got %v, want ErrMetadataTooLarge", err)
+	}
+	if len(img.Metadata()) != 0 {
+		t.Errorf("failed sets left metadata %v", img.Metadata())
+	}
+
+	v2Path := filepath.Join(dir, "v2.qcow2")
+	v2, err := Create(v2Path, CreateOptions{Size: 1024 * 1024, Version: Version2})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := v2.SetMetadata("id", "1"); err == nil {
+		t.Error("SetMetadata on a version 2 image succeeded")
+	}
+	v2.Close()
+
+	ro, err := OpenFile(v2Path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer ro.Close()
+	if err := ro.SetMetadata("id", "1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only: got %v, want ErrReadOnly", err)
+	}
+}
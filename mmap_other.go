@@ -0,0 +1,12 @@
+//go:build !unix
+
+package qcow2
+
+// mmapFile is not supported on this platform; reads use ReadAt.
+func mmapFile(f File) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,86 @@
+// mmap_test.go - Memory-mapped read tests
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestMmapReadsMatch verifies mmap-backed reads return the same data as
+// regular reads, across allocated, zero, compressed, and unallocated
+// clusters.
+func TestMmapReadsMatch(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "mmap.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(testutil.RandomBytes(1, 5*cs+100), 1000); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(int64(8*cs), int64(cs)); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte("abcd"), cs/4), int64(10*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	img.Close()
+
+	want := readAll(t, path)
+
+	mapped, err := OpenFile(path, os.O_RDONLY, 0, WithMmap())
+	if err != nil {
+		t.Fatalf("OpenFile with mmap failed: %v", err)
+	}
+	defer mapped.Close()
+	if runtime.GOOS == "linux" && mapped.mmapData == nil {
+		t.Fatal("expected image to be mapped")
+	}
+
+	got := make([]byte, mapped.Size())
+	if _, err := mapped.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("mmap reads differ from regular reads")
+	}
+
+	// Unaligned small reads
+	buf := make([]byte, 777)
+	if _, err := mapped.ReadAt(buf, int64(cs-300)); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, want[cs-300:cs-300+777]) {
+		t.Error("unaligned mmap read differs")
+	}
+}
+
+// TestMmapIgnoredForWritable verifies writable images are never mapped.
+func TestMmapIgnoredForWritable(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "rw.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithMmap())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	if img.mmapData != nil {
+		t.Error("writable image should not be mapped")
+	}
+}
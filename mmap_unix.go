@@ -0,0 +1,27 @@
+//go:build unix
+
+package qcow2
+
+import "syscall"
+
+// mmapFile maps the whole of f read-only. It returns nil if f is not backed
+// by a file descriptor or is empty.
+func mmapFile(f File) ([]byte, error) {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return nil, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, nil
+	}
+	return syscall.Mmap(int(fd.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,91 @@
+// multiwrite_test.go - Batched write tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestMultiWriteAt verifies overlapping requests resolve in submission
+// order, adjacent ones are merged, and the batch syncs once.
+func TestMultiWriteAt(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "batch.qcow2")
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, ff := openFaulty(t, path)
+	defer img.Close()
+	cs := int64(img.ClusterSize())
+
+	reqs := []WriteRequest{
+		{Off: 5 * cs, Data: testutil.RandomBytes(1, int(cs))},
+		{Off: 0, Data: testutil.RandomBytes(2, int(2*cs))},
+		{Off: 2 * cs, Data: testutil.RandomBytes(3, int(cs))},
+		{Off: 100, Data: bytes.Repeat([]byte{0xee}, 50)},     // Overwrites part of request 1
+		{Off: 5*cs + 10, Data: []byte("later wins")},         // Overwrites part of request 0
+		{Off: 8 * cs, Data: nil},                             // Empty requests are skipped
+		{Off: 3*cs - 4, Data: bytes.Repeat([]byte{0x11}, 8)}, // Overlaps the end of request 2
+	}
+	want := make([]byte, 9*cs)
+	for _, r := range reqs {
+		copy(want[r.Off:], r.Data)
+	}
+
+	syncs := ff.Calls(testutil.OpSync)
+	if err := img.MultiWriteAt(reqs); err != nil {
+		t.Fatalf("MultiWriteAt failed: %v", err)
+	}
+	// Each allocating write keeps its metadata barrier
+	if got := ff.Calls(testutil.OpSync) - syncs; got < 3 {
+		t.Errorf("batch issued %d syncs, want a metadata barrier per allocating write and one at the end", got)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("data mismatch")
+	}
+
+	// Clusters 0-2 were merged into one run and allocated together
+	first, _ := img.translate(0)
+	third, _ := img.translate(uint64(2 * cs))
+	if third.physOff != first.physOff+uint64(2*cs) {
+		t.Errorf("merged run not contiguous: 0x%x, 0x%x", first.physOff, third.physOff)
+	}
+
+	// Overwrites need no metadata barriers, and their data barriers are
+	// deferred to the one at the end
+	img.SetWriteBarrierMode(BarrierFull)
+	syncs = ff.Calls(testutil.OpSync)
+	if err := img.MultiWriteAt([]WriteRequest{
+		{Off: 0, Data: want[:cs]},
+		{Off: 2 * cs, Data: want[2*cs : 3*cs]},
+		{Off: 5 * cs, Data: want[5*cs : 6*cs]},
+	}); err != nil {
+		t.Fatalf("MultiWriteAt failed: %v", err)
+	}
+	if got := ff.Calls(testutil.OpSync) - syncs; got != 1 {
+		t.Errorf("overwrite batch issued %d syncs, want 1", got)
+	}
+	img.SetWriteBarrierMode(BarrierMetadata)
+
+	if err := img.MultiWriteAt([]WriteRequest{
+		{Off: 0, Data: []byte("ok")},
+		{Off: img.Size() - 1, Data: []byte("xx")},
+	}); err != ErrOffsetOutOfRange {
+		t.Errorf("out of range batch: got %v, want ErrOffsetOutOfRange", err)
+	}
+	if _, err := img.ReadAt(got[:2], 0); err != nil || !bytes.Equal(got[:2], want[:2]) {
+		t.Error("rejected batch was partially applied")
+	}
+}
@@ -0,0 +1,36 @@
+package qcow2
+
+import (
+	"time"
+)
+
+// OpenStats records where the time went while an image was opened, to
+// find what makes opening slow: a huge L1 table, a refcount rebuild after
+// an unclean shutdown with lazy refcounts, many snapshots or a deep
+// backing chain. Phases with nothing to do take next to no time.
+type OpenStats struct {
+	Header          time.Duration // Reading, parsing and validating the header
+	L1Table         time.Duration // Loading the L1 table
+	RefcountRebuild time.Duration // Rebuilding lazy refcounts of a dirty image
+	Unlock          time.Duration // Deriving the LUKS key from a passphrase
+	Snapshots       time.Duration // Loading the snapshot table
+	Backing         time.Duration // Opening the whole backing chain
+	Total           time.Duration // The whole open
+
+	// BackingStats are the stats of the qcow2 backing file, nil without
+	// one.
+	BackingStats *OpenStats
+}
+
+// OpenStats returns the time spent in each phase of opening the image.
+func (img *Image) OpenStats() OpenStats {
+	return img.openStats
+}
+
+// timePhase adds the time since start to *phase and returns the current
+// time, to start the next phase from.
+func timePhase(phase *time.Duration, start time.Time) time.Time {
+	now := time.Now()
+	*phase += now.Sub(start)
+	return now
+}
@@ -0,0 +1,56 @@
+// openstats_test.go - Open timing tests
+
+package qcow2
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenStats checks OpenWithOptions reports the open phases, including
+// those of the backing file.
+func TestOpenStats(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.qcow2")
+	overlay := filepath.Join(dir, "overlay.qcow2")
+
+	img, err := CreateSimple(base, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+	img, err = CreateOverlay(overlay, base)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	img.Close()
+
+	var stats OpenStats
+	v2, err := OpenWithOptions(overlay, OpenOptionsV2{ReadOnly: true, Stats: &stats})
+	if err != nil {
+		t.Fatalf("OpenWithOptions failed: %v", err)
+	}
+	defer v2.Close()
+
+	if stats != v2.(*Image).OpenStats() {
+		t.Error("Stats differ from Image.OpenStats")
+	}
+	if stats.Total <= 0 {
+		t.Errorf("Total = %v, want > 0", stats.Total)
+	}
+	sum := stats.Header + stats.L1Table + stats.RefcountRebuild + stats.Unlock +
+		stats.Snapshots + stats.Backing
+	if sum > stats.Total {
+		t.Errorf("phases add up to %v, more than Total %v", sum, stats.Total)
+	}
+	if stats.BackingStats == nil {
+		t.Fatal("BackingStats is nil for an overlay")
+	}
+	if stats.BackingStats.Total > stats.Backing {
+		t.Errorf("backing Total %v exceeds Backing %v", stats.BackingStats.Total, stats.Backing)
+	}
+	if stats.BackingStats.BackingStats != nil {
+		t.Errorf("base image reports a backing file: %+v", stats.BackingStats)
+	}
+}
@@ -1,5 +1,10 @@
 package qcow2
 
+import (
+	"crypto/ed25519"
+	"time"
+)
+
 // Default cache sizes
 const (
 	// DefaultL2CacheSize is the default number of L2 table entries to cache.
@@ -19,8 +24,41 @@ type Option func(*imageOptions)
 // imageOptions holds configuration for opening an image.
 type imageOptions struct {
 	l2CacheSize         int
+	l2CacheShards       int
 	compressedCacheSize int
 	refcountCacheSize   int
+	refcountWriteback   bool
+	reusePolicy         ClusterReusePolicy
+	dataCacheSize       int
+	checksumPath        string
+	maxAllocation       uint64
+	maxVirtualSize      uint64
+	fileWrapper         func(File) File
+	mmap                bool
+	backingRetry        *BackingRetryPolicy
+	ioRetry             *IORetryPolicy
+	backingStore        BackingStore
+	delayedAllocation   uint64
+	writerGoroutine     bool
+	writeRangeLocking   bool
+	priorityScheduling  bool
+	priorityMaxWait     time.Duration
+	events              Events
+	trimOnClose         bool
+	fileAdvice          FileAdvice
+	autoGrow            uint64
+	autoGrowEnabled     bool
+	lazyL1              bool
+	refcountVerifier    *RefcountVerifierOptions
+	forensic            func(ForensicWarning)
+	metaChecksumPath    string
+	ioAlignment         int
+	keyProvider         KeyProvider
+	compatLevel         CompatLevel
+	zstdFrameSize       int
+	readOnly            bool
+	signature           *Signature
+	signatureKey        ed25519.PublicKey
 }
 
 // defaultImageOptions returns the default configuration.
@@ -29,6 +67,7 @@ func defaultImageOptions() *imageOptions {
 		l2CacheSize:         DefaultL2CacheSize,
 		compressedCacheSize: DefaultCompressedCacheSize,
 		refcountCacheSize:   DefaultRefcountCacheSize,
+		maxVirtualSize:      DefaultMaxVirtualSize,
 	}
 }
 
@@ -38,15 +77,29 @@ func defaultImageOptions() *imageOptions {
 // covering 16GB of virtual address space.
 //
 // Larger values improve performance for sequential access patterns
-// and reduce disk I/O, but consume more memory.
+// and reduce disk I/O, but consume more memory. 0 disables the cache, so
+// every lookup reads the L2 table from disk.
 func WithL2CacheSize(size int) Option {
 	return func(o *imageOptions) {
-		if size > 0 {
+		if size >= 0 {
 			o.l2CacheSize = size
 		}
 	}
 }
 
+// WithL2CacheShards sets how many independently locked shards the L2
+// cache is split into; it is rounded up to a power of two. More shards
+// let concurrent readers of different tables proceed in parallel, at the
+// cost of a less exact LRU, since each shard gets an equal part of the
+// cache size and at least one entry. The default is 8.
+func WithL2CacheShards(shards int) Option {
+	return func(o *imageOptions) {
+		if shards > 0 {
+			o.l2CacheShards = shards
+		}
+	}
+}
+
 // WithCompressedCacheSize sets the number of decompressed clusters to cache.
 // Compressed clusters must be fully decompressed before reading any part,
 // so caching them avoids repeated decompression overhead.
@@ -61,15 +114,414 @@ func WithCompressedCacheSize(size int) Option {
 	}
 }
 
+// WithDataCacheSize sets the number of uncompressed data clusters to cache.
+// Reads of a cached cluster are served from memory, which pays off when the
+// image lives on high-latency storage such as a network filesystem and the
+// workload keeps returning to the same hot clusters. Writes, discards and
+// reallocation drop the affected clusters, so the cache never returns stale
+// data.
+//
+// Encrypted images and images read through WithMmap are not cached.
+// 0 (the default) disables the cache.
+func WithDataCacheSize(size int) Option {
+	return func(o *imageOptions) {
+		if size >= 0 {
+			o.dataCacheSize = size
+		}
+	}
+}
+
 // WithRefcountCacheSize sets the number of refcount block entries to cache.
 // Each refcount block is one cluster in size.
 // Refcount lookups occur during allocation and deallocation.
 //
-// Larger values reduce disk I/O during heavy write workloads.
+// Larger values reduce disk I/O during heavy write workloads; 0 disables
+// the cache.
 func WithRefcountCacheSize(size int) Option {
 	return func(o *imageOptions) {
-		if size > 0 {
+		if size >= 0 {
 			o.refcountCacheSize = size
 		}
 	}
 }
+
+// WithClusterReusePolicy sets how freed clusters are reused for new data.
+// The default is ReuseFirstFit.
+func WithClusterReusePolicy(policy ClusterReusePolicy) Option {
+	return func(o *imageOptions) {
+		o.reusePolicy = policy
+	}
+}
+
+// WithRefcountWriteback keeps the refcount block that allocations are
+// going to in memory and writes it back when allocation moves on to
+// another block, at each metadata barrier, and on Flush and Close. The
+// barrier write-back puts refcounts on disk ahead of the L2 and L1 entries
+// pointing at their clusters, so a bulk import of large writes costs one
+// refcount block write per write instead of one per allocated cluster.
+//
+// Under BarrierNone there are no barriers, and the block is written back
+// only once per block. Refcount updates made since the last write-back are
+// then lost if the process stops without Flush or Close, leaving clusters
+// in use with a refcount of 0. Run Repair on such an image before writing
+// to it again.
+func WithRefcountWriteback() Option {
+	return func(o *imageOptions) {
+		o.refcountWriteback = true
+	}
+}
+
+// WithChecksumFile attaches a per-cluster checksum sidecar at path.
+// Every data cluster written through WriteAt gets a CRC-32C recorded in the
+// sidecar, and ReadAt verifies clusters against it, returning a
+// *ChecksumError on mismatch. The file is created if it does not exist and
+// the image is writable.
+//
+// Clusters written before the sidecar was attached have no checksum and are
+// not verified until they are rewritten.
+func WithChecksumFile(path string) Option {
+	return func(o *imageOptions) {
+		o.checksumPath = path
+	}
+}
+
+// WithMaxAllocation caps the host space the image may occupy (the size of
+// the image file plus any external data file) at maxBytes. Writes that need
+// a new cluster beyond the cap fail with ErrQuotaExceeded; writes to
+// already-allocated clusters and reuse of freed clusters are unaffected.
+//
+// 0 means no limit.
+func WithMaxAllocation(maxBytes uint64) Option {
+	return func(o *imageOptions) {
+		o.maxAllocation = maxBytes
+	}
+}
+
+// WithMaxVirtualSize sets the largest virtual size an image may claim to
+// be opened, DefaultMaxVirtualSize by default. Larger headers fail with
+// ErrVirtualSizeLimit, and headers whose virtual size would need an L1
+// table beyond QEMU's 32MB limit fail with ErrL1TableSize. 0 disables
+// both of those checks, for images known to be genuinely that large; an L1
+// table recorded in the header as larger than 32MB is still refused. The
+// limit applies to the whole backing chain.
+//
+// Create applies no limit, so an image created beyond the default needs
+// this option to be opened again.
+func WithMaxVirtualSize(maxBytes uint64) Option {
+	return func(o *imageOptions) {
+		o.maxVirtualSize = maxBytes
+	}
+}
+
+// WithFileWrapper routes all I/O on the image file (and its external data
+// file, if any) through wrap. The wrapper receives the opened *os.File and
+// returns the File the image uses; closing the image closes the wrapper.
+//
+// This is intended for instrumentation and fault injection in tests.
+// Backing files are opened without the wrapper.
+func WithFileWrapper(wrap func(File) File) Option {
+	return func(o *imageOptions) {
+		o.fileWrapper = wrap
+	}
+}
+
+// WithMetadataChecksumFile keeps a CRC-32C of every L1 table, L2 table,
+// refcount table and refcount block cluster in a sidecar at path, so silent
+// corruption of the image's metadata is caught before it is used to find
+// guest data. The L1 and refcount tables are checked on open and L2 tables
+// and refcount blocks when they are loaded; a mismatch fails with a
+// *ChecksumError. The file is created if it does not exist and the image is
+// writable.
+//
+// The sums are brought up to date by Flush and Close. If the image was not
+// closed cleanly, or the sidecar is new, the sums are rebuilt from the
+// image on the next writable open, trusting whatever metadata it holds.
+// Read-only opens of such an image skip verification. Modifying the image
+// with other tools makes it fail verification.
+func WithMetadataChecksumFile(path string) Option {
+	return func(o *imageOptions) {
+		o.metaChecksumPath = path
+	}
+}
+
+// WithReadOnly opens the image read-only whatever the flags passed to
+// OpenFile, so a file opened read-write (or one the caller lacks a
+// read-only path to) is never modified: the header is not marked dirty,
+// lazy refcounts are not rebuilt, and every mutating method fails with
+// ErrReadOnly. The image behaves exactly as if it had been opened with
+// os.O_RDONLY, including for ReopenReadWrite, which it refuses.
+func WithReadOnly() Option {
+	return func(o *imageOptions) {
+		o.readOnly = true
+	}
+}
+
+// WithMmap memory-maps the data file of a read-only image and serves reads
+// of uncompressed, unencrypted clusters by copying straight from the
+// mapping, skipping a read syscall per request. This helps workloads that
+// issue many small reads against shared base images, such as boot storms.
+//
+// The option is ignored for writable images and on platforms without mmap.
+// The image file must not be truncated while it is mapped.
+func WithMmap() Option {
+	return func(o *imageOptions) {
+		o.mmap = true
+	}
+}
+
+// WithBackingRetry retries failed reads of the image's backing file
+// according to policy, reopening the backing file before each retry. Use
+// it for backing files on network storage that can briefly disappear.
+//
+// The policy applies to this image's own backing file only; images further
+// down the chain fail on their first error.
+func WithBackingRetry(policy BackingRetryPolicy) Option {
+	return func(o *imageOptions) {
+		o.backingRetry = &policy
+	}
+}
+
+// WithIORetry retries operations on the image file and its external data
+// file that fail with transient errors, according to policy. Without it
+// they fail on the first error.
+//
+// Whether or not a policy is set, writes that fail with ENOSPC return an
+// error wrapping ErrNoSpace, and a cluster allocated for a write that
+// could not be stored is released rather than leaked.
+func WithIORetry(policy IORetryPolicy) Option {
+	return func(o *imageOptions) {
+		o.ioRetry = &policy
+	}
+}
+
+// WithBackingStore reads unallocated clusters from store instead of the
+// backing file named in the header, whether or not the header names one.
+// The image closes store when it is closed.
+//
+// This is how an overlay created with CreateOverlayFromSnapshot is opened
+// again, since its header cannot refer to an internal snapshot.
+func WithBackingStore(store BackingStore) Option {
+	return func(o *imageOptions) {
+		o.backingStore = store
+	}
+}
+
+// WithDelayedAllocation buffers writes to clusters that are not yet
+// allocated in memory, up to maxBytes, instead of allocating each cluster
+// as it is first written. Flush, Close, and a full buffer allocate all
+// buffered clusters as one contiguous run in guest order, so bulk imports
+// produce images laid out like qemu-img convert output even when the data
+// arrives out of order. Writes to allocated clusters are not buffered.
+//
+// Buffered data is lost if the process dies before a flush, and allocation
+// errors such as ErrQuotaExceeded surface from the flush rather than from
+// WriteAt. Until then the clusters read back through ReadAt but count as
+// unallocated for Map, Check and DescribeCluster. Creating a snapshot
+// flushes the buffer.
+//
+// The option is ignored for read-only images and has no effect on images
+// with an external data file or a checksum sidecar. 0 disables it.
+func WithDelayedAllocation(maxBytes uint64) Option {
+	return func(o *imageOptions) {
+		o.delayedAllocation = maxBytes
+	}
+}
+
+// WithWriterGoroutine runs WriteAt, WriteZeroAt, WriteZeroAtMode, Flush
+// and Close on a dedicated goroutine, one call at a time, in the order
+// callers submit them, at the cost of any parallelism between writes and a
+// channel round trip per call. Only those calls are ordered this way. Reads
+// and every other method, including mutations such as WriteAtCompressed,
+// Discard, Resize, TrimTail and the snapshot and external data file
+// operations, run on the caller's goroutine as usual and rely on the
+// image's own locking against the writer goroutine, as they would against
+// concurrent WriteAt callers.
+//
+// The goroutine exits with Close.
+func WithWriterGoroutine() Option {
+	return func(o *imageOptions) {
+		o.writerGoroutine = true
+	}
+}
+
+// WithWriteRangeLocking serializes guest writes whose ranges share a
+// cluster. Without it, concurrent WriteAt calls to overlapping ranges each
+// update the image a cluster at a time, so the result can mix the data of
+// both, even within a cluster. With it, each WriteAt, WriteAtCompressed,
+// WriteZeroAt and WriteZeroAtMode holds the clusters it covers until it
+// returns: where writes overlap, the one that got its clusters last wins in
+// full, as if they had been issued one after the other. Writes to disjoint
+// clusters still run in parallel. Reads are not held off, so a read
+// concurrent with a write may still see part of it.
+func WithWriteRangeLocking() Option {
+	return func(o *imageOptions) {
+		o.writeRangeLocking = true
+	}
+}
+
+// WithPriorityScheduling holds requests tagged PriorityBackground (see
+// WithPriority) while guest I/O is in flight, so background jobs such as
+// Scrub run in the gaps between guest requests instead of competing with
+// them. Guest I/O is ReadAt, WriteAt and their Context variants at normal
+// priority.
+//
+// A background request waits at most maxWait, so a busy guest delays it
+// rather than starving it; 0 means it waits as long as the guest is busy.
+// It fails with ctx.Err() if its context is done first, which makes a
+// context deadline the request's deadline. Without this option priorities
+// are ignored.
+func WithPriorityScheduling(maxWait time.Duration) Option {
+	return func(o *imageOptions) {
+		o.priorityScheduling = true
+		o.priorityMaxWait = maxWait
+	}
+}
+
+// WithEvents registers callbacks for cluster allocation, file growth and
+// copy-on-write; see Events.
+func WithEvents(events Events) Option {
+	return func(o *imageOptions) {
+		o.events = events
+	}
+}
+
+// WithTrimTailOnClose makes Close call TrimTail, so an image whose data at
+// the end was discarded shrinks once it is closed.
+func WithTrimTailOnClose() Option {
+	return func(o *imageOptions) {
+		o.trimOnClose = true
+	}
+}
+
+// WithLazyL1 reads the L1 table in 64KB segments as lookups reach them
+// instead of all at open. Multi-terabyte images with small clusters have
+// L1 tables of tens of megabytes, most of which a short-lived open never
+// needs. Operations that walk the whole table, such as Check, snapshots
+// and growing the table, read the rest of it first, and freed clusters are
+// only reused once the whole table is in memory.
+func WithLazyL1() Option {
+	return func(o *imageOptions) {
+		o.lazyL1 = true
+	}
+}
+
+// WithSignature verifies the image against sig with pub once it is open,
+// as VerifySignature does, and fails the open if it does not match, so an
+// image that was tampered with is never handed to the caller. This reads
+// every data cluster of the image and its backing chain, so opening takes
+// as long as reading the whole disk.
+func WithSignature(sig *Signature, pub ed25519.PublicKey) Option {
+	return func(o *imageOptions) {
+		o.signature = sig
+		o.signatureKey = pub
+	}
+}
+
+// WithAutoGrow makes writes past the end of the virtual disk grow it,
+// rounded up to whole 512-byte sectors, instead of failing with
+// ErrOffsetOutOfRange or stopping short with ErrShortWrite. This suits
+// building an image by appending to it. The disk grows to at most maxSize
+// bytes, beyond which writes fail as before; 0 means the WithMaxVirtualSize
+// limit. Images with persistent bitmaps cannot grow.
+func WithAutoGrow(maxSize uint64) Option {
+	return func(o *imageOptions) {
+		o.autoGrow = maxSize
+		o.autoGrowEnabled = true
+	}
+}
+
+// WithFileAdvice passes advice to the host for the image's files once they
+// are open, for instance AdviceRandom for an image serving random guest
+// I/O; see Image.Advise.
+func WithFileAdvice(advice FileAdvice) Option {
+	return func(o *imageOptions) {
+		o.fileAdvice = advice
+	}
+}
+
+// WithRefcountVerifier starts a low-priority background verifier that keeps
+// walking the image's refcounts against the tables that reference the
+// clusters, so drift is noticed on a long-running host instead of only by
+// Check. Each pass is rate limited and a drift is only reported once two
+// consecutive passes agree on it. Only used versus free is compared, not
+// exact counts. Images with lazy refcounts or an external data file are
+// not verified. The verifier stops when the image is closed.
+func WithRefcountVerifier(opts RefcountVerifierOptions) Option {
+	return func(o *imageOptions) {
+		o.refcountVerifier = &opts
+	}
+}
+
+// WithLUKSPasswords supplies LUKS passphrases by image file path, so that a
+// LUKS-encrypted image, and any LUKS-encrypted layers of its backing chain,
+// are unlocked as they are opened, each with its own passphrase. Paths are
+// compared after making them absolute; backing file names are resolved
+// relative to the image naming them, as usual. Layers without an entry are
+// opened locked, and the top image can still be unlocked with UnlockLUKS.
+//
+// It is a KeyProvider over the map and replaces any set with
+// WithKeyProvider. A store set with WithBackingStore is used as is and must
+// be unlocked by the caller.
+func WithLUKSPasswords(passwords map[string]string) Option {
+	p := make(passwordProvider, len(passwords))
+	for path, password := range passwords {
+		p[layerPath(path)] = password
+	}
+	return WithKeyProvider(p)
+}
+
+// WithKeyProvider unlocks LUKS-encrypted images with keys fetched from p as
+// they are opened: the image itself and any encrypted layers of its backing
+// chain, which are opened with the same provider. Images p has no key for
+// are opened locked.
+func WithKeyProvider(p KeyProvider) Option {
+	return func(o *imageOptions) {
+		o.keyProvider = p
+	}
+}
+
+// WithCompatLevel holds an existing image to a compat level, as
+// CreateOptions.Compat does for a new one: opening fails with ErrCompatLevel
+// if the image already uses a feature beyond the level, and operations that
+// would enable one, such as zstd compression or attaching an external data
+// file, fail instead.
+func WithCompatLevel(level CompatLevel) Option {
+	return func(o *imageOptions) {
+		o.compatLevel = level
+	}
+}
+
+// WithZstdFrameSize makes zstd-compressed clusters a sequence of
+// independent frames, each holding at most size bytes of the cluster,
+// instead of a single frame. Decoders such as QEMU's read the frames in
+// turn, so the output is valid either way; smaller frames bound the window
+// a decoder needs, at some cost in compression ratio. size is rounded up to
+// a multiple of 512. 0, the default, writes one frame per cluster.
+func WithZstdFrameSize(size int) Option {
+	return func(o *imageOptions) {
+		o.zstdFrameSize = max(0, (size+511)&^511)
+	}
+}
+
+// WithAlignedIO lets the image run on files that only accept block-aligned
+// I/O, such as files opened with O_DIRECT:
+//
+//	img, err := qcow2.OpenFile(path, os.O_RDWR|syscall.O_DIRECT, 0,
+//		qcow2.WithAlignedIO(4096))
+//
+// Callers can then read and write at any offset and length. I/O that is
+// already aligned to blockSize (offset, length and buffer address) goes
+// straight to the file; anything else is staged in an aligned bounce
+// buffer, with partial blocks at the edges read and written back. The same
+// applies to the external data file. A wrapper set with WithFileWrapper sees
+// the aligned I/O.
+//
+// blockSize must be a power of two, typically the device's logical block
+// size; other values are ignored.
+func WithAlignedIO(blockSize int) Option {
+	return func(o *imageOptions) {
+		if blockSize > 1 && blockSize&(blockSize-1) == 0 {
+			o.ioAlignment = blockSize
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// partial_write_test.go - Tests for writes that stop part way
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteAtPartialFailure checks that a write failing mid-way reports how
+// much landed, that those bytes read back, and that the image stays clean.
+func TestWriteAtPartialFailure(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(make([]byte, cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = Open(path, WithMaxAllocation(uint64(info.Size())))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	// The first cluster is allocated and rewritten in place; the second
+	// needs a cluster the quota does not allow
+	data := bytes.Repeat([]byte("partial!"), 2*cs/8)
+	n, err := img.WriteAt(data[cs/2:], int64(cs/2))
+	var werr *WriteError
+	if !errors.As(err, &werr) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("WriteAt: got %v, want *WriteError wrapping ErrQuotaExceeded", err)
+	}
+	if n != cs/2 || werr.Written != n || werr.Off != int64(cs/2) {
+		t.Errorf("n = %d, WriteError = %+v; want %d bytes at %d", n, werr, cs/2, cs/2)
+	}
+
+	got := make([]byte, 2*cs)
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got[:cs/2], make([]byte, cs/2)) || !bytes.Equal(got[cs/2:cs], data[cs/2:cs]) {
+		t.Error("written bytes do not read back")
+	}
+	if !bytes.Equal(got[cs:], make([]byte, cs)) {
+		t.Error("unwritten cluster changed")
+	}
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean after partial write: %+v", result)
+	}
+}
+
+func TestWriteAtShortWrite(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	data := bytes.Repeat([]byte{0xAB}, 8192)
+	off := img.Size() - 4096
+	n, err := img.WriteAt(data, off)
+	if !errors.Is(err, ErrShortWrite) {
+		t.Fatalf("WriteAt past end: got %v, want ErrShortWrite", err)
+	}
+	if n != 4096 {
+		t.Errorf("n = %d, want 4096", n)
+	}
+	got := make([]byte, 4096)
+	if _, err := img.ReadAt(got, off); err != nil || !bytes.Equal(got, data[:4096]) {
+		t.Errorf("tail of image mismatch (err %v)", err)
+	}
+
+	// Exactly up to the end is a complete write
+	if _, err := img.WriteAt(data[:4096], off); err != nil {
+		t.Errorf("WriteAt up to end failed: %v", err)
+	}
+}
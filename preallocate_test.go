@@ -0,0 +1,89 @@
+// preallocate_test.go - Metadata preallocation tests
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestPreallocateMetadata verifies L2 tables and refcount blocks are created
+// up front so later writes only allocate data clusters.
+func TestPreallocateMetadata(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prealloc.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	// 3GB spans six L2 tables and needs a second refcount block
+	if err := img.PreallocateMetadata(0, 3*1024*1024*1024); err != nil {
+		t.Fatalf("PreallocateMetadata failed: %v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if binary.BigEndian.Uint64(img.l1Table[i*8:]) == 0 {
+			t.Errorf("L1[%d] not preallocated", i)
+		}
+	}
+	if binary.BigEndian.Uint64(img.l1Table[6*8:]) != 0 {
+		t.Error("L1[6] is outside the range and should stay empty")
+	}
+	if binary.BigEndian.Uint64(img.refcountTable[8:]) == 0 {
+		t.Error("second refcount block not preallocated")
+	}
+
+	// Reads are unaffected
+	buf := make([]byte, 4096)
+	if _, err := img.ReadAt(buf, 1024*1024*1024); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	for _, b := range buf {
+		if b != 0 {
+			t.Fatal("preallocated range should read as zeros")
+		}
+	}
+
+	// A write now only grows the file by one data cluster
+	before := testutil.FileSize(t, path)
+	if _, err := img.WriteAt([]byte("hello"), 2*1024*1024*1024+12345); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if grown := testutil.FileSize(t, path) - before; grown != int64(img.ClusterSize()) {
+		t.Errorf("write grew file by %d bytes, want %d", grown, img.ClusterSize())
+	}
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean after preallocation: %+v", result)
+	}
+}
+
+// TestPreallocateMetadataBounds verifies range validation.
+func TestPreallocateMetadataBounds(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	img, err := CreateSimple(filepath.Join(dir, "bounds.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	if err := img.PreallocateMetadata(0, 2*1024*1024); err != ErrOffsetOutOfRange {
+		t.Errorf("expected ErrOffsetOutOfRange, got %v", err)
+	}
+	if err := img.PreallocateMetadata(-1, 10); err != ErrOffsetOutOfRange {
+		t.Errorf("expected ErrOffsetOutOfRange, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package qcow2
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority orders requests when guest I/O and background jobs share an
+// image opened with WithPriorityScheduling.
+type Priority int
+
+const (
+	// PriorityNormal is guest I/O, and the default for every request.
+	PriorityNormal Priority = iota
+
+	// PriorityBackground is for jobs such as Scrub, copies and streaming:
+	// each request waits for in-flight guest I/O to drain before it runs.
+	PriorityBackground
+)
+
+// priorityKey is the context key for a request's Priority.
+type priorityKey struct{}
+
+// WithPriority returns a context that tags the requests it is passed to
+// (ReadAtContext, WriteAtContext, FlushContext, Scrub, ScanOrphans,
+// ContentBitmap) with p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityOf returns the priority ctx carries, PriorityNormal by default.
+func PriorityOf(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// ioScheduler holds background requests back while guest I/O is in
+// flight.
+type ioScheduler struct {
+	active  atomic.Int64 // Guest requests in flight
+	waiters atomic.Int64 // Background requests waiting for active to reach 0
+	maxWait time.Duration
+
+	mu   sync.Mutex
+	idle chan struct{} // Closed when active drops to 0 with waiters
+}
+
+func newIOScheduler(maxWait time.Duration) *ioScheduler {
+	return &ioScheduler{maxWait: maxWait, idle: make(chan struct{})}
+}
+
+// track counts a guest request in flight until the returned function is
+// called.
+func (s *ioScheduler) track() func() {
+	s.active.Add(1)
+	return s.done
+}
+
+func (s *ioScheduler) done() {
+	if s.active.Add(-1) == 0 && s.waiters.Load() > 0 {
+		s.mu.Lock()
+		close(s.idle)
+		s.idle = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+// wait blocks until no guest request is in flight, maxWait has passed, or
+// ctx is done, in which case it returns ctx.Err().
+func (s *ioScheduler) wait(ctx context.Context) error {
+	var timeout <-chan time.Time
+	if s.maxWait > 0 {
+		timer := time.NewTimer(s.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	s.waiters.Add(1)
+	defer s.waiters.Add(-1)
+	for {
+		// Take the channel before checking active, so a done that sees
+		// this waiter closes the channel waited on below
+		s.mu.Lock()
+		idle := s.idle
+		s.mu.Unlock()
+		if s.active.Load() == 0 {
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-timeout:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitTurn returns ctx.Err() if ctx is done and, on images with priority
+// scheduling, holds background requests back while guest I/O is in flight.
+// It reports whether the caller is a background request, which must then
+// use the untracked read and write paths so other background requests do
+// not wait on it.
+func (img *Image) waitTurn(ctx context.Context) (background bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if img.sched == nil || PriorityOf(ctx) != PriorityBackground {
+		return false, nil
+	}
+	return true, img.sched.wait(ctx)
+}
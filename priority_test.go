@@ -0,0 +1,98 @@
+// priority_test.go - Priority scheduling tests
+
+package qcow2
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestPriorityScheduling verifies background reads wait for in-flight
+// guest I/O, up to the image's maximum wait or the context deadline.
+func TestPriorityScheduling(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "prio.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithPriorityScheduling(0))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	bg := WithPriority(context.Background(), PriorityBackground)
+	buf := make([]byte, 512)
+
+	// Hold a guest request in flight; the background read must wait for it
+	guestDone := img.sched.track()
+	result := make(chan error, 1)
+	go func() {
+		_, err := img.ReadAtContext(bg, buf, 0)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		t.Fatalf("background read finished (%v) while guest I/O was in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	guestDone()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("background read failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("background read still waiting after guest I/O finished")
+	}
+
+	// Normal-priority requests never wait
+	guestDone = img.sched.track()
+	if _, err := img.ReadAtContext(context.Background(), buf, 0); err != nil {
+		t.Errorf("normal read failed: %v", err)
+	}
+
+	// A deadline bounds the wait
+	ctx, cancel := context.WithTimeout(bg, 20*time.Millisecond)
+	defer cancel()
+	if _, err := img.ReadAtContext(ctx, buf, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("background read past deadline: got %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := img.Scrub(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("background Scrub past deadline: got %v, want context.DeadlineExceeded", err)
+	}
+	guestDone()
+}
+
+// TestPrioritySchedulingMaxWait verifies a busy guest delays background
+// requests by at most the configured wait.
+func TestPrioritySchedulingMaxWait(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "prio.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithPriorityScheduling(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	defer img.sched.track()()
+	start := time.Now()
+	bg := WithPriority(context.Background(), PriorityBackground)
+	if _, err := img.ReadAtContext(bg, make([]byte, 512), 0); err != nil {
+		t.Fatalf("background read failed: %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("background read waited %v, want at least 20ms", waited)
+	}
+}
@@ -0,0 +1,77 @@
+package qcow2
+
+import "sort"
+
+// CreateProfile is a named bundle of creation settings for a common use,
+// selected with CreateOptions.Profile.
+type CreateProfile struct {
+	Name        string
+	Description string
+
+	ClusterBits         uint32
+	RefcountBits        uint32
+	LazyRefcounts       bool
+	CompressionLevel    CompressionLevel
+	CompressionType     uint8
+	PreallocateMetadata bool
+}
+
+var createProfiles = map[string]CreateProfile{
+	"kvm-default": {
+		Name:                "kvm-default",
+		Description:         "VM disk: 64KB clusters, preallocated metadata so first writes are fast",
+		ClusterBits:         16,
+		RefcountBits:        16,
+		PreallocateMetadata: true,
+	},
+	"archival-compressed": {
+		Name:             "archival-compressed",
+		Description:      "long-term storage: full-cluster writes compressed with zlib at the best level",
+		ClusterBits:      16,
+		RefcountBits:     16,
+		CompressionLevel: CompressionBest,
+		CompressionType:  CompressionZlib,
+	},
+	"ci-ephemeral": {
+		Name:          "ci-ephemeral",
+		Description:   "throwaway test disk: lazy refcounts trade crash consistency for write speed",
+		ClusterBits:   16,
+		RefcountBits:  16,
+		LazyRefcounts: true,
+	},
+}
+
+// CreateProfiles returns the built-in creation profiles, sorted by name.
+func CreateProfiles() []CreateProfile {
+	profiles := make([]CreateProfile, 0, len(createProfiles))
+	for _, p := range createProfiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// LookupCreateProfile returns the built-in profile called name.
+func LookupCreateProfile(name string) (CreateProfile, bool) {
+	p, ok := createProfiles[name]
+	return p, ok
+}
+
+// apply fills in the fields of opts left at their zero value. Boolean
+// settings can only be turned on, never off, by the profile.
+func (p CreateProfile) apply(opts *CreateOptions) {
+	if opts.ClusterBits == 0 {
+		opts.ClusterBits = p.ClusterBits
+	}
+	if opts.RefcountBits == 0 {
+		opts.RefcountBits = p.RefcountBits
+	}
+	if opts.CompressionLevel == CompressionDisabled {
+		opts.CompressionLevel = p.CompressionLevel
+	}
+	if opts.CompressionType == CompressionZlib {
+		opts.CompressionType = p.CompressionType
+	}
+	opts.LazyRefcounts = opts.LazyRefcounts || p.LazyRefcounts
+	opts.PreallocateMetadata = opts.PreallocateMetadata || p.PreallocateMetadata
+}
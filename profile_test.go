@@ -0,0 +1,120 @@
+// profile_test.go - Creation profile tests
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// TestCreateProfiles checks each built-in profile creates a clean image
+// with its settings applied, and that explicit options win.
+func TestCreateProfiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	for _, p := range CreateProfiles() {
+		path := filepath.Join(dir, p.Name+".qcow2")
+		img, err := Create(path, CreateOptions{Size: 4 * 1024 * 1024, Profile: p.Name})
+		if err != nil {
+			t.Fatalf("Create(%s) failed: %v", p.Name, err)
+		}
+		if img.lazyRefcounts != p.LazyRefcounts {
+			t.Errorf("%s: lazy refcounts = %v, want %v", p.Name, img.lazyRefcounts, p.LazyRefcounts)
+		}
+		if img.compressionLevel != p.CompressionLevel {
+			t.Errorf("%s: compression level = %v, want %v", p.Name, img.compressionLevel, p.CompressionLevel)
+		}
+		if got := uint32(img.ClusterSize()); got != 1<<p.ClusterBits {
+			t.Errorf("%s: cluster size = %d, want %d", p.Name, got, 1<<p.ClusterBits)
+		}
+		if l2 := binary.BigEndian.Uint64(img.l1Table); (l2 != 0) != p.PreallocateMetadata {
+			t.Errorf("%s: L1 entry 0 = 0x%x, preallocated metadata = %v", p.Name, l2, p.PreallocateMetadata)
+		}
+		if err := img.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		img, err = Open(path)
+		if err != nil {
+			t.Fatalf("Open(%s) failed: %v", p.Name, err)
+		}
+		result, err := img.Check()
+		if err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		if !result.IsClean() {
+			t.Errorf("%s: image not clean: %+v", p.Name, result)
+		}
+		img.Close()
+	}
+
+	img, err := Create(filepath.Join(dir, "override.qcow2"), CreateOptions{
+		Size:        1024 * 1024,
+		Profile:     "archival-compressed",
+		ClusterBits: 12,
+	})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer img.Close()
+	if img.ClusterSize() != 4096 {
+		t.Errorf("cluster size = %d, want 4096", img.ClusterSize())
+	}
+
+	_, err = Create(filepath.Join(dir, "unknown.qcow2"), CreateOptions{Size: 1024 * 1024, Profile: "nope"})
+	if !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("Create with unknown profile: got %v, want ErrUnknownProfile", err)
+	}
+}
+
+// TestCreateRefcountBits checks images created with each refcount width
+// open, take writes and pass Check.
+func TestCreateRefcountBits(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	for _, width := range []uint32{1, 2, 4, 8, 16, 32, 64} {
+		path := filepath.Join(dir, fmt.Sprintf("refcount%d.qcow2", width))
+		img, err := Create(path, CreateOptions{Size: 1024 * 1024, RefcountBits: width})
+		if err != nil {
+			t.Fatalf("Create(%d bits) failed: %v", width, err)
+		}
+		if _, err := img.WriteAt(data, 65536); err != nil {
+			t.Fatalf("WriteAt(%d bits) failed: %v", width, err)
+		}
+		img.Close()
+
+		img, err = Open(path)
+		if err != nil {
+			t.Fatalf("Open(%d bits) failed: %v", width, err)
+		}
+		if got := img.header.RefcountBits(); got != width {
+			t.Errorf("refcount bits = %d, want %d", got, width)
+		}
+		result, err := img.Check()
+		if err != nil {
+			t.Fatalf("Check(%d bits) failed: %v", width, err)
+		}
+		if !result.IsClean() {
+			t.Errorf("%d bits: image not clean: %+v", width, result)
+		}
+		img.Close()
+	}
+
+	for _, opts := range []CreateOptions{
+		{Size: 1024 * 1024, RefcountBits: 12},
+		{Size: 1024 * 1024, RefcountBits: 128},
+		{Size: 1024 * 1024, RefcountBits: 8, Version: Version2},
+	} {
+		if img, err := Create(filepath.Join(dir, "bad.qcow2"), opts); err == nil {
+			img.Close()
+			t.Errorf("Create(%+v) succeeded", opts)
+		}
+	}
+}
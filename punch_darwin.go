@@ -0,0 +1,43 @@
+//go:build darwin
+
+package qcow2
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// fcntl(2) command to deallocate a file range
+const fPunchHole = 99
+
+// fpunchhole is struct fpunchhole from <sys/fcntl.h>.
+type fpunchhole struct {
+	flags    uint32
+	reserved uint32
+	offset   int64
+	length   int64
+}
+
+// punchHole deallocates the byte range in f without changing its size.
+// APFS requires off and length to be multiples of the file system block
+// size, which clusters of 4 KiB and up always are.
+func punchHole(f File, off, length int64) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return ErrHolePunchUnsupported
+	}
+	args := fpunchhole{offset: off, length: length}
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), fPunchHole, uintptr(unsafe.Pointer(&args)))
+	if errno == syscall.ENOTSUP {
+		return ErrHolePunchUnsupported
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// markSparse is not needed on macOS: APFS files are sparse when grown.
+func markSparse(f File) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package qcow2
+
+import (
+	"syscall"
+)
+
+// fallocate(2) mode flags
+const (
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+)
+
+// punchHole deallocates the byte range in f without changing its size.
+func punchHole(f File, off, length int64) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return ErrHolePunchUnsupported
+	}
+	return syscall.Fallocate(int(fd.Fd()), fallocFlPunchHole|fallocFlKeepSize, off, length)
+}
+
+// markSparse is a no-op: files on Linux are sparse when grown.
+func markSparse(f File) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows && !darwin
+
+package qcow2
+
+// punchHole is not supported on this platform.
+func punchHole(f File, off, length int64) error {
+	return ErrHolePunchUnsupported
+}
+
+// markSparse is not needed on this platform.
+func markSparse(f File) error {
+	return nil
+}
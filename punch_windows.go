@@ -0,0 +1,50 @@
+//go:build windows
+
+package qcow2
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// DeviceIoControl codes for NTFS sparse files
+const (
+	fsctlSetSparse   = 0x000900c4
+	fsctlSetZeroData = 0x000980c8
+)
+
+// fileZeroDataInformation is FILE_ZERO_DATA_INFORMATION.
+type fileZeroDataInformation struct {
+	FileOffset      int64
+	BeyondFinalZero int64
+}
+
+// markSparse marks f as a sparse file, so ranges it grows by and ranges
+// punched out of it take no disk space. It is best effort: file systems
+// without sparse file support simply allocate.
+func markSparse(f File) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return ErrHolePunchUnsupported
+	}
+	var returned uint32
+	return syscall.DeviceIoControl(syscall.Handle(fd.Fd()), fsctlSetSparse,
+		nil, 0, nil, 0, &returned, nil)
+}
+
+// punchHole deallocates the byte range in f without changing its size.
+func punchHole(f File, off, length int64) error {
+	fd, ok := f.(fdFile)
+	if !ok {
+		return ErrHolePunchUnsupported
+	}
+	// FSCTL_SET_ZERO_DATA only deallocates in sparse files; on others it
+	// writes zeros
+	if err := markSparse(f); err != nil {
+		return ErrHolePunchUnsupported
+	}
+	info := fileZeroDataInformation{FileOffset: off, BeyondFinalZero: off + length}
+	var returned uint32
+	return syscall.DeviceIoControl(syscall.Handle(fd.Fd()), fsctlSetZeroData,
+		(*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), nil, 0, &returned, nil)
+}
@@ -1,7 +1,9 @@
 package qcow2
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -9,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // BackingStore is the interface for backing files (qcow2 or raw).
@@ -20,8 +23,8 @@ type BackingStore interface {
 // Image is the primary interface for interacting with a QCOW2 image.
 // It implements io.ReaderAt and io.WriterAt for random access.
 type Image struct {
-	file             *os.File
-	externalDataFile *os.File // External data file (when IncompatExternalData is set)
+	file             File
+	externalDataFile File // External data file (when IncompatExternalData is set)
 	header           *Header
 
 	// Derived values cached for performance
@@ -45,6 +48,9 @@ type Image struct {
 	// Compressed cluster cache - keeps decompressed clusters
 	compressedCache *compressedClusterCache
 
+	// Data cluster cache - keeps hot uncompressed clusters, nil if disabled
+	dataCache *dataClusterCache
+
 	// Refcount table (level 1) - loaded entirely into memory
 	refcountTable     []byte
 	refcountTableLock sync.RWMutex
@@ -52,8 +58,15 @@ type Image struct {
 	// Refcount block cache (level 2) - LRU cache of refcount blocks
 	refcountBlockCache *l2Cache
 
+	// Refcount block held for write-back, nil unless enabled
+	refcountPin *pinnedRefcountBlock
+
+	// Which free cluster allocations reuse
+	reusePolicy ClusterReusePolicy
+
 	// Write tracking
 	readOnly bool
+	writable bool // Host files were opened for writing
 	dirty    atomic.Bool
 
 	// Lazy refcounts mode - defer refcount updates for better write performance
@@ -75,11 +88,25 @@ type Image struct {
 	// Snapshots
 	snapshots []*Snapshot
 
+	// Snapshot L1 tables loaded by ReadAtSnapshot, keyed by table offset
+	snapshotL1   map[uint64][]byte
+	snapshotL1Mu sync.Mutex
+
 	// Write ordering barrier mode
 	barrierMode WriteBarrierMode
 
+	// End-of-allocation tracking when the image is on a block device
+	device *blockDeviceFile
+
 	// Pending sync flag for batched barrier mode
-	pendingSync bool
+	pendingSync atomic.Bool
+
+	// Number of MultiWriteAt batches in progress; data barriers are
+	// deferred to the end of the batch while it is non-zero
+	barrierDeferrals atomic.Int32
+
+	// Guest ranges written since the last sync, for FlushAt
+	unsynced unsyncedRanges
 
 	// Compression level for write operations (CompressionDisabled by default)
 	compressionLevel CompressionLevel
@@ -93,6 +120,19 @@ type Image struct {
 	// LUKS decryptor for modern encrypted images (method=2)
 	luksDecryptor *LUKSDecryptor
 
+	// Source of LUKS keys, handed down the backing chain
+	keyProvider KeyProvider
+
+	// Largest virtual size accepted on open (WithMaxVirtualSize), handed
+	// down the backing chain
+	maxVirtualSize uint64
+
+	// Oldest QEMU the image must stay usable with
+	compat CompatLevel
+
+	// Cluster bytes per zstd frame, 0 for one frame per cluster
+	zstdFrameSize int
+
 	// Extended L2 entries support (128-bit entries with 32 subclusters)
 	extendedL2     bool   // True if IncompatExtendedL2 feature is set
 	l2EntrySize    uint32 // 8 for standard, 16 for extended L2
@@ -105,6 +145,69 @@ type Image struct {
 
 	// Buffer pool for cluster-sized allocations
 	clusterPool sync.Pool
+
+	// Optional per-cluster checksum sidecar (nil when disabled)
+	checksums *checksumStore
+
+	// Optional metadata checksum sidecar (nil when disabled)
+	metaChecksums *metadataChecksums
+
+	// Read-only mapping of the data file (nil unless WithMmap)
+	mmapData []byte
+
+	// Optional wrapper applied to host files as they are opened
+	fileWrapper func(File) File
+
+	// Retry policy for backing file reads (nil = fail on first error)
+	backingRetry *BackingRetryPolicy
+
+	// Host allocation limit in bytes (0 = unlimited)
+	maxAllocation uint64
+
+	// Allocation event callbacks (WithEvents)
+	events Events
+
+	// Truncate free clusters at the end of the file on Close
+	trimOnClose bool
+
+	// Background refcount verifier (nil unless WithRefcountVerifier)
+	verifier *refcountVerifier
+
+	// Writes past the end grow the virtual size up to this (0 = never)
+	autoGrow uint64
+
+	// Time spent in each phase of newImage
+	openStats OpenStats
+
+	// I/O counters behind Stats
+	stats ioStats
+
+	// Segments of l1Table read so far (nil unless WithLazyL1)
+	lazyL1 *lazyL1
+
+	// Buffered writes to unallocated clusters (nil unless WithDelayedAllocation)
+	delayed *delayedAllocator
+
+	// Damage reports for an image opened with OpenForensic, nil otherwise
+	forensic func(ForensicWarning)
+
+	// Set by Close; I/O after it fails with ErrClosed
+	closed atomic.Bool
+
+	// Goroutine running WriteAt, WriteZeroAt, Flush and Close (nil unless
+	// WithWriterGoroutine)
+	writer *writerActor
+
+	// Holds background requests behind guest I/O (nil unless
+	// WithPriorityScheduling)
+	sched *ioScheduler
+
+	// Serializes writes to overlapping clusters (nil unless
+	// WithWriteRangeLocking)
+	rangeLocks *rangeLocks
+
+	// One-shot file growth notification (nil when not armed)
+	writeThreshold atomic.Pointer[writeThreshold]
 }
 
 // getClusterBuffer retrieves a cluster-sized buffer from the pool.
@@ -126,15 +229,13 @@ func (img *Image) putClusterBuffer(buf []byte) {
 // getZeroedClusterBuffer retrieves a zeroed cluster-sized buffer from the pool.
 func (img *Image) getZeroedClusterBuffer() []byte {
 	buf := img.getClusterBuffer()
-	for i := range buf {
-		buf[i] = 0
-	}
+	clear(buf)
 	return buf
 }
 
 // dataFile returns the file handle for cluster data I/O.
 // If an external data file is configured, returns that; otherwise returns the main image file.
-func (img *Image) dataFile() *os.File {
+func (img *Image) dataFile() File {
 	if img.externalDataFile != nil {
 		return img.externalDataFile
 	}
@@ -143,11 +244,18 @@ func (img *Image) dataFile() *os.File {
 
 // metadataBarrier issues a sync if barrier mode requires it for metadata updates.
 func (img *Image) metadataBarrier() error {
+	if img.barrierMode != BarrierNone {
+		// Refcounts held back by WithRefcountWriteback go out ahead of the
+		// metadata that points at their clusters
+		if err := img.writebackRefcountPin(); err != nil {
+			return err
+		}
+	}
 	switch img.barrierMode {
 	case BarrierNone:
 		return nil
 	case BarrierBatched:
-		img.pendingSync = true
+		img.pendingSync.Store(true)
 		return nil
 	default: // BarrierMetadata, BarrierFull
 		return img.file.Sync()
@@ -156,11 +264,14 @@ func (img *Image) metadataBarrier() error {
 
 // dataBarrier issues a sync if barrier mode requires it for data writes.
 func (img *Image) dataBarrier() error {
+	if img.dataBarriersDeferred() {
+		return nil
+	}
 	switch img.barrierMode {
 	case BarrierNone:
 		return nil
 	case BarrierBatched:
-		img.pendingSync = true
+		img.pendingSync.Store(true)
 		return nil
 	case BarrierMetadata:
 		return nil
@@ -171,6 +282,14 @@ func (img *Image) dataBarrier() error {
 	return nil
 }
 
+// dataBarriersDeferred reports whether a MultiWriteAt batch is in progress,
+// in which case the batch syncs the data once at its end. Metadata barriers
+// are never deferred, since they order updates that keep the image
+// consistent after a crash.
+func (img *Image) dataBarriersDeferred() bool {
+	return img.barrierDeferrals.Load() > 0
+}
+
 // SetWriteBarrierMode sets the write ordering barrier mode.
 // This can be changed at any time; the new mode applies to subsequent writes.
 func (img *Image) SetWriteBarrierMode(mode WriteBarrierMode) {
@@ -236,17 +355,44 @@ func openFileWithDepth(path string, flag int, perm os.FileMode, depth int, opts
 	return img, nil
 }
 
-// newImage creates an Image from an already-open file.
-func newImage(f *os.File, readOnly bool, chainDepth int, opts ...Option) (*Image, error) {
+// newImage creates an Image from an already-open file. On failure the
+// caller still owns f and closes it; everything else newImage opened is
+// released.
+func newImage(f *os.File, readOnly bool, chainDepth int, opts ...Option) (_ *Image, err error) {
+	openStart := time.Now()
+
 	// Apply options
 	imgOpts := defaultImageOptions()
 	for _, opt := range opts {
 		opt(imgOpts)
 	}
+	readOnly = readOnly || imgOpts.readOnly
+	wrap, ioRetry := imgOpts.fileWrapper, imgOpts.ioRetry
+	imgOpts.fileWrapper = func(f File) File {
+		if wrap != nil {
+			f = wrap(f)
+		}
+		return newIOFile(f, ioRetry)
+	}
+	if block := imgOpts.ioAlignment; block > 0 {
+		wrap := imgOpts.fileWrapper
+		imgOpts.fileWrapper = func(f File) File {
+			if wrap != nil {
+				f = wrap(f)
+			}
+			return newAlignedFile(f, block)
+		}
+	}
+
+	file, device, err := openHostFile(f, imgOpts.fileWrapper)
+	if err != nil {
+		return nil, err
+	}
 
 	// Read header (include extra byte for compression type at offset 104)
+	phase := time.Now()
 	headerBuf := make([]byte, HeaderSizeV3+1)
-	n, err := f.ReadAt(headerBuf, 0)
+	n, err := file.ReadAt(headerBuf, 0)
 	if err != nil && err != io.EOF {
 		return nil, fmt.Errorf("qcow2: failed to read header: %w", err)
 	}
@@ -259,23 +405,64 @@ func newImage(f *os.File, readOnly bool, chainDepth int, opts ...Option) (*Image
 		return nil, err
 	}
 
-	if err := header.Validate(); err != nil {
+	if err := header.Validate(); err != nil && !imgOpts.tolerate(err) {
 		return nil, err
 	}
+	// Forensic opens cut an oversized layout down to the file instead
+	if imgOpts.forensic == nil {
+		if err := checkHeaderLimits(header, imgOpts.maxVirtualSize); err != nil {
+			return nil, err
+		}
+	}
 
-	img := &Image{
-		file:          f,
-		header:        header,
-		clusterSize:   header.ClusterSize(),
-		clusterBits:   header.ClusterBits,
-		l2Entries:     header.L2Entries(),
-		offsetMask:    header.ClusterSize() - 1,
-		readOnly:      readOnly,
-		lazyRefcounts: header.HasLazyRefcounts(),
-		chainDepth:    chainDepth,
-		barrierMode:   BarrierMetadata, // Default: sync after metadata updates
+	var stats OpenStats
+	timePhase(&stats.Header, phase)
+
+	// Let the image grow thinly where files are not sparse by default
+	if !readOnly {
+		_ = markSparse(f)
 	}
 
+	// Open the metadata checksum sidecar before anything writes to the image
+	var metaChecksums *metadataChecksums
+	if imgOpts.metaChecksumPath != "" {
+		metaChecksums, err = openMetadataChecksums(imgOpts.metaChecksumPath, header.ClusterBits, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		if !readOnly {
+			file = trackMetadataWrites(file, metaChecksums)
+		}
+	}
+
+	img := &Image{
+		file:           file,
+		header:         header,
+		clusterSize:    header.ClusterSize(),
+		clusterBits:    header.ClusterBits,
+		l2Entries:      header.L2Entries(),
+		offsetMask:     header.ClusterSize() - 1,
+		readOnly:       readOnly,
+		writable:       !readOnly,
+		lazyRefcounts:  header.HasLazyRefcounts(),
+		chainDepth:     chainDepth,
+		barrierMode:    BarrierMetadata, // Default: sync after metadata updates
+		fileWrapper:    imgOpts.fileWrapper,
+		zstdFrameSize:  imgOpts.zstdFrameSize,
+		backingRetry:   imgOpts.backingRetry,
+		metaChecksums:  metaChecksums,
+		device:         device,
+		forensic:       imgOpts.forensic,
+		openStats:      stats,
+		maxVirtualSize: imgOpts.maxVirtualSize,
+	}
+	img.stats.since = openStart
+	defer func() {
+		if err != nil {
+			img.abandon()
+		}
+	}()
+
 	// Configure L2 entry handling based on extended L2 feature
 	if header.HasExtendedL2() {
 		img.extendedL2 = true
@@ -292,19 +479,45 @@ func newImage(f *os.File, readOnly bool, chainDepth int, opts ...Option) (*Image
 		img.subclusterSize = img.clusterSize // Subcluster = full cluster
 	}
 
+	// Refuse an image that is already beyond the requested compat level
+	img.compat = imgOpts.compatLevel
+	if err := img.checkCompatLevel(); err != nil {
+		return nil, err
+	}
+
+	// A damaged image is opened with whatever of its L1 table is there
+	if img.forensic != nil {
+		if err := img.trimForensicLayout(imgOpts); err != nil {
+			return nil, err
+		}
+	}
+
 	// Load L1 table
-	if err := img.loadL1Table(); err != nil {
+	phase = time.Now()
+	if imgOpts.lazyL1 && img.forensic == nil {
+		img.initLazyL1()
+	} else if err := img.loadL1Table(); err != nil {
 		return nil, fmt.Errorf("qcow2: failed to load L1 table: %w", err)
 	}
+	timePhase(&img.openStats.L1Table, phase)
 
 	// Initialize L2 cache
-	img.l2Cache = newL2Cache(imgOpts.l2CacheSize, int(img.clusterSize))
+	img.l2Cache = newL2CacheWithShards(imgOpts.l2CacheSize, imgOpts.l2CacheShards)
 
 	// Initialize compressed cluster cache
 	img.compressedCache = newCompressedClusterCache(imgOpts.compressedCacheSize, int(img.clusterSize))
 
+	// Initialize data cluster cache if requested
+	if imgOpts.dataCacheSize > 0 {
+		img.dataCache = newDataClusterCache(imgOpts.dataCacheSize, int(img.clusterSize))
+	}
+
 	// Initialize refcount block cache
 	img.refcountBlockCache = newL2Cache(imgOpts.refcountCacheSize, int(img.clusterSize))
+	if imgOpts.refcountWriteback {
+		img.enableRefcountWriteback()
+	}
+	img.reusePolicy = imgOpts.reusePolicy
 
 	// Initialize cluster buffer pool
 	clusterSize := img.clusterSize
@@ -314,11 +527,22 @@ func newImage(f *os.File, readOnly bool, chainDepth int, opts ...Option) (*Image
 		},
 	}
 
+	// On a block device, find where the image ends before anything allocates
+	if device != nil {
+		end, err := img.allocatedEnd()
+		if err != nil {
+			return nil, fmt.Errorf("qcow2: failed to find end of image on block device: %w", err)
+		}
+		device.setEnd(int64(end))
+	}
+
 	// If lazy refcounts enabled and image is dirty, rebuild refcounts
 	if !readOnly && header.HasLazyRefcounts() && header.IsDirty() {
+		phase = time.Now()
 		if err := img.rebuildRefcounts(); err != nil {
 			return nil, fmt.Errorf("qcow2: failed to rebuild refcounts: %w", err)
 		}
+		timePhase(&img.openStats.RefcountRebuild, phase)
 	}
 
 	// Mark image dirty if opened for writing (v3 only)
@@ -331,25 +555,120 @@ func newImage(f *os.File, readOnly bool, chainDepth int, opts ...Option) (*Image
 	// Parse header extensions
 	extensions, err := img.parseHeaderExtensions()
 	if err != nil {
-		return nil, fmt.Errorf("qcow2: failed to parse header extensions: %w", err)
+		err = fmt.Errorf("qcow2: failed to parse header extensions: %w", err)
+		if !imgOpts.tolerate(err) {
+			return nil, err
+		}
+		extensions = &HeaderExtensions{}
 	}
 	img.extensions = extensions
 
+	// Unlock LUKS encryption if a key provider was supplied
+	img.keyProvider = imgOpts.keyProvider
+	phase = time.Now()
+	if _, err := img.unlockLUKS(img.keyProvider); err != nil {
+		return nil, err
+	}
+	timePhase(&img.openStats.Unlock, phase)
+
 	// Open external data file if required
 	if err := img.openExternalDataFile(f.Name(), readOnly); err != nil {
 		return nil, err
 	}
 
+	// A raw data file must cover the whole disk to be usable on its own
+	if !readOnly && img.rawExternalData() {
+		if err := img.ensureDataFileSize(header.Size); err != nil {
+			return nil, err
+		}
+	}
+
 	// Load snapshots if present
+	phase = time.Now()
 	if err := img.loadSnapshots(); err != nil {
-		return nil, fmt.Errorf("qcow2: failed to load snapshots: %w", err)
+		err = fmt.Errorf("qcow2: failed to load snapshots: %w", err)
+		if !imgOpts.tolerate(err) {
+			return nil, err
+		}
 	}
+	phase = timePhase(&img.openStats.Snapshots, phase)
 
-	// Open backing file if present
-	if err := img.openBackingFile(); err != nil {
+	// Open backing file if present, unless the caller supplied one
+	if imgOpts.backingStore != nil {
+		img.backing = imgOpts.backingStore
+	} else if err := img.openBackingFile(); err != nil && !imgOpts.tolerate(err) {
 		return nil, err
 	}
+	timePhase(&img.openStats.Backing, phase)
+
+	// Attach checksum sidecar if requested
+	if imgOpts.checksumPath != "" {
+		checksums, err := openChecksumStore(imgOpts.checksumPath, img.clusterBits, readOnly)
+		if err != nil {
+			return nil, err
+		}
+		img.checksums = checksums
+	}
+
+	img.maxAllocation = imgOpts.maxAllocation
+	img.events = imgOpts.events
+	img.trimOnClose = imgOpts.trimOnClose
+	img.autoGrow = imgOpts.autoGrow
+	if img.autoGrow == 0 && imgOpts.autoGrowEnabled {
+		img.autoGrow = imgOpts.maxVirtualSize
+		if img.autoGrow == 0 {
+			img.autoGrow = 1<<63 - 1
+		}
+	}
+
+	if imgOpts.delayedAllocation > 0 && !readOnly {
+		img.delayed = newDelayedAllocator(imgOpts.delayedAllocation)
+	}
 
+	// Check the tables loaded so far, or build the sums for a new sidecar
+	if img.metaChecksums != nil {
+		if err := img.initMetadataChecksums(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Map the data file for zero-syscall reads if requested
+	if imgOpts.mmap && readOnly && img.header.EncryptMethod == EncryptionNone {
+		data, err := mmapFile(img.dataFile())
+		if err != nil {
+			return nil, fmt.Errorf("qcow2: failed to mmap image: %w", err)
+		}
+		img.mmapData = data
+	}
+
+	if imgOpts.fileAdvice != AdviceNormal && chainDepth == 0 {
+		if err := img.Advise(imgOpts.fileAdvice); err != nil {
+			return nil, err
+		}
+	}
+
+	// Checked before any goroutine starts, so a refused image has none
+	if imgOpts.signature != nil && chainDepth == 0 {
+		err := VerifySignature(context.Background(), img, imgOpts.signature, imgOpts.signatureKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if imgOpts.priorityScheduling {
+		img.sched = newIOScheduler(imgOpts.priorityMaxWait)
+	}
+	if imgOpts.writerGoroutine {
+		img.writer = newWriterActor()
+	}
+	if imgOpts.writeRangeLocking {
+		img.rangeLocks = newRangeLocks()
+	}
+	if v := imgOpts.refcountVerifier; v != nil && chainDepth == 0 && !img.lazyRefcounts && img.externalDataFile == nil {
+		img.verifier = startRefcountVerifier(img, *v)
+	}
+
+	img.openStats.Total = time.Since(openStart)
 	return img, nil
 }
 
@@ -364,21 +683,9 @@ func (img *Image) openExternalDataFile(imagePath string, readOnly bool) error {
 		return ErrExternalDataFileMissing
 	}
 
-	dataPath := img.extensions.ExternalDataFile
-
-	// Validate path
-	if strings.ContainsRune(dataPath, 0) {
-		return fmt.Errorf("qcow2: external data file path contains null byte")
-	}
-	dataPath = strings.TrimSpace(dataPath)
-	if dataPath == "" {
-		return ErrExternalDataFileMissing
-	}
-
-	// Resolve relative paths relative to the image file
-	if !filepath.IsAbs(dataPath) {
-		imgDir := filepath.Dir(imagePath)
-		dataPath = filepath.Join(imgDir, dataPath)
+	dataPath, err := resolveExternalDataPath(imagePath, img.extensions.ExternalDataFile)
+	if err != nil {
+		return err
 	}
 
 	// Open the external data file
@@ -391,11 +698,37 @@ func (img *Image) openExternalDataFile(imagePath string, readOnly bool) error {
 	if err != nil {
 		return fmt.Errorf("qcow2: failed to open external data file %q: %w", dataPath, err)
 	}
+	if !readOnly {
+		_ = markSparse(f)
+	}
 
-	img.externalDataFile = f
+	img.externalDataFile, _, err = openHostFile(f, img.fileWrapper)
+	if err != nil {
+		f.Close()
+		return err
+	}
 	return nil
 }
 
+// resolveExternalDataPath validates an external data file name from the
+// header and resolves it relative to the image file.
+func resolveExternalDataPath(imagePath, dataPath string) (string, error) {
+	if strings.ContainsRune(dataPath, 0) {
+		return "", fmt.Errorf("qcow2: external data file path contains null byte")
+	}
+	dataPath = strings.TrimSpace(dataPath)
+	if dataPath == "" {
+		return "", ErrExternalDataFileMissing
+	}
+
+	// Resolve relative paths relative to the image file
+	if !filepath.IsAbs(dataPath) {
+		imgDir := filepath.Dir(imagePath)
+		dataPath = filepath.Join(imgDir, dataPath)
+	}
+	return dataPath, nil
+}
+
 // markDirty sets the dirty bit in the header.
 func (img *Image) markDirty() error {
 	if img.header.IncompatibleFeatures&IncompatDirtyBit != 0 {
@@ -436,12 +769,14 @@ func (img *Image) loadL1Table() error {
 		return err
 	}
 
+	img.markL1Loaded()
 	return nil
 }
 
 // Size returns the virtual size of the image in bytes.
 func (img *Image) Size() int64 {
-	return int64(img.header.Size)
+	// Atomic, since WithAutoGrow can raise it while others read
+	return int64(atomic.LoadUint64(&img.header.Size))
 }
 
 // ClusterSize returns the cluster size in bytes.
@@ -452,6 +787,26 @@ func (img *Image) ClusterSize() int {
 // ReadAt reads len(p) bytes from the image at offset off.
 // It implements io.ReaderAt.
 func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
+	if img.sched != nil {
+		defer img.sched.track()()
+	}
+	return img.readUntracked(p, off)
+}
+
+// readUntracked is ReadAt without counting as guest I/O for priority
+// scheduling.
+func (img *Image) readUntracked(p []byte, off int64) (n int, err error) {
+	defer func() { img.stats.countRead(n, err) }()
+	if img.forensic != nil {
+		return img.readAtForensic(p, off)
+	}
+	return img.readAt(p, off)
+}
+
+func (img *Image) readAt(p []byte, off int64) (n int, err error) {
+	if img.closed.Load() {
+		return 0, ErrClosed
+	}
 	if off < 0 {
 		return 0, ErrOffsetOutOfRange
 	}
@@ -466,14 +821,24 @@ func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
 		p = p[:size-off]
 	}
 
+	dataFile := img.dataFile()
 	for len(p) > 0 {
-		// Calculate how much we can read in this cluster
+		// Calculate how much we can read in this cluster (subcluster on
+		// extended L2 images, where each subcluster has its own state)
 		clusterOff := uint64(off) & img.offsetMask
-		toRead := img.clusterSize - clusterOff
+		toRead := img.subclusterSize - clusterOff%img.subclusterSize
 		if toRead > uint64(len(p)) {
 			toRead = uint64(len(p))
 		}
 
+		// Clusters waiting for delayed allocation exist only in memory
+		if img.delayed != nil && img.readDelayed(p[:toRead], uint64(off)) {
+			n += int(toRead)
+			p = p[toRead:]
+			off += int64(toRead)
+			continue
+		}
+
 		// Translate virtual offset to cluster info
 		info, err := img.translate(uint64(off))
 		if err != nil {
@@ -482,6 +847,13 @@ func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
 
 		switch info.ctype {
 		case clusterNormal:
+			// Verify the whole host cluster before handing out any of it
+			if img.checksums != nil {
+				if err := img.verifyChecksum(info.physOff &^ img.offsetMask); err != nil {
+					return n, err
+				}
+			}
+
 			// Read from allocated cluster (use dataFile for external data file support)
 			switch img.header.EncryptMethod {
 			case EncryptionAES:
@@ -499,8 +871,26 @@ func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
 					return n, err
 				}
 			default:
-				// Normal unencrypted read
-				read, err := img.dataFile().ReadAt(p[:toRead], int64(info.physOff))
+				if img.dataCache != nil && info.physOff+toRead > uint64(len(img.mmapData)) {
+					read, err := img.readCachedData(p[:toRead], info.physOff)
+					n += read
+					if err != nil {
+						return n, err
+					}
+					break
+				}
+
+				// Normal unencrypted read, extended over following clusters
+				// that are contiguous on the host so it is a single syscall
+				toRead, err = img.extendNormalRun(p, uint64(off), info.physOff, toRead)
+				if err != nil {
+					return n, err
+				}
+				if info.physOff+toRead <= uint64(len(img.mmapData)) {
+					n += copy(p[:toRead], img.mmapData[info.physOff:])
+					break
+				}
+				read, err := dataFile.ReadAt(p[:toRead], int64(info.physOff))
 				n += read
 				if err != nil {
 					return n, err
@@ -509,9 +899,7 @@ func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
 
 		case clusterZero:
 			// Zero cluster - return zeros without disk I/O
-			for i := uint64(0); i < toRead; i++ {
-				p[i] = 0
-			}
+			clear(p[:toRead])
 			n += int(toRead)
 
 		case clusterUnallocated:
@@ -524,30 +912,26 @@ func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
 				}
 			} else {
 				// Zero fill
-				for i := uint64(0); i < toRead; i++ {
-					p[i] = 0
-				}
+				clear(p[:toRead])
 				n += int(toRead)
 			}
 
 		case clusterCompressed:
-			// Get decompressed cluster data (from cache or decompress)
-			clusterStart := uint64(off) & ^img.offsetMask
+			// Copy straight out of the decompressed cluster cache, or
+			// decompress and cache it on a miss
+			clusterOff := uint64(off) & img.offsetMask
 			cacheKey := info.l2Entry // Use L2 entry as cache key
 
-			decompressed := img.compressedCache.get(cacheKey)
-			if decompressed == nil {
-				var err error
-				decompressed, err = img.decompressCluster(info.l2Entry)
-				if err != nil {
+			if !img.compressedCache.readAt(cacheKey, p[:toRead], clusterOff) {
+				decompressed := img.getClusterBuffer()
+				if err := img.decompressCluster(info.l2Entry, decompressed); err != nil {
+					img.putClusterBuffer(decompressed)
 					return n, err
 				}
 				img.compressedCache.put(cacheKey, decompressed)
+				copy(p[:toRead], decompressed[clusterOff:clusterOff+toRead])
+				img.putClusterBuffer(decompressed)
 			}
-
-			// Read from decompressed data
-			clusterOff := uint64(off) - clusterStart
-			copy(p[:toRead], decompressed[clusterOff:clusterOff+toRead])
 			n += int(toRead)
 		}
 
@@ -558,9 +942,69 @@ func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
 	return n, nil
 }
 
+// WriteError reports a write that stopped before all of its data was
+// written. Written is the count WriteAt returned alongside it.
+type WriteError struct {
+	Off     int64 // Guest offset the write started at
+	Written int   // Leading bytes of the write that landed
+	Err     error // Why the write stopped
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("qcow2: write at offset %d stopped after %d bytes: %v", e.Off, e.Written, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// writeStopped wraps the error that stopped a write at off after n bytes.
+// Anything may have changed on disk by then, so the image is marked as
+// needing a sync.
+func (img *Image) writeStopped(off int64, n int, err error) error {
+	img.dirty.Store(true)
+	return &WriteError{Off: off, Written: n, Err: err}
+}
+
 // WriteAt writes len(p) bytes to the image at offset off.
 // It implements io.WriterAt.
+//
+// If the write stops early, the error is a *WriteError and n counts the
+// leading bytes of p that were written: reading them back returns the new
+// data, and they become durable on the next Flush like any other write. A
+// write extending past the end of the image writes what fits and stops with
+// ErrShortWrite. Beyond the first n bytes, the range being written when the
+// error occurred may read back as old data, new data or a mix of the two;
+// the rest of p is untouched. The image metadata stays consistent. At
+// worst, host clusters allocated for the unwritten part are leaked, which
+// Check reports and Repair reclaims.
 func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
+	if img.sched != nil {
+		defer img.sched.track()()
+	}
+	return img.writeUntracked(p, off)
+}
+
+// writeUntracked is WriteAt without counting as guest I/O for priority
+// scheduling.
+func (img *Image) writeUntracked(p []byte, off int64) (n int, err error) {
+	defer func() { img.stats.countWrite(n, err) }()
+	defer img.lockRange(off, int64(len(p)))()
+	if img.writer == nil {
+		return img.writeAt(p, off)
+	}
+	err = img.writer.do(func() error {
+		n, err = img.writeAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+// writeAt is WriteAt for callers on the writer goroutine, if there is one.
+func (img *Image) writeAt(p []byte, off int64) (n int, err error) {
+	if img.closed.Load() {
+		return 0, ErrClosed
+	}
 	if img.readOnly {
 		return 0, ErrReadOnly
 	}
@@ -571,6 +1015,12 @@ func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
 	if img.extendedL2 {
 		return 0, fmt.Errorf("qcow2: writing to extended L2 images (subcluster allocation) is not yet supported")
 	}
+	if err := img.autoGrowFor(off, len(p)); err != nil {
+		return 0, img.writeStopped(off, 0, err)
+	}
+
+	// Record what was written once it has landed, for FlushAt
+	defer func(off int64) { img.unsynced.addWrite(off, int64(n)) }(off)
 
 	// Check encryption support
 	switch img.header.EncryptMethod {
@@ -579,7 +1029,7 @@ func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
 	case EncryptionLUKS:
 		// LUKS encryption supported - use encrypted write path
 		if img.luksDecryptor == nil {
-			return 0, fmt.Errorf("qcow2: LUKS encrypted image requires password (call SetPasswordLUKS)")
+			return 0, fmt.Errorf("qcow2: LUKS encrypted image requires a key (call UnlockLUKS)")
 		}
 		return img.writeAtLUKS(p, off)
 	default:
@@ -597,7 +1047,8 @@ func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
 	}
 
 	// Clamp write to image size
-	if off+int64(len(p)) > size {
+	start, short := off, off+int64(len(p)) > size
+	if short {
 		p = p[:size-off]
 	}
 
@@ -605,12 +1056,41 @@ func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
 	// This marks them as in-use so consumers know they're stale
 	if !img.bitmapsInvalidated && img.hasBitmaps() {
 		if err := img.invalidateBitmaps(); err != nil {
-			return 0, fmt.Errorf("qcow2: failed to invalidate bitmaps: %w", err)
+			return 0, img.writeStopped(start, 0, fmt.Errorf("qcow2: failed to invalidate bitmaps: %w", err))
 		}
 		img.bitmapsInvalidated = true
 	}
 
+	delayed := img.delayedActive()
 	for len(p) > 0 {
+		// Unallocated clusters are buffered until the next flush in
+		// delayed allocation mode
+		if delayed {
+			toWrite := min(img.clusterSize-uint64(off)&img.offsetMask, uint64(len(p)))
+			buffered, err := img.writeDelayed(p[:toWrite], off)
+			if err != nil {
+				return n, img.writeStopped(start, n, err)
+			}
+			if buffered {
+				n += int(toWrite)
+				p = p[toWrite:]
+				off += int64(toWrite)
+				continue
+			}
+		}
+
+		// Runs of unallocated clusters are allocated and written in one go
+		runWritten, err := img.writeRun(p, off)
+		if err != nil {
+			return n, img.writeStopped(start, n, err)
+		}
+		if runWritten > 0 {
+			n += runWritten
+			p = p[runWritten:]
+			off += int64(runWritten)
+			continue
+		}
+
 		// Calculate how much we can write in this cluster
 		clusterOff := uint64(off) & img.offsetMask
 		toWrite := img.clusterSize - clusterOff
@@ -618,17 +1098,26 @@ func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
 			toWrite = uint64(len(p))
 		}
 
-		// Get or allocate physical cluster
-		physOff, err := img.getClusterForWrite(uint64(off))
+		// Get or allocate physical cluster; a newly allocated cluster is
+		// filled straight from p when the write covers all of it
+		var cover []byte
+		if toWrite == img.clusterSize {
+			cover = p[:toWrite]
+		}
+		physOff, written, err := img.getClusterForWrite(uint64(off), cover)
 		if err != nil {
-			return n, err
+			return n, img.writeStopped(start, n, err)
 		}
 
 		// Write to allocated cluster (use dataFile for external data file support)
-		written, err := img.dataFile().WriteAt(p[:toWrite], int64(physOff))
-		n += written
-		if err != nil {
-			return n, err
+		if written {
+			n += int(toWrite)
+		} else {
+			written, err := img.writeDataAt(p[:toWrite], physOff)
+			n += written
+			if err != nil {
+				return n, img.writeStopped(start, n, err)
+			}
 		}
 
 		p = p[toWrite:]
@@ -636,9 +1125,54 @@ func (img *Image) WriteAt(p []byte, off int64) (n int, err error) {
 	}
 
 	img.dirty.Store(true)
+	if short {
+		return n, &WriteError{Off: start, Written: n, Err: ErrShortWrite}
+	}
 	return n, nil
 }
 
+// writeDataAt writes guest data to the data file at physOff, keeping the
+// checksum sidecar up to date if there is one and dropping any cached copy.
+func (img *Image) writeDataAt(p []byte, physOff uint64) (int, error) {
+	defer img.dataWritten(physOff, uint64(len(p)))
+	if img.checksums != nil {
+		return img.writeChecksummed(p, physOff)
+	}
+	return img.dataFile().WriteAt(p, int64(physOff))
+}
+
+// dataWritten drops any cached copy of the host data at [physOff,
+// physOff+length) once it has changed on disk. Everything that writes,
+// zeroes or punches data clusters other than through writeDataAt must call
+// it, as must allocation, since a reused cluster may still be cached from
+// its previous life.
+func (img *Image) dataWritten(physOff, length uint64) {
+	if img.dataCache != nil {
+		img.dataCache.invalidate(physOff, length, img.clusterSize)
+	}
+}
+
+// readCachedData reads len(p) bytes of an unencrypted data cluster at host
+// offset physOff through the data cluster cache. p must not cross a cluster
+// boundary.
+func (img *Image) readCachedData(p []byte, physOff uint64) (int, error) {
+	clusterStart := physOff &^ img.offsetMask
+	pos := physOff & img.offsetMask
+	if img.dataCache.readAt(clusterStart, p, pos) {
+		return len(p), nil
+	}
+
+	gen := img.dataCache.generation()
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	if _, err := img.dataFile().ReadAt(buf, int64(clusterStart)); err != nil {
+		// A short cluster at the end of the file is read directly, uncached
+		return img.dataFile().ReadAt(p, int64(physOff))
+	}
+	img.dataCache.put(clusterStart, buf, gen)
+	return copy(p, buf[pos:]), nil
+}
+
 // writeAtLUKS handles writes to LUKS-encrypted images.
 // It encrypts data before writing and handles partial cluster writes correctly.
 func (img *Image) writeAtLUKS(p []byte, off int64) (n int, err error) {
@@ -652,14 +1186,15 @@ func (img *Image) writeAtLUKS(p []byte, off int64) (n int, err error) {
 	}
 
 	// Clamp write to image size
-	if off+int64(len(p)) > size {
+	start, short := off, off+int64(len(p)) > size
+	if short {
 		p = p[:size-off]
 	}
 
 	// Invalidate any persistent bitmaps on first write
 	if !img.bitmapsInvalidated && img.hasBitmaps() {
 		if err := img.invalidateBitmaps(); err != nil {
-			return 0, fmt.Errorf("qcow2: failed to invalidate bitmaps: %w", err)
+			return 0, img.writeStopped(start, 0, fmt.Errorf("qcow2: failed to invalidate bitmaps: %w", err))
 		}
 		img.bitmapsInvalidated = true
 	}
@@ -672,24 +1207,38 @@ func (img *Image) writeAtLUKS(p []byte, off int64) (n int, err error) {
 			toWrite = uint64(len(p))
 		}
 
-		// Check if cluster was previously allocated (before getClusterForWrite may allocate it)
-		wasAllocated := img.isClusterAllocated(uint64(off))
+		// Where the rest of a partially written cluster comes from, looked
+		// up before getClusterForWrite may allocate it
+		info, err := img.translate(uint64(off))
+		if err != nil {
+			return n, img.writeStopped(start, n, err)
+		}
 
 		// Get or allocate physical cluster
-		physOff, err := img.getClusterForWrite(uint64(off))
+		physOff, _, err := img.getClusterForWrite(uint64(off), nil)
 		if err != nil {
-			return n, err
+			return n, img.writeStopped(start, n, err)
 		}
 
-		// For LUKS: handle encryption
-		// isNewCluster means the cluster was NOT previously allocated
-		isNewCluster := !wasAllocated
-
 		// Write encrypted data
-		written, err := img.writeLUKSEncrypted(p[:toWrite], physOff, isNewCluster)
+		var lock *sync.Mutex
+		if img.checksums != nil {
+			lock = img.checksums.clusterLock(physOff)
+			lock.Lock()
+		}
+
+		written, err := img.writeLUKSEncrypted(p[:toWrite], physOff, uint64(off), info.ctype)
 		n += written
+
+		// Checksums cover the encrypted host bytes, so always read back
+		if err == nil && img.checksums != nil {
+			err = img.updateChecksum(physOff&^img.offsetMask, nil)
+		}
+		if lock != nil {
+			lock.Unlock()
+		}
 		if err != nil {
-			return n, err
+			return n, img.writeStopped(start, n, err)
 		}
 
 		p = p[toWrite:]
@@ -697,14 +1246,43 @@ func (img *Image) writeAtLUKS(p []byte, off int64) (n int, err error) {
 	}
 
 	img.dirty.Store(true)
+	if short {
+		return n, &WriteError{Off: start, Written: n, Err: ErrShortWrite}
+	}
 	return n, nil
 }
 
+// extendNormalRun grows a read of toRead bytes at virtual offset off, which
+// maps to host offset physOff, over the following clusters (subclusters on
+// extended L2 images) while they are normal and contiguous on the host. Returns the new length,
+// capped at len(p).
+func (img *Image) extendNormalRun(p []byte, off, physOff, toRead uint64) (uint64, error) {
+	for toRead < uint64(len(p)) {
+		next, err := img.translate(off + toRead)
+		if err != nil {
+			return 0, err
+		}
+		if next.ctype != clusterNormal || next.physOff != physOff+toRead {
+			break
+		}
+		if img.checksums != nil && next.physOff&img.offsetMask == 0 {
+			if err := img.verifyChecksum(next.physOff); err != nil {
+				return 0, err
+			}
+		}
+		toRead += min(img.subclusterSize, uint64(len(p))-toRead)
+	}
+	return toRead, nil
+}
+
 // isClusterAllocated checks if a cluster at the given virtual offset is already allocated.
 // This is used to determine if we need to read existing data before a partial write.
 func (img *Image) isClusterAllocated(virtOff uint64) bool {
 	l2Index := (virtOff >> img.clusterBits) & (img.l2Entries - 1)
 	l1Index := virtOff >> (img.clusterBits + img.l2Bits)
+	if err := img.faultL1(l1Index); err != nil {
+		return false
+	}
 
 	// Check L1 bounds
 	if l1Index >= uint64(len(img.l1Table)/8) {
@@ -749,6 +1327,9 @@ type clusterInfo struct {
 
 	// Extended L2 fields (for subcluster-level allocation)
 	extL2Bitmap uint64 // Second 64-bit word of extended L2 entry
+
+	// No L2 table maps the offset, so its whole L2 span is unallocated
+	noL2 bool
 }
 
 // translate converts a virtual offset to cluster information.
@@ -757,36 +1338,42 @@ func (img *Image) translate(virtOff uint64) (clusterInfo, error) {
 	l2Index := (virtOff >> img.clusterBits) & (img.l2Entries - 1)
 	l1Index := virtOff >> (img.clusterBits + img.l2Bits)
 
-	// Check L1 bounds
-	if l1Index >= uint64(img.header.L1Size) {
-		return clusterInfo{ctype: clusterUnallocated}, nil
+	// Read L1 entry, checking bounds under the lock since the table can grow
+	if err := img.faultL1(l1Index); err != nil {
+		return clusterInfo{}, err
 	}
-
-	// Read L1 entry
 	img.l1Mu.RLock()
+	if l1Index >= uint64(len(img.l1Table))/8 {
+		img.l1Mu.RUnlock()
+		return clusterInfo{ctype: clusterUnallocated, noL2: true}, nil
+	}
 	l1Entry := binary.BigEndian.Uint64(img.l1Table[l1Index*8:])
 	img.l1Mu.RUnlock()
 
 	// Extract L2 table offset
 	l2TableOff := l1Entry & L1EntryOffsetMask
 	if l2TableOff == 0 {
-		return clusterInfo{ctype: clusterUnallocated}, nil
-	}
-
-	// Get L2 table (from cache or disk)
-	l2Table, err := img.getL2Table(l2TableOff)
-	if err != nil {
-		return clusterInfo{}, err
+		return clusterInfo{ctype: clusterUnallocated, noL2: true}, nil
 	}
 
-	// Read L2 entry (8 bytes for standard, first 8 of 16 for extended)
+	// Read the L2 entry (8 bytes for standard, 16 for extended) straight out
+	// of the cache; only load the whole table on a miss
+	var raw [16]byte
+	entry := raw[:img.l2EntrySize]
 	entryOffset := l2Index * uint64(img.l2EntrySize)
-	l2Entry := binary.BigEndian.Uint64(l2Table[entryOffset:])
+	if !img.l2Cache.readAt(l2TableOff, entry, entryOffset) {
+		l2Table, err := img.getL2Table(l2TableOff)
+		if err != nil {
+			return clusterInfo{}, err
+		}
+		copy(entry, l2Table[entryOffset:])
+	}
+	l2Entry := binary.BigEndian.Uint64(raw[0:8])
 
 	// Read extended L2 bitmap if applicable
 	var extL2Bitmap uint64
 	if img.extendedL2 {
-		extL2Bitmap = binary.BigEndian.Uint64(l2Table[entryOffset+8:])
+		extL2Bitmap = binary.BigEndian.Uint64(raw[8:16])
 	}
 
 	// Check if compressed (not supported with extended L2 in QEMU)
@@ -859,30 +1446,48 @@ func (img *Image) translateExtendedL2(virtOff uint64, l2Entry uint64, extL2Bitma
 
 // getL2Table retrieves an L2 table, using cache when possible.
 func (img *Image) getL2Table(offset uint64) ([]byte, error) {
+	table := make([]byte, img.clusterSize)
+	if err := img.readL2Table(offset, table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// readL2Table copies the L2 table at offset into table, which must be
+// cluster-sized. Hot paths pass a pooled buffer to avoid allocating a
+// private copy of the table.
+func (img *Image) readL2Table(offset uint64, table []byte) error {
 	// Check cache first
-	if table := img.l2Cache.get(offset); table != nil {
-		return table, nil
+	if img.l2Cache.readAt(offset, table, 0) {
+		return nil
 	}
 
 	// Read from disk
-	table := make([]byte, img.clusterSize)
-	_, err := img.file.ReadAt(table, int64(offset))
-	if err != nil {
-		return nil, fmt.Errorf("qcow2: failed to read L2 table at 0x%x: %w", offset, err)
+	if _, err := img.file.ReadAt(table, int64(offset)); err != nil {
+		return fmt.Errorf("qcow2: failed to read L2 table at 0x%x: %w", offset, err)
+	}
+	if err := img.verifyMetadata(offset, table); err != nil {
+		return fmt.Errorf("qcow2: L2 table at 0x%x: %w", offset, err)
 	}
 
 	// Add to cache
 	img.l2Cache.put(offset, table)
 
-	return table, nil
+	return nil
 }
 
 // getOrAllocateL2Table returns the offset of the L2 table for the given L1 index,
 // allocating a new L2 table if necessary, or COW'ing a shared L2 table.
 func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
-	// Ensure L1 table is large enough
+	// Ensure L1 table is large enough (tables sized by other tools may not
+	// cover the whole virtual disk)
 	if l1Index >= uint64(img.header.L1Size) {
-		return 0, fmt.Errorf("qcow2: write beyond L1 table bounds")
+		if err := img.growL1TableLocked(l1Index + 1); err != nil {
+			return 0, err
+		}
+	}
+	if err := img.faultL1(l1Index); err != nil {
+		return 0, err
 	}
 
 	img.l1Mu.Lock()
@@ -909,21 +1514,20 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 				}
 
 				// Copy L2 table content
-				l2Data := make([]byte, img.clusterSize)
+				l2Data := img.getClusterBuffer()
+				defer img.putClusterBuffer(l2Data)
 				if _, err := img.file.ReadAt(l2Data, int64(l2TableOff)); err != nil {
+					img.releaseClusters(newL2TableOff, 1)
 					return 0, fmt.Errorf("qcow2: failed to read L2 table for COW: %w", err)
 				}
 				if _, err := img.file.WriteAt(l2Data, int64(newL2TableOff)); err != nil {
+					img.releaseClusters(newL2TableOff, 1)
 					return 0, fmt.Errorf("qcow2: failed to write L2 table COW: %w", err)
 				}
 
-				// Decrement refcount for old L2 table
-				if err := img.decrementRefcount(l2TableOff); err != nil {
-					return 0, fmt.Errorf("qcow2: failed to decrement old L2 table refcount: %w", err)
-				}
-
 				// Barrier: ensure L2 table is on disk before L1 points to it
 				if err := img.metadataBarrier(); err != nil {
+					img.releaseClusters(newL2TableOff, 1)
 					return 0, fmt.Errorf("qcow2: L2 table COW barrier failed: %w", err)
 				}
 
@@ -934,6 +1538,8 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 				// Write L1 entry to disk
 				if _, err := img.file.WriteAt(img.l1Table[l1Index*8:l1Index*8+8],
 					int64(img.header.L1TableOffset+l1Index*8)); err != nil {
+					binary.BigEndian.PutUint64(img.l1Table[l1Index*8:], l1Entry)
+					img.releaseClusters(newL2TableOff, 1)
 					return 0, err
 				}
 
@@ -943,6 +1549,12 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 				// Update cache with new L2 table
 				img.l2Cache.put(newL2TableOff, l2Data)
 
+				// Decrement refcount for old L2 table, which L1 no longer
+				// points at
+				if err := img.decrementRefcount(l2TableOff); err != nil {
+					return 0, fmt.Errorf("qcow2: failed to decrement old L2 table refcount: %w", err)
+				}
+
 				return newL2TableOff, nil
 			}
 
@@ -951,6 +1563,7 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 			binary.BigEndian.PutUint64(img.l1Table[l1Index*8:], newL1Entry)
 			if _, err := img.file.WriteAt(img.l1Table[l1Index*8:l1Index*8+8],
 				int64(img.header.L1TableOffset+l1Index*8)); err != nil {
+				binary.BigEndian.PutUint64(img.l1Table[l1Index*8:], l1Entry)
 				return 0, err
 			}
 		}
@@ -970,11 +1583,13 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 	_, writeErr := img.file.WriteAt(zeros, int64(l2TableOff))
 	img.putClusterBuffer(zeros)
 	if writeErr != nil {
+		img.releaseClusters(l2TableOff, 1)
 		return 0, writeErr
 	}
 
 	// Barrier: ensure L2 table is on disk before L1 points to it
 	if err := img.metadataBarrier(); err != nil {
+		img.releaseClusters(l2TableOff, 1)
 		return 0, fmt.Errorf("qcow2: L2 table barrier failed: %w", err)
 	}
 
@@ -985,6 +1600,8 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 	// Write L1 entry to disk
 	if _, err := img.file.WriteAt(img.l1Table[l1Index*8:l1Index*8+8],
 		int64(img.header.L1TableOffset+l1Index*8)); err != nil {
+		binary.BigEndian.PutUint64(img.l1Table[l1Index*8:], l1Entry)
+		img.releaseClusters(l2TableOff, 1)
 		return 0, err
 	}
 
@@ -999,7 +1616,12 @@ func (img *Image) getOrAllocateL2Table(l1Index uint64) (uint64, error) {
 // getClusterForWrite returns the physical offset for writing.
 // Allocates a new cluster if needed, or performs COW if the cluster is shared.
 // Handles compressed and zero-flagged clusters by decompressing/allocating as needed.
-func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
+//
+// cover, if non-nil, is a write of the whole cluster. A newly allocated
+// cluster is then filled from cover instead of copying the old or backing
+// data that would be overwritten anyway, and written reports that the caller
+// has nothing left to write.
+func (img *Image) getClusterForWrite(virtOff uint64, cover []byte) (physOff uint64, written bool, err error) {
 	// Serialize cluster allocation and L2 updates to prevent races where
 	// multiple goroutines try to allocate the same cluster concurrently.
 	img.writeMu.Lock()
@@ -1012,13 +1634,14 @@ func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
 	// Get or allocate L2 table
 	l2TableOff, err := img.getOrAllocateL2Table(l1Index)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 
-	// Get L2 table
-	l2Table, err := img.getL2Table(l2TableOff)
-	if err != nil {
-		return 0, err
+	// Get L2 table (the cache keeps its own copy of any updates)
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	if err := img.readL2Table(l2TableOff, l2Table); err != nil {
+		return 0, false, err
 	}
 
 	// Check L2 entry
@@ -1027,17 +1650,22 @@ func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
 	// Handle compressed clusters - must decompress and reallocate
 	isCompressed := l2Entry&L2EntryCompressed != 0
 	if isCompressed {
-		return img.decompressClusterForWrite(virtOff, l2Entry, l2Table, l2TableOff, l2Index)
+		physOff, err := img.decompressClusterForWrite(virtOff, l2Entry, l2Table, l2TableOff, l2Index)
+		return physOff, false, err
 	}
 
 	// Handle zero-flagged clusters - must allocate new cluster
 	isZero := l2Entry&L2EntryZeroFlag != 0
 	if isZero {
-		return img.allocateZeroClusterForWrite(virtOff, l2Entry, l2Table, l2TableOff, l2Index)
+		physOff, err := img.allocateZeroClusterForWrite(virtOff, l2Entry, l2Table, l2TableOff, l2Index)
+		return physOff, false, err
 	}
 
-	physOff := l2Entry & L2EntryOffsetMask
+	physOff = l2Entry & L2EntryOffsetMask
 	isCopied := l2Entry&L2EntryCopied != 0
+	if err := img.checkRawMapping(virtOff, physOff); err != nil {
+		return 0, false, err
+	}
 
 	// Check if we need to allocate or COW
 	needsAlloc := physOff == 0
@@ -1048,9 +1676,13 @@ func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
 		// Check refcount to decide if we need COW
 		refcount, err := img.getRefcount(physOff)
 		if err != nil {
-			return 0, fmt.Errorf("qcow2: failed to get refcount for COW check: %w", err)
+			return 0, false, fmt.Errorf("qcow2: failed to get refcount for COW check: %w", err)
 		}
 		if refcount > 1 {
+			// A copy would have to live somewhere else in the raw file
+			if img.rawExternalData() {
+				return 0, false, fmt.Errorf("%w: cluster at 0x%x is shared", ErrRawDataFile, physOff)
+			}
 			needsCOW = true
 		} else if refcount == 1 {
 			// Refcount is 1, we can safely write and set COPIED flag
@@ -1058,7 +1690,7 @@ func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
 			binary.BigEndian.PutUint64(l2Table[l2Index*8:], newL2Entry)
 			if _, err := img.file.WriteAt(l2Table[l2Index*8:l2Index*8+8],
 				int64(l2TableOff+l2Index*8)); err != nil {
-				return 0, err
+				return 0, false, err
 			}
 			img.l2Cache.put(l2TableOff, l2Table)
 		}
@@ -1068,49 +1700,62 @@ func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
 		oldPhysOff := physOff
 
 		// Allocate new data cluster
-		physOff, err = img.allocateCluster()
+		physOff, err = img.allocateDataCluster(virtOff)
 		if err != nil {
-			return 0, err
+			return 0, false, err
 		}
 
 		// COW: Copy existing data to new cluster
 		dataFile := img.dataFile() // Use external data file if present
-		if needsCOW {
+		if cover != nil {
+			// The write replaces the whole cluster, so put it there directly
+			// rather than copying data it would overwrite. It still lands
+			// ahead of the L2 update.
+			if _, err := img.writeDataAt(cover, physOff); err != nil {
+				img.releaseClusters(physOff, 1)
+				return 0, false, err
+			}
+			written = true
+		} else if needsCOW {
 			// Read from old cluster
-			clusterData := make([]byte, img.clusterSize)
+			clusterData := img.getClusterBuffer()
+			defer img.putClusterBuffer(clusterData)
 			if _, err := dataFile.ReadAt(clusterData, int64(oldPhysOff)); err != nil {
-				return 0, fmt.Errorf("qcow2: COW read failed: %w", err)
+				img.releaseClusters(physOff, 1)
+				return 0, false, fmt.Errorf("qcow2: COW read failed: %w", err)
 			}
 
 			// Write to new cluster
 			if _, err := dataFile.WriteAt(clusterData, int64(physOff)); err != nil {
-				return 0, fmt.Errorf("qcow2: COW write failed: %w", err)
-			}
-
-			// Decrement refcount for old cluster (now one less reference)
-			if err := img.decrementRefcount(oldPhysOff); err != nil {
-				return 0, fmt.Errorf("qcow2: failed to decrement old cluster refcount: %w", err)
+				img.releaseClusters(physOff, 1)
+				return 0, false, fmt.Errorf("qcow2: COW write failed: %w", err)
 			}
-		} else if img.backing != nil {
-			// No existing data but have backing file - copy from backing
+		} else if img.backing != nil && img.header.EncryptMethod != EncryptionLUKS {
+			// No existing data but have backing file - copy from backing.
+			// Encrypted images do this themselves, so plaintext never
+			// lands in the image file
 			clusterStart := virtOff & ^img.offsetMask // Align to cluster boundary
-			clusterData := make([]byte, img.clusterSize)
+			clusterData := img.getClusterBuffer()
+			defer img.putClusterBuffer(clusterData)
 
 			// Read from backing file (may be zeros if unallocated there too)
 			_, err := img.backing.ReadAt(clusterData, int64(clusterStart))
 			if err != nil && err != io.EOF {
-				return 0, fmt.Errorf("qcow2: COW read from backing failed: %w", err)
+				img.releaseClusters(physOff, 1)
+				return 0, false, fmt.Errorf("qcow2: COW read from backing failed: %w", err)
 			}
 
 			// Write the backing data to our new cluster
 			if _, err := dataFile.WriteAt(clusterData, int64(physOff)); err != nil {
-				return 0, fmt.Errorf("qcow2: COW write failed: %w", err)
+				img.releaseClusters(physOff, 1)
+				return 0, false, fmt.Errorf("qcow2: COW write failed: %w", err)
 			}
 		}
 
 		// Barrier: ensure data is on disk before L2 points to it
 		if err := img.dataBarrier(); err != nil {
-			return 0, fmt.Errorf("qcow2: data barrier failed: %w", err)
+			img.releaseClusters(physOff, 1)
+			return 0, false, fmt.Errorf("qcow2: data barrier failed: %w", err)
 		}
 
 		// Update L2 entry with COPIED flag
@@ -1120,33 +1765,51 @@ func (img *Image) getClusterForWrite(virtOff uint64) (uint64, error) {
 		// Write L2 entry to disk
 		if _, err := img.file.WriteAt(l2Table[l2Index*8:l2Index*8+8],
 			int64(l2TableOff+l2Index*8)); err != nil {
-			return 0, err
+			img.releaseClusters(physOff, 1)
+			return 0, false, err
 		}
 
+		// Update cache
+		img.l2Cache.put(l2TableOff, l2Table)
+
 		// Barrier: ensure L2 update is on disk
 		if err := img.metadataBarrier(); err != nil {
-			return 0, fmt.Errorf("qcow2: L2 update barrier failed: %w", err)
+			return 0, false, fmt.Errorf("qcow2: L2 update barrier failed: %w", err)
 		}
 
-		// Update cache
-		img.l2Cache.put(l2TableOff, l2Table)
+		switch {
+		case cover != nil:
+		case needsCOW:
+			img.copiedOnWrite(virtOff, false)
+		case img.backing != nil && img.header.EncryptMethod != EncryptionLUKS:
+			img.copiedOnWrite(virtOff, true)
+		}
+
+		// The old cluster loses its reference only once the L2 table no
+		// longer points at it. If that fails it leaks, which is safe
+		if needsCOW {
+			if err := img.decrementRefcount(oldPhysOff); err != nil {
+				return 0, false, fmt.Errorf("qcow2: failed to decrement old cluster refcount: %w", err)
+			}
+		}
 	}
 
 	// Add intra-cluster offset
-	return physOff + (virtOff & img.offsetMask), nil
+	return physOff + (virtOff & img.offsetMask), written, nil
 }
 
 // decompressClusterForWrite handles writing to a compressed cluster by
 // decompressing it to a new normal cluster.
 func (img *Image) decompressClusterForWrite(virtOff uint64, l2Entry uint64, l2Table []byte, l2TableOff uint64, l2Index uint64) (uint64, error) {
 	// Decompress the cluster
-	decompressed, err := img.decompressCluster(l2Entry)
-	if err != nil {
+	decompressed := img.getClusterBuffer()
+	defer img.putClusterBuffer(decompressed)
+	if err := img.decompressCluster(l2Entry, decompressed); err != nil {
 		return 0, fmt.Errorf("qcow2: failed to decompress cluster for write: %w", err)
 	}
 
 	// Allocate a new normal cluster
-	physOff, err := img.allocateCluster()
+	physOff, err := img.allocateDataCluster(virtOff)
 	if err != nil {
 		return 0, fmt.Errorf("qcow2: failed to allocate cluster for decompressed data: %w", err)
 	}
@@ -1154,11 +1817,13 @@ func (img *Image) decompressClusterForWrite(virtOff uint64, l2Entry uint64, l2Ta
 	// Write the decompressed data to the new cluster
 	dataFile := img.dataFile()
 	if _, err := dataFile.WriteAt(decompressed, int64(physOff)); err != nil {
+		img.releaseClusters(physOff, 1)
 		return 0, fmt.Errorf("qcow2: failed to write decompressed cluster: %w", err)
 	}
 
 	// Barrier: ensure data is on disk before L2 points to it
 	if err := img.dataBarrier(); err != nil {
+		img.releaseClusters(physOff, 1)
 		return 0, fmt.Errorf("qcow2: data barrier failed: %w", err)
 	}
 
@@ -1169,18 +1834,19 @@ func (img *Image) decompressClusterForWrite(virtOff uint64, l2Entry uint64, l2Ta
 	// Write L2 entry to disk
 	if _, err := img.file.WriteAt(l2Table[l2Index*8:l2Index*8+8],
 		int64(l2TableOff+l2Index*8)); err != nil {
+		img.releaseClusters(physOff, 1)
 		return 0, fmt.Errorf("qcow2: failed to write L2 entry: %w", err)
 	}
 
+	// Update cache and invalidate compressed cache entry
+	img.l2Cache.put(l2TableOff, l2Table)
+	img.compressedCache.cache.invalidate(l2Entry) // Invalidate old compressed cache entry
+
 	// Barrier: ensure L2 update is on disk
 	if err := img.metadataBarrier(); err != nil {
 		return 0, fmt.Errorf("qcow2: L2 update barrier failed: %w", err)
 	}
 
-	// Update cache and invalidate compressed cache entry
-	img.l2Cache.put(l2TableOff, l2Table)
-	img.compressedCache.cache.invalidate(l2Entry) // Invalidate old compressed cache entry
-
 	// Return offset with intra-cluster offset
 	return physOff + (virtOff & img.offsetMask), nil
 }
@@ -1191,30 +1857,24 @@ func (img *Image) allocateZeroClusterForWrite(virtOff uint64, l2Entry uint64, l2
 	oldPhysOff := l2Entry & L2EntryOffsetMask
 
 	// Allocate a new cluster
-	physOff, err := img.allocateCluster()
+	physOff, err := img.allocateDataCluster(virtOff)
 	if err != nil {
 		return 0, fmt.Errorf("qcow2: failed to allocate cluster for zero write: %w", err)
 	}
 
-	// For ZERO_ALLOC (has old offset), decrement the old refcount
-	// For ZERO_PLAIN (no offset), nothing to decrement
-	if oldPhysOff != 0 {
-		if err := img.decrementRefcount(oldPhysOff); err != nil {
-			return 0, fmt.Errorf("qcow2: failed to decrement old zero-alloc cluster refcount: %w", err)
-		}
-	}
-
 	// Initialize the new cluster with zeros (caller will overwrite partially)
 	dataFile := img.dataFile()
 	zeros := img.getZeroedClusterBuffer()
 	if _, err := dataFile.WriteAt(zeros, int64(physOff)); err != nil {
 		img.putClusterBuffer(zeros)
+		img.releaseClusters(physOff, 1)
 		return 0, fmt.Errorf("qcow2: failed to zero new cluster: %w", err)
 	}
 	img.putClusterBuffer(zeros)
 
 	// Barrier: ensure data is on disk before L2 points to it
 	if err := img.dataBarrier(); err != nil {
+		img.releaseClusters(physOff, 1)
 		return 0, fmt.Errorf("qcow2: data barrier failed: %w", err)
 	}
 
@@ -1225,16 +1885,26 @@ func (img *Image) allocateZeroClusterForWrite(virtOff uint64, l2Entry uint64, l2
 	// Write L2 entry to disk
 	if _, err := img.file.WriteAt(l2Table[l2Index*8:l2Index*8+8],
 		int64(l2TableOff+l2Index*8)); err != nil {
+		img.releaseClusters(physOff, 1)
 		return 0, fmt.Errorf("qcow2: failed to write L2 entry: %w", err)
 	}
 
+	// Update cache
+	img.l2Cache.put(l2TableOff, l2Table)
+
 	// Barrier: ensure L2 update is on disk
 	if err := img.metadataBarrier(); err != nil {
 		return 0, fmt.Errorf("qcow2: L2 update barrier failed: %w", err)
 	}
 
-	// Update cache
-	img.l2Cache.put(l2TableOff, l2Table)
+	// For ZERO_ALLOC (has old offset), decrement the old refcount once the
+	// L2 entry no longer points at it. For ZERO_PLAIN (no offset), nothing
+	// to decrement
+	if oldPhysOff != 0 {
+		if err := img.decrementRefcount(oldPhysOff); err != nil {
+			return 0, fmt.Errorf("qcow2: failed to decrement old zero-alloc cluster refcount: %w", err)
+		}
+	}
 
 	// Return offset with intra-cluster offset
 	return physOff + (virtOff & img.offsetMask), nil
@@ -1254,8 +1924,10 @@ func (img *Image) allocateCluster() (uint64, error) {
 		// Free cluster bitmap tracks qcow2 file, not external data file
 		if offset, found := img.findFreeCluster(); found {
 			// Zero the cluster before reuse
-			zeros := make([]byte, img.clusterSize)
-			if _, err := dataFile.WriteAt(zeros, int64(offset)); err != nil {
+			zeros := img.getZeroedClusterBuffer()
+			_, err := dataFile.WriteAt(zeros, int64(offset))
+			img.putClusterBuffer(zeros)
+			if err != nil {
 				return 0, err
 			}
 
@@ -1264,6 +1936,8 @@ func (img *Image) allocateCluster() (uint64, error) {
 				return 0, fmt.Errorf("qcow2: failed to update refcount for reused cluster: %w", err)
 			}
 
+			img.dataWritten(offset, img.clusterSize)
+			img.allocated(offset, img.clusterSize, AllocData, true)
 			return offset, nil
 		}
 	}
@@ -1281,7 +1955,10 @@ func (img *Image) allocateCluster() (uint64, error) {
 	}
 
 	// Extend file
-	if err := dataFile.Truncate(int64(offset + img.clusterSize)); err != nil {
+	if err := img.checkQuota(dataFile, offset+img.clusterSize); err != nil {
+		return 0, err
+	}
+	if err := img.growFile(dataFile, info.Size(), offset+img.clusterSize); err != nil {
 		return 0, err
 	}
 
@@ -1296,9 +1973,23 @@ func (img *Image) allocateCluster() (uint64, error) {
 		return 0, fmt.Errorf("qcow2: failed to update refcount for new cluster: %w", err)
 	}
 
+	// The file may have been shorter once than it is now
+	img.dataWritten(offset, img.clusterSize)
+	img.allocated(offset, img.clusterSize, AllocData, false)
 	return offset, nil
 }
 
+// releaseClusters gives back n clusters from offset that were allocated but
+// never became reachable because a later step of the write failed, so the
+// failed write does not leak them. Undoing is best effort: if a refcount
+// cannot be lowered either, the cluster stays allocated and Check reports
+// it as a leak.
+func (img *Image) releaseClusters(offset, n uint64) {
+	for i := uint64(0); i < n; i++ {
+		_ = img.decrementRefcount(offset + i*img.clusterSize)
+	}
+}
+
 // allocateMetadataCluster allocates a new cluster for metadata (L2 tables, snapshot data, etc).
 // Metadata is always allocated in the main qcow2 file, never in external data files.
 func (img *Image) allocateMetadataCluster() (uint64, error) {
@@ -1307,8 +1998,10 @@ func (img *Image) allocateMetadataCluster() (uint64, error) {
 		// Try to find a free cluster first
 		if offset, found := img.findFreeCluster(); found {
 			// Zero the cluster before reuse
-			zeros := make([]byte, img.clusterSize)
-			if _, err := img.file.WriteAt(zeros, int64(offset)); err != nil {
+			zeros := img.getZeroedClusterBuffer()
+			_, err := img.file.WriteAt(zeros, int64(offset))
+			img.putClusterBuffer(zeros)
+			if err != nil {
 				return 0, err
 			}
 
@@ -1317,6 +2010,7 @@ func (img *Image) allocateMetadataCluster() (uint64, error) {
 				return 0, fmt.Errorf("qcow2: failed to update refcount for reused cluster: %w", err)
 			}
 
+			img.allocated(offset, img.clusterSize, AllocMetadata, true)
 			return offset, nil
 		}
 	}
@@ -1334,7 +2028,10 @@ func (img *Image) allocateMetadataCluster() (uint64, error) {
 	}
 
 	// Extend file
-	if err := img.file.Truncate(int64(offset + img.clusterSize)); err != nil {
+	if err := img.checkQuota(img.file, offset+img.clusterSize); err != nil {
+		return 0, err
+	}
+	if err := img.growFile(img.file, info.Size(), offset+img.clusterSize); err != nil {
 		return 0, err
 	}
 
@@ -1349,6 +2046,7 @@ func (img *Image) allocateMetadataCluster() (uint64, error) {
 		return 0, fmt.Errorf("qcow2: failed to update refcount for new cluster: %w", err)
 	}
 
+	img.allocated(offset, img.clusterSize, AllocMetadata, false)
 	return offset, nil
 }
 
@@ -1392,6 +2090,12 @@ func (img *Image) buildFreeBitmap() {
 // findFreeCluster searches for a cluster with refcount == 0 using O(1) bitmap lookup.
 // Returns the cluster offset and true if found, or 0 and false if none available.
 func (img *Image) findFreeCluster() (uint64, bool) {
+	// Until the whole L1 table is read, free clusters cannot be told apart
+	// from L2 tables with broken refcounts
+	if img.reusePolicy == ReuseAppendOnly || !img.l1Loaded() {
+		return 0, false
+	}
+
 	// Build bitmap lazily on first use
 	img.freeBitmapOnce.Do(img.buildFreeBitmap)
 
@@ -1399,8 +2103,14 @@ func (img *Image) findFreeCluster() (uint64, bool) {
 		return 0, false
 	}
 
-	// O(1) lookup using bitmap
-	clusterIdx, found := img.freeBitmap.findFree()
+	// O(1) lookup using bitmap; best fit scans it for the shortest run
+	var clusterIdx uint64
+	var found bool
+	if img.reusePolicy == ReuseBestFit {
+		clusterIdx, found = img.freeBitmap.findBestFit()
+	} else {
+		clusterIdx, found = img.freeBitmap.findFree()
+	}
 	if !found {
 		return 0, false
 	}
@@ -1535,7 +2245,8 @@ func (img *Image) CheckOverlap(hostOffset uint64) OverlapCheckResult {
 		return OverlapCheckResult{Overlaps: true, MetadataType: "refcount_table", MetadataOffset: img.header.RefcountTableOffset}
 	}
 
-	// L2 tables
+	// L2 tables; a read error leaves the unread part of the table empty
+	_ = img.faultAllL1()
 	if len(img.l1Table) > 0 {
 		l1Entries := uint64(img.header.L1Size)
 		for i := uint64(0); i < l1Entries; i++ {
@@ -1571,7 +2282,64 @@ func (img *Image) CheckOverlap(hostOffset uint64) OverlapCheckResult {
 
 // Flush syncs all pending writes to disk.
 func (img *Image) Flush() error {
-	if img.dirty.Load() || img.pendingSync {
+	img.stats.count(&img.stats.flushes, 1)
+	return img.serialize(img.flush)
+}
+
+func (img *Image) flush() error {
+	if img.closed.Load() {
+		return ErrClosed
+	}
+	if err := img.flushDelayed(); err != nil {
+		return err
+	}
+	if err := img.writebackRefcountPin(); err != nil {
+		return err
+	}
+	if err := img.syncFiles(); err != nil {
+		return err
+	}
+	return img.commitMetadataChecksums()
+}
+
+// flushLocked is Flush for callers holding writeMu.
+func (img *Image) flushLocked() error {
+	if err := img.flushDelayedLocked(); err != nil {
+		return err
+	}
+	if err := img.writebackRefcountPin(); err != nil {
+		return err
+	}
+	if err := img.syncFiles(); err != nil {
+		return err
+	}
+	if img.metaChecksums == nil || img.readOnly {
+		return nil
+	}
+	return img.commitMetadataChecksumsLocked()
+}
+
+// syncFiles syncs the image's files if anything was written since the last
+// sync.
+func (img *Image) syncFiles() (err error) {
+	synced := img.unsynced.beginSync()
+	defer func() { img.unsynced.endSync(synced, err) }()
+
+	// Clear the flags before syncing, so a write landing during the sync
+	// sets them again for the next one. Ranges taken for FlushAt are synced
+	// even if a concurrent sync cleared the flags before their write set
+	// them.
+	dirty := img.dirty.Swap(false)
+	pending := img.pendingSync.Swap(false)
+	if dirty || pending || synced.all || len(synced.ranges) > 0 {
+		defer func() {
+			if err != nil {
+				img.dirty.Store(true)
+				if pending {
+					img.pendingSync.Store(true)
+				}
+			}
+		}()
 		// Sync external data file first if present
 		if img.externalDataFile != nil {
 			if err := img.externalDataFile.Sync(); err != nil {
@@ -1582,43 +2350,124 @@ func (img *Image) Flush() error {
 		if err := img.file.Sync(); err != nil {
 			return err
 		}
-		img.dirty.Store(false)
-		img.pendingSync = false
+		if img.checksums != nil {
+			if err := img.checksums.sync(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-// Close closes the image file.
-// On clean close, the dirty bit is cleared (unless lazy refcounts are enabled,
-// in which case the image stays dirty and refcounts are rebuilt on next open).
+// Close flushes the image and closes its files, along with its backing
+// chain and sidecars. On a clean flush the dirty bit is cleared, unless
+// lazy refcounts are enabled, in which case the image stays dirty and
+// refcounts are rebuilt on next open.
+//
+// Close releases everything even when a step fails, and returns all
+// failures joined. Afterwards the image reports Closed, its I/O methods
+// return ErrClosed, and further calls to Close return nil.
 func (img *Image) Close() error {
-	if err := img.Flush(); err != nil {
+	if img.writer == nil {
+		return img.close()
+	}
+	if err := img.writer.stop(img.close); err != ErrClosed {
 		return err
 	}
+	return nil
+}
+
+func (img *Image) close() error {
+	if img.closed.Load() {
+		return nil
+	}
+	if img.verifier != nil {
+		img.verifier.close()
+	}
 
-	// Clear dirty bit on clean close (v3 only, RW only)
-	// Skip if lazy refcounts is enabled - keep dirty bit for refcount rebuild
-	if !img.readOnly && img.header.Version >= Version3 && !img.lazyRefcounts {
-		if err := img.clearDirty(); err != nil {
-			// Log but don't fail - data is already flushed
-			// The image will just need repair on next open
+	var errs []error
+	if err := img.flush(); err != nil {
+		errs = append(errs, fmt.Errorf("qcow2: failed to flush on close: %w", err))
+	} else if !img.readOnly {
+		if img.trimOnClose {
+			if _, err := img.TrimTail(); err != nil {
+				errs = append(errs, fmt.Errorf("qcow2: failed to trim file on close: %w", err))
+			}
+		}
+		// The dirty bit is only cleared after a clean flush; otherwise it
+		// stays, so the image is repaired on next open
+		if img.header.Version >= Version3 && !img.lazyRefcounts {
+			if err := img.clearDirty(); err != nil {
+				errs = append(errs, fmt.Errorf("qcow2: failed to clear dirty bit: %w", err))
+			}
 		}
 	}
+	img.closed.Store(true)
 
 	if img.backing != nil {
 		if err := img.backing.Close(); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
 	// Close external data file if present
 	if img.externalDataFile != nil {
 		if err := img.externalDataFile.Close(); err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
 
-	return img.file.Close()
+	if img.checksums != nil {
+		if err := img.checksums.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if img.metaChecksums != nil {
+		if err := img.metaChecksums.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if img.mmapData != nil {
+		if err := munmapFile(img.mmapData); err != nil {
+			errs = append(errs, err)
+		}
+		img.mmapData = nil
+	}
+
+	if err := img.file.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// abandon releases what a failed newImage opened besides the image file,
+// which the caller closes. Nothing is flushed, and a dirty bit set by the
+// open stays, so the next open repairs whatever the open began.
+func (img *Image) abandon() {
+	img.closed.Store(true)
+	if img.backing != nil {
+		img.backing.Close()
+	}
+	if img.externalDataFile != nil {
+		img.externalDataFile.Close()
+	}
+	if img.checksums != nil {
+		img.checksums.close()
+	}
+	if img.metaChecksums != nil {
+		img.metaChecksums.close()
+	}
+	if img.mmapData != nil {
+		munmapFile(img.mmapData)
+		img.mmapData = nil
+	}
+}
+
+// Closed reports whether Close has been called.
+func (img *Image) Closed() bool {
+	return img.closed.Load()
 }
 
 // Header returns the image header (read-only).
@@ -1643,17 +2492,33 @@ func (img *Image) RefcountCacheStats() CacheStats {
 	return img.refcountBlockCache.stats()
 }
 
+// DataCacheStats returns statistics about the data cluster cache enabled by
+// WithDataCacheSize. It returns zero stats if the cache is disabled.
+func (img *Image) DataCacheStats() CacheStats {
+	if img.dataCache == nil {
+		return CacheStats{}
+	}
+	return img.dataCache.cache.stats()
+}
+
 // ResetCacheStats resets all cache statistics counters to zero.
 // Useful for measuring cache performance over a specific workload.
 func (img *Image) ResetCacheStats() {
 	img.l2Cache.resetStats()
 	img.refcountBlockCache.resetStats()
+	if img.dataCache != nil {
+		img.dataCache.cache.resetStats()
+	}
 }
 
 // WriteZeroAt writes zeros efficiently using the zero cluster flag.
 // This avoids allocating storage for all-zero data.
 // It writes zeros from offset off for length bytes.
 // Uses ZeroPlain mode which deallocates clusters.
+//
+// On extended L2 images whole subclusters are zeroed through the L2 zero
+// bitmap. Ranges that start or end mid-subcluster are only supported where
+// the subcluster already reads as zeros or is allocated in place.
 func (img *Image) WriteZeroAt(off int64, length int64) error {
 	return img.WriteZeroAtMode(off, length, ZeroPlain)
 }
@@ -1661,16 +2526,27 @@ func (img *Image) WriteZeroAt(off int64, length int64) error {
 // WriteZeroAtMode writes zeros with the specified zero mode.
 // ZeroPlain deallocates clusters for space efficiency.
 // ZeroAlloc keeps clusters allocated (useful for preallocated images).
+//
+// Images with a raw external data file always behave as ZeroAlloc, and the
+// zeros are also written to the data file so it stays usable on its own.
 func (img *Image) WriteZeroAtMode(off int64, length int64, mode ZeroMode) error {
+	defer img.lockRange(off, length)()
+	err := img.serialize(func() error {
+		return img.writeZeroAt(off, length, mode)
+	})
+	// Clamped, since the size may have changed since the write
+	img.stats.countZero(max(0, min(length, img.Size()-off)), err)
+	return err
+}
+
+func (img *Image) writeZeroAt(off int64, length int64, mode ZeroMode) error {
+	if img.closed.Load() {
+		return ErrClosed
+	}
 	if img.readOnly {
 		return ErrReadOnly
 	}
 
-	// Extended L2 images are read-only for now
-	if img.extendedL2 {
-		return fmt.Errorf("qcow2: writing to extended L2 images (subcluster allocation) is not yet supported")
-	}
-
 	if off < 0 {
 		return ErrOffsetOutOfRange
 	}
@@ -1684,6 +2560,7 @@ func (img *Image) WriteZeroAtMode(off int64, length int64, mode ZeroMode) error
 	if off+length > size {
 		length = size - off
 	}
+	defer img.unsynced.addWrite(off, length)
 
 	// Invalidate any persistent bitmaps on first write
 	if !img.bitmapsInvalidated && img.hasBitmaps() {
@@ -1693,6 +2570,20 @@ func (img *Image) WriteZeroAtMode(off int64, length int64, mode ZeroMode) error
 		img.bitmapsInvalidated = true
 	}
 
+	// A raw data file is read directly, so it has to hold the zeros too; the
+	// clusters stay allocated to keep the 1:1 mapping
+	if img.rawExternalData() {
+		if err := img.zeroRawRange(off, length); err != nil {
+			return err
+		}
+		mode = ZeroAlloc
+	}
+
+	// Extended L2 images zero per subcluster
+	if img.extendedL2 {
+		return img.writeZeroExtended(off, length, mode)
+	}
+
 	for length > 0 {
 		// Calculate cluster boundaries
 		clusterStart := uint64(off) & ^img.offsetMask
@@ -1705,8 +2596,10 @@ func (img *Image) WriteZeroAtMode(off int64, length int64, mode ZeroMode) error
 			if toWrite > uint64(length) {
 				toWrite = uint64(length)
 			}
-			zeros := make([]byte, toWrite)
-			if _, err := img.WriteAt(zeros, off); err != nil {
+			zeros := img.getZeroedClusterBuffer()
+			_, err := img.writeAt(zeros[:toWrite], off)
+			img.putClusterBuffer(zeros)
+			if err != nil {
 				return err
 			}
 			off += int64(toWrite)
@@ -1725,8 +2618,10 @@ func (img *Image) WriteZeroAtMode(off int64, length int64, mode ZeroMode) error
 		}
 
 		// Partial cluster at the end
-		zeros := make([]byte, length)
-		if _, err := img.WriteAt(zeros, off); err != nil {
+		zeros := img.getZeroedClusterBuffer()
+		_, err := img.writeAt(zeros[:length], off)
+		img.putClusterBuffer(zeros)
+		if err != nil {
 			return err
 		}
 		break
@@ -1744,6 +2639,9 @@ func (img *Image) setZeroCluster(virtOff uint64, mode ZeroMode) error {
 	img.writeMu.Lock()
 	defer img.writeMu.Unlock()
 
+	// The zeros replace anything still waiting for delayed allocation
+	img.dropDelayedCluster(virtOff)
+
 	// Calculate L1 and L2 indices
 	l2Index := (virtOff >> img.clusterBits) & (img.l2Entries - 1)
 	l1Index := virtOff >> (img.clusterBits + img.l2Bits)
@@ -1782,7 +2680,7 @@ func (img *Image) setZeroCluster(virtOff uint64, mode ZeroMode) error {
 		if oldOffset == 0 {
 			// Can't use ZeroAlloc on unallocated cluster - allocate first
 			var allocErr error
-			oldOffset, allocErr = img.allocateCluster()
+			oldOffset, allocErr = img.allocateDataCluster(virtOff)
 			if allocErr != nil {
 				return allocErr
 			}
@@ -319,6 +319,51 @@ func TestInvalidMagic(t *testing.T) {
 	}
 }
 
+// TestHeaderFieldErrors checks out of range header fields are rejected
+// with a HeaderFieldError carrying the value and the valid range.
+func TestHeaderFieldErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		off   int
+		value uint32
+		want  error
+		field HeaderFieldError
+	}{
+		{"cluster_bits_small", 20, 8, ErrInvalidClusterBits, HeaderFieldError{Field: "cluster_bits", Value: 8, Min: MinClusterBits, Max: MaxClusterBits}},
+		{"cluster_bits_large", 20, 30, ErrInvalidClusterBits, HeaderFieldError{Field: "cluster_bits", Value: 30, Min: MinClusterBits, Max: MaxClusterBits}},
+		{"refcount_order", 96, 7, ErrInvalidRefcountOrder, HeaderFieldError{Field: "refcount_order", Value: 7, Max: MaxRefcountOrder}},
+		{"header_length_short", 100, 96, ErrInvalidHeaderLength, HeaderFieldError{Field: "header_length", Value: 96, Min: HeaderSizeV3, Max: 65536, Align: 8}},
+		{"header_length_unaligned", 100, 107, ErrInvalidHeaderLength, HeaderFieldError{Field: "header_length", Value: 107, Min: HeaderSizeV3, Max: 65536, Align: 8}},
+		{"header_length_large", 100, 65544, ErrInvalidHeaderLength, HeaderFieldError{Field: "header_length", Value: 65544, Min: HeaderSizeV3, Max: 65536, Align: 8}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := make([]byte, HeaderSizeV3)
+			binary.BigEndian.PutUint32(header[0:4], Magic)
+			binary.BigEndian.PutUint32(header[4:8], Version3)
+			binary.BigEndian.PutUint32(header[20:24], 16)
+			binary.BigEndian.PutUint32(header[96:100], 4)
+			binary.BigEndian.PutUint32(header[100:104], HeaderSizeV3)
+			binary.BigEndian.PutUint32(header[tc.off:], tc.value)
+
+			_, err := ParseHeader(header)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("ParseHeader error = %v, want %v", err, tc.want)
+			}
+			var fe *HeaderFieldError
+			if !errors.As(err, &fe) {
+				t.Fatalf("ParseHeader error %v is not a *HeaderFieldError", err)
+			}
+			got := *fe
+			got.err = nil
+			if got != tc.field {
+				t.Errorf("HeaderFieldError = %+v, want %+v", got, tc.field)
+			}
+		})
+	}
+}
+
 func TestL2Cache(t *testing.T) {
 	t.Parallel()
 	// Use single shard for deterministic LRU testing
@@ -461,6 +506,77 @@ func TestL2CacheConcurrent(t *testing.T) {
 	wg.Wait()
 }
 
+func TestL2CacheSecondChance(t *testing.T) {
+	t.Parallel()
+	cache := newL2CacheWithShards(3, 1)
+
+	for _, off := range []uint64{1000, 2000, 3000} {
+		cache.put(off, make([]byte, 64))
+	}
+
+	// 1000 is at the tail but was looked up, so 2000 goes instead
+	if !cache.readAt(1000, make([]byte, 8), 0) {
+		t.Fatal("cache.readAt(1000) missed")
+	}
+	cache.put(4000, make([]byte, 64))
+	if cache.get(2000) != nil {
+		t.Error("cache.get(2000) should have been evicted")
+	}
+	for _, off := range []uint64{1000, 3000, 4000} {
+		if cache.get(off) == nil {
+			t.Errorf("cache.get(%d) should still be present", off)
+		}
+	}
+
+	stats := cache.stats()
+	if stats.Hits != 4 || stats.Misses != 1 || stats.Evictions != 1 || stats.Insertions != 4 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestL2CacheConcurrentReaders(t *testing.T) {
+	t.Parallel()
+	cache := newL2CacheWithShards(16, 4)
+	for off := uint64(0); off < 16; off++ {
+		cache.put(off, bytes.Repeat([]byte{byte(off)}, 64))
+	}
+
+	// Readers share the shard locks while a writer updates the tables
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			off := uint64(i % 16)
+			cache.put(off, bytes.Repeat([]byte{byte(off)}, 64))
+		}
+	}()
+	var readers sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			buf := make([]byte, 8)
+			for i := 0; i < 1000; i++ {
+				off := uint64(i % 16)
+				if cache.readAt(off, buf, 32) && buf[0] != byte(off) {
+					t.Errorf("readAt(%d) = %d", off, buf[0])
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(stop)
+	wg.Wait()
+}
+
 func TestOpenWithOptions(t *testing.T) {
 	t.Parallel()
 	dir := t.TempDir()
@@ -476,6 +592,7 @@ func TestOpenWithOptions(t *testing.T) {
 	// Open with custom cache sizes
 	img, err = Open(path,
 		WithL2CacheSize(64),
+		WithL2CacheShards(16),
 		WithCompressedCacheSize(32),
 		WithRefcountCacheSize(24),
 	)
@@ -500,6 +617,90 @@ func TestOpenWithOptions(t *testing.T) {
 	}
 }
 
+func TestCloseIdempotent(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if img.Closed() {
+		t.Fatal("Closed before Close")
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if !img.Closed() {
+		t.Error("not Closed after Close")
+	}
+	if err := img.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := img.ReadAt(buf, 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("ReadAt: got %v, want ErrClosed", err)
+	}
+	if _, err := img.WriteAt(buf, 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteAt: got %v, want ErrClosed", err)
+	}
+	if err := img.WriteZeroAt(0, 4); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteZeroAt: got %v, want ErrClosed", err)
+	}
+	if err := img.Flush(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Flush: got %v, want ErrClosed", err)
+	}
+}
+
+// TestCloseFlushFailure verifies Close reports a failed flush, still closes
+// the image, and leaves the dirty bit set.
+func TestCloseFlushFailure(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	var ff *testutil.FaultFile
+	img, err = Open(path, WithFileWrapper(func(f File) File {
+		ff = testutil.NewFaultFile(f, testutil.FaultConfig{})
+		return ff
+	}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.markDirty(); err != nil {
+		t.Fatalf("markDirty failed: %v", err)
+	}
+	ff.SetConfig(testutil.FaultConfig{Sync: testutil.FaultProfile{ErrorRate: 1}})
+
+	if err := img.Close(); !errors.Is(err, testutil.ErrInjected) {
+		t.Errorf("Close: got %v, want ErrInjected", err)
+	}
+	if !img.Closed() {
+		t.Error("not Closed after failed Close")
+	}
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer img.Close()
+	if !img.IsDirty() {
+		t.Error("dirty bit cleared after failed flush")
+	}
+}
+
 func TestCacheStats(t *testing.T) {
 	t.Parallel()
 	dir := t.TempDir()
@@ -558,6 +759,80 @@ func TestCacheStats(t *testing.T) {
 	img.Close()
 }
 
+func TestDataCache(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithDataCacheSize(4))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := int64(img.ClusterSize())
+	check := func(off int64, want []byte) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := img.ReadAt(got, off); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadAt(%d) = %q, want %q", off, got[:min(len(got), 16)], want[:min(len(want), 16)])
+		}
+	}
+
+	first := bytes.Repeat([]byte("A"), int(cs))
+	if _, err := img.WriteAt(first, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.ResetCacheStats()
+	check(100, first[100:200])
+	check(200, first[200:300])
+	if stats := img.DataCacheStats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("stats = %+v, want 1 miss then 1 hit", stats)
+	}
+
+	// Overwrites are visible immediately
+	if _, err := img.WriteAt([]byte("updated"), 150); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(first[150:], "updated")
+	check(0, first)
+
+	// A snapshot makes the next write copy the cluster elsewhere; deleting
+	// it frees the old copy for reuse by an unrelated cluster
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("copied"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(first, "copied")
+	check(0, first)
+	if err := img.DeleteSnapshot("snap"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	second := bytes.Repeat([]byte("B"), int(cs))
+	for i := int64(1); i < 4; i++ {
+		if _, err := img.WriteAt(second, i*cs); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		check(i*cs, second)
+	}
+	check(0, first)
+
+	// Zeroed clusters read as zeros, not as their cached contents
+	if err := img.WriteZeroAt(cs, cs); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	check(cs, make([]byte, cs))
+}
+
 func TestDirtyBitTracking(t *testing.T) {
 	t.Parallel()
 	dir := t.TempDir()
@@ -1251,6 +1526,49 @@ func TestFreeClusterReuse(t *testing.T) {
 	img.Close()
 }
 
+func TestClusterReusePolicyAppendOnly(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+	img, err = Open(path, WithClusterReusePolicy(ReuseAppendOnly))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	data := bytes.Repeat([]byte{0xAA}, 64*1024)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	first, err := img.translate(0)
+	if err != nil {
+		t.Fatalf("translate failed: %v", err)
+	}
+	if err := img.WriteZeroAt(0, 64*1024); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if free, err := img.IsClusterFree(first.physOff); err != nil || !free {
+		t.Fatalf("IsClusterFree = %v, %v; want freed cluster", free, err)
+	}
+
+	// The freed cluster stays a hole; new data goes to the end of the file
+	if _, err := img.WriteAt(data, 128*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	info, err := img.translate(128 * 1024)
+	if err != nil {
+		t.Fatalf("translate failed: %v", err)
+	}
+	if info.physOff <= first.physOff {
+		t.Errorf("new cluster at 0x%x, want past freed cluster at 0x%x", info.physOff, first.physOff)
+	}
+}
+
 func TestRefcountDeallocation(t *testing.T) {
 	t.Parallel()
 	dir := t.TempDir()
@@ -1834,6 +2152,73 @@ func TestCheckReadOnly(t *testing.T) {
 	}
 }
 
+func TestWithReadOnly(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	img.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-write file descriptor, but no modification allowed
+	img, err = OpenFile(path, os.O_RDWR, 0, WithReadOnly())
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if img.IsDirty() {
+		t.Error("read-only image marked dirty")
+	}
+	buf := make([]byte, 4)
+	if _, err := img.ReadAt(buf, 0); err != nil || string(buf) != "data" {
+		t.Errorf("ReadAt = %q, %v", buf, err)
+	}
+
+	mutations := map[string]func() error{
+		"WriteAt":                func() error { _, err := img.WriteAt(buf, 0); return err },
+		"WriteAtCompressed":      func() error { _, err := img.WriteAtCompressed(make([]byte, 65536), 0); return err },
+		"WriteZeroAt":            func() error { return img.WriteZeroAt(0, 65536) },
+		"MultiWriteAt":           func() error { return img.MultiWriteAt([]WriteRequest{{Data: buf}}) },
+		"CreateSnapshot":         func() error { _, err := img.CreateSnapshot("new"); return err },
+		"DeleteSnapshot":         func() error { return img.DeleteSnapshot("snap") },
+		"RevertToSnapshot":       func() error { return img.RevertToSnapshot("snap") },
+		"PruneSnapshots":         func() error { _, err := img.PruneSnapshots(RetentionPolicy{KeepLast: 1}); return err },
+		"PreallocateMetadata":    func() error { return img.PreallocateMetadata(0, 65536) },
+		"GrowL1Table":            func() error { return img.GrowL1Table(64) },
+		"Repair":                 func() error { _, err := img.Repair(); return err },
+		"AttachExternalDataFile": func() error { return img.AttachExternalDataFile(filepath.Join(dir, "data.raw")) },
+		"ReopenReadWrite":        img.ReopenReadWrite,
+	}
+	for name, mutate := range mutations {
+		if err := mutate(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: got %v, want ErrReadOnly", name, err)
+		}
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("image file modified")
+	}
+}
+
 func TestWriteBarrierModes(t *testing.T) {
 	t.Parallel()
 	dir := t.TempDir()
@@ -2516,6 +2901,173 @@ func TestWriteAtCompressedZstd(t *testing.T) {
 	}
 }
 
+// TestZstdMultiFrame writes 2MB clusters as several zstd frames and reads
+// them back, and checks that skippable frames are passed over.
+func TestZstdMultiFrame(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "frames.qcow2")
+	img, err := Create(path, CreateOptions{Size: 8 << 20, ClusterBits: 21})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithZstdFrameSize(256*1024))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	img.SetCompressionLevel(CompressionDefault)
+	img.SetCompressionType(CompressionZstd)
+	data := make([]byte, img.ClusterSize())
+	for i := 0; i < len(data); i += 4096 {
+		copy(data[i:], testutil.RandomBytes(int64(i/65536), 1024))
+	}
+
+	compressed, err := img.compressZstd(data, nil)
+	if err != nil {
+		t.Fatalf("compressZstd failed: %v", err)
+	}
+	magic := []byte{0x28, 0xb5, 0x2f, 0xfd}
+	if frames := bytes.Count(compressed, magic); frames != 8 {
+		t.Errorf("cluster compressed into %d frames, want 8", frames)
+	}
+
+	if _, err := img.WriteAtCompressed(data, 2<<20); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer img.Close()
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 2<<20); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("multi-frame cluster mismatch")
+	}
+
+	// A skippable frame between frames, and sector padding after them
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 4, 0, 0, 0, 'm', 'e', 't', 'a'}
+	half, err := img.compressZstd(data[:len(data)/2], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := img.compressZstd(data[len(data)/2:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := append(append(append(append([]byte(nil), half...), skippable...), rest...), make([]byte, 300)...)
+	clear(got)
+	if err := img.decompressZstd(stream, got); err != nil {
+		t.Fatalf("decompressZstd failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("skippable frame not passed over")
+	}
+}
+
+// TestLikelyIncompressible checks the sampling heuristic that skips
+// compressing random clusters.
+func TestLikelyIncompressible(t *testing.T) {
+	t.Parallel()
+	const cs = 64 * 1024
+	random := testutil.RandomBytes(1, cs)
+	halfRandom := append(testutil.RandomBytes(2, cs/2), make([]byte, cs/2)...)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), cs/44+1)[:cs]
+	repeated := bytes.Repeat(testutil.RandomBytes(3, 4096), cs/4096)
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"random", random, true},
+		{"half random", halfRandom, false},
+		{"zeros", make([]byte, cs), false},
+		{"text", text, false},
+		{"repeated random block", repeated, false},
+		{"small random", testutil.RandomBytes(4, 4096), false},
+	}
+	for _, tt := range tests {
+		if got := likelyIncompressible(tt.data); got != tt.want {
+			t.Errorf("%s: likelyIncompressible = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// What the heuristic lets through still compresses
+	path := filepath.Join(t.TempDir(), "probe.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	img.SetCompressionLevel(CompressionDefault)
+	if _, err := img.compressCluster(random, nil); err != ErrCompressionNotBeneficial {
+		t.Errorf("random cluster: got %v, want ErrCompressionNotBeneficial", err)
+	}
+	for _, data := range [][]byte{halfRandom, repeated} {
+		if _, err := img.compressCluster(data, nil); err != nil {
+			t.Errorf("compressCluster failed: %v", err)
+		}
+	}
+}
+
+func TestCompressedRoundTripAllLevels(t *testing.T) {
+	t.Parallel()
+
+	// Compressors and decompressors are pooled; mixing levels and reading
+	// concurrently must never hand back another cluster's data
+	for _, ctype := range []uint8{CompressionZlib, CompressionZstd} {
+		path := filepath.Join(t.TempDir(), fmt.Sprintf("levels_%d.qcow2", ctype))
+		img, err := CreateSimple(path, 1024*1024)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		img.SetCompressionType(ctype)
+
+		cs := int(img.ClusterSize())
+		levels := []CompressionLevel{CompressionFast, CompressionDefault, CompressionBest, CompressionFast}
+		want := make([][]byte, len(levels))
+		for i, level := range levels {
+			img.SetCompressionLevel(level)
+			want[i] = bytes.Repeat([]byte(fmt.Sprintf("cluster %d level %d;", i, level)), cs/16)[:cs]
+			if _, err := img.WriteAtCompressed(want[i], int64(i*cs)); err != nil {
+				t.Fatalf("WriteAtCompressed(%d) failed: %v", i, err)
+			}
+		}
+		img.Close()
+
+		img, err = Open(path)
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, cs)
+				for i := range want {
+					if _, err := img.ReadAt(buf, int64(i*cs)); err != nil {
+						t.Errorf("ReadAt(%d) failed: %v", i, err)
+						return
+					}
+					if !bytes.Equal(buf, want[i]) {
+						t.Errorf("type %d cluster %d: data mismatch", ctype, i)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		img.Close()
+	}
+}
+
 func TestCompressionTypeSettings(t *testing.T) {
 	t.Parallel()
 	dir := t.TempDir()
@@ -0,0 +1,416 @@
+// Package qcow2img builds the reports printed by qemu-img's info, check, map
+// and snapshot -l commands, so pipelines scripted against qemu-img can run
+// against go-qcow2.
+//
+// Each report marshals to JSON with the field names qemu-img uses for
+// --output=json; those names are part of the API and will not change. Fields
+// qemu-img does not have are only ever added, and are omitted when empty.
+// WriteText prints the same information in qemu-img's human-readable layout.
+package qcow2img
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// SnapshotInfo describes one internal snapshot.
+type SnapshotInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize uint64 `json:"vm-state-size"`
+	DateSec     int64  `json:"date-sec"`
+	DateNsec    int64  `json:"date-nsec"`
+	VMClockSec  uint64 `json:"vm-clock-sec"`
+	VMClockNsec uint64 `json:"vm-clock-nsec"`
+}
+
+// FormatSpecific holds the qcow2 details of an InfoReport.
+type FormatSpecific struct {
+	Type string           `json:"type"` // Always "qcow2"
+	Data QCOW2Information `json:"data"`
+}
+
+// QCOW2Information holds the qcow2 header features.
+type QCOW2Information struct {
+	Compat          string `json:"compat"`
+	CompressionType string `json:"compression-type"`
+	LazyRefcounts   bool   `json:"lazy-refcounts"`
+	RefcountBits    uint32 `json:"refcount-bits"`
+	Corrupt         bool   `json:"corrupt"`
+	ExtendedL2      bool   `json:"extended-l2"`
+}
+
+// BackingLayer is the copy-on-write divergence of an image from one layer
+// of its backing chain; see qcow2.Image.COWStats. qemu-img has no
+// equivalent.
+type BackingLayer struct {
+	Depth          int    `json:"depth"`
+	Filename       string `json:"filename"`
+	Clusters       uint64 `json:"clusters"`
+	CopiedClusters uint64 `json:"copied-clusters"`
+}
+
+// InfoReport is the output of qemu-img info.
+type InfoReport struct {
+	Filename              string            `json:"filename"`
+	Format                string            `json:"format"` // Always "qcow2"
+	VirtualSize           int64             `json:"virtual-size"`
+	ActualSize            int64             `json:"actual-size"`
+	ClusterSize           int               `json:"cluster-size"`
+	BackingFilename       string            `json:"backing-filename,omitempty"`
+	BackingFilenameFormat string            `json:"backing-filename-format,omitempty"`
+	DirtyFlag             bool              `json:"dirty-flag"`
+	Snapshots             []SnapshotInfo    `json:"snapshots,omitempty"`
+	FormatSpecific        FormatSpecific    `json:"format-specific"`
+	BackingLayers         []BackingLayer    `json:"backing-layers,omitempty"`
+	Metadata              map[string]string `json:"metadata,omitempty"`
+}
+
+// Info reports on img, which was opened from filename.
+func Info(img *qcow2.Image, filename string) (*InfoReport, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	h := img.Header()
+	compat := "0.10"
+	if h.Version >= qcow2.Version3 {
+		compat = "1.1"
+	}
+	compression := "zlib"
+	if h.CompressionType == qcow2.CompressionZstd {
+		compression = "zstd"
+	}
+	stats, err := img.COWStats()
+	if err != nil {
+		return nil, err
+	}
+	metadata := img.Metadata()
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	var layers []BackingLayer
+	for _, s := range stats {
+		layers = append(layers, BackingLayer{
+			Depth:          s.Depth,
+			Filename:       s.Filename,
+			Clusters:       s.Clusters,
+			CopiedClusters: s.Copied,
+		})
+	}
+	return &InfoReport{
+		Filename:              filename,
+		Format:                "qcow2",
+		VirtualSize:           img.Size(),
+		ActualSize:            diskUsage(fi),
+		ClusterSize:           img.ClusterSize(),
+		BackingFilename:       img.BackingFile(),
+		BackingFilenameFormat: img.BackingFormat(),
+		DirtyFlag:             img.IsDirty(),
+		Snapshots:             Snapshots(img),
+		FormatSpecific: FormatSpecific{
+			Type: "qcow2",
+			Data: QCOW2Information{
+				Compat:          compat,
+				CompressionType: compression,
+				LazyRefcounts:   h.HasLazyRefcounts(),
+				RefcountBits:    h.RefcountBits(),
+				Corrupt:         h.Features().Has(qcow2.FeatureCorrupt),
+				ExtendedL2:      h.Features().Has(qcow2.FeatureExtendedL2),
+			},
+		},
+		BackingLayers: layers,
+		Metadata:      metadata,
+	}, nil
+}
+
+// WriteText prints the report as qemu-img info does.
+func (r *InfoReport) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("image: %s\n", r.Filename)
+	ew.printf("file format: %s\n", r.Format)
+	ew.printf("virtual size: %s (%d bytes)\n", sizeToStr(uint64(r.VirtualSize)), r.VirtualSize)
+	ew.printf("disk size: %s\n", sizeToStr(uint64(r.ActualSize)))
+	ew.printf("cluster_size: %d\n", r.ClusterSize)
+	if r.BackingFilename != "" {
+		ew.printf("backing file: %s\n", r.BackingFilename)
+		if r.BackingFilenameFormat != "" {
+			ew.printf("backing file format: %s\n", r.BackingFilenameFormat)
+		}
+	}
+	if len(r.Snapshots) > 0 {
+		writeSnapshotTable(ew, r.Snapshots)
+	}
+	d := r.FormatSpecific.Data
+	ew.printf("Format specific information:\n")
+	ew.printf("    compat: %s\n", d.Compat)
+	ew.printf("    compression type: %s\n", d.CompressionType)
+	ew.printf("    lazy refcounts: %t\n", d.LazyRefcounts)
+	ew.printf("    refcount bits: %d\n", d.RefcountBits)
+	ew.printf("    corrupt: %t\n", d.Corrupt)
+	ew.printf("    extended l2: %t\n", d.ExtendedL2)
+	if r.DirtyFlag {
+		ew.printf("dirty flag: true\n")
+	}
+	if len(r.Metadata) > 0 {
+		keys := make([]string, 0, len(r.Metadata))
+		for k := range r.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ew.printf("User metadata:\n")
+		for _, k := range keys {
+			ew.printf("    %s: %s\n", k, r.Metadata[k])
+		}
+	}
+	if len(r.BackingLayers) > 0 {
+		ew.printf("Copy-on-write statistics:\n")
+		for _, l := range r.BackingLayers {
+			pct := 0.0
+			if l.Clusters > 0 {
+				pct = 100 * float64(l.CopiedClusters) / float64(l.Clusters)
+			}
+			ew.printf("    layer %d: %s: %d/%d clusters copied (%.1f%%)\n",
+				l.Depth, l.Filename, l.CopiedClusters, l.Clusters, pct)
+		}
+	}
+	return ew.err
+}
+
+// Snapshots lists the internal snapshots of img, oldest first.
+func Snapshots(img *qcow2.Image) []SnapshotInfo {
+	var list []SnapshotInfo
+	for _, s := range img.Snapshots() {
+		list = append(list, SnapshotInfo{
+			ID:          s.ID,
+			Name:        s.Name,
+			VMStateSize: s.VMStateLength(),
+			DateSec:     s.Date.Unix(),
+			DateNsec:    int64(s.Date.Nanosecond()),
+			VMClockSec:  s.VMClock / 1e9,
+			VMClockNsec: s.VMClock % 1e9,
+		})
+	}
+	return list
+}
+
+// WriteSnapshotList prints snapshots as qemu-img snapshot -l does, which is
+// nothing at all for an image without snapshots.
+func WriteSnapshotList(w io.Writer, snapshots []SnapshotInfo) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	ew := &errWriter{w: w}
+	writeSnapshotTable(ew, snapshots)
+	return ew.err
+}
+
+func writeSnapshotTable(ew *errWriter, snapshots []SnapshotInfo) {
+	ew.printf("Snapshot list:\n")
+	ew.printf("%-9s %-17s %7s%20s%13s\n", "ID", "TAG", "VM SIZE", "DATE", "VM CLOCK")
+	for _, s := range snapshots {
+		date := time.Unix(s.DateSec, s.DateNsec).Format("2006-01-02 15:04:05")
+		secs := s.VMClockSec
+		clock := fmt.Sprintf("%02d:%02d:%02d.%03d", secs/3600, secs/60%60, secs%60, s.VMClockNsec/1e6)
+		ew.printf("%-9s %-17s %7s%20s%13s\n", s.ID, s.Name, sizeToStr(s.VMStateSize), date, clock)
+	}
+}
+
+// CheckReport is the output of qemu-img check. CheckErrors counts the
+// problems in Errors that are not corruptions, such as refcount mismatches
+// and unreadable tables.
+type CheckReport struct {
+	Filename           string   `json:"filename"`
+	Format             string   `json:"format"` // Always "qcow2"
+	CheckErrors        int      `json:"check-errors"`
+	ImageEndOffset     int64    `json:"image-end-offset"`
+	TotalClusters      uint64   `json:"total-clusters"`
+	AllocatedClusters  uint64   `json:"allocated-clusters"`
+	FragmentedClusters uint64   `json:"fragmented-clusters"`
+	Leaks              int      `json:"leaks,omitempty"`
+	Corruptions        int      `json:"corruptions,omitempty"`
+	Errors             []string `json:"errors,omitempty"` // Not in qemu-img
+}
+
+// Clean reports whether the check found no leaks, corruptions or errors.
+func (r *CheckReport) Clean() bool {
+	return r.Leaks == 0 && r.Corruptions == 0 && r.CheckErrors == 0
+}
+
+// Check runs a consistency check of img, which was opened from filename.
+func Check(img *qcow2.Image, filename string) (*CheckReport, error) {
+	res, err := img.Check()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	cs := uint64(img.ClusterSize())
+	return &CheckReport{
+		Filename:           filename,
+		Format:             "qcow2",
+		CheckErrors:        len(res.Errors) - res.Corruptions,
+		ImageEndOffset:     fi.Size(),
+		TotalClusters:      (uint64(img.Size()) + cs - 1) / cs,
+		AllocatedClusters:  res.ReferencedClusters,
+		FragmentedClusters: res.FragmentedClusters,
+		Leaks:              res.Leaks,
+		Corruptions:        res.Corruptions,
+		Errors:             res.Errors,
+	}, nil
+}
+
+// WriteText prints the report as qemu-img check does.
+func (r *CheckReport) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	for _, e := range r.Errors {
+		ew.printf("ERROR %s\n", e)
+	}
+	switch {
+	case r.Corruptions > 0:
+		ew.printf("\n%d errors were found on the image.\n", r.Corruptions)
+		ew.printf("Data may be corrupted, or further writes to the image may corrupt it.\n")
+	case r.CheckErrors > 0:
+		ew.printf("\n%d internal errors have occurred during the check.\n", r.CheckErrors)
+	case r.Leaks == 0:
+		ew.printf("No errors were found on the image.\n")
+	}
+	if r.Leaks > 0 {
+		ew.printf("\n%d leaked clusters were found on the image.\n", r.Leaks)
+		ew.printf("This means waste of disk space, but no harm to data.\n")
+	}
+	if r.TotalClusters > 0 {
+		ew.printf("%d/%d = %.2f%% allocated, %.2f%% fragmented\n",
+			r.AllocatedClusters, r.TotalClusters,
+			100*float64(r.AllocatedClusters)/float64(r.TotalClusters),
+			100*float64(r.FragmentedClusters)/float64(max(r.AllocatedClusters, 1)))
+	}
+	ew.printf("Image end offset: %d\n", r.ImageEndOffset)
+	return ew.err
+}
+
+// MapEntry is one range of qemu-img map output.
+type MapEntry struct {
+	Start      uint64 `json:"start"`
+	Length     uint64 `json:"length"`
+	Depth      int    `json:"depth"`
+	Present    bool   `json:"present"`
+	Zero       bool   `json:"zero"`
+	Data       bool   `json:"data"`
+	Compressed bool   `json:"compressed"`
+	Offset     uint64 `json:"offset,omitempty"`
+}
+
+// Map returns the allocation map of img. Data clusters are split where
+// their host offsets stop being contiguous, as qemu-img does.
+//
+// Ranges that come from a backing file are reported at depth 1 with
+// Present false; unlike qemu-img, Map does not look into the backing chain.
+func Map(img *qcow2.Image) ([]MapEntry, error) {
+	extents, err := img.Map(0, img.Size())
+	if err != nil {
+		return nil, err
+	}
+	var entries []MapEntry
+	add := func(e MapEntry) {
+		if n := len(entries); n > 0 {
+			last := &entries[n-1]
+			if last.Depth == e.Depth && last.Present == e.Present && last.Zero == e.Zero &&
+				last.Data == e.Data && last.Compressed == e.Compressed &&
+				(last.Offset == 0 && e.Offset == 0 || last.Offset+last.Length == e.Offset) {
+				last.Length += e.Length
+				return
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	cs := uint64(img.ClusterSize())
+	for _, ext := range extents {
+		switch ext.Type {
+		case qcow2.ExtentZero:
+			add(MapEntry{Start: ext.Start, Length: ext.Length, Present: true, Zero: true})
+		case qcow2.ExtentBacking:
+			add(MapEntry{Start: ext.Start, Length: ext.Length, Depth: 1})
+		case qcow2.ExtentUnallocated:
+			add(MapEntry{Start: ext.Start, Length: ext.Length, Zero: true})
+		case qcow2.ExtentData:
+			for off := ext.Start; off < ext.End(); {
+				desc, err := img.DescribeCluster(off)
+				if err != nil {
+					return nil, err
+				}
+				n := min(desc.VirtualOffset+cs, ext.End()) - off
+				e := MapEntry{Start: off, Length: n, Present: true, Data: true}
+				if desc.Type == qcow2.ClusterCompressed {
+					e.Compressed = true
+				} else {
+					e.Offset = desc.HostOffset + off - desc.VirtualOffset
+				}
+				add(e)
+				off += n
+			}
+		}
+	}
+	return entries, nil
+}
+
+// WriteMap prints the data entries of a map as qemu-img map does.
+func WriteMap(w io.Writer, entries []MapEntry, filename string) error {
+	ew := &errWriter{w: w}
+	ew.printf("%-16s%-16s%-16s%s\n", "Offset", "Length", "Mapped to", "File")
+	for _, e := range entries {
+		if e.Data && e.Offset != 0 {
+			ew.printf("%-16s%-16s%-16s%s\n", hex(e.Start), hex(e.Length), hex(e.Offset), filename)
+		}
+	}
+	return ew.err
+}
+
+// hex formats v like C's %#x, which prints zero without a prefix.
+func hex(v uint64) string {
+	if v == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+// diskUsage returns the bytes a file occupies on disk, which can be less
+// than its size for sparse files.
+func diskUsage(fi os.FileInfo) int64 {
+	if blocks, ok := statBlocks(fi); ok {
+		return blocks * 512
+	}
+	return fi.Size()
+}
+
+// sizeToStr formats a size with three significant digits, as qemu does:
+// "4 MiB", "1.5 GiB", "196 KiB".
+func sizeToStr(v uint64) string {
+	suffixes := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	_, exp := math.Frexp(float64(v) / (1000.0 / 1024.0))
+	i := max(exp-1, 0) / 10
+	return strconv.FormatFloat(float64(v)/float64(uint64(1)<<(10*i)), 'g', 3, 64) + " " + suffixes[i]
+}
+
+// errWriter remembers the first write error so reports can be printed
+// without checking every line.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...any) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
@@ -0,0 +1,176 @@
+package qcow2img
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// createTestImage creates an image with data, compressed and zero clusters,
+// and optionally a snapshot.
+func createTestImage(t *testing.T, snapshot bool) (*qcow2.Image, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "img.qcow2")
+	img, err := qcow2.CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	t.Cleanup(func() { img.Close() })
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, 2*cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte{2}, cs), int64(3*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	if err := img.WriteZeroAtMode(int64(4*cs), int64(cs), qcow2.ZeroAlloc); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+	if snapshot {
+		if _, err := img.CreateSnapshot("snap1"); err != nil {
+			t.Fatalf("CreateSnapshot failed: %v", err)
+		}
+	}
+	return img, path
+}
+
+// TestInfoJSON checks the info report keeps qemu-img's JSON field names.
+func TestInfoJSON(t *testing.T) {
+	t.Parallel()
+	img, path := createTestImage(t, true)
+	if err := img.SetMetadata("image-id", "42"); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+
+	r, err := Info(img, path)
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"filename", "format", "virtual-size", "actual-size", "cluster-size", "dirty-flag", "snapshots", "format-specific"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("info JSON has no %q: %s", key, data)
+		}
+	}
+	if got["virtual-size"] != float64(4*1024*1024) || got["format"] != "qcow2" {
+		t.Errorf("info JSON = %s", data)
+	}
+	if r.Metadata["image-id"] != "42" {
+		t.Errorf("metadata = %v, want image-id 42", r.Metadata)
+	}
+	if len(r.Snapshots) != 1 || r.Snapshots[0].Name != "snap1" {
+		t.Errorf("snapshots = %+v, want snap1", r.Snapshots)
+	}
+
+	var text strings.Builder
+	if err := r.WriteText(&text); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	for _, want := range []string{"virtual size: 4 MiB (4194304 bytes)\n", "cluster_size: 65536\n", "snap1", "    compat: 1.1\n", "    image-id: 42\n"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("info text lacks %q:\n%s", want, text.String())
+		}
+	}
+}
+
+// TestInfoBackingLayers checks an overlay reports how much it has copied
+// from its backing file, and a standalone image reports no layers.
+func TestInfoBackingLayers(t *testing.T) {
+	t.Parallel()
+	img, basePath := createTestImage(t, false)
+	if r, err := Info(img, basePath); err != nil || r.BackingLayers != nil {
+		t.Errorf("standalone image: layers = %+v, err = %v", r.BackingLayers, err)
+	}
+	img.Close()
+
+	path := filepath.Join(filepath.Dir(basePath), "overlay.qcow2")
+	overlay, err := qcow2.CreateOverlay(path, basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	defer overlay.Close()
+	if _, err := overlay.WriteAt([]byte{9}, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	r, err := Info(overlay, path)
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	want := []BackingLayer{{Depth: 1, Filename: basePath, Clusters: 4, CopiedClusters: 1}}
+	if !reflect.DeepEqual(r.BackingLayers, want) {
+		t.Errorf("layers = %+v, want %+v", r.BackingLayers, want)
+	}
+	var text strings.Builder
+	if err := r.WriteText(&text); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	if !strings.Contains(text.String(), "1/4 clusters copied (25.0%)") {
+		t.Errorf("info text lacks copy-on-write statistics:\n%s", text.String())
+	}
+}
+
+// TestCheckReport checks a clean image reports no problems. Check does not
+// understand snapshots yet, so the image has none.
+func TestCheckReport(t *testing.T) {
+	t.Parallel()
+	img, path := createTestImage(t, false)
+
+	r, err := Check(img, path)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !r.Clean() || r.TotalClusters != 64 || r.AllocatedClusters == 0 {
+		t.Errorf("check report = %+v", r)
+	}
+	data, _ := json.Marshal(r)
+	if strings.Contains(string(data), "leaks") || !strings.Contains(string(data), `"check-errors":0`) {
+		t.Errorf("check JSON = %s", data)
+	}
+}
+
+// TestMapEntries checks data, compressed, zero and unallocated ranges.
+func TestMapEntries(t *testing.T) {
+	t.Parallel()
+	img, _ := createTestImage(t, false)
+	cs := uint64(img.ClusterSize())
+
+	entries, err := Map(img)
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	for i := range entries {
+		entries[i].Offset = min(entries[i].Offset, 1)
+	}
+	want := []MapEntry{
+		{Start: 0, Length: 2 * cs, Present: true, Data: true, Offset: 1},
+		{Start: 2 * cs, Length: cs, Zero: true},
+		{Start: 3 * cs, Length: cs, Present: true, Data: true, Compressed: true},
+		{Start: 4 * cs, Length: cs, Present: true, Zero: true},
+		{Start: 5 * cs, Length: 59 * cs, Zero: true},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("map = %+v\nwant %+v", entries, want)
+	}
+}
+
+func TestSizeToStr(t *testing.T) {
+	t.Parallel()
+	for v, want := range map[uint64]string{0: "0 B", 512: "512 B", 1023: "0.999 KiB", 4 << 20: "4 MiB", 3 << 29: "1.5 GiB", 196 << 10: "196 KiB"} {
+		if got := sizeToStr(v); got != want {
+			t.Errorf("sizeToStr(%d) = %q, want %q", v, got, want)
+		}
+	}
+}
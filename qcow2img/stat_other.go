@@ -0,0 +1,10 @@
+//go:build !unix
+
+package qcow2img
+
+import "os"
+
+// statBlocks is not supported on this platform; disk usage is the file size.
+func statBlocks(os.FileInfo) (int64, bool) {
+	return 0, false
+}
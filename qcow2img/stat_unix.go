@@ -0,0 +1,17 @@
+//go:build unix
+
+package qcow2img
+
+import (
+	"os"
+	"syscall"
+)
+
+// statBlocks returns the number of 512-byte blocks allocated to a file.
+func statBlocks(fi os.FileInfo) (int64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(st.Blocks), true
+}
@@ -0,0 +1,293 @@
+package qcow2inspect
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// Region kinds reported by Annotate.
+const (
+	KindHeader           = "header"
+	KindHeaderCluster    = "header_cluster"
+	KindHeaderExtension  = "header_extension"
+	KindBackingFileName  = "backing_file_name"
+	KindLUKSHeader       = "luks_header"
+	KindL1Table          = "l1_table"
+	KindL2Table          = "l2_table"
+	KindRefcountTable    = "refcount_table"
+	KindRefcountBlock    = "refcount_block"
+	KindSnapshotEntry    = "snapshot_entry"
+	KindSnapshotL1Table  = "snapshot_l1_table"
+	KindBitmapDirectory  = "bitmap_directory_entry"
+	KindBitmapTable      = "bitmap_table"
+	KindBitmapData       = "bitmap_data"
+	KindData             = "data"
+	KindCompressedData   = "compressed_data"
+	KindPreallocatedZero = "preallocated_zero"
+)
+
+// Region is a byte range of the image file owned by one structure.
+type Region struct {
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+
+	// Snapshot is the ID of the snapshot whose tables reference this region,
+	// or empty for the active image.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// VirtualOffset is the guest offset mapped to Start, for data regions.
+	VirtualOffset uint64 `json:"virtual_offset,omitempty"`
+}
+
+// Contains reports whether off lies inside the region.
+func (r Region) Contains(off uint64) bool {
+	return off >= r.Start && off-r.Start < r.Length
+}
+
+// Annotation describes what a file offset belongs to.
+type Annotation struct {
+	Offset       uint64 `json:"offset"`
+	Cluster      uint64 `json:"cluster"`
+	ClusterStart uint64 `json:"cluster_start"`
+	PastEOF      bool   `json:"past_eof"`
+
+	// Regions lists every structure covering the offset, most specific
+	// first. More than one data region means the cluster is shared (e.g. by
+	// snapshots); overlapping metadata regions indicate corruption.
+	Regions []Region `json:"regions"`
+
+	// Refcount is the cluster's refcount, if refcount blocks were inspected.
+	Refcount    uint64 `json:"refcount"`
+	HasRefcount bool   `json:"has_refcount"`
+}
+
+// VirtualOffsets returns the guest offsets of the annotated byte, one per
+// data region that references it.
+func (a *Annotation) VirtualOffsets() []uint64 {
+	var offs []uint64
+	for _, r := range a.Regions {
+		if r.Kind == KindData || r.Kind == KindPreallocatedZero {
+			offs = append(offs, r.VirtualOffset+(a.Offset-r.Start))
+		}
+	}
+	return offs
+}
+
+// Annotator answers reverse lookups (file offset to owning structure) for
+// an inspected image. It is the inverse of the L1/L2 walk: where
+// qcow2.Image.CheckOverlap only knows metadata, Annotate also covers data
+// clusters and the virtual offsets that map to them.
+type Annotator struct {
+	report  *Report
+	regions []Region
+}
+
+// NewAnnotator indexes the regions of a report. The report should be built
+// with L2Tables and SnapshotTables (and optionally RefcountBlocks and
+// BitmapTables); structures that were not inspected cannot be found.
+func NewAnnotator(r *Report) *Annotator {
+	a := &Annotator{report: r}
+	a.build()
+	return a
+}
+
+// AnnotateFile inspects the image at path with every option enabled and
+// annotates a single file offset.
+func AnnotateFile(path string, offset uint64) (*Annotation, error) {
+	report, err := InspectFile(path, Options{
+		L2Tables:       true,
+		RefcountBlocks: true,
+		BitmapTables:   true,
+		SnapshotTables: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ann := NewAnnotator(report).Annotate(offset)
+	return &ann, nil
+}
+
+// Regions returns every indexed region, sorted by start offset.
+func (a *Annotator) Regions() []Region {
+	return a.regions
+}
+
+// Annotate reports which structures own the byte at the given file offset.
+// An offset covered by no region is free space (or leaked, if its refcount
+// is non-zero).
+func (a *Annotator) Annotate(offset uint64) Annotation {
+	h := a.report.Header
+	ann := Annotation{
+		Offset:  offset,
+		PastEOF: int64(offset) >= a.report.FileSize,
+	}
+	if h.ClusterSize != 0 {
+		ann.Cluster = offset / h.ClusterSize
+		ann.ClusterStart = ann.Cluster * h.ClusterSize
+	}
+
+	for _, r := range a.regions {
+		if r.Start > offset {
+			break
+		}
+		if r.Contains(offset) {
+			ann.Regions = append(ann.Regions, r)
+		}
+	}
+	sort.SliceStable(ann.Regions, func(i, j int) bool {
+		return ann.Regions[i].Length < ann.Regions[j].Length
+	})
+
+	ann.Refcount, ann.HasRefcount = a.refcount(ann.Cluster)
+	return ann
+}
+
+// refcount looks up a cluster's refcount in the inspected refcount blocks.
+func (a *Annotator) refcount(cluster uint64) (uint64, bool) {
+	h := a.report.Header
+	if h.ClusterSize == 0 || h.RefcountOrder > 6 {
+		return 0, false
+	}
+	perBlock := h.ClusterSize * 8 / (uint64(1) << h.RefcountOrder)
+	tableIndex := cluster / perBlock
+
+	for _, e := range a.report.Refcounts {
+		if e.Index != tableIndex {
+			continue
+		}
+		if e.Refcounts == nil {
+			return 0, false // Block not inspected
+		}
+		for _, rc := range e.Refcounts {
+			if rc.Cluster == cluster {
+				return rc.Refcount, true
+			}
+		}
+		return 0, true
+	}
+	// No refcount block covers the cluster
+	return 0, true
+}
+
+func (a *Annotator) add(r Region) {
+	if r.Length > 0 {
+		a.regions = append(a.regions, r)
+	}
+}
+
+func (a *Annotator) build() {
+	r := a.report
+	h := r.Header
+	cs := h.ClusterSize
+
+	headerLen := uint64(h.HeaderLength)
+	if h.Version < qcow2.Version3 || headerLen == 0 {
+		headerLen = qcow2.HeaderSizeV2
+	}
+	a.add(Region{Start: 0, Length: headerLen, Kind: KindHeader})
+	a.add(Region{Start: 0, Length: cs, Kind: KindHeaderCluster})
+
+	for _, ext := range r.Extensions {
+		a.add(Region{
+			Start:  ext.Offset,
+			Length: 8 + (uint64(ext.Length)+7)&^7,
+			Kind:   KindHeaderExtension,
+			Detail: ext.Name,
+		})
+		if ext.Type == qcow2.ExtensionFullDiskEncrypt && len(ext.Data) >= 16 {
+			a.add(Region{
+				Start:  binary.BigEndian.Uint64(ext.Data[0:8]),
+				Length: binary.BigEndian.Uint64(ext.Data[8:16]),
+				Kind:   KindLUKSHeader,
+			})
+		}
+	}
+	if h.BackingFileOffset != 0 {
+		a.add(Region{Start: h.BackingFileOffset, Length: uint64(h.BackingFileSize), Kind: KindBackingFileName})
+	}
+
+	a.add(Region{Start: h.L1TableOffset, Length: uint64(h.L1Size) * 8, Kind: KindL1Table})
+	a.addTree(r.L1, "")
+
+	a.add(Region{Start: h.RefcountTableOffset, Length: uint64(h.RefcountTableClusters) * cs, Kind: KindRefcountTable})
+	if h.RefcountOrder <= 6 && cs != 0 {
+		perBlock := cs * 8 / (uint64(1) << h.RefcountOrder)
+		for _, e := range r.Refcounts {
+			a.add(Region{
+				Start:  e.BlockOffset,
+				Length: cs,
+				Kind:   KindRefcountBlock,
+				Detail: fmt.Sprintf("refcount_table[%d], clusters %d-%d", e.Index, e.Index*perBlock, (e.Index+1)*perBlock-1),
+			})
+		}
+	}
+
+	for _, s := range r.Snapshots {
+		size := (40 + uint64(len(s.ExtraData)) + uint64(len(s.ID)) + uint64(len(s.Name)) + 7) &^ 7
+		a.add(Region{Start: s.Offset, Length: size, Kind: KindSnapshotEntry, Detail: s.Name, Snapshot: s.ID})
+		a.add(Region{Start: s.L1TableOffset, Length: uint64(s.L1Size) * 8, Kind: KindSnapshotL1Table, Snapshot: s.ID})
+		a.addTree(s.L1, s.ID)
+	}
+
+	for _, b := range r.Bitmaps {
+		size := (24 + uint64(len(b.ExtraData)) + uint64(len(b.Name)) + 7) &^ 7
+		a.add(Region{Start: b.Offset, Length: size, Kind: KindBitmapDirectory, Detail: b.Name})
+		a.add(Region{Start: b.TableOffset, Length: uint64(b.TableSize) * 8, Kind: KindBitmapTable, Detail: b.Name})
+		for i, entry := range b.Table {
+			// Bits 9-55 hold the data cluster offset
+			if off := entry & 0x00fffffffffffe00; off != 0 {
+				a.add(Region{Start: off, Length: cs, Kind: KindBitmapData, Detail: fmt.Sprintf("%s[%d]", b.Name, i)})
+			}
+		}
+	}
+
+	sort.SliceStable(a.regions, func(i, j int) bool {
+		return a.regions[i].Start < a.regions[j].Start
+	})
+}
+
+// addTree indexes the L2 tables and data clusters referenced by an L1 table.
+func (a *Annotator) addTree(l1 []L1Entry, snapshot string) {
+	cs := a.report.Header.ClusterSize
+	for _, e := range l1 {
+		if e.L2Offset == 0 {
+			continue
+		}
+		a.add(Region{
+			Start:         e.L2Offset,
+			Length:        cs,
+			Kind:          KindL2Table,
+			Detail:        fmt.Sprintf("L1[%d]", e.Index),
+			Snapshot:      snapshot,
+			VirtualOffset: e.VirtualOffset,
+		})
+		for _, l2 := range e.L2 {
+			region := Region{
+				Start:         l2.HostOffset,
+				Length:        cs,
+				Detail:        fmt.Sprintf("L1[%d] L2[%d]", e.Index, l2.Index),
+				Snapshot:      snapshot,
+				VirtualOffset: l2.VirtualOffset,
+			}
+			switch l2.Type {
+			case "normal":
+				region.Kind = KindData
+			case "compressed":
+				region.Kind = KindCompressedData
+				region.Length = l2.CompressedSize
+			case "zero":
+				region.Kind = KindPreallocatedZero
+			default:
+				continue
+			}
+			if region.Start != 0 {
+				a.add(region)
+			}
+		}
+	}
+}
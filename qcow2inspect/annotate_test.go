@@ -0,0 +1,76 @@
+package qcow2inspect
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// TestAnnotate resolves metadata and data offsets, including clusters shared
+// between the active image and a snapshot.
+func TestAnnotate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "annotate.qcow2")
+
+	img, err := qcow2.CreateSimple(path, 8*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := uint64(img.ClusterSize())
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, int(cs)), int64(3*cs)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("base"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	img.Close()
+
+	report, err := InspectFile(path, Options{L2Tables: true, RefcountBlocks: true, SnapshotTables: true})
+	if err != nil {
+		t.Fatalf("InspectFile failed: %v", err)
+	}
+	a := NewAnnotator(report)
+
+	// L1 table
+	ann := a.Annotate(report.Header.L1TableOffset + 8)
+	if len(ann.Regions) == 0 || ann.Regions[0].Kind != KindL1Table {
+		t.Errorf("L1 offset annotated as %+v", ann.Regions)
+	}
+
+	// Data cluster shared by the active image and the snapshot
+	var hostOff uint64
+	for _, e := range report.L1[0].L2 {
+		if e.VirtualOffset == 3*cs {
+			hostOff = e.HostOffset
+		}
+	}
+	if hostOff == 0 {
+		t.Fatal("data cluster not found in report")
+	}
+	ann = a.Annotate(hostOff + 10)
+	virts := ann.VirtualOffsets()
+	if len(virts) != 2 || virts[0] != 3*cs+10 || virts[1] != 3*cs+10 {
+		t.Errorf("VirtualOffsets = %v, want two refs to 0x%x", virts, 3*cs+10)
+	}
+	if !ann.HasRefcount || ann.Refcount != 2 {
+		t.Errorf("refcount = %d (has=%v), want 2", ann.Refcount, ann.HasRefcount)
+	}
+	snapshotRefs := 0
+	for _, r := range ann.Regions {
+		if r.Snapshot != "" {
+			snapshotRefs++
+		}
+	}
+	if snapshotRefs != 1 {
+		t.Errorf("expected one snapshot reference, got %+v", ann.Regions)
+	}
+
+	// Past the end of the file
+	ann = a.Annotate(uint64(report.FileSize) + cs)
+	if !ann.PastEOF || len(ann.Regions) != 0 {
+		t.Errorf("expected empty past-EOF annotation, got %+v", ann)
+	}
+}
@@ -0,0 +1,674 @@
+// Package qcow2inspect dumps the raw metadata of a QCOW2 image as structured
+// Go values and JSON.
+//
+// Unlike qcow2.Open, inspection never rejects an image: each section is parsed
+// independently and problems are recorded in Report.Errors, so damaged images
+// can be examined without reaching for a hex editor. The image is only read.
+package qcow2inspect
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// Limits that keep inspection of hostile or corrupt images bounded.
+const (
+	maxL1Bytes            = 32 * 1024 * 1024
+	maxRefcountTableBytes = 8 * 1024 * 1024
+	maxSnapshots          = 65536
+	maxBitmaps            = 65535
+)
+
+// Options selects which of the larger structures are included in a Report.
+// The header, extensions, L1 table, refcount table, snapshot table, and
+// bitmap directory are always dumped.
+type Options struct {
+	// L2Tables includes the non-empty entries of every L2 table.
+	L2Tables bool
+
+	// RefcountBlocks includes the non-zero refcounts of every refcount block.
+	RefcountBlocks bool
+
+	// BitmapTables includes the table entries of every bitmap.
+	BitmapTables bool
+
+	// SnapshotTables includes the L1 table of every snapshot (and, with
+	// L2Tables, the L2 tables they reference).
+	SnapshotTables bool
+}
+
+// Report is the full metadata dump of an image.
+type Report struct {
+	FileSize   int64             `json:"file_size"`
+	Header     Header            `json:"header"`
+	Extensions []Extension       `json:"extensions,omitempty"`
+	L1         []L1Entry         `json:"l1,omitempty"`
+	Refcounts  []RefcountEntry   `json:"refcount_table,omitempty"`
+	Snapshots  []SnapshotEntry   `json:"snapshots,omitempty"`
+	Bitmaps    []BitmapDirectory `json:"bitmaps,omitempty"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// Header mirrors qcow2.Header with derived values and JSON names.
+type Header struct {
+	Magic                 uint32 `json:"magic"`
+	Version               uint32 `json:"version"`
+	BackingFileOffset     uint64 `json:"backing_file_offset"`
+	BackingFileSize       uint32 `json:"backing_file_size"`
+	BackingFile           string `json:"backing_file,omitempty"`
+	ClusterBits           uint32 `json:"cluster_bits"`
+	ClusterSize           uint64 `json:"cluster_size"`
+	Size                  uint64 `json:"size"`
+	EncryptMethod         uint32 `json:"encrypt_method"`
+	L1Size                uint32 `json:"l1_size"`
+	L1TableOffset         uint64 `json:"l1_table_offset"`
+	RefcountTableOffset   uint64 `json:"refcount_table_offset"`
+	RefcountTableClusters uint32 `json:"refcount_table_clusters"`
+	NbSnapshots           uint32 `json:"nb_snapshots"`
+	SnapshotsOffset       uint64 `json:"snapshots_offset"`
+	IncompatibleFeatures  uint64 `json:"incompatible_features"`
+	CompatibleFeatures    uint64 `json:"compatible_features"`
+	AutoclearFeatures     uint64 `json:"autoclear_features"`
+	RefcountOrder         uint32 `json:"refcount_order"`
+	HeaderLength          uint32 `json:"header_length"`
+	CompressionType       uint8  `json:"compression_type"`
+}
+
+// Extension is one header extension.
+type Extension struct {
+	Offset uint64 `json:"offset"`
+	Type   uint32 `json:"type"`
+	Name   string `json:"name"`
+	Length uint32 `json:"length"`
+	Data   []byte `json:"data,omitempty"`
+
+	// Decoded forms of well-known extensions
+	BackingFormat    string        `json:"backing_format,omitempty"`
+	ExternalDataFile string        `json:"external_data_file,omitempty"`
+	FeatureNames     []FeatureName `json:"feature_names,omitempty"`
+}
+
+// FeatureName is one entry of the feature name table extension.
+type FeatureName struct {
+	Type string `json:"type"` // "incompatible", "compatible", or "autoclear"
+	Bit  uint8  `json:"bit"`
+	Name string `json:"name"`
+}
+
+// L1Entry is one non-empty L1 table entry.
+type L1Entry struct {
+	Index         uint64    `json:"index"`
+	Raw           uint64    `json:"raw"`
+	L2Offset      uint64    `json:"l2_offset"`
+	Copied        bool      `json:"copied"`
+	VirtualOffset uint64    `json:"virtual_offset"`
+	L2            []L2Entry `json:"l2,omitempty"`
+}
+
+// L2Entry is one non-empty L2 table entry.
+type L2Entry struct {
+	Index          uint64 `json:"index"`
+	VirtualOffset  uint64 `json:"virtual_offset"`
+	Raw            uint64 `json:"raw"`
+	Type           string `json:"type"` // "normal", "compressed", "zero", or "unallocated"
+	HostOffset     uint64 `json:"host_offset,omitempty"`
+	CompressedSize uint64 `json:"compressed_size,omitempty"`
+	Copied         bool   `json:"copied"`
+
+	// Extended L2 images only
+	SubclusterBitmap uint64 `json:"subcluster_bitmap,omitempty"`
+}
+
+// RefcountEntry is one non-empty refcount table entry.
+type RefcountEntry struct {
+	Index       uint64            `json:"index"`
+	BlockOffset uint64            `json:"block_offset"`
+	Refcounts   []ClusterRefcount `json:"refcounts,omitempty"`
+}
+
+// ClusterRefcount is the refcount of a single host cluster.
+type ClusterRefcount struct {
+	Cluster  uint64 `json:"cluster"`
+	Offset   uint64 `json:"offset"`
+	Refcount uint64 `json:"refcount"`
+}
+
+// SnapshotEntry is one entry of the snapshot table.
+type SnapshotEntry struct {
+	Offset        uint64    `json:"offset"`
+	L1TableOffset uint64    `json:"l1_table_offset"`
+	L1Size        uint32    `json:"l1_size"`
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Date          time.Time `json:"date"`
+	VMClock       uint64    `json:"vm_clock"`
+	VMStateSize   uint32    `json:"vm_state_size"`
+	ExtraData     []byte    `json:"extra_data,omitempty"`
+	L1            []L1Entry `json:"l1,omitempty"`
+}
+
+// BitmapDirectory is one entry of the bitmap directory.
+type BitmapDirectory struct {
+	Offset          uint64   `json:"offset"`
+	Name            string   `json:"name"`
+	TableOffset     uint64   `json:"table_offset"`
+	TableSize       uint32   `json:"table_size"`
+	Flags           uint32   `json:"flags"`
+	Type            uint8    `json:"type"`
+	GranularityBits uint8    `json:"granularity_bits"`
+	ExtraData       []byte   `json:"extra_data,omitempty"`
+	Table           []uint64 `json:"table,omitempty"`
+}
+
+// inspector carries state while building a report.
+type inspector struct {
+	r      io.ReaderAt
+	opts   Options
+	report *Report
+	hdr    *qcow2.Header
+
+	clusterSize uint64
+	extendedL2  bool
+	bitmapExt   []byte
+}
+
+// InspectFile opens path read-only and inspects it.
+func InspectFile(path string, opts Options) (*Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2inspect: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("qcow2inspect: %w", err)
+	}
+	return Inspect(f, info.Size(), opts)
+}
+
+// Inspect dumps the metadata of the image in r, which is size bytes long.
+// An error is returned only if the header cannot be parsed at all; every
+// other problem is recorded in Report.Errors.
+func Inspect(r io.ReaderAt, size int64, opts Options) (*Report, error) {
+	buf := make([]byte, qcow2.HeaderSizeV3+1)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("qcow2inspect: failed to read header: %w", err)
+	}
+	hdr, err := qcow2.ParseHeader(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("qcow2inspect: %w", err)
+	}
+
+	in := &inspector{
+		r:      r,
+		opts:   opts,
+		report: &Report{FileSize: size},
+		hdr:    hdr,
+	}
+	in.report.Header = headerInfo(hdr)
+
+	// Sections that depend on the cluster size need a sane one
+	if hdr.ClusterBits < qcow2.MinClusterBits || hdr.ClusterBits > qcow2.MaxClusterBits {
+		in.errorf("header: cluster_bits %d out of range, skipping cluster-based structures", hdr.ClusterBits)
+		return in.report, nil
+	}
+	in.clusterSize = hdr.ClusterSize()
+	in.extendedL2 = hdr.HasExtendedL2()
+
+	in.readBackingFile()
+	in.readExtensions()
+	in.readL1()
+	in.readRefcounts()
+	in.readSnapshots()
+	in.readBitmaps()
+
+	return in.report, nil
+}
+
+// JSON returns the report as indented JSON.
+func (r *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (in *inspector) errorf(format string, args ...interface{}) {
+	in.report.Errors = append(in.report.Errors, fmt.Sprintf(format, args...))
+}
+
+// readFull reads len(p) bytes at off, treating a short read as an error.
+func (in *inspector) readFull(p []byte, off uint64) error {
+	n, err := in.r.ReadAt(p, int64(off))
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func headerInfo(h *qcow2.Header) Header {
+	return Header{
+		Magic:                 h.Magic,
+		Version:               h.Version,
+		BackingFileOffset:     h.BackingFileOffset,
+		BackingFileSize:       h.BackingFileSize,
+		ClusterBits:           h.ClusterBits,
+		ClusterSize:           uint64(1) << (h.ClusterBits & 63),
+		Size:                  h.Size,
+		EncryptMethod:         h.EncryptMethod,
+		L1Size:                h.L1Size,
+		L1TableOffset:         h.L1TableOffset,
+		RefcountTableOffset:   h.RefcountTableOffset,
+		RefcountTableClusters: h.RefcountTableClusters,
+		NbSnapshots:           h.NbSnapshots,
+		SnapshotsOffset:       h.SnapshotsOffset,
+		IncompatibleFeatures:  h.IncompatibleFeatures,
+		CompatibleFeatures:    h.CompatibleFeatures,
+		AutoclearFeatures:     h.AutoclearFeatures,
+		RefcountOrder:         h.RefcountOrder,
+		HeaderLength:          h.HeaderLength,
+		CompressionType:       h.CompressionType,
+	}
+}
+
+func (in *inspector) readBackingFile() {
+	h := in.hdr
+	if h.BackingFileOffset == 0 || h.BackingFileSize == 0 {
+		return
+	}
+	if h.BackingFileSize > 1023 {
+		in.errorf("header: backing file name length %d exceeds 1023", h.BackingFileSize)
+		return
+	}
+	name := make([]byte, h.BackingFileSize)
+	if err := in.readFull(name, h.BackingFileOffset); err != nil {
+		in.errorf("header: failed to read backing file name: %v", err)
+		return
+	}
+	in.report.Header.BackingFile = string(name)
+}
+
+// extensionName returns a human-readable name for a header extension type.
+func extensionName(t uint32) string {
+	switch t {
+	case qcow2.ExtensionBackingFormat:
+		return "backing_format"
+	case qcow2.ExtensionFeatureNameTable:
+		return "feature_name_table"
+	case qcow2.ExtensionBitmaps:
+		return "bitmaps"
+	case qcow2.ExtensionFullDiskEncrypt:
+		return "full_disk_encryption"
+	case qcow2.ExtensionExternalDataFile:
+		return "external_data_file"
+	default:
+		return "unknown"
+	}
+}
+
+func (in *inspector) readExtensions() {
+	start := uint64(qcow2.HeaderSizeV2)
+	if in.hdr.Version >= qcow2.Version3 {
+		start = uint64(in.hdr.HeaderLength)
+	}
+	end := in.clusterSize
+	if in.hdr.BackingFileOffset > 0 && in.hdr.BackingFileOffset < end {
+		end = in.hdr.BackingFileOffset
+	}
+
+	for off := start; off+8 <= end; {
+		var eh [8]byte
+		if err := in.readFull(eh[:], off); err != nil {
+			in.errorf("extension at 0x%x: %v", off, err)
+			return
+		}
+		ext := Extension{
+			Offset: off,
+			Type:   binary.BigEndian.Uint32(eh[0:4]),
+			Length: binary.BigEndian.Uint32(eh[4:8]),
+		}
+		if ext.Type == qcow2.ExtensionEndOfHeader {
+			return
+		}
+		ext.Name = extensionName(ext.Type)
+
+		if off+8+uint64(ext.Length) > end {
+			in.errorf("extension %s at 0x%x: length %d runs past end of header area", ext.Name, off, ext.Length)
+			return
+		}
+		ext.Data = make([]byte, ext.Length)
+		if err := in.readFull(ext.Data, off+8); err != nil {
+			in.errorf("extension %s at 0x%x: %v", ext.Name, off, err)
+			return
+		}
+
+		switch ext.Type {
+		case qcow2.ExtensionBackingFormat:
+			ext.BackingFormat = string(ext.Data)
+		case qcow2.ExtensionExternalDataFile:
+			ext.ExternalDataFile = string(ext.Data)
+		case qcow2.ExtensionFeatureNameTable:
+			ext.FeatureNames = parseFeatureNames(ext.Data)
+		case qcow2.ExtensionBitmaps:
+			in.bitmapExt = ext.Data
+		}
+
+		in.report.Extensions = append(in.report.Extensions, ext)
+		off += 8 + (uint64(ext.Length)+7)&^7
+	}
+}
+
+func parseFeatureNames(data []byte) []FeatureName {
+	var names []FeatureName
+	for i := 0; i+48 <= len(data); i += 48 {
+		entry := data[i : i+48]
+		typ := qcow2.FeatureType(entry[0]).String()
+		name := entry[2:48]
+		for j, b := range name {
+			if b == 0 {
+				name = name[:j]
+				break
+			}
+		}
+		names = append(names, FeatureName{Type: typ, Bit: entry[1], Name: string(name)})
+	}
+	return names
+}
+
+func (in *inspector) readL1() {
+	in.report.L1 = in.readL1Table("l1", in.hdr.L1TableOffset, in.hdr.L1Size)
+}
+
+// readL1Table reads an L1 table (active or snapshot) and, if requested, the
+// L2 tables it points to. label prefixes error messages.
+func (in *inspector) readL1Table(label string, offset uint64, size uint32) []L1Entry {
+	if size == 0 {
+		return nil
+	}
+	l1Bytes := uint64(size) * 8
+	if l1Bytes > maxL1Bytes {
+		in.errorf("%s: size %d entries exceeds inspection limit", label, size)
+		return nil
+	}
+	table := make([]byte, l1Bytes)
+	if err := in.readFull(table, offset); err != nil {
+		in.errorf("%s: failed to read table at 0x%x: %v", label, offset, err)
+		return nil
+	}
+
+	entrySize := uint64(8)
+	if in.extendedL2 {
+		entrySize = 16
+	}
+	l2Entries := in.clusterSize / entrySize
+	l2Coverage := l2Entries * in.clusterSize
+
+	var entries []L1Entry
+	for i := uint64(0); i < uint64(size); i++ {
+		raw := binary.BigEndian.Uint64(table[i*8:])
+		if raw == 0 {
+			continue
+		}
+		entry := L1Entry{
+			Index:         i,
+			Raw:           raw,
+			L2Offset:      raw & qcow2.L1EntryOffsetMask,
+			Copied:        raw&qcow2.L1EntryCopied != 0,
+			VirtualOffset: i * l2Coverage,
+		}
+		if entry.L2Offset&(in.clusterSize-1) != 0 {
+			in.errorf("%s[%d]: L2 offset 0x%x is not cluster-aligned", label, i, entry.L2Offset)
+		} else if in.opts.L2Tables && entry.L2Offset != 0 {
+			entry.L2 = in.readL2(label, i, entry.L2Offset, entry.VirtualOffset, entrySize)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (in *inspector) readL2(label string, l1Index, l2Offset, virtBase, entrySize uint64) []L2Entry {
+	table := make([]byte, in.clusterSize)
+	if err := in.readFull(table, l2Offset); err != nil {
+		in.errorf("%s[%d]: failed to read L2 table at 0x%x: %v", label, l1Index, l2Offset, err)
+		return nil
+	}
+
+	clusterBits := in.hdr.ClusterBits
+	var entries []L2Entry
+	for j := uint64(0); j < in.clusterSize/entrySize; j++ {
+		raw := binary.BigEndian.Uint64(table[j*entrySize:])
+		var bitmap uint64
+		if in.extendedL2 {
+			bitmap = binary.BigEndian.Uint64(table[j*entrySize+8:])
+		}
+		if raw == 0 && bitmap == 0 {
+			continue
+		}
+
+		e := L2Entry{
+			Index:            j,
+			VirtualOffset:    virtBase + j*in.clusterSize,
+			Raw:              raw,
+			Copied:           raw&qcow2.L2EntryCopied != 0,
+			SubclusterBitmap: bitmap,
+		}
+		switch {
+		case raw&qcow2.L2EntryCompressed != 0:
+			// See the compressed cluster descriptor in the QCOW2 spec
+			x := 70 - clusterBits
+			e.Type = "compressed"
+			e.HostOffset = raw & ((uint64(1) << x) - 1)
+			e.CompressedSize = (((raw >> x) & ((uint64(1) << (62 - x)) - 1)) + 1) * 512
+		case !in.extendedL2 && raw&qcow2.L2EntryZeroFlag != 0:
+			e.Type = "zero"
+			e.HostOffset = raw & qcow2.L2EntryOffsetMask
+		case raw&qcow2.L2EntryOffsetMask != 0:
+			e.Type = "normal"
+			e.HostOffset = raw & qcow2.L2EntryOffsetMask
+		default:
+			e.Type = "unallocated"
+		}
+		if e.Type == "normal" && e.HostOffset&(in.clusterSize-1) != 0 {
+			in.errorf("%s[%d] L2[%d]: host offset 0x%x is not cluster-aligned", label, l1Index, j, e.HostOffset)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (in *inspector) readRefcounts() {
+	h := in.hdr
+	tableBytes := uint64(h.RefcountTableClusters) * in.clusterSize
+	if tableBytes == 0 {
+		return
+	}
+	if tableBytes > maxRefcountTableBytes {
+		in.errorf("refcount: table of %d clusters exceeds inspection limit", h.RefcountTableClusters)
+		return
+	}
+	if h.RefcountOrder > 6 {
+		in.errorf("refcount: refcount_order %d out of range", h.RefcountOrder)
+		return
+	}
+	table := make([]byte, tableBytes)
+	if err := in.readFull(table, h.RefcountTableOffset); err != nil {
+		in.errorf("refcount: failed to read table at 0x%x: %v", h.RefcountTableOffset, err)
+		return
+	}
+
+	refBits := uint64(1) << h.RefcountOrder
+	perBlock := in.clusterSize * 8 / refBits
+
+	for i := uint64(0); i < tableBytes/8; i++ {
+		off := binary.BigEndian.Uint64(table[i*8:])
+		if off == 0 {
+			continue
+		}
+		entry := RefcountEntry{Index: i, BlockOffset: off}
+		if off&(in.clusterSize-1) != 0 {
+			in.errorf("refcount[%d]: block offset 0x%x is not cluster-aligned", i, off)
+		} else if in.opts.RefcountBlocks {
+			block := make([]byte, in.clusterSize)
+			if err := in.readFull(block, off); err != nil {
+				in.errorf("refcount[%d]: failed to read block at 0x%x: %v", i, off, err)
+			} else {
+				for k := uint64(0); k < perBlock; k++ {
+					rc := refcountAt(block, k, refBits)
+					if rc == 0 {
+						continue
+					}
+					cluster := i*perBlock + k
+					entry.Refcounts = append(entry.Refcounts, ClusterRefcount{
+						Cluster:  cluster,
+						Offset:   cluster * in.clusterSize,
+						Refcount: rc,
+					})
+				}
+			}
+		}
+		in.report.Refcounts = append(in.report.Refcounts, entry)
+	}
+}
+
+// refcountAt decodes entry k of a refcount block with the given entry width.
+func refcountAt(block []byte, k, bits uint64) uint64 {
+	switch bits {
+	case 8:
+		return uint64(block[k])
+	case 16:
+		return uint64(binary.BigEndian.Uint16(block[k*2:]))
+	case 32:
+		return uint64(binary.BigEndian.Uint32(block[k*4:]))
+	case 64:
+		return binary.BigEndian.Uint64(block[k*8:])
+	default:
+		// Sub-byte widths pack entries starting at the most significant bit,
+		// matching the qcow2 package
+		perByte := 8 / bits
+		shift := 8 - bits - (k%perByte)*bits
+		return uint64(block[k/perByte]>>shift) & ((1 << bits) - 1)
+	}
+}
+
+func (in *inspector) readSnapshots() {
+	h := in.hdr
+	if h.NbSnapshots == 0 {
+		return
+	}
+	if h.NbSnapshots > maxSnapshots {
+		in.errorf("snapshots: count %d exceeds limit", h.NbSnapshots)
+		return
+	}
+
+	off := h.SnapshotsOffset
+	for i := uint32(0); i < h.NbSnapshots; i++ {
+		var fixed [40]byte
+		if err := in.readFull(fixed[:], off); err != nil {
+			in.errorf("snapshot %d at 0x%x: %v", i, off, err)
+			return
+		}
+		idSize := uint64(binary.BigEndian.Uint16(fixed[12:14]))
+		nameSize := uint64(binary.BigEndian.Uint16(fixed[14:16]))
+		extraSize := uint64(binary.BigEndian.Uint32(fixed[36:40]))
+		if extraSize > 1024*1024 {
+			in.errorf("snapshot %d at 0x%x: extra data size %d is implausible", i, off, extraSize)
+			return
+		}
+
+		variable := make([]byte, extraSize+idSize+nameSize)
+		if err := in.readFull(variable, off+40); err != nil {
+			in.errorf("snapshot %d at 0x%x: %v", i, off, err)
+			return
+		}
+
+		s := SnapshotEntry{
+			Offset:        off,
+			L1TableOffset: binary.BigEndian.Uint64(fixed[0:8]),
+			L1Size:        binary.BigEndian.Uint32(fixed[8:12]),
+			Date: time.Unix(int64(binary.BigEndian.Uint32(fixed[16:20])),
+				int64(binary.BigEndian.Uint32(fixed[20:24]))).UTC(),
+			VMClock:     binary.BigEndian.Uint64(fixed[24:32]),
+			VMStateSize: binary.BigEndian.Uint32(fixed[32:36]),
+			ExtraData:   variable[:extraSize],
+			ID:          string(variable[extraSize : extraSize+idSize]),
+			Name:        string(variable[extraSize+idSize:]),
+		}
+		if in.opts.SnapshotTables {
+			s.L1 = in.readL1Table(fmt.Sprintf("snapshot %s l1", s.ID), s.L1TableOffset, s.L1Size)
+		}
+		in.report.Snapshots = append(in.report.Snapshots, s)
+
+		off += (40 + uint64(len(variable)) + 7) &^ 7
+	}
+}
+
+func (in *inspector) readBitmaps() {
+	if in.bitmapExt == nil {
+		return
+	}
+	if len(in.bitmapExt) < 24 {
+		in.errorf("bitmaps: extension too short (%d bytes)", len(in.bitmapExt))
+		return
+	}
+	count := binary.BigEndian.Uint32(in.bitmapExt[0:4])
+	dirSize := binary.BigEndian.Uint64(in.bitmapExt[8:16])
+	dirOffset := binary.BigEndian.Uint64(in.bitmapExt[16:24])
+	if count > maxBitmaps || dirSize > 64*1024*1024 {
+		in.errorf("bitmaps: directory of %d entries / %d bytes exceeds limit", count, dirSize)
+		return
+	}
+
+	dir := make([]byte, dirSize)
+	if err := in.readFull(dir, dirOffset); err != nil {
+		in.errorf("bitmaps: failed to read directory at 0x%x: %v", dirOffset, err)
+		return
+	}
+
+	pos := uint64(0)
+	for i := uint32(0); i < count; i++ {
+		if pos+24 > dirSize {
+			in.errorf("bitmaps: directory truncated at entry %d", i)
+			return
+		}
+		e := dir[pos:]
+		nameSize := uint64(binary.BigEndian.Uint16(e[18:20]))
+		extraSize := uint64(binary.BigEndian.Uint32(e[20:24]))
+		entrySize := (24 + extraSize + nameSize + 7) &^ 7
+		if pos+24+extraSize+nameSize > dirSize {
+			in.errorf("bitmaps: entry %d runs past end of directory", i)
+			return
+		}
+
+		b := BitmapDirectory{
+			Offset:          dirOffset + pos,
+			TableOffset:     binary.BigEndian.Uint64(e[0:8]),
+			TableSize:       binary.BigEndian.Uint32(e[8:12]),
+			Flags:           binary.BigEndian.Uint32(e[12:16]),
+			Type:            e[16],
+			GranularityBits: e[17],
+			ExtraData:       e[24 : 24+extraSize],
+			Name:            string(e[24+extraSize : 24+extraSize+nameSize]),
+		}
+		if in.opts.BitmapTables && b.TableSize > 0 {
+			table := make([]byte, uint64(b.TableSize)*8)
+			if err := in.readFull(table, b.TableOffset); err != nil {
+				in.errorf("bitmap %q: failed to read table at 0x%x: %v", b.Name, b.TableOffset, err)
+			} else {
+				b.Table = make([]uint64, b.TableSize)
+				for k := range b.Table {
+					b.Table[k] = binary.BigEndian.Uint64(table[k*8:])
+				}
+			}
+		}
+		in.report.Bitmaps = append(in.report.Bitmaps, b)
+		pos += entrySize
+	}
+}
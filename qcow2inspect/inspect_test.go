@@ -0,0 +1,127 @@
+package qcow2inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// TestInspectImage dumps an image with data, compression, and a snapshot.
+func TestInspectImage(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inspect.qcow2")
+
+	img, err := qcow2.CreateSimple(path, 8*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte{2}, cs), int64(2*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	if err := img.WriteZeroAt(int64(4*cs), int64(cs)); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("snap1"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	img.Close()
+
+	report, err := InspectFile(path, Options{L2Tables: true, RefcountBlocks: true})
+	if err != nil {
+		t.Fatalf("InspectFile failed: %v", err)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("unexpected errors: %v", report.Errors)
+	}
+	if report.Header.Size != 8*1024*1024 || report.Header.ClusterSize != uint64(cs) {
+		t.Errorf("unexpected header: %+v", report.Header)
+	}
+
+	if len(report.L1) != 1 {
+		t.Fatalf("expected 1 L1 entry, got %d", len(report.L1))
+	}
+	types := map[uint64]string{}
+	for _, e := range report.L1[0].L2 {
+		types[e.VirtualOffset] = e.Type
+	}
+	want := map[uint64]string{0: "normal", uint64(2 * cs): "compressed", uint64(4 * cs): "zero"}
+	for off, typ := range want {
+		if types[off] != typ {
+			t.Errorf("L2 entry at 0x%x: type %q, want %q", off, types[off], typ)
+		}
+	}
+
+	if len(report.Snapshots) != 1 || report.Snapshots[0].Name != "snap1" {
+		t.Errorf("unexpected snapshots: %+v", report.Snapshots)
+	}
+
+	if len(report.Refcounts) == 0 || len(report.Refcounts[0].Refcounts) == 0 {
+		t.Fatal("expected refcount entries")
+	}
+	if rc := report.Refcounts[0].Refcounts[0]; rc.Cluster != 0 || rc.Refcount != 1 {
+		t.Errorf("header cluster refcount = %+v", rc)
+	}
+
+	data, err := report.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("report JSON does not round-trip: %v", err)
+	}
+	if _, ok := decoded["header"]; !ok {
+		t.Error("JSON is missing header")
+	}
+}
+
+// TestInspectCorruptImage verifies damage is reported instead of failing.
+func TestInspectCorruptImage(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corrupt.qcow2")
+
+	img, err := qcow2.CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	l1Offset := img.Header().L1TableOffset
+	img.Close()
+
+	// Point L1[0] at a misaligned offset
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	var entry [8]byte
+	binary.BigEndian.PutUint64(entry[:], 0x10200)
+	if _, err := f.WriteAt(entry[:], int64(l1Offset)); err != nil {
+		t.Fatalf("corrupt write failed: %v", err)
+	}
+	f.Close()
+
+	report, err := InspectFile(path, Options{L2Tables: true})
+	if err != nil {
+		t.Fatalf("InspectFile failed: %v", err)
+	}
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "not cluster-aligned") {
+		t.Errorf("expected alignment error, got %v", report.Errors)
+	}
+	if len(report.L1) != 1 || report.L1[0].L2Offset != 0x10200 {
+		t.Errorf("corrupt L1 entry should still be reported: %+v", report.L1)
+	}
+}
@@ -0,0 +1,322 @@
+// Package qcow2io runs qemu-io style commands against a QCOW2 image, so test
+// scripts written against qemu-io can drive go-qcow2 instead.
+//
+// The supported commands and options are:
+//
+//	read [-P pattern] [-q] [-v] off len
+//	write [-P pattern | -z [-u]] [-c] [-q] off len
+//	discard [-q] off len
+//	map
+//	flush
+//	length
+//
+// Offsets and lengths take qemu-io's K, M, G, T, P and E suffixes. Output
+// matches qemu-io's, without the timing line that follows each read or
+// write; scripts usually filter it out anyway. Unlike qemu-io, map only
+// counts ranges allocated in the image itself, not in its backing files.
+package qcow2io
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// ErrVerifyFailed is returned by a read whose data does not match its -P
+// pattern.
+var ErrVerifyFailed = errors.New("qcow2io: pattern verification failed")
+
+// Session runs commands against one image.
+type Session struct {
+	img *qcow2.Image
+	out io.Writer
+}
+
+// New returns a session running commands against img and writing their
+// output to out.
+func New(img *qcow2.Image, out io.Writer) *Session {
+	return &Session{img: img, out: out}
+}
+
+// command is one qemu-io command: its getopt option string, and how to run
+// it with the parsed options and remaining arguments.
+type command struct {
+	opts string
+	args int
+	run  func(s *Session, opts map[byte]string, args []string) error
+}
+
+var commands = map[string]command{
+	"read":    {"P:qv", 2, (*Session).read},
+	"write":   {"P:zucq", 2, (*Session).write},
+	"discard": {"q", 2, (*Session).discard},
+	"map":     {"", 0, (*Session).mapImage},
+	"flush":   {"", 0, func(s *Session, _ map[byte]string, _ []string) error { return s.img.Flush() }},
+	"length":  {"", 0, (*Session).length},
+}
+
+// Exec runs a single command line, such as "write -P 0xab 0 64k".
+func (s *Session) Exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	cmd, ok := commands[fields[0]]
+	if !ok {
+		return fmt.Errorf("qcow2io: unknown command %q", fields[0])
+	}
+	opts, args, err := getopt(fields[1:], cmd.opts)
+	if err != nil {
+		return fmt.Errorf("qcow2io: %s: %w", fields[0], err)
+	}
+	if len(args) != cmd.args {
+		return fmt.Errorf("qcow2io: %s: want %d arguments, got %d", fields[0], cmd.args, len(args))
+	}
+	return cmd.run(s, opts, args)
+}
+
+func (s *Session) read(opts map[byte]string, args []string) error {
+	off, length, err := parseRange(args)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, length)
+	n, err := s.img.ReadAt(buf, off)
+	if err != nil {
+		return fmt.Errorf("read failed: %w", err)
+	}
+
+	if p, ok := opts['P']; ok {
+		pattern, err := parsePattern(p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, bytes.Repeat([]byte{pattern}, length)) {
+			fmt.Fprintf(s.out, "Pattern verification failed at offset %d, %d bytes\n", off, length)
+			return ErrVerifyFailed
+		}
+	}
+	if _, ok := opts['v']; ok {
+		dumpBuffer(s.out, buf, off)
+	}
+	if _, ok := opts['q']; !ok {
+		fmt.Fprintf(s.out, "read %d/%d bytes at offset %d\n", n, length, off)
+	}
+	return nil
+}
+
+func (s *Session) write(opts map[byte]string, args []string) error {
+	off, length, err := parseRange(args)
+	if err != nil {
+		return err
+	}
+	_, zero := opts['z']
+	_, unmap := opts['u']
+	_, compressed := opts['c']
+	p, hasPattern := opts['P']
+	switch {
+	case zero && (hasPattern || compressed):
+		return errors.New("qcow2io: write: -z cannot be combined with -P or -c")
+	case unmap && !zero:
+		return errors.New("qcow2io: write: -u requires -z")
+	}
+
+	if zero {
+		mode := qcow2.ZeroAlloc
+		if unmap {
+			mode = qcow2.ZeroPlain
+		}
+		if err := s.img.WriteZeroAtMode(off, int64(length), mode); err != nil {
+			return fmt.Errorf("write failed: %w", err)
+		}
+	} else {
+		pattern := byte(0xcd)
+		if hasPattern {
+			if pattern, err = parsePattern(p); err != nil {
+				return err
+			}
+		}
+		buf := bytes.Repeat([]byte{pattern}, length)
+		if compressed {
+			_, err = s.img.WriteAtCompressed(buf, off)
+		} else {
+			_, err = s.img.WriteAt(buf, off)
+		}
+		if err != nil {
+			return fmt.Errorf("write failed: %w", err)
+		}
+	}
+	if _, ok := opts['q']; !ok {
+		fmt.Fprintf(s.out, "wrote %d/%d bytes at offset %d\n", length, length, off)
+	}
+	return nil
+}
+
+func (s *Session) discard(opts map[byte]string, args []string) error {
+	off, length, err := parseRange(args)
+	if err != nil {
+		return err
+	}
+	if err := s.img.WriteZeroAtMode(off, int64(length), qcow2.ZeroPlain); err != nil {
+		return fmt.Errorf("discard failed: %w", err)
+	}
+	if _, ok := opts['q']; !ok {
+		fmt.Fprintf(s.out, "discard %d/%d bytes at offset %d\n", length, length, off)
+	}
+	return nil
+}
+
+// mapImage prints the ranges allocated and not allocated in the image,
+// merging data and zero clusters as qemu-io does.
+func (s *Session) mapImage(_ map[byte]string, _ []string) error {
+	extents, err := s.img.Map(0, s.img.Size())
+	if err != nil {
+		return fmt.Errorf("map failed: %w", err)
+	}
+	var start, length uint64
+	var allocated bool
+	flush := func() {
+		if length == 0 {
+			return
+		}
+		state := "not allocated"
+		if allocated {
+			state = "    allocated"
+		}
+		fmt.Fprintf(s.out, "%s (0x%x) bytes %s at offset %s (0x%x)\n",
+			cvtstr(length), length, state, cvtstr(start), start)
+	}
+	for _, e := range extents {
+		isAlloc := e.Type == qcow2.ExtentData || e.Type == qcow2.ExtentZero
+		if length > 0 && isAlloc == allocated {
+			length += e.Length
+			continue
+		}
+		flush()
+		start, length, allocated = e.Start, e.Length, isAlloc
+	}
+	flush()
+	return nil
+}
+
+func (s *Session) length(_ map[byte]string, _ []string) error {
+	fmt.Fprintln(s.out, cvtstr(uint64(s.img.Size())))
+	return nil
+}
+
+// getopt splits args into options, as described by a getopt(3) option
+// string, and the remaining arguments.
+func getopt(args []string, spec string) (map[byte]string, []string, error) {
+	opts := make(map[byte]string)
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+	chars:
+		for i := 1; i < len(arg); i++ {
+			j := strings.IndexByte(spec, arg[i])
+			if j < 0 || arg[i] == ':' {
+				return nil, nil, fmt.Errorf("invalid option -%c", arg[i])
+			}
+			if j+1 == len(spec) || spec[j+1] != ':' {
+				opts[arg[i]] = ""
+				continue
+			}
+			switch {
+			case i+1 < len(arg):
+				opts[arg[i]] = arg[i+1:]
+			case len(args) > 0:
+				opts[arg[i]] = args[0]
+				args = args[1:]
+			default:
+				return nil, nil, fmt.Errorf("option -%c requires an argument", arg[i])
+			}
+			break chars
+		}
+	}
+	return opts, args, nil
+}
+
+// parseRange parses an offset and length argument pair.
+func parseRange(args []string) (int64, int, error) {
+	off, err := cvtnum(args[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := cvtnum(args[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if length > 1<<31 {
+		return 0, 0, fmt.Errorf("qcow2io: length %d is too large", length)
+	}
+	return off, int(length), nil
+}
+
+// cvtnum parses a number with an optional binary size suffix, as qemu-io
+// does.
+func cvtnum(s string) (int64, error) {
+	shift := 0
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("bkmgtpe", s[n-1]|0x20); i >= 0 && !strings.HasPrefix(s, "0x") {
+			shift = 10 * i
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil || v < 0 || v > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("qcow2io: invalid number %q", s)
+	}
+	return v << shift, nil
+}
+
+// parsePattern parses a -P byte pattern.
+func parsePattern(s string) (byte, error) {
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("qcow2io: invalid pattern %q", s)
+	}
+	return byte(v), nil
+}
+
+// cvtstr formats a size the way qemu-io does: "64 KiB", "1.500000 MiB",
+// "512 bytes".
+func cvtstr(v uint64) string {
+	units := []string{" EiB", " PiB", " TiB", " GiB", " MiB", " KiB"}
+	value, suffix := float64(v), " bytes"
+	for i, unit := range units {
+		if limit := uint64(1) << (10 * (6 - i)); v >= limit {
+			value, suffix = float64(v)/float64(limit), unit
+			break
+		}
+	}
+	str := strconv.FormatFloat(value, 'f', 6, 64)
+	if i := strings.Index(str, ".000"); i >= 0 {
+		return str[:i] + suffix
+	}
+	return str + suffix
+}
+
+// dumpBuffer prints buf as qemu-io's read -v does: offsets, 16 hex bytes
+// per line, then the printable characters.
+func dumpBuffer(w io.Writer, buf []byte, off int64) {
+	for i := 0; i < len(buf); i += 16 {
+		line := buf[i:min(i+16, len(buf))]
+		fmt.Fprintf(w, "%08x:  ", off+int64(i))
+		for _, b := range line {
+			fmt.Fprintf(w, "%02x ", b)
+		}
+		fmt.Fprint(w, " ")
+		for _, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			fmt.Fprintf(w, "%c", b)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,102 @@
+package qcow2io
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2"
+)
+
+// TestSession runs a qemu-io style script and compares its output with what
+// qemu-io prints for the same commands.
+func TestSession(t *testing.T) {
+	t.Parallel()
+	img, err := qcow2.CreateSimple(filepath.Join(t.TempDir(), "io.qcow2"), 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	var out strings.Builder
+	s := New(img, &out)
+	script := []string{
+		"write -P 0xab 0 64k",
+		"write -z 128k 64k",
+		"write -q -P 7 1M 512",
+		"read -P 0xab 0 64k",
+		"read -P 0 128k 64k",
+		"read -v 1M 16",
+		"discard 0 64k",
+		"flush",
+		"map",
+		"length",
+	}
+	for _, cmd := range script {
+		if err := s.Exec(cmd); err != nil {
+			t.Fatalf("%q failed: %v", cmd, err)
+		}
+	}
+
+	want := `wrote 65536/65536 bytes at offset 0
+wrote 65536/65536 bytes at offset 131072
+read 65536/65536 bytes at offset 0
+read 65536/65536 bytes at offset 131072
+00100000:  07 07 07 07 07 07 07 07 07 07 07 07 07 07 07 07  ................
+read 16/16 bytes at offset 1048576
+discard 65536/65536 bytes at offset 0
+64 KiB (0x10000) bytes     allocated at offset 0 bytes (0x0)
+64 KiB (0x10000) bytes not allocated at offset 64 KiB (0x10000)
+64 KiB (0x10000) bytes     allocated at offset 128 KiB (0x20000)
+832 KiB (0xd0000) bytes not allocated at offset 192 KiB (0x30000)
+64 KiB (0x10000) bytes     allocated at offset 1 MiB (0x100000)
+2.937500 MiB (0x2f0000) bytes not allocated at offset 1.062500 MiB (0x110000)
+4 MiB
+`
+	if got := out.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestSessionErrors checks pattern mismatches and malformed commands fail.
+func TestSessionErrors(t *testing.T) {
+	t.Parallel()
+	img, err := qcow2.CreateSimple(filepath.Join(t.TempDir(), "io.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	var out strings.Builder
+	s := New(img, &out)
+	if err := s.Exec("read -P 0x55 0 4k"); !errors.Is(err, ErrVerifyFailed) {
+		t.Errorf("mismatched read: got %v, want ErrVerifyFailed", err)
+	}
+	if got, want := out.String(), "Pattern verification failed at offset 0, 4096 bytes\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	for _, cmd := range []string{
+		"bogus 0 1",
+		"read 0",
+		"read -x 0 512",
+		"read -P",
+		"write -z -P 1 0 512",
+		"write -u 0 512",
+		"write -P 256 0 512",
+		"read 0 12q",
+	} {
+		if err := s.Exec(cmd); err == nil {
+			t.Errorf("%q succeeded, want an error", cmd)
+		}
+	}
+}
+
+func TestCvtnum(t *testing.T) {
+	t.Parallel()
+	for s, want := range map[string]int64{"512": 512, "0x200": 512, "4k": 4096, "1M": 1 << 20, "2g": 2 << 30, "0xb": 11} {
+		if got, err := cvtnum(s); err != nil || got != want {
+			t.Errorf("cvtnum(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+}
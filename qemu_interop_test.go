@@ -1386,3 +1386,49 @@ func TestQemuInterop_RevertToSnapshotMultiple(t *testing.T) {
 		t.Errorf("qemu-img check failed: %s", checkResult.Stderr)
 	}
 }
+
+// TestQemuInterop_ZstdMultiFrame writes 2MB clusters as multi-frame zstd
+// with go-qcow2 and reads them back with qemu-img.
+func TestQemuInterop_ZstdMultiFrame(t *testing.T) {
+	t.Parallel()
+	testutil.RequireQemu(t)
+
+	path := testutil.TempImage(t, "zstd_frames.qcow2")
+	img, err := Create(path, CreateOptions{Size: 8 << 20, ClusterBits: 21})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithZstdFrameSize(128*1024))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	img.SetCompressionLevel(CompressionDefault)
+	img.SetCompressionType(CompressionZstd)
+	want := make([]byte, 4<<20)
+	for i := 0; i < len(want); i += 8192 {
+		copy(want[i:], testutil.RandomBytes(int64(i), 2048))
+	}
+	for off := 0; off < len(want); off += img.ClusterSize() {
+		if _, err := img.WriteAtCompressed(want[off:off+img.ClusterSize()], int64(off)); err != nil {
+			t.Fatalf("WriteAtCompressed failed: %v", err)
+		}
+	}
+	img.Close()
+
+	if result := testutil.QemuCheck(t, path); !result.IsClean {
+		t.Errorf("qemu-img check not clean: %+v", result)
+	}
+	rawPath := testutil.TempImage(t, "zstd_frames.raw")
+	if result := testutil.RunQemuImg(t, "convert", "-f", "qcow2", "-O", "raw", path, rawPath); !result.IsSuccess() {
+		t.Fatalf("qemu-img convert failed: %s", result.Stderr)
+	}
+	got, err := os.ReadFile(rawPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(want)], want) {
+		t.Error("qemu-img read back different data")
+	}
+}
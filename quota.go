@@ -0,0 +1,54 @@
+package qcow2
+
+import (
+	"fmt"
+)
+
+// checkQuota fails with ErrQuotaExceeded if growing f to newSize bytes would
+// take the image's host footprint past the configured maximum. Refcount
+// block allocation is not checked: it happens in the middle of recording
+// another allocation, and failing there would leave refcounts inconsistent.
+func (img *Image) checkQuota(f File, newSize uint64) error {
+	if img.maxAllocation == 0 {
+		return nil
+	}
+
+	total := newSize
+	if img.externalDataFile != nil {
+		other := img.externalDataFile
+		if f == other {
+			other = img.file
+		}
+		info, err := other.Stat()
+		if err != nil {
+			return fmt.Errorf("qcow2: failed to stat file: %w", err)
+		}
+		total += uint64(info.Size())
+	}
+
+	if total > img.maxAllocation {
+		return fmt.Errorf("%w: allocation would use %d bytes, limit is %d", ErrQuotaExceeded, total, img.maxAllocation)
+	}
+	return nil
+}
+
+// growFile extends f from oldSize to size bytes for an allocation. If that
+// fails, for instance with ErrNoSpace part way through, f is cut back to
+// oldSize so no half-allocated space is left behind.
+func (img *Image) growFile(f File, oldSize int64, size uint64) error {
+	if err := f.Truncate(int64(size)); err != nil {
+		_ = f.Truncate(oldSize)
+		return err
+	}
+	img.fileGrew(size)
+	if fn := img.events.OnFileGrow; fn != nil {
+		fn(FileGrowEvent{DataFile: f != img.file, OldSize: uint64(oldSize), NewSize: size})
+	}
+	return nil
+}
+
+// MaxAllocation returns the host allocation limit set with
+// WithMaxAllocation, or 0 if there is none.
+func (img *Image) MaxAllocation() uint64 {
+	return img.maxAllocation
+}
@@ -0,0 +1,55 @@
+// quota_test.go - Allocation quota tests
+
+package qcow2
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestMaxAllocation verifies writes needing space beyond the cap fail while
+// overwrites of allocated clusters keep working.
+func TestMaxAllocation(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "quota.qcow2")
+
+	img, err := CreateSimple(path, 64*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	img.Close()
+
+	// Room for one L2 table and four data clusters
+	limit := uint64(testutil.FileSize(t, path)) + 5*uint64(cs)
+	img, err = Open(path, WithMaxAllocation(limit))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	if img.MaxAllocation() != limit {
+		t.Errorf("MaxAllocation = %d, want %d", img.MaxAllocation(), limit)
+	}
+
+	data := testutil.RandomBytes(1, 4*cs)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt within quota failed: %v", err)
+	}
+
+	_, err = img.WriteAt(data[:cs], int64(8*cs))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("WriteAt beyond quota: got %v, want ErrQuotaExceeded", err)
+	}
+	if size := uint64(testutil.FileSize(t, path)); size > limit {
+		t.Errorf("file size %d exceeds limit %d", size, limit)
+	}
+
+	// Overwriting allocated clusters needs no new space
+	if _, err := img.WriteAt(data[cs:2*cs], 0); err != nil {
+		t.Errorf("overwrite within quota failed: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package qcow2
+
+import "sync"
+
+// rangeLocks serializes guest writes that touch the same clusters
+// (WithWriteRangeLocking). Each write holds the run of clusters it covers
+// for its whole duration, so overlapping writes apply one after the other
+// and writes to disjoint clusters still run in parallel.
+type rangeLocks struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	held []clusterRange
+}
+
+// clusterRange is a run of guest cluster indices, end exclusive.
+type clusterRange struct{ start, end uint64 }
+
+func newRangeLocks() *rangeLocks {
+	l := &rangeLocks{}
+	l.cond.L = &l.mu
+	return l
+}
+
+// lock waits until no held range overlaps r, then holds r.
+func (l *rangeLocks) lock(r clusterRange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.overlaps(r) {
+		l.cond.Wait()
+	}
+	l.held = append(l.held, r)
+}
+
+// unlock releases a range taken with lock.
+func (l *rangeLocks) unlock(r clusterRange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, h := range l.held {
+		if h == r {
+			l.held[i] = l.held[len(l.held)-1]
+			l.held = l.held[:len(l.held)-1]
+			break
+		}
+	}
+	l.cond.Broadcast()
+}
+
+func (l *rangeLocks) overlaps(r clusterRange) bool {
+	for _, h := range l.held {
+		if h.start < r.end && r.start < h.end {
+			return true
+		}
+	}
+	return false
+}
+
+// lockRange holds the clusters of the guest range [off, off+length) until
+// the returned function is called. Without WithWriteRangeLocking, or for
+// an empty or negative range, which the write rejects anyway, it does
+// nothing.
+func (img *Image) lockRange(off, length int64) func() {
+	if img.rangeLocks == nil || off < 0 || length <= 0 {
+		return func() {}
+	}
+	r := clusterRange{
+		start: uint64(off) >> img.clusterBits,
+		end:   (uint64(off+length)-1)>>img.clusterBits + 1,
+	}
+	img.rangeLocks.lock(r)
+	return func() { img.rangeLocks.unlock(r) }
+}
@@ -0,0 +1,388 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// OrphanKind classifies an orphaned cluster by its contents.
+type OrphanKind int
+
+const (
+	// OrphanData is a cluster of guest data, or of anything not recognized.
+	OrphanData OrphanKind = iota
+
+	// OrphanL2Table is a cluster that parses as an L2 table no L1 table
+	// points to, such as one dropped by a damaged L1 table.
+	OrphanL2Table
+)
+
+// OrphanCluster is a non-zero cluster of the image file that no metadata
+// references.
+type OrphanCluster struct {
+	// HostOffset is the offset of the cluster in the image file.
+	HostOffset uint64
+
+	Kind OrphanKind
+
+	// GuestOffset is the guessed guest offset of a data cluster, or -1 if
+	// nothing hints at one.
+	GuestOffset int64
+
+	// Hint describes what the guess, or the lack of one, is based on.
+	Hint string
+}
+
+// OrphanReport summarizes a ScanOrphans pass.
+type OrphanReport struct {
+	// ClustersScanned is the number of clusters in the image file.
+	ClustersScanned uint64
+
+	// ZeroClusters is the number of unreferenced clusters that only hold
+	// zeros. They are not listed in Orphans.
+	ZeroClusters uint64
+
+	// Orphans lists the unreferenced clusters holding data, in file order.
+	Orphans []OrphanCluster
+}
+
+// ScanOrphans reads every cluster of the image file that is not referenced
+// by the header, the refcount structures, the active or any snapshot's
+// L1/L2 tables, the snapshot table, bitmaps or the LUKS header, to find
+// data that damaged metadata no longer reaches. It guesses where each one
+// belongs in the guest, in order of confidence, from:
+//
+//   - an orphaned L2 table pointing to it, placed by the entries it shares
+//     with the active tables
+//   - a partition table (MBR or GPT), which belongs at guest offset 0
+//   - a host neighbor still mapped, since allocation tends to be sequential
+//
+// Clusters holding an ext2/3/4 or NTFS boot record are noted in the hint.
+// Only the image file is scanned, not an external data file. ScanOrphans
+// never modifies the image; it pairs well with OpenForensic. It returns
+// early with ctx.Err() if the context is cancelled, and runs at the priority
+// ctx carries (WithPriority).
+func (img *Image) ScanOrphans(ctx context.Context) (*OrphanReport, error) {
+	info, err := img.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to stat file: %w", err)
+	}
+	numClusters := uint64(info.Size()) >> img.clusterBits
+
+	refs, err := img.referencedClusters()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &OrphanReport{ClustersScanned: numClusters}
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	var tables []uint64 // Orphaned L2 tables, by index into report.Orphans
+	for idx := uint64(0); idx < numClusters; idx++ {
+		if refs.used[idx] {
+			continue
+		}
+		if _, err := img.waitTurn(ctx); err != nil {
+			return report, err
+		}
+		if _, err := img.file.ReadAt(buf, int64(idx<<img.clusterBits)); err != nil {
+			return report, fmt.Errorf("qcow2: failed to read cluster %d: %w", idx, err)
+		}
+		if isZeroBuffer(buf) {
+			report.ZeroClusters++
+			continue
+		}
+
+		orphan := OrphanCluster{HostOffset: idx << img.clusterBits, GuestOffset: -1}
+		if img.looksLikeL2Table(buf, numClusters) {
+			orphan.Kind = OrphanL2Table
+			tables = append(tables, uint64(len(report.Orphans)))
+		} else {
+			img.guessGuestOffset(&orphan, buf, refs.guest)
+		}
+		report.Orphans = append(report.Orphans, orphan)
+	}
+
+	// Orphaned L2 tables place their data clusters best, overriding the
+	// guesses above
+	for _, i := range tables {
+		if err := img.placeByL2Table(report, report.Orphans[i].HostOffset, refs.guest); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// ReadOrphan reads the cluster o into p, which must be at least one cluster
+// long.
+func (img *Image) ReadOrphan(o OrphanCluster, p []byte) error {
+	if uint64(len(p)) < img.clusterSize {
+		return fmt.Errorf("qcow2: buffer of %d bytes is smaller than a cluster", len(p))
+	}
+	_, err := img.file.ReadAt(p[:img.clusterSize], int64(o.HostOffset))
+	return err
+}
+
+// DumpOrphans writes each orphaned data cluster in report to its own file
+// in dir, named after its host offset and, if guessed, its guest offset.
+func (img *Image) DumpOrphans(report *OrphanReport, dir string) error {
+	buf := img.getClusterBuffer()
+	defer img.putClusterBuffer(buf)
+	for _, o := range report.Orphans {
+		if o.Kind != OrphanData {
+			continue
+		}
+		if err := img.ReadOrphan(o, buf); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("host-%012x.bin", o.HostOffset)
+		if o.GuestOffset >= 0 {
+			name = fmt.Sprintf("guest-%012x-host-%012x.bin", o.GuestOffset, o.HostOffset)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), buf, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterRefs records which host clusters the image's metadata references,
+// and the guest offset of each data cluster of the active L1 table.
+type clusterRefs struct {
+	used  map[uint64]bool
+	guest map[uint64]uint64
+}
+
+// markRange marks the clusters overlapping [off, off+length).
+func (r *clusterRefs) markRange(img *Image, off, length uint64) {
+	if length == 0 {
+		return
+	}
+	for idx := off >> img.clusterBits; idx <= (off+length-1)>>img.clusterBits; idx++ {
+		r.used[idx] = true
+	}
+}
+
+// referencedClusters walks all of the image's metadata. Unreadable tables
+// are skipped, since whatever they referenced is then what the caller is
+// looking for.
+func (img *Image) referencedClusters() (*clusterRefs, error) {
+	refs, l1Tables, err := img.referencedMetadata()
+	if err != nil {
+		return nil, err
+	}
+	for i, l1 := range l1Tables {
+		img.markL1(refs, l1, i == 0)
+	}
+	return refs, nil
+}
+
+// referencedMetadata is referencedClusters without walking the L1 tables:
+// it marks everything else and returns copies of the active L1 table,
+// first, and of each readable snapshot L1 table.
+func (img *Image) referencedMetadata() (*clusterRefs, [][]byte, error) {
+	if err := img.loadRefcountTable(); err != nil {
+		return nil, nil, fmt.Errorf("qcow2: failed to load refcount table: %w", err)
+	}
+	if err := img.faultAllL1(); err != nil {
+		return nil, nil, err
+	}
+
+	refs := &clusterRefs{used: make(map[uint64]bool), guest: make(map[uint64]uint64)}
+	refs.used[0] = true
+	refs.markRange(img, img.header.RefcountTableOffset, uint64(img.header.RefcountTableClusters)<<img.clusterBits)
+	img.refcountTableLock.RLock()
+	for i := 0; i+8 <= len(img.refcountTable); i += 8 {
+		if block := binary.BigEndian.Uint64(img.refcountTable[i:]); block != 0 {
+			refs.used[block>>img.clusterBits] = true
+		}
+	}
+	img.refcountTableLock.RUnlock()
+
+	if img.extensions != nil && img.extensions.EncryptionHeader != nil {
+		ext := img.extensions.EncryptionHeader
+		refs.markRange(img, ext.Offset, ext.Length)
+	}
+
+	img.l1Mu.RLock()
+	l1 := bytes.Clone(img.l1Table)
+	img.l1Mu.RUnlock()
+	refs.markRange(img, img.header.L1TableOffset, uint64(len(l1)))
+	l1Tables := [][]byte{l1}
+
+	// Snapshot table and the snapshots' own tables
+	if img.header.NbSnapshots > 0 && img.header.SnapshotsOffset != 0 {
+		offset := int64(img.header.SnapshotsOffset)
+		for i := uint32(0); i < img.header.NbSnapshots; i++ {
+			_, size, err := parseSnapshot(img.file, offset)
+			if err != nil {
+				break
+			}
+			offset += size
+		}
+		refs.markRange(img, img.header.SnapshotsOffset, uint64(offset)-img.header.SnapshotsOffset)
+	}
+	for _, snap := range img.snapshots {
+		l1 := make([]byte, uint64(snap.L1Size)*8)
+		if _, err := img.file.ReadAt(l1, int64(snap.L1TableOffset)); err != nil {
+			continue
+		}
+		refs.markRange(img, snap.L1TableOffset, uint64(len(l1)))
+		l1Tables = append(l1Tables, l1)
+	}
+
+	// Bitmap directory, tables and data
+	if img.bitmapExt != nil {
+		refs.markRange(img, img.bitmapExt.directoryOffset, img.bitmapExt.directorySize)
+		bitmaps, _ := img.Bitmaps()
+		for _, bm := range bitmaps {
+			table := make([]byte, uint64(bm.TableSize)*8)
+			if _, err := img.file.ReadAt(table, int64(bm.TableOffset)); err != nil {
+				continue
+			}
+			refs.markRange(img, bm.TableOffset, uint64(len(table)))
+			for i := 0; i < len(table); i += 8 {
+				if off := binary.BigEndian.Uint64(table[i:]) & BMETableEntryOffsetMask; off != 0 {
+					refs.used[off>>img.clusterBits] = true
+				}
+			}
+		}
+	}
+	return refs, l1Tables, nil
+}
+
+// markL1 marks the L2 tables of an L1 table and the clusters they map.
+// With active set, data clusters are also recorded by guest offset.
+func (img *Image) markL1(refs *clusterRefs, l1 []byte, active bool) {
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	for i := 0; i+8 <= len(l1); i += 8 {
+		l2Off := binary.BigEndian.Uint64(l1[i:]) & L1EntryOffsetMask
+		if l2Off == 0 {
+			continue
+		}
+		refs.used[l2Off>>img.clusterBits] = true
+		if _, err := img.file.ReadAt(l2Table, int64(l2Off)); err != nil {
+			continue
+		}
+		base := uint64(i/8) << (img.clusterBits + img.l2Bits)
+		for j := uint64(0); j < img.l2Entries; j++ {
+			entry := binary.BigEndian.Uint64(l2Table[j*uint64(img.l2EntrySize):])
+			if entry&L2EntryCompressed != 0 {
+				off, size := img.parseCompressedL2Entry(entry)
+				refs.markRange(img, off, size)
+				continue
+			}
+			dataOff := entry & L2EntryOffsetMask
+			if dataOff == 0 || img.externalDataFile != nil {
+				continue
+			}
+			refs.used[dataOff>>img.clusterBits] = true
+			if active {
+				refs.guest[dataOff>>img.clusterBits] = base + j<<img.clusterBits
+			}
+		}
+	}
+}
+
+// looksLikeL2Table reports whether buf parses as a standard L2 table with
+// at least one entry, every one pointing inside the file.
+func (img *Image) looksLikeL2Table(buf []byte, numClusters uint64) bool {
+	if img.extendedL2 {
+		return false
+	}
+	fileSize := numClusters << img.clusterBits
+	entries := 0
+	for i := 0; i+8 <= len(buf); i += 8 {
+		entry := binary.BigEndian.Uint64(buf[i:])
+		if entry == 0 {
+			continue
+		}
+		if entry&L2EntryCompressed != 0 {
+			if off, _ := img.parseCompressedL2Entry(entry); off >= fileSize {
+				return false
+			}
+		} else if entry&^(L2EntryCopied|L2EntryOffsetMask|L2EntryZeroFlag) != 0 ||
+			entry&L2EntryOffsetMask&img.offsetMask != 0 || entry&L2EntryOffsetMask >= fileSize {
+			return false
+		}
+		entries++
+	}
+	return entries > 0
+}
+
+// guessGuestOffset fills in a data cluster's guess from its contents or
+// its host neighbors.
+func (img *Image) guessGuestOffset(o *OrphanCluster, buf []byte, guest map[uint64]uint64) {
+	idx := o.HostOffset >> img.clusterBits
+	switch {
+	case len(buf) >= 520 && string(buf[512:520]) == "EFI PART":
+		o.GuestOffset, o.Hint = 0, "GPT header"
+		return
+	case buf[510] == 0x55 && buf[511] == 0xAA && buf[446]&0x7f == 0:
+		o.GuestOffset, o.Hint = 0, "MBR partition table"
+		return
+	}
+
+	if g, ok := guest[idx-1]; ok && idx > 0 {
+		o.GuestOffset = int64(g + img.clusterSize)
+		o.Hint = fmt.Sprintf("follows host cluster mapped at guest 0x%x", g)
+	} else if g, ok := guest[idx+1]; ok && g >= img.clusterSize {
+		o.GuestOffset = int64(g - img.clusterSize)
+		o.Hint = fmt.Sprintf("precedes host cluster mapped at guest 0x%x", g)
+	} else {
+		o.Hint = "no placement hint"
+	}
+
+	switch {
+	case len(buf) >= 1084 && binary.LittleEndian.Uint16(buf[1080:]) == 0xEF53:
+		o.Hint += "; ext2/3/4 superblock at 1024"
+	case string(buf[3:11]) == "NTFS    ":
+		o.Hint += "; NTFS boot sector"
+	}
+}
+
+// placeByL2Table anchors the orphaned L2 table at tableOff to a guest
+// range through an entry it shares with the active tables, and places the
+// orphaned data clusters it maps.
+func (img *Image) placeByL2Table(report *OrphanReport, tableOff uint64, guest map[uint64]uint64) error {
+	table := img.getClusterBuffer()
+	defer img.putClusterBuffer(table)
+	if _, err := img.file.ReadAt(table, int64(tableOff)); err != nil {
+		return err
+	}
+
+	base := int64(-1)
+	mapped := make(map[uint64]uint64) // host cluster -> entry index
+	for j := uint64(0); j < img.l2Entries; j++ {
+		entry := binary.BigEndian.Uint64(table[j*8:])
+		dataOff := entry & L2EntryOffsetMask
+		if entry&L2EntryCompressed != 0 || dataOff == 0 {
+			continue
+		}
+		idx := dataOff >> img.clusterBits
+		mapped[idx] = j
+		if g, ok := guest[idx]; ok && base < 0 && g>>img.clusterBits&(img.l2Entries-1) == j {
+			base = int64(g - j<<img.clusterBits)
+		}
+	}
+
+	for i := range report.Orphans {
+		o := &report.Orphans[i]
+		j, ok := mapped[o.HostOffset>>img.clusterBits]
+		if !ok || o.Kind != OrphanData {
+			continue
+		}
+		if base >= 0 {
+			o.GuestOffset = base + int64(j<<img.clusterBits)
+			o.Hint = fmt.Sprintf("entry %d of orphaned L2 table at 0x%x", j, tableOff)
+		} else {
+			o.Hint += fmt.Sprintf("; entry %d of orphaned L2 table at 0x%x, which could not be placed", j, tableOff)
+		}
+	}
+	return nil
+}
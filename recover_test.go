@@ -0,0 +1,103 @@
+// recover_test.go - Orphaned cluster scanner tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestScanOrphans verifies clusters dropped from the L2 tables are found
+// and placed back at their guest offsets, and that they can be dumped.
+func TestScanOrphans(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "damaged.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := int64(img.ClusterSize())
+	for i := int64(0); i < 4; i++ {
+		if _, err := img.WriteAt(bytes.Repeat([]byte{byte(i + 1)}, int(cs)), i*cs); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+	l2Off := int64(binary.BigEndian.Uint64(img.l1Table) & L1EntryOffsetMask)
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Keep a stale copy of the L2 table at the end of the file, then drop
+	// clusters 1 and 3 from the live one
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := make([]byte, cs)
+	if _, err := f.ReadAt(table, l2Off); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	staleOff := (info.Size() + cs - 1) &^ (cs - 1)
+	if _, err := f.WriteAt(table, staleOff); err != nil {
+		t.Fatal(err)
+	}
+	var zero [8]byte
+	for _, j := range []int64{1, 3} {
+		if _, err := f.WriteAt(zero[:], l2Off+j*8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	img, err = OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer img.Close()
+	report, err := img.ScanOrphans(context.Background())
+	if err != nil {
+		t.Fatalf("ScanOrphans failed: %v", err)
+	}
+
+	placed := make(map[int64]bool)
+	var tables int
+	for _, o := range report.Orphans {
+		if o.Kind == OrphanL2Table {
+			tables++
+			if o.HostOffset != uint64(staleOff) {
+				t.Errorf("L2 table orphan at 0x%x, want 0x%x", o.HostOffset, staleOff)
+			}
+			continue
+		}
+		buf := make([]byte, cs)
+		if err := img.ReadOrphan(o, buf); err != nil {
+			t.Fatalf("ReadOrphan failed: %v", err)
+		}
+		if want := o.GuestOffset/cs + 1; o.GuestOffset < 0 || int64(buf[0]) != want {
+			t.Errorf("orphan at 0x%x placed at %d (%s) but holds cluster %d", o.HostOffset, o.GuestOffset, o.Hint, buf[0]-1)
+		}
+		placed[o.GuestOffset] = true
+	}
+	if tables != 1 || len(placed) != 2 || !placed[cs] || !placed[3*cs] {
+		t.Errorf("orphans = %+v, want the stale L2 table and clusters 1 and 3", report.Orphans)
+	}
+
+	dumpDir := filepath.Join(dir, "dump")
+	if err := os.Mkdir(dumpDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.DumpOrphans(report, dumpDir); err != nil {
+		t.Fatalf("DumpOrphans failed: %v", err)
+	}
+	entries, err := os.ReadDir(dumpDir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("dumped %d files (%v), want 2", len(entries), err)
+	}
+}
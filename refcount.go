@@ -3,8 +3,25 @@ package qcow2
 import (
 	"encoding/binary"
 	"fmt"
+	"sync"
 )
 
+// pinnedRefcountBlock is the refcount block allocations are going to, held
+// in memory by WithRefcountWriteback. Updates to it are written back once
+// allocation moves to another block, at metadata barriers, or when the
+// image is flushed.
+type pinnedRefcountBlock struct {
+	mu     sync.Mutex
+	offset uint64 // 0 if no block is pinned
+	block  []byte
+	dirty  bool
+}
+
+// enableRefcountWriteback makes refcount updates go through a pinned block.
+func (img *Image) enableRefcountWriteback() {
+	img.refcountPin = &pinnedRefcountBlock{block: make([]byte, img.clusterSize)}
+}
+
 // loadRefcountTable loads the refcount table into memory.
 // The refcount table is a two-level structure:
 // - Level 1: Refcount table (array of 64-bit offsets to refcount blocks)
@@ -57,15 +74,27 @@ func (img *Image) getRefcount(hostOffset uint64) (uint64, error) {
 		return 0, nil // Block not allocated, refcount is 0
 	}
 
+	// The pinned block is newer than the cache and the file
+	if pin := img.refcountPin; pin != nil {
+		pin.mu.Lock()
+		defer pin.mu.Unlock()
+		if pin.offset == blockOffset {
+			return readRefcountEntry(pin.block, refcountBlockIndex, refcountBits), nil
+		}
+	}
+
 	// Check cache first
-	block := img.refcountBlockCache.get(blockOffset)
-	if block == nil {
+	block := img.getClusterBuffer()
+	defer img.putClusterBuffer(block)
+	if !img.refcountBlockCache.readAt(blockOffset, block, 0) {
 		// Cache miss - read from disk
-		block = make([]byte, img.clusterSize)
 		_, err := img.file.ReadAt(block, int64(blockOffset))
 		if err != nil {
 			return 0, fmt.Errorf("qcow2: failed to read refcount block: %w", err)
 		}
+		if err := img.verifyMetadata(blockOffset, block); err != nil {
+			return 0, fmt.Errorf("qcow2: refcount block at 0x%x: %w", blockOffset, err)
+		}
 		// Add to cache
 		img.refcountBlockCache.put(blockOffset, block)
 	}
@@ -232,13 +261,21 @@ func (img *Image) updateRefcount(hostOffset uint64, delta int64) error {
 		}
 	}
 
-	// Check cache first, otherwise read from disk
-	block := img.refcountBlockCache.get(blockOffset)
-	if block == nil {
-		block = make([]byte, img.clusterSize)
-		_, err := img.file.ReadAt(block, int64(blockOffset))
-		if err != nil {
-			return fmt.Errorf("qcow2: failed to read refcount block: %w", err)
+	// Update the pinned block in place, or a copy from the cache or disk
+	pin := img.refcountPin
+	var block []byte
+	if pin != nil {
+		pin.mu.Lock()
+		defer pin.mu.Unlock()
+		if err := img.pinRefcountBlock(blockOffset); err != nil {
+			return err
+		}
+		block = pin.block
+	} else {
+		block = img.getClusterBuffer()
+		defer img.putClusterBuffer(block)
+		if err := img.readRefcountBlock(blockOffset, block); err != nil {
+			return err
 		}
 	}
 
@@ -264,14 +301,17 @@ func (img *Image) updateRefcount(hostOffset uint64, delta int64) error {
 	// Write new refcount
 	writeRefcountEntry(block, refcountBlockIndex, refcountBits, newRefcount)
 
-	// Write block back to disk
-	_, err := img.file.WriteAt(block, int64(blockOffset))
-	if err != nil {
-		return fmt.Errorf("qcow2: failed to write refcount block: %w", err)
-	}
+	if pin != nil {
+		pin.dirty = true
+	} else {
+		// Write block back to disk
+		if _, err := img.file.WriteAt(block, int64(blockOffset)); err != nil {
+			return fmt.Errorf("qcow2: failed to write refcount block: %w", err)
+		}
 
-	// Update cache
-	img.refcountBlockCache.put(blockOffset, block)
+		// Update cache
+		img.refcountBlockCache.put(blockOffset, block)
+	}
 
 	// Update free bitmap if it exists
 	if img.freeBitmap != nil {
@@ -289,9 +329,93 @@ func (img *Image) updateRefcount(hostOffset uint64, delta int64) error {
 	return nil
 }
 
+// readRefcountBlock reads the refcount block at blockOffset into block,
+// from the cache if it is there.
+func (img *Image) readRefcountBlock(blockOffset uint64, block []byte) error {
+	if img.refcountBlockCache.readAt(blockOffset, block, 0) {
+		return nil
+	}
+	if _, err := img.file.ReadAt(block, int64(blockOffset)); err != nil {
+		return fmt.Errorf("qcow2: failed to read refcount block: %w", err)
+	}
+	if err := img.verifyMetadata(blockOffset, block); err != nil {
+		return fmt.Errorf("qcow2: refcount block at 0x%x: %w", blockOffset, err)
+	}
+	return nil
+}
+
+// pinRefcountBlock makes the block at blockOffset the pinned one, writing
+// back the block pinned before. Must be called with the pin locked.
+func (img *Image) pinRefcountBlock(blockOffset uint64) error {
+	pin := img.refcountPin
+	if pin.offset == blockOffset {
+		return nil
+	}
+	if err := img.writebackRefcountPinLocked(); err != nil {
+		return err
+	}
+	pin.offset = 0
+	if err := img.readRefcountBlock(blockOffset, pin.block); err != nil {
+		return err
+	}
+	pin.offset = blockOffset
+	return nil
+}
+
+// writebackRefcountPinLocked writes the pinned block to disk if it has
+// unwritten updates. Must be called with the pin locked.
+func (img *Image) writebackRefcountPinLocked() error {
+	pin := img.refcountPin
+	if !pin.dirty {
+		return nil
+	}
+	if _, err := img.file.WriteAt(pin.block, int64(pin.offset)); err != nil {
+		return fmt.Errorf("qcow2: failed to write refcount block: %w", err)
+	}
+	img.refcountBlockCache.put(pin.offset, pin.block)
+	pin.dirty = false
+	return nil
+}
+
+// writebackRefcountPin writes back the pinned refcount block, if any.
+func (img *Image) writebackRefcountPin() error {
+	pin := img.refcountPin
+	if pin == nil {
+		return nil
+	}
+	pin.mu.Lock()
+	defer pin.mu.Unlock()
+	return img.writebackRefcountPinLocked()
+}
+
+// unpinRefcountBlock writes back and releases the pinned refcount block, for
+// code that reads or writes refcount blocks on disk directly. If discard is
+// set, unwritten updates are dropped instead.
+func (img *Image) unpinRefcountBlock(discard bool) error {
+	pin := img.refcountPin
+	if pin == nil {
+		return nil
+	}
+	pin.mu.Lock()
+	defer pin.mu.Unlock()
+	if discard {
+		pin.dirty = false
+	}
+	if err := img.writebackRefcountPinLocked(); err != nil {
+		return err
+	}
+	pin.offset = 0
+	return nil
+}
+
 // allocateRefcountBlock allocates a new refcount block and updates the table.
 // Must be called with refcountTableLock held.
 func (img *Image) allocateRefcountBlock(tableIndex uint64) (uint64, error) {
+	// The new block's own refcount may go into the pinned block
+	if err := img.unpinRefcountBlock(false); err != nil {
+		return 0, err
+	}
+
 	// Get current file size for allocation
 	info, err := img.file.Stat()
 	if err != nil {
@@ -305,7 +429,7 @@ func (img *Image) allocateRefcountBlock(tableIndex uint64) (uint64, error) {
 	}
 
 	// Extend file
-	if err := img.file.Truncate(int64(offset + img.clusterSize)); err != nil {
+	if err := img.growFile(img.file, info.Size(), offset+img.clusterSize); err != nil {
 		return 0, err
 	}
 
@@ -318,10 +442,12 @@ func (img *Image) allocateRefcountBlock(tableIndex uint64) (uint64, error) {
 	// Update refcount table entry
 	binary.BigEndian.PutUint64(img.refcountTable[tableIndex*8:], offset)
 
-	// Write updated table entry to disk
+	// Write updated table entry to disk; the in-memory table must not point
+	// at a block the file does not know about
 	_, err = img.file.WriteAt(img.refcountTable[tableIndex*8:tableIndex*8+8],
 		int64(img.header.RefcountTableOffset+tableIndex*8))
 	if err != nil {
+		binary.BigEndian.PutUint64(img.refcountTable[tableIndex*8:], 0)
 		return 0, fmt.Errorf("qcow2: failed to update refcount table: %w", err)
 	}
 
@@ -352,9 +478,9 @@ func (img *Image) allocateRefcountBlock(tableIndex uint64) (uint64, error) {
 		if newBlockTableIndex < uint64(len(img.refcountTable))/8 {
 			trackingBlockOffset := binary.BigEndian.Uint64(img.refcountTable[newBlockTableIndex*8:])
 			if trackingBlockOffset != 0 {
-				trackingBlock := img.refcountBlockCache.get(trackingBlockOffset)
-				if trackingBlock == nil {
-					trackingBlock = make([]byte, img.clusterSize)
+				trackingBlock := img.getClusterBuffer()
+				defer img.putClusterBuffer(trackingBlock)
+				if !img.refcountBlockCache.readAt(trackingBlockOffset, trackingBlock, 0) {
 					if _, err := img.file.ReadAt(trackingBlock, int64(trackingBlockOffset)); err != nil {
 						return 0, fmt.Errorf("qcow2: failed to read tracking refcount block: %w", err)
 					}
@@ -371,6 +497,7 @@ func (img *Image) allocateRefcountBlock(tableIndex uint64) (uint64, error) {
 		}
 	}
 
+	img.allocated(offset, img.clusterSize, AllocMetadata, false)
 	return offset, nil
 }
 
@@ -401,9 +528,15 @@ func (img *Image) rebuildRefcounts() error {
 	if err := img.loadRefcountTable(); err != nil {
 		return err
 	}
+	if err := img.faultAllL1(); err != nil {
+		return err
+	}
 
 	// Clear refcount block cache since we're rebuilding everything
 	img.refcountBlockCache.clear()
+	if err := img.unpinRefcountBlock(true); err != nil {
+		return err
+	}
 
 	// Get refcount configuration
 	refcountBits := img.header.RefcountBits()
@@ -413,13 +546,14 @@ func (img *Image) rebuildRefcounts() error {
 	}
 
 	// First, zero all existing refcount blocks
+	zeros := img.getZeroedClusterBuffer()
+	defer img.putClusterBuffer(zeros)
 	tableEntries := uint64(len(img.refcountTable)) / 8
 	for i := uint64(0); i < tableEntries; i++ {
 		blockOffset := binary.BigEndian.Uint64(img.refcountTable[i*8:])
 		if blockOffset == 0 {
 			continue
 		}
-		zeros := make([]byte, img.clusterSize)
 		if _, err := img.file.WriteAt(zeros, int64(blockOffset)); err != nil {
 			return fmt.Errorf("qcow2: failed to zero refcount block: %w", err)
 		}
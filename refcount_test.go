@@ -5,6 +5,7 @@ package qcow2
 
 import (
 	"bytes"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -510,3 +511,113 @@ func TestRefcountMixedOperations(t *testing.T) {
 		t.Errorf("Check found %d corruptions after mixed operations", result.Corruptions)
 	}
 }
+
+// TestRefcountWriteback checks that WithRefcountWriteback writes refcount
+// blocks once per block rather than per allocated cluster, that Flush
+// persists them, and that an image copied before Flush can be repaired.
+func TestRefcountWriteback(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	// 4 KiB clusters: one refcount block covers 2048 clusters, so the
+	// writes below move on to a second block
+	const clusters = 3000
+	allocate := func(path string, opts ...Option) (*Image, uint64) {
+		t.Helper()
+		img, err := Create(path, CreateOptions{Size: 64 * 1024 * 1024, ClusterBits: 12})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		img.Close()
+
+		var ff *testutil.FaultFile
+		opts = append(opts, WithFileWrapper(func(f File) File {
+			ff = testutil.NewFaultFile(f, testutil.FaultConfig{})
+			return ff
+		}))
+		img, err = Open(path, opts...)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		img.SetWriteBarrierMode(BarrierNone)
+		before := ff.Calls(testutil.OpWrite)
+		for i := 0; i < clusters; i++ {
+			data := bytes.Repeat([]byte{byte(i)}, 4096)
+			if _, err := img.WriteAt(data, int64(i)*4096); err != nil {
+				t.Fatalf("WriteAt %d failed: %v", i, err)
+			}
+		}
+		return img, ff.Calls(testutil.OpWrite) - before
+	}
+
+	plain, plainWrites := allocate(filepath.Join(dir, "plain.qcow2"))
+	plain.Close()
+	path := filepath.Join(dir, "writeback.qcow2")
+	img, writes := allocate(path, WithRefcountWriteback())
+	defer img.Close()
+	if writes > plainWrites-clusters+10 {
+		t.Errorf("%d writes with write-back, %d without; want about %d fewer", writes, plainWrites, clusters)
+	}
+
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean before flush: %+v", result)
+	}
+
+	// Flush makes the file complete on its own
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	openCopy := func(name string) (*Image, *CheckResult) {
+		t.Helper()
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyPath := filepath.Join(dir, name)
+		if err := os.WriteFile(copyPath, raw, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cp, err := Open(copyPath)
+		if err != nil {
+			t.Fatalf("Open copy failed: %v", err)
+		}
+		t.Cleanup(func() { cp.Close() })
+		got := make([]byte, 4096)
+		if _, err := cp.ReadAt(got, 100*4096); err != nil || got[0] != 100 {
+			t.Errorf("copy reads %d, %v at cluster 100", got[0], err)
+		}
+		result, err := cp.Check()
+		if err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		return cp, result
+	}
+	if _, result := openCopy("flushed.qcow2"); !result.IsClean() {
+		t.Errorf("flushed copy not clean: %+v", result)
+	}
+
+	// Updates since the flush are only in memory; Repair recovers them
+	if _, err := img.WriteAt(make([]byte, 4096), clusters*4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	cp, result := openCopy("unflushed.qcow2")
+	if result.Corruptions == 0 {
+		t.Errorf("unflushed copy has all refcounts: %+v", result)
+	}
+	if result, err := cp.Repair(); err != nil || !result.IsClean() {
+		t.Errorf("Repair = %+v, %v; want clean", result, err)
+	}
+
+	// With barriers, refcounts reach the file ahead of the L2 entries
+	img.SetWriteBarrierMode(BarrierMetadata)
+	if _, err := img.WriteAt(make([]byte, 2*4096), (clusters+1)*4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, result := openCopy("barrier.qcow2"); !result.IsClean() {
+		t.Errorf("copy after a metadata barrier not clean: %+v", result)
+	}
+}
@@ -0,0 +1,209 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Defaults for RefcountVerifierOptions.
+const (
+	DefaultVerifyClustersPerSecond = 1000
+	DefaultVerifyInterval          = time.Hour
+)
+
+// RefcountDrift is a host cluster whose refcount disagrees with the image's
+// metadata, found by the background verifier (WithRefcountVerifier).
+type RefcountDrift struct {
+	// HostOffset is the cluster's offset in the image file.
+	HostOffset uint64
+
+	// Refcount is the cluster's refcount, and Referenced whether any table
+	// points at the cluster. A referenced cluster with refcount 0 is
+	// corruption, since it can be allocated again and overwritten; an
+	// unreferenced cluster with a nonzero refcount is a leak.
+	Refcount   uint64
+	Referenced bool
+}
+
+// Leak reports whether d is a leaked cluster rather than corruption.
+func (d RefcountDrift) Leak() bool {
+	return !d.Referenced
+}
+
+// RefcountVerifyPass summarizes one pass of the background verifier.
+type RefcountVerifyPass struct {
+	Clusters uint64        // Host clusters whose refcount was checked
+	Drifts   int           // Drifts reported by the pass
+	Duration time.Duration // Time the pass took
+	Err      error         // Why the pass stopped early, if it did
+}
+
+// RefcountVerifierOptions configures WithRefcountVerifier.
+type RefcountVerifierOptions struct {
+	// ClustersPerSecond caps how many refcounts and L2 tables a pass reads
+	// per second; 0 means DefaultVerifyClustersPerSecond.
+	ClustersPerSecond int
+
+	// Interval is the pause between passes; 0 means DefaultVerifyInterval.
+	Interval time.Duration
+
+	// OnDrift is called for each drift a pass confirms, and OnPass after
+	// each pass. Both run on the verifier's goroutine and must not close
+	// the image.
+	OnDrift func(RefcountDrift)
+	OnPass  func(RefcountVerifyPass)
+}
+
+// refcountVerifier walks the image's refcounts against its metadata in
+// the background, a little at a time. Locks are only held for one L2 table
+// or refcount at a time, so writes keep going while a pass runs; what they
+// change mid-pass can look like drift, which is why a drift is only
+// reported once two consecutive passes see the same one.
+type refcountVerifier struct {
+	img  *Image
+	opts RefcountVerifierOptions
+	stop chan struct{}
+	done chan struct{}
+
+	// Drift seen by the previous pass, keyed by cluster index
+	suspects map[uint64]RefcountDrift
+
+	// Rate limiting for the current pass
+	start time.Time
+	reads int
+}
+
+func startRefcountVerifier(img *Image, opts RefcountVerifierOptions) *refcountVerifier {
+	if opts.ClustersPerSecond <= 0 {
+		opts.ClustersPerSecond = DefaultVerifyClustersPerSecond
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultVerifyInterval
+	}
+	v := &refcountVerifier{
+		img:  img,
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go v.run()
+	return v
+}
+
+// close stops the verifier and waits for it to exit.
+func (v *refcountVerifier) close() {
+	close(v.stop)
+	<-v.done
+}
+
+func (v *refcountVerifier) run() {
+	defer close(v.done)
+	for {
+		p, ok := v.pass()
+		if !ok {
+			return
+		}
+		if fn := v.opts.OnPass; fn != nil {
+			fn(p)
+		}
+		if !v.sleep(v.opts.Interval) {
+			return
+		}
+	}
+}
+
+// sleep waits for d and reports false if the verifier was stopped first.
+func (v *refcountVerifier) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-v.stop:
+		return false
+	}
+}
+
+// throttle accounts for one read and waits until the pass is back under
+// the rate limit. It reports false if the verifier was stopped.
+func (v *refcountVerifier) throttle() bool {
+	v.reads++
+	due := v.start.Add(time.Duration(v.reads) * time.Second / time.Duration(v.opts.ClustersPerSecond))
+	if wait := time.Until(due); wait > 0 {
+		return v.sleep(wait)
+	}
+	select {
+	case <-v.stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// pass runs one verification pass. It reports false if the verifier was
+// stopped part way through.
+func (v *refcountVerifier) pass() (RefcountVerifyPass, bool) {
+	img := v.img
+	v.start, v.reads = time.Now(), 0
+	var p RefcountVerifyPass
+	finish := func(err error) (RefcountVerifyPass, bool) {
+		p.Err = err
+		p.Duration = time.Since(v.start)
+		return p, true
+	}
+
+	img.writeMu.Lock()
+	refs, l1Tables, err := img.referencedMetadata()
+	img.writeMu.Unlock()
+	if err != nil {
+		return finish(err)
+	}
+	for _, l1 := range l1Tables {
+		for i := 0; i+8 <= len(l1); i += 8 {
+			if binary.BigEndian.Uint64(l1[i:])&L1EntryOffsetMask == 0 {
+				continue
+			}
+			if !v.throttle() {
+				return p, false
+			}
+			img.writeMu.Lock()
+			img.markL1(refs, l1[i:i+8], false)
+			img.writeMu.Unlock()
+		}
+	}
+
+	info, err := img.file.Stat()
+	if err != nil {
+		return finish(fmt.Errorf("qcow2: failed to stat file: %w", err))
+	}
+	numClusters := uint64(info.Size()) >> img.clusterBits
+	found := make(map[uint64]RefcountDrift)
+	for idx := uint64(0); idx < numClusters; idx++ {
+		if !v.throttle() {
+			return p, false
+		}
+		img.writeMu.Lock()
+		refcount, err := img.getRefcount(idx << img.clusterBits)
+		img.writeMu.Unlock()
+		if err != nil {
+			return finish(err)
+		}
+		p.Clusters++
+
+		referenced := refs.used[idx]
+		if referenced == (refcount > 0) {
+			continue
+		}
+		d := RefcountDrift{HostOffset: idx << img.clusterBits, Refcount: refcount, Referenced: referenced}
+		found[idx] = d
+		if prev, ok := v.suspects[idx]; ok && prev == d {
+			p.Drifts++
+			if fn := v.opts.OnDrift; fn != nil {
+				fn(d)
+			}
+		}
+	}
+	v.suspects = found
+	return finish(nil)
+}
@@ -0,0 +1,136 @@
+// refcount_verifier_test.go - Background refcount verifier tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fastVerifier returns verifier options that run passes back to back.
+func fastVerifier(drifts chan<- RefcountDrift, passes chan<- RefcountVerifyPass) RefcountVerifierOptions {
+	return RefcountVerifierOptions{
+		ClustersPerSecond: 1_000_000,
+		Interval:          time.Millisecond,
+		OnDrift: func(d RefcountDrift) {
+			select {
+			case drifts <- d:
+			default:
+			}
+		},
+		OnPass: func(p RefcountVerifyPass) {
+			select {
+			case passes <- p:
+			default:
+			}
+		},
+	}
+}
+
+// TestRefcountVerifierClean checks a consistent image reports no drift,
+// even while it is being written to.
+func TestRefcountVerifierClean(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "verify.qcow2")
+
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	drifts := make(chan RefcountDrift, 16)
+	passes := make(chan RefcountVerifyPass, 16)
+	img, err = Open(path, WithRefcountVerifier(fastVerifier(drifts, passes)))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := img.ClusterSize()
+	data := bytes.Repeat([]byte{0x5a}, cs)
+	for i := 0; i < 4; {
+		select {
+		case p := <-passes:
+			if p.Err != nil {
+				t.Fatalf("pass failed: %v", p.Err)
+			}
+			i++
+		case d := <-drifts:
+			t.Fatalf("unexpected drift on a clean image: %+v", d)
+		case <-time.After(5 * time.Second):
+			t.Fatal("verifier made no progress")
+		}
+		if _, err := img.WriteAt(data, int64(i*8*cs)); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+}
+
+// TestRefcountVerifierDrift checks both a leak and a referenced cluster
+// with refcount 0 are reported.
+func TestRefcountVerifierDrift(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "verify.qcow2")
+
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	hostOffset := func(off int64) uint64 {
+		if _, err := img.WriteAt(bytes.Repeat([]byte{1}, cs), off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		info, err := img.translate(uint64(off))
+		if err != nil {
+			t.Fatalf("translate failed: %v", err)
+		}
+		return info.physOff
+	}
+
+	// A cluster that is discarded and then given a refcount again leaks
+	leaked := hostOffset(0)
+	if err := img.WriteZeroAtMode(0, int64(cs), ZeroPlain); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+	if err := img.incrementRefcount(leaked); err != nil {
+		t.Fatalf("incrementRefcount failed: %v", err)
+	}
+
+	// A data cluster whose refcount drops to 0 is still referenced
+	lost := hostOffset(int64(cs))
+	if err := img.decrementRefcount(lost); err != nil {
+		t.Fatalf("decrementRefcount failed: %v", err)
+	}
+	img.Close()
+
+	drifts := make(chan RefcountDrift, 16)
+	passes := make(chan RefcountVerifyPass, 16)
+	img, err = Open(path, WithRefcountVerifier(fastVerifier(drifts, passes)))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	want := map[uint64]RefcountDrift{
+		leaked: {HostOffset: leaked, Refcount: 1},
+		lost:   {HostOffset: lost, Referenced: true},
+	}
+	for len(want) > 0 {
+		select {
+		case d := <-drifts:
+			if w, ok := want[d.HostOffset]; !ok || w != d {
+				t.Fatalf("unexpected drift %+v", d)
+			}
+			delete(want, d.HostOffset)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("drift not reported: %+v", want)
+		}
+	}
+	if !(RefcountDrift{Refcount: 1}).Leak() {
+		t.Error("unreferenced cluster not reported as a leak")
+	}
+}
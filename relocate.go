@@ -0,0 +1,249 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MetadataRelocation reports what RelocateMetadata moved.
+type MetadataRelocation struct {
+	Offset         uint64 // Host offset of the region the tables were moved to
+	Size           uint64 // Size of the region in bytes
+	L2Tables       int    // Active L2 tables moved
+	RefcountBlocks int    // Refcount blocks moved
+	SharedL2Tables int    // L2 tables shared with snapshots, left in place
+}
+
+// RelocateMetadata moves the active L2 tables and the refcount blocks,
+// which allocating writes keep rewriting, into one contiguous region at
+// the end of the image file. On spinning disks the head then travels
+// between the data and a single metadata region instead of to tables
+// scattered wherever the file happened to end when each was allocated.
+//
+// L2 tables shared with internal snapshots stay where they are, since the
+// snapshots' L1 tables point at them too. Each table is copied and synced
+// before anything points at its new copy, and its old cluster is freed
+// only once the pointer is on disk, so a crash at any point leaves a
+// consistent image that at worst leaks clusters. Writes wait until
+// relocation is done. Images with lazy refcounts are refused, since
+// their refcounts cannot tell which clusters are free.
+func (img *Image) RelocateMetadata() (*MetadataRelocation, error) {
+	if img.readOnly {
+		return nil, ErrReadOnly
+	}
+	if img.closed.Load() {
+		return nil, ErrClosed
+	}
+	if img.lazyRefcounts {
+		return nil, fmt.Errorf("qcow2: cannot relocate metadata of an image with lazy refcounts")
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	// Buffered allocations and refcounts must be on disk before tables move
+	if err := img.flushLocked(); err != nil {
+		return nil, err
+	}
+	if err := img.faultAllL1(); err != nil {
+		return nil, err
+	}
+	if err := img.loadRefcountTable(); err != nil {
+		return nil, err
+	}
+
+	result := &MetadataRelocation{}
+	var l1Indices []uint64
+	img.l1Mu.RLock()
+	for i := uint64(0); i < uint64(len(img.l1Table))/8; i++ {
+		entry := binary.BigEndian.Uint64(img.l1Table[i*8:])
+		if entry&L1EntryOffsetMask == 0 {
+			continue
+		}
+		if entry&L1EntryCopied == 0 {
+			result.SharedL2Tables++
+			continue
+		}
+		l1Indices = append(l1Indices, i)
+	}
+	img.l1Mu.RUnlock()
+
+	blocks := img.refcountBlockIndices()
+	n := uint64(len(l1Indices) + len(blocks))
+	if n == 0 {
+		return result, nil
+	}
+
+	// Counting the region's own clusters can take new refcount blocks,
+	// which are moved into the region as well, so leave room for them
+	refcountBits := uint64(img.header.RefcountBits())
+	entriesPerBlock := img.clusterSize * 8 / refcountBits
+	reserved := n + n/entriesPerBlock + 2
+	region, err := img.allocateClusterRun(reserved, AllocMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to allocate metadata region: %w", err)
+	}
+	next := region
+
+	if err := img.relocateL2Tables(l1Indices, &next); err != nil {
+		return nil, err
+	}
+	result.L2Tables = len(l1Indices)
+
+	moved, err := img.relocateRefcountBlocks(region+reserved*img.clusterSize, &next)
+	if err != nil {
+		return nil, err
+	}
+	result.RefcountBlocks = moved
+
+	// Give back the part of the region left over
+	used := (next - region) >> img.clusterBits
+	img.releaseClusters(next, reserved-used)
+	result.Offset = region
+	result.Size = next - region
+
+	img.dirty.Store(true)
+	return result, nil
+}
+
+// refcountBlockIndices returns the refcount table indices that have a
+// block.
+func (img *Image) refcountBlockIndices() []uint64 {
+	img.refcountTableLock.RLock()
+	defer img.refcountTableLock.RUnlock()
+	var indices []uint64
+	for i := uint64(0); i < uint64(len(img.refcountTable))/8; i++ {
+		if binary.BigEndian.Uint64(img.refcountTable[i*8:]) != 0 {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// relocateL2Tables copies the L2 tables of the given L1 entries to *next
+// onwards, advancing it, then points the L1 table at the copies and frees
+// the originals. The caller holds writeMu.
+func (img *Image) relocateL2Tables(l1Indices []uint64, next *uint64) error {
+	type move struct{ l1Index, from, to uint64 }
+	moves := make([]move, 0, len(l1Indices))
+	table := img.getClusterBuffer()
+	defer img.putClusterBuffer(table)
+
+	for _, i := range l1Indices {
+		img.l1Mu.RLock()
+		from := binary.BigEndian.Uint64(img.l1Table[i*8:]) & L1EntryOffsetMask
+		img.l1Mu.RUnlock()
+		if err := img.readL2Table(from, table); err != nil {
+			return err
+		}
+		if _, err := img.file.WriteAt(table, int64(*next)); err != nil {
+			return fmt.Errorf("qcow2: failed to copy L2 table: %w", err)
+		}
+		moves = append(moves, move{i, from, *next})
+		*next += img.clusterSize
+	}
+
+	// Barrier: the copies must be on disk before the L1 table points at them
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: L2 table copy barrier failed: %w", err)
+	}
+
+	for _, m := range moves {
+		img.l1Mu.Lock()
+		old := binary.BigEndian.Uint64(img.l1Table[m.l1Index*8:])
+		entry := old&^L1EntryOffsetMask | m.to
+		binary.BigEndian.PutUint64(img.l1Table[m.l1Index*8:], entry)
+		_, err := img.file.WriteAt(img.l1Table[m.l1Index*8:m.l1Index*8+8],
+			int64(img.header.L1TableOffset+m.l1Index*8))
+		if err != nil {
+			binary.BigEndian.PutUint64(img.l1Table[m.l1Index*8:], old)
+		}
+		img.l1Mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("qcow2: failed to update L1 table: %w", err)
+		}
+		img.l2Cache.invalidate(m.from)
+	}
+
+	// Barrier: the L1 table must point at the copies before the originals
+	// can be reused
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: L1 table barrier failed: %w", err)
+	}
+	for _, m := range moves {
+		if err := img.decrementRefcount(m.from); err != nil {
+			return fmt.Errorf("qcow2: failed to free old L2 table: %w", err)
+		}
+	}
+	return nil
+}
+
+// relocateRefcountBlocks copies each refcount block to *next onwards,
+// advancing it up to limit, points the refcount table at the copy and
+// frees the original. Blocks already in the region stay. It returns the
+// number of blocks moved. The caller holds writeMu.
+func (img *Image) relocateRefcountBlocks(limit uint64, next *uint64) (int, error) {
+	region := *next
+	block := img.getClusterBuffer()
+	defer img.putClusterBuffer(block)
+
+	// Freeing an old block changes the refcounts in some block, possibly
+	// one still to move, so each block is read just before it is copied
+	moved := 0
+	for _, i := range img.refcountBlockIndices() {
+		if *next >= limit {
+			break
+		}
+		// The pinned block must be on disk and not written to the old place
+		if err := img.unpinRefcountBlock(false); err != nil {
+			return moved, err
+		}
+
+		img.refcountTableLock.Lock()
+		from := binary.BigEndian.Uint64(img.refcountTable[i*8:])
+		if from >= region && from < limit {
+			img.refcountTableLock.Unlock()
+			continue
+		}
+		err := img.moveRefcountBlockLocked(i, from, *next, block)
+		img.refcountTableLock.Unlock()
+		if err != nil {
+			return moved, err
+		}
+
+		if err := img.decrementRefcount(from); err != nil {
+			return moved, fmt.Errorf("qcow2: failed to free old refcount block: %w", err)
+		}
+		*next += img.clusterSize
+		moved++
+	}
+	return moved, nil
+}
+
+// moveRefcountBlockLocked copies the refcount block of table entry index
+// from one offset to another and switches the table entry to the copy.
+// The caller holds refcountTableLock.
+func (img *Image) moveRefcountBlockLocked(index, from, to uint64, block []byte) error {
+	if err := img.readRefcountBlock(from, block); err != nil {
+		return err
+	}
+	if _, err := img.file.WriteAt(block, int64(to)); err != nil {
+		return fmt.Errorf("qcow2: failed to copy refcount block: %w", err)
+	}
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: refcount block copy barrier failed: %w", err)
+	}
+
+	binary.BigEndian.PutUint64(img.refcountTable[index*8:], to)
+	_, err := img.file.WriteAt(img.refcountTable[index*8:index*8+8],
+		int64(img.header.RefcountTableOffset+index*8))
+	if err != nil {
+		binary.BigEndian.PutUint64(img.refcountTable[index*8:], from)
+		return fmt.Errorf("qcow2: failed to update refcount table: %w", err)
+	}
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: refcount table barrier failed: %w", err)
+	}
+	img.refcountBlockCache.invalidate(from)
+	return nil
+}
@@ -0,0 +1,141 @@
+// relocate_test.go - Metadata relocation tests
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestRelocateMetadata checks L2 tables and refcount blocks end up in one
+// region, with the data and refcounts intact.
+func TestRelocateMetadata(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "relocate.qcow2")
+
+	// 4KB clusters: each L2 table maps 2MB, so the writes need several
+	// tables, allocated between data clusters
+	img, err := Create(path, CreateOptions{Size: 64 * 1024 * 1024, ClusterBits: 12})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer img.Close()
+
+	offsets := []int64{0, 5 << 20, 17 << 20, 40<<20 + 123, 63 << 20}
+	data := make([][]byte, len(offsets))
+	for i, off := range offsets {
+		data[i] = testutil.RandomBytes(int64(i), 64*1024)
+		if _, err := img.WriteAt(data[i], off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+
+	result, err := img.RelocateMetadata()
+	if err != nil {
+		t.Fatalf("RelocateMetadata failed: %v", err)
+	}
+	if result.L2Tables != len(offsets) || result.RefcountBlocks == 0 || result.SharedL2Tables != 0 {
+		t.Errorf("result = %+v, want %d L2 tables and some refcount blocks", result, len(offsets))
+	}
+	if want := uint64(result.L2Tables+result.RefcountBlocks) * img.clusterSize; result.Size != want {
+		t.Errorf("region size = %d, want %d", result.Size, want)
+	}
+
+	inRegion := func(off uint64) bool {
+		return off >= result.Offset && off < result.Offset+result.Size
+	}
+	for i := uint64(0); i < img.L1Size(); i++ {
+		if off := binary.BigEndian.Uint64(img.l1Table[i*8:]) & L1EntryOffsetMask; off != 0 && !inRegion(off) {
+			t.Errorf("L2 table %d at %#x is outside the region", i, off)
+		}
+	}
+	for _, i := range img.refcountBlockIndices() {
+		if off := binary.BigEndian.Uint64(img.refcountTable[i*8:]); !inRegion(off) {
+			t.Errorf("refcount block %d at %#x is outside the region", i, off)
+		}
+	}
+
+	check, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !check.IsClean() {
+		t.Errorf("Check found problems: %+v", check)
+	}
+	for i, off := range offsets {
+		buf := make([]byte, len(data[i]))
+		if _, err := img.ReadAt(buf, off); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(buf, data[i]) {
+			t.Errorf("data at %d changed", off)
+		}
+	}
+
+	// Writes after relocation still allocate correctly
+	more := testutil.RandomBytes(99, 8192)
+	if _, err := img.WriteAt(more, 30<<20); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	buf := make([]byte, len(more))
+	if _, err := img.ReadAt(buf, 30<<20); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, more) {
+		t.Error("write after relocation read back wrong")
+	}
+}
+
+// TestRelocateMetadataSnapshot checks L2 tables shared with a snapshot
+// stay in place.
+func TestRelocateMetadataSnapshot(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "relocate-snap.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 16 * 1024 * 1024, ClusterBits: 12})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer img.Close()
+
+	data := testutil.RandomBytes(7, 8192)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAt(data, 9<<20); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	// Copy-on-write gives the first table an unshared copy
+	if _, err := img.WriteAt(data[:512], 4096); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	result, err := img.RelocateMetadata()
+	if err != nil {
+		t.Fatalf("RelocateMetadata failed: %v", err)
+	}
+	if result.L2Tables != 1 || result.SharedL2Tables != 1 {
+		t.Errorf("result = %+v, want 1 moved and 1 shared L2 table", result)
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, 9<<20); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("data under the shared table changed")
+	}
+	if _, err := img.ReadAtSnapshot(buf, 0, img.FindSnapshot("snap")); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("snapshot data changed")
+	}
+}
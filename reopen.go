@@ -0,0 +1,67 @@
+package qcow2
+
+import (
+	"fmt"
+)
+
+// ReopenReadOnly switches a writable image to read-only without closing it,
+// so a backup agent can take a consistent copy of the file while the image
+// stays open. Pending writes are flushed and the dirty bit is cleared as on
+// Close (kept with lazy refcounts, which are rebuilt on the next writable
+// open), leaving the file as a clean close would. Writes then fail with
+// ErrReadOnly until ReopenReadWrite.
+//
+// The host files stay open for writing; nothing stops another process from
+// opening the image read-write meanwhile. Calling it on a read-only image
+// does nothing. It must not race with writes.
+func (img *Image) ReopenReadOnly() error {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	if img.readOnly {
+		return nil
+	}
+	if err := img.flushLocked(); err != nil {
+		return err
+	}
+	if img.header.Version >= Version3 && !img.lazyRefcounts {
+		if err := img.clearDirty(); err != nil {
+			return fmt.Errorf("qcow2: failed to clear dirty bit: %w", err)
+		}
+	}
+	img.readOnly = true
+	return nil
+}
+
+// ReopenReadWrite switches an image demoted by ReopenReadOnly back to
+// read-write, marking it dirty again and rebuilding lazy refcounts as a
+// writable open would. An image opened read-only has no writable file
+// handle and must be reopened with Open instead; it fails with ErrReadOnly.
+// Calling it on a writable image does nothing.
+//
+// Metadata is not reloaded. If another process wrote to the image in the
+// meantime, call InvalidateCaches first, while the image is still
+// read-only.
+func (img *Image) ReopenReadWrite() error {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	if !img.readOnly {
+		return nil
+	}
+	if !img.writable {
+		return fmt.Errorf("%w: image was opened read-only", ErrReadOnly)
+	}
+	if img.lazyRefcounts && img.header.IsDirty() {
+		if err := img.rebuildRefcounts(); err != nil {
+			return fmt.Errorf("qcow2: failed to rebuild refcounts: %w", err)
+		}
+	}
+	if img.header.Version >= Version3 {
+		if err := img.markDirty(); err != nil {
+			return fmt.Errorf("qcow2: failed to mark image dirty: %w", err)
+		}
+	}
+	img.readOnly = false
+	return nil
+}
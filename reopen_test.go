@@ -0,0 +1,99 @@
+// reopen_test.go - Tests for switching an open image between read-only and read-write
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReopenReadOnly(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	data := bytes.Repeat([]byte("backup"), 1000)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.ReopenReadOnly(); err != nil {
+		t.Fatalf("ReopenReadOnly failed: %v", err)
+	}
+	if err := img.ReopenReadOnly(); err != nil {
+		t.Fatalf("second ReopenReadOnly failed: %v", err)
+	}
+	if img.IsDirty() {
+		t.Error("demoted image still marked dirty")
+	}
+	if _, err := img.WriteAt(data, 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("WriteAt on demoted image: got %v, want ErrReadOnly", err)
+	}
+
+	// The file is complete and clean while demoted
+	copyPath := filepath.Join(t.TempDir(), "copy.qcow2")
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(copyPath, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := OpenFile(copyPath, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open copy failed: %v", err)
+	}
+	if backup.IsDirty() {
+		t.Error("copy taken while demoted is dirty")
+	}
+	got := make([]byte, len(data))
+	if _, err := backup.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("copy data mismatch (err %v)", err)
+	}
+	backup.Close()
+
+	if err := img.ReopenReadWrite(); err != nil {
+		t.Fatalf("ReopenReadWrite failed: %v", err)
+	}
+	if !img.IsDirty() {
+		t.Error("image not marked dirty after ReopenReadWrite")
+	}
+	if _, err := img.WriteAt([]byte("again"), 64*1024); err != nil {
+		t.Fatalf("WriteAt after ReopenReadWrite failed: %v", err)
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean: %+v", result)
+	}
+}
+
+func TestReopenReadWriteOpenedReadOnly(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open read-only failed: %v", err)
+	}
+	defer img.Close()
+	if err := img.ReopenReadOnly(); err != nil {
+		t.Errorf("ReopenReadOnly on read-only image failed: %v", err)
+	}
+	if err := img.ReopenReadWrite(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("ReopenReadWrite: got %v, want ErrReadOnly", err)
+	}
+}
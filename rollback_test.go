@@ -0,0 +1,229 @@
+// rollback_test.go - Tests that failed writes give back what they allocated
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// rollbackCase is a write that allocates, run against a fault at each of
+// its host file calls in turn.
+type rollbackCase struct {
+	name string
+	// setup prepares the image at path and closes it
+	setup func(t *testing.T, path string)
+	opts  []Option
+	// write is the operation under test
+	write func(img *Image) error
+	// off and want are what the image reads once write has succeeded
+	off  int64
+	want []byte
+	// cleanup runs before Check, e.g. to drop a snapshot that hides leaks
+	cleanup func(img *Image) error
+	// replaces is set when the write drops a reference to an old cluster.
+	// That happens after the new mapping is committed, so if it fails the
+	// old cluster leaks rather than being freed while still in use
+	replaces bool
+}
+
+func rollbackData(n int) []byte {
+	return bytes.Repeat([]byte("rollback"), n/8)
+}
+
+func rollbackCases(cs int) []rollbackCase {
+	full := rollbackData(cs)
+	create := func(t *testing.T, path string) *Image {
+		t.Helper()
+		img, err := CreateSimple(path, 4*1024*1024)
+		if err != nil {
+			t.Fatalf("CreateSimple failed: %v", err)
+		}
+		return img
+	}
+	withFirst := func(t *testing.T, path string) *Image {
+		t.Helper()
+		img := create(t, path)
+		if _, err := img.WriteAt(full, 0); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		return img
+	}
+	writeAt := func(p []byte, off int64) func(*Image) error {
+		return func(img *Image) error {
+			_, err := img.WriteAt(p, off)
+			return err
+		}
+	}
+
+	return []rollbackCase{
+		{
+			name:  "new L2 table",
+			setup: func(t *testing.T, path string) { create(t, path).Close() },
+			write: writeAt(full, 0),
+			off:   0, want: full,
+		},
+		{
+			name:  "new cluster",
+			setup: func(t *testing.T, path string) { withFirst(t, path).Close() },
+			write: writeAt(full, int64(cs)),
+			off:   int64(cs), want: full,
+		},
+		{
+			name:  "cluster run",
+			setup: func(t *testing.T, path string) { withFirst(t, path).Close() },
+			write: writeAt(rollbackData(3*cs), int64(cs)+512),
+			off:   int64(cs) + 512, want: rollbackData(3 * cs),
+		},
+		{
+			name: "backing copy",
+			setup: func(t *testing.T, path string) {
+				base := filepath.Join(filepath.Dir(path), "base.qcow2")
+				withFirst(t, base).Close()
+				img, err := CreateOverlay(path, base)
+				if err != nil {
+					t.Fatalf("CreateOverlay failed: %v", err)
+				}
+				img.Close()
+			},
+			write: writeAt([]byte("overlay"), 100),
+			off:   0, want: append(append(append([]byte{}, full[:100]...), "overlay"...), full[107:]...),
+		},
+		{
+			name: "snapshot copy",
+			setup: func(t *testing.T, path string) {
+				img := withFirst(t, path)
+				if _, err := img.CreateSnapshot("before"); err != nil {
+					t.Fatalf("CreateSnapshot failed: %v", err)
+				}
+				img.Close()
+			},
+			write: writeAt([]byte("changed"), 100),
+			off:   0, want: append(append(append([]byte{}, full[:100]...), "changed"...), full[107:]...),
+			cleanup:  func(img *Image) error { return img.DeleteSnapshot("before") },
+			replaces: true,
+		},
+		{
+			name: "zero cluster",
+			setup: func(t *testing.T, path string) {
+				img := withFirst(t, path)
+				if err := img.WriteZeroAtMode(0, int64(cs), ZeroAlloc); err != nil {
+					t.Fatalf("WriteZeroAtMode failed: %v", err)
+				}
+				img.Close()
+			},
+			write: writeAt([]byte("changed"), 100),
+			off:   100, want: []byte("changed"),
+			replaces: true,
+		},
+		{
+			name:  "delayed flush",
+			setup: func(t *testing.T, path string) { withFirst(t, path).Close() },
+			opts:  []Option{WithDelayedAllocation(1024 * 1024)},
+			write: func(img *Image) error {
+				if _, err := img.WriteAt(full, int64(cs)); err != nil {
+					return err
+				}
+				if _, err := img.WriteAt(full, 8*1024*1024/4); err != nil {
+					return err
+				}
+				return img.Flush()
+			},
+			off: int64(cs), want: full,
+		},
+	}
+}
+
+// TestAllocationRollback fails each write and sync of an allocating
+// operation in turn and checks that the image is left without leaked or
+// wrongly freed clusters, and that the operation then succeeds.
+func TestAllocationRollback(t *testing.T) {
+	t.Parallel()
+	for _, tc := range rollbackCases(64 * 1024) {
+		for op, opName := range map[testutil.FaultOp]string{testutil.OpWrite: "write", testutil.OpSync: "sync"} {
+			t.Run(tc.name+"/"+opName, func(t *testing.T) {
+				t.Parallel()
+				dir := t.TempDir()
+				path := filepath.Join(dir, "prepared.qcow2")
+				tc.setup(t, path)
+				prepared, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				failed := 0
+				for k := uint64(1); ; k++ {
+					if err := os.WriteFile(path, prepared, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					if !runRollbackCase(t, tc, path, op, k) {
+						break
+					}
+					failed++
+				}
+				if failed == 0 {
+					t.Error("no fault was hit")
+				}
+			})
+		}
+	}
+}
+
+// runRollbackCase runs tc with the k-th call of op failing and reports
+// whether the fault was hit.
+func runRollbackCase(t *testing.T, tc rollbackCase, path string, op testutil.FaultOp, k uint64) bool {
+	t.Helper()
+	var ff *testutil.FaultFile
+	opts := append([]Option{WithFileWrapper(func(f File) File {
+		ff = testutil.NewFaultFile(f, testutil.FaultConfig{})
+		return ff
+	})}, tc.opts...)
+	img, err := Open(path, opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	img.SetWriteBarrierMode(BarrierFull)
+
+	cfg := testutil.FaultConfig{}
+	if op == testutil.OpWrite {
+		cfg.Write.FailAt = k
+	} else {
+		cfg.Sync.FailAt = k
+	}
+	ff.SetConfig(cfg)
+	err = tc.write(img)
+	ff.SetConfig(testutil.FaultConfig{})
+	if ff.Faults(op) == 0 {
+		if err != nil {
+			t.Fatalf("op %d: write failed without a fault: %v", op, err)
+		}
+		return false
+	}
+
+	// Whether or not the fault stopped the write, trying again completes it
+	if err := tc.write(img); err != nil {
+		t.Fatalf("op %d, call %d: retry failed: %v", op, k, err)
+	}
+	got := make([]byte, len(tc.want))
+	if _, err := img.ReadAt(got, tc.off); err != nil || !bytes.Equal(got, tc.want) {
+		t.Errorf("op %d, call %d: data mismatch after retry (err %v)", op, k, err)
+	}
+	if tc.cleanup != nil {
+		if err := tc.cleanup(img); err != nil {
+			t.Fatalf("cleanup failed: %v", err)
+		}
+	}
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Corruptions != 0 || len(result.Errors) != 0 || result.Leaks > 0 && !tc.replaces || result.Leaks > 1 {
+		t.Errorf("op %d, call %d: image not clean: %+v", op, k, result)
+	}
+	return true
+}
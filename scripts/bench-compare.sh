@@ -0,0 +1,69 @@
+#!/bin/sh
+# bench-compare.sh - compare benchmarks between a base git ref and the working
+# tree with benchstat, and fail if any benchmark got significantly slower.
+#
+# Usage: scripts/bench-compare.sh [base-ref]
+#
+# Environment:
+#   BENCH      benchmark regex (default: .)
+#   COUNT      runs per benchmark, benchstat needs >= 6 for p-values (default: 6)
+#   BENCHTIME  go test -benchtime (default: 1s)
+#   THRESHOLD  max allowed sec/op increase in percent (default: 10)
+#   OUT        directory for old.txt/new.txt (default: a temp dir)
+set -eu
+
+BASE=${1:-main}
+BENCH=${BENCH:-.}
+COUNT=${COUNT:-6}
+BENCHTIME=${BENCHTIME:-1s}
+THRESHOLD=${THRESHOLD:-10}
+
+ROOT=$(git rev-parse --show-toplevel)
+OUT=${OUT:-$(mktemp -d)}
+WORKTREE=$(mktemp -d)
+trap 'git -C "$ROOT" worktree remove --force "$WORKTREE" >/dev/null 2>&1 || true' EXIT
+trap 'exit 130' INT TERM
+
+if command -v benchstat >/dev/null 2>&1; then
+	BENCHSTAT=benchstat
+else
+	BENCHSTAT="go run golang.org/x/perf/cmd/benchstat@latest"
+fi
+
+# Each tree runs its own benchmarks, so only benchmarks present in both are
+# compared. A tree that fails to build or test stops the script with its
+# output, rather than leaving benchstat an empty file.
+run_bench() {
+	if ! (cd "$1" && go test -run '^$' -bench "$BENCH" -benchmem -count "$COUNT" -benchtime "$BENCHTIME" .) > "$2" 2>&1; then
+		cat "$2" >&2
+		echo "bench-compare: benchmarks failed in $3" >&2
+		exit 1
+	fi
+}
+
+echo "Benchmarking base ($BASE)..."
+git -C "$ROOT" worktree add --detach "$WORKTREE" "$BASE" >/dev/null
+run_bench "$WORKTREE" "$OUT/old.txt" "base ($BASE)"
+
+echo "Benchmarking working tree..."
+run_bench "$ROOT" "$OUT/new.txt" "working tree"
+
+$BENCHSTAT "$OUT/old.txt" "$OUT/new.txt" | tee "$OUT/benchstat.txt"
+
+# Flag statistically significant sec/op increases above the threshold.
+# benchstat prints "~" instead of a delta when the change is not significant.
+awk -v threshold="$THRESHOLD" '
+	/│/ { in_time = ($0 ~ /sec\/op/) ; next }
+	in_time && $1 != "geomean" {
+		for (i = 2; i <= NF; i++) {
+			if ($i ~ /^\+[0-9.]+%$/) {
+				delta = substr($i, 2, length($i) - 2) + 0
+				if (delta > threshold) {
+					printf "REGRESSION: %s %s\n", $1, $i
+					bad = 1
+				}
+			}
+		}
+	}
+	END { exit bad }
+' "$OUT/benchstat.txt" && echo "No sec/op regressions above ${THRESHOLD}%."
@@ -0,0 +1,117 @@
+// scrub_test.go - Scrub tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestScrubCleanImage verifies a healthy image scrubs clean.
+func TestScrubCleanImage(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	img, err := CreateSimple(filepath.Join(dir, "clean.qcow2"), 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(bytes.Repeat([]byte{1}, 3*cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAtCompressed(bytes.Repeat([]byte{2}, cs), int64(8*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+
+	report, err := img.Scrub(context.Background())
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if !report.IsClean() {
+		t.Errorf("expected clean report, got %+v", report)
+	}
+	if report.ClustersRead != 4 {
+		t.Errorf("ClustersRead = %d, want 4", report.ClustersRead)
+	}
+}
+
+// TestScrubReportsCorruptCompressedCluster damages compressed data on disk
+// and verifies Scrub reports the range instead of failing outright.
+func TestScrubReportsCorruptCompressedCluster(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corrupt.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	data := bytes.Repeat([]byte("compressible "), cs/13+1)[:cs]
+	if _, err := img.WriteAtCompressed(data, int64(2*cs)); err != nil {
+		t.Fatalf("WriteAtCompressed failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{3}, cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	info, err := img.translate(uint64(2 * cs))
+	if err != nil || info.ctype != clusterCompressed {
+		t.Fatalf("expected compressed cluster, got %v (err %v)", info.ctype, err)
+	}
+	hostOff, _ := img.parseCompressedL2Entry(info.l2Entry)
+	img.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xFF}, 64), int64(hostOff)); err != nil {
+		t.Fatalf("corrupt write failed: %v", err)
+	}
+	f.Close()
+
+	img, err = OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	report, err := img.Scrub(context.Background())
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if len(report.Unreadable) != 1 {
+		t.Fatalf("expected 1 unreadable range, got %+v", report.Unreadable)
+	}
+	if r := report.Unreadable[0]; r.Start != uint64(2*cs) || r.Length != uint64(cs) {
+		t.Errorf("unreadable range = %+v, want [%d, +%d)", r, 2*cs, cs)
+	}
+	if report.ClustersRead != 2 {
+		t.Errorf("ClustersRead = %d, want 2", report.ClustersRead)
+	}
+}
+
+// TestScrubCancelled verifies Scrub honors context cancellation.
+func TestScrubCancelled(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	img, err := CreateSimple(filepath.Join(dir, "cancel.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := img.Scrub(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SignatureVersion is the version of the signature format written by
+// Signature.WriteTo.
+const SignatureVersion = 1
+
+// ErrInvalidSignature is returned when a signature is malformed, does not
+// verify with the public key, or was made for a different image.
+var ErrInvalidSignature = errors.New("qcow2: invalid image signature")
+
+// Signature is a detached Ed25519 signature of an image's manifest, kept
+// next to the image by a distribution pipeline. Since the manifest holds a
+// hash of every data cluster, the signature covers the image's contents,
+// virtual size and backing file name, not just its header.
+type Signature struct {
+	Version   int    `json:"version"`   // SignatureVersion
+	Algorithm string `json:"algorithm"` // Always "ed25519"
+
+	// Manifest is the signed manifest as encoded when signing, so that
+	// verification does not depend on re-encoding it. The signature covers
+	// its compact form; whitespace may change in transit.
+	Manifest json.RawMessage `json:"manifest"`
+
+	Signature []byte `json:"signature"` // Signature of Manifest
+}
+
+// Sign builds a manifest of the active image and signs it with key. It
+// returns early with ctx.Err() if the context is cancelled, and runs at the
+// priority ctx carries (WithPriority).
+func (img *Image) Sign(ctx context.Context, key ed25519.PrivateKey) (*Signature, error) {
+	m, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return SignManifest(m, key)
+}
+
+// SignManifest signs a manifest with key.
+func SignManifest(m *Manifest, key ed25519.PrivateKey) (*Signature, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("qcow2: bad Ed25519 private key size %d", len(key))
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		Version:   SignatureVersion,
+		Algorithm: "ed25519",
+		Manifest:  data,
+		Signature: ed25519.Sign(key, data),
+	}, nil
+}
+
+// Verify checks the signature with pub and returns the signed manifest.
+// It only checks the signature; VerifySignature also checks an image.
+func (s *Signature) Verify(pub ed25519.PublicKey) (*Manifest, error) {
+	if s.Version != SignatureVersion || s.Algorithm != "ed25519" {
+		return nil, fmt.Errorf("%w: unsupported version %d or algorithm %q",
+			ErrInvalidSignature, s.Version, s.Algorithm)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: bad Ed25519 public key size %d", ErrInvalidSignature, len(pub))
+	}
+	var data bytes.Buffer
+	if err := json.Compact(&data, s.Manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(pub, data.Bytes(), s.Signature) {
+		return nil, fmt.Errorf("%w: signature does not verify", ErrInvalidSignature)
+	}
+	m, err := ReadManifest(&data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return m, nil
+}
+
+// WriteTo writes the signature as indented JSON.
+func (s *Signature) WriteTo(w io.Writer) (int64, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
+
+// ReadSignature reads a signature written by Signature.WriteTo. It does
+// not verify it.
+func ReadSignature(r io.Reader) (*Signature, error) {
+	var s Signature
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return &s, nil
+}
+
+// VerifySignature checks that img is the image sig was made for: the
+// signature must verify with pub, and the image must match the signed
+// manifest, as VerifyAgainstManifest checks, with the same backing file
+// name. This reads every data cluster of the image and its backing chain.
+//
+// It fails with ErrInvalidSignature if the signature is bad or names a
+// different backing file, and with an error wrapping ErrManifestMismatch
+// for the first range whose contents differ. It returns early with
+// ctx.Err() if the context is cancelled, and runs at the priority ctx
+// carries (WithPriority).
+func VerifySignature(ctx context.Context, img *Image, sig *Signature, pub ed25519.PublicKey) error {
+	m, err := sig.Verify(pub)
+	if err != nil {
+		return err
+	}
+	if m.BackingFile != img.BackingFile() {
+		return fmt.Errorf("%w: signed with backing file %q, image has %q",
+			ErrInvalidSignature, m.BackingFile, img.BackingFile())
+	}
+	report, err := VerifyAgainstManifest(ctx, img, m)
+	if err != nil {
+		if errors.Is(err, ErrInvalidManifest) {
+			return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+		return err
+	}
+	if len(report.Unreadable) > 0 {
+		return report.Unreadable[0].Err
+	}
+	if len(report.ManifestMismatches) > 0 {
+		return report.ManifestMismatches[0].Err
+	}
+	return nil
+}
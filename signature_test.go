@@ -0,0 +1,114 @@
+// signature_test.go - Image signing tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSignature checks a signature round-trips, verifies the image it was
+// made for on open, and rejects a wrong key or changed contents.
+func TestSignature(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "signed.qcow2")
+	ctx := context.Background()
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	pub := key.Public().(ed25519.PublicKey)
+	otherPub := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{7}, 3*img.ClusterSize()), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	signed, err := img.Sign(ctx, key)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var file bytes.Buffer
+	if _, err := signed.WriteTo(&file); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	sig, err := ReadSignature(&file)
+	if err != nil {
+		t.Fatalf("ReadSignature failed: %v", err)
+	}
+
+	img, err = Open(path, WithReadOnly(), WithSignature(sig, pub))
+	if err != nil {
+		t.Fatalf("Open with signature failed: %v", err)
+	}
+	if err := VerifySignature(ctx, img, sig, otherPub); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifySignature with wrong key = %v, want ErrInvalidSignature", err)
+	}
+	img.Close()
+
+	forged := *sig
+	forged.Signature = bytes.Clone(sig.Signature)
+	forged.Signature[0] ^= 1
+	if _, err := Open(path, WithReadOnly(), WithSignature(&forged, pub)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Open with forged signature = %v, want ErrInvalidSignature", err)
+	}
+
+	// Change one byte behind the signature's back
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte{8}, int64(img.ClusterSize())+5); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	_, err = Open(path, WithReadOnly(), WithSignature(sig, pub))
+	if !errors.Is(err, ErrManifestMismatch) {
+		t.Fatalf("Open of tampered image = %v, want ErrManifestMismatch", err)
+	}
+}
+
+// TestSignatureOpenFailureLeavesFile checks a refused open hands the file
+// back to the caller still open, without having closed it itself.
+func TestSignatureOpenFailureLeavesFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "refused.qcow2")
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	otherPub := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	sig, err := img.Sign(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	_, err = newImage(f, false, 0, WithSignature(sig, otherPub),
+		WithRefcountVerifier(RefcountVerifierOptions{}))
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("newImage with wrong key = %v, want ErrInvalidSignature", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("closing the file after a refused open: %v", err)
+	}
+}
@@ -156,8 +156,7 @@ func (img *Image) ReadAtSnapshot(p []byte, off int64, snap *Snapshot) (int, erro
 		return 0, fmt.Errorf("qcow2: nil snapshot")
 	}
 
-	// Load the snapshot's L1 table
-	l1Table, err := img.loadSnapshotL1Table(snap)
+	l1Table, err := img.snapshotL1Table(snap)
 	if err != nil {
 		return 0, err
 	}
@@ -168,11 +167,17 @@ func (img *Image) ReadAtSnapshot(p []byte, off int64, snap *Snapshot) (int, erro
 	}
 
 	// Clamp read to image size
-	toRead := int64(len(p))
-	if off+toRead > size {
-		toRead = size - off
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
 	}
+	return img.readAtL1(p, off, l1Table, img.backing)
+}
 
+// readAtL1 reads p at virtual offset off through l1Table, which may run
+// past the virtual size. Clusters the table leaves unallocated are read
+// from backing, or as zeros if it is nil.
+func (img *Image) readAtL1(p []byte, off int64, l1Table []byte, backing BackingStore) (int, error) {
+	toRead := int64(len(p))
 	totalRead := 0
 	for toRead > 0 {
 		// Translate using snapshot's L1 table
@@ -181,8 +186,9 @@ func (img *Image) ReadAtSnapshot(p []byte, off int64, snap *Snapshot) (int, erro
 			return totalRead, err
 		}
 
-		// Calculate how much to read from this cluster
-		clusterRemaining := img.clusterSize - (uint64(off) & img.offsetMask)
+		// Calculate how much to read from this cluster (subcluster on
+		// extended L2 images, where each subcluster has its own state)
+		clusterRemaining := img.subclusterSize - (uint64(off)&img.offsetMask)%img.subclusterSize
 		readLen := uint64(toRead)
 		if readLen > clusterRemaining {
 			readLen = clusterRemaining
@@ -190,28 +196,50 @@ func (img *Image) ReadAtSnapshot(p []byte, off int64, snap *Snapshot) (int, erro
 
 		switch info.ctype {
 		case clusterUnallocated, clusterZero:
-			// Fill with zeros
-			for i := uint64(0); i < readLen; i++ {
-				p[totalRead+int(i)] = 0
+			buf := p[totalRead : totalRead+int(readLen)]
+			n := 0
+			if info.ctype == clusterUnallocated && backing != nil {
+				// Fall through to the backing chain as live reads do; a
+				// backing file shorter than the image reads as zeros
+				// past its end
+				n, err = backing.ReadAt(buf, off)
+				if err != nil && err != io.EOF {
+					return totalRead, err
+				}
 			}
+			clear(buf[n:])
 
 		case clusterCompressed:
 			// Read compressed cluster
-			decompressed, err := img.decompressCluster(info.l2Entry)
-			if err != nil {
+			decompressed := img.getClusterBuffer()
+			if err := img.decompressCluster(info.l2Entry, decompressed); err != nil {
+				img.putClusterBuffer(decompressed)
 				return totalRead, err
 			}
 			clusterOff := uint64(off) & img.offsetMask
 			copy(p[totalRead:], decompressed[clusterOff:clusterOff+readLen])
+			img.putClusterBuffer(decompressed)
 
 		case clusterNormal:
-			// Read from physical offset (use dataFile for external data file support)
-			n, err := img.dataFile().ReadAt(p[totalRead:totalRead+int(readLen)], int64(info.physOff))
-			if err != nil && err != io.EOF {
-				return totalRead, err
-			}
-			if n < int(readLen) {
-				return totalRead + n, io.ErrUnexpectedEOF
+			buf := p[totalRead : totalRead+int(readLen)]
+			switch img.header.EncryptMethod {
+			case EncryptionAES:
+				if _, err := img.readEncrypted(buf, info.physOff, uint64(off)); err != nil {
+					return totalRead, err
+				}
+			case EncryptionLUKS:
+				if _, err := img.readLUKSEncrypted(buf, info.physOff, uint64(off)); err != nil {
+					return totalRead, err
+				}
+			default:
+				// Read from physical offset (use dataFile for external data file support)
+				n, err := img.dataFile().ReadAt(buf, int64(info.physOff))
+				if err != nil && err != io.EOF {
+					return totalRead, err
+				}
+				if n < int(readLen) {
+					return totalRead + n, io.ErrUnexpectedEOF
+				}
 			}
 		}
 
@@ -233,6 +261,34 @@ func (img *Image) loadSnapshotL1Table(snap *Snapshot) ([]byte, error) {
 	return l1Table, nil
 }
 
+// snapshotL1Table returns the L1 table of snap, reading it from disk only on
+// first use. The table is shared between callers and must not be modified.
+func (img *Image) snapshotL1Table(snap *Snapshot) ([]byte, error) {
+	img.snapshotL1Mu.Lock()
+	defer img.snapshotL1Mu.Unlock()
+
+	if l1Table, ok := img.snapshotL1[snap.L1TableOffset]; ok && len(l1Table) == int(snap.L1Size)*8 {
+		return l1Table, nil
+	}
+	l1Table, err := img.loadSnapshotL1Table(snap)
+	if err != nil {
+		return nil, err
+	}
+	if img.snapshotL1 == nil {
+		img.snapshotL1 = make(map[uint64][]byte)
+	}
+	img.snapshotL1[snap.L1TableOffset] = l1Table
+	return l1Table, nil
+}
+
+// forgetSnapshotL1Table drops the cached L1 table of snap, whose clusters
+// are about to be freed and may be reused for another table.
+func (img *Image) forgetSnapshotL1Table(snap *Snapshot) {
+	img.snapshotL1Mu.Lock()
+	delete(img.snapshotL1, snap.L1TableOffset)
+	img.snapshotL1Mu.Unlock()
+}
+
 // translateWithL1 translates a virtual offset using a specific L1 table.
 func (img *Image) translateWithL1(virtOff uint64, l1Table []byte) (clusterInfo, error) {
 	// Calculate indices
@@ -241,7 +297,7 @@ func (img *Image) translateWithL1(virtOff uint64, l1Table []byte) (clusterInfo,
 
 	// Check L1 bounds
 	if l1Index*8 >= uint64(len(l1Table)) {
-		return clusterInfo{ctype: clusterUnallocated}, nil
+		return clusterInfo{ctype: clusterUnallocated, noL2: true}, nil
 	}
 
 	// Read L1 entry
@@ -250,17 +306,22 @@ func (img *Image) translateWithL1(virtOff uint64, l1Table []byte) (clusterInfo,
 	// Extract L2 table offset
 	l2TableOff := l1Entry & L1EntryOffsetMask
 	if l2TableOff == 0 {
-		return clusterInfo{ctype: clusterUnallocated}, nil
+		return clusterInfo{ctype: clusterUnallocated, noL2: true}, nil
 	}
 
-	// Get L2 table (from cache or disk)
-	l2Table, err := img.getL2Table(l2TableOff)
-	if err != nil {
-		return clusterInfo{}, err
+	// Read the L2 entry (8 bytes for standard, 16 for extended) straight out
+	// of the cache; only load the whole table on a miss
+	var raw [16]byte
+	entry := raw[:img.l2EntrySize]
+	entryOffset := l2Index * uint64(img.l2EntrySize)
+	if !img.l2Cache.readAt(l2TableOff, entry, entryOffset) {
+		l2Table, err := img.getL2Table(l2TableOff)
+		if err != nil {
+			return clusterInfo{}, err
+		}
+		copy(entry, l2Table[entryOffset:])
 	}
-
-	// Read L2 entry
-	l2Entry := binary.BigEndian.Uint64(l2Table[l2Index*8:])
+	l2Entry := binary.BigEndian.Uint64(raw[0:8])
 
 	// Check if compressed
 	if l2Entry&L2EntryCompressed != 0 {
@@ -270,6 +331,11 @@ func (img *Image) translateWithL1(virtOff uint64, l1Table []byte) (clusterInfo,
 		}, nil
 	}
 
+	// For extended L2, check subcluster status
+	if img.extendedL2 {
+		return img.translateExtendedL2(virtOff, l2Entry, binary.BigEndian.Uint64(raw[8:16]))
+	}
+
 	// Check for zero cluster
 	if l2Entry&L2EntryZeroFlag != 0 {
 		return clusterInfo{ctype: clusterZero}, nil
@@ -332,7 +398,7 @@ func serializeSnapshot(snap *Snapshot) []byte {
 // and incrementing refcounts for all referenced clusters.
 func (img *Image) CreateSnapshot(name string) (*Snapshot, error) {
 	if img.readOnly {
-		return nil, fmt.Errorf("qcow2: cannot create snapshot on read-only image")
+		return nil, fmt.Errorf("%w: cannot create snapshot", ErrReadOnly)
 	}
 
 	if name == "" {
@@ -343,16 +409,39 @@ func (img *Image) CreateSnapshot(name string) (*Snapshot, error) {
 	img.writeMu.Lock()
 	defer img.writeMu.Unlock()
 
+	return img.createSnapshotLocked(name, "")
+}
+
+// createSnapshotLocked creates a snapshot with the given name and ID. An
+// empty ID is generated. Caller must hold img.writeMu.
+func (img *Image) createSnapshotLocked(name, id string) (*Snapshot, error) {
+	// Snapshots need copy-on-write, which cannot keep the raw mapping
+	if img.rawExternalData() {
+		return nil, fmt.Errorf("%w: snapshots are not supported", ErrRawDataFile)
+	}
+
+	// The snapshot has to include buffered writes
+	if err := img.flushDelayedLocked(); err != nil {
+		return nil, err
+	}
+	if err := img.faultAllL1(); err != nil {
+		return nil, err
+	}
+
 	// Check for duplicate name
 	if img.findSnapshotLocked(name) != nil {
 		return nil, fmt.Errorf("qcow2: snapshot with name %q already exists", name)
 	}
 
-	// Generate unique ID (QEMU uses sequential numbers as strings)
-	id := fmt.Sprintf("%d", len(img.snapshots)+1)
-	// Ensure ID is unique
-	for img.findSnapshotLocked(id) != nil {
-		id = fmt.Sprintf("%d", len(img.snapshots)+100)
+	if id == "" {
+		// Generate unique ID (QEMU uses sequential numbers as strings)
+		id = fmt.Sprintf("%d", len(img.snapshots)+1)
+		// Ensure ID is unique
+		for img.findSnapshotLocked(id) != nil {
+			id = fmt.Sprintf("%d", len(img.snapshots)+100)
+		}
+	} else if img.findSnapshotLocked(id) != nil {
+		return nil, fmt.Errorf("qcow2: snapshot with ID %q already exists", id)
 	}
 
 	// Copy L1 table to new cluster(s)
@@ -423,6 +512,14 @@ func (img *Image) CreateSnapshot(name string) (*Snapshot, error) {
 		extraData = make([]byte, 16)
 		binary.BigEndian.PutUint64(extraData[0:8], 0)                // vm_state_size_large
 		binary.BigEndian.PutUint64(extraData[8:16], img.header.Size) // disk_size
+
+		// Record lineage; the new snapshot becomes the active state's parent
+		parentID := ""
+		if current := img.currentSnapshotLocked(); current != nil {
+			parentID = current.ID
+		}
+		extraData = withLineage(extraData, parentID, true)
+		img.setCurrentSnapshotLocked(nil)
 	}
 
 	// Create snapshot entry
@@ -600,7 +697,7 @@ func (img *Image) writeSnapshotTable(newSnap *Snapshot) error {
 // removes the snapshot from the table, and updates the header.
 func (img *Image) DeleteSnapshot(idOrName string) error {
 	if img.readOnly {
-		return fmt.Errorf("qcow2: cannot delete snapshot on read-only image")
+		return fmt.Errorf("%w: cannot delete snapshot", ErrReadOnly)
 	}
 
 	if idOrName == "" {
@@ -611,6 +708,11 @@ func (img *Image) DeleteSnapshot(idOrName string) error {
 	img.writeMu.Lock()
 	defer img.writeMu.Unlock()
 
+	return img.deleteSnapshotLocked(idOrName)
+}
+
+// deleteSnapshotLocked deletes a snapshot. Caller must hold img.writeMu.
+func (img *Image) deleteSnapshotLocked(idOrName string) error {
 	// Find the snapshot index
 	snapIndex := -1
 	for i, snap := range img.snapshots {
@@ -624,6 +726,7 @@ func (img *Image) DeleteSnapshot(idOrName string) error {
 	}
 
 	snap := img.snapshots[snapIndex]
+	img.forgetSnapshotL1Table(snap)
 
 	// Decrement refcounts for all clusters referenced by this snapshot
 	if err := img.decrementSnapshotRefcounts(snap); err != nil {
@@ -635,6 +738,9 @@ func (img *Image) DeleteSnapshot(idOrName string) error {
 		return fmt.Errorf("qcow2: failed to restore COPIED flags: %w", err)
 	}
 
+	// Keep the lineage tree connected
+	img.detachLineageLocked(snap)
+
 	// Remove snapshot from in-memory list
 	img.snapshots = append(img.snapshots[:snapIndex], img.snapshots[snapIndex+1:]...)
 
@@ -813,6 +919,9 @@ func (img *Image) rewriteSnapshotTable() error {
 // COPIED flag for any entries where refcount=1. This is called after deleting
 // a snapshot to ensure the COPIED flag is consistent with refcounts.
 func (img *Image) restoreCopiedFlags() error {
+	if err := img.faultAllL1(); err != nil {
+		return err
+	}
 	img.l1Mu.Lock()
 	defer img.l1Mu.Unlock()
 
@@ -913,7 +1022,11 @@ func (img *Image) restoreCopiedFlags() error {
 // The snapshot itself remains intact and can be reverted to again.
 func (img *Image) RevertToSnapshot(idOrName string) error {
 	if img.readOnly {
-		return fmt.Errorf("qcow2: cannot revert snapshot on read-only image")
+		return fmt.Errorf("%w: cannot revert snapshot", ErrReadOnly)
+	}
+
+	if img.rawExternalData() {
+		return fmt.Errorf("%w: snapshots are not supported", ErrRawDataFile)
 	}
 
 	if idOrName == "" {
@@ -926,27 +1039,35 @@ func (img *Image) RevertToSnapshot(idOrName string) error {
 		return fmt.Errorf("qcow2: snapshot %q not found", idOrName)
 	}
 
+	// Writes not yet allocated belong to the state being thrown away
+	img.discardDelayed()
+
 	// Load the snapshot's L1 table
 	snapL1Table, err := img.loadSnapshotL1Table(snap)
 	if err != nil {
 		return fmt.Errorf("qcow2: failed to load snapshot L1 table: %w", err)
 	}
 
+	// The active L1 table may have grown since the snapshot was taken, or
+	// (for images from other tools) be smaller than the snapshot's
+	img.writeMu.Lock()
+	err = img.growL1TableLocked(uint64(len(snapL1Table)) / 8)
+	img.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
 	// Decrement refcounts for all clusters in current L1/L2 tables
 	// This "releases" the current state
 	if err := img.decrementCurrentRefcounts(); err != nil {
 		return fmt.Errorf("qcow2: failed to decrement current refcounts: %w", err)
 	}
 
-	// Copy snapshot's L1 table to current L1 table
+	// Copy snapshot's L1 table to current L1 table; entries past the end of
+	// a smaller snapshot table are unallocated
 	img.l1Mu.Lock()
-	// Ensure the tables are the same size
-	if uint32(len(snapL1Table)/8) != img.header.L1Size {
-		img.l1Mu.Unlock()
-		return fmt.Errorf("qcow2: snapshot L1 size mismatch: snapshot=%d, current=%d",
-			len(snapL1Table)/8, img.header.L1Size)
-	}
-	copy(img.l1Table, snapL1Table)
+	n := copy(img.l1Table, snapL1Table)
+	clear(img.l1Table[n:])
 	img.l1Mu.Unlock()
 
 	// Increment refcounts for all clusters in the restored L1/L2 tables
@@ -971,6 +1092,17 @@ func (img *Image) RevertToSnapshot(idOrName string) error {
 		return fmt.Errorf("qcow2: failed to restore COPIED flags: %w", err)
 	}
 
+	// The active state now descends from the snapshot
+	img.writeMu.Lock()
+	if _, _, ok := parseLineage(snap.ExtraData); ok && img.currentSnapshotLocked() != snap {
+		img.setCurrentSnapshotLocked(snap)
+		if err := img.rewriteSnapshotTable(); err != nil {
+			img.writeMu.Unlock()
+			return fmt.Errorf("qcow2: failed to rewrite snapshot table: %w", err)
+		}
+	}
+	img.writeMu.Unlock()
+
 	if err := img.file.Sync(); err != nil {
 		return fmt.Errorf("qcow2: failed to sync: %w", err)
 	}
@@ -981,6 +1113,9 @@ func (img *Image) RevertToSnapshot(idOrName string) error {
 // decrementCurrentRefcounts decrements refcounts for all L2 tables and data clusters
 // referenced by the current image's L1 table.
 func (img *Image) decrementCurrentRefcounts() error {
+	if err := img.faultAllL1(); err != nil {
+		return err
+	}
 	img.l1Mu.RLock()
 	defer img.l1Mu.RUnlock()
 
@@ -1038,6 +1173,9 @@ func (img *Image) decrementCurrentRefcounts() error {
 // incrementCurrentRefcounts increments refcounts for all L2 tables and data clusters
 // referenced by the current image's L1 table.
 func (img *Image) incrementCurrentRefcounts() error {
+	if err := img.faultAllL1(); err != nil {
+		return err
+	}
 	img.l1Mu.RLock()
 	defer img.l1Mu.RUnlock()
 
@@ -1091,3 +1229,48 @@ func (img *Image) incrementCurrentRefcounts() error {
 
 	return nil
 }
+
+// RevertOptions configures RevertToSnapshotWithOptions.
+type RevertOptions struct {
+	// SafetySnapshot snapshots the current state before reverting, so an
+	// accidental revert can itself be undone.
+	SafetySnapshot bool
+
+	// SafetySnapshotName names the safety snapshot. If empty, a name of the
+	// form "pre-revert-<target>-<timestamp>" is generated.
+	SafetySnapshotName string
+}
+
+// RevertToSnapshotWithOptions reverts the image to the given snapshot like
+// RevertToSnapshot. If opts.SafetySnapshot is set, the current state is
+// first captured in a new snapshot, which is returned; otherwise the
+// returned snapshot is nil.
+func (img *Image) RevertToSnapshotWithOptions(idOrName string, opts RevertOptions) (*Snapshot, error) {
+	if !opts.SafetySnapshot {
+		return nil, img.RevertToSnapshot(idOrName)
+	}
+
+	target := img.FindSnapshot(idOrName)
+	if target == nil {
+		return nil, fmt.Errorf("qcow2: snapshot %q not found", idOrName)
+	}
+
+	name := opts.SafetySnapshotName
+	if name == "" {
+		base := fmt.Sprintf("pre-revert-%s-%s", target.Name, time.Now().UTC().Format("20060102T150405Z"))
+		name = base
+		for i := 2; img.FindSnapshot(name) != nil; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+	}
+
+	safety, err := img.CreateSnapshot(name)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to create safety snapshot: %w", err)
+	}
+
+	if err := img.RevertToSnapshot(target.ID); err != nil {
+		return safety, err
+	}
+	return safety, nil
+}
@@ -0,0 +1,176 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrHolePunchUnsupported is returned when freed clusters cannot be
+// deallocated from the host file on this platform.
+var ErrHolePunchUnsupported = errors.New("qcow2: hole punching is not supported on this platform")
+
+// DeleteSnapshotOptions configures DeleteSnapshotWithOptions.
+type DeleteSnapshotOptions struct {
+	// PunchHoles deallocates freed clusters from the host file(s), so the
+	// space is returned to the filesystem immediately instead of only being
+	// reused by later allocations. It is supported on Linux (fallocate),
+	// macOS (F_PUNCHHOLE) and Windows (FSCTL_SET_ZERO_DATA on a sparse
+	// file); elsewhere it fails with ErrHolePunchUnsupported.
+	PunchHoles bool
+}
+
+// SnapshotDeleteReport describes the space released by deleting a snapshot.
+type SnapshotDeleteReport struct {
+	// Snapshot is the deleted snapshot
+	Snapshot *Snapshot
+
+	// DataClustersFreed and MetadataClustersFreed count clusters whose
+	// refcount dropped to zero. Clusters still shared with the active image
+	// or other snapshots are not freed.
+	DataClustersFreed     uint64
+	MetadataClustersFreed uint64
+
+	// BytesReclaimable is the host space occupied by freed clusters
+	BytesReclaimable uint64
+
+	// BytesPunched is the host space deallocated by hole punching
+	BytesPunched uint64
+}
+
+// ClustersFreed returns the total number of freed clusters.
+func (r *SnapshotDeleteReport) ClustersFreed() uint64 {
+	return r.DataClustersFreed + r.MetadataClustersFreed
+}
+
+// DeleteSnapshotWithOptions deletes a snapshot like DeleteSnapshot and
+// reports which clusters were freed. With lazy refcounts enabled, refcounts
+// are not maintained until the next open and nothing is reported as freed.
+//
+// If opts.PunchHoles is set and hole punching fails after the snapshot was
+// deleted, the report is returned along with the error.
+func (img *Image) DeleteSnapshotWithOptions(idOrName string, opts DeleteSnapshotOptions) (*SnapshotDeleteReport, error) {
+	if img.readOnly {
+		return nil, fmt.Errorf("%w: cannot delete snapshot", ErrReadOnly)
+	}
+	if idOrName == "" {
+		return nil, fmt.Errorf("qcow2: snapshot ID or name cannot be empty")
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	snap := img.findSnapshotLocked(idOrName)
+	if snap == nil {
+		return nil, fmt.Errorf("qcow2: snapshot %q not found", idOrName)
+	}
+
+	// Clusters the snapshot references; any of them may be freed
+	data, metadata, err := img.snapshotClusters(snap)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to scan snapshot: %w", err)
+	}
+	if img.header.SnapshotsOffset != 0 {
+		metadata[img.header.SnapshotsOffset] = struct{}{}
+	}
+
+	if err := img.deleteSnapshotLocked(snap.ID); err != nil {
+		return nil, err
+	}
+
+	report := &SnapshotDeleteReport{Snapshot: snap}
+	var freedData, freedMetadata []uint64
+	for off := range data {
+		if free, err := img.clusterFreed(off); err != nil {
+			return report, err
+		} else if free {
+			freedData = append(freedData, off)
+		}
+	}
+	for off := range metadata {
+		if free, err := img.clusterFreed(off); err != nil {
+			return report, err
+		} else if free {
+			freedMetadata = append(freedMetadata, off)
+		}
+	}
+	report.DataClustersFreed = uint64(len(freedData))
+	report.MetadataClustersFreed = uint64(len(freedMetadata))
+	report.BytesReclaimable = report.ClustersFreed() * img.clusterSize
+
+	if !opts.PunchHoles {
+		return report, nil
+	}
+
+	for _, off := range freedData {
+		if err := punchHole(img.dataFile(), int64(off), int64(img.clusterSize)); err != nil {
+			return report, fmt.Errorf("qcow2: failed to punch hole at 0x%x: %w", off, err)
+		}
+		img.dataWritten(off, img.clusterSize)
+		report.BytesPunched += img.clusterSize
+	}
+	for _, off := range freedMetadata {
+		if err := punchHole(img.file, int64(off), int64(img.clusterSize)); err != nil {
+			return report, fmt.Errorf("qcow2: failed to punch hole at 0x%x: %w", off, err)
+		}
+		report.BytesPunched += img.clusterSize
+	}
+
+	return report, nil
+}
+
+// snapshotClusters returns the host offsets of the data clusters and
+// metadata clusters (L1 and L2 tables) referenced by a snapshot. Compressed
+// clusters are skipped, as snapshot deletion does not release them.
+func (img *Image) snapshotClusters(snap *Snapshot) (data, metadata map[uint64]struct{}, err error) {
+	data = make(map[uint64]struct{})
+	metadata = make(map[uint64]struct{})
+
+	l1Table, err := img.loadSnapshotL1Table(snap)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l1Clusters := (uint64(snap.L1Size)*8 + img.clusterSize - 1) / img.clusterSize
+	for i := uint64(0); i < l1Clusters; i++ {
+		metadata[snap.L1TableOffset+i*img.clusterSize] = struct{}{}
+	}
+
+	for i := uint64(0); i < uint64(len(l1Table))/8; i++ {
+		l2Offset := binary.BigEndian.Uint64(l1Table[i*8:]) & L1EntryOffsetMask
+		if l2Offset == 0 {
+			continue
+		}
+		metadata[l2Offset] = struct{}{}
+
+		l2Table, err := img.getL2Table(l2Offset)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read L2 table at 0x%x: %w", l2Offset, err)
+		}
+		for j := uint64(0); j < img.l2Entries; j++ {
+			l2Entry := binary.BigEndian.Uint64(l2Table[j*uint64(img.l2EntrySize):])
+			if l2Entry&L2EntryCompressed != 0 {
+				continue
+			}
+			if dataOffset := l2Entry & L2EntryOffsetMask; dataOffset != 0 {
+				data[dataOffset] = struct{}{}
+			}
+		}
+	}
+
+	return data, metadata, nil
+}
+
+// clusterFreed reports whether the cluster at hostOffset has no references.
+func (img *Image) clusterFreed(hostOffset uint64) (bool, error) {
+	if img.lazyRefcounts {
+		return false, nil
+	}
+	img.refcountTableLock.Lock()
+	refcount, err := img.getRefcount(hostOffset)
+	img.refcountTableLock.Unlock()
+	if err != nil {
+		return false, fmt.Errorf("qcow2: failed to read refcount at 0x%x: %w", hostOffset, err)
+	}
+	return refcount == 0, nil
+}
@@ -0,0 +1,83 @@
+package qcow2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CreateExternalSnapshot takes an external snapshot of a live image: it
+// creates a new, empty overlay at path whose header names this image as its
+// qcow2 backing file, and freezes this image as the overlay's read-only
+// base. This is the workflow used for live backups: the guest keeps running
+// on the returned overlay while the frozen base is copied.
+//
+// The image is flushed and cleanly marked before it is frozen, so the base
+// file is consistent on disk as soon as the call returns. Afterwards the
+// image rejects writes with ErrReadOnly and belongs to the overlay, which
+// reads through it (keeping its caches warm) and closes it on Close; the
+// caller must switch all I/O to the overlay and must not close the image
+// itself. Writes that race with the call may land in either layer.
+//
+// The overlay's header refers to the base by a path relative to the
+// overlay, so the two files can be moved together. If the call fails the
+// image stays writable and no overlay is left behind.
+func (img *Image) CreateExternalSnapshot(path string) (*Image, error) {
+	if img.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	basePath, err := filepath.Abs(img.file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to resolve image path: %w", err)
+	}
+	overlayPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("qcow2: failed to resolve overlay path: %w", err)
+	}
+	backingName, err := filepath.Rel(filepath.Dir(overlayPath), basePath)
+	if err != nil {
+		backingName = basePath
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	if err := img.flushLocked(); err != nil {
+		return nil, err
+	}
+
+	overlay, err := Create(path, CreateOptions{
+		Size:          uint64(img.Size()),
+		ClusterBits:   img.header.ClusterBits,
+		BackingFile:   backingName,
+		BackingFormat: "qcow2",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create opened the base a second time; read through this image instead
+	if overlay.backing != nil {
+		if err := overlay.backing.Close(); err != nil {
+			overlay.backing = nil
+			overlay.Close()
+			os.Remove(path)
+			return nil, err
+		}
+	}
+
+	// Mark the base clean, as Close would, before it stops taking writes
+	if img.header.Version >= Version3 && !img.lazyRefcounts {
+		if err := img.clearDirty(); err != nil {
+			overlay.backing = nil
+			overlay.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("qcow2: failed to mark image clean: %w", err)
+		}
+	}
+
+	img.readOnly = true
+	overlay.backing = img
+	return overlay, nil
+}
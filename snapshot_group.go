@@ -0,0 +1,140 @@
+package qcow2
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// SnapshotGroup is a set of snapshots, one per image, taken at the same
+// consistency point. Every snapshot in the group has the group's ID and
+// name, so the group can be found again with FindSnapshot on each image.
+type SnapshotGroup struct {
+	ID        string
+	Name      string
+	Snapshots []*Snapshot // In the order of the images passed in
+}
+
+// PreparedSnapshotGroup is a snapshot group that has been validated and
+// quiesced but not yet created. Until Commit or Abort is called, snapshot
+// operations and cluster allocation are blocked on every image in the group.
+type PreparedSnapshotGroup struct {
+	id     string
+	name   string
+	images []*Image
+	done   bool
+}
+
+// CreateSnapshotGroup snapshots every image with the same name and a shared
+// group ID. Either all snapshots are created or none are.
+//
+// As with single-image snapshots, the caller must pause guest I/O to all
+// images for the snapshots to be a consistent point across disks.
+func CreateSnapshotGroup(images []*Image, name string) (*SnapshotGroup, error) {
+	prepared, err := PrepareSnapshotGroup(images, name)
+	if err != nil {
+		return nil, err
+	}
+	return prepared.Commit()
+}
+
+// PrepareSnapshotGroup is the first phase of a group snapshot. It checks
+// that the snapshot can be created on every image, flushes each image, and
+// locks them against metadata changes. It must be followed by Commit or
+// Abort.
+func PrepareSnapshotGroup(images []*Image, name string) (*PreparedSnapshotGroup, error) {
+	if len(images) == 0 {
+		return nil, fmt.Errorf("qcow2: snapshot group has no images")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("qcow2: snapshot name cannot be empty")
+	}
+	seen := make(map[*Image]bool, len(images))
+	for _, img := range images {
+		if seen[img] {
+			return nil, fmt.Errorf("qcow2: image appears twice in snapshot group")
+		}
+		seen[img] = true
+	}
+
+	var idBytes [8]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to generate group ID: %w", err)
+	}
+	p := &PreparedSnapshotGroup{
+		id:     "group-" + hex.EncodeToString(idBytes[:]),
+		name:   name,
+		images: images,
+	}
+
+	// Lock in slice order; Commit and Abort release in the same set
+	for i, img := range images {
+		img.writeMu.Lock()
+		if err := p.prepareImage(img); err != nil {
+			for _, locked := range images[:i+1] {
+				locked.writeMu.Unlock()
+			}
+			return nil, fmt.Errorf("qcow2: image %d: %w", i, err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *PreparedSnapshotGroup) prepareImage(img *Image) error {
+	if img.readOnly {
+		return fmt.Errorf("%w: cannot create snapshot", ErrReadOnly)
+	}
+	if img.findSnapshotLocked(p.name) != nil {
+		return fmt.Errorf("qcow2: snapshot with name %q already exists", p.name)
+	}
+	if img.findSnapshotLocked(p.id) != nil {
+		return fmt.Errorf("qcow2: snapshot with ID %q already exists", p.id)
+	}
+	return img.flushLocked()
+}
+
+// ID returns the group ID the snapshots will be created with.
+func (p *PreparedSnapshotGroup) ID() string {
+	return p.id
+}
+
+// Commit creates the snapshots and releases the images. If any snapshot
+// fails, the ones already created are deleted and the error is returned.
+func (p *PreparedSnapshotGroup) Commit() (*SnapshotGroup, error) {
+	if p.done {
+		return nil, fmt.Errorf("qcow2: snapshot group already committed or aborted")
+	}
+	p.done = true
+	defer p.unlock()
+
+	group := &SnapshotGroup{ID: p.id, Name: p.name}
+	for i, img := range p.images {
+		snap, err := img.createSnapshotLocked(p.name, p.id)
+		if err != nil {
+			for j, created := range group.Snapshots {
+				// Best effort; the original error is more useful
+				_ = p.images[j].deleteSnapshotLocked(created.ID)
+			}
+			return nil, fmt.Errorf("qcow2: snapshot group failed on image %d: %w", i, err)
+		}
+		group.Snapshots = append(group.Snapshots, snap)
+	}
+
+	return group, nil
+}
+
+// Abort releases the images without creating any snapshots.
+func (p *PreparedSnapshotGroup) Abort() {
+	if p.done {
+		return
+	}
+	p.done = true
+	p.unlock()
+}
+
+func (p *PreparedSnapshotGroup) unlock() {
+	for _, img := range p.images {
+		img.writeMu.Unlock()
+	}
+}
@@ -0,0 +1,93 @@
+// snapshot_group_test.go - Multi-image snapshot group tests
+
+package qcow2
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func createGroupImages(t *testing.T, n int) []*Image {
+	t.Helper()
+	dir := t.TempDir()
+	var images []*Image
+	for i := 0; i < n; i++ {
+		img, err := CreateSimple(filepath.Join(dir, fmt.Sprintf("disk%d.qcow2", i)), 1024*1024)
+		if err != nil {
+			t.Fatalf("CreateSimple failed: %v", err)
+		}
+		t.Cleanup(func() { img.Close() })
+		images = append(images, img)
+	}
+	return images
+}
+
+// TestCreateSnapshotGroup verifies every image gets the same ID and name.
+func TestCreateSnapshotGroup(t *testing.T) {
+	t.Parallel()
+	images := createGroupImages(t, 3)
+
+	group, err := CreateSnapshotGroup(images, "checkpoint")
+	if err != nil {
+		t.Fatalf("CreateSnapshotGroup failed: %v", err)
+	}
+	if len(group.Snapshots) != 3 {
+		t.Fatalf("got %d snapshots, want 3", len(group.Snapshots))
+	}
+	for i, img := range images {
+		snap := img.FindSnapshot(group.ID)
+		if snap == nil || snap.Name != "checkpoint" {
+			t.Errorf("image %d: group snapshot not found", i)
+		}
+	}
+
+	// Images are usable again after commit
+	if _, err := images[0].CreateSnapshot("after"); err != nil {
+		t.Errorf("CreateSnapshot after group failed: %v", err)
+	}
+}
+
+// TestSnapshotGroupAllOrNothing verifies a failing image leaves no
+// snapshots behind on the others.
+func TestSnapshotGroupAllOrNothing(t *testing.T) {
+	t.Parallel()
+	images := createGroupImages(t, 3)
+
+	if _, err := images[2].CreateSnapshot("checkpoint"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := CreateSnapshotGroup(images, "checkpoint"); err == nil {
+		t.Fatal("expected error for conflicting snapshot name")
+	}
+	for i, img := range images[:2] {
+		if n := len(img.Snapshots()); n != 0 {
+			t.Errorf("image %d has %d snapshots, want 0", i, n)
+		}
+	}
+
+	if _, err := CreateSnapshotGroup([]*Image{images[0], images[0]}, "dup"); err == nil {
+		t.Error("expected error for duplicate image")
+	}
+}
+
+// TestSnapshotGroupAbort verifies Abort releases the images.
+func TestSnapshotGroupAbort(t *testing.T) {
+	t.Parallel()
+	images := createGroupImages(t, 2)
+
+	prepared, err := PrepareSnapshotGroup(images, "checkpoint")
+	if err != nil {
+		t.Fatalf("PrepareSnapshotGroup failed: %v", err)
+	}
+	prepared.Abort()
+
+	if _, err := prepared.Commit(); err == nil {
+		t.Error("expected error committing an aborted group")
+	}
+	for i, img := range images {
+		if n := len(img.Snapshots()); n != 0 {
+			t.Errorf("image %d has %d snapshots, want 0", i, n)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package qcow2
+
+import (
+	"fmt"
+)
+
+// SnapshotStore is a read-only view of an image as it was when a snapshot
+// was taken. It implements BackingStore, so new overlays can branch off an
+// internal snapshot without reverting the image to it.
+//
+// The store reads through the image it came from, which must stay open,
+// and the snapshot must not be deleted while the store is in use.
+type SnapshotStore struct {
+	img  *Image
+	snap *Snapshot
+}
+
+// SnapshotStore returns a read-only BackingStore for the contents of the
+// image at the given snapshot.
+func (img *Image) SnapshotStore(idOrName string) (*SnapshotStore, error) {
+	snap := img.FindSnapshot(idOrName)
+	if snap == nil {
+		return nil, fmt.Errorf("qcow2: snapshot %q not found", idOrName)
+	}
+	return &SnapshotStore{img: img, snap: snap}, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *SnapshotStore) ReadAt(p []byte, off int64) (int, error) {
+	return s.img.ReadAtSnapshot(p, off, s.snap)
+}
+
+// Close implements io.Closer. It does not close the underlying image, which
+// belongs to the caller.
+func (s *SnapshotStore) Close() error {
+	return nil
+}
+
+// Size returns the virtual size of the snapshot in bytes.
+func (s *SnapshotStore) Size() int64 {
+	return s.img.Size()
+}
+
+// Snapshot returns the snapshot the store reads.
+func (s *SnapshotStore) Snapshot() *Snapshot {
+	return s.snap
+}
+
+// CreateOverlayFromSnapshot creates a new, empty image at path whose reads
+// fall through to the given snapshot of base, like CreateOverlay does for a
+// backing file. base is left untouched and can keep running on its active
+// layer.
+//
+// The backing relationship only exists in memory: a qcow2 header cannot name
+// an internal snapshot, so the new image is written without a backing file.
+// Reopen it with WithBackingStore and a SnapshotStore of the same snapshot.
+func CreateOverlayFromSnapshot(path string, base *Image, idOrName string) (*Image, error) {
+	store, err := base.SnapshotStore(idOrName)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := Create(path, CreateOptions{
+		Size:        uint64(base.Size()),
+		ClusterBits: base.header.ClusterBits,
+	})
+	if err != nil {
+		return nil, err
+	}
+	img.backing = store
+	return img, nil
+}
@@ -0,0 +1,165 @@
+// snapshot_overlay_test.go - Overlays backed by internal snapshots
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestCreateOverlayFromSnapshot verifies an overlay sees the snapshot, not
+// the base image's later writes, and keeps its own writes separate.
+func TestCreateOverlayFromSnapshot(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	base, err := CreateSimple(filepath.Join(dir, "base.qcow2"), 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer base.Close()
+
+	before := testutil.RandomBytes(1, 128*1024)
+	if _, err := base.WriteAt(before, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := base.CreateSnapshot("golden"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	after := testutil.RandomBytes(2, 128*1024)
+	if _, err := base.WriteAt(after, 0); err != nil {
+		t.Fatalf("WriteAt after snapshot failed: %v", err)
+	}
+
+	if _, err := CreateOverlayFromSnapshot(filepath.Join(dir, "bad.qcow2"), base, "missing"); err == nil {
+		t.Error("CreateOverlayFromSnapshot should fail for an unknown snapshot")
+	}
+
+	overlayPath := filepath.Join(dir, "branch.qcow2")
+	overlay, err := CreateOverlayFromSnapshot(overlayPath, base, "golden")
+	if err != nil {
+		t.Fatalf("CreateOverlayFromSnapshot failed: %v", err)
+	}
+	if overlay.Size() != base.Size() {
+		t.Errorf("overlay size = %d, want %d", overlay.Size(), base.Size())
+	}
+
+	want := append([]byte(nil), before...)
+	own := testutil.RandomBytes(3, 1000)
+	if _, err := overlay.WriteAt(own, 70000); err != nil {
+		t.Fatalf("overlay WriteAt failed: %v", err)
+	}
+	copy(want[70000:], own)
+
+	got := make([]byte, len(want))
+	if _, err := overlay.ReadAt(got, 0); err != nil {
+		t.Fatalf("overlay ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("overlay does not read the snapshot contents")
+	}
+	if err := overlay.Close(); err != nil {
+		t.Fatalf("overlay Close failed: %v", err)
+	}
+
+	// The base image is unaffected and still open
+	if _, err := base.ReadAt(got, 0); err != nil {
+		t.Fatalf("base ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, after) {
+		t.Error("base image changed")
+	}
+
+	// Reopen with the snapshot supplied again
+	store, err := base.SnapshotStore("golden")
+	if err != nil {
+		t.Fatalf("SnapshotStore failed: %v", err)
+	}
+	overlay, err = Open(overlayPath, WithBackingStore(store))
+	if err != nil {
+		t.Fatalf("Open with backing store failed: %v", err)
+	}
+	defer overlay.Close()
+	if _, err := overlay.ReadAt(got, 0); err != nil {
+		t.Fatalf("reopened overlay ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("reopened overlay data mismatch")
+	}
+}
+
+// TestCreateExternalSnapshot hands a live image over to a new overlay and
+// verifies the base is frozen, clean and found again by path on reopen.
+func TestCreateExternalSnapshot(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+
+	base, err := CreateSimple(basePath, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	before := testutil.RandomBytes(1, 8192)
+	if _, err := base.WriteAt(before, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	overlay, err := base.CreateExternalSnapshot(overlayPath)
+	if err != nil {
+		t.Fatalf("CreateExternalSnapshot failed: %v", err)
+	}
+	if _, err := base.WriteAt([]byte("late"), 0); err != ErrReadOnly {
+		t.Errorf("write to frozen base: got %v, want ErrReadOnly", err)
+	}
+	after := testutil.RandomBytes(2, 8192)
+	if _, err := overlay.WriteAt(after, 1024*1024); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if overlay.BackingFile() != "base.qcow2" {
+		t.Errorf("BackingFile() = %q, want base.qcow2", overlay.BackingFile())
+	}
+
+	// The base file is consistent while the overlay is still open
+	frozen, err := OpenFile(basePath, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open base failed: %v", err)
+	}
+	if frozen.IsDirty() {
+		t.Error("frozen base is still marked dirty")
+	}
+	got := make([]byte, 8192)
+	if _, err := frozen.ReadAt(got, 1024*1024); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, make([]byte, 8192)) {
+		t.Error("overlay write reached the base")
+	}
+	frozen.Close()
+
+	if err := overlay.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	overlay, err = Open(overlayPath)
+	if err != nil {
+		t.Fatalf("Open overlay failed: %v", err)
+	}
+	defer overlay.Close()
+	if _, err := overlay.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, before) {
+		t.Error("base data not visible through the overlay")
+	}
+	if _, err := overlay.ReadAt(got, 1024*1024); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, after) {
+		t.Error("overlay data mismatch")
+	}
+}
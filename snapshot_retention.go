@@ -0,0 +1,119 @@
+package qcow2
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy selects which snapshots PruneSnapshots keeps. A snapshot
+// is kept if any rule selects it. Calendar periods are evaluated in UTC.
+type RetentionPolicy struct {
+	// KeepLast keeps the N most recent snapshots.
+	KeepLast int
+
+	// KeepDaily, KeepWeekly, and KeepMonthly keep the most recent snapshot
+	// of each of the last N days, ISO weeks, and months that have one.
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+
+	// DryRun computes the result without deleting anything.
+	DryRun bool
+}
+
+// PruneResult lists the outcome of PruneSnapshots, newest first.
+type PruneResult struct {
+	Kept    []*Snapshot
+	Deleted []*Snapshot
+}
+
+// PruneSnapshots deletes every snapshot not selected by the policy. The
+// snapshot table is rewritten once, so the image goes directly from the old
+// snapshot set to the new one. A policy that keeps nothing is rejected.
+func (img *Image) PruneSnapshots(policy RetentionPolicy) (*PruneResult, error) {
+	if policy.KeepLast <= 0 && policy.KeepDaily <= 0 && policy.KeepWeekly <= 0 && policy.KeepMonthly <= 0 {
+		return nil, fmt.Errorf("qcow2: retention policy keeps no snapshots")
+	}
+	if img.readOnly && !policy.DryRun {
+		return nil, fmt.Errorf("%w: cannot delete snapshot", ErrReadOnly)
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	result := selectRetained(img.snapshots, policy)
+	if policy.DryRun || len(result.Deleted) == 0 {
+		return result, nil
+	}
+
+	for _, snap := range result.Deleted {
+		if err := img.decrementSnapshotRefcounts(snap); err != nil {
+			return nil, fmt.Errorf("qcow2: failed to decrement refcounts for snapshot %q: %w", snap.Name, err)
+		}
+		img.detachLineageLocked(snap)
+		for i, s := range img.snapshots {
+			if s == snap {
+				img.snapshots = append(img.snapshots[:i], img.snapshots[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if err := img.restoreCopiedFlags(); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to restore COPIED flags: %w", err)
+	}
+	if err := img.rewriteSnapshotTable(); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to rewrite snapshot table: %w", err)
+	}
+
+	return result, nil
+}
+
+// selectRetained applies a retention policy to a snapshot list.
+func selectRetained(snapshots []*Snapshot, policy RetentionPolicy) *PruneResult {
+	sorted := make([]*Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.After(sorted[j].Date)
+	})
+
+	keep := make(map[*Snapshot]bool)
+	for i := 0; i < policy.KeepLast && i < len(sorted); i++ {
+		keep[sorted[i]] = true
+	}
+
+	keepPeriods := func(n int, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, snap := range sorted {
+			if len(seen) >= n {
+				return
+			}
+			p := period(snap.Date.UTC())
+			if !seen[p] {
+				seen[p] = true
+				keep[snap] = true
+			}
+		}
+	}
+	keepPeriods(policy.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPeriods(policy.KeepMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	result := &PruneResult{}
+	for _, snap := range sorted {
+		if keep[snap] {
+			result.Kept = append(result.Kept, snap)
+		} else {
+			result.Deleted = append(result.Deleted, snap)
+		}
+	}
+	return result
+}
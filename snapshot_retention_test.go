@@ -0,0 +1,127 @@
+// snapshot_retention_test.go - Snapshot retention policy tests
+
+package qcow2
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSelectRetained verifies the calendar bucket rules.
+func TestSelectRetained(t *testing.T) {
+	t.Parallel()
+
+	// One snapshot every 12 hours for 70 days
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var snaps []*Snapshot
+	for i := 0; i < 140; i++ {
+		snaps = append(snaps, &Snapshot{
+			ID:   fmt.Sprintf("%d", i+1),
+			Name: fmt.Sprintf("s%d", i),
+			Date: start.Add(time.Duration(i) * 12 * time.Hour),
+		})
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   int
+	}{
+		{"last", RetentionPolicy{KeepLast: 5}, 5},
+		{"daily", RetentionPolicy{KeepDaily: 7}, 7},
+		{"weekly", RetentionPolicy{KeepWeekly: 4}, 4},
+		{"monthly", RetentionPolicy{KeepMonthly: 12}, 3},
+		{"last overlaps daily", RetentionPolicy{KeepLast: 2, KeepDaily: 2}, 3},
+	}
+	for _, tt := range tests {
+		result := selectRetained(snaps, tt.policy)
+		if len(result.Kept) != tt.want {
+			t.Errorf("%s: kept %d, want %d", tt.name, len(result.Kept), tt.want)
+		}
+		if len(result.Kept)+len(result.Deleted) != len(snaps) {
+			t.Errorf("%s: kept+deleted = %d, want %d", tt.name, len(result.Kept)+len(result.Deleted), len(snaps))
+		}
+		if result.Kept[0] != snaps[len(snaps)-1] {
+			t.Errorf("%s: newest snapshot not kept", tt.name)
+		}
+	}
+}
+
+// TestPruneSnapshots verifies pruning deletes unselected snapshots and
+// leaves the kept ones readable.
+func TestPruneSnapshots(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "prune.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := img.WriteAt([]byte{byte(i)}, 0); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+		if _, err := img.CreateSnapshot(fmt.Sprintf("s%d", i)); err != nil {
+			t.Fatalf("CreateSnapshot failed: %v", err)
+		}
+	}
+	// Space the snapshots a second apart so they order deterministically
+	for i, snap := range img.Snapshots() {
+		snap.Date = time.Unix(int64(1000+i), 0)
+	}
+
+	if _, err := img.PruneSnapshots(RetentionPolicy{}); err == nil {
+		t.Error("expected error for empty policy")
+	}
+
+	dry, err := img.PruneSnapshots(RetentionPolicy{KeepLast: 2, DryRun: true})
+	if err != nil {
+		t.Fatalf("PruneSnapshots dry run failed: %v", err)
+	}
+	if len(dry.Deleted) != 3 || len(img.Snapshots()) != 5 {
+		t.Fatalf("dry run deleted %d (have %d snapshots)", len(dry.Deleted), len(img.Snapshots()))
+	}
+
+	result, err := img.PruneSnapshots(RetentionPolicy{KeepLast: 2})
+	if err != nil {
+		t.Fatalf("PruneSnapshots failed: %v", err)
+	}
+	if len(result.Deleted) != 3 {
+		t.Errorf("deleted %d, want 3", len(result.Deleted))
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	snaps := img.Snapshots()
+	if len(snaps) != 2 || snaps[0].Name != "s3" || snaps[1].Name != "s4" {
+		t.Fatalf("unexpected snapshots after prune: %d", len(snaps))
+	}
+	buf := make([]byte, 1)
+	for i, snap := range snaps {
+		if _, err := img.ReadAtSnapshot(buf, 0, snap); err != nil {
+			t.Fatalf("ReadAtSnapshot failed: %v", err)
+		}
+		if buf[0] != byte(3+i) {
+			t.Errorf("snapshot %s data = %d, want %d", snap.Name, buf[0], 3+i)
+		}
+	}
+	if parent, ok := snaps[0].ParentID(); !ok || parent != "" {
+		t.Errorf("s3 parent = %q, want root", parent)
+	}
+
+	check, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if check.Corruptions != 0 {
+		t.Errorf("Check found %d corruptions: %v", check.Corruptions, check.Errors)
+	}
+}
@@ -5,6 +5,7 @@ package qcow2
 
 import (
 	"bytes"
+	"errors"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -873,3 +874,274 @@ func TestSnapshotL1SizeMismatch(t *testing.T) {
 		t.Error("Data mismatch after revert")
 	}
 }
+
+// TestRevertWithSafetySnapshot verifies the pre-revert state is kept.
+func TestRevertWithSafetySnapshot(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "revert.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	if _, err := img.WriteAt([]byte("old"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.CreateSnapshot("snap"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte("new"), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	safety, err := img.RevertToSnapshotWithOptions("snap", RevertOptions{SafetySnapshot: true})
+	if err != nil {
+		t.Fatalf("RevertToSnapshotWithOptions failed: %v", err)
+	}
+	if safety == nil {
+		t.Fatal("expected a safety snapshot")
+	}
+
+	buf := make([]byte, 3)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if string(buf) != "old" {
+		t.Errorf("active data = %q, want old", buf)
+	}
+	if _, err := img.ReadAtSnapshot(buf, 0, safety); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if string(buf) != "new" {
+		t.Errorf("safety snapshot data = %q, want new", buf)
+	}
+
+	// Undo the revert
+	if err := img.RevertToSnapshot(safety.ID); err != nil {
+		t.Fatalf("RevertToSnapshot failed: %v", err)
+	}
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if string(buf) != "new" {
+		t.Errorf("data after undo = %q, want new", buf)
+	}
+
+	if _, err := img.RevertToSnapshotWithOptions("missing", RevertOptions{SafetySnapshot: true}); err == nil {
+		t.Error("expected error for missing snapshot")
+	}
+	if n := len(img.Snapshots()); n != 2 {
+		t.Errorf("got %d snapshots, want 2", n)
+	}
+}
+
+// TestDeleteSnapshotReport verifies the report counts only clusters that
+// are no longer shared with the active image.
+func TestDeleteSnapshotReport(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "reclaim.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	clusterSize := img.ClusterSize()
+	data := bytes.Repeat([]byte{0xAB}, 4*clusterSize)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	// Unchanged since the snapshot: nothing data-wise is freed
+	if _, err := img.CreateSnapshot("shared"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	report, err := img.DeleteSnapshotWithOptions("shared", DeleteSnapshotOptions{})
+	if err != nil {
+		t.Fatalf("DeleteSnapshotWithOptions failed: %v", err)
+	}
+	if report.DataClustersFreed != 0 {
+		t.Errorf("DataClustersFreed = %d, want 0", report.DataClustersFreed)
+	}
+	if report.MetadataClustersFreed == 0 {
+		t.Error("expected the snapshot L1 table to be freed")
+	}
+
+	// Overwritten after the snapshot: the old data clusters are freed
+	if _, err := img.CreateSnapshot("old"); err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0xCD}, 3*clusterSize), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	report, err = img.DeleteSnapshotWithOptions("old", DeleteSnapshotOptions{PunchHoles: true})
+	if errors.Is(err, ErrHolePunchUnsupported) {
+		t.Skip("hole punching not supported")
+	}
+	if err != nil {
+		t.Fatalf("DeleteSnapshotWithOptions failed: %v", err)
+	}
+	if report.DataClustersFreed != 3 {
+		t.Errorf("DataClustersFreed = %d, want 3", report.DataClustersFreed)
+	}
+	if report.BytesReclaimable != report.ClustersFreed()*uint64(clusterSize) {
+		t.Errorf("BytesReclaimable = %d, want %d", report.BytesReclaimable, report.ClustersFreed()*uint64(clusterSize))
+	}
+	if report.BytesPunched != report.BytesReclaimable {
+		t.Errorf("BytesPunched = %d, want %d", report.BytesPunched, report.BytesReclaimable)
+	}
+
+	buf := make([]byte, 4*clusterSize)
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf[:3*clusterSize], bytes.Repeat([]byte{0xCD}, 3*clusterSize)) ||
+		!bytes.Equal(buf[3*clusterSize:], data[3*clusterSize:]) {
+		t.Error("active data changed after delete")
+	}
+	if _, err := img.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+}
+
+// TestDeleteSnapshotReportExtendedL2 verifies the scan of a snapshot's L2
+// tables steps over the subcluster bitmaps of extended L2 entries.
+func TestDeleteSnapshotReportExtendedL2(t *testing.T) {
+	t.Parallel()
+	path, data := createExtendedL2Image(t, true)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	entry, _ := extendedL2Entry(t, img, 0)
+	snap, err := img.CreateSnapshot("ext")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	dataClusters, _, err := img.snapshotClusters(snap)
+	if err != nil {
+		t.Fatalf("snapshotClusters failed: %v", err)
+	}
+	if _, ok := dataClusters[entry&L2EntryOffsetMask]; !ok || len(dataClusters) != 1 {
+		t.Errorf("snapshot data clusters = %v, want only 0x%x", dataClusters, entry&L2EntryOffsetMask)
+	}
+
+	report, err := img.DeleteSnapshotWithOptions("ext", DeleteSnapshotOptions{})
+	if err != nil {
+		t.Fatalf("DeleteSnapshotWithOptions failed: %v", err)
+	}
+	if report.DataClustersFreed != 0 {
+		t.Errorf("DataClustersFreed = %d, want 0", report.DataClustersFreed)
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := img.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("active data changed after delete")
+	}
+}
+
+// TestReadAtSnapshotL1Cache verifies snapshot L1 tables are loaded once and
+// dropped on delete, so a new snapshot reusing the clusters is read fresh.
+func TestReadAtSnapshotL1Cache(t *testing.T) {
+	t.Parallel()
+	img, err := CreateSimple(filepath.Join(t.TempDir(), "l1cache.qcow2"), 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	first := bytes.Repeat([]byte{0x11}, 4096)
+	if _, err := img.WriteAt(first, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	snap, err := img.CreateSnapshot("first")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		if _, err := img.ReadAtSnapshot(buf, 0, snap); err != nil {
+			t.Fatalf("ReadAtSnapshot failed: %v", err)
+		}
+	}
+	if !bytes.Equal(buf, first) {
+		t.Error("snapshot data mismatch")
+	}
+	if len(img.snapshotL1) != 1 {
+		t.Errorf("%d cached L1 tables, want 1", len(img.snapshotL1))
+	}
+
+	if err := img.DeleteSnapshot("first"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	if len(img.snapshotL1) != 0 {
+		t.Errorf("%d cached L1 tables after delete, want 0", len(img.snapshotL1))
+	}
+
+	second := bytes.Repeat([]byte{0x22}, 4096)
+	if _, err := img.WriteAt(second, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	snap, err = img.CreateSnapshot("second")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.ReadAtSnapshot(buf, 0, snap); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if !bytes.Equal(buf, second) {
+		t.Error("second snapshot read stale data")
+	}
+}
+
+// TestReadAtSnapshotBacking verifies clusters a snapshot of an overlay
+// leaves unallocated are read from the backing file, not as zeros.
+func TestReadAtSnapshotBacking(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+
+	base, err := CreateSimple(basePath, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	baseData := bytes.Repeat([]byte{0x33}, 8192)
+	if _, err := base.WriteAt(baseData, 0); err != nil {
+		t.Fatalf("WriteAt base failed: %v", err)
+	}
+	base.Close()
+
+	img, err := CreateOverlay(filepath.Join(dir, "overlay.qcow2"), basePath)
+	if err != nil {
+		t.Fatalf("CreateOverlay failed: %v", err)
+	}
+	defer img.Close()
+	snap, err := img.CreateSnapshot("backed")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0x44}, 8192), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+
+	buf := make([]byte, 16384)
+	if _, err := img.ReadAtSnapshot(buf, 0, snap); err != nil {
+		t.Fatalf("ReadAtSnapshot failed: %v", err)
+	}
+	if !bytes.Equal(buf[:8192], baseData) {
+		t.Error("snapshot did not read through to the backing file")
+	}
+	if !bytes.Equal(buf[8192:], make([]byte, 8192)) {
+		t.Error("snapshot read nonzero data past the backing data")
+	}
+}
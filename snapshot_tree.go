@@ -0,0 +1,184 @@
+package qcow2
+
+import (
+	"encoding/binary"
+)
+
+// Snapshot lineage is stored as an optional trailer in the snapshot extra
+// data, after the fields QEMU defines:
+//
+//	Offset  Size  Description
+//	0       8     vm_state_size_large
+//	8       8     disk_size
+//	16      8     icount (all ones: not recorded)
+//	24      4     Magic "GQLN"
+//	28      1     Flags (bit 0: active state descends from this snapshot)
+//	29      1     Reserved
+//	30      2     Parent ID length
+//	32      ...   Parent ID, padded to 8 bytes
+//
+// QEMU preserves extra data it does not understand, so lineage survives
+// snapshot operations performed by qemu-img. Snapshots without the trailer
+// (created by other tools, or on version 2 images) have no known parent.
+const (
+	lineageOffset     = 24
+	lineageMagic      = "GQLN"
+	lineageHeaderSize = 8
+	lineageFlagActive = 1 << 0
+)
+
+// SnapshotNode is a snapshot and the snapshots taken from states that
+// descend from it.
+type SnapshotNode struct {
+	Snapshot *Snapshot
+	Children []*SnapshotNode
+}
+
+// ParentID returns the ID of the snapshot this snapshot's state descends
+// from. ok is false if the snapshot has no lineage data; a snapshot with
+// lineage but no parent returns "", true.
+func (s *Snapshot) ParentID() (id string, ok bool) {
+	parent, _, ok := parseLineage(s.ExtraData)
+	return parent, ok
+}
+
+// SnapshotTree returns the snapshots arranged by lineage, roots first in
+// snapshot table order. Snapshots without lineage data, or whose parent has
+// been deleted outside this library, are roots.
+func (img *Image) SnapshotTree() []*SnapshotNode {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	snaps := img.snapshots
+
+	nodes := make(map[string]*SnapshotNode, len(snaps))
+	for _, snap := range snaps {
+		nodes[snap.ID] = &SnapshotNode{Snapshot: snap}
+	}
+
+	var roots []*SnapshotNode
+	for _, snap := range snaps {
+		node := nodes[snap.ID]
+		parentID, ok := snap.ParentID()
+		if parent := nodes[parentID]; ok && parentID != "" && parent != nil && parent != node {
+			parent.Children = append(parent.Children, node)
+			continue
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+// CurrentSnapshot returns the snapshot the active state descends from: the
+// most recently created or reverted-to snapshot. It returns nil if no
+// snapshot carries lineage data.
+func (img *Image) CurrentSnapshot() *Snapshot {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	return img.currentSnapshotLocked()
+}
+
+func (img *Image) currentSnapshotLocked() *Snapshot {
+	for _, snap := range img.snapshots {
+		if _, active, ok := parseLineage(snap.ExtraData); ok && active {
+			return snap
+		}
+	}
+	return nil
+}
+
+// snapshotByIDLocked finds a snapshot by ID only.
+func (img *Image) snapshotByIDLocked(id string) *Snapshot {
+	for _, snap := range img.snapshots {
+		if snap.ID == id {
+			return snap
+		}
+	}
+	return nil
+}
+
+// setCurrentSnapshotLocked moves the active marker to snap (nil clears it).
+// Only snapshots that already carry lineage are modified. The caller
+// rewrites the snapshot table, whose entries change size when a parent ID
+// does (see reparentChildrenLocked).
+func (img *Image) setCurrentSnapshotLocked(snap *Snapshot) {
+	for _, s := range img.snapshots {
+		parent, active, ok := parseLineage(s.ExtraData)
+		if !ok || active == (s == snap) {
+			continue
+		}
+		s.ExtraData = withLineage(s.ExtraData, parent, s == snap)
+	}
+}
+
+// detachLineageLocked prepares the lineage of the remaining snapshots for the
+// deletion of snap: its children are reparented to its parent, and if the
+// active state descended from it, it now descends from its parent.
+func (img *Image) detachLineageLocked(snap *Snapshot) {
+	img.reparentChildrenLocked(snap)
+	if img.currentSnapshotLocked() == snap {
+		parentID, _, _ := parseLineage(snap.ExtraData)
+		img.setCurrentSnapshotLocked(img.snapshotByIDLocked(parentID))
+	}
+}
+
+// reparentChildrenLocked points the children of a snapshot being deleted at
+// its parent, keeping the tree connected.
+func (img *Image) reparentChildrenLocked(snap *Snapshot) {
+	grandparent, _, ok := parseLineage(snap.ExtraData)
+	if !ok {
+		grandparent = ""
+	}
+	for _, s := range img.snapshots {
+		parent, active, ok := parseLineage(s.ExtraData)
+		if ok && s != snap && parent == snap.ID {
+			s.ExtraData = withLineage(s.ExtraData, grandparent, active)
+		}
+	}
+}
+
+// parseLineage decodes the lineage trailer of snapshot extra data.
+func parseLineage(extra []byte) (parent string, active, ok bool) {
+	if len(extra) < lineageOffset+lineageHeaderSize {
+		return "", false, false
+	}
+	trailer := extra[lineageOffset:]
+	if string(trailer[0:4]) != lineageMagic {
+		return "", false, false
+	}
+	n := int(binary.BigEndian.Uint16(trailer[6:8]))
+	if len(trailer) < lineageHeaderSize+n {
+		return "", false, false
+	}
+	return string(trailer[lineageHeaderSize : lineageHeaderSize+n]), trailer[4]&lineageFlagActive != 0, true
+}
+
+// withLineage returns a copy of extra with the lineage trailer set. The
+// QEMU-defined fields are kept, as is any data after them or after an old
+// trailer, which follows the new one; a missing icount is recorded as all
+// ones.
+func withLineage(extra []byte, parent string, active bool) []byte {
+	var rest []byte
+	if len(extra) > lineageOffset {
+		rest = extra[lineageOffset:]
+		if old, _, ok := parseLineage(extra); ok {
+			rest = rest[min(len(rest), lineageHeaderSize+(len(old)+7)&^7):]
+		}
+	}
+
+	trailerSize := lineageHeaderSize + (len(parent)+7)&^7
+	out := make([]byte, lineageOffset+trailerSize+len(rest))
+	copy(out, extra[:min(len(extra), lineageOffset)])
+	if len(extra) < lineageOffset {
+		binary.BigEndian.PutUint64(out[16:24], ^uint64(0))
+	}
+	copy(out[lineageOffset+trailerSize:], rest)
+
+	trailer := out[lineageOffset:]
+	copy(trailer[0:4], lineageMagic)
+	if active {
+		trailer[4] = lineageFlagActive
+	}
+	binary.BigEndian.PutUint16(trailer[6:8], uint16(len(parent)))
+	copy(trailer[lineageHeaderSize:], parent)
+	return out
+}
@@ -0,0 +1,157 @@
+// snapshot_tree_test.go - Snapshot lineage tests
+
+package qcow2
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestSnapshotTreeBranches verifies reverting and snapshotting again creates
+// a branch, and that lineage survives reopening.
+func TestSnapshotTreeBranches(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "tree.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+
+	// base -> a, base -> b
+	for _, step := range []struct{ revert, create string }{
+		{"", "base"},
+		{"", "a"},
+		{"base", "b"},
+	} {
+		if step.revert != "" {
+			if err := img.RevertToSnapshot(step.revert); err != nil {
+				t.Fatalf("RevertToSnapshot(%s) failed: %v", step.revert, err)
+			}
+		}
+		if _, err := img.CreateSnapshot(step.create); err != nil {
+			t.Fatalf("CreateSnapshot(%s) failed: %v", step.create, err)
+		}
+	}
+	if cur := img.CurrentSnapshot(); cur == nil || cur.Name != "b" {
+		t.Errorf("CurrentSnapshot = %v, want b", cur)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	roots := img.SnapshotTree()
+	if len(roots) != 1 || roots[0].Snapshot.Name != "base" {
+		t.Fatalf("expected single root base, got %d roots", len(roots))
+	}
+	children := roots[0].Children
+	if len(children) != 2 || children[0].Snapshot.Name != "a" || children[1].Snapshot.Name != "b" {
+		t.Fatalf("unexpected children of base: %d", len(children))
+	}
+
+	if err := img.RevertToSnapshot("a"); err != nil {
+		t.Fatalf("RevertToSnapshot failed: %v", err)
+	}
+	if cur := img.CurrentSnapshot(); cur == nil || cur.Name != "a" {
+		t.Errorf("CurrentSnapshot after revert = %v, want a", cur)
+	}
+}
+
+// TestSnapshotTreeDeleteReparents verifies deleting an inner snapshot
+// attaches its children to its parent.
+func TestSnapshotTreeDeleteReparents(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "tree.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	for _, name := range []string{"s1", "s2", "s3"} {
+		if _, err := img.CreateSnapshot(name); err != nil {
+			t.Fatalf("CreateSnapshot(%s) failed: %v", name, err)
+		}
+	}
+	if err := img.DeleteSnapshot("s2"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+
+	s1, s3 := img.FindSnapshot("s1"), img.FindSnapshot("s3")
+	if parent, ok := s3.ParentID(); !ok || parent != s1.ID {
+		t.Errorf("s3 parent = %q (ok=%v), want %q", parent, ok, s1.ID)
+	}
+
+	if err := img.DeleteSnapshot("s3"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	if cur := img.CurrentSnapshot(); cur == nil || cur.Name != "s1" {
+		t.Errorf("CurrentSnapshot = %v, want s1", cur)
+	}
+}
+
+// TestSnapshotTreeReparentGrowsEntry verifies a reparent that lengthens a
+// parent ID grows the snapshot table entry, keeping data after the trailer.
+func TestSnapshotTreeReparentGrowsEntry(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "tree.qcow2")
+
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	for _, name := range []string{"s1", "s2", "s3"} {
+		if _, err := img.CreateSnapshot(name); err != nil {
+			t.Fatalf("CreateSnapshot(%s) failed: %v", name, err)
+		}
+	}
+
+	// Give s1 an ID longer than the padded one-digit IDs, and s3 extra data
+	// of its own after the trailer
+	const longID = "grandparent-id"
+	trailing := []byte("trailing")
+	img.writeMu.Lock()
+	s1, s2, s3 := img.findSnapshotLocked("s1"), img.findSnapshotLocked("s2"), img.findSnapshotLocked("s3")
+	s1.ID = longID
+	s2.ExtraData = withLineage(s2.ExtraData, longID, false)
+	s3.ExtraData = append(s3.ExtraData, trailing...)
+	err = img.rewriteSnapshotTable()
+	img.writeMu.Unlock()
+	if err != nil {
+		t.Fatalf("rewriteSnapshotTable failed: %v", err)
+	}
+	before := len(s3.ExtraData)
+
+	if err := img.DeleteSnapshot("s2"); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	if len(s3.ExtraData) <= before {
+		t.Fatalf("s3 extra data is %d bytes, want more than %d", len(s3.ExtraData), before)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	s1, s3 = img.FindSnapshot("s1"), img.FindSnapshot("s3")
+	if s1 == nil || s3 == nil || s1.ID != longID {
+		t.Fatalf("snapshots after reopen: s1=%v s3=%v", s1, s3)
+	}
+	if parent, ok := s3.ParentID(); !ok || parent != longID {
+		t.Errorf("s3 parent = %q (ok=%v), want %q", parent, ok, longID)
+	}
+	if cur := img.CurrentSnapshot(); cur == nil || cur.Name != "s3" {
+		t.Errorf("CurrentSnapshot = %v, want s3", cur)
+	}
+	if !bytes.HasSuffix(s3.ExtraData, trailing) {
+		t.Errorf("s3 extra data lost its trailing bytes: %q", s3.ExtraData)
+	}
+}
@@ -0,0 +1,128 @@
+package qcow2
+
+import (
+	"io"
+)
+
+// sparseBatchSize is how much data SparseWriter collects before a WriteAt.
+const sparseBatchSize = 1024 * 1024
+
+// SparseWriter is an io.WriteCloser that streams data into an image from a
+// starting offset, the way dd writes a device. Whole clusters that are all
+// zeros become WriteZeroAt calls rather than data, so piping a mostly empty
+// disk into an image keeps it sparse. Partial clusters at either end of the
+// stream are written as data.
+//
+// Writes are buffered: errors may only surface on a later Write or on
+// Close, which must be called to write the tail. Close does not close or
+// flush the image.
+type SparseWriter struct {
+	img *Image
+	pos int64  // Offset of the next byte written
+	buf []byte // Received part of the cluster pos is in
+
+	// At most one of a data run and a zero run is pending
+	runStart  int64
+	run       []byte
+	zeroStart int64
+	zeroLen   int64
+
+	err error
+}
+
+var _ io.WriteCloser = (*SparseWriter)(nil)
+
+// NewSparseWriter returns a SparseWriter writing to img from offset off.
+func NewSparseWriter(img *Image, off int64) *SparseWriter {
+	return &SparseWriter{img: img, pos: off}
+}
+
+// Offset returns the virtual offset the next Write continues at.
+func (w *SparseWriter) Offset() int64 {
+	return w.pos
+}
+
+// Write implements io.Writer.
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	cs := int64(w.img.clusterSize)
+	n := 0
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		take := min(int64(len(p)), cs-w.pos&int64(w.img.offsetMask))
+		w.buf = append(w.buf, p[:take]...)
+		w.pos += take
+		n += int(take)
+		p = p[take:]
+		if w.pos&int64(w.img.offsetMask) == 0 {
+			w.cluster(w.buf, w.pos-int64(len(w.buf)))
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, w.err
+}
+
+// Close writes whatever is still buffered. Later writes fail with
+// ErrClosed.
+func (w *SparseWriter) Close() error {
+	if w.err == nil && len(w.buf) > 0 {
+		w.addData(w.buf, w.pos-int64(len(w.buf)))
+		w.buf = w.buf[:0]
+	}
+	if w.err == nil {
+		w.flushZeros()
+	}
+	if w.err == nil {
+		w.flushData()
+	}
+	err := w.err
+	if err == nil {
+		w.err = ErrClosed
+	}
+	return err
+}
+
+// cluster queues data, which ends at a cluster boundary and starts at off.
+func (w *SparseWriter) cluster(data []byte, off int64) {
+	if len(data) < int(w.img.clusterSize) || !isZeroBuffer(data) {
+		w.addData(data, off)
+		return
+	}
+	w.flushData()
+	if w.zeroLen == 0 {
+		w.zeroStart = off
+	}
+	w.zeroLen += int64(len(data))
+}
+
+func (w *SparseWriter) addData(data []byte, off int64) {
+	w.flushZeros()
+	if len(w.run) == 0 {
+		w.runStart = off
+	}
+	w.run = append(w.run, data...)
+	if len(w.run) >= sparseBatchSize {
+		w.flushData()
+	}
+}
+
+func (w *SparseWriter) flushData() {
+	if w.err != nil || len(w.run) == 0 {
+		return
+	}
+	if _, err := w.img.WriteAt(w.run, w.runStart); err != nil {
+		w.err = err
+	}
+	w.run = w.run[:0]
+}
+
+func (w *SparseWriter) flushZeros() {
+	if w.err != nil || w.zeroLen == 0 {
+		return
+	}
+	if err := w.img.WriteZeroAt(w.zeroStart, w.zeroLen); err != nil {
+		w.err = err
+	}
+	w.zeroLen = 0
+}
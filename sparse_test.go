@@ -0,0 +1,75 @@
+// sparse_test.go - SparseWriter tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestSparseWriter streams data with zero runs through small, odd-sized
+// writes and checks the zero clusters stay unallocated.
+func TestSparseWriter(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "sparse.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	cs := img.ClusterSize()
+
+	// Starts mid-cluster: a data head, three zero clusters and a data
+	// cluster, then a partial cluster of zeros, which is written as data
+	const start = 1000
+	stream := make([]byte, 0, 6*cs)
+	stream = append(stream, testutil.RandomBytes(1, cs-start)...)
+	stream = append(stream, make([]byte, 3*cs)...)
+	stream = append(stream, testutil.RandomBytes(2, cs)...)
+	stream = append(stream, make([]byte, 100)...)
+
+	w := NewSparseWriter(img, start)
+	if _, err := io.CopyBuffer(w, bytes.NewReader(stream), make([]byte, 4093)); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if w.Offset() != start+int64(len(stream)) {
+		t.Errorf("Offset() = %d, want %d", w.Offset(), start+len(stream))
+	}
+	if _, err := w.Write([]byte{1}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Write after Close = %v, want ErrClosed", err)
+	}
+
+	buf := make([]byte, len(stream))
+	if _, err := img.ReadAt(buf, start); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, stream) {
+		t.Fatal("streamed data mismatch")
+	}
+
+	extents, err := img.Map(0, int64(6*cs))
+	if err != nil {
+		t.Fatalf("Map failed: %v", err)
+	}
+	want := []ExtentType{ExtentData, ExtentZero, ExtentData}
+	if len(extents) != len(want) {
+		t.Fatalf("Map = %+v, want types %v", extents, want)
+	}
+	for i, e := range extents {
+		if e.Type != want[i] {
+			t.Errorf("extent %d = %+v, want %s", i, e, want[i])
+		}
+	}
+	if extents[1].Start != uint64(cs) || extents[1].Length != uint64(3*cs) {
+		t.Errorf("zero extent = %+v, want clusters 1-3", extents[1])
+	}
+}
@@ -0,0 +1,150 @@
+package qcow2
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts the I/O an image has done since it was opened or since the
+// last ResetStats, for monitoring agents that sample it periodically.
+type Stats struct {
+	Reads       uint64 // ReadAt calls and internal scans reading guest data
+	ReadBytes   uint64 // Bytes those reads returned
+	ReadErrors  uint64 // Reads that failed, other than with io.EOF
+	Writes      uint64 // WriteAt calls
+	WriteBytes  uint64 // Bytes those writes stored
+	WriteErrors uint64 // Writes and zero writes that failed or stopped short
+	ZeroWrites  uint64 // WriteZeroAt and WriteZeroAtMode calls
+	ZeroBytes   uint64 // Bytes those calls zeroed
+	Flushes     uint64 // Flush calls
+
+	AllocatedBytes uint64 // Host bytes allocated, as reported to OnAllocate
+	COWs           uint64 // Clusters copied on write, as reported to OnCOW
+
+	// Cache counters over the same interval; Size and MaxSize are current.
+	L2Cache       CacheStats
+	RefcountCache CacheStats
+	DataCache     CacheStats
+
+	Since time.Time // Start of the interval: the open or the last ResetStats
+	Taken time.Time // When the stats were taken
+}
+
+// Interval returns how long the stats were counted over.
+func (s Stats) Interval() time.Duration {
+	return s.Taken.Sub(s.Since)
+}
+
+// ioStats holds the counters behind Stats. Each operation updates its
+// counters under a read lock and snapshots take the write lock, so a
+// snapshot never sees half of an operation, such as a read counted
+// without its bytes.
+type ioStats struct {
+	mu    sync.RWMutex
+	since time.Time
+
+	reads, readBytes, readErrors    atomic.Uint64
+	writes, writeBytes, writeErrors atomic.Uint64
+	zeroWrites, zeroBytes           atomic.Uint64
+	flushes                         atomic.Uint64
+	allocatedBytes, cows            atomic.Uint64
+}
+
+// countRead records a read that returned n bytes.
+func (s *ioStats) countRead(n int, err error) {
+	s.mu.RLock()
+	s.reads.Add(1)
+	s.readBytes.Add(uint64(n))
+	if err != nil && err != io.EOF {
+		s.readErrors.Add(1)
+	}
+	s.mu.RUnlock()
+}
+
+// countWrite records a write that stored n bytes.
+func (s *ioStats) countWrite(n int, err error) {
+	s.mu.RLock()
+	s.writes.Add(1)
+	s.writeBytes.Add(uint64(n))
+	if err != nil {
+		s.writeErrors.Add(1)
+	}
+	s.mu.RUnlock()
+}
+
+// countZero records a zero write of length bytes.
+func (s *ioStats) countZero(length int64, err error) {
+	s.mu.RLock()
+	s.zeroWrites.Add(1)
+	if err != nil {
+		s.writeErrors.Add(1)
+	} else {
+		s.zeroBytes.Add(uint64(length))
+	}
+	s.mu.RUnlock()
+}
+
+// count adds n to one counter.
+func (s *ioStats) count(c *atomic.Uint64, n uint64) {
+	s.mu.RLock()
+	c.Add(n)
+	s.mu.RUnlock()
+}
+
+// Stats returns the counters since the open or the last ResetStats. The
+// I/O counters are taken together, so each call in flight is either
+// counted in full or not at all. The cache counters are taken one by one,
+// since cache lookups do not wait for a snapshot.
+func (img *Image) Stats() Stats {
+	return img.takeStats(false)
+}
+
+// ResetStats returns the stats like Stats and starts a new interval in the
+// same step: every operation is counted in exactly one interval, however
+// it overlaps the reset. Monitoring agents can call it periodically to get
+// per-interval deltas without subtracting totals. It resets the cache
+// counters too, like ResetCacheStats.
+func (img *Image) ResetStats() Stats {
+	return img.takeStats(true)
+}
+
+func (img *Image) takeStats(reset bool) Stats {
+	s := &img.stats
+	take := func(c *atomic.Uint64) uint64 {
+		if reset {
+			return c.Swap(0)
+		}
+		return c.Load()
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	stats := Stats{
+		Reads:          take(&s.reads),
+		ReadBytes:      take(&s.readBytes),
+		ReadErrors:     take(&s.readErrors),
+		Writes:         take(&s.writes),
+		WriteBytes:     take(&s.writeBytes),
+		WriteErrors:    take(&s.writeErrors),
+		ZeroWrites:     take(&s.zeroWrites),
+		ZeroBytes:      take(&s.zeroBytes),
+		Flushes:        take(&s.flushes),
+		AllocatedBytes: take(&s.allocatedBytes),
+		COWs:           take(&s.cows),
+		Since:          s.since,
+		Taken:          now,
+	}
+	if reset {
+		s.since = now
+	}
+	s.mu.Unlock()
+
+	stats.L2Cache = img.l2Cache.takeStats(reset)
+	stats.RefcountCache = img.refcountBlockCache.takeStats(reset)
+	if img.dataCache != nil {
+		stats.DataCache = img.dataCache.cache.takeStats(reset)
+	}
+	return stats
+}
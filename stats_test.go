@@ -0,0 +1,115 @@
+// stats_test.go - I/O statistics tests
+
+package qcow2
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestStats checks each operation is counted and ResetStats starts a new
+// interval.
+func TestStats(t *testing.T) {
+	t.Parallel()
+	img, err := CreateSimple(filepath.Join(t.TempDir(), "stats.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+	cs := img.ClusterSize()
+
+	buf := make([]byte, 2*cs)
+	if _, err := img.WriteAt(buf, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.ReadAt(buf[:100], 10); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if err := img.WriteZeroAt(int64(4*cs), int64(cs)); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if _, err := img.ReadAt(buf[:1], -1); err == nil {
+		t.Fatal("ReadAt at negative offset succeeded")
+	}
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	s := img.ResetStats()
+	if s.Reads != 2 || s.ReadBytes != 100 || s.ReadErrors != 1 {
+		t.Errorf("reads: %d, %d bytes, %d errors", s.Reads, s.ReadBytes, s.ReadErrors)
+	}
+	if s.Writes != 1 || s.WriteBytes != uint64(2*cs) || s.WriteErrors != 0 {
+		t.Errorf("writes: %d, %d bytes, %d errors", s.Writes, s.WriteBytes, s.WriteErrors)
+	}
+	if s.ZeroWrites != 1 || s.ZeroBytes != uint64(cs) || s.Flushes != 1 {
+		t.Errorf("zero writes: %d, %d bytes; flushes: %d", s.ZeroWrites, s.ZeroBytes, s.Flushes)
+	}
+	if s.AllocatedBytes < uint64(2*cs) {
+		t.Errorf("AllocatedBytes = %d, want at least %d", s.AllocatedBytes, 2*cs)
+	}
+	if s.Interval() <= 0 {
+		t.Errorf("Interval = %v", s.Interval())
+	}
+
+	next := img.Stats()
+	if next.Reads != 0 || next.Writes != 0 || next.AllocatedBytes != 0 || next.L2Cache.Hits != 0 {
+		t.Errorf("stats after reset: %+v", next)
+	}
+	if !next.Since.Equal(s.Taken) {
+		t.Errorf("new interval starts %v, previous ended %v", next.Since, s.Taken)
+	}
+}
+
+// TestResetStatsConcurrent checks resets racing with reads lose no reads
+// and never split one.
+func TestResetStatsConcurrent(t *testing.T) {
+	t.Parallel()
+	img, err := CreateSimple(filepath.Join(t.TempDir(), "stats.qcow2"), 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	const readers, reads, size = 4, 2000, 512
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, size)
+			for i := 0; i < reads; i++ {
+				if _, err := img.ReadAt(buf, int64(i*size)%img.Size()); err != nil {
+					t.Errorf("ReadAt failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var total uint64
+	check := func(s Stats) {
+		if s.ReadBytes != s.Reads*size {
+			t.Fatalf("snapshot split a read: %d reads, %d bytes", s.Reads, s.ReadBytes)
+		}
+		total += s.Reads
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		check(img.ResetStats())
+	}
+	check(img.ResetStats())
+	if total != readers*reads {
+		t.Errorf("counted %d reads, want %d", total, readers*reads)
+	}
+}
@@ -0,0 +1,176 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// writeZeroExtended implements WriteZeroAtMode for extended L2 images. Whole
+// subclusters are zeroed by setting their zero bits in the L2 bitmap, so no
+// data is written and nothing is allocated. The unaligned head and tail of
+// the range are written in place when they fall in an allocated subcluster
+// of a cluster this image owns exclusively, and skipped when they already
+// read as zeros.
+func (img *Image) writeZeroExtended(off, length int64, mode ZeroMode) error {
+	for length > 0 {
+		clusterStart := uint64(off) &^ img.offsetMask
+		from := uint64(off) & img.offsetMask
+		to := img.clusterSize
+		if uint64(length) < to-from {
+			to = from + uint64(length)
+		}
+
+		if err := img.zeroSubclusters(clusterStart, from, to, mode); err != nil {
+			return err
+		}
+
+		off += int64(to - from)
+		length -= int64(to - from)
+	}
+
+	img.dirty.Store(true)
+	return nil
+}
+
+// zeroSubclusters zeroes the byte range [from, to) of the cluster at
+// virtual offset clusterStart on an extended L2 image.
+//
+// Subclusters covered entirely get their zero bit set and allocation bit
+// cleared. A fully zeroed cluster in ZeroPlain mode also drops its host
+// cluster; in ZeroAlloc mode the host cluster is kept (and allocated if
+// missing), mirroring setZeroCluster.
+func (img *Image) zeroSubclusters(clusterStart, from, to uint64, mode ZeroMode) error {
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	l2Index := (clusterStart >> img.clusterBits) & (img.l2Entries - 1)
+	l1Index := clusterStart >> (img.clusterBits + img.l2Bits)
+
+	l2TableOff, err := img.getOrAllocateL2Table(l1Index)
+	if err != nil {
+		return err
+	}
+
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	if err := img.readL2Table(l2TableOff, l2Table); err != nil {
+		return err
+	}
+
+	entryOff := l2Index * uint64(img.l2EntrySize)
+	l2Entry := binary.BigEndian.Uint64(l2Table[entryOff:])
+	bitmap := binary.BigEndian.Uint64(l2Table[entryOff+8:])
+	if l2Entry&L2EntryCompressed != 0 {
+		return fmt.Errorf("qcow2: compressed cluster at 0x%x on extended L2 image", clusterStart)
+	}
+	hostOff := l2Entry & L2EntryOffsetMask
+
+	// Unaligned edges: a subcluster can only be partly zeroed with a data
+	// write, which is possible in place but not via allocation or COW
+	sub := img.subclusterSize
+	firstFull := (from + sub - 1) / sub
+	endFull := to / sub
+	if firstFull > endFull {
+		// Range lies inside a single subcluster
+		if err := img.zeroPartialSubcluster(clusterStart, from, to, l2Entry, bitmap); err != nil {
+			return err
+		}
+		return nil
+	}
+	if head := firstFull * sub; from < head {
+		if err := img.zeroPartialSubcluster(clusterStart, from, head, l2Entry, bitmap); err != nil {
+			return err
+		}
+	}
+	if tail := endFull * sub; tail < to {
+		if err := img.zeroPartialSubcluster(clusterStart, tail, to, l2Entry, bitmap); err != nil {
+			return err
+		}
+	}
+	if firstFull == endFull {
+		return nil
+	}
+
+	// Whole subclusters: flip them to zero in the bitmap
+	mask := ((uint64(1) << (endFull - firstFull)) - 1) << firstFull
+	newBitmap := (bitmap &^ mask) | (mask << 32)
+	newEntry := l2Entry
+	var freed, allocated uint64
+
+	if mask == ExtL2AllocBitmapMask {
+		if mode == ZeroPlain && hostOff != 0 {
+			freed = hostOff
+			newEntry = 0
+		}
+		if mode == ZeroAlloc && hostOff == 0 {
+			newOff, err := img.allocateDataCluster(clusterStart)
+			if err != nil {
+				return err
+			}
+			allocated = newOff
+			newEntry = newOff | L2EntryCopied
+		}
+	}
+
+	if newEntry == l2Entry && newBitmap == bitmap {
+		return nil
+	}
+	binary.BigEndian.PutUint64(l2Table[entryOff:], newEntry)
+	binary.BigEndian.PutUint64(l2Table[entryOff+8:], newBitmap)
+
+	// Write L2 entry to disk
+	if _, err := img.file.WriteAt(l2Table[entryOff:entryOff+16], int64(l2TableOff+entryOff)); err != nil {
+		if allocated != 0 {
+			img.releaseClusters(allocated, 1)
+		}
+		return err
+	}
+	img.l2Cache.put(l2TableOff, l2Table)
+
+	// Barrier: ensure L2 update is on disk
+	if err := img.metadataBarrier(); err != nil {
+		return fmt.Errorf("qcow2: L2 zero update barrier failed: %w", err)
+	}
+
+	// The dropped cluster loses its reference only once the L2 table no
+	// longer points at it. If that fails it leaks, which is safe
+	if freed != 0 {
+		if err := img.decrementRefcount(freed); err != nil {
+			return fmt.Errorf("qcow2: failed to decrement refcount for deallocated cluster: %w", err)
+		}
+	}
+	return nil
+}
+
+// zeroPartialSubcluster zeroes [from, to) within a single subcluster of the
+// cluster at clusterStart, given that cluster's current L2 entry and bitmap.
+func (img *Image) zeroPartialSubcluster(clusterStart, from, to, l2Entry, bitmap uint64) error {
+	idx := from / img.subclusterSize
+	allocated := bitmap&(uint64(1)<<idx) != 0
+	zero := bitmap&(uint64(1)<<(32+idx)) != 0
+	hostOff := l2Entry & L2EntryOffsetMask
+
+	switch {
+	case !allocated && (zero || img.backing == nil):
+		// Already reads as zeros
+		return nil
+	case allocated && hostOff != 0 && l2Entry&L2EntryCopied != 0:
+		zeros := img.getZeroedClusterBuffer()
+		defer img.putClusterBuffer(zeros)
+		physOff := hostOff + from
+		var err error
+		if img.checksums != nil {
+			_, err = img.writeChecksummed(zeros[:to-from], physOff)
+		} else {
+			_, err = img.dataFile().WriteAt(zeros[:to-from], int64(physOff))
+		}
+		if err != nil {
+			return fmt.Errorf("qcow2: failed to zero subcluster data: %w", err)
+		}
+		img.dataWritten(physOff, to-from)
+		return nil
+	default:
+		return fmt.Errorf("qcow2: zeroing part of a subcluster at 0x%x needs allocation or COW, "+
+			"which extended L2 images do not support yet", clusterStart+from)
+	}
+}
@@ -0,0 +1,266 @@
+// subcluster_test.go - Extended L2 subcluster tests
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// createExtendedL2Image builds a 10MB extended L2 image without qemu-img:
+// cluster 0 is written as a normal image, then the header gains the
+// extended L2 feature and the cluster's entry gets a full allocation
+// bitmap. The 16-byte entry for cluster 0 overlays the old 8-byte entries
+// 0 and 1, and entry 1 was unallocated, so only the bitmap needs writing.
+func createExtendedL2Image(t *testing.T, copied bool) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "extended_l2.qcow2")
+
+	img, err := Create(path, CreateOptions{Size: 10 * 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	data := bytes.Repeat([]byte{0xab}, int(img.ClusterSize()))
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	l1Offset := int64(img.header.L1TableOffset)
+	features := img.header.IncompatibleFeatures | IncompatExtendedL2
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	defer f.Close()
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], features)
+	if _, err := f.WriteAt(buf[:], 72); err != nil {
+		t.Fatalf("patching features failed: %v", err)
+	}
+	if _, err := f.ReadAt(buf[:], l1Offset); err != nil {
+		t.Fatalf("reading L1 failed: %v", err)
+	}
+	l2Offset := int64(binary.BigEndian.Uint64(buf[:]) & L1EntryOffsetMask)
+	if !copied {
+		if _, err := f.ReadAt(buf[:], l2Offset); err != nil {
+			t.Fatalf("reading L2 failed: %v", err)
+		}
+		binary.BigEndian.PutUint64(buf[:], binary.BigEndian.Uint64(buf[:])&^L2EntryCopied)
+		if _, err := f.WriteAt(buf[:], l2Offset); err != nil {
+			t.Fatalf("clearing COPIED failed: %v", err)
+		}
+	}
+	binary.BigEndian.PutUint64(buf[:], ExtL2AllocBitmapMask)
+	if _, err := f.WriteAt(buf[:], l2Offset+8); err != nil {
+		t.Fatalf("writing bitmap failed: %v", err)
+	}
+
+	return path, data
+}
+
+// extendedL2Entry returns the L2 entry and subcluster bitmap for virtOff.
+func extendedL2Entry(t *testing.T, img *Image, virtOff uint64) (uint64, uint64) {
+	t.Helper()
+	l1Index := virtOff >> (img.clusterBits + img.l2Bits)
+	l2Index := (virtOff >> img.clusterBits) & (img.l2Entries - 1)
+	l2Offset := binary.BigEndian.Uint64(img.l1Table[l1Index*8:]) & L1EntryOffsetMask
+	if l2Offset == 0 {
+		return 0, 0
+	}
+	table, err := img.getL2Table(l2Offset)
+	if err != nil {
+		t.Fatalf("getL2Table failed: %v", err)
+	}
+	return binary.BigEndian.Uint64(table[l2Index*16:]), binary.BigEndian.Uint64(table[l2Index*16+8:])
+}
+
+func TestWriteZeroAtSubclusters(t *testing.T) {
+	t.Parallel()
+	path, data := createExtendedL2Image(t, true)
+
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if !img.extendedL2 {
+		t.Fatal("Expected extended L2 image")
+	}
+	sub := int64(img.subclusterSize)
+	entryBefore, _ := extendedL2Entry(t, img, 0)
+
+	// Subclusters 2-4 exactly
+	if err := img.WriteZeroAt(2*sub, 3*sub); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	// Mid-subcluster head and tail around subcluster 9
+	if err := img.WriteZeroAt(8*sub+100, sub+200); err != nil {
+		t.Fatalf("unaligned WriteZeroAt failed: %v", err)
+	}
+
+	entry, bitmap := extendedL2Entry(t, img, 0)
+	if entry != entryBefore {
+		t.Errorf("L2 entry changed: 0x%x -> 0x%x", entryBefore, entry)
+	}
+	wantZero := uint64(0b11100) << 32
+	if bitmap&ExtL2ZeroBitmapMask != wantZero {
+		t.Errorf("zero bitmap = 0x%x, want 0x%x", bitmap&ExtL2ZeroBitmapMask, wantZero)
+	}
+	if bitmap&0b11100 != 0 {
+		t.Errorf("alloc bits for zeroed subclusters still set: 0x%x", bitmap)
+	}
+	// Subclusters 8 and 9 were zeroed in place and stay allocated
+	if bitmap&(0b11<<8) != 0b11<<8 {
+		t.Errorf("partially zeroed subclusters lost allocation: 0x%x", bitmap)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer img.Close()
+
+	want := append([]byte(nil), data...)
+	clear(want[2*sub : 5*sub])
+	clear(want[8*sub+100 : 9*sub+300])
+	got := make([]byte, len(data))
+	if _, err := img.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Data mismatch after subcluster zeroing")
+	}
+}
+
+func TestWriteZeroAtSubclustersWholeCluster(t *testing.T) {
+	t.Parallel()
+
+	t.Run("plain", func(t *testing.T) {
+		t.Parallel()
+		path, _ := createExtendedL2Image(t, true)
+		img, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer img.Close()
+
+		entry, _ := extendedL2Entry(t, img, 0)
+		host := entry & L2EntryOffsetMask
+		if err := img.WriteZeroAt(0, int64(img.ClusterSize())); err != nil {
+			t.Fatalf("WriteZeroAt failed: %v", err)
+		}
+
+		entry, bitmap := extendedL2Entry(t, img, 0)
+		if entry != 0 || bitmap != ExtL2ZeroBitmapMask {
+			t.Errorf("entry = 0x%x bitmap = 0x%x, want 0 and 0x%x", entry, bitmap, ExtL2ZeroBitmapMask)
+		}
+		if rc, err := img.ClusterRefcount(host); err != nil || rc != 0 {
+			t.Errorf("host cluster refcount = %d (%v), want 0", rc, err)
+		}
+	})
+
+	// A failure at any write leaves the host cluster referenced for as long
+	// as the L2 entry points at it; at worst it leaks
+	t.Run("plain failing", func(t *testing.T) {
+		t.Parallel()
+		for failAt := uint64(1); failAt <= 3; failAt++ {
+			path, _ := createExtendedL2Image(t, true)
+			img, ff := openFaulty(t, path)
+			before, _ := extendedL2Entry(t, img, 0)
+			ff.SetConfig(testutil.FaultConfig{Write: testutil.FaultProfile{FailAt: failAt}})
+			err := img.WriteZeroAt(0, int64(img.ClusterSize()))
+			ff.SetConfig(testutil.FaultConfig{})
+			if err == nil && ff.Faults(testutil.OpWrite) > 0 {
+				t.Errorf("write %d failed but WriteZeroAt succeeded", failAt)
+			}
+			if entry, _ := extendedL2Entry(t, img, 0); entry != 0 {
+				rc, err := img.ClusterRefcount(before & L2EntryOffsetMask)
+				if err != nil || rc == 0 {
+					t.Errorf("write %d failing: mapped host cluster has refcount %d (%v)", failAt, rc, err)
+				}
+			}
+			img.Close()
+		}
+	})
+
+	t.Run("alloc", func(t *testing.T) {
+		t.Parallel()
+		path, _ := createExtendedL2Image(t, true)
+		img, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		defer img.Close()
+
+		before, _ := extendedL2Entry(t, img, 0)
+		if err := img.WriteZeroAtMode(0, int64(img.ClusterSize()), ZeroAlloc); err != nil {
+			t.Fatalf("WriteZeroAtMode failed: %v", err)
+		}
+
+		entry, bitmap := extendedL2Entry(t, img, 0)
+		if entry != before || bitmap != ExtL2ZeroBitmapMask {
+			t.Errorf("entry = 0x%x bitmap = 0x%x, want 0x%x and 0x%x", entry, bitmap, before, ExtL2ZeroBitmapMask)
+		}
+		buf := make([]byte, img.ClusterSize())
+		if _, err := img.ReadAt(buf, 0); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(buf, make([]byte, len(buf))) {
+			t.Error("Zeroed cluster does not read as zeros")
+		}
+	})
+}
+
+func TestWriteZeroAtSubclustersUnallocated(t *testing.T) {
+	t.Parallel()
+	path, _ := createExtendedL2Image(t, true)
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	// The unaligned edges already read as zeros without a backing file
+	cs := int64(img.ClusterSize())
+	sub := int64(img.subclusterSize)
+	if err := img.WriteZeroAt(3*cs+10, 2*sub); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	entry, bitmap := extendedL2Entry(t, img, uint64(3*cs))
+	if entry != 0 || bitmap != uint64(1)<<33 {
+		t.Errorf("entry = 0x%x bitmap = 0x%x, want 0 and 0x%x", entry, bitmap, uint64(1)<<33)
+	}
+}
+
+func TestWriteZeroAtSubclustersShared(t *testing.T) {
+	t.Parallel()
+	path, _ := createExtendedL2Image(t, false)
+	img, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+
+	// Partial subclusters of a cluster without COPIED would need COW
+	if err := img.WriteZeroAt(100, 100); err == nil {
+		t.Error("partial subcluster zeroing of a shared cluster should fail")
+	}
+
+	// Whole subclusters only touch the L2 bitmap
+	sub := int64(img.subclusterSize)
+	if err := img.WriteZeroAt(sub, sub); err != nil {
+		t.Fatalf("WriteZeroAt failed: %v", err)
+	}
+	if _, bitmap := extendedL2Entry(t, img, 0); bitmap&(uint64(1)<<33) == 0 {
+		t.Errorf("zero bit not set: 0x%x", bitmap)
+	}
+}
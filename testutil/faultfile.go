@@ -0,0 +1,184 @@
+package testutil
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the default error returned by injected faults.
+var ErrInjected = errors.New("testutil: injected fault")
+
+// File matches the host file interface used by qcow2.Image (qcow2.File),
+// so a FaultFile can be returned from a qcow2.WithFileWrapper function.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Name() string
+}
+
+// FaultOp identifies the operation type a fault profile applies to.
+type FaultOp int
+
+// Operation types.
+const (
+	OpRead FaultOp = iota
+	OpWrite
+	OpSync
+	OpTruncate
+	numFaultOps
+)
+
+// FaultProfile describes the misbehavior injected into one operation type.
+type FaultProfile struct {
+	// Latency is added before every call; Jitter adds a uniformly random
+	// extra delay in [0, Jitter).
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// ErrorRate is the probability (0 to 1) that a call fails with Err
+	// (ErrInjected if nil) without reaching the underlying file.
+	ErrorRate float64
+	Err       error
+
+	// FailAt, if non-zero, also fails the FailAt-th call (counting from 1)
+	// made after the profile was set, so a test can step a fault through
+	// every call of an operation in turn.
+	FailAt uint64
+}
+
+// FaultConfig holds the fault profiles of a FaultFile.
+type FaultConfig struct {
+	Read     FaultProfile
+	Write    FaultProfile
+	Sync     FaultProfile
+	Truncate FaultProfile
+
+	// Seed makes error injection reproducible.
+	Seed int64
+}
+
+// FaultFile wraps a File and injects latency and errors per operation
+// type, for testing timeout and retry logic against misbehaving storage.
+// Stat, Name, and Close are passed through unchanged.
+type FaultFile struct {
+	File
+
+	mu     sync.Mutex
+	cfg    FaultConfig
+	rng    *rand.Rand
+	calls  [numFaultOps]uint64
+	faults [numFaultOps]uint64
+	since  [numFaultOps]uint64 // calls counted toward FailAt
+}
+
+// NewFaultFile wraps f with the given fault configuration.
+func NewFaultFile(f File, cfg FaultConfig) *FaultFile {
+	return &FaultFile{File: f, cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+// SetConfig replaces the fault configuration, e.g. to start injecting
+// faults only after an image has been opened.
+func (f *FaultFile) SetConfig(cfg FaultConfig) {
+	f.mu.Lock()
+	f.cfg = cfg
+	f.rng = rand.New(rand.NewSource(cfg.Seed))
+	f.since = [numFaultOps]uint64{}
+	f.mu.Unlock()
+}
+
+// Calls returns how many times the operation was called.
+func (f *FaultFile) Calls(op FaultOp) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// Faults returns how many calls of the operation failed with an injected
+// error.
+func (f *FaultFile) Faults(op FaultOp) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.faults[op]
+}
+
+// inject applies the profile for op and returns the error to fail with, if
+// any.
+func (f *FaultFile) inject(op FaultOp) error {
+	f.mu.Lock()
+	var p FaultProfile
+	switch op {
+	case OpRead:
+		p = f.cfg.Read
+	case OpWrite:
+		p = f.cfg.Write
+	case OpSync:
+		p = f.cfg.Sync
+	case OpTruncate:
+		p = f.cfg.Truncate
+	}
+	delay := p.Latency
+	if p.Jitter > 0 {
+		delay += time.Duration(f.rng.Int63n(int64(p.Jitter)))
+	}
+	fail := p.ErrorRate > 0 && f.rng.Float64() < p.ErrorRate
+	f.since[op]++
+	if p.FailAt != 0 && f.since[op] == p.FailAt {
+		fail = true
+	}
+	f.calls[op]++
+	if fail {
+		f.faults[op]++
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if !fail {
+		return nil
+	}
+	if p.Err != nil {
+		return p.Err
+	}
+	return ErrInjected
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *FaultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.inject(OpRead); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+// WriteAt implements io.WriterAt.
+func (f *FaultFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.inject(OpWrite); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// Sync commits the file to stable storage.
+func (f *FaultFile) Sync() error {
+	if err := f.inject(OpSync); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+// Truncate changes the size of the file.
+func (f *FaultFile) Truncate(size int64) error {
+	if err := f.inject(OpTruncate); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
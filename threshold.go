@@ -0,0 +1,42 @@
+package qcow2
+
+// writeThreshold is an armed write threshold.
+type writeThreshold struct {
+	limit uint64
+	fn    func(size uint64)
+}
+
+// SetWriteThreshold arms a one-shot notification: the first time an
+// allocation grows the image file (or the external data file) past
+// threshold bytes, fn is called with the new file size. Like QEMU's
+// BLOCK_WRITE_THRESHOLD event, the threshold is disarmed once it fires and
+// must be set again to get another notification.
+//
+// fn runs on its own goroutine so it may call back into the image. A
+// threshold of 0 or a nil fn disarms any pending threshold.
+func (img *Image) SetWriteThreshold(threshold uint64, fn func(size uint64)) {
+	if threshold == 0 || fn == nil {
+		img.writeThreshold.Store(nil)
+		return
+	}
+	img.writeThreshold.Store(&writeThreshold{limit: threshold, fn: fn})
+}
+
+// WriteThreshold returns the armed write threshold, or 0 if none is armed.
+func (img *Image) WriteThreshold() uint64 {
+	if t := img.writeThreshold.Load(); t != nil {
+		return t.limit
+	}
+	return 0
+}
+
+// fileGrew is called after an allocation extends a file to size bytes.
+func (img *Image) fileGrew(size uint64) {
+	t := img.writeThreshold.Load()
+	if t == nil || size <= t.limit {
+		return
+	}
+	if img.writeThreshold.CompareAndSwap(t, nil) {
+		go t.fn(size)
+	}
+}
@@ -0,0 +1,68 @@
+// threshold_test.go - Write threshold notification tests
+
+package qcow2
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-qcow2/testutil"
+)
+
+// TestWriteThresholdFiresOnce verifies the callback fires once when the
+// file grows past the threshold and the threshold is then disarmed.
+func TestWriteThresholdFiresOnce(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "threshold.qcow2")
+
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	start := uint64(testutil.FileSize(t, path))
+	threshold := start + 4*uint64(img.ClusterSize())
+
+	fired := make(chan uint64, 4)
+	img.SetWriteThreshold(threshold, func(size uint64) { fired <- size })
+	if img.WriteThreshold() != threshold {
+		t.Errorf("WriteThreshold = %d, want %d", img.WriteThreshold(), threshold)
+	}
+
+	// Stays under the threshold
+	if _, err := img.WriteAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	select {
+	case size := <-fired:
+		t.Fatalf("threshold fired early at %d", size)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Crosses it, twice
+	data := testutil.RandomBytes(1, 8*img.ClusterSize())
+	for _, off := range []int64{1024 * 1024, 8 * 1024 * 1024} {
+		if _, err := img.WriteAt(data, off); err != nil {
+			t.Fatalf("WriteAt failed: %v", err)
+		}
+	}
+
+	select {
+	case size := <-fired:
+		if size <= threshold {
+			t.Errorf("callback size %d not past threshold %d", size, threshold)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("threshold did not fire")
+	}
+	select {
+	case <-fired:
+		t.Error("threshold fired more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if img.WriteThreshold() != 0 {
+		t.Errorf("WriteThreshold after firing = %d, want 0", img.WriteThreshold())
+	}
+}
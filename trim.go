@@ -0,0 +1,64 @@
+package qcow2
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TrimTail truncates the image file after its last cluster in use, so
+// clusters freed at the end of the image (by discards, deleted snapshots
+// or a rebuild) give their space back to the host. It returns the number
+// of bytes removed. Free clusters in the middle of the file are left for
+// reuse; see WithClusterReusePolicy.
+//
+// Clusters count as in use if their refcount is nonzero or any table of
+// the image or its snapshots points at them. Images with lazy refcounts
+// are left alone, since their refcounts do not cover every allocation. An
+// external data file is never truncated.
+func (img *Image) TrimTail() (int64, error) {
+	if img.readOnly {
+		return 0, ErrReadOnly
+	}
+	if img.closed.Load() {
+		return 0, ErrClosed
+	}
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+	return img.trimTailLocked()
+}
+
+// trimTailLocked is TrimTail for callers holding writeMu.
+func (img *Image) trimTailLocked() (int64, error) {
+	if img.lazyRefcounts {
+		return 0, nil
+	}
+	// Buffered allocations and refcounts must be on disk to be counted
+	if err := img.flushLocked(); err != nil {
+		return 0, err
+	}
+
+	end, err := img.allocatedEnd()
+	if err != nil {
+		return 0, err
+	}
+	info, err := img.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("qcow2: failed to stat file: %w", err)
+	}
+	size := info.Size()
+	if size <= int64(end) {
+		return 0, nil
+	}
+	if err := img.file.Truncate(int64(end)); err != nil {
+		return 0, fmt.Errorf("qcow2: failed to truncate file: %w", err)
+	}
+
+	// The free cluster bitmap still lists the clusters cut off
+	img.freeBitmap = nil
+	img.freeBitmapOnce = sync.Once{}
+
+	if err := img.file.Sync(); err != nil {
+		return 0, fmt.Errorf("qcow2: failed to sync file: %w", err)
+	}
+	return size - int64(end), nil
+}
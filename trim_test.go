@@ -0,0 +1,107 @@
+// trim_test.go - Tail truncation tests
+
+package qcow2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTrimTail checks discarding the last data clusters lets TrimTail
+// shrink the file without losing the data before them.
+func TestTrimTail(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "trim.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	keep := bytes.Repeat([]byte{0x11}, cs)
+	if _, err := img.WriteAt(keep, 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0x22}, 8*cs), int64(cs)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := img.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	before, _ := os.Stat(path)
+
+	if n, err := img.TrimTail(); err != nil || n != 0 {
+		t.Errorf("TrimTail with nothing free = %d, %v; want 0, nil", n, err)
+	}
+	if err := img.WriteZeroAtMode(int64(cs), int64(8*cs), ZeroPlain); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+	n, err := img.TrimTail()
+	if err != nil {
+		t.Fatalf("TrimTail failed: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if n != int64(8*cs) || after.Size() != before.Size()-n {
+		t.Errorf("TrimTail removed %d bytes, file went from %d to %d; want %d removed", n, before.Size(), after.Size(), 8*cs)
+	}
+
+	// Allocation carries on from the new end
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0x33}, cs), int64(2*cs)); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	result, err := img.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.IsClean() {
+		t.Errorf("image not clean after trim: %+v", result)
+	}
+	buf := make([]byte, cs)
+	if _, err := img.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, keep) {
+		t.Errorf("data before the trimmed tail lost: %v", err)
+	}
+	if _, err := img.ReadAt(buf, int64(2*cs)); err != nil || buf[0] != 0x33 {
+		t.Errorf("data written after trim lost: %v", err)
+	}
+}
+
+// TestTrimTailOnClose checks WithTrimTailOnClose trims the file on Close.
+func TestTrimTailOnClose(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "trim.qcow2")
+
+	img, err := CreateSimple(path, 4*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	cs := img.ClusterSize()
+	if _, err := img.WriteAt(bytes.Repeat([]byte{0x22}, 4*cs), 0); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	img.Close()
+	full, _ := os.Stat(path)
+
+	img, err = OpenFile(path, os.O_RDWR, 0, WithTrimTailOnClose())
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if err := img.WriteZeroAtMode(int64(2*cs), int64(2*cs), ZeroPlain); err != nil {
+		t.Fatalf("WriteZeroAtMode failed: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	trimmed, _ := os.Stat(path)
+	if trimmed.Size() != full.Size()-int64(2*cs) {
+		t.Errorf("file size after close = %d, want %d", trimmed.Size(), full.Size()-int64(2*cs))
+	}
+}
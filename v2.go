@@ -0,0 +1,263 @@
+package qcow2
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"os"
+	"time"
+)
+
+// The package has two API versions that live side by side:
+//
+//   - Version 1 is Open, OpenFile and the With* functional options, which
+//     return the concrete *Image. It keeps working unchanged, but *Image
+//     gains methods as features land.
+//   - Version 2 is OpenWithOptions, configured by an OpenOptionsV2 struct
+//     and returning the ImageV2 interface. New open-time features become new
+//     OpenOptionsV2 fields whose zero value keeps the old behavior, and the
+//     interface only grows with context-aware methods for new operations, so
+//     code written against version 2 keeps compiling and behaving the same.
+//
+// A change that cannot be made that way goes into an OpenOptionsV3 and
+// ImageV3, next to version 2 rather than in place of it.
+
+// ImageV2 is the stable interface to an open image. *Image implements it.
+type ImageV2 interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	// ReadAtContext, WriteAtContext and FlushContext are ReadAt, WriteAt
+	// and Flush that do not start once ctx is done, returning ctx.Err().
+	// An operation already running is not interrupted. They run at the
+	// priority ctx carries (WithPriority).
+	ReadAtContext(ctx context.Context, p []byte, off int64) (int, error)
+	WriteAtContext(ctx context.Context, p []byte, off int64) (int, error)
+	FlushContext(ctx context.Context) error
+
+	// Flush writes buffered data and metadata to stable storage.
+	Flush() error
+
+	// WriteZeroAtMode zeroes [off, off+length) using mode.
+	WriteZeroAtMode(off, length int64, mode ZeroMode) error
+
+	// Map returns the allocation map for [off, off+length).
+	Map(off, length int64) ([]Extent, error)
+
+	// Size is the virtual size and ClusterSize the cluster size in bytes.
+	Size() int64
+	ClusterSize() int
+
+	// Closed reports whether Close has been called.
+	Closed() bool
+}
+
+var _ ImageV2 = (*Image)(nil)
+
+// OpenOptionsV2 configures OpenWithOptions. The zero value opens the image
+// read-write with the same defaults as Open. Each field matches the With*
+// option named in its comment.
+type OpenOptionsV2 struct {
+	// ReadOnly opens the file read-only (WithReadOnly).
+	ReadOnly bool
+
+	// Cache sizes; 0 keeps the default (WithL2CacheSize,
+	// WithL2CacheShards, WithCompressedCacheSize, WithRefcountCacheSize,
+	// WithDataCacheSize).
+	L2CacheSize         int
+	L2CacheShards       int
+	CompressedCacheSize int
+	RefcountCacheSize   int
+	DataCacheSize       int
+
+	// NoL2Cache, NoCompressedCache and NoRefcountCache disable those
+	// caches, as a size of 0 does for the With* options.
+	NoL2Cache         bool
+	NoCompressedCache bool
+	NoRefcountCache   bool
+
+	// Allocation behavior (WithClusterReusePolicy, WithRefcountWriteback,
+	// WithDelayedAllocation, WithMaxAllocation).
+	ReusePolicy       ClusterReusePolicy
+	RefcountWriteback bool
+	DelayedAllocation uint64
+	MaxAllocation     uint64
+
+	// Sidecar files; empty disables them (WithChecksumFile,
+	// WithMetadataChecksumFile).
+	ChecksumFile         string
+	MetadataChecksumFile string
+
+	// I/O (WithFileWrapper, WithIORetry, WithAlignedIO, WithMmap,
+	// WithWriterGoroutine, WithWriteRangeLocking).
+	FileWrapper       func(File) File
+	IORetry           *IORetryPolicy
+	AlignedIO         int
+	Mmap              bool
+	WriterGoroutine   bool
+	WriteRangeLocking bool
+
+	// PriorityScheduling holds background requests behind guest I/O for
+	// at most PriorityMaxWait (WithPriorityScheduling).
+	PriorityScheduling bool
+	PriorityMaxWait    time.Duration
+
+	// Events holds allocation callbacks (WithEvents).
+	Events Events
+
+	// TrimTailOnClose truncates free clusters at the end of the file on
+	// Close (WithTrimTailOnClose).
+	TrimTailOnClose bool
+
+	// LazyL1 reads the L1 table as lookups reach it (WithLazyL1).
+	LazyL1 bool
+
+	// AutoGrow lets writes past the end grow the virtual size up to
+	// AutoGrowMax bytes (WithAutoGrow).
+	AutoGrow    bool
+	AutoGrowMax uint64
+
+	// FileAdvice is passed to the host for the image's files
+	// (WithFileAdvice).
+	FileAdvice FileAdvice
+
+	// RefcountVerifier starts a background refcount verifier
+	// (WithRefcountVerifier).
+	RefcountVerifier *RefcountVerifierOptions
+
+	// Backing files (WithBackingStore, WithBackingRetry).
+	BackingStore BackingStore
+	BackingRetry *BackingRetryPolicy
+
+	// Encryption keys (WithKeyProvider, WithLUKSPasswords).
+	KeyProvider   KeyProvider
+	LUKSPasswords map[string]string
+
+	// Format limits (WithCompatLevel, WithZstdFrameSize).
+	Compat        CompatLevel
+	ZstdFrameSize int
+
+	// MaxVirtualSize is the largest virtual size accepted; 0 keeps
+	// DefaultMaxVirtualSize and NoVirtualSizeLimit removes the limit
+	// (WithMaxVirtualSize).
+	MaxVirtualSize     uint64
+	NoVirtualSizeLimit bool
+
+	// Signature, if set, is verified with SignatureKey before the open
+	// succeeds (WithSignature).
+	Signature    *Signature
+	SignatureKey ed25519.PublicKey
+
+	// Stats, if set, receives the time spent in each phase of the open
+	// (Image.OpenStats).
+	Stats *OpenStats
+
+	// Extra holds functional options applied after the fields above.
+	Extra []Option
+}
+
+// options converts o to functional options.
+func (o *OpenOptionsV2) options() []Option {
+	var opts []Option
+	add := func(set bool, opt Option) {
+		if set {
+			opts = append(opts, opt)
+		}
+	}
+	add(o.ReadOnly, WithReadOnly())
+	add(o.L2CacheSize > 0, WithL2CacheSize(o.L2CacheSize))
+	add(o.L2CacheShards > 0, WithL2CacheShards(o.L2CacheShards))
+	add(o.CompressedCacheSize > 0, WithCompressedCacheSize(o.CompressedCacheSize))
+	add(o.RefcountCacheSize > 0, WithRefcountCacheSize(o.RefcountCacheSize))
+	add(o.DataCacheSize > 0, WithDataCacheSize(o.DataCacheSize))
+	add(o.NoL2Cache, WithL2CacheSize(0))
+	add(o.NoCompressedCache, WithCompressedCacheSize(0))
+	add(o.NoRefcountCache, WithRefcountCacheSize(0))
+	add(o.ReusePolicy != ReuseFirstFit, WithClusterReusePolicy(o.ReusePolicy))
+	add(o.RefcountWriteback, WithRefcountWriteback())
+	add(o.DelayedAllocation > 0, WithDelayedAllocation(o.DelayedAllocation))
+	add(o.MaxAllocation > 0, WithMaxAllocation(o.MaxAllocation))
+	add(o.ChecksumFile != "", WithChecksumFile(o.ChecksumFile))
+	add(o.MetadataChecksumFile != "", WithMetadataChecksumFile(o.MetadataChecksumFile))
+	add(o.FileWrapper != nil, WithFileWrapper(o.FileWrapper))
+	if o.IORetry != nil {
+		opts = append(opts, WithIORetry(*o.IORetry))
+	}
+	add(o.AlignedIO > 0, WithAlignedIO(o.AlignedIO))
+	add(o.Mmap, WithMmap())
+	add(o.WriterGoroutine, WithWriterGoroutine())
+	add(o.WriteRangeLocking, WithWriteRangeLocking())
+	add(o.PriorityScheduling, WithPriorityScheduling(o.PriorityMaxWait))
+	add(o.Events.OnAllocate != nil || o.Events.OnFileGrow != nil || o.Events.OnCOW != nil, WithEvents(o.Events))
+	add(o.TrimTailOnClose, WithTrimTailOnClose())
+	add(o.LazyL1, WithLazyL1())
+	add(o.AutoGrow, WithAutoGrow(o.AutoGrowMax))
+	add(o.FileAdvice != AdviceNormal, WithFileAdvice(o.FileAdvice))
+	if o.RefcountVerifier != nil {
+		opts = append(opts, WithRefcountVerifier(*o.RefcountVerifier))
+	}
+	add(o.BackingStore != nil, WithBackingStore(o.BackingStore))
+	if o.BackingRetry != nil {
+		opts = append(opts, WithBackingRetry(*o.BackingRetry))
+	}
+	add(o.KeyProvider != nil, WithKeyProvider(o.KeyProvider))
+	add(o.LUKSPasswords != nil, WithLUKSPasswords(o.LUKSPasswords))
+	add(o.Compat != CompatAny, WithCompatLevel(o.Compat))
+	add(o.ZstdFrameSize > 0, WithZstdFrameSize(o.ZstdFrameSize))
+	add(o.MaxVirtualSize > 0, WithMaxVirtualSize(o.MaxVirtualSize))
+	add(o.NoVirtualSizeLimit, WithMaxVirtualSize(0))
+	add(o.Signature != nil, WithSignature(o.Signature, o.SignatureKey))
+	return append(opts, o.Extra...)
+}
+
+// OpenWithOptions opens an existing image through the version 2 API.
+func OpenWithOptions(path string, opts OpenOptionsV2) (ImageV2, error) {
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	img, err := OpenFile(path, flag, 0, opts.options()...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Stats != nil {
+		*opts.Stats = img.OpenStats()
+	}
+	return img, nil
+}
+
+// ReadAtContext is ReadAt that does not start once ctx is done. It runs at
+// the priority ctx carries; see WithPriority.
+func (img *Image) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	background, err := img.waitTurn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if background {
+		return img.readUntracked(p, off)
+	}
+	return img.ReadAt(p, off)
+}
+
+// WriteAtContext is WriteAt that does not start once ctx is done. It runs
+// at the priority ctx carries; see WithPriority.
+func (img *Image) WriteAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	background, err := img.waitTurn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if background {
+		return img.writeUntracked(p, off)
+	}
+	return img.WriteAt(p, off)
+}
+
+// FlushContext is Flush that does not start once ctx is done. A background
+// flush waits for guest I/O to drain first; see WithPriority.
+func (img *Image) FlushContext(ctx context.Context) error {
+	if _, err := img.waitTurn(ctx); err != nil {
+		return err
+	}
+	return img.Flush()
+}
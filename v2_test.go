@@ -0,0 +1,61 @@
+// v2_test.go - Version 2 API tests
+
+package qcow2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenWithOptionsV2 verifies the struct options reach the image and the
+// context-aware methods refuse to start once the context is done.
+func TestOpenWithOptionsV2(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "v2.qcow2")
+	img, err := CreateSimple(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	v2, err := OpenWithOptions(path, OpenOptionsV2{L2CacheShards: 2, WriterGoroutine: true})
+	if err != nil {
+		t.Fatalf("OpenWithOptions failed: %v", err)
+	}
+	if got := len(v2.(*Image).l2Cache.shards); got != 2 {
+		t.Errorf("L2 cache shards = %d, want 2", got)
+	}
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	if _, err := v2.WriteAtContext(ctx, data, 0); err != nil {
+		t.Fatalf("WriteAtContext failed: %v", err)
+	}
+	if err := v2.FlushContext(ctx); err != nil {
+		t.Fatalf("FlushContext failed: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := v2.WriteAtContext(canceled, data, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("WriteAtContext with canceled context: got %v, want context.Canceled", err)
+	}
+	if err := v2.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ro, err := OpenWithOptions(path, OpenOptionsV2{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("OpenWithOptions read-only failed: %v", err)
+	}
+	defer ro.Close()
+	got := make([]byte, len(data))
+	if _, err := ro.ReadAtContext(ctx, got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadAtContext = %v, data match %v", err, bytes.Equal(got, data))
+	}
+	if _, err := ro.WriteAt(data, 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("WriteAt on read-only image: got %v, want ErrReadOnly", err)
+	}
+}
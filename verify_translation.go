@@ -0,0 +1,129 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// TranslationReport compares how the open image maps one virtual offset,
+// through its in-memory L1 table and L2 cache, with the mapping a fresh
+// open would derive from the file.
+type TranslationReport struct {
+	VirtualOffset uint64 // Virtual offset that was checked
+
+	CachedL1TableOffset uint64 // L1 table offset the image uses
+	DiskL1TableOffset   uint64 // L1 table offset in the header on disk
+	CachedL1Entry       uint64 // Entry of the in-memory L1 table
+	DiskL1Entry         uint64 // Entry of the L1 table on disk
+
+	// L2Cached is whether the L2 table was in the L2 cache. Without it
+	// CachedL2Entry is unset: the next lookup reads the table from disk.
+	L2Cached      bool
+	CachedL2Entry []byte // Raw cached L2 entry (16 bytes with extended L2)
+	DiskL2Entry   []byte // Raw L2 entry on disk, nil without an L2 table
+
+	// Mismatches describes each difference found; empty when consistent.
+	Mismatches []string
+}
+
+// Consistent reports whether the cached and on-disk mappings agree.
+func (r *TranslationReport) Consistent() bool {
+	return len(r.Mismatches) == 0
+}
+
+// VerifyTranslation re-reads the header, L1 entry and L2 entry for virtOff
+// straight from the image file, bypassing every cache, and compares them
+// with the state the image translates through. It is a diagnostic for
+// cache coherency problems, for example in embedders that write the file
+// behind the image's back. Writes are held off while it runs, so an
+// update in flight does not show up as a difference.
+//
+// The report is returned whenever the file could be read. If the mappings
+// differ, the error wraps ErrTranslationMismatch and lists the differences.
+func (img *Image) VerifyTranslation(virtOff uint64) (*TranslationReport, error) {
+	if img.closed.Load() {
+		return nil, ErrClosed
+	}
+	if virtOff >= uint64(img.Size()) {
+		return nil, ErrOffsetOutOfRange
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	report := &TranslationReport{VirtualOffset: virtOff}
+	l2Index := (virtOff >> img.clusterBits) & (img.l2Entries - 1)
+	l1Index := virtOff >> (img.clusterBits + img.l2Bits)
+
+	// L1 size (offset 36) and L1 table offset (offset 40) from the header
+	var hdr [12]byte
+	if _, err := img.file.ReadAt(hdr[:], 36); err != nil {
+		return nil, fmt.Errorf("qcow2: failed to read header: %w", err)
+	}
+	diskL1Size := uint64(binary.BigEndian.Uint32(hdr[0:4]))
+	report.DiskL1TableOffset = binary.BigEndian.Uint64(hdr[4:12])
+
+	if err := img.faultL1(l1Index); err != nil {
+		return nil, err
+	}
+	img.l1Mu.RLock()
+	report.CachedL1TableOffset = img.header.L1TableOffset
+	if l1Index < uint64(len(img.l1Table))/8 {
+		report.CachedL1Entry = binary.BigEndian.Uint64(img.l1Table[l1Index*8:])
+	}
+	img.l1Mu.RUnlock()
+
+	if l1Index < diskL1Size {
+		var raw [8]byte
+		if _, err := img.file.ReadAt(raw[:], int64(report.DiskL1TableOffset+l1Index*8)); err != nil {
+			return nil, fmt.Errorf("qcow2: failed to read L1 entry: %w", err)
+		}
+		report.DiskL1Entry = binary.BigEndian.Uint64(raw[:])
+	}
+
+	if report.CachedL1TableOffset != report.DiskL1TableOffset {
+		report.mismatch("L1 table offset: cached %#x, on disk %#x",
+			report.CachedL1TableOffset, report.DiskL1TableOffset)
+	}
+	if report.CachedL1Entry != report.DiskL1Entry {
+		report.mismatch("L1 entry %d: cached %#x, on disk %#x",
+			l1Index, report.CachedL1Entry, report.DiskL1Entry)
+	}
+
+	entryOffset := l2Index * uint64(img.l2EntrySize)
+	if l2Off := report.DiskL1Entry & L1EntryOffsetMask; l2Off != 0 {
+		report.DiskL2Entry = make([]byte, img.l2EntrySize)
+		if _, err := img.file.ReadAt(report.DiskL2Entry, int64(l2Off+entryOffset)); err != nil {
+			return nil, fmt.Errorf("qcow2: failed to read L2 entry: %w", err)
+		}
+	}
+	if l2Off := report.CachedL1Entry & L1EntryOffsetMask; l2Off != 0 {
+		entry := make([]byte, img.l2EntrySize)
+		if img.l2Cache.readAt(l2Off, entry, entryOffset) {
+			report.L2Cached = true
+			report.CachedL2Entry = entry
+		}
+	}
+
+	if report.L2Cached {
+		disk := report.DiskL2Entry
+		if disk == nil {
+			disk = make([]byte, img.l2EntrySize)
+		}
+		if string(report.CachedL2Entry) != string(disk) {
+			report.mismatch("L2 entry %d: cached %x, on disk %x",
+				l2Index, report.CachedL2Entry, disk)
+		}
+	}
+
+	if !report.Consistent() {
+		return report, fmt.Errorf("%w at virtual offset %#x: %s",
+			ErrTranslationMismatch, virtOff, strings.Join(report.Mismatches, "; "))
+	}
+	return report, nil
+}
+
+func (r *TranslationReport) mismatch(format string, args ...any) {
+	r.Mismatches = append(r.Mismatches, fmt.Sprintf(format, args...))
+}
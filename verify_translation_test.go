@@ -0,0 +1,74 @@
+// verify_translation_test.go - Translation self-test tests
+
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerifyTranslation checks a clean image verifies, and that changes to
+// the file behind the image's back show up as mismatches.
+func TestVerifyTranslation(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "verify.qcow2")
+
+	img, err := CreateSimple(path, 1<<30)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	defer img.Close()
+
+	cs := int64(img.ClusterSize())
+	if _, err := img.WriteAt(make([]byte, cs), cs); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	for _, off := range []uint64{0, uint64(cs), 3 * 1024 * 1024} {
+		report, err := img.VerifyTranslation(off)
+		if err != nil {
+			t.Fatalf("VerifyTranslation(%#x) failed: %v", off, err)
+		}
+		if !report.Consistent() {
+			t.Errorf("VerifyTranslation(%#x) mismatches: %v", off, report.Mismatches)
+		}
+	}
+	report, _ := img.VerifyTranslation(uint64(cs))
+	if !report.L2Cached || report.DiskL2Entry == nil {
+		t.Errorf("written cluster: L2Cached=%v, DiskL2Entry=%x", report.L2Cached, report.DiskL2Entry)
+	}
+
+	// Zero the L2 entry on disk; the cache still maps the cluster
+	l2Off := report.DiskL1Entry & L1EntryOffsetMask
+	if _, err := img.file.WriteAt(make([]byte, 8), int64(l2Off)+8); err != nil {
+		t.Fatalf("file WriteAt failed: %v", err)
+	}
+	report, err = img.VerifyTranslation(uint64(cs))
+	if !errors.Is(err, ErrTranslationMismatch) {
+		t.Fatalf("VerifyTranslation error = %v, want ErrTranslationMismatch", err)
+	}
+	if report == nil || len(report.Mismatches) != 1 {
+		t.Fatalf("report = %+v, want one mismatch", report)
+	}
+
+	// The neighbouring cluster's entry is untouched
+	if _, err := img.VerifyTranslation(0); err != nil {
+		t.Errorf("VerifyTranslation(0) failed: %v", err)
+	}
+
+	// A stale in-memory L1 entry
+	img.l1Mu.Lock()
+	binary.BigEndian.PutUint64(img.l1Table[8:], 0x123000)
+	img.l1Mu.Unlock()
+	if _, err := img.VerifyTranslation(1 << (img.clusterBits + img.l2Bits)); !errors.Is(err, ErrTranslationMismatch) {
+		t.Errorf("VerifyTranslation with stale L1 error = %v, want ErrTranslationMismatch", err)
+	}
+	img.l1Mu.Lock()
+	binary.BigEndian.PutUint64(img.l1Table[8:], 0)
+	img.l1Mu.Unlock()
+
+	if _, err := img.VerifyTranslation(uint64(img.Size())); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("VerifyTranslation past the end error = %v, want ErrOffsetOutOfRange", err)
+	}
+}
@@ -0,0 +1,57 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// VMStateLength returns the size of the VM state saved with the snapshot
+// (by savevm), preferring the 64-bit size in the extra data when present.
+// It is 0 for disk-only snapshots.
+func (s *Snapshot) VMStateLength() uint64 {
+	if len(s.ExtraData) >= 8 {
+		if large := binary.BigEndian.Uint64(s.ExtraData[0:8]); large != 0 {
+			return large
+		}
+	}
+	return uint64(s.VMStateSize)
+}
+
+// ReadVMState returns a reader over the VM state saved with snap, so that
+// migration and restore tooling can consume savevm state without qemu. It
+// fails with ErrNoVMState for disk-only snapshots.
+//
+// As in qemu, the state is stored in the snapshot's own clusters, starting
+// at the first L1 entry past the disk size the snapshot was taken at.
+// Reads are not synchronized with DeleteSnapshot; do not delete snap while
+// the reader is in use.
+func (img *Image) ReadVMState(snap *Snapshot) (*io.SectionReader, error) {
+	length := snap.VMStateLength()
+	if length == 0 {
+		return nil, ErrNoVMState
+	}
+	l1Table, err := img.snapshotL1Table(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	diskSize := uint64(img.Size())
+	if len(snap.ExtraData) >= 16 {
+		diskSize = binary.BigEndian.Uint64(snap.ExtraData[8:16])
+	}
+	l2Coverage := img.clusterSize * img.l2Entries
+	start := (diskSize + l2Coverage - 1) / l2Coverage * l2Coverage
+	r := vmStateReader{img: img, l1Table: l1Table, start: int64(start)}
+	return io.NewSectionReader(r, 0, int64(length)), nil
+}
+
+// vmStateReader reads the VM state region of a snapshot.
+type vmStateReader struct {
+	img     *Image
+	l1Table []byte
+	start   int64
+}
+
+func (r vmStateReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.img.readAtL1(p, r.start+off, r.l1Table, nil)
+}
@@ -0,0 +1,83 @@
+// vmstate_test.go - Snapshot VM state tests
+
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReadVMState lays out a snapshot the way savevm does, with the VM
+// state in the L1 entries past the disk, and reads the state back.
+func TestReadVMState(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "vmstate.qcow2")
+
+	// With 64KB clusters each L1 entry covers 512MB. Write the "VM state"
+	// at 512MB of a 1GB image, snapshot it, then record the snapshot as a
+	// 512MB disk with saved state
+	const diskSize = 512 << 20
+	img, err := CreateSimple(path, 2*diskSize)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	state := make([]byte, 100000)
+	for i := range state {
+		state[i] = byte(i * 7)
+	}
+	if _, err := img.WriteAt(state, diskSize); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	snap, err := img.CreateSnapshot("savevm")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if _, err := img.ReadVMState(snap); !errors.Is(err, ErrNoVMState) {
+		t.Errorf("ReadVMState of disk-only snapshot: got %v, want ErrNoVMState", err)
+	}
+	entryOff := int64(img.header.SnapshotsOffset)
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(state)))
+	if _, err := f.WriteAt(buf[:4], entryOff+32); err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint64(buf[:], diskSize)
+	if _, err := f.WriteAt(buf[:], entryOff+snapshotHeaderSize+8); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer img.Close()
+	snap = img.FindSnapshot("savevm")
+	if got := snap.VMStateLength(); got != uint64(len(state)) {
+		t.Fatalf("VMStateLength = %d, want %d", got, len(state))
+	}
+	r, err := img.ReadVMState(snap)
+	if err != nil {
+		t.Fatalf("ReadVMState failed: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading VM state failed: %v", err)
+	}
+	if !bytes.Equal(got, state) {
+		t.Errorf("VM state does not match what was saved")
+	}
+}
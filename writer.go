@@ -0,0 +1,66 @@
+package qcow2
+
+// writerActor runs an image's writes, flushes and Close one at a time on a
+// dedicated goroutine (see WithWriterGoroutine). Callers hand it a function
+// and wait for its result, so those calls never run concurrently with each
+// other.
+type writerActor struct {
+	reqs chan writerRequest
+	done chan struct{} // Closed when the goroutine exits
+}
+
+type writerRequest struct {
+	fn   func() error
+	errc chan error
+
+	// Stop the goroutine after fn, which closes the image
+	last bool
+}
+
+func newWriterActor() *writerActor {
+	a := &writerActor{
+		reqs: make(chan writerRequest),
+		done: make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *writerActor) run() {
+	defer close(a.done)
+	for req := range a.reqs {
+		req.errc <- req.fn()
+		if req.last {
+			return
+		}
+	}
+}
+
+// do runs fn on the writer goroutine and returns its error, or ErrClosed
+// once the goroutine has stopped.
+func (a *writerActor) do(fn func() error) error {
+	return a.submit(writerRequest{fn: fn, errc: make(chan error, 1)})
+}
+
+// stop runs fn like do and then stops the goroutine.
+func (a *writerActor) stop(fn func() error) error {
+	return a.submit(writerRequest{fn: fn, errc: make(chan error, 1), last: true})
+}
+
+func (a *writerActor) submit(req writerRequest) error {
+	select {
+	case a.reqs <- req:
+		return <-req.errc
+	case <-a.done:
+		return ErrClosed
+	}
+}
+
+// serialize runs fn on the writer goroutine if there is one, and directly
+// otherwise. fn must not call a method that serializes itself.
+func (img *Image) serialize(fn func() error) error {
+	if img.writer == nil {
+		return fn()
+	}
+	return img.writer.do(fn)
+}
@@ -0,0 +1,87 @@
+// writer_test.go - Writer goroutine mode tests
+
+package qcow2
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestWriterGoroutine verifies concurrent writers funneled through the
+// writer goroutine all land, and that the goroutine stops with Close.
+func TestWriterGoroutine(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "writer.qcow2")
+	img, err := CreateSimple(path, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("CreateSimple failed: %v", err)
+	}
+	img.Close()
+
+	img, err = Open(path, WithWriterGoroutine())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	cs := int64(img.ClusterSize())
+
+	const writers = 8
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := int64(0); i < 16; i++ {
+				off := (i*writers + int64(w)) * cs
+				if _, err := img.WriteAt(bytes.Repeat([]byte{byte(w + 1)}, int(cs)), off); err != nil {
+					t.Errorf("WriteAt failed: %v", err)
+					return
+				}
+				if i%4 == 3 {
+					if err := img.WriteZeroAt(off, cs); err != nil {
+						t.Errorf("WriteZeroAt failed: %v", err)
+						return
+					}
+				}
+			}
+			if err := img.Flush(); err != nil {
+				t.Errorf("Flush failed: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := img.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := img.WriteAt([]byte{1}, 0); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteAt after Close: got %v, want ErrClosed", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	img, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer img.Close()
+	got := make([]byte, cs)
+	for idx := int64(0); idx < 16*writers; idx++ {
+		if _, err := img.ReadAt(got, idx*cs); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		want := byte(idx%writers + 1)
+		if idx/writers%4 == 3 {
+			want = 0
+		}
+		if !bytes.Equal(got, bytes.Repeat([]byte{want}, int(cs))) {
+			t.Errorf("cluster %d: got %d, want %d", idx, got[0], want)
+		}
+	}
+	if result, err := img.Check(); err != nil || !result.IsClean() {
+		t.Errorf("Check = %+v, %v; want clean", result, err)
+	}
+}
@@ -0,0 +1,155 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// writeRun writes the start of p at off when it spans two or more
+// consecutive unallocated clusters of one L2 table. The clusters are
+// allocated as one contiguous run, the backing data of a partially covered
+// first or last cluster is read in a single ReadAt, and the data and the L2
+// entries each go out in one write with one barrier apiece, instead of a
+// round of allocation, copy-on-write and barriers per cluster.
+//
+// It returns the number of bytes written, which is 0 when the fast path does
+// not apply and the caller should fall back to per-cluster writes.
+func (img *Image) writeRun(p []byte, off int64) (int, error) {
+	clusterOff := uint64(off) & img.offsetMask
+	if clusterOff+uint64(len(p)) <= img.clusterSize {
+		return 0, nil
+	}
+	// Images whose data needs per-cluster handling take the slow path
+	if img.externalDataFile != nil || img.checksums != nil || img.extendedL2 {
+		return 0, nil
+	}
+	// Cheap check before taking the lock: most large writes land on
+	// allocated clusters
+	if info, err := img.translate(uint64(off)); err != nil || info.ctype != clusterUnallocated {
+		return 0, nil
+	}
+
+	img.writeMu.Lock()
+	defer img.writeMu.Unlock()
+
+	clusterStart := uint64(off) &^ img.offsetMask
+	l2Index := (clusterStart >> img.clusterBits) & (img.l2Entries - 1)
+	l1Index := clusterStart >> (img.clusterBits + img.l2Bits)
+
+	// Clusters touched by the write, within this L2 table
+	want := (clusterOff + uint64(len(p)) + img.offsetMask) >> img.clusterBits
+	if left := img.l2Entries - l2Index; want > left {
+		want = left
+	}
+
+	l2TableOff, err := img.getOrAllocateL2Table(l1Index)
+	if err != nil {
+		return 0, err
+	}
+	l2Table := img.getClusterBuffer()
+	defer img.putClusterBuffer(l2Table)
+	if err := img.readL2Table(l2TableOff, l2Table); err != nil {
+		return 0, err
+	}
+
+	var count uint64
+	for count < want && binary.BigEndian.Uint64(l2Table[(l2Index+count)*8:]) == 0 {
+		count++
+	}
+	if count < 2 {
+		return 0, nil
+	}
+
+	// The part of p that lands in the run
+	runLen := count * img.clusterSize
+	n := uint64(len(p))
+	if clusterOff+n > runLen {
+		n = runLen - clusterOff
+	}
+	headPartial := clusterOff != 0
+	tailPartial := (clusterOff+n)&img.offsetMask != 0
+
+	physStart, err := img.allocateClusterRun(count, AllocData)
+	if err != nil {
+		return 0, err
+	}
+
+	// Partially covered edge clusters are merged with the backing data; a
+	// fully covered run is written straight from p
+	data := p[:n]
+	if headPartial || tailPartial {
+		data = make([]byte, runLen)
+		if img.backing != nil {
+			if err := img.readRunEdges(data, clusterStart, headPartial, tailPartial); err != nil {
+				img.releaseClusters(physStart, count)
+				return 0, err
+			}
+		}
+		copy(data[clusterOff:], p[:n])
+	}
+	if _, err := img.file.WriteAt(data, int64(physStart)); err != nil {
+		img.releaseClusters(physStart, count)
+		return 0, fmt.Errorf("qcow2: failed to write cluster run: %w", err)
+	}
+
+	// Barrier: ensure data is on disk before L2 points to it
+	if err := img.dataBarrier(); err != nil {
+		img.releaseClusters(physStart, count)
+		return 0, fmt.Errorf("qcow2: data barrier failed: %w", err)
+	}
+
+	if err := img.setL2Run(l2TableOff, l2Table, l2Index, count, physStart); err != nil {
+		img.releaseClusters(physStart, count)
+		return 0, err
+	}
+
+	// Barrier: ensure L2 update is on disk
+	if err := img.metadataBarrier(); err != nil {
+		return 0, fmt.Errorf("qcow2: L2 update barrier failed: %w", err)
+	}
+
+	return int(n), nil
+}
+
+// setL2Run points count consecutive entries of an L2 table, starting at
+// l2Index, at the host clusters from physStart on, writes them in one go and
+// updates the cache. The caller issues the barrier.
+func (img *Image) setL2Run(l2TableOff uint64, l2Table []byte, l2Index, count, physStart uint64) error {
+	for i := uint64(0); i < count; i++ {
+		binary.BigEndian.PutUint64(l2Table[(l2Index+i)*8:], (physStart+i*img.clusterSize)|L2EntryCopied)
+	}
+	if _, err := img.file.WriteAt(l2Table[l2Index*8:(l2Index+count)*8], int64(l2TableOff+l2Index*8)); err != nil {
+		return err
+	}
+	img.l2Cache.put(l2TableOff, l2Table)
+	return nil
+}
+
+// readRunEdges fills the partially covered first and last clusters of a
+// run buffer from the backing file. Adjacent edges are read together.
+func (img *Image) readRunEdges(run []byte, virtStart uint64, head, tail bool) error {
+	read := func(buf []byte, off uint64) error {
+		if _, err := img.backing.ReadAt(buf, int64(off)); err != nil && err != io.EOF {
+			return fmt.Errorf("qcow2: COW read from backing failed: %w", err)
+		}
+		for i := uint64(0); i < uint64(len(buf)); i += img.clusterSize {
+			img.copiedOnWrite(off+i, true)
+		}
+		return nil
+	}
+
+	last := uint64(len(run)) - img.clusterSize
+	if head && tail && last == img.clusterSize {
+		return read(run, virtStart)
+	}
+	if head {
+		if err := read(run[:img.clusterSize], virtStart); err != nil {
+			return err
+		}
+	}
+	if tail {
+		return read(run[last:], virtStart+last)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package qcow2
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// DefaultZeroBufferSize is the size of the shared zero buffer unless
+// SetZeroBufferSize changes it.
+const DefaultZeroBufferSize = 64 * 1024
+
+// zeroBuf is a buffer of zeros shared by the whole package, never written.
+var zeroBuf atomic.Pointer[[]byte]
+
+// SetZeroBufferSize sets the size of the pre-zeroed buffer the package
+// compares data against to find zero clusters, when converting images,
+// streaming through a SparseWriter, scanning content and the like. Larger
+// buffers mean fewer, longer comparisons at the cost of the memory, which
+// is held for the life of the process; the default of 64KB covers a
+// default-sized cluster in one. size is rounded up to a multiple of 512,
+// and 0 or less restores the default.
+//
+// Reads of zero and unallocated clusters do not use the buffer: they clear
+// the caller's buffer in place, which is already as fast as memset.
+func SetZeroBufferSize(size int) {
+	if size <= 0 {
+		size = DefaultZeroBufferSize
+	}
+	buf := make([]byte, (size+511)&^511)
+	zeroBuf.Store(&buf)
+}
+
+// zeroBuffer returns the shared zero buffer. Callers must not write to it.
+func zeroBuffer() []byte {
+	if buf := zeroBuf.Load(); buf != nil {
+		return *buf
+	}
+	buf := make([]byte, DefaultZeroBufferSize)
+	zeroBuf.CompareAndSwap(nil, &buf)
+	return *zeroBuf.Load()
+}
+
+// isZeroBuffer reports whether every byte of buf is zero. It compares buf
+// with the shared zero buffer a chunk at a time, which runs as a vectorized
+// memcmp instead of a loop over single bytes.
+func isZeroBuffer(buf []byte) bool {
+	zero := zeroBuffer()
+	for len(buf) > 0 {
+		n := min(len(buf), len(zero))
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			return false
+		}
+		buf = buf[n:]
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+// zerobuf_test.go - Shared zero buffer tests
+
+package qcow2
+
+import "testing"
+
+// TestIsZeroBuffer checks zero detection across zero buffer chunks, with
+// buffers smaller and larger than the data.
+func TestIsZeroBuffer(t *testing.T) {
+	defer SetZeroBufferSize(0)
+	for _, size := range []int{1, 4096, 0} {
+		SetZeroBufferSize(size)
+		if n := len(zeroBuffer()); n%512 != 0 || n == 0 {
+			t.Fatalf("zero buffer size %d for %d", n, size)
+		}
+		for _, n := range []int{0, 1, 511, 4096, 4097, 3*DefaultZeroBufferSize + 7} {
+			buf := make([]byte, n)
+			if !isZeroBuffer(buf) {
+				t.Errorf("size %d: %d zeros not detected", size, n)
+			}
+			for _, pos := range []int{0, n / 2, n - 1} {
+				if n == 0 {
+					break
+				}
+				buf[pos] = 1
+				if isZeroBuffer(buf) {
+					t.Errorf("size %d: byte %d of %d set but detected as zeros", size, pos, n)
+				}
+				buf[pos] = 0
+			}
+		}
+	}
+}